@@ -6,15 +6,22 @@ rm -f termite/version.gen.go
 
 for target in "clean" "install"
 do
-  for d in stats attr cba fs termite \
-      bin/coordinator \
+  for d in stats attr cba fs termite cli \
+      bin/termite bin/coordinator \
       bin/worker bin/master bin/shell-wrapper ; \
   do
     (cd $d && go $target . )
   done
 done
 
-for d in stats attr cba termite
+# Compatibility names for the termite binary.
+bindir=$(go env GOPATH | cut -d: -f1)/bin
+for n in coordinator worker master shell-wrapper
+do
+  ln -sf termite $bindir/termite-$n
+done
+
+for d in stats attr cba termite cli
 do
   (cd $d && go test . )
 done
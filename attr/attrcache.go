@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 )
@@ -23,10 +24,52 @@ type AttributeCache struct {
 
 	clients       map[string]*attrCachePending
 	nextFileSetId int
+	stats         AttributeCacheStats
+
+	// Lookups run under a read lock, so their counts have a lock
+	// of their own.
+	hitMutex     sync.Mutex
+	hits         int
+	negativeHits int
+
+	// Paths for which the getter returned no file, with the time
+	// their entry expires.
+	negative map[string]time.Time
+
+	// Counts updates, so a getter that raced with one does not
+	// leave a stale negative entry.
+	updates uint64
+
+	// Last generation given to a directory.
+	generation uint64
+
+	// Cached pages of paged directories, by path.
+	pages map[string]*dirPages
+
+	// Sorted listings of directories, for serving pages.
+	listingMutex sync.Mutex
+	listings     map[string]*dirListing
+
+	// Symlink targets read separately, by path.
+	links map[string]string
 
 	Paranoia bool
+
+	// If positive, names that the getter reported as missing are
+	// reported missing for this long without asking the getter
+	// again, unless an Update creates them.
+	NegativeTTL time.Duration
+
+	// If positive, directories with more entries are sent to
+	// clients without their listing, which clients then read in
+	// pages.
+	PageThreshold int
 }
 
+// Expired negative entries are dropped when the number of entries
+// reaches a multiple of this.
+const _NEGATIVE_SWEEP = 1024
+
 type attrCachePending struct {
 	client    AttributeCacheClient
 	pending   []*FileAttr
@@ -89,7 +132,10 @@ func (me *AttributeCache) Send(client AttributeCacheClient) error {
 	if len(c.pending) == 0 || needSync <= c.sentId {
 		return nil
 	}
-	p := c.pending
+	p := coalesceFiles(c.pending)
+	for i, f := range p {
+		p[i] = me.pageDir(f)
+	}
 	c.pending = nil
 	c.busy = true
 	me.mutex.Unlock()
@@ -113,6 +159,32 @@ func (me *AttributeCache) Queue(fs FileSet) {
 	}
 }
 
+// coalesceFiles returns the files with a single entry per path.  The
+// entry takes the place of the first one for the path, so parent
+// directories still precede their children, and holds the result of
+// applying all entries for the path in order.
+func coalesceFiles(files []*FileAttr) []*FileAttr {
+	idx := make(map[string]int, len(files))
+	out := make([]*FileAttr, 0, len(files))
+	for _, f := range files {
+		i, ok := idx[f.Path]
+		if !ok {
+			idx[f.Path] = len(out)
+			out = append(out, f)
+			continue
+		}
+		prev := out[i]
+		if prev.Deletion() || f.Deletion() {
+			out[i] = f
+			continue
+		}
+		merged := prev.Copy(true)
+		merged.Merge(*f)
+		out[i] = merged
+	}
+	return out
+}
+
 // NewAttributeCache creates a new AttrCache. Its arguments are a
 // function to fetch attributes remotely (for individual attributes), and
 // a stat function (for bulk refreshing data).
@@ -121,6 +193,10 @@ func NewAttributeCache(getter func(n string) *FileAttr,
 	me := &AttributeCache{
 		attributes: make(map[string]*FileAttr),
 		busy:       map[string]bool{},
+		negative:   map[string]time.Time{},
+		pages:      map[string]*dirPages{},
+		listings:   map[string]*dirListing{},
+		links:      map[string]string{},
 	}
 	me.nextFileSetId = 1
 	me.cond = sync.NewCond(&me.mutex)
@@ -156,7 +232,7 @@ func (me *AttributeCache) verify() {
 		if v.Deletion() {
 			log.Panicf("Attribute cache may not contain deletions %q", k)
 		}
-		if v.IsDir() && v.NameModeMap == nil {
+		if v.IsDir() && v.NameModeMap == nil && !v.Paged() {
 			log.Panicf("dir has no NameModeMap %q", k)
 		}
 		for childName, mode := range v.NameModeMap {
@@ -176,7 +252,7 @@ func (me *AttributeCache) verify() {
 			if !v.Deletion() && parent == nil {
 				log.Panicf("Missing parent for %q", k)
 			}
-			if !v.Deletion() && parent.NameModeMap[base] == 0 {
+			if !v.Deletion() && !parent.Paged() && parent.NameModeMap[base] == 0 {
 				log.Panicf("Parent %q has no entry for %q", dir, base)
 			}
 		}
@@ -190,6 +266,17 @@ func (me *AttributeCache) Have(name string) bool {
 	return ok
 }
 
+// Cached returns the cached attributes of name, or nil.  It does not
+// call the getter.
+func (me *AttributeCache) Cached(name string) *FileAttr {
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+	if a := me.attributes[name]; a != nil {
+		return a.Copy(false)
+	}
+	return nil
+}
+
 func (me *AttributeCache) Get(name string) (rep *FileAttr) {
 	return me.get(name, false)
 }
@@ -221,6 +308,7 @@ func (me *AttributeCache) get(name string, withdir bool) (rep *FileAttr) {
 	rep = me.localGet(name, withdir)
 
 	if rep != nil {
+		me.countHit(rep.Deletion())
 		return rep
 	}
 
@@ -233,7 +321,8 @@ func (me *AttributeCache) unsafeGet(name string, withdir bool) (rep *FileAttr) {
 	if name != "" {
 		dir, base := SplitPath(name)
 		dirAttr := me.unsafeGet(dir, true)
-		if dirAttr.Deletion() || !dirAttr.IsDir() || dirAttr.NameModeMap[base] == 0 {
+		if dirAttr.Deletion() || !dirAttr.IsDir() || (!dirAttr.Paged() && dirAttr.NameModeMap[base] == 0) {
+			me.countHit(true)
 			return &FileAttr{Path: name}
 		}
 	}
@@ -243,22 +332,39 @@ func (me *AttributeCache) unsafeGet(name string, withdir bool) (rep *FileAttr) {
 	}
 	rep, ok := me.attributes[name]
 	if ok {
+		me.countHit(false)
 		return rep
 	}
+	if expiry, ok := me.negative[name]; ok {
+		if time.Now().Before(expiry) {
+			me.countHit(true)
+			return &FileAttr{Path: name}
+		}
+		delete(me.negative, name)
+	}
 	me.busy[name] = true
+	updates := me.updates
 	me.mutex.Unlock()
 
 	rep = me.getter(name)
 
 	me.mutex.Lock()
+	me.stats.Fetches++
 	if rep == nil {
 		// This is an error, but what can we do?
+		delete(me.busy, name)
+		me.cond.Broadcast()
 		return &FileAttr{Path: name}
 	}
 	rep.Path = name
 
 	if !rep.Deletion() {
+		if rep.NameModeMap != nil {
+			me.bumpGeneration(rep)
+		}
 		me.attributes[name] = rep
+	} else if me.NegativeTTL > 0 && me.updates == updates {
+		me.addNegative(name)
 	}
 	me.cond.Broadcast()
 	delete(me.busy, name)
@@ -272,6 +378,65 @@ func (me *AttributeCache) unsafeGet(name string, withdir bool) (rep *FileAttr) {
 	return c
 }
 
+// addNegative records that name is missing.  Must hold mutex.
+func (me *AttributeCache) addNegative(name string) {
+	now := time.Now()
+	me.negative[name] = now.Add(me.NegativeTTL)
+	if len(me.negative)%_NEGATIVE_SWEEP != 0 {
+		return
+	}
+	for n, expiry := range me.negative {
+		if !now.Before(expiry) {
+			delete(me.negative, n)
+		}
+	}
+}
+
+// CachedChildren returns the cached attributes of up to max files and
+// symlinks in directory dir.  It does not call the getter.
+func (me *AttributeCache) CachedChildren(dir string, max int) []*FileAttr {
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+	d := me.attributes[dir]
+	if d == nil {
+		return nil
+	}
+	var result []*FileAttr
+	for n, mode := range d.NameModeMap {
+		if len(result) >= max {
+			break
+		}
+		if mode.IsDir() {
+			continue
+		}
+		if a := me.attributes[filepath.Join(dir, n)]; a != nil {
+			result = append(result, a.Copy(false))
+		}
+	}
+	return result
+}
+
+// Prime adds attributes of files that the cache does not have yet,
+// but that their cached directory lists.  Attributes already in the
+// cache may be newer, so they are left alone.
+func (me *AttributeCache) Prime(files []*FileAttr) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	var add []*FileAttr
+	for _, f := range files {
+		if f.Deletion() || f.IsDir() || me.attributes[f.Path] != nil {
+			continue
+		}
+		dir, base := SplitPath(f.Path)
+		d := me.attributes[dir]
+		if d == nil || d.NameModeMap[base] != fuse.FileMode(f.Mode&^07777) {
+			continue
+		}
+		add = append(add, f)
+	}
+	me.update(add)
+}
+
 func (me *AttributeCache) Update(files []*FileAttr) {
 	me.mutex.Lock()
 	defer me.mutex.Unlock()
@@ -280,6 +445,7 @@ func (me *AttributeCache) Update(files []*FileAttr) {
 
 func (me *AttributeCache) update(files []*FileAttr) {
 	defer me.verify()
+	me.updates++
 	attributes := me.attributes
 	for _, inF := range files {
 		r := *inF
@@ -294,23 +460,33 @@ func (me *AttributeCache) update(files []*FileAttr) {
 				log.Println("Discarding update: ", r)
 				continue
 			}
-			if dirAttr.NameModeMap == nil {
+			me.dropListing(dir)
+			if dirAttr.Paged() {
+				// The next listing reads new pages.
+				delete(me.pages, dir)
+			} else if dirAttr.NameModeMap == nil {
 				log.Panicf("parent dir has no NameModeMap: %q", dir)
-			}
-			if r.Deletion() {
-				delete(dirAttr.NameModeMap, basename)
 			} else {
-				dirAttr.NameModeMap[basename] = fuse.FileMode(r.Mode &^ 07777)
+				if r.Deletion() {
+					delete(dirAttr.NameModeMap, basename)
+				} else {
+					dirAttr.NameModeMap[basename] = fuse.FileMode(r.Mode &^ 07777)
+				}
+				me.bumpGeneration(dirAttr)
 			}
 		}
 
+		delete(me.pages, r.Path)
+		me.dropListing(r.Path)
+		delete(me.links, r.Path)
 		if r.Deletion() {
 			delete(attributes, r.Path)
 			continue
 		}
+		delete(me.negative, r.Path)
 
 		old := attributes[r.Path]
-		if old == nil && r.IsDir() && r.NameModeMap == nil {
+		if old == nil && r.IsDir() && r.NameModeMap == nil && !r.Paged() {
 			// This is a metadata update only. If it does
 			// not come with contents, we can't use it to
 			// short-cut deletion queries.
@@ -318,10 +494,14 @@ func (me *AttributeCache) update(files []*FileAttr) {
 		}
 
 		if old == nil {
-			attributes[r.Path] = &r
+			old = &r
+			attributes[r.Path] = old
 		} else {
 			old.Merge(r)
 		}
+		if r.NameModeMap != nil {
+			me.bumpGeneration(old)
+		}
 		delete(me.busy, r.Path)
 	}
 	me.cond.Broadcast()
@@ -380,6 +560,9 @@ func (me *AttributeCache) Refresh(prefix string) FileSet {
 
 	files := []*FileAttr{}
 	for t := range updated {
+		if !t.Deletion() {
+			me.stats.Fetches++
+		}
 		files = append(files, t)
 	}
 	fs := FileSet{Files: files}
@@ -197,6 +197,61 @@ func TestAttrCacheClientBasic(t *testing.T) {
 	}
 }
 
+func TestAttrCacheClientCoalesce(t *testing.T) {
+	ac, _, clean := attrCacheTestCase(t)
+	defer clean()
+
+	cl := testClient{
+		id: "testid",
+	}
+	ac.AddClient(&cl)
+	check(ac.Send(&cl))
+	cl.attrs = nil
+
+	dir := FileAttr{
+		Path:        "d",
+		Attr:        &fuse.Attr{Mode: syscall.S_IFDIR | 0755},
+		NameModeMap: map[string]fuse.FileMode{"f": syscall.S_IFREG},
+	}
+	dirChmod := FileAttr{
+		Path: "d",
+		Attr: &fuse.Attr{Mode: syscall.S_IFDIR | 0700},
+	}
+	v1 := FileAttr{
+		Path: "d/f",
+		Attr: &fuse.Attr{Mode: syscall.S_IFREG | 0644, Size: 1},
+	}
+	v2 := FileAttr{
+		Path: "d/f",
+		Attr: &fuse.Attr{Mode: syscall.S_IFREG | 0644, Size: 2},
+	}
+	gone := FileAttr{
+		Path: "g",
+		Attr: &fuse.Attr{Mode: syscall.S_IFREG | 0644},
+	}
+	goneDel := FileAttr{Path: "g"}
+	ac.Queue(FileSet{Files: []*FileAttr{&dir, &v1, &gone}})
+	ac.Queue(FileSet{Files: []*FileAttr{&v2, &dirChmod, &goneDel}})
+	check(ac.Send(&cl))
+
+	if len(cl.attrs) != 3 {
+		t.Fatalf("got %d entries, want 3: %v", len(cl.attrs), cl.attrs)
+	}
+	d := cl.attrs[0]
+	if d.Path != "d" || d.Mode&07777 != 0700 || d.NameModeMap["f"] == 0 {
+		t.Errorf("directory not merged: %v", d)
+	}
+	if f := cl.attrs[1]; f.Path != "d/f" || f.Size != 2 {
+		t.Errorf("got %v, want newest d/f", f)
+	}
+	if g := cl.attrs[2]; g.Path != "g" || !g.Deletion() {
+		t.Errorf("got %v, want deletion of g", g)
+	}
+	if dir.Mode&07777 != 0755 || dirChmod.NameModeMap != nil {
+		t.Errorf("queued entries were modified")
+	}
+}
+
 func TestAttrCacheClientExtra(t *testing.T) {
 	ac, dir, clean := attrCacheTestCase(t)
 	defer clean()
@@ -327,3 +382,384 @@ func TestAttrCacheIncompleteDir(t *testing.T) {
 		t.Errorf("Client should ignore timestamp update to unknown directory: %v", g)
 	}
 }
+
+func TestAttrCacheSaveLoad(t *testing.T) {
+	ac, dir, clean := attrCacheTestCase(t)
+	defer clean()
+
+	os.Mkdir(dir+"/sub", 0755)
+	ioutil.WriteFile(dir+"/sub/same", []byte("same"), 0644)
+	ioutil.WriteFile(dir+"/sub/changed", []byte("before"), 0644)
+	os.Mkdir(dir+"/gone", 0755)
+	ioutil.WriteFile(dir+"/gone/file", []byte("gone"), 0644)
+	for _, n := range []string{"sub/same", "sub/changed", "gone/file"} {
+		if a := ac.Get(n); a.Deletion() {
+			t.Fatalf("Get(%q) returned deletion", n)
+		}
+	}
+
+	snapshotDir, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(snapshotDir)
+	snapshot := snapshotDir + "/snapshot"
+	if err := ac.Save(snapshot); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	ioutil.WriteFile(dir+"/sub/changed", []byte("after, longer"), 0644)
+	os.Remove(dir + "/gone/file")
+
+	restarted := NewAttributeCache(ac.getter, ac.statter)
+	if err := restarted.Load(snapshot, nil); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	restarted.Paranoia = true
+	restarted.Verify()
+
+	// The root, sub and sub/same.
+	if stats := restarted.Stats(); stats.Loaded != 3 || stats.Stale != 3 {
+		t.Errorf("got %+v, want 3 loaded and 3 stale entries", stats)
+	}
+	if a := restarted.Get("sub/same"); a.Deletion() || a.Hash == "" {
+		t.Errorf("sub/same: got %v", a)
+	}
+	if got := restarted.Stats().Fetches; got != 0 {
+		t.Errorf("unchanged file was fetched %d times", got)
+	}
+
+	if a := restarted.Get("sub/changed"); a.Deletion() || a.Size != uint64(len("after, longer")) {
+		t.Errorf("sub/changed: got %v", a)
+	}
+	if a := restarted.Get("gone/file"); !a.Deletion() {
+		t.Errorf("gone/file: got %v", a)
+	}
+	if got := restarted.Stats().Fetches; got == 0 {
+		t.Errorf("changed files were not fetched")
+	}
+
+	if err := restarted.Load(snapshotDir+"/nonexistent", nil); err == nil {
+		t.Errorf("Load of missing file should fail")
+	}
+}
+
+func TestAttrCacheNegativeTTL(t *testing.T) {
+	fetches := map[string]int{}
+	ac := NewAttributeCache(
+		func(n string) *FileAttr {
+			fetches[n]++
+			switch n {
+			case "":
+				// The directory lists the files, but they
+				// disappeared before we asked for them.
+				return &FileAttr{
+					Attr: &fuse.Attr{Mode: fuse.S_IFDIR | 0755},
+					NameModeMap: map[string]fuse.FileMode{
+						"gone": fuse.S_IFREG, "late": fuse.S_IFREG, "error": fuse.S_IFREG,
+					},
+				}
+			case "error":
+				return nil
+			}
+			return &FileAttr{}
+		}, nil)
+
+	for i := 0; i < 2; i++ {
+		if a := ac.Get("gone"); !a.Deletion() {
+			t.Fatalf("got %v, want deletion", a)
+		}
+	}
+	if fetches["gone"] != 2 {
+		t.Errorf("without TTL: got %d fetches, want 2", fetches["gone"])
+	}
+
+	ac.NegativeTTL = time.Nanosecond
+	ac.Get("late")
+	time.Sleep(time.Millisecond)
+	ac.Get("late")
+	if fetches["late"] != 2 {
+		t.Errorf("expired: got %d fetches, want 2", fetches["late"])
+	}
+
+	ac.NegativeTTL = time.Hour
+	fetches["gone"] = 0
+	for i := 0; i < 3; i++ {
+		ac.Get("gone")
+	}
+	if fetches["gone"] != 1 {
+		t.Errorf("with TTL: got %d fetches, want 1", fetches["gone"])
+	}
+
+	// Errors are not cached, and do not block later lookups.
+	ac.Get("error")
+	ac.Get("error")
+	if fetches["error"] != 2 {
+		t.Errorf("error: got %d fetches, want 2", fetches["error"])
+	}
+
+	ac.Update([]*FileAttr{{Path: "gone", Attr: &fuse.Attr{Mode: fuse.S_IFREG | 0644, Size: 3}}})
+	if a := ac.Get("gone"); a.Deletion() || a.Size != 3 {
+		t.Errorf("after creation: got %v", a)
+	}
+	if fetches["gone"] != 1 {
+		t.Errorf("after creation: got %d fetches, want 1", fetches["gone"])
+	}
+}
+
+func TestAttrCacheNegativeRace(t *testing.T) {
+	var ac *AttributeCache
+	created := false
+	ac = NewAttributeCache(
+		func(n string) *FileAttr {
+			switch {
+			case n == "":
+				return &FileAttr{
+					Attr:        &fuse.Attr{Mode: fuse.S_IFDIR | 0755},
+					NameModeMap: map[string]fuse.FileMode{"dir": fuse.S_IFDIR},
+				}
+			case !created:
+				// The directory is created while we look
+				// for it.
+				created = true
+				ac.Update([]*FileAttr{{Path: n, Attr: &fuse.Attr{Mode: fuse.S_IFDIR | 0755}}})
+				return &FileAttr{}
+			}
+			return &FileAttr{
+				Attr:        &fuse.Attr{Mode: fuse.S_IFDIR | 0755},
+				NameModeMap: map[string]fuse.FileMode{},
+			}
+		}, nil)
+	ac.NegativeTTL = time.Hour
+
+	if a := ac.Get("dir"); !a.Deletion() {
+		t.Fatalf("got %v, want deletion", a)
+	}
+	if a := ac.Get("dir"); a.Deletion() {
+		t.Errorf("stale negative entry after creation")
+	}
+}
+
+func TestAttrCachePrime(t *testing.T) {
+	fetches := 0
+	ac := NewAttributeCache(
+		func(n string) *FileAttr {
+			fetches++
+			if n == "" {
+				return &FileAttr{
+					Attr: &fuse.Attr{Mode: fuse.S_IFDIR | 0755},
+					NameModeMap: map[string]fuse.FileMode{
+						"a": fuse.S_IFREG, "b": fuse.S_IFREG,
+					},
+				}
+			}
+			return &FileAttr{Attr: &fuse.Attr{Mode: fuse.S_IFREG | 0644, Size: 1}}
+		}, nil)
+	ac.Get("a")
+
+	ac.Prime([]*FileAttr{
+		{Path: "a", Attr: &fuse.Attr{Mode: fuse.S_IFREG | 0644, Size: 99}},
+		{Path: "b", Attr: &fuse.Attr{Mode: fuse.S_IFREG | 0644, Size: 2}},
+		// Not listed in the directory; maybe deleted since.
+		{Path: "c", Attr: &fuse.Attr{Mode: fuse.S_IFREG | 0644, Size: 3}},
+	})
+	if a := ac.Get("a"); a.Size != 1 {
+		t.Errorf("Prime overwrote a: got %v", a)
+	}
+	if b := ac.Get("b"); b.Deletion() || b.Size != 2 {
+		t.Errorf("Prime did not add b: got %v", b)
+	}
+	if c := ac.Get("c"); !c.Deletion() {
+		t.Errorf("Prime added unlisted c: got %v", c)
+	}
+	if fetches != 2 {
+		t.Errorf("got %d fetches, want 2", fetches)
+	}
+	if s := ac.Stats(); s.Hits != 2 || s.NegativeHits != 1 {
+		t.Errorf("got stats %+v", s)
+	}
+}
+
+func TestAttrCachePages(t *testing.T) {
+	ac := NewAttributeCache(
+		func(n string) *FileAttr {
+			if n == "" {
+				return &FileAttr{
+					Attr: &fuse.Attr{Mode: fuse.S_IFDIR | 0755},
+					NameModeMap: map[string]fuse.FileMode{
+						"c": fuse.S_IFREG, "a": fuse.S_IFREG, "b": fuse.S_IFDIR,
+					},
+				}
+			}
+			return &FileAttr{Attr: &fuse.Attr{Mode: fuse.S_IFREG | 0644}}
+		}, nil)
+	ac.PageThreshold = 2
+	server := NewServer(ac)
+
+	rep := AttrResponse{}
+	check(server.GetAttr(&AttrRequest{Name: ""}, &rep))
+	dir := rep.Attrs[0]
+	if !dir.Paged() || dir.PagedEntries != 3 || dir.NameModeMap != nil {
+		t.Fatalf("directory was not paged: %v", dir)
+	}
+	if a := ac.GetDir(""); len(a.NameModeMap) != 3 {
+		t.Errorf("paging changed the cache: %v", a)
+	}
+
+	var names []string
+	for offset := 0; ; offset += 2 {
+		page := DirPageResponse{}
+		check(server.ReadDirPage(&DirPageRequest{Generation: dir.Generation, Offset: offset, Limit: 2}, &page))
+		if page.Generation != dir.Generation {
+			t.Fatalf("got generation %d, want %d", page.Generation, dir.Generation)
+		}
+		for _, e := range page.Entries {
+			names = append(names, e.Name)
+		}
+		if len(page.Entries) < 2 {
+			break
+		}
+	}
+	if got := strings.Join(names, ","); got != "a,b,c" {
+		t.Errorf("got listing %q, want a,b,c", got)
+	}
+
+	ac.Update([]*FileAttr{{Path: "d", Attr: &fuse.Attr{Mode: fuse.S_IFREG | 0644}}})
+	if l := ac.listings[""]; l != nil {
+		t.Errorf("listing of generation %d kept after update", l.generation)
+	}
+	page := DirPageResponse{}
+	check(server.ReadDirPage(&DirPageRequest{Generation: dir.Generation, Offset: 2, Limit: 2}, &page))
+	if page.Generation == dir.Generation || len(page.Entries) != 0 {
+		t.Errorf("stale generation: got %+v", page)
+	}
+	check(server.ReadDirPage(&DirPageRequest{Generation: page.Generation, Offset: 2, Limit: 2}, &page))
+	if len(page.Entries) != 2 || page.Entries[1].Name != "d" {
+		t.Errorf("after update: got %+v", page)
+	}
+
+	// Clients only cache pages of the generation they have.
+	client := NewAttributeCache(nil, nil)
+	client.Update([]*FileAttr{{Path: "", Attr: dir.Attr, PagedEntries: 3, Generation: dir.Generation}})
+	client.AddPage("", page.Generation, 0, page.Entries)
+	if _, _, ok := client.Page("", 0); ok {
+		t.Errorf("page of a newer generation cached")
+	}
+	client.AddPage("", dir.Generation, 0, page.Entries)
+	if _, g, ok := client.Page("", 0); !ok || g != dir.Generation {
+		t.Errorf("page of the current generation not cached")
+	}
+}
+
+func TestAttrCacheExpandDir(t *testing.T) {
+	root := map[string]fuse.FileMode{"sub": fuse.S_IFDIR}
+	for i := 0; i < _EXPAND_CHUNK+10; i++ {
+		root[fmt.Sprintf("f%d", i)] = fuse.S_IFREG
+	}
+	fetched := 0
+	ac := NewAttributeCache(
+		func(n string) *FileAttr {
+			switch n {
+			case "":
+				return &FileAttr{
+					Attr:        &fuse.Attr{Mode: fuse.S_IFDIR | 0755},
+					NameModeMap: root,
+				}
+			case "sub":
+				return &FileAttr{
+					Attr:        &fuse.Attr{Mode: fuse.S_IFDIR | 0755},
+					NameModeMap: map[string]fuse.FileMode{},
+				}
+			}
+			fetched++
+			return &FileAttr{Attr: &fuse.Attr{Mode: fuse.S_IFREG | 0644}}
+		}, nil)
+	server := NewServer(ac)
+
+	// Files the cache does not have yet are left out, rather than
+	// fetched.
+	rep := AttrResponse{}
+	check(server.GetAttr(&AttrRequest{ExpandDir: true}, &rep))
+	if len(rep.Attrs) != 0 || fetched != 0 {
+		t.Errorf("uncached: got %d attributes, %d fetched", len(rep.Attrs), fetched)
+	}
+	for n := range root {
+		ac.Get(n)
+	}
+
+	var files []*FileAttr
+	req := AttrRequest{ExpandDir: true}
+	for {
+		rep := AttrResponse{}
+		check(server.GetAttr(&req, &rep))
+		files = append(files, rep.Attrs...)
+		if rep.NextOffset == 0 {
+			break
+		}
+		if len(rep.Attrs) > _EXPAND_CHUNK {
+			t.Fatalf("chunk has %d entries", len(rep.Attrs))
+		}
+		req.Offset = rep.NextOffset
+	}
+	if len(files) != _EXPAND_CHUNK+10 {
+		t.Errorf("got %d files, want %d", len(files), _EXPAND_CHUNK+10)
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			t.Errorf("directory %v expanded", f)
+		}
+	}
+}
+
+func TestAttrCacheLinks(t *testing.T) {
+	target := ""
+	ac := NewAttributeCache(
+		func(n string) *FileAttr {
+			switch n {
+			case "":
+				return &FileAttr{
+					Attr: &fuse.Attr{Mode: fuse.S_IFDIR | 0755},
+					NameModeMap: map[string]fuse.FileMode{
+						"l": fuse.S_IFLNK, "f": fuse.S_IFREG,
+					},
+				}
+			case "l":
+				return &FileAttr{Attr: &fuse.Attr{Mode: fuse.S_IFLNK | 0777}, Link: target}
+			}
+			return &FileAttr{Attr: &fuse.Attr{Mode: fuse.S_IFREG | 0644}}
+		}, nil)
+	server := NewServer(ac)
+
+	// The first stat does not read the target.
+	if a := ac.Get("l"); !a.IsSymlink() || a.Link != "" {
+		t.Fatalf("got %v, want bare symlink", a)
+	}
+	target = "t1"
+	rep := ReadlinkResponse{}
+	check(server.Readlink(&AttrRequest{Name: "l"}, &rep))
+	if rep.Link != "t1" {
+		t.Errorf("got %q, want t1", rep.Link)
+	}
+	if l, ok := ac.Link("l"); !ok || l != "t1" {
+		t.Errorf("target not cached: %q, %v", l, ok)
+	}
+
+	// An update drops the cached target.
+	ac.Update([]*FileAttr{{Path: "l", Attr: &fuse.Attr{Mode: fuse.S_IFLNK | 0777, Mtime: 1}}})
+	if _, ok := ac.Link("l"); ok {
+		t.Errorf("target survived update")
+	}
+	target = "t2"
+	check(server.Readlink(&AttrRequest{Name: "l"}, &rep))
+	if rep.Link != "t2" {
+		t.Errorf("after update: got %q, want t2", rep.Link)
+	}
+
+	// Targets read before an update are not cached.
+	ac.Update([]*FileAttr{{Path: "l", Attr: &fuse.Attr{Mode: fuse.S_IFLNK | 0777, Mtime: 2}}})
+	ac.AddLink(&FileAttr{Path: "l", Attr: &fuse.Attr{Mode: fuse.S_IFLNK | 0777, Mtime: 1}}, "t2")
+	if _, ok := ac.Link("l"); ok {
+		t.Errorf("stale target was cached")
+	}
+
+	if err := server.Readlink(&AttrRequest{Name: "f"}, &rep); err == nil {
+		t.Errorf("Readlink on a regular file succeeded")
+	}
+}
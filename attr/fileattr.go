@@ -21,6 +21,15 @@ type FileAttr struct {
 
 	// Only filled for directories.
 	NameModeMap map[string]fuse.FileMode
+
+	// For directories too large to send whole, the number of
+	// entries.  NameModeMap is then nil, and clients read the
+	// listing with Server.ReadDirPage.
+	PagedEntries int
+
+	// Changes whenever the listing of the directory changes, so
+	// pages of different versions are not mixed.
+	Generation uint64
 }
 
 func (me FileAttr) String() string {
@@ -37,6 +46,9 @@ func (me FileAttr) String() string {
 		if me.NameModeMap != nil {
 			id += "+names"
 		}
+		if me.Paged() {
+			id += fmt.Sprintf("+%d paged", me.PagedEntries)
+		}
 	} else {
 		id += " (del)"
 	}
@@ -55,6 +67,11 @@ func (me FileAttr) Deletion() bool {
 	return me.Attr == nil
 }
 
+// Paged returns true for a directory whose listing is read in pages.
+func (me FileAttr) Paged() bool {
+	return me.PagedEntries > 0
+}
+
 func (me FileAttr) Status() fuse.Status {
 	if me.Deletion() {
 		return fuse.ENOENT
@@ -226,6 +243,7 @@ func (me *FileAttr) Merge(r FileAttr) {
 
 	other := r.NameModeMap
 	mine := me.NameModeMap
+	paged, generation := me.PagedEntries, me.Generation
 	*me = r
 	me.NameModeMap = nil
 
@@ -235,8 +253,10 @@ func (me *FileAttr) Merge(r FileAttr) {
 			for k, v := range other {
 				me.NameModeMap[k] = v
 			}
-		} else {
+		} else if !r.Paged() {
+			// Metadata only; keep the listing we have.
 			me.NameModeMap = mine
+			me.PagedEntries, me.Generation = paged, generation
 		}
 	}
 }
@@ -3,6 +3,7 @@ package attr
 import (
 	"fmt"
 	"sort"
+	"strings"
 )
 
 type FileSet struct {
@@ -37,3 +38,50 @@ func (me *FileSet) Swap(i, j int) {
 func (me *FileSet) Sort() {
 	sort.Sort(me)
 }
+
+// MaxNameLength is NAME_MAX for common Linux file systems.
+const MaxNameLength = 255
+
+// PathTooLongError is returned for paths that will not fit in a
+// mirror.
+type PathTooLongError struct {
+	Path string
+
+	// Component is set if a single path component is too long.
+	Component string
+
+	Limit int
+}
+
+func (e *PathTooLongError) Error() string {
+	if e.Component != "" {
+		return fmt.Sprintf("path %q: component %q is %d bytes, limit %d",
+			e.Path, e.Component, len(e.Component), e.Limit)
+	}
+	return fmt.Sprintf("path %q is %d bytes, limit %d", e.Path, len(e.Path), e.Limit)
+}
+
+// CheckPathLength verifies that path is at most maxPath bytes long,
+// and that none of its components exceed MaxNameLength.
+func CheckPathLength(path string, maxPath int) error {
+	if len(path) > maxPath {
+		return &PathTooLongError{Path: path, Limit: maxPath}
+	}
+	for _, c := range strings.Split(path, "/") {
+		if len(c) > MaxNameLength {
+			return &PathTooLongError{Path: path, Component: c, Limit: MaxNameLength}
+		}
+	}
+	return nil
+}
+
+// CheckPathLengths runs CheckPathLength on all files in the set, and
+// returns the first failure.
+func (me *FileSet) CheckPathLengths(maxPath int) error {
+	for _, f := range me.Files {
+		if err := CheckPathLength(f.Path, maxPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package attr
 
 import (
+	"strings"
 	"syscall"
 	"testing"
 
@@ -25,3 +26,27 @@ func TestFileSet(t *testing.T) {
 		t.Fatalf("incorrect sort order: %v", fs)
 	}
 }
+
+func TestFileSetCheckPathLengths(t *testing.T) {
+	limit := 600
+	dir := strings.Repeat("d", 200) + "/" + strings.Repeat("e", 200) + "/"
+	under := dir + strings.Repeat("f", limit-len(dir))
+	over := under + "g"
+
+	fset := FileSet{[]*FileAttr{{Path: "a"}, {Path: under}}}
+	if err := fset.CheckPathLengths(limit); err != nil {
+		t.Errorf("CheckPathLengths(%d) for %d byte path: %v", limit, len(under), err)
+	}
+
+	fset.Files = append(fset.Files, &FileAttr{Path: over})
+	err := fset.CheckPathLengths(limit)
+	if e, ok := err.(*PathTooLongError); !ok || e.Path != over {
+		t.Errorf("CheckPathLengths(%d) for %d byte path: got %v", limit, len(over), err)
+	}
+
+	long := "a/" + strings.Repeat("x", MaxNameLength+1)
+	err = CheckPathLength(long, limit)
+	if e, ok := err.(*PathTooLongError); !ok || e.Component == "" {
+		t.Errorf("CheckPathLength(%q): got %v, want component error", long, err)
+	}
+}
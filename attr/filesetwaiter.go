@@ -10,6 +10,10 @@ type FileSetWaiter struct {
 	process func(fset FileSet) error
 	sync.Mutex
 	channels map[int]chan int
+
+	// If set, reorders the other tasks of a FileSet before Wait
+	// wakes them.  For tests.
+	Order func(ids []int)
 }
 
 func NewFileSetWaiter(proc func(FileSet) error) *FileSetWaiter {
@@ -59,11 +63,20 @@ func (me *FileSetWaiter) drop(id int) {
 	delete(me.channels, id)
 }
 
+// Discard stops waiting for waitId, without processing its FileSet.
+func (me *FileSetWaiter) Discard(waitId int) {
+	me.drop(waitId)
+}
+
 func (me *FileSetWaiter) Wait(fs *FileSet, taskids []int, waitId int) (err error) {
 	if fs != nil {
 		log.Println("Got data for tasks: ", taskids, fs.Files)
 
 		err = me.process(*fs)
+		if me.Order != nil {
+			taskids = append([]int(nil), taskids...)
+			me.Order(taskids)
+		}
 		for _, id := range taskids {
 			if id == waitId {
 				continue
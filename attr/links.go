@@ -0,0 +1,44 @@
+package attr
+
+// Symlinks usually arrive with their target in Link, but attributes
+// from a bare stat, or merged from an update, may lack it.  Clients
+// then read the target with Server.Readlink, and keep it here until
+// an update for the link comes in.
+
+// Link returns the cached target of the symlink name.
+func (me *AttributeCache) Link(name string) (string, bool) {
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+	l, ok := me.links[name]
+	return l, ok
+}
+
+// AddLink caches the target of symlink a.  It is dropped if the link
+// changed since a was read.
+func (me *AttributeCache) AddLink(a *FileAttr, target string) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	cur := me.attributes[a.Path]
+	if cur == nil || !cur.IsSymlink() || !FuseAttrEq(cur.Attr, a.Attr) {
+		return
+	}
+	me.links[a.Path] = target
+}
+
+// readlink returns the target of symlink a, asking the getter if
+// the cached attribute does not have it.
+func (me *AttributeCache) readlink(a *FileAttr) string {
+	if a.Link != "" {
+		return a.Link
+	}
+	if l, ok := me.Link(a.Path); ok {
+		return l
+	}
+	fresh := me.getter(a.Path)
+	if fresh == nil || !fresh.IsSymlink() || fresh.Link == "" {
+		return ""
+	}
+	fresh.Path = a.Path
+	me.AddLink(fresh, fresh.Link)
+	return fresh.Link
+}
@@ -0,0 +1,126 @@
+package attr
+
+import (
+	"sort"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// Sending the NameModeMap of a directory with hundreds of thousands
+// of entries every time it changes is expensive, so with
+// PageThreshold set, large directories are sent without their
+// listing.  Clients read the listing in pages with
+// Server.ReadDirPage, and cache the pages until the directory
+// changes.  Each listing has a generation, so pages of different
+// versions are never combined.
+
+type dirPages struct {
+	generation uint64
+
+	// By offset.
+	pages map[int][]fuse.DirEntry
+}
+
+type dirListing struct {
+	generation uint64
+	entries    []fuse.DirEntry
+}
+
+// bumpGeneration gives a the next generation.  Must hold mutex.
+func (me *AttributeCache) bumpGeneration(a *FileAttr) {
+	me.generation++
+	a.Generation = me.generation
+}
+
+// pageDir returns a without its listing if the directory is large
+// enough to be paged.
+func (me *AttributeCache) pageDir(a *FileAttr) *FileAttr {
+	if me.PageThreshold <= 0 || a.NameModeMap == nil || len(a.NameModeMap) <= me.PageThreshold {
+		return a
+	}
+	p := a.Copy(false)
+	p.PagedEntries = len(a.NameModeMap)
+	return p
+}
+
+// Page returns the cached page of dir at offset, and its generation.
+func (me *AttributeCache) Page(dir string, offset int) (entries []fuse.DirEntry, generation uint64, ok bool) {
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+	p := me.pages[dir]
+	if p == nil {
+		return nil, 0, false
+	}
+	entries, ok = p.pages[offset]
+	return entries, p.generation, ok
+}
+
+// AddPage caches a page of the listing of dir.  Pages of other
+// generations are dropped, and so is a page of another generation
+// than the cached directory, which is from a listing that changed
+// since.
+func (me *AttributeCache) AddPage(dir string, generation uint64, offset int, entries []fuse.DirEntry) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if a := me.attributes[dir]; a == nil || !a.Paged() || a.Generation != generation {
+		return
+	}
+	p := me.pages[dir]
+	if p == nil || p.generation != generation {
+		p = &dirPages{
+			generation: generation,
+			pages:      map[int][]fuse.DirEntry{},
+		}
+		me.pages[dir] = p
+	}
+	p.pages[offset] = entries
+}
+
+// dropListing forgets the sorted listing of dir, which changed or
+// went away.  Must hold mutex.
+func (me *AttributeCache) dropListing(dir string) {
+	me.listingMutex.Lock()
+	defer me.listingMutex.Unlock()
+	delete(me.listings, dir)
+}
+
+// listing returns the entries of dir sorted by name, and their
+// generation.  Sorting once per generation makes offsets stable.
+func (me *AttributeCache) listing(dir string) ([]fuse.DirEntry, uint64, fuse.Status) {
+	// Fetch the directory without copying its listing.
+	if a := me.Get(dir); a.Deletion() {
+		return nil, 0, fuse.ENOENT
+	}
+
+	me.mutex.RLock()
+	defer me.mutex.RUnlock()
+	a := me.attributes[dir]
+	if a == nil {
+		return nil, 0, fuse.ENOENT
+	}
+	if !a.IsDir() {
+		return nil, 0, fuse.ENOTDIR
+	}
+
+	me.listingMutex.Lock()
+	defer me.listingMutex.Unlock()
+	if l := me.listings[dir]; l != nil && l.generation == a.Generation {
+		return l.entries, l.generation, fuse.OK
+	}
+	l := &dirListing{
+		generation: a.Generation,
+		entries:    make([]fuse.DirEntry, 0, len(a.NameModeMap)),
+	}
+	for n, m := range a.NameModeMap {
+		l.entries = append(l.entries, fuse.DirEntry{Name: n, Mode: uint32(m)})
+	}
+	sort.Sort(dirEntries(l.entries))
+	me.listings[dir] = l
+	return l.entries, l.generation, fuse.OK
+}
+
+type dirEntries []fuse.DirEntry
+
+func (me dirEntries) Len() int           { return len(me) }
+func (me dirEntries) Less(i, j int) bool { return me[i].Name < me[j].Name }
+func (me dirEntries) Swap(i, j int)      { me[i], me[j] = me[j], me[i] }
@@ -0,0 +1,148 @@
+package attr
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"os"
+)
+
+// The attribute cache can be saved to a file, so a restarted master
+// does not have to stat and hash its whole tree again.
+
+// Bump when the format of FileAttr changes.
+const snapshotVersion = 1
+
+type attrCacheSnapshot struct {
+	Version int
+	Files   []*FileAttr
+}
+
+// AttributeCacheStats counts how attributes entered the cache.
+type AttributeCacheStats struct {
+	// Attributes obtained from the getter, which typically stats
+	// and hashes the file.
+	Fetches int
+
+	// Entries restored by Load.
+	Loaded int
+
+	// Entries in the snapshot that were dropped by Load because
+	// the file changed or disappeared.
+	Stale int
+
+	// Lookups answered without the getter, for files that exist
+	// and for files that are missing.
+	Hits         int
+	NegativeHits int
+}
+
+func (me *AttributeCache) Stats() AttributeCacheStats {
+	me.mutex.RLock()
+	s := me.stats
+	me.mutex.RUnlock()
+
+	me.hitMutex.Lock()
+	defer me.hitMutex.Unlock()
+	s.Hits = me.hits
+	s.NegativeHits = me.negativeHits
+	return s
+}
+
+// countHit counts a lookup answered from the cache.
+func (me *AttributeCache) countHit(negative bool) {
+	me.hitMutex.Lock()
+	defer me.hitMutex.Unlock()
+	if negative {
+		me.negativeHits++
+	} else {
+		me.hits++
+	}
+}
+
+// Save writes all attributes to the file name.
+func (me *AttributeCache) Save(name string) error {
+	snapshot := attrCacheSnapshot{
+		Version: snapshotVersion,
+		Files:   me.Copy().Files,
+	}
+
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = gob.NewEncoder(w).Encode(&snapshot)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Load adds the attributes saved in the file name to the cache.
+// Entries whose file changed on disk since, according to the
+// statter, are dropped, as are those for which keep returns false,
+// and entries below dropped directories.
+func (me *AttributeCache) Load(name string, keep func(*FileAttr) bool) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	snapshot := attrCacheSnapshot{}
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&snapshot); err != nil {
+		return fmt.Errorf("decode %s: %v", name, err)
+	}
+	if snapshot.Version != snapshotVersion {
+		return fmt.Errorf("%s has version %d, want %d", name, snapshot.Version, snapshotVersion)
+	}
+
+	// Sorting puts directories before their contents.
+	fs := FileSet{Files: snapshot.Files}
+	fs.Sort()
+
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	for _, a := range fs.Files {
+		if a.Deletion() || me.attributes[a.Path] != nil {
+			continue
+		}
+		if a.Path != "" {
+			dir, base := SplitPath(a.Path)
+			parent := me.attributes[dir]
+			if parent == nil || parent.NameModeMap[base] == 0 {
+				me.stats.Stale++
+				continue
+			}
+		}
+		if a.IsDir() && a.NameModeMap == nil {
+			me.stats.Stale++
+			continue
+		}
+
+		disk := me.statter(a.Path)
+		if disk == nil || !FuseAttrEq(disk, a.Attr) || (keep != nil && !keep(a)) {
+			me.stats.Stale++
+			continue
+		}
+		if a.NameModeMap != nil {
+			// Generations of a previous run may be reused.
+			me.bumpGeneration(a)
+		}
+		me.attributes[a.Path] = a
+		me.stats.Loaded++
+	}
+	me.verify()
+	return nil
+}
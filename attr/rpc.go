@@ -1,11 +1,14 @@
 package attr
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"net/rpc"
+	"path/filepath"
 	"time"
 
+	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/termite/stats"
 )
 
@@ -14,10 +17,40 @@ type AttrRequest struct {
 
 	// Worker asking for the request. Useful for debugging.
 	Origin string
+
+	// If set, return the attributes of the files and symlinks in
+	// directory Name instead, starting at entry Offset of the
+	// sorted listing.
+	ExpandDir bool
+	Offset    int
 }
 
 type AttrResponse struct {
 	Attrs []*FileAttr
+
+	// For ExpandDir, the Offset of the next chunk, or 0 if the
+	// directory was done.
+	NextOffset int
+}
+
+type DirPageRequest struct {
+	Name string
+
+	// Generation of the listing the client is reading.
+	Generation uint64
+	Offset     int
+	Limit      int
+}
+
+type DirPageResponse struct {
+	// The current generation.  If it differs from the requested
+	// one, Entries is empty, and the client should start over.
+	Generation uint64
+	Entries    []fuse.DirEntry
+}
+
+type ReadlinkResponse struct {
+	Link string
 }
 
 type Client struct {
@@ -39,6 +72,20 @@ func (c *Client) Close() {
 }
 
 func (c *Client) GetAttr(n string, wanted *FileAttr) error {
+	attrs, err := c.GetAttrs(n)
+	for _, attr := range attrs {
+		if attr.Path == n {
+			*wanted = *attr
+			break
+		}
+	}
+
+	return err
+}
+
+// GetAttrs returns the attributes for n, and those of its siblings
+// that the server has cached.
+func (c *Client) GetAttrs(n string) ([]*FileAttr, error) {
 	req := &AttrRequest{
 		Name:   n,
 		Origin: c.id,
@@ -48,17 +95,83 @@ func (c *Client) GetAttr(n string, wanted *FileAttr) error {
 	err := c.client.Call("Server.GetAttr", req, rep)
 	dt := time.Now().Sub(start)
 	c.timings.Log("Client.GetAttr", dt)
+	return rep.Attrs, err
+}
 
-	for _, attr := range rep.Attrs {
-		if attr.Path == n {
-			*wanted = *attr
-			break
-		}
+// ReadDirPage reads up to limit entries of the listing of directory
+// n, starting at offset.
+func (c *Client) ReadDirPage(n string, generation uint64, offset, limit int) (*DirPageResponse, error) {
+	req := &DirPageRequest{
+		Name:       n,
+		Generation: generation,
+		Offset:     offset,
+		Limit:      limit,
 	}
+	start := time.Now()
+	rep := &DirPageResponse{}
+	err := c.client.Call("Server.ReadDirPage", req, rep)
+	dt := time.Now().Sub(start)
+	c.timings.Log("Client.ReadDirPage", dt)
+	return rep, err
+}
 
-	return err
+// Ping checks that the server answers within timeout.
+func (c *Client) Ping(timeout time.Duration) error {
+	call := c.client.Go("Server.Ping", &AttrRequest{Origin: c.id}, &AttrResponse{}, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(timeout):
+		return fmt.Errorf("no reply after %v", timeout)
+	}
 }
 
+// Readlink returns the target of symlink n.
+func (c *Client) Readlink(n string) (string, error) {
+	req := &AttrRequest{
+		Name:   n,
+		Origin: c.id,
+	}
+	start := time.Now()
+	rep := &ReadlinkResponse{}
+	err := c.client.Call("Server.Readlink", req, rep)
+	dt := time.Now().Sub(start)
+	c.timings.Log("Client.Readlink", dt)
+	return rep.Link, err
+}
+
+// ExpandDir returns the attributes of the files and symlinks in
+// directory n.
+func (c *Client) ExpandDir(n string) ([]*FileAttr, error) {
+	var result []*FileAttr
+	req := &AttrRequest{
+		Name:      n,
+		Origin:    c.id,
+		ExpandDir: true,
+	}
+	for {
+		start := time.Now()
+		rep := &AttrResponse{}
+		err := c.client.Call("Server.GetAttr", req, rep)
+		dt := time.Now().Sub(start)
+		c.timings.Log("Client.ExpandDir", dt)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, rep.Attrs...)
+		if rep.NextOffset <= req.Offset {
+			return result, nil
+		}
+		req.Offset = rep.NextOffset
+	}
+}
+
+// Maximum number of cached siblings returned with an attribute.
+const _MAX_SIBLING_ATTRS = 64
+
+// Maximum number of directory entries expanded in one response.
+const _EXPAND_CHUNK = 512
+
 type Server struct {
 	attributes *AttributeCache
 	stats      *stats.TimerStats
@@ -77,19 +190,104 @@ func (s *Server) TimingMessages() []string {
 	return s.stats.TimingMessages()
 }
 
+// Ping does nothing, for checking the connection.
+func (s *Server) Ping(req *AttrRequest, rep *AttrResponse) error {
+	return nil
+}
+
 func (s *Server) GetAttr(req *AttrRequest, rep *AttrResponse) error {
 	start := time.Now()
 	log.Printf("GetAttr %s req %q", req.Origin, req.Name)
 	if req.Name != "" && req.Name[0] == '/' {
 		panic("leading /")
 	}
+	if req.ExpandDir {
+		err := s.expandDir(req, rep)
+		s.stats.Log("Server.ExpandDir", time.Now().Sub(start))
+		return err
+	}
 
 	a := s.attributes.GetDir(req.Name)
 	if a.Hash != "" {
 		log.Printf("GetAttr %v", a)
 	}
-	rep.Attrs = append(rep.Attrs, a)
+	rep.Attrs = append(rep.Attrs, s.attributes.pageDir(a))
+
+	// Compilers probe many files in the same directory, so save
+	// the client some round trips.
+	if req.Name != "" {
+		dir, _ := SplitPath(req.Name)
+		for _, s := range s.attributes.CachedChildren(dir, _MAX_SIBLING_ATTRS+1) {
+			if s.Path != req.Name && len(rep.Attrs) <= _MAX_SIBLING_ATTRS {
+				rep.Attrs = append(rep.Attrs, s)
+			}
+		}
+	}
 	dt := time.Now().Sub(start)
 	s.stats.Log("Server.GetAttr", dt)
 	return nil
 }
+
+func (s *Server) expandDir(req *AttrRequest, rep *AttrResponse) error {
+	entries, _, code := s.attributes.listing(req.Name)
+	if !code.Ok() {
+		return fmt.Errorf("ExpandDir %q: %v", req.Name, code)
+	}
+	if req.Offset < 0 || req.Offset >= len(entries) {
+		return nil
+	}
+	end := req.Offset + _EXPAND_CHUNK
+	if end < len(entries) {
+		rep.NextOffset = end
+	} else {
+		end = len(entries)
+	}
+	// Only attributes we have are sent: getting the others would
+	// hash every file in the directory.  The client asks for those
+	// when it needs them.
+	for _, e := range entries[req.Offset:end] {
+		if fuse.FileMode(e.Mode).IsDir() {
+			continue
+		}
+		if a := s.attributes.Cached(filepath.Join(req.Name, e.Name)); a != nil {
+			rep.Attrs = append(rep.Attrs, a)
+		}
+	}
+	return nil
+}
+
+func (s *Server) ReadDirPage(req *DirPageRequest, rep *DirPageResponse) error {
+	start := time.Now()
+	entries, generation, code := s.attributes.listing(req.Name)
+	if !code.Ok() {
+		return fmt.Errorf("ReadDirPage %q: %v", req.Name, code)
+	}
+	rep.Generation = generation
+	if generation == req.Generation && req.Offset >= 0 && req.Offset < len(entries) {
+		end := len(entries)
+		if req.Limit > 0 && req.Offset+req.Limit < end {
+			end = req.Offset + req.Limit
+		}
+		rep.Entries = append([]fuse.DirEntry{}, entries[req.Offset:end]...)
+	}
+	dt := time.Now().Sub(start)
+	s.stats.Log("Server.ReadDirPage", dt)
+	return nil
+}
+
+func (s *Server) Readlink(req *AttrRequest, rep *ReadlinkResponse) error {
+	start := time.Now()
+	a := s.attributes.Get(req.Name)
+	if a == nil || a.Deletion() {
+		return fmt.Errorf("Readlink %q: %v", req.Name, fuse.ENOENT)
+	}
+	if !a.IsSymlink() {
+		return fmt.Errorf("Readlink %q: %v", req.Name, fuse.EINVAL)
+	}
+	rep.Link = s.attributes.readlink(a)
+	s.stats.Log("Server.Readlink", time.Now().Sub(start))
+	if rep.Link == "" {
+		return fmt.Errorf("Readlink %q: target unknown", req.Name)
+	}
+	return nil
+}
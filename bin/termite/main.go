@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+
+	"github.com/hanwen/termite/cli"
+)
+
+func main() {
+	cli.Main(os.Args)
+}
@@ -1,6 +1,7 @@
 package cba
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"net/rpc"
@@ -18,15 +19,57 @@ type Client struct {
 	mutex    sync.Mutex
 	cond     *sync.Cond
 	fetching map[string]bool
+
+	// Closed by Cancel to stop fetches in progress.
+	cancels map[string]chan bool
+
+	// Objects queued or being fetched by Prefetch, the queue, and
+	// the number of goroutines working through it.
+	prefetching     map[string]bool
+	prefetchQueue   []prefetchItem
+	prefetchWorkers int
+
+	// Lookups through this client.  An object is counted once,
+	// when it is first asked for: objects counted by Prefetch are
+	// not counted again by the next FetchOnce.  The prefetched
+	// objects are kept in two generations.
+	hits, misses int
+	counted      map[string]bool
+	countedOld   map[string]bool
+}
+
+// Prefetched objects remembered in one generation, so a later
+// FetchOnce does not count them again.
+const maxCountedPrefetches = 4096
+
+type prefetchItem struct {
+	hash string
+	size int64
+}
+
+// corruptionError is returned if fetched data does not match the
+// requested hash.
+type corruptionError struct {
+	want, got string
+}
+
+func (e *corruptionError) Error() string {
+	return fmt.Sprintf("file corruption: got %x want %x", e.got, e.want)
 }
 
+// CancelledError is returned for fetches stopped by Cancel.
+var CancelledError = fmt.Errorf("fetch cancelled")
+
 func (store *Store) NewClient(conn io.ReadWriteCloser) *Client {
 	cl := &Client{
-		store:    store,
-		fetching: map[string]bool{},
+		store:       store,
+		fetching:    map[string]bool{},
+		cancels:     map[string]chan bool{},
+		prefetching: map[string]bool{},
+		counted:     map[string]bool{},
 	}
 	cl.cond = sync.NewCond(&cl.mutex)
-	cl.client = rpc.NewClient(conn)
+	cl.client = rpc.NewClientWithCodec(newContentClientCodec(conn))
 	return cl
 }
 
@@ -34,17 +77,46 @@ func (c *Client) Close() {
 	c.client.Close()
 }
 
+// Ping checks that the server answers within timeout.
+func (c *Client) Ping(timeout time.Duration) error {
+	call := c.client.Go("Server.Ping", &Request{}, &Response{}, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(timeout):
+		return fmt.Errorf("no reply after %v", timeout)
+	}
+}
+
 // FetchOnce makes sure only one fetch is done, if concurrent fetches
 // for the same file happen.
 func (c *Client) FetchOnce(want string, size int64) (bool, error) {
+	return c.fetchOnce(want, size, true)
+}
+
+// fetchOnce is FetchOnce; lookup is false for fetches that should
+// not count towards the hit rate.  Waiting for a fetch in flight
+// counts as a miss.
+func (c *Client) fetchOnce(want string, size int64, lookup bool) (bool, error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	if lookup && c.takeCounted(want) {
+		lookup = false
+	}
+	waited := false
 	for !c.store.Has(want) && c.fetching[want] {
+		waited = true
 		c.cond.Wait()
 	}
 	if c.store.Has(want) {
+		if lookup {
+			c.lookup(!waited)
+		}
 		return true, nil
 	}
+	if lookup {
+		c.lookup(false)
+	}
 	c.fetching[want] = true
 	c.mutex.Unlock()
 
@@ -56,9 +128,149 @@ func (c *Client) FetchOnce(want string, size int64) (bool, error) {
 	return got, err
 }
 
+// Prefetch fetches objects in the background, given as a map from
+// hash to size, so they are present by the time they are needed.  At
+// most Options.PrefetchConcurrency prefetches run at a time.  Objects
+// that are present, being fetched or already queued are skipped.  A
+// FetchOnce for an object that is being prefetched waits for the
+// prefetch.  The lookup of an object is counted here, and not again
+// by the FetchOnce that follows.
+func (c *Client) Prefetch(objects map[string]int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for h, size := range objects {
+		if c.fetching[h] || c.prefetching[h] {
+			continue
+		}
+		have := c.store.Has(h)
+		if !c.takeCounted(h) {
+			c.lookup(have)
+		}
+		c.markCounted(h)
+		if have {
+			continue
+		}
+		c.prefetching[h] = true
+		c.prefetchQueue = append(c.prefetchQueue, prefetchItem{h, size})
+	}
+	for c.prefetchWorkers < c.store.Options.PrefetchConcurrency && c.prefetchWorkers < len(c.prefetchQueue) {
+		c.prefetchWorkers++
+		go c.prefetchLoop()
+	}
+}
+
+// lookup counts a lookup in the client and the store.  Must hold
+// c.mutex.
+func (c *Client) lookup(hit bool) {
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	c.store.addLookup(hit)
+}
+
+// markCounted records that the lookup of h was counted by Prefetch.
+// Must hold c.mutex.
+func (c *Client) markCounted(h string) {
+	if len(c.counted) >= maxCountedPrefetches {
+		c.countedOld = c.counted
+		c.counted = map[string]bool{}
+	}
+	c.counted[h] = true
+}
+
+// takeCounted returns whether Prefetch counted the lookup of h, and
+// forgets it.  Must hold c.mutex.
+func (c *Client) takeCounted(h string) bool {
+	counted := c.counted[h] || c.countedOld[h]
+	delete(c.counted, h)
+	delete(c.countedOld, h)
+	return counted
+}
+
+// Lookups returns how many lookups through this client found their
+// object in the store, and how many had to fetch it.
+func (c *Client) Lookups() (hits, misses int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.hits, c.misses
+}
+
+// prefetchLoop fetches queued objects until the queue is empty.
+func (c *Client) prefetchLoop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for len(c.prefetchQueue) > 0 {
+		item := c.prefetchQueue[0]
+		c.prefetchQueue = c.prefetchQueue[1:]
+		c.mutex.Unlock()
+		_, err := c.fetchOnce(item.hash, item.size, false)
+		if err != nil {
+			log.Printf("prefetch %x: %v", item.hash, err)
+		}
+		c.mutex.Lock()
+		delete(c.prefetching, item.hash)
+	}
+	c.prefetchWorkers--
+}
+
+// Cancel stops fetches of the given hash that are in progress. Data
+// received so far is kept, so a later fetch resumes where the
+// cancelled one stopped.
+func (c *Client) Cancel(hash string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if ch, ok := c.cancels[hash]; ok {
+		close(ch)
+		delete(c.cancels, hash)
+	}
+}
+
+func (c *Client) cancelChannel(hash string) chan bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ch, ok := c.cancels[hash]
+	if !ok {
+		ch = make(chan bool)
+		c.cancels[hash] = ch
+	}
+	return ch
+}
+
+func (c *Client) releaseCancel(hash string, ch chan bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.cancels[hash] == ch {
+		delete(c.cancels, hash)
+	}
+}
+
+func cancelled(ch chan bool) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+	}
+	return false
+}
+
 func (c *Client) Fetch(want string, size int64) (bool, error) {
+	if err := c.store.CheckSpace(size); err != nil {
+		return false, err
+	}
+	c.store.addFetchesInFlight(1)
+	defer c.store.addFetchesInFlight(-1)
+
+	cancel := c.cancelChannel(want)
+	defer c.releaseCancel(want, cancel)
+
 	start := time.Now()
-	succ, err := c.fetch(want, size)
+	succ, err := c.fetch(want, size, cancel)
+	if _, ok := err.(*corruptionError); ok {
+		log.Printf("%v; retrying", err)
+		succ, err = c.fetch(want, size, cancel)
+	}
 	dt := time.Now().Sub(start)
 	c.store.AddTiming("Fetch", int(size), dt)
 	return succ, err
@@ -72,7 +284,142 @@ func (c *Client) fetchChunk(req *Request, rep *Response) error {
 	return err
 }
 
-func (c *Client) fetch(want string, size int64) (bool, error) {
+func (c *Client) fetch(want string, size int64, cancel chan bool) (bool, error) {
+	if size > int64(defaultServeSize) && c.store.Options.FetchConcurrency > 1 {
+		return c.fetchParallel(want, size, cancel)
+	}
+	return c.fetchSequential(want, size, cancel)
+}
+
+type chunkResult struct {
+	start int
+	rep   *Response
+	err   error
+}
+
+// checkChunk returns an error if rep is not a valid answer to req,
+// which asked for at most max bytes.  Empty chunks have no Chunk on
+// the wire, so the caller's buffer stays in rep.Chunk.
+func checkChunk(req *Request, rep *Response, max int) error {
+	switch {
+	case rep.Size < 0 || rep.Size > max:
+		return fmt.Errorf("chunk %v has %d bytes, asked for at most %d", req, rep.Size, max)
+	case rep.Size > len(rep.Chunk) || (rep.Size > 0 && rep.Size != len(rep.Chunk)):
+		return fmt.Errorf("chunk %v claims %d bytes, carries %d", req, rep.Size, len(rep.Chunk))
+	case rep.Size == 0 && !rep.Last:
+		return fmt.Errorf("chunk %v is empty", req)
+	}
+	return nil
+}
+
+func (c *Client) fetchRange(want string, start, end int, out chan<- chunkResult) {
+	req := &Request{Hash: want, Start: start, End: end}
+	rep := &Response{}
+	err := c.fetchChunk(req, rep)
+	if err == nil && rep.Have {
+		err = checkChunk(req, rep, end-start)
+	}
+	if err == nil && rep.Have && rep.Size != end-start {
+		err = fmt.Errorf("short read for %v: got %d bytes", req, rep.Size)
+	}
+	out <- chunkResult{start, rep, err}
+}
+
+// fetchParallel keeps up to FetchConcurrency chunk requests in
+// flight. Since the HashWriter needs sequential data, chunks that
+// arrive out of order are buffered until their predecessors are in.
+// Requests never run more than FetchConcurrency chunks ahead of the
+// written data, so a slow chunk cannot make the buffer grow without
+// bound.  After a cancel, no new requests are issued, but chunks in
+// flight are still written out.
+func (c *Client) fetchParallel(want string, size int64, cancel chan bool) (bool, error) {
+	window := c.store.Options.FetchConcurrency
+	results := make(chan chunkResult, window)
+
+	output := c.store.newPartialWriter(want, size)
+	if output == nil {
+		output = c.store.NewHashWriter()
+	}
+
+	resumed := output.size
+	next := resumed
+	inFlight := 0
+	issue := func() {
+		end := next + defaultServeSize
+		if int64(end) > size {
+			end = int(size)
+		}
+		go c.fetchRange(want, next, end, results)
+		next = end
+		inFlight++
+	}
+	written := output.size
+	issueAll := func() {
+		for int64(next) < size && next < written+window*defaultServeSize {
+			issue()
+		}
+	}
+	issueAll()
+
+	pending := map[int][]byte{}
+	have := true
+	var firstErr error
+	for inFlight > 0 {
+		r := <-results
+		inFlight--
+		if r.err != nil || !r.rep.Have {
+			// A failed call says nothing about whether the
+			// server has the object, and must not discard
+			// the partial file.
+			have = have && (r.err != nil || r.rep.Have)
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		if firstErr != nil || !have {
+			continue
+		}
+
+		pending[r.start] = r.rep.Chunk[:r.rep.Size]
+		for {
+			data, ok := pending[written]
+			if !ok {
+				break
+			}
+			delete(pending, written)
+			n, err := output.Write(data)
+			written += n
+			if err != nil {
+				firstErr = err
+				break
+			}
+		}
+		if firstErr == nil && !cancelled(cancel) {
+			issueAll()
+		}
+	}
+	if firstErr == nil && have && int64(written) < size {
+		firstErr = CancelledError
+	}
+
+	if !have {
+		output.abort()
+		return false, firstErr
+	}
+	if firstErr != nil {
+		output.interrupt()
+		c.store.addThroughput(int64(written-resumed), 0)
+		return false, firstErr
+	}
+	c.store.addThroughput(int64(written-resumed), 0)
+	if err := output.closeWant(want); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *Client) fetchSequential(want string, size int64, cancel chan bool) (bool, error) {
 	chunkSize := defaultServeSize
 	if int64(chunkSize) > size+1 {
 		chunkSize = int(size + 1)
@@ -80,49 +427,64 @@ func (c *Client) fetch(want string, size int64) (bool, error) {
 
 	buf := make([]byte, chunkSize)
 
+	// Objects that need more than one chunk go to a partial file,
+	// so we can resume if we are interrupted.
 	var output *HashWriter
+	if size > int64(chunkSize) {
+		output = c.store.newPartialWriter(want, size)
+	}
 	written := 0
+	if output != nil {
+		written = output.size
+	}
+	resumed := written
 
-	var saved string
 	for {
+		if cancelled(cancel) {
+			if output != nil {
+				output.interrupt()
+			}
+			c.store.addThroughput(int64(written-resumed), 0)
+			return false, CancelledError
+		}
 		req := &Request{
 			Hash:  want,
 			Start: written,
 		}
 		rep := &Response{Chunk: buf}
 		err := c.fetchChunk(req, rep)
+		if err == nil && rep.Have {
+			err = checkChunk(req, rep, defaultServeSize)
+		}
+		if err == nil && !rep.Have && output != nil {
+			output.abort()
+		} else if err != nil && output != nil {
+			output.interrupt()
+			c.store.addThroughput(int64(written-resumed), 0)
+		}
 		if err != nil || !rep.Have {
 			return false, err
 		}
 
-		// is this a bug in the rpc package?
 		content := rep.Chunk[:rep.Size]
 
-		if rep.Last && written == 0 {
-			saved = c.store.Save(content)
-			written = len(content)
-			break
-		} else if output == nil {
+		if output == nil {
 			output = c.store.NewHashWriter()
-			defer output.Close()
 		}
 
 		n, err := output.Write(content)
 		written += n
 		if err != nil {
+			output.interrupt()
 			return false, err
 		}
 		if rep.Last {
 			break
 		}
 	}
-	if output != nil {
-		output.Close()
-		saved = string(output.Sum())
-	}
-	c.store.addThroughput(int64(written), 0)
-	if want != saved {
-		log.Fatalf("file corruption: got %x want %x", saved, want)
+	c.store.addThroughput(int64(written-resumed), 0)
+	if err := output.closeWant(want); err != nil {
+		return false, err
 	}
 	return true, nil
 }
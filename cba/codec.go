@@ -0,0 +1,248 @@
+package cba
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"net/rpc"
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/splice"
+)
+
+// Content connections speak net/rpc with gob, except that the data
+// of a chunk does not go through gob: each Response is followed by
+// its Size bytes on the raw stream.  This lets the server splice a
+// range from the object file into the socket, without copying it
+// through the Go heap; see spliceServer.serveRange.  Connections that
+// are not sockets, such as TLS connections, get the bytes written
+// from memory.
+
+// Replies claiming more data than this are taken to be garbage.
+const maxChunkSize = 16 << 20
+
+type contentServerCodec struct {
+	conn   io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func newContentServerCodec(conn io.ReadWriteCloser) *contentServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &contentServerCodec{
+		conn:   conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+func (c *contentServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *contentServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *contentServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	rep, ok := body.(*Response)
+	if ok && rep.release != nil {
+		defer rep.release()
+	}
+	if r.Error != "" || !ok {
+		// net/rpc sends a placeholder body with errors; the
+		// client knows no data follows.
+		return c.write(r, body, nil)
+	}
+
+	out := *rep
+	out.Chunk = nil
+	if rep.file == nil {
+		out.Size = len(rep.Chunk)
+	}
+	return c.write(r, &out, rep)
+}
+
+// write sends the header and the body, and then the data of rep, if
+// given.  A failed write leaves the stream unusable, so it closes the
+// connection.
+func (c *contentServerCodec) write(r *rpc.Response, body interface{}, rep *Response) error {
+	err := c.enc.Encode(r)
+	if err == nil {
+		err = c.enc.Encode(body)
+	}
+	if err == nil {
+		err = c.encBuf.Flush()
+	}
+	if err == nil && rep != nil {
+		if rep.file != nil {
+			err = c.sendRange(rep.file, rep.off, rep.Size)
+		} else {
+			_, err = c.conn.Write(rep.Chunk)
+		}
+	}
+	if err != nil {
+		log.Println("contentServerCodec:", err)
+		c.Close()
+	}
+	return err
+}
+
+// sendRange writes size bytes of f at off to the connection.  Bytes
+// that cannot be read, for example because the file is shorter than
+// it should be, are sent as zeros to keep the stream in sync; the
+// client notices the hash mismatch.
+func (c *contentServerCodec) sendRange(f *os.File, off int64, size int) error {
+	done := 0
+	if sc, ok := c.conn.(syscall.Conn); ok {
+		var err error
+		done, err = spliceRange(sc, f, off, size)
+		if err != nil {
+			return err
+		}
+	}
+	if done == size {
+		return nil
+	}
+	data := make([]byte, size-done)
+	f.ReadAt(data, off+int64(done))
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// spliceRange splices up to size bytes of f at off into the socket.
+// It returns how many bytes were sent; an error means the socket
+// failed.  It stops early, without error, if splicing is not
+// possible or the file cannot be read.
+func spliceRange(sc syscall.Conn, f *os.File, off int64, size int) (int, error) {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, nil
+	}
+	pair, err := splice.Get()
+	if err != nil {
+		return 0, nil
+	}
+	defer splice.Done(pair)
+	if size > pair.Cap() {
+		// If this fails, we send pieces of the pipe size.
+		pair.Grow(size)
+	}
+
+	done := 0
+	for done < size {
+		want := size - done
+		if max := pair.Cap(); max > 0 && want > max {
+			want = max
+		}
+		n, err := pair.LoadFromAt(f.Fd(), want, off+int64(done))
+		if err != nil || n <= 0 {
+			break
+		}
+
+		written := 0
+		var werr error
+		err = rc.Write(func(fd uintptr) bool {
+			m, e := pair.WriteTo(fd, n-written)
+			if m > 0 {
+				written += m
+			}
+			if e == syscall.EAGAIN {
+				return false
+			}
+			werr = e
+			return e != nil || written == n
+		})
+		if err == nil {
+			err = werr
+		}
+		done += written
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+func (c *contentServerCodec) Close() error {
+	return c.conn.Close()
+}
+
+type contentClientCodec struct {
+	conn   io.ReadWriteCloser
+	r      *bufio.Reader
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+
+	// Set if the response being read carries an error, and so
+	// has no data.
+	failed bool
+}
+
+func newContentClientCodec(conn io.ReadWriteCloser) *contentClientCodec {
+	r := bufio.NewReader(conn)
+	buf := bufio.NewWriter(conn)
+	return &contentClientCodec{
+		conn:   conn,
+		r:      r,
+		dec:    gob.NewDecoder(r),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+func (c *contentClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *contentClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	err := c.dec.Decode(r)
+	c.failed = r.Error != ""
+	return err
+}
+
+// ReadResponseBody reads the Response and its data.  The data goes
+// into the Chunk buffer of the caller if it is large enough.  A body
+// of nil discards the response.
+func (c *contentClientCodec) ReadResponseBody(body interface{}) error {
+	if c.failed {
+		return c.dec.Decode(body)
+	}
+	rep, ok := body.(*Response)
+	if !ok {
+		rep = &Response{}
+	}
+	if err := c.dec.Decode(rep); err != nil {
+		return err
+	}
+	if rep.Size < 0 || rep.Size > maxChunkSize {
+		// We can't find the next reply in the stream.
+		c.Close()
+		return fmt.Errorf("reply claims %d bytes of data", rep.Size)
+	}
+	if rep.Size == 0 {
+		return nil
+	}
+	if cap(rep.Chunk) < rep.Size {
+		rep.Chunk = make([]byte, rep.Size)
+	}
+	rep.Chunk = rep.Chunk[:rep.Size]
+	_, err := io.ReadFull(c.r, rep.Chunk)
+	return err
+}
+
+func (c *contentClientCodec) Close() error {
+	return c.conn.Close()
+}
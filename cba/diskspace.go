@@ -0,0 +1,66 @@
+package cba
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// A store whose volume fills up can no longer save what it fetches.
+// With StoreOptions.MinFreeBytes, fetches that would leave less free
+// space are refused with a DiskFullError, which callers may retry
+// elsewhere or later.
+
+// DiskFullError is returned for fetches that would take the free
+// space below StoreOptions.MinFreeBytes.
+type DiskFullError struct {
+	Dir  string
+	Free uint64
+	Need int64
+}
+
+func (e *DiskFullError) Error() string {
+	return fmt.Sprintf("%s: %d bytes free, fetching %d would leave less than the minimum",
+		e.Dir, e.Free, e.Need)
+}
+
+// Temporary returns true: the fetch may succeed once space is freed.
+func (e *DiskFullError) Temporary() bool {
+	return true
+}
+
+// DiskAvailable returns the free space for unprivileged users on the
+// file system holding dir, or 0 if unknown.
+func DiskAvailable(dir string) uint64 {
+	var s syscall.Statfs_t
+	if err := syscall.Statfs(dir, &s); err != nil {
+		return 0
+	}
+	return s.Bavail * uint64(s.Bsize)
+}
+
+// DiskAvailable returns the free space for unprivileged users on the
+// file system of the store, or 0 if unknown.
+func (st *Store) DiskAvailable() uint64 {
+	return DiskAvailable(st.Dir())
+}
+
+// CheckSpace returns a DiskFullError if saving size more bytes would
+// take the free space below the minimum.
+func (st *Store) CheckSpace(size int64) error {
+	min := st.Options.MinFreeBytes
+	if min == 0 {
+		return nil
+	}
+	free := st.DiskAvailable()
+	if free == 0 {
+		// Unknown.
+		return nil
+	}
+	if size < 0 {
+		size = 0
+	}
+	if free < min+uint64(size) {
+		return &DiskFullError{Dir: st.Dir(), Free: free, Need: size}
+	}
+	return nil
+}
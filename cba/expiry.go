@@ -0,0 +1,214 @@
+package cba
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/hanwen/termite/fastpath"
+)
+
+// Objects may have an expiry time, set when they are saved with a
+// TTL.  Expired objects are treated as absent, and removed when they
+// are next looked up, or by ReapExpired.
+//
+// The expiry times are kept in an append-only log in the store
+// directory.  The last entry for a hash wins; a zero time means the
+// object is permanent.
+const expiryLogName = "expiry.log"
+
+func (st *Store) expiryLogPath() string {
+	return fastpath.Join(st.Dir(), expiryLogName)
+}
+
+func (st *Store) loadExpiry() {
+	st.expiry = map[string]time.Time{}
+	f, err := os.Open(st.expiryLogPath())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var hash []byte
+		var nsec int64
+		if _, err := fmt.Sscanf(scanner.Text(), "%x %d", &hash, &nsec); err != nil {
+			log.Printf("loadExpiry: ignoring %q: %v", scanner.Text(), err)
+			continue
+		}
+		if nsec == 0 {
+			delete(st.expiry, string(hash))
+		} else {
+			st.expiry[string(hash)] = time.Unix(0, nsec)
+		}
+	}
+}
+
+// Must hold lock.
+func (st *Store) logExpiry(hash string, t time.Time) {
+	f, err := os.OpenFile(st.expiryLogPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Println("logExpiry:", err)
+		return
+	}
+	defer f.Close()
+
+	nsec := int64(0)
+	if !t.IsZero() {
+		nsec = t.UnixNano()
+	}
+	if _, err := fmt.Fprintf(f, "%x %d\n", hash, nsec); err != nil {
+		log.Println("logExpiry:", err)
+	}
+}
+
+// expired returns true if the object has expired. Expired objects are
+// removed, unless they are pinned.
+func (st *Store) expired(hash string) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	t, ok := st.expiry[hash]
+	if !ok || time.Now().Before(t) || st.refs[hash] > 0 {
+		return false
+	}
+	st.removeExpired(hash)
+	return true
+}
+
+// Must hold lock.
+func (st *Store) removeExpired(hash string) {
+	if err := st.removeObject(hash); err != nil {
+		log.Println("removeExpired:", err)
+	}
+	delete(st.expiry, hash)
+	st.logExpiry(hash, time.Time{})
+}
+
+// clearExpiry makes an object permanent.
+func (st *Store) clearExpiry(hash string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if _, ok := st.expiry[hash]; ok {
+		delete(st.expiry, hash)
+		st.logExpiry(hash, time.Time{})
+	}
+}
+
+// SaveStreamWithTTL saves the input, and lets it expire after the
+// given TTL.  If the object was already stored permanently, it stays
+// permanent.
+func (st *Store) SaveStreamWithTTL(input io.Reader, size int64, ttl time.Duration) (hash string) {
+	dup := st.NewHashWriter()
+	if _, err := io.CopyN(dup, input, size); err != nil {
+		dup.abort()
+		return ""
+	}
+
+	hash = dup.Sum()
+	permanent := st.Has(hash)
+	st.mutex.Lock()
+	expiry, hasExpiry := st.expiry[hash]
+	st.mutex.Unlock()
+	permanent = permanent && !hasExpiry
+
+	if err := dup.Close(); err != nil {
+		return ""
+	}
+	if permanent {
+		return hash
+	}
+
+	t := time.Now().Add(ttl)
+	if t.Before(expiry) {
+		t = expiry
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.expiry[hash] = t
+	st.logExpiry(hash, t)
+	return hash
+}
+
+// SaveWithTTL is like Save, but lets the content expire after the
+// given TTL.
+func (st *Store) SaveWithTTL(content []byte, ttl time.Duration) (hash string) {
+	return st.SaveStreamWithTTL(bytes.NewBuffer(content), int64(len(content)), ttl)
+}
+
+// ReapExpired removes all expired objects that are not pinned, and
+// compacts the expiry log if anything was removed. It returns the
+// number of objects removed.  Removals are throttled like other
+// maintenance.
+func (st *Store) ReapExpired() int {
+	now := time.Now()
+	st.mutex.Lock()
+	var candidates []string
+	for h, t := range st.expiry {
+		if !now.Before(t) {
+			candidates = append(candidates, h)
+		}
+	}
+	st.mutex.Unlock()
+	if len(candidates) == 0 {
+		return 0
+	}
+
+	st.beginMaintenance("reap expired", len(candidates))
+	defer st.endMaintenance()
+	n := 0
+	for _, h := range candidates {
+		st.maintenanceStep()
+
+		// The object may have been saved permanently or pinned
+		// meanwhile.
+		st.mutex.Lock()
+		if t, ok := st.expiry[h]; ok && !now.Before(t) && st.refs[h] == 0 {
+			if err := st.removeObject(h); err != nil {
+				log.Println("ReapExpired:", err)
+			}
+			delete(st.expiry, h)
+			n++
+		}
+		st.mutex.Unlock()
+	}
+	if n == 0 {
+		return 0
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if err := st.writeExpiryLog(); err != nil {
+		log.Println("ReapExpired:", err)
+	}
+	return n
+}
+
+// writeExpiryLog replaces the expiry log with the current expiry
+// times.  Must hold lock.
+func (st *Store) writeExpiryLog() error {
+	buf := &bytes.Buffer{}
+	for h, t := range st.expiry {
+		fmt.Fprintf(buf, "%x %d\n", h, t.UnixNano())
+	}
+	f, err := ioutil.TempFile(st.Dir(), ".expirytemp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), st.expiryLogPath())
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
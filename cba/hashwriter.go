@@ -1,6 +1,7 @@
 package cba
 
 import (
+	"fmt"
 	"hash"
 	"io"
 	"log"
@@ -15,6 +16,10 @@ type HashWriter struct {
 	dest   *os.File
 	cache  *Store
 	size   int
+
+	// Set to the hash being fetched if dest is its resumable
+	// partial file.
+	partial string
 }
 
 func (st *HashWriter) Sum() string {
@@ -31,6 +36,7 @@ func (st *HashWriter) Write(p []byte) (n int, err error) {
 func (st *HashWriter) WriteClose(p []byte) (err error) {
 	_, err = st.Write(p)
 	if err != nil {
+		st.abort()
 		return err
 	}
 	err = st.Close()
@@ -40,28 +46,84 @@ func (st *HashWriter) WriteClose(p []byte) (err error) {
 func (st *HashWriter) CopyClose(input io.Reader, size int64) error {
 	_, err := io.CopyN(st, input, size)
 	if err != nil {
+		st.abort()
 		return err
 	}
 	err = st.Close()
 	return err
 }
 
-func (st *HashWriter) Close() error {
-	st.dest.Chmod(0444)
-	err := st.dest.Close()
-	if err != nil {
+// CopyAllClose copies input until EOF, and saves the result. On
+// error, the written data is discarded.
+func (st *HashWriter) CopyAllClose(input io.Reader) error {
+	if _, err := io.Copy(st, input); err != nil {
+		st.abort()
 		return err
 	}
+	return st.Close()
+}
+
+// interrupt stops writing.  A partial file is kept so a later fetch
+// can resume from it; other temporary files are removed.
+func (st *HashWriter) interrupt() {
+	if st.partial != "" {
+		// Only record what reached the disk; if the sync
+		// fails, the previous record stays valid.
+		if err := st.dest.Sync(); err == nil {
+			st.cache.writePartialLength(st.partial, st.size)
+		}
+		st.dest.Close()
+	} else {
+		st.abort()
+	}
+}
+
+// abort discards the written data.
+func (st *HashWriter) abort() {
+	st.dest.Close()
+	os.Remove(st.dest.Name())
+	if st.partial != "" {
+		st.cache.removePartialLength(st.partial)
+	}
+}
+
+// closeWant saves the data like Close, but only if it hashes to
+// want.  Otherwise the data is discarded, so an object already
+// stored under the hash it does have is left alone.
+func (st *HashWriter) closeWant(want string) error {
+	if got := st.Sum(); got != want {
+		st.abort()
+		st.cache.mutex.Lock()
+		st.cache.corrupt++
+		st.cache.mutex.Unlock()
+		return &corruptionError{want, got}
+	}
+	return st.Close()
+}
+
+func (st *HashWriter) Close() error {
+	st.dest.Chmod(0444)
 	src := st.dest.Name()
 	dir, _ := filepath.Split(src)
 	sum := st.Sum()
 	sumpath := HashPath(dir, sum)
 
+	// Rename before closing, so a partial file stays locked until
+	// it is out of the way.
 	log.Printf("saving hash %x\n", sum)
-	err = os.Rename(src, sumpath)
+	err := os.Rename(src, sumpath)
 	if err != nil {
-		log.Fatal("Rename failed", err)
+		st.interrupt()
+		return fmt.Errorf("saving %x: %v", sum, err)
+	}
+	if st.partial != "" {
+		st.cache.removePartialLength(st.partial)
+	}
+	if err = st.dest.Close(); err != nil {
+		return err
 	}
+	st.cache.verified.add(sum)
+	st.cache.saved(sumpath, sum)
 
 	dt := time.Now().Sub(st.start)
 
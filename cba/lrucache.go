@@ -10,9 +10,11 @@ type cacheEntry struct {
 	key   string
 	val   interface{}
 	index int
+	bytes int64
 }
 
-// A fixed entry count cache with LRU eviction policy.
+// A fixed entry count cache with LRU eviction policy. Optionally, the
+// total size of []byte values can be capped too, see SetByteLimit.
 //
 // Should be protected by a Mutex (not RWMutex) for all methods.
 type LruCache struct {
@@ -22,6 +24,15 @@ type LruCache struct {
 	lastUsedKeys []*cacheEntry
 	nextEvict    int
 
+	// If positive, evict until the []byte values take at most
+	// this many bytes.
+	byteLimit int64
+	bytes     int64
+
+	// If positive, []byte values larger than this are not
+	// cached.
+	maxItemBytes int64
+
 	// Stats to give some insight if the size of the cache is
 	// right.
 	ages    int64
@@ -41,17 +52,59 @@ func NewLruCache(size int) (me *LruCache) {
 	return me
 }
 
+// SetByteLimit caps the total size of []byte values in the cache. A
+// limit of 0 only caps the entry count.
+func (me *LruCache) SetByteLimit(limit int64) {
+	me.byteLimit = limit
+	if limit <= 0 {
+		return
+	}
+	for i := 0; i < me.size && me.bytes > limit; i++ {
+		me.evict((me.nextEvict + i) % me.size)
+	}
+}
+
+// SetMaxItemBytes keeps []byte values larger than limit out of the
+// cache, so a few large values do not evict many small ones.  A limit
+// of 0 admits values up to the byte limit.
+func (me *LruCache) SetMaxItemBytes(limit int64) {
+	me.maxItemBytes = limit
+}
+
+func (me *LruCache) evict(i int) {
+	e := me.lastUsedKeys[i]
+	if e == nil {
+		return
+	}
+	delete(me.contents, e.key)
+	me.bytes -= e.bytes
+	me.lastUsedKeys[i] = nil
+}
+
 func (me *LruCache) Add(key string, val interface{}) {
-	evict := me.lastUsedKeys[me.nextEvict]
-	if evict != nil {
-		delete(me.contents, evict.key)
+	var sz int64
+	if b, ok := val.([]byte); ok {
+		sz = int64(len(b))
+	}
+	if (me.byteLimit > 0 && sz > me.byteLimit) || (me.maxItemBytes > 0 && sz > me.maxItemBytes) {
+		return
+	}
+	if old, ok := me.contents[key]; ok {
+		me.evict(old.index)
+	}
+
+	me.evict(me.nextEvict)
+	for i := 1; i < me.size && me.byteLimit > 0 && me.bytes+sz > me.byteLimit; i++ {
+		me.evict((me.nextEvict + i) % me.size)
 	}
 
 	e := &cacheEntry{
 		key:   key,
 		val:   val,
 		index: me.nextEvict,
+		bytes: sz,
 	}
+	me.bytes += sz
 
 	me.contents[key] = e
 	me.lastUsedKeys[me.nextEvict] = e
@@ -69,6 +122,13 @@ func (me *LruCache) swap(i, j int) {
 	}
 }
 
+// Remove drops key from the cache, if present.
+func (me *LruCache) Remove(key string) {
+	if e, ok := me.contents[key]; ok {
+		me.evict(e.index)
+	}
+}
+
 func (me *LruCache) Has(key string) bool {
 	_, ok := me.contents[key]
 	return ok
@@ -78,6 +138,22 @@ func (me *LruCache) Size() int {
 	return len(me.contents)
 }
 
+// Bytes returns the total size of the []byte values in the cache.
+func (me *LruCache) Bytes() int64 {
+	return me.bytes
+}
+
+// Keys returns the keys in the cache, most recently used first.
+func (me *LruCache) Keys() []string {
+	keys := make([]string, 0, len(me.contents))
+	for i := 1; i <= me.size; i++ {
+		if e := me.lastUsedKeys[(me.nextEvict-i+me.size)%me.size]; e != nil {
+			keys = append(keys, e.key)
+		}
+	}
+	return keys
+}
+
 func (me *LruCache) AverageAge() int {
 	if me.lookups == 0 {
 		return 0
@@ -1,6 +1,8 @@
 package cba
 
 import (
+	"fmt"
+	"math/rand"
 	"testing"
 )
 
@@ -31,6 +33,17 @@ func TestLruCache(t *testing.T) {
 	}
 }
 
+func TestLruCacheKeys(t *testing.T) {
+	c := NewLruCache(3)
+	for _, k := range []string{"1", "2", "3", "4"} {
+		c.Add(k, k)
+	}
+	c.Get("2")
+	if got, want := fmt.Sprint(c.Keys()), "[2 4 3]"; got != want {
+		t.Errorf("got keys %s, want %s", got, want)
+	}
+}
+
 func TestLruCacheDistance(t *testing.T) {
 	v := interface{}(1)
 	c := NewLruCache(4)
@@ -58,3 +71,115 @@ func TestLruCacheDistance(t *testing.T) {
 		t.Errorf("got average age %d, want 4.", d)
 	}
 }
+
+func TestLruCacheByteLimit(t *testing.T) {
+	c := NewLruCache(10)
+	c.SetByteLimit(10)
+
+	c.Add("1", make([]byte, 4))
+	c.Add("2", make([]byte, 4))
+	if c.Size() != 2 || c.Bytes() != 8 {
+		t.Fatalf("got %d entries, %d bytes, want 2, 8", c.Size(), c.Bytes())
+	}
+
+	c.Add("3", make([]byte, 4))
+	if c.Has("1") {
+		t.Errorf("key 1 should have been evicted")
+	}
+	if !c.Has("2") || !c.Has("3") || c.Bytes() != 8 {
+		t.Errorf("got %d bytes, keys 2: %v, 3: %v", c.Bytes(), c.Has("2"), c.Has("3"))
+	}
+
+	c.Add("big", make([]byte, 11))
+	if c.Has("big") {
+		t.Errorf("value over the byte limit should not be cached")
+	}
+
+	c.Add("2", make([]byte, 2))
+	if c.Size() != 2 || c.Bytes() != 6 {
+		t.Errorf("after replace: got %d entries, %d bytes, want 2, 6", c.Size(), c.Bytes())
+	}
+
+	c.SetByteLimit(3)
+	if c.Bytes() > 3 {
+		t.Errorf("got %d bytes after lowering the limit to 3", c.Bytes())
+	}
+}
+
+func TestLruCacheMaxItemBytes(t *testing.T) {
+	c := NewLruCache(10)
+	c.SetByteLimit(100)
+	c.SetMaxItemBytes(10)
+
+	c.Add("small", make([]byte, 10))
+	c.Add("large", make([]byte, 11))
+	if !c.Has("small") || c.Has("large") {
+		t.Errorf("small: %v, large: %v", c.Has("small"), c.Has("large"))
+	}
+	if c.Bytes() != 10 {
+		t.Errorf("got %d bytes, want 10", c.Bytes())
+	}
+}
+
+// headerWorkload simulates the reads of a build: many small headers
+// with skewed popularity, and now and then a large archive.
+type headerWorkload struct {
+	rnd     *rand.Rand
+	zipf    *rand.Zipf
+	headers [][]byte
+	archive []byte
+}
+
+func newHeaderWorkload() *headerWorkload {
+	rnd := rand.New(rand.NewSource(1))
+	w := &headerWorkload{
+		rnd:     rnd,
+		zipf:    rand.NewZipf(rnd, 1.1, 1, 4999),
+		archive: make([]byte, 100<<20),
+	}
+	for i := 0; i < 5000; i++ {
+		w.headers = append(w.headers, make([]byte, 1<<10+rnd.Intn(31<<10)))
+	}
+	return w
+}
+
+func (w *headerWorkload) next() (string, []byte) {
+	if w.rnd.Intn(100) == 0 {
+		return fmt.Sprintf("archive%d", w.rnd.Intn(20)), w.archive
+	}
+	i := int(w.zipf.Uint64())
+	return fmt.Sprintf("header%d", i), w.headers[i]
+}
+
+func benchmarkLruCacheWorkload(b *testing.B, c *LruCache) {
+	w := newHeaderWorkload()
+	var hits, hitBytes, totalBytes, maxBytes int64
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key, val := w.next()
+		totalBytes += int64(len(val))
+		if c.Get(key) != nil {
+			hits++
+			hitBytes += int64(len(val))
+			continue
+		}
+		c.Add(key, val)
+		if c.Bytes() > maxBytes {
+			maxBytes = c.Bytes()
+		}
+	}
+	b.ReportMetric(float64(hits)/float64(b.N), "hits/op")
+	b.ReportMetric(float64(hitBytes)/float64(totalBytes), "hitbytes/byte")
+	b.ReportMetric(float64(maxBytes>>20), "maxMB")
+}
+
+func BenchmarkLruCacheHeadersByCount(b *testing.B) {
+	benchmarkLruCacheWorkload(b, NewLruCache(1024))
+}
+
+func BenchmarkLruCacheHeadersByBytes(b *testing.B) {
+	c := NewLruCache(1 << 13)
+	c.SetByteLimit(32 << 20)
+	c.SetMaxItemBytes(1 << 20)
+	benchmarkLruCacheWorkload(b, c)
+}
@@ -0,0 +1,181 @@
+package cba
+
+import (
+	"log"
+	"sync"
+)
+
+// Reaping expired objects and stale temporaries, and migrating the
+// store, go through the cache directory object by object, and can
+// keep the disk busy enough to slow down the jobs that use it.  Such
+// maintenance is therefore throttled: every object it handles waits
+// for a token from a bucket filled at Options.MaintenanceOpsPerSec,
+// and maintenance stops between objects while it is paused with
+// PauseMaintenance.  StartMaintenance runs the reaping in a goroutine
+// of its own, so callers do not wait for it.
+
+// Objects per second that maintenance handles, unless
+// Options.MaintenanceOpsPerSec says otherwise.
+const defaultMaintenanceOpsPerSec = 1000
+
+// States of maintenance in MaintenanceStatus.
+const (
+	MaintenanceIdle    = "idle"
+	MaintenanceRunning = "running"
+	MaintenancePaused  = "paused"
+)
+
+// MaintenanceStatus reports on the background maintenance of a
+// store.
+type MaintenanceStatus struct {
+	// One of MaintenanceIdle, MaintenanceRunning or
+	// MaintenancePaused.
+	State string
+
+	// The running operation, if any, with the objects it found,
+	// and how many of those it handled.
+	Operation string
+	Total     int
+	Done      int
+
+	// Objects handled since the store was created.
+	Handled int
+}
+
+type maintenance struct {
+	// Serializes operations.
+	runMutex sync.Mutex
+
+	// Counts operations per second.
+	limiter *rateLimiter
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	// Nesting depth of PauseMaintenance.
+	pauses int
+
+	// Set while StartMaintenance has a pass pending.
+	queued bool
+
+	op      string
+	total   int
+	done    int
+	handled int
+}
+
+func (st *Store) initMaintenance() {
+	m := &st.maintenance
+	m.cond = sync.NewCond(&m.mutex)
+	m.limiter = newRateLimiter(realClock{}, int64(st.Options.MaintenanceOpsPerSec))
+}
+
+// beginMaintenance waits for other operations to finish, and starts
+// op, which will handle up to total objects.  It must be followed by
+// endMaintenance.
+func (st *Store) beginMaintenance(op string, total int) {
+	m := &st.maintenance
+	m.runMutex.Lock()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.op = op
+	m.total = total
+	m.done = 0
+}
+
+func (st *Store) endMaintenance() {
+	m := &st.maintenance
+	m.mutex.Lock()
+	m.op = ""
+	m.total = 0
+	m.done = 0
+	m.mutex.Unlock()
+	m.runMutex.Unlock()
+}
+
+// maintenanceStep is called before handling an object.  It blocks
+// while maintenance is paused, and to keep within
+// Options.MaintenanceOpsPerSec.  Must not hold mutex.
+func (st *Store) maintenanceStep() {
+	m := &st.maintenance
+	m.mutex.Lock()
+	for m.pauses > 0 {
+		m.cond.Wait()
+	}
+	m.mutex.Unlock()
+
+	m.limiter.wait(1)
+
+	m.mutex.Lock()
+	m.done++
+	m.handled++
+	m.mutex.Unlock()
+}
+
+// PauseMaintenance stops maintenance before its next object, until a
+// matching ResumeMaintenance.  Calls nest.
+func (st *Store) PauseMaintenance() {
+	m := &st.maintenance
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pauses++
+}
+
+// ResumeMaintenance undoes PauseMaintenance.
+func (st *Store) ResumeMaintenance() {
+	m := &st.maintenance
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.pauses == 0 {
+		log.Panic("ResumeMaintenance without PauseMaintenance")
+	}
+	m.pauses--
+	if m.pauses == 0 {
+		m.cond.Broadcast()
+	}
+}
+
+// MaintenanceStatus returns the state of the background
+// maintenance.
+func (st *Store) MaintenanceStatus() MaintenanceStatus {
+	m := &st.maintenance
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := MaintenanceStatus{
+		State:     MaintenanceIdle,
+		Operation: m.op,
+		Total:     m.total,
+		Done:      m.done,
+		Handled:   m.handled,
+	}
+	switch {
+	case m.pauses > 0:
+		s.State = MaintenancePaused
+	case m.op != "":
+		s.State = MaintenanceRunning
+	}
+	return s
+}
+
+// StartMaintenance reaps expired objects and stale temporaries in the
+// background.  It does nothing if a previous pass has not finished.
+func (st *Store) StartMaintenance() {
+	m := &st.maintenance
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.queued {
+		return
+	}
+	m.queued = true
+	go func() {
+		if n := st.ReapExpired(); n > 0 {
+			log.Printf("Removed %d expired objects", n)
+		}
+		if n := st.ReapTemporaries(); n > 0 {
+			log.Printf("Removed %d stale temporary files", n)
+		}
+		m.mutex.Lock()
+		m.queued = false
+		m.mutex.Unlock()
+	}()
+}
@@ -0,0 +1,100 @@
+package cba
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMaintenancePauseAndThrottle(t *testing.T) {
+	tc := newCcTestCase()
+	defer tc.Clean()
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	tc.store.maintenance.limiter = newRateLimiter(clock, 1)
+
+	old := time.Now().Add(-2 * tc.store.Options.TempTTL)
+	var stale []string
+	for _, s := range []string{"a", "b", "c"} {
+		p := tc.store.partialPath(md5([]byte(s)))
+		if err := ioutil.WriteFile(p, []byte(s), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+		stale = append(stale, p)
+	}
+
+	if s := tc.store.MaintenanceStatus(); s.State != MaintenanceIdle {
+		t.Errorf("got state %q, want idle", s.State)
+	}
+
+	tc.store.PauseMaintenance()
+	done := make(chan int, 1)
+	go func() { done <- tc.store.ReapTemporaries() }()
+
+	for tc.store.MaintenanceStatus().Operation == "" {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case n := <-done:
+		t.Fatalf("ReapTemporaries removed %d files while paused", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if s := tc.store.MaintenanceStatus(); s.State != MaintenancePaused || s.Total != 3 || s.Done != 0 {
+		t.Errorf("got %+v, want paused at 0 of 3", s)
+	}
+	for _, p := range stale {
+		if _, err := os.Lstat(p); err != nil {
+			t.Errorf("removed while paused: %v", err)
+		}
+	}
+
+	// A fetch resumes meanwhile.
+	now := time.Now()
+	os.Chtimes(stale[0], now, now)
+
+	start := clock.Now()
+	tc.store.ResumeMaintenance()
+	if n := <-done; n != 2 {
+		t.Errorf("ReapTemporaries: got %d, want 2", n)
+	}
+	if _, err := os.Lstat(stale[0]); err != nil {
+		t.Errorf("removed a file in use: %v", err)
+	}
+	if dt := clock.Now().Sub(start); dt != 3*time.Second {
+		t.Errorf("removing 3 files at 1/s took %v", dt)
+	}
+	if s := tc.store.MaintenanceStatus(); s.State != MaintenanceIdle || s.Handled != 3 {
+		t.Errorf("got %+v, want idle after 3 objects", s)
+	}
+}
+
+func TestMaintenanceReapExpiredUnlocked(t *testing.T) {
+	tc := newCcTestCase()
+	defer tc.Clean()
+
+	h := tc.store.SaveWithTTL([]byte("short"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	tc.store.PauseMaintenance()
+	done := make(chan int, 1)
+	go func() { done <- tc.store.ReapExpired() }()
+	for tc.store.MaintenanceStatus().Operation == "" {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The store stays usable while reaping waits, and an object
+	// saved permanently meanwhile survives.
+	if got := tc.store.Save([]byte("short")); got != h {
+		t.Fatalf("Save: got %x, want %x", got, h)
+	}
+	tc.store.ResumeMaintenance()
+	if n := <-done; n != 0 {
+		t.Errorf("ReapExpired: got %d, want 0", n)
+	}
+	if !tc.store.Has(h) {
+		t.Errorf("object saved permanently was reaped")
+	}
+}
@@ -0,0 +1,151 @@
+package cba
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// The master reads the same small objects, mostly headers, over and
+// over, to push them to workers along with jobs.  A Store can keep
+// recently read objects in memory.  The cache is bounded by an entry
+// count (SetMemoryCacheSize), or by the bytes it holds
+// (SetMemoryCacheBytes).  With the latter, a few large archives
+// cannot take the room of thousands of headers, and do not blow up
+// the memory use of the process: objects over a threshold are never
+// cached.  Only ReadContent goes through the cache.  Objects that are
+// deleted or expire are dropped from it.
+
+// Entries of a cache that is bounded by bytes.  Eviction scans the
+// entry slots, so more slots make adding slower.
+const _MEMORY_CACHE_ENTRIES = 1 << 13
+
+// Objects above this size are not cached, if StoreOptions does not
+// say otherwise.
+const _MEMORY_CACHE_MAX_ITEM = 1 << 20
+
+type memoryCache struct {
+	mutex sync.Mutex
+	cache *LruCache
+
+	// Lookups, and their bytes.
+	hits      int64
+	misses    int64
+	hitBytes  int64
+	missBytes int64
+
+	// Counts objects dropped, so a read that raced a removal is
+	// not cached.
+	removals int64
+}
+
+// SetMemoryCacheSize keeps up to entries objects in memory, whatever
+// their size.  Zero disables the cache.
+func (st *Store) SetMemoryCacheSize(entries int) {
+	st.setMemoryCache(entries, 0, 0)
+}
+
+// SetMemoryCacheBytes keeps objects in memory up to a total of bytes.
+// Objects larger than maxItem are not cached; if maxItem is 0, a
+// default is used.  Zero bytes disables the cache.
+func (st *Store) SetMemoryCacheBytes(bytes, maxItem int64) {
+	if maxItem <= 0 {
+		maxItem = _MEMORY_CACHE_MAX_ITEM
+	}
+	entries := 0
+	if bytes > 0 {
+		entries = _MEMORY_CACHE_ENTRIES
+	}
+	st.setMemoryCache(entries, bytes, maxItem)
+}
+
+func (st *Store) setMemoryCache(entries int, bytes, maxItem int64) {
+	st.memory.mutex.Lock()
+	defer st.memory.mutex.Unlock()
+	st.memory.cache = nil
+	if entries <= 0 {
+		return
+	}
+	st.memory.cache = NewLruCache(entries)
+	st.memory.cache.SetByteLimit(bytes)
+	st.memory.cache.SetMaxItemBytes(maxItem)
+}
+
+// ReadContent returns the content of an object, from memory if it is
+// cached.
+func (st *Store) ReadContent(hash string) ([]byte, error) {
+	if st.expired(hash) {
+		return nil, fmt.Errorf("ReadContent: object %x expired", hash)
+	}
+	m := &st.memory
+	m.mutex.Lock()
+	removals := m.removals
+	if m.cache != nil {
+		if v := m.cache.Get(hash); v != nil {
+			content := v.([]byte)
+			m.hits++
+			m.hitBytes += int64(len(content))
+			m.mutex.Unlock()
+			return content, nil
+		}
+	}
+	m.mutex.Unlock()
+
+	if !st.Verify(hash) {
+		return nil, fmt.Errorf("ReadContent: object %x is missing or corrupt", hash)
+	}
+	content, err := ioutil.ReadFile(st.Path(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.cache != nil {
+		m.misses++
+		m.missBytes += int64(len(content))
+		if m.removals == removals {
+			m.cache.Add(hash, content)
+		}
+	}
+	return content, nil
+}
+
+// forget drops an object from the memory cache.
+func (st *Store) forget(hash string) {
+	m := &st.memory
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removals++
+	if m.cache != nil {
+		m.cache.Remove(hash)
+	}
+}
+
+// forgetAll empties the memory cache.
+func (st *Store) forgetAll() {
+	m := &st.memory
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removals++
+	if m.cache != nil {
+		for k := range m.cache.contents {
+			m.cache.Remove(k)
+		}
+	}
+}
+
+// MemoryHitRate returns the fraction of ReadContent calls that were
+// answered from memory, and the fraction of the bytes read that were.
+func (st *Store) MemoryHitRate() (hits, bytes float64) {
+	m := &st.memory
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.hits+m.misses > 0 {
+		hits = float64(m.hits) / float64(m.hits+m.misses)
+	}
+	if m.hitBytes+m.missBytes > 0 {
+		bytes = float64(m.hitBytes) / float64(m.hitBytes+m.missBytes)
+	}
+	return hits, bytes
+}
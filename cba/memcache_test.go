@@ -0,0 +1,112 @@
+package cba
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStoreReadContent(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "term-memcache")
+	defer os.RemoveAll(dir)
+	store := NewStore(&StoreOptions{Dir: dir})
+	store.SetMemoryCacheBytes(100, 10)
+
+	small := store.Save([]byte("small"))
+	large := store.Save([]byte("larger than ten"))
+	for i := 0; i < 2; i++ {
+		if c, err := store.ReadContent(small); err != nil || string(c) != "small" {
+			t.Fatalf("ReadContent: %q, %v", c, err)
+		}
+		if c, err := store.ReadContent(large); err != nil || string(c) != "larger than ten" {
+			t.Fatalf("ReadContent: %q, %v", c, err)
+		}
+	}
+
+	// Only the second read of small is a hit.
+	hits, bytes := store.MemoryHitRate()
+	if hits != 0.25 {
+		t.Errorf("got hit rate %v, want 0.25", hits)
+	}
+	if want := 5.0 / 40; bytes != want {
+		t.Errorf("got byte hit rate %v, want %v", bytes, want)
+	}
+
+	if _, err := store.ReadContent("missing"); err == nil {
+		t.Errorf("ReadContent of a missing object succeeded")
+	}
+}
+
+func TestStoreReadContentInvalidated(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "term-memcache")
+	defer os.RemoveAll(dir)
+	store := NewStore(&StoreOptions{Dir: dir})
+	store.SetMemoryCacheSize(10)
+
+	h := store.Save([]byte("deleted"))
+	store.ReadContent(h)
+	if err := store.Delete(h); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if c, err := store.ReadContent(h); err == nil {
+		t.Errorf("ReadContent after Delete: got %q", c)
+	}
+
+	h = store.SaveWithTTL([]byte("expires"), time.Millisecond)
+	store.ReadContent(h)
+	time.Sleep(5 * time.Millisecond)
+	if c, err := store.ReadContent(h); err == nil {
+		t.Errorf("ReadContent after expiry: got %q", c)
+	}
+
+	h = store.Save([]byte("all"))
+	store.ReadContent(h)
+	if err := store.DeleteAll(); err != nil {
+		t.Fatalf("DeleteAll: %v", err)
+	}
+	if c, err := store.ReadContent(h); err == nil {
+		t.Errorf("ReadContent after DeleteAll: got %q", c)
+	}
+}
+
+func TestStoreWarmCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "term-memcache")
+	defer os.RemoveAll(dir)
+	opts := StoreOptions{Dir: dir, MemoryCacheBytes: 100, WarmCacheOnStart: true}
+	store := NewStore(&opts)
+
+	var hashes []string
+	for _, c := range []string{"kept", "deleted", "unread"} {
+		hashes = append(hashes, store.Save([]byte(c)))
+	}
+	for _, h := range hashes[:2] {
+		store.ReadContent(h)
+	}
+	if err := store.SaveMemoryCache(); err != nil {
+		t.Fatalf("SaveMemoryCache: %v", err)
+	}
+	if err := store.Delete(hashes[1]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	opts = StoreOptions{Dir: dir, MemoryCacheBytes: 100, WarmCacheOnStart: true}
+	store = NewStore(&opts)
+	for i, want := range []bool{true, false, false} {
+		if got := store.memory.cache.Has(hashes[i]); got != want {
+			t.Errorf("object %d: in memory %v, want %v", i, got, want)
+		}
+	}
+	if c, err := store.ReadContent(hashes[0]); err != nil || string(c) != "kept" {
+		t.Errorf("ReadContent: %q, %v", c, err)
+	}
+	if hits, _ := store.MemoryHitRate(); hits != 1 {
+		t.Errorf("got hit rate %v, want 1", hits)
+	}
+
+	// The list is used once.
+	store = NewStore(&opts)
+	if store.memory.cache.Size() != 0 {
+		t.Errorf("warmed twice: %d objects", store.memory.cache.Size())
+	}
+}
@@ -0,0 +1,296 @@
+package cba
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/termite/fastpath"
+	"github.com/hanwen/termite/stats"
+)
+
+// A store can be moved to another directory, for example on a new
+// disk, while it is in use.  MigrateTo links or copies the objects to
+// the new directory, while lookups and saves keep using the old one.
+// Objects saved in the meantime are recorded, and migrated before the
+// store switches over.  After the switch, the old copies are removed.
+
+// Log progress after this many objects.
+const _MIGRATE_LOG_INTERVAL = 10000
+
+// MigrationProgress reports on a running MigrateTo.
+type MigrationProgress struct {
+	// The destination directory.
+	Dir string
+
+	// Objects found in the old directory, and how many of those
+	// were migrated.
+	Objects int
+	Done    int
+
+	// Bytes copied because the directories are on different file
+	// systems.
+	Copied stats.MemCounter
+
+	// Objects that did not match their hash.  They are dropped.
+	Corrupt int
+}
+
+type migration struct {
+	MigrationProgress
+	from string
+
+	// Objects saved in the old directory during the migration.
+	saved []string
+}
+
+// Replaced in tests, to simulate directories on different file
+// systems.
+var linkObject = os.Link
+
+// MigrateTo moves the objects to dir.  Objects are hard linked if
+// possible, and copied and verified otherwise.  The store keeps
+// serving from its current directory until all objects are in dir,
+// and then switches over atomically.  Options.LowerDir is not
+// affected.  Objects are migrated at the pace of other maintenance.
+func (st *Store) MigrateTo(dir string) error {
+	dir = filepath.Clean(dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	st.mutex.Lock()
+	from := st.Dir()
+	if st.migration != nil {
+		st.mutex.Unlock()
+		return fmt.Errorf("MigrateTo: migration to %s in progress", st.migration.Dir)
+	}
+	if from == dir {
+		st.mutex.Unlock()
+		return fmt.Errorf("MigrateTo: store is already in %s", dir)
+	}
+	m := &migration{
+		MigrationProgress: MigrationProgress{Dir: dir},
+		from:              from,
+	}
+	st.migration = m
+	st.mutex.Unlock()
+
+	hashes, err := listObjects(from)
+	if err != nil {
+		st.abortMigration()
+		return err
+	}
+	st.mutex.Lock()
+	m.Objects = len(hashes)
+	st.mutex.Unlock()
+	log.Printf("migrating %d objects from %s to %s", len(hashes), from, dir)
+
+	st.beginMaintenance("migrate to "+dir, len(hashes))
+	defer st.endMaintenance()
+	for i, h := range hashes {
+		st.maintenanceStep()
+		if err := st.migrateObject(from, dir, h); err != nil {
+			st.abortMigration()
+			return fmt.Errorf("MigrateTo: object %x: %v", h, err)
+		}
+		st.mutex.Lock()
+		m.Done++
+		st.mutex.Unlock()
+		if (i+1)%_MIGRATE_LOG_INTERVAL == 0 {
+			log.Printf("migrated %d of %d objects to %s", i+1, len(hashes), dir)
+		}
+	}
+
+	// Catch up with saves, and switch over once there are none
+	// left.
+	for {
+		st.mutex.Lock()
+		saved := m.saved
+		m.saved = nil
+		if len(saved) == 0 {
+			break
+		}
+		st.mutex.Unlock()
+		for _, h := range saved {
+			if err := st.migrateObject(from, dir, h); err != nil {
+				st.abortMigration()
+				return fmt.Errorf("MigrateTo: object %x: %v", h, err)
+			}
+		}
+		hashes = append(hashes, saved...)
+	}
+	st.dirMutex.Lock()
+	st.dir = dir
+	st.dirMutex.Unlock()
+	st.migration = nil
+	err = st.writeExpiryLog()
+	progress := m.MigrationProgress
+	st.mutex.Unlock()
+	if err != nil {
+		log.Println("MigrateTo:", err)
+	}
+
+	for _, h := range hashes {
+		if err := os.Remove(objectPath(from, h)); err != nil && !os.IsNotExist(err) {
+			log.Println("MigrateTo:", err)
+		}
+	}
+	removeEmptyPrefixDirs(from)
+	os.Remove(fastpath.Join(from, expiryLogName))
+
+	log.Printf("migrated %d objects from %s to %s; copied %v, %d corrupt",
+		len(hashes), from, dir, progress.Copied, progress.Corrupt)
+	return nil
+}
+
+func (st *Store) abortMigration() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.migration = nil
+}
+
+// saved is called after an object was stored at path.  During a
+// migration, the object is recorded to be migrated before the
+// switch.  If the store switched over already, the object is moved
+// now.
+func (st *Store) saved(path, hash string) {
+	st.clearExpiry(hash)
+	dir := filepath.Dir(filepath.Dir(path))
+
+	st.mutex.Lock()
+	if m := st.migration; m != nil && m.from == dir {
+		m.saved = append(m.saved, hash)
+		st.mutex.Unlock()
+		return
+	}
+	st.mutex.Unlock()
+
+	if cur := st.Dir(); cur != dir {
+		if err := st.migrateObject(dir, cur, hash); err != nil {
+			log.Printf("object %x saved in %s after migration: %v", hash, dir, err)
+			return
+		}
+		os.Remove(path)
+	}
+}
+
+// migrateObject puts the object for hash from directory from into
+// directory to.  Objects that disappear before they are migrated are
+// skipped.
+func (st *Store) migrateObject(from, to, hash string) error {
+	src := objectPath(from, hash)
+	dst := HashPath(to, hash)
+	if _, err := os.Lstat(dst); err == nil {
+		return nil
+	}
+
+	// Objects are removed from both directories while migrating,
+	// so a link cannot revive a removed object.
+	err := linkObject(src, dst)
+	if err == nil || os.IsExist(err) || os.IsNotExist(err) {
+		return nil
+	}
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+	return st.copyObject(src, dst, hash)
+}
+
+func (st *Store) copyObject(src, dst, hash string) error {
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	dir, _ := filepath.Split(dst)
+	out, err := ioutil.TempFile(dir, ".hashtemp")
+	if err != nil {
+		return err
+	}
+	h := st.Options.Hash.New()
+	n, err := io.Copy(io.MultiWriter(out, h), in)
+	if err == nil {
+		err = out.Chmod(0444)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if string(h.Sum(nil)) != hash {
+		log.Printf("not migrating corrupt object %x", hash)
+		os.Remove(out.Name())
+		st.corrupt++
+		if st.migration != nil {
+			st.migration.Corrupt++
+		}
+		return nil
+	}
+	if _, err := os.Lstat(src); err != nil {
+		// Removed while we copied.
+		os.Remove(out.Name())
+		return nil
+	}
+	if err := os.Rename(out.Name(), dst); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	if st.migration != nil {
+		st.migration.Copied += stats.MemCounter(n)
+	}
+	return nil
+}
+
+// listObjects returns the hashes of the objects stored in dir.
+func listObjects(dir string) ([]string, error) {
+	prefixes, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var hashes []string
+	for _, p := range prefixes {
+		if !p.IsDir() || len(p.Name()) != 2 {
+			continue
+		}
+		entries, err := ioutil.ReadDir(fastpath.Join(dir, p.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() || e.Name()[0] == '.' {
+				continue
+			}
+			h, err := hex.DecodeString(p.Name() + e.Name())
+			if err != nil {
+				continue
+			}
+			hashes = append(hashes, string(h))
+		}
+	}
+	return hashes, nil
+}
+
+func removeEmptyPrefixDirs(dir string) {
+	prefixes, _ := ioutil.ReadDir(dir)
+	for _, p := range prefixes {
+		if p.IsDir() && len(p.Name()) == 2 {
+			// Fails if the directory is not empty.
+			os.Remove(fastpath.Join(dir, p.Name()))
+		}
+	}
+}
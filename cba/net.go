@@ -13,13 +13,16 @@ func (c *Store) ServeConn(conn io.ReadWriteCloser) {
 	s := c.newServer()
 	rpcServer := rpc.NewServer()
 	rpcServer.RegisterName("Server", s)
-	rpcServer.ServeConn(conn)
+	rpcServer.ServeCodec(newContentServerCodec(conn))
 	conn.Close()
 	s.Close()
 }
 
 type Server interface {
 	ServeChunk(req *Request, rep *Response) (err error)
+
+	// Ping does nothing, for checking the connection.
+	Ping(req *Request, rep *Response) error
 	Close()
 }
 
@@ -34,10 +37,15 @@ func (s *contentServer) Close() {
 	// nop.
 }
 
+func (s *contentServer) Ping(req *Request, rep *Response) error {
+	return nil
+}
+
 func (s *contentServer) ServeChunk(req *Request, rep *Response) (err error) {
 	start := time.Now()
 	err = s.store.ServeChunk(req, rep)
-	s.store.addThroughput(0, int64(len(rep.Chunk)))
+	s.store.addChunkServed(len(rep.Chunk))
+	s.store.limiter.wait(len(rep.Chunk))
 	dt := time.Now().Sub(start)
 	s.store.AddTiming("ServeChunk", len(rep.Chunk), dt)
 	return err
@@ -58,6 +66,9 @@ func (st *Store) ServeChunk(req *Request, rep *Response) (err error) {
 	defer f.Close()
 
 	sz := defaultServeSize
+	if req.End > req.Start && req.End-req.Start < sz {
+		sz = req.End - req.Start
+	}
 	rep.Chunk = make([]byte, sz)
 	n, err := f.ReadAt(rep.Chunk, int64(req.Start))
 	rep.Chunk = rep.Chunk[:n]
@@ -2,11 +2,16 @@ package cba
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/rpc"
 	"os"
+	"path/filepath"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hanwen/go-fuse/splice"
 )
@@ -36,7 +41,13 @@ func unixSocketpair() (l *os.File, r *os.File, err error) {
 func (tc *netTestCase) Clean() {
 	tc.sockS.Close()
 	tc.sockC.Close()
-	os.RemoveAll(tc.tmp)
+	for _, s := range []*Store{tc.server, tc.clientStore} {
+		if err := s.DeleteAll(); err != nil {
+			tc.tester.Errorf("DeleteAll: %v", err)
+		}
+		os.Remove(s.Dir())
+	}
+	os.Remove(tc.tmp)
 	if tc.startSplices != splice.Used() {
 		tc.tester.Fatalf("Splice leak before %d after %d",
 			tc.startSplices, splice.Used())
@@ -111,3 +122,673 @@ func TestNetLargeFile(t *testing.T) {
 		t.Errorf("after fetch, the hash should be there")
 	}
 }
+
+func TestNetLargeFileParallel(t *testing.T) {
+	b := make([]byte, 5*defaultServeSize+17)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+
+	for _, n := range []int{1, 3} {
+		tc := newNetTestCase(t)
+		tc.clientStore.Options.FetchConcurrency = n
+
+		hash := tc.server.Save(b)
+		if got, err := tc.client.Fetch(hash, int64(len(b))); !got || err != nil {
+			t.Fatalf("Fetch(concurrency %d): %v, %v", n, got, err)
+		}
+		content, err := ioutil.ReadFile(tc.clientStore.Path(hash))
+		if err != nil || bytes.Compare(content, b) != 0 {
+			t.Errorf("concurrency %d: content mismatch, err %v", n, err)
+		}
+
+		different := hash[1:] + "x"
+		if got, err := tc.client.Fetch(different, int64(len(b))); got || err != nil {
+			t.Errorf("concurrency %d: non-existent fetch should return false without error: %v %v", n, got, err)
+		}
+		tc.Clean()
+	}
+}
+
+func TestNetResumePartial(t *testing.T) {
+	b := make([]byte, 5*defaultServeSize+17)
+	for i := range b {
+		b[i] = byte(i * 11)
+	}
+	prefix := 2*defaultServeSize + 5
+
+	for _, n := range []int{1, 3} {
+		tc := newNetTestCase(t)
+		tc.clientStore.Options.FetchConcurrency = n
+
+		hash := tc.server.Save(b)
+		partial := tc.clientStore.partialPath(hash)
+		if err := ioutil.WriteFile(partial, b[:prefix], 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		tc.clientStore.writePartialLength(hash, prefix)
+		if got, err := tc.client.Fetch(hash, int64(len(b))); !got || err != nil {
+			t.Fatalf("Fetch(concurrency %d): %v, %v", n, got, err)
+		}
+		content, err := ioutil.ReadFile(tc.clientStore.Path(hash))
+		if err != nil || bytes.Compare(content, b) != 0 {
+			t.Errorf("concurrency %d: content mismatch, err %v", n, err)
+		}
+		if received, _ := tc.clientStore.Totals(); received != int64(len(b)-prefix) {
+			t.Errorf("concurrency %d: received %d bytes, want %d", n, received, len(b)-prefix)
+		}
+		if _, err := os.Lstat(partial); err == nil {
+			t.Errorf("concurrency %d: partial file left behind", n)
+		}
+		if _, err := os.Lstat(partial + partialLengthSuffix); err == nil {
+			t.Errorf("concurrency %d: length record left behind", n)
+		}
+		tc.Clean()
+	}
+}
+
+func TestNetResumeRecordedLength(t *testing.T) {
+	b := make([]byte, 5*defaultServeSize+17)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	prefix := 2*defaultServeSize + 5
+	garbage := append(append([]byte{}, b[:prefix]...), make([]byte, 1000)...)
+
+	for _, record := range []bool{true, false} {
+		tc := newNetTestCase(t)
+		hash := tc.server.Save(b)
+
+		// A crash can leave bytes past the last recorded
+		// length, here zeros.
+		partial := tc.clientStore.partialPath(hash)
+		if err := ioutil.WriteFile(partial, garbage, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		want := len(b)
+		if record {
+			tc.clientStore.writePartialLength(hash, prefix)
+			want -= prefix
+		}
+		if got, err := tc.client.Fetch(hash, int64(len(b))); !got || err != nil {
+			t.Fatalf("record %v: Fetch: %v, %v", record, got, err)
+		}
+		if received, _ := tc.clientStore.Totals(); received != int64(want) {
+			t.Errorf("record %v: received %d bytes, want %d", record, received, want)
+		}
+		content, err := ioutil.ReadFile(tc.clientStore.Path(hash))
+		if err != nil || bytes.Compare(content, b) != 0 {
+			t.Errorf("record %v: content mismatch, err %v", record, err)
+		}
+		tc.Clean()
+	}
+}
+
+// chunkServer serves chunks from a store, and lets tests watch and
+// change what goes over the wire.
+type chunkServer struct {
+	store *Store
+
+	mutex  sync.Mutex
+	starts []int
+
+	// If set, called on each response.
+	hook func(req *Request, rep *Response)
+}
+
+func (s *chunkServer) ServeChunk(req *Request, rep *Response) error {
+	s.mutex.Lock()
+	s.starts = append(s.starts, req.Start)
+	s.mutex.Unlock()
+	if err := s.store.ServeChunk(req, rep); err != nil {
+		return err
+	}
+	if s.hook != nil {
+		s.hook(req, rep)
+	}
+	return nil
+}
+
+func (s *chunkServer) Ping(req *Request, rep *Response) error {
+	return nil
+}
+
+// firstStart returns the lowest offset asked for.
+func (s *chunkServer) firstStart() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	first := -1
+	for _, st := range s.starts {
+		if first < 0 || st < first {
+			first = st
+		}
+	}
+	return first
+}
+
+// connect returns a client for store that fetches from s.  If wrap
+// is set, the client reads through what it returns for the client
+// side of the connection.
+func (s *chunkServer) connect(t *testing.T, store *Store, wrap func(*os.File) io.ReadWriteCloser) *Client {
+	sockS, sockC, err := unixSocketpair()
+	if err != nil {
+		t.Fatalf("unixSocketpair: %v", err)
+	}
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName("Server", s)
+	go func() {
+		rpcServer.ServeCodec(newContentServerCodec(sockS))
+		sockS.Close()
+	}()
+	var conn io.ReadWriteCloser = sockC
+	if wrap != nil {
+		conn = wrap(sockC)
+	}
+	return store.NewClient(conn)
+}
+
+func TestNetParallelWindow(t *testing.T) {
+	tc := newNetTestCase(t)
+	defer tc.Clean()
+	tc.clientStore.Options.FetchConcurrency = 3
+	b := make([]byte, 20*defaultServeSize)
+	for i := range b {
+		b[i] = byte(i * 31)
+	}
+	hash := tc.server.Save(b)
+
+	// The first chunk is held back; the others must not be
+	// requested more than the window ahead of it.
+	release := make(chan bool)
+	s := &chunkServer{
+		store: tc.server,
+		hook: func(req *Request, rep *Response) {
+			if req.Start == 0 {
+				<-release
+			}
+		},
+	}
+	client := s.connect(t, tc.clientStore, nil)
+	defer client.Close()
+	done := make(chan bool)
+	go func() {
+		if got, err := client.Fetch(hash, int64(len(b))); !got || err != nil {
+			t.Errorf("Fetch: %v, %v", got, err)
+		}
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	s.mutex.Lock()
+	for _, st := range s.starts {
+		if st >= 3*defaultServeSize {
+			t.Errorf("requested offset %d while the first chunk was outstanding", st)
+		}
+	}
+	s.mutex.Unlock()
+	close(release)
+	<-done
+}
+
+func TestNetResumeAfterDrop(t *testing.T) {
+	b := make([]byte, 20*defaultServeSize+3)
+	for i := range b {
+		b[i] = byte(i * 17)
+	}
+
+	for _, n := range []int{1, 3} {
+		tc := newNetTestCase(t)
+		tc.clientStore.Options.FetchConcurrency = n
+		hash := tc.server.Save(b)
+
+		// Drop the connection in the middle of the transfer.
+		// Later chunks are slowed down, so parallel fetches get
+		// the first ones before.
+		first := &chunkServer{
+			store: tc.server,
+			hook: func(req *Request, rep *Response) {
+				if req.Start >= 2*defaultServeSize {
+					time.Sleep(10 * time.Millisecond)
+				}
+			},
+		}
+		client := first.connect(t, tc.clientStore, func(sock *os.File) io.ReadWriteCloser {
+			return &cancellingConn{
+				ReadWriteCloser: sock,
+				left:            3 * defaultServeSize,
+				cancel:          func() { syscall.Shutdown(int(sock.Fd()), syscall.SHUT_RDWR) },
+			}
+		})
+		if got, err := client.Fetch(hash, int64(len(b))); got || err == nil {
+			t.Fatalf("concurrency %d: Fetch over dropped connection: %v, %v", n, got, err)
+		}
+		client.Close()
+
+		second := &chunkServer{store: tc.server}
+		client = second.connect(t, tc.clientStore, nil)
+		if got, err := client.Fetch(hash, int64(len(b))); !got || err != nil {
+			t.Fatalf("concurrency %d: resumed Fetch: %v, %v", n, got, err)
+		}
+		client.Close()
+		if start := second.firstStart(); start <= 0 {
+			t.Errorf("concurrency %d: second attempt started at %d", n, start)
+		}
+		content, err := ioutil.ReadFile(tc.clientStore.Path(hash))
+		if err != nil || bytes.Compare(content, b) != 0 {
+			t.Errorf("concurrency %d: content mismatch, err %v", n, err)
+		}
+		tc.Clean()
+	}
+}
+
+func TestNetChunkValidation(t *testing.T) {
+	b := make([]byte, 3*defaultServeSize+11)
+	for i := range b {
+		b[i] = byte(i * 5)
+	}
+
+	for _, n := range []int{1, 3} {
+		tc := newNetTestCase(t)
+		tc.clientStore.Options.FetchConcurrency = n
+		hash := tc.server.Save(b)
+
+		// The server claims more bytes than it sends.
+		s := &chunkServer{
+			store: tc.server,
+			hook: func(req *Request, rep *Response) {
+				if req.Start > 0 {
+					rep.Chunk = rep.Chunk[:rep.Size/2]
+				}
+			},
+		}
+		client := s.connect(t, tc.clientStore, nil)
+		if got, err := client.Fetch(hash, int64(len(b))); got || err == nil {
+			t.Errorf("concurrency %d: Fetch of short chunks: %v, %v", n, got, err)
+		}
+		client.Close()
+		if tc.clientStore.Has(hash) {
+			t.Errorf("concurrency %d: short data was saved", n)
+		}
+		tc.Clean()
+	}
+}
+
+// cancellingConn cancels a fetch once it has read a given number of
+// bytes.
+type cancellingConn struct {
+	io.ReadWriteCloser
+	left   int
+	cancel func()
+}
+
+func (c *cancellingConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	if c.left > 0 {
+		c.left -= n
+		if c.left <= 0 {
+			c.cancel()
+		}
+	}
+	return n, err
+}
+
+func TestNetCancelResume(t *testing.T) {
+	b := make([]byte, 20*defaultServeSize+3)
+	for i := range b {
+		b[i] = byte(i * 13)
+	}
+
+	for _, n := range []int{1, 3} {
+		tc := newNetTestCase(t)
+		tc.clientStore.Options.FetchConcurrency = n
+		hash := tc.server.Save(b)
+
+		sockS, sockC, err := unixSocketpair()
+		if err != nil {
+			t.Fatalf("unixSocketpair: %v", err)
+		}
+		served := make(chan bool)
+		go func() {
+			tc.server.ServeConn(sockS)
+			close(served)
+		}()
+		conn := &cancellingConn{ReadWriteCloser: sockC, left: 3 * defaultServeSize}
+		client := tc.clientStore.NewClient(conn)
+		conn.cancel = func() { client.Cancel(hash) }
+
+		if got, err := client.Fetch(hash, int64(len(b))); got || err != CancelledError {
+			t.Fatalf("concurrency %d: cancelled Fetch returned %v, %v", n, got, err)
+		}
+		// Closing does not wake up the blocked reader, so shut
+		// down the socket to let the server finish.
+		syscall.Shutdown(int(sockC.Fd()), syscall.SHUT_RDWR)
+		client.Close()
+		<-served
+
+		fi, err := os.Lstat(tc.clientStore.partialPath(hash))
+		if err != nil {
+			t.Fatalf("concurrency %d: no partial after cancel: %v", n, err)
+		}
+		if fi.Size() < 2*int64(defaultServeSize) || fi.Size() >= int64(len(b)) {
+			t.Fatalf("concurrency %d: partial has %d bytes", n, fi.Size())
+		}
+
+		before, _ := tc.clientStore.Totals()
+		if got, err := tc.client.Fetch(hash, int64(len(b))); !got || err != nil {
+			t.Fatalf("concurrency %d: resumed Fetch: %v, %v", n, got, err)
+		}
+		after, _ := tc.clientStore.Totals()
+		if after-before != int64(len(b))-fi.Size() {
+			t.Errorf("concurrency %d: resume received %d bytes, want %d", n, after-before, int64(len(b))-fi.Size())
+		}
+		content, err := ioutil.ReadFile(tc.clientStore.Path(hash))
+		if err != nil || bytes.Compare(content, b) != 0 {
+			t.Errorf("concurrency %d: content mismatch, err %v", n, err)
+		}
+		tc.Clean()
+	}
+}
+
+func TestNetRecoverCorruption(t *testing.T) {
+	tc := newNetTestCase(t)
+	defer tc.Clean()
+
+	b := []byte("hello world")
+	hash := tc.server.Save(b)
+	if got, err := tc.client.FetchOnce(hash, int64(len(b))); !got || err != nil {
+		t.Fatalf("FetchOnce: %v, %v", got, err)
+	}
+
+	// A crash during save can leave an empty file.
+	p := tc.clientStore.Path(hash)
+	os.Remove(p)
+	if err := ioutil.WriteFile(p, nil, 0444); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if tc.clientStore.Has(hash) {
+		t.Fatalf("Has should reject the empty file")
+	}
+	if got, err := tc.client.FetchOnce(hash, int64(len(b))); !got || err != nil {
+		t.Fatalf("FetchOnce after truncation: %v, %v", got, err)
+	}
+	if content, err := ioutil.ReadFile(p); err != nil || bytes.Compare(content, b) != 0 {
+		t.Errorf("got %q, %v; want %q", content, err, b)
+	}
+
+	// Corrupt the server side: the fetch fails, but does not bring
+	// down the client.  The client already has the content the
+	// server sends, which must survive.
+	bad := tc.server.Path(hash)
+	os.Remove(bad)
+	if err := ioutil.WriteFile(bad, []byte("hello wOrld"), 0444); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := tc.clientStore.Delete(hash); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	other := tc.clientStore.Save([]byte("hello wOrld"))
+	got, err := tc.client.Fetch(hash, int64(len(b)))
+	if _, ok := err.(*corruptionError); got || !ok {
+		t.Errorf("Fetch of corrupt data: got %v, %v", got, err)
+	}
+	if tc.clientStore.Has(hash) {
+		t.Errorf("corrupt data was kept")
+	}
+	if !tc.clientStore.Has(other) {
+		t.Errorf("existing object %x was removed", other)
+	}
+}
+
+func TestNetVerifyRefetch(t *testing.T) {
+	tc := newNetTestCase(t)
+	defer tc.Clean()
+
+	b := []byte("hello world")
+	hash := tc.server.Save(b)
+
+	// An object that was not written by this process, and was
+	// damaged on disk.
+	p := tc.clientStore.Path(hash)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := ioutil.WriteFile(p, []byte("hello wOrld"), 0444); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if !tc.clientStore.Has(hash) {
+		t.Fatalf("Has should not rehash non-empty objects")
+	}
+	if tc.clientStore.Verify(hash) || tc.clientStore.Has(hash) {
+		t.Fatalf("Verify should remove the corrupt object")
+	}
+	if got, err := tc.client.FetchOnce(hash, int64(len(b))); !got || err != nil {
+		t.Fatalf("FetchOnce: %v, %v", got, err)
+	}
+	if content, err := tc.clientStore.ReadContent(hash); err != nil || bytes.Compare(content, b) != 0 {
+		t.Errorf("got %q, %v; want %q", content, err, b)
+	}
+	if !tc.clientStore.Verify(hash) {
+		t.Errorf("Verify rejects fetched object")
+	}
+}
+
+func TestNetStoreStats(t *testing.T) {
+	tc := newNetTestCase(t)
+	defer tc.Clean()
+
+	b := []byte("hello")
+	hash := tc.server.Save(b)
+	for i := 0; i < 3; i++ {
+		if got, err := tc.client.FetchOnce(hash, int64(len(b))); !got || err != nil {
+			t.Fatalf("FetchOnce: %v, %v", got, err)
+		}
+	}
+
+	c := tc.clientStore.Stats()
+	if c.Lookups != 3 || c.Hits != 2 || c.Fetches != 1 {
+		t.Errorf("client stats: got %d lookups, %d hits, %d fetches; want 3, 2, 1", c.Lookups, c.Hits, c.Fetches)
+	}
+	if s := tc.server.Stats(); s.ChunksServed != 1 {
+		t.Errorf("server stats: got %d chunks served, want 1", s.ChunksServed)
+	}
+}
+
+func TestNetPrefetchLookups(t *testing.T) {
+	tc := newNetTestCase(t)
+	defer tc.Clean()
+
+	b := []byte("prefetched")
+	hash := tc.server.Save(b)
+
+	// Prefetch and the open that follows count one miss, however
+	// far the prefetch got.
+	tc.client.Prefetch(map[string]int64{hash: int64(len(b))})
+	if got, err := tc.client.FetchOnce(hash, int64(len(b))); !got || err != nil {
+		t.Fatalf("FetchOnce: %v, %v", got, err)
+	}
+	if hits, misses := tc.client.Lookups(); hits != 0 || misses != 1 {
+		t.Errorf("after prefetch: got %d hits, %d misses, want 0, 1", hits, misses)
+	}
+
+	// The next open finds it.
+	if got, err := tc.client.FetchOnce(hash, int64(len(b))); !got || err != nil {
+		t.Fatalf("FetchOnce: %v, %v", got, err)
+	}
+	tc.client.Prefetch(map[string]int64{hash: int64(len(b))})
+	if got, err := tc.client.FetchOnce(hash, int64(len(b))); !got || err != nil {
+		t.Fatalf("FetchOnce: %v, %v", got, err)
+	}
+	if hits, misses := tc.client.Lookups(); hits != 2 || misses != 1 {
+		t.Errorf("got %d hits, %d misses, want 2, 1", hits, misses)
+	}
+	if c := tc.clientStore.Stats(); c.Lookups != 3 || c.Hits != 2 {
+		t.Errorf("store stats: got %d lookups, %d hits, want 3, 2", c.Lookups, c.Hits)
+	}
+}
+
+// sendReply passes rep through the codecs of a content connection.
+func sendReply(t *testing.T, rep *Response) *Response {
+	l, r, err := unixSocketpair()
+	if err != nil {
+		t.Fatalf("unixSocketpair: %v", err)
+	}
+	defer l.Close()
+	defer r.Close()
+
+	done := make(chan bool)
+	go func() {
+		newContentServerCodec(l).WriteResponse(&rpc.Response{ServiceMethod: "Server.ServeChunk"}, rep)
+		close(done)
+	}()
+	defer func() { <-done }()
+	cc := newContentClientCodec(r)
+	got := &Response{}
+	if err := cc.ReadResponseHeader(&rpc.Response{}); err != nil {
+		t.Fatalf("ReadResponseHeader: %v", err)
+	}
+	if err := cc.ReadResponseBody(got); err != nil {
+		t.Fatalf("ReadResponseBody: %v", err)
+	}
+	return got
+}
+
+func TestSpliceServerRange(t *testing.T) {
+	tc := newCcTestCase()
+	defer tc.Clean()
+	start := splice.Used()
+
+	b := make([]byte, 3*defaultServeSize+17)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	hash := tc.store.Save(b)
+	s := newSpliceServer(tc.store)
+
+	for _, r := range [][2]int{
+		{defaultServeSize, 2 * defaultServeSize},
+		{0, spliceRangeThreshold},
+		{3 * defaultServeSize, len(b)},
+		{10, 20},
+	} {
+		req := &Request{Hash: hash, Start: r[0], End: r[1]}
+		rep := &Response{}
+		if err := s.ServeChunk(req, rep); err != nil {
+			t.Fatalf("ServeChunk %v: %v", req, err)
+		}
+		if r[1]-r[0] >= spliceRangeThreshold && rep.file == nil {
+			t.Errorf("%v: not spliced", req)
+		}
+		got := sendReply(t, rep)
+		if !got.Have || bytes.Compare(got.Chunk, b[r[0]:r[1]]) != 0 {
+			t.Errorf("%v: content mismatch, got %d bytes", req, got.Size)
+		}
+	}
+	if len(s.files) != 1 || s.files[hash].refs != 0 {
+		t.Errorf("got open files %v, want one idle file", s.files)
+	}
+
+	// Deleting the object forgets its file; a range in flight is
+	// still served from it.
+	rep := &Response{}
+	if err := s.ServeChunk(&Request{Hash: hash, Start: 0, End: defaultServeSize}, rep); err != nil || rep.file == nil {
+		t.Fatalf("ServeChunk: %v, file %v", err, rep.file)
+	}
+	if err := tc.store.Delete(hash); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if len(s.files) != 0 {
+		t.Errorf("Delete left files open: %v", s.files)
+	}
+	if got := sendReply(t, rep); bytes.Compare(got.Chunk, b[:defaultServeSize]) != 0 {
+		t.Errorf("range in flight: content mismatch, got %d bytes", got.Size)
+	}
+	if _, err := rep.file.Stat(); err == nil {
+		t.Errorf("file of deleted object still open")
+	}
+
+	rep = &Response{}
+	if err := s.ServeChunk(&Request{Hash: hash, Start: 0, End: defaultServeSize}, rep); err != nil || rep.Have {
+		t.Errorf("deleted hash: got Have %v, err %v", rep.Have, err)
+	}
+
+	missing := &Request{Hash: hash[1:] + "x", Start: 0, End: defaultServeSize}
+	if err := s.ServeChunk(missing, rep); err != nil || rep.Have {
+		t.Errorf("missing hash: got Have %v, err %v", rep.Have, err)
+	}
+
+	s.Close()
+	if len(s.files) != 0 {
+		t.Errorf("Close left files open: %v", s.files)
+	}
+	if splice.Used() != start {
+		t.Errorf("splice leak: before %d after %d", start, splice.Used())
+	}
+}
+
+func TestNetPrefetch(t *testing.T) {
+	tc := newNetTestCase(t)
+	defer tc.Clean()
+
+	objects := map[string]int64{}
+	for i := 0; i < 10; i++ {
+		b := []byte(fmt.Sprintf("object %d", i))
+		objects[tc.server.Save(b)] = int64(len(b))
+	}
+	local := []byte("already here")
+	tc.server.Save(local)
+	objects[tc.clientStore.Save(local)] = int64(len(local))
+
+	tc.client.Prefetch(objects)
+	tc.client.Prefetch(objects)
+
+	limit := tc.clientStore.Options.PrefetchConcurrency
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		tc.client.mutex.Lock()
+		n := len(tc.client.prefetching)
+		workers := tc.client.prefetchWorkers
+		tc.client.mutex.Unlock()
+		if workers > limit {
+			t.Fatalf("%d prefetch workers, want at most %d", workers, limit)
+		}
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d prefetches did not finish", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for h := range objects {
+		if !tc.clientStore.Has(h) {
+			t.Errorf("object %x was not prefetched", h)
+		}
+	}
+	// Each object is looked up once, however often it is
+	// prefetched.
+	c := tc.clientStore.Stats()
+	if c.Fetches != 10 || c.Lookups != 11 || c.Hits != 1 {
+		t.Errorf("got %d fetches, %d lookups, %d hits; want 10, 11, 1", c.Fetches, c.Lookups, c.Hits)
+	}
+}
+
+func TestNetMinFreeBytes(t *testing.T) {
+	tc := newNetTestCase(t)
+	defer tc.Clean()
+
+	hash := tc.server.Save([]byte("hello"))
+	tc.clientStore.Options.MinFreeBytes = 1 << 62
+	succ, err := tc.client.Fetch(hash, 5)
+	if succ || err == nil {
+		t.Fatalf("fetch past the free space minimum: %v, %v", succ, err)
+	}
+	if e, ok := err.(*DiskFullError); !ok || !e.Temporary() {
+		t.Errorf("got error %#v, want temporary DiskFullError", err)
+	}
+
+	tc.clientStore.Options.MinFreeBytes = 1
+	if succ, err := tc.client.Fetch(hash, 5); !succ || err != nil {
+		t.Errorf("Fetch: %v, %v", succ, err)
+	}
+}
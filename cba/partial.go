@@ -0,0 +1,180 @@
+package cba
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/termite/fastpath"
+)
+
+// Fetches of large objects write to a partial file named after the
+// hash, so a fetch that is interrupted can resume from the bytes
+// already received rather than starting over.  Next to it, a length
+// file records how many bytes of the partial file were synced to
+// disk when the fetch stopped.  Bytes past that, as left by a crash,
+// are dropped when the fetch resumes, and partial files without a
+// length file are not resumed at all.
+const partialPrefix = ".partial-"
+
+const partialLengthSuffix = ".len"
+
+// Temporary files older than this are removed by ReapTemporaries.
+const defaultTempTTL = 24 * time.Hour
+
+func (st *Store) partialPath(hash string) string {
+	return fastpath.Join(st.Dir(), fmt.Sprintf("%s%x", partialPrefix, hash))
+}
+
+// readPartialLength returns the length recorded for the partial file
+// of hash.
+func (st *Store) readPartialLength(hash string) (int64, error) {
+	content, err := ioutil.ReadFile(st.partialPath(hash) + partialLengthSuffix)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+}
+
+// writePartialLength records that the partial file of hash holds n
+// bytes.  A torn write leaves a record that does not parse, which
+// makes the next fetch start over.
+func (st *Store) writePartialLength(hash string, n int) {
+	p := st.partialPath(hash) + partialLengthSuffix
+	if err := ioutil.WriteFile(p, []byte(strconv.Itoa(n)+"\n"), 0644); err != nil {
+		log.Println("writePartialLength:", err)
+	}
+}
+
+func (st *Store) removePartialLength(hash string) {
+	os.Remove(st.partialPath(hash) + partialLengthSuffix)
+}
+
+// newPartialWriter opens the partial file for hash, and returns a
+// HashWriter positioned after the recorded data already there, which
+// it re-hashes.  It returns nil if the partial file is in use by
+// another fetch.
+func (st *Store) newPartialWriter(hash string, size int64) *HashWriter {
+	f, err := os.OpenFile(st.partialPath(hash), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.Println("newPartialWriter:", err)
+		return nil
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil
+	}
+
+	w := &HashWriter{
+		cache:   st,
+		start:   time.Now(),
+		dest:    f,
+		hasher:  st.Options.Hash.New(),
+		partial: hash,
+	}
+	var n int64
+	recorded, err := st.readPartialLength(hash)
+	fi, statErr := f.Stat()
+	switch {
+	case statErr != nil:
+		err = statErr
+	case fi.Size() == 0:
+		recorded, err = 0, nil
+	case err != nil:
+		err = fmt.Errorf("no valid length record: %v", err)
+	case recorded < 0 || recorded > fi.Size():
+		err = fmt.Errorf("partial has %d bytes, recorded %d", fi.Size(), recorded)
+	case recorded >= size:
+		err = fmt.Errorf("partial has %d bytes, want less than %d", recorded, size)
+	}
+	if err == nil {
+		n, err = io.CopyN(w.hasher, f, recorded)
+	}
+	if err == nil && fi.Size() > recorded {
+		log.Printf("newPartialWriter %x: dropping %d unrecorded bytes", hash, fi.Size()-recorded)
+		err = f.Truncate(recorded)
+	}
+	if err != nil {
+		log.Printf("newPartialWriter %x: %v; starting over", hash, err)
+		w.hasher.Reset()
+		n = 0
+		err = f.Truncate(0)
+		if err == nil {
+			_, err = f.Seek(0, 0)
+		}
+		if err != nil {
+			log.Println("newPartialWriter:", err)
+			f.Close()
+			return nil
+		}
+	}
+	if n > 0 {
+		log.Printf("resuming fetch of %x at %d bytes", hash, n)
+	} else {
+		st.writePartialLength(hash, 0)
+	}
+	w.size = int(n)
+	return w
+}
+
+func isTemporary(name string) bool {
+	for _, p := range []string{".hashtemp", ".expirytemp", partialPrefix} {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReapTemporaries removes temporary files, including partial
+// fetches, that were not modified for Options.TempTTL.  It returns
+// the number of files removed.  Removals are throttled like other
+// maintenance.
+func (st *Store) ReapTemporaries() int {
+	dir := st.Dir()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Println("ReapTemporaries:", err)
+		return 0
+	}
+
+	cutoff := time.Now().Add(-st.Options.TempTTL)
+	var stale []string
+	for _, fi := range entries {
+		name := fi.Name()
+		if fi.IsDir() || !isTemporary(name) {
+			continue
+		}
+		if fi.ModTime().Before(cutoff) {
+			stale = append(stale, name)
+		}
+	}
+	if len(stale) == 0 {
+		return 0
+	}
+
+	st.beginMaintenance("reap temporaries", len(stale))
+	defer st.endMaintenance()
+	n := 0
+	for _, name := range stale {
+		st.maintenanceStep()
+		// Maintenance may have waited a while; the file may be
+		// in use again, or gone.
+		p := fastpath.Join(dir, name)
+		if fi, err := os.Lstat(p); err != nil || !fi.ModTime().Before(time.Now().Add(-st.Options.TempTTL)) {
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			log.Println("ReapTemporaries:", err)
+			continue
+		}
+		n++
+	}
+	return n
+}
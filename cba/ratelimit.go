@@ -0,0 +1,113 @@
+package cba
+
+import (
+	"sync"
+	"time"
+)
+
+// Serving content to a cold worker can saturate the uplink, and
+// starve the RPCs that share it.  A Store can therefore limit the
+// rate at which it serves chunks, over all its connections together,
+// with a token bucket.  The bucket holds at most one second worth of
+// bytes.  Content pushed to workers by other means goes through the
+// same bucket with Throttle.
+
+// clock is time.Now and time.Sleep, replaced in tests.
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+type rateLimiter struct {
+	mutex sync.Mutex
+	clock clock
+
+	// Bytes per second, or 0 for no limit.
+	rate int64
+
+	// Bytes that may be sent right away.  Negative if senders
+	// are waiting.
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(c clock, rate int64) *rateLimiter {
+	me := &rateLimiter{clock: c}
+	me.setRate(rate)
+	return me
+}
+
+// setRate changes the rate.  Tokens accumulated, or owed by waiting
+// senders, carry over.
+func (me *rateLimiter) setRate(rate int64) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.refill()
+	me.rate = rate
+	if rate <= 0 {
+		me.tokens = 0
+	} else if max := float64(rate); me.tokens > max {
+		me.tokens = max
+	}
+}
+
+// refill adds the tokens for the time since the last call.  Must be
+// called with the mutex held.
+func (me *rateLimiter) refill() {
+	now := me.clock.Now()
+	if me.rate > 0 {
+		me.tokens += now.Sub(me.last).Seconds() * float64(me.rate)
+		if max := float64(me.rate); me.tokens > max {
+			me.tokens = max
+		}
+	}
+	me.last = now
+}
+
+func (me *rateLimiter) getRate() int64 {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return me.rate
+}
+
+// wait blocks until n more bytes may be sent.
+func (me *rateLimiter) wait(n int) {
+	me.mutex.Lock()
+	if me.rate <= 0 {
+		me.mutex.Unlock()
+		return
+	}
+	me.refill()
+	me.tokens -= float64(n)
+	var d time.Duration
+	if me.tokens < 0 {
+		d = time.Duration(-me.tokens / float64(me.rate) * float64(time.Second))
+	}
+	me.mutex.Unlock()
+
+	if d > 0 {
+		me.clock.Sleep(d)
+	}
+}
+
+// SetRateLimit limits how many bytes per second the store serves.
+// Zero lifts the limit.
+func (st *Store) SetRateLimit(bytesPerSec int64) {
+	st.limiter.setRate(bytesPerSec)
+}
+
+// Throttle blocks until n more bytes may be sent under the rate
+// limit, for content sent to workers outside ServeChunk.
+func (st *Store) Throttle(n int) {
+	st.limiter.wait(n)
+}
+
+// RateLimit returns the limit set with SetRateLimit, or 0.
+func (st *Store) RateLimit() int64 {
+	return st.limiter.getRate()
+}
@@ -0,0 +1,106 @@
+package cba
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestRateLimiter(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	l := newRateLimiter(clock, 1000)
+	start := clock.Now()
+	for i := 0; i < 10; i++ {
+		l.wait(500)
+	}
+	if dt := clock.Now().Sub(start); dt != 5*time.Second {
+		t.Errorf("sending 5000 bytes at 1000/s took %v", dt)
+	}
+
+	// Idle time refills the bucket, but only up to a second.
+	clock.Sleep(time.Hour)
+	start = clock.Now()
+	l.wait(3000)
+	if dt := clock.Now().Sub(start); dt != 2*time.Second {
+		t.Errorf("after idling: took %v, want 2s", dt)
+	}
+
+	// Changing the rate keeps the tokens.
+	clock.Sleep(time.Hour)
+	l.setRate(2000)
+	start = clock.Now()
+	l.wait(1000)
+	if dt := clock.Now().Sub(start); dt != 0 {
+		t.Errorf("after setRate: took %v, want 0", dt)
+	}
+
+	l.setRate(0)
+	start = clock.Now()
+	l.wait(1 << 30)
+	if dt := clock.Now().Sub(start); dt != 0 {
+		t.Errorf("unlimited: took %v", dt)
+	}
+}
+
+func TestNetRateLimit(t *testing.T) {
+	tmp, _ := ioutil.TempDir("", "term-cba")
+	defer os.RemoveAll(tmp)
+	server := NewStore(&StoreOptions{Dir: tmp + "/server"})
+	clientStore := NewStore(&StoreOptions{Dir: tmp + "/client"})
+
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	server.limiter = newRateLimiter(clock, 1<<20)
+	sockS, sockC, err := unixSocketpair()
+	if err != nil {
+		t.Fatalf("unixSocketpair: %v", err)
+	}
+	defer sockC.Close()
+	go server.ServeConn(sockS)
+	client := clientStore.NewClient(sockC)
+
+	b := make([]byte, 10<<20)
+	for i := range b {
+		b[i] = byte(i * 3)
+	}
+	hash := server.Save(b)
+	start := clock.Now()
+	if got, err := client.Fetch(hash, int64(len(b))); !got || err != nil {
+		t.Fatalf("Fetch: %v, %v", got, err)
+	}
+	if dt := clock.Now().Sub(start); dt < 9*time.Second {
+		t.Errorf("fetching 10MB at 1MB/s took %v", dt)
+	}
+
+	server.SetRateLimit(0)
+	if server.RateLimit() != 0 {
+		t.Errorf("RateLimit: got %d", server.RateLimit())
+	}
+	b[0]++
+	hash = server.Save(b)
+	start = clock.Now()
+	if got, err := client.Fetch(hash, int64(len(b))); !got || err != nil {
+		t.Fatalf("Fetch: %v, %v", got, err)
+	}
+	if dt := clock.Now().Sub(start); dt != 0 {
+		t.Errorf("unlimited fetch took %v", dt)
+	}
+}
@@ -2,14 +2,22 @@ package cba
 
 import (
 	"fmt"
+	"os"
 )
 
 type Request struct {
 	Hash  string
 	Start int
+
+	// If nonzero, the chunk ends at End, and is served using
+	// random access.
+	End int
 }
 
 func (me *Request) String() string {
+	if me.End > 0 {
+		return fmt.Sprintf("%x [%d-%d]", me.Hash, me.Start, me.End)
+	}
 	return fmt.Sprintf("%x [%d]", me.Hash, me.Start)
 }
 
@@ -18,4 +26,11 @@ type Response struct {
 	Have  bool
 	Last  bool
 	Chunk []byte
+
+	// If file is set, the server sends Size bytes of it from off,
+	// instead of Chunk, and calls release when they are out.  See
+	// contentServerCodec.
+	file    *os.File
+	off     int64
+	release func()
 }
@@ -63,33 +63,69 @@ type serverKey struct {
 	off  int64
 }
 
+// Ranged requests of at least this size are read from a file kept
+// open across requests.  Smaller ones are read by Store.ServeChunk.
+const spliceRangeThreshold = 16 << 10
+
+// Number of files kept open for ranged requests after they become
+// idle.
+const spliceMaxIdleFiles = 8
+
 // spliceServer stores that are in progress of being served.
 type spliceServer struct {
 	store   *Store
 	mu      sync.Mutex
 	pending map[serverKey][]chan ServeSplice
+
+	// Files open for ranged requests, keyed by hash.  A parallel
+	// fetch asks for many ranges of the same file, so we don't
+	// reopen it for each one.
+	files map[string]*rangeFile
+}
+
+type rangeFile struct {
+	f    *os.File
+	refs int
 }
 
 var _ = (Server)((*spliceServer)(nil))
 
 func newSpliceServer(store *Store) *spliceServer {
-	return &spliceServer{
+	s := &spliceServer{
 		store:   store,
 		pending: make(map[serverKey][]chan ServeSplice),
+		files:   make(map[string]*rangeFile),
 	}
+	store.mutex.Lock()
+	store.rangeServers[s] = true
+	store.mutex.Unlock()
+	return s
+}
+
+func (s *spliceServer) Ping(req *Request, rep *Response) error {
+	return nil
 }
 
 func (s *spliceServer) ServeChunk(req *Request, rep *Response) (err error) {
 	start := time.Now()
 	err = s.serveChunk(req, rep)
-	s.store.addThroughput(0, int64(len(rep.Chunk)))
+	s.store.addChunkServed(rep.Size)
+	s.store.limiter.wait(rep.Size)
 	dt := time.Now().Sub(start)
-	s.store.AddTiming("ServeChunk", len(rep.Chunk), dt)
+	s.store.AddTiming("ServeChunk", rep.Size, dt)
 	return err
 }
 
 // Get the next splice, read it into the response.
 func (s *spliceServer) serveChunk(req *Request, rep *Response) (err error) {
+	if req.End > 0 {
+		// Ranged requests come out of order, so we can't
+		// prepare a splice sequence for them.
+		if req.End-req.Start < spliceRangeThreshold {
+			return s.store.ServeChunk(req, rep)
+		}
+		return s.serveRange(req, rep)
+	}
 	if req.Start == 0 {
 		err := s.prepareServe(req.Hash)
 		if err != nil {
@@ -116,6 +152,134 @@ func (s *spliceServer) serveChunk(req *Request, rep *Response) (err error) {
 	return nil
 }
 
+// serveRange serves the requested range from a file that is kept
+// open for the following ranges.  The reply only points at the file:
+// contentServerCodec splices the range into the connection, so it
+// does not pass through memory.
+func (s *spliceServer) serveRange(req *Request, rep *Response) error {
+	rf := s.openRange(req.Hash)
+	if rf == nil {
+		rep.Have = false
+		return nil
+	}
+	fi, err := rf.f.Stat()
+	if err != nil {
+		s.releaseRange(req.Hash, rf)
+		return s.store.ServeChunk(req, rep)
+	}
+
+	sz := req.End - req.Start
+	if sz > defaultServeSize {
+		sz = defaultServeSize
+	}
+	n := sz
+	if left := fi.Size() - int64(req.Start); left < int64(n) {
+		n = 0
+		if left > 0 {
+			n = int(left)
+		}
+	}
+
+	rep.Have = true
+	rep.Size = n
+	rep.Last = n < sz
+	rep.file = rf.f
+	rep.off = int64(req.Start)
+	rep.release = func() { s.releaseRange(req.Hash, rf) }
+	return nil
+}
+
+// openRange returns the open file for hash, or nil if we don't have
+// it.  Each call must be matched by releaseRange.
+func (s *spliceServer) openRange(h string) *rangeFile {
+	// dropRange takes our lock with the store lock held, so we
+	// call into the store without ours.
+	if s.store.expired(h) {
+		return nil
+	}
+	s.mu.Lock()
+	if rf := s.files[h]; rf != nil {
+		rf.refs++
+		s.mu.Unlock()
+		return rf
+	}
+	s.mu.Unlock()
+
+	if !s.store.Has(h) {
+		return nil
+	}
+	f, err := os.Open(s.store.Path(h))
+	if err != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rf := s.files[h]; rf != nil {
+		f.Close()
+		rf.refs++
+		return rf
+	}
+	rf := &rangeFile{f: f, refs: 1}
+	s.files[h] = rf
+	return rf
+}
+
+func (s *spliceServer) releaseRange(h string, rf *rangeFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rf.refs--
+	if rf.refs > 0 {
+		return
+	}
+	if s.files[h] != rf {
+		// Dropped while it was being served.
+		rf.f.Close()
+		return
+	}
+
+	idle := 0
+	for _, v := range s.files {
+		if v.refs == 0 {
+			idle++
+		}
+	}
+	if idle > spliceMaxIdleFiles {
+		rf.f.Close()
+		delete(s.files, h)
+	}
+}
+
+// dropRange forgets the file for h, when the object is removed from
+// the store.  A file that is being served is closed by the last
+// releaseRange, so a splice never reads from a reused descriptor.
+// Called with the store lock held.
+func (s *spliceServer) dropRange(h string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rf := s.files[h]; rf != nil {
+		s.drop(h, rf)
+	}
+}
+
+// dropAll forgets all files, for DeleteAll.  Called with the store
+// lock held.
+func (s *spliceServer) dropAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, rf := range s.files {
+		s.drop(h, rf)
+	}
+}
+
+// drop must be called with s.mu held.
+func (s *spliceServer) drop(h string, rf *rangeFile) {
+	delete(s.files, h)
+	if rf.refs == 0 {
+		rf.f.Close()
+	}
+}
+
 func (s *spliceServer) insert(h string, off int64, ch chan ServeSplice) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -139,6 +303,9 @@ func (s *spliceServer) remove(h string, off int64) (out chan ServeSplice) {
 }
 
 func (s *spliceServer) prepareServe(h string) error {
+	if !s.store.Has(h) {
+		return os.ErrNotExist
+	}
 	seq, err := newSpliceSequence(s.store.Path(h))
 	if err != nil {
 		return err
@@ -163,12 +330,19 @@ func (s *spliceServer) serve(h string, off int64) *ServeSplice {
 }
 
 func (s *spliceServer) Close() {
+	s.store.mutex.Lock()
+	delete(s.store.rangeServers, s)
+	s.store.mutex.Unlock()
+
 	chans := []chan ServeSplice{}
 	s.mu.Lock()
 	for _, p := range s.pending {
 		chans = append(chans, p...)
 	}
 	s.pending = map[serverKey][]chan ServeSplice{}
+	for h, rf := range s.files {
+		s.drop(h, rf)
+	}
 	s.mu.Unlock()
 
 	for _, c := range chans {
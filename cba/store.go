@@ -2,11 +2,14 @@ package cba
 
 import (
 	"crypto"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/termite/fastpath"
@@ -24,20 +27,112 @@ type Store struct {
 	mutex         sync.Mutex
 	bytesServed   stats.MemCounter
 	bytesReceived stats.MemCounter
+
+	// Expiry times of objects saved with a TTL.
+	expiry map[string]time.Time
+
+	// Reference counts of pinned objects.  Pinned objects are
+	// not removed when they expire.
+	refs map[string]int
+
+	fetchesInFlight int
+
+	// Throttles serving chunks.
+	limiter *rateLimiter
+
+	// Servers with files open for ranged requests, which must be
+	// closed when objects are removed.
+	rangeServers map[*spliceServer]bool
+
+	// Recently read objects; see ReadContent.
+	memory memoryCache
+
+	// Objects known to match their hash; see Verify.
+	verified verifiedSet
+
+	// Progress of a running MigrateTo, or nil.
+	migration *migration
+
+	// Throttles reaping and migration.
+	maintenance maintenance
+
+	// Directory holding the objects.  It starts out as
+	// Options.Dir, and changes when MigrateTo completes.
+	dirMutex sync.RWMutex
+	dir      string
+
+	// Counters for StoreStats.
+	lookups      int
+	hits         int
+	fetches      int
+	chunksServed int
+	corrupt      int
 }
 
 type StoreOptions struct {
-	Hash       crypto.Hash
-	Dir        string
+	Hash crypto.Hash
+	Dir  string
+
+	// How many chunks to fetch concurrently for large files.
+	FetchConcurrency int
+
+	// How many objects Client.Prefetch fetches concurrently.
+	PrefetchConcurrency int
+
+	// How long temporary files, such as partially fetched
+	// objects, are kept.
+	TempTTL time.Duration
+
+	// If set, a read-only directory with more objects, such as a
+	// pre-populated cache shared over NFS. Lookups check Dir
+	// first, then LowerDir. New objects are always written to
+	// Dir, and objects in LowerDir are never removed.
+	LowerDir string
+
+	// If positive, the store serves at most this many bytes per
+	// second over all connections.  See SetRateLimit.
+	RateLimitBytesPerSec int64
+
+	// If positive, keep objects up to MemoryCacheMaxItem bytes in
+	// memory, up to this many bytes in total.  See
+	// SetMemoryCacheBytes.
+	MemoryCacheBytes   int64
+	MemoryCacheMaxItem int64
+
+	// If set, SaveMemoryCache records which objects are in the
+	// memory cache, and NewStore reads them back into memory.
+	WarmCacheOnStart bool
+
+	// If positive, fetches that would leave less free space on
+	// the volume of Dir are refused.  See DiskFullError.
+	MinFreeBytes uint64
+
+	// Background maintenance handles at most this many objects
+	// per second.  Defaults to defaultMaintenanceOpsPerSec;
+	// negative is unlimited.  See StartMaintenance.
+	MaintenanceOpsPerSec int
 }
 
-// NewStore creates a content cache based in directory d.
-// memorySize sets the maximum number of file contents to keep in
-// memory.
+// NewStore creates a content cache based in directory
+// options.Dir. There is no in-memory index of the stored hashes: Has
+// checks the file system directly, so startup does not scan the
+// directory, whatever the size of the cache.
 func NewStore(options *StoreOptions) *Store {
 	if options.Hash == 0 {
 		options.Hash = crypto.MD5
 	}
+	if options.FetchConcurrency == 0 {
+		options.FetchConcurrency = 4
+	}
+	if options.PrefetchConcurrency == 0 {
+		options.PrefetchConcurrency = 4
+	}
+	if options.TempTTL == 0 {
+		options.TempTTL = defaultTempTTL
+	}
+	if options.MaintenanceOpsPerSec == 0 {
+		options.MaintenanceOpsPerSec = defaultMaintenanceOpsPerSec
+	}
 	if fi, _ := os.Lstat(options.Dir); fi == nil {
 		err := os.MkdirAll(options.Dir, 0700)
 		if err != nil {
@@ -46,10 +141,21 @@ func NewStore(options *StoreOptions) *Store {
 	}
 
 	c := &Store{
-		Options:  options,
-		timings:  stats.NewTimerStats(),
+		Options: options,
+		timings: stats.NewTimerStats(),
+		refs:    map[string]int{},
+		dir:     filepath.Clean(options.Dir),
+		limiter: newRateLimiter(realClock{}, options.RateLimitBytesPerSec),
+
+		rangeServers: map[*spliceServer]bool{},
 	}
+	c.SetMemoryCacheBytes(options.MemoryCacheBytes, options.MemoryCacheMaxItem)
 	c.initThroughputSampler()
+	c.initMaintenance()
+	c.loadExpiry()
+	if options.WarmCacheOnStart {
+		c.warmMemoryCache()
+	}
 	return c
 }
 
@@ -57,6 +163,14 @@ func (st *Store) HashType() crypto.Hash {
 	return st.Options.Hash
 }
 
+// Dir returns the directory holding the objects.  It is Options.Dir,
+// unless the store was migrated elsewhere with MigrateTo.
+func (st *Store) Dir() string {
+	st.dirMutex.RLock()
+	defer st.dirMutex.RUnlock()
+	return st.dir
+}
+
 func hexDigit(b byte) byte {
 	if b < 10 {
 		return byte('0' + b)
@@ -64,7 +178,7 @@ func hexDigit(b byte) byte {
 	return b + 'a' - 10
 }
 
-func HashPath(dir string, hash string) string {
+func hashPathParts(dir string, hash string) (prefixDir, name string) {
 	hex := make([]byte, 2*len(hash))
 	j := 0
 	for i := 0; i < len(hash); i++ {
@@ -72,27 +186,231 @@ func HashPath(dir string, hash string) string {
 		hex[j+1] = hexDigit(hash[i] & 0x0f)
 		j += 2
 	}
-	prefixDir := fastpath.Join(dir, string(hex[:2]))
+	return fastpath.Join(dir, string(hex[:2])), string(hex[2:])
+}
+
+func HashPath(dir string, hash string) string {
+	prefixDir, name := hashPathParts(dir, hash)
 	if err := os.MkdirAll(prefixDir, 0700); err != nil {
 		log.Fatal("MkdirAll error:", err)
 	}
-	return fastpath.Join(prefixDir, string(hex[2:]))
+	return fastpath.Join(prefixDir, name)
+}
+
+// objectPath is like HashPath, but does not create the prefix
+// directory.
+func objectPath(dir string, hash string) string {
+	prefixDir, name := hashPathParts(dir, hash)
+	return fastpath.Join(prefixDir, name)
+}
+
+// Ref pins the object for hash, so it is not removed on expiry
+// until the matching Unref.  The object need not be present yet.
+func (st *Store) Ref(hash string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.refs[hash]++
+}
+
+// Unref drops a reference taken with Ref.
+func (st *Store) Unref(hash string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	n := st.refs[hash]
+	if n == 0 {
+		log.Panicf("Unref of unreferenced object %x", hash)
+	}
+	if n == 1 {
+		delete(st.refs, hash)
+	} else {
+		st.refs[hash] = n - 1
+	}
 }
 
 func (st *Store) Has(hash string) bool {
-	_, err := os.Lstat(st.Path(hash))
-	return err == nil
+	if st.expired(hash) {
+		return false
+	}
+	fi, err := os.Lstat(st.Path(hash))
+	if err != nil {
+		return false
+	}
+	// An empty file may be left behind by a crash during save.
+	if fi.Size() == 0 {
+		return st.Validate(hash)
+	}
+	return true
 }
 
+// Validate rehashes the stored file for hash. If the contents do not
+// match, the file is removed, so it can be fetched again.
+func (st *Store) Validate(hash string) bool {
+	f, err := os.Open(st.Path(hash))
+	if err != nil {
+		return false
+	}
+	h := st.Options.Hash.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err == nil && string(h.Sum(nil)) == hash {
+		return true
+	}
+
+	log.Printf("removing corrupt object %x", hash)
+	st.mutex.Lock()
+	st.corrupt++
+	st.mutex.Unlock()
+	st.verified.drop(hash)
+	if p := st.upperPath(hash); p != st.Path(hash) {
+		log.Printf("corrupt object %x is in the read-only directory", hash)
+	} else if err := os.Remove(p); err != nil {
+		log.Println("Validate:", err)
+	}
+	return false
+}
+
+// Delete removes the object for hash from Dir, along with its expiry
+// time and any partially fetched data, so it has to be saved or
+// fetched again.  Objects in LowerDir are left alone.  Deleting an
+// object that is not there is not an error; deleting one pinned with
+// Ref is.
+func (st *Store) Delete(hash string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.refs[hash] > 0 {
+		return fmt.Errorf("Delete: object %x is referenced", hash)
+	}
+	if _, ok := st.expiry[hash]; ok {
+		delete(st.expiry, hash)
+		st.logExpiry(hash, time.Time{})
+	}
+	if err := st.removeObject(hash); err != nil {
+		return err
+	}
+	if err := os.Remove(st.partialPath(hash)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeObject removes the object from the store directory, and
+// from the destination of a running migration.  Must hold lock.
+func (st *Store) removeObject(hash string) error {
+	st.forget(hash)
+	st.verified.drop(hash)
+	for s := range st.rangeServers {
+		s.dropRange(hash)
+	}
+	paths := []string{st.upperPath(hash)}
+	if st.migration != nil {
+		paths = append(paths, objectPath(st.migration.Dir, hash))
+	}
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteAll removes everything from Dir except the objects pinned
+// with Ref, leaving an otherwise empty store.
+func (st *Store) DeleteAll() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.migration != nil {
+		return fmt.Errorf("DeleteAll: migration to %s in progress", st.migration.Dir)
+	}
+	keep := map[string]bool{}
+	expiry := map[string]time.Time{}
+	for h := range st.refs {
+		keep[st.upperPath(h)] = true
+		if t, ok := st.expiry[h]; ok {
+			expiry[h] = t
+		}
+	}
+	if err := removeAllBut(st.Dir(), keep); err != nil {
+		return err
+	}
+	st.expiry = expiry
+	if len(expiry) > 0 {
+		if err := st.writeExpiryLog(); err != nil {
+			return err
+		}
+	}
+	st.forgetAll()
+	st.verified.clear()
+	for s := range st.rangeServers {
+		s.dropAll()
+	}
+	return nil
+}
+
+// removeAllBut removes the contents of dir, except the paths in keep
+// and the directories leading to them.
+func removeAllBut(dir string, keep map[string]bool) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		p := fastpath.Join(dir, fi.Name())
+		if keep[p] {
+			continue
+		}
+		if len(keep) > 0 && fi.IsDir() {
+			if err := removeAllBut(p, keep); err != nil {
+				return err
+			}
+			// Fails if something was kept.
+			os.Remove(p)
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HasHashes is the batched version of Has: the result has an entry
+// for each of the given hashes.
+func (st *Store) HasHashes(hashes []string) []bool {
+	have := make([]bool, len(hashes))
+	for i, h := range hashes {
+		have[i] = st.Has(h)
+	}
+	return have
+}
+
+// Path returns the file holding the object. Objects in Dir take
+// precedence over those in LowerDir.
 func (st *Store) Path(hash string) string {
-	return HashPath(st.Options.Dir, hash)
+	p := st.upperPath(hash)
+	if st.Options.LowerDir == "" {
+		return p
+	}
+	if _, err := os.Lstat(p); err == nil {
+		return p
+	}
+	lower := objectPath(st.Options.LowerDir, hash)
+	if _, err := os.Lstat(lower); err == nil {
+		return lower
+	}
+	return p
+}
+
+// upperPath returns the path of the object in the writable
+// directory.
+func (st *Store) upperPath(hash string) string {
+	return HashPath(st.Dir(), hash)
 }
 
 func (store *Store) NewHashWriter() *HashWriter {
 	st := &HashWriter{cache: store}
 
 	st.start = time.Now()
-	tmp, err := ioutil.TempFile(store.Options.Dir, ".hashtemp")
+	tmp, err := ioutil.TempFile(store.Dir(), ".hashtemp")
 	if err != nil {
 		log.Panic("NewHashWriter: ", err)
 	}
@@ -129,19 +447,21 @@ func (st *Store) DestructiveSavePath(path string) (hash string, err error) {
 	s := string(h.Sum(nil))
 	if st.Has(s) {
 		os.Remove(path)
+		st.clearExpiry(s)
 		return s, nil
 	}
 
-	p := st.Path(s)
-	err = os.Rename(path, p)
-	if err != nil {
-		log.Fatal("Rename failed", err)
+	p := st.upperPath(s)
+	if err = os.Rename(path, p); err != nil {
+		return "", err
 	}
 	f.Chmod(0444)
 	after, _ := f.Stat()
 	if !after.ModTime().Equal(before.ModTime()) || after.Size() != before.Size() {
-		log.Fatal("File changed during save", before, after)
+		os.Remove(p)
+		return "", fmt.Errorf("%s changed during save", path)
 	}
+	st.saved(p, s)
 
 	dt := time.Now().Sub(start)
 
@@ -151,6 +471,106 @@ func (st *Store) DestructiveSavePath(path string) (hash string, err error) {
 	return s, nil
 }
 
+// SaveImmutablePath saves a file that has no write permission,
+// such as a system library. The object is created as a hard link to
+// the file, so the content is not copied. If the file is on another
+// file system, or cannot be linked, the content is copied instead.
+// Since the object shares the inode, changing the file in place, for
+// example as root, corrupts the object; Validate catches this.  Only
+// use it for files that the user cannot make writable, such as files
+// of other users outside the build tree.
+func (st *Store) SaveImmutablePath(path string) (hash string, err error) {
+	start := time.Now()
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	before, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !before.Mode().IsRegular() {
+		return "", fmt.Errorf("SaveImmutablePath %s: not a regular file", path)
+	}
+	if before.Mode().Perm()&0222 != 0 {
+		return "", fmt.Errorf("SaveImmutablePath %s: file is writable (mode %o)", path, before.Mode().Perm())
+	}
+
+	h := st.Options.Hash.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	after, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !after.ModTime().Equal(before.ModTime()) || after.Size() != before.Size() {
+		return "", fmt.Errorf("SaveImmutablePath %s: file changed while hashing", path)
+	}
+
+	hash = string(h.Sum(nil))
+	if st.Has(hash) {
+		st.clearExpiry(hash)
+		return hash, nil
+	}
+
+	p := st.upperPath(hash)
+	if err := os.Link(path, p); err != nil && !os.IsExist(err) {
+		if _, err := f.Seek(0, 0); err != nil {
+			return "", err
+		}
+		if saved := st.SaveStream(f, size); saved != hash {
+			return "", fmt.Errorf("SaveImmutablePath %s: copy has hash %x, want %x", path, saved, hash)
+		}
+		st.AddTiming("ImmutableSave", int(size), time.Now().Sub(start))
+		return hash, nil
+	}
+	st.saved(p, hash)
+	st.AddTiming("ImmutableSave", int(size), time.Now().Sub(start))
+	return hash, nil
+}
+
+// Hardlink makes dest a hard link to the object for hash, so large
+// files can be put in place without copying.  If dest is on another
+// file system, the content is copied instead.  It fails if dest
+// exists.  A linked dest shares the inode of the object, so it must
+// not be modified in place.
+func (st *Store) Hardlink(hash string, dest string) error {
+	if !st.Has(hash) {
+		return fmt.Errorf("Hardlink: object %x not found", hash)
+	}
+	src := st.Path(hash)
+	err := os.Link(src, dest)
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
+
 func (st *Store) SavePath(path string) (hash string) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -186,6 +606,16 @@ func (st *Store) SaveStream(input io.Reader, size int64) (hash string) {
 	return dup.Sum()
 }
 
+// SaveReader saves the input up to EOF, for content whose size is
+// not known in advance.
+func (st *Store) SaveReader(input io.Reader) (hash string, err error) {
+	dup := st.NewHashWriter()
+	if err := dup.CopyAllClose(input); err != nil {
+		return "", err
+	}
+	return dup.Sum(), nil
+}
+
 func (st *Store) AddTiming(name string, bytes int, dt time.Duration) {
 	st.timings.Log("ContentStore."+name, dt)
 	st.timings.LogN("ContentStore."+name+"Bytes", int64(bytes), dt)
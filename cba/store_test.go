@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func md5(c []byte) string {
@@ -39,7 +42,8 @@ func newCcTestCase() *ccTestCase {
 }
 
 func (me *ccTestCase) Clean() {
-	os.RemoveAll(me.dir)
+	me.store.DeleteAll()
+	os.Remove(me.dir)
 }
 
 func TestHashWriter(t *testing.T) {
@@ -150,6 +154,20 @@ func TestStoreStream(t *testing.T) {
 	}
 }
 
+func TestStoreHasHashes(t *testing.T) {
+	tc := newCcTestCase()
+	defer tc.Clean()
+
+	a := tc.store.Save([]byte("a"))
+	b := md5([]byte("b"))
+	c := tc.store.Save([]byte("c"))
+
+	got := tc.store.HasHashes([]string{a, b, c})
+	if len(got) != 3 || !got[0] || got[1] || !got[2] {
+		t.Errorf("HasHashes: got %v, want [true false true]", got)
+	}
+}
+
 func TestStoreSave(t *testing.T) {
 	tc := newCcTestCase()
 	defer tc.Clean()
@@ -177,3 +195,407 @@ func TestHashPath(t *testing.T) {
 		t.Errorf("got %q want %q", got, want)
 	}
 }
+
+func TestStoreTTL(t *testing.T) {
+	tc := newCcTestCase()
+	defer tc.Clean()
+
+	permanent := tc.store.Save([]byte("permanent"))
+	shortLived := tc.store.SaveWithTTL([]byte("short"), 50*time.Millisecond)
+	reaped := tc.store.SaveWithTTL([]byte("reaped"), 50*time.Millisecond)
+	kept := tc.store.SaveWithTTL([]byte("permanent"), 50*time.Millisecond)
+	if kept != permanent {
+		t.Fatalf("hash mismatch %x %x", kept, permanent)
+	}
+	if !tc.store.Has(shortLived) || !tc.store.Has(reaped) {
+		t.Fatalf("objects with TTL should be present before expiry")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if tc.store.Has(shortLived) {
+		t.Errorf("expired object still present")
+	}
+	if _, err := os.Lstat(tc.store.Path(shortLived)); err == nil {
+		t.Errorf("expired object not removed on access")
+	}
+
+	if n := tc.store.ReapExpired(); n != 1 {
+		t.Errorf("ReapExpired: got %d, want 1", n)
+	}
+	if _, err := os.Lstat(tc.store.Path(reaped)); err == nil {
+		t.Errorf("expired object not removed by ReapExpired")
+	}
+	if !tc.store.Has(permanent) {
+		t.Errorf("permanent object should persist")
+	}
+
+	// The expiry log survives a restart.
+	ttl := tc.store.SaveWithTTL([]byte("ttl"), time.Hour)
+	restarted := NewStore(tc.store.Options)
+	if len(restarted.expiry) != 1 || restarted.expiry[ttl].IsZero() {
+		t.Errorf("expiry not reloaded: %v", restarted.expiry)
+	}
+}
+
+func TestStoreRef(t *testing.T) {
+	tc := newCcTestCase()
+	defer tc.Clean()
+
+	pinned := tc.store.SaveWithTTL([]byte("pinned"), 50*time.Millisecond)
+	tc.store.Ref(pinned)
+	tc.store.Ref(pinned)
+
+	time.Sleep(100 * time.Millisecond)
+	if n := tc.store.ReapExpired(); n != 0 {
+		t.Errorf("ReapExpired removed %d pinned objects", n)
+	}
+	if !tc.store.Has(pinned) {
+		t.Fatalf("pinned object removed on access")
+	}
+
+	tc.store.Unref(pinned)
+	if n := tc.store.ReapExpired(); n != 0 {
+		t.Errorf("ReapExpired removed %d objects that are still pinned", n)
+	}
+	tc.store.Unref(pinned)
+	if n := tc.store.ReapExpired(); n != 1 {
+		t.Errorf("ReapExpired: got %d, want 1", n)
+	}
+	if tc.store.Has(pinned) {
+		t.Errorf("unpinned expired object still present")
+	}
+}
+
+func TestStoreDelete(t *testing.T) {
+	tc := newCcTestCase()
+	defer tc.Clean()
+
+	kept := tc.store.Save([]byte("kept"))
+	deleted := tc.store.SaveWithTTL([]byte("deleted"), time.Hour)
+	if err := tc.store.Delete(deleted); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if tc.store.Has(deleted) {
+		t.Errorf("deleted object still present")
+	}
+	if _, ok := tc.store.expiry[deleted]; ok {
+		t.Errorf("expiry of deleted object not cleared")
+	}
+	if !tc.store.Has(kept) {
+		t.Errorf("Delete removed another object")
+	}
+	if err := tc.store.Delete(deleted); err != nil {
+		t.Errorf("Delete of absent object: %v", err)
+	}
+
+	// A deleted object can be saved again.
+	if h := tc.store.Save([]byte("deleted")); h != deleted || !tc.store.Has(deleted) {
+		t.Errorf("could not save deleted object again")
+	}
+
+	if err := tc.store.DeleteAll(); err != nil {
+		t.Fatalf("DeleteAll: %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(tc.dir); len(entries) != 0 {
+		t.Errorf("DeleteAll left %d entries", len(entries))
+	}
+	if tc.store.Has(kept) || tc.store.Has(deleted) {
+		t.Errorf("DeleteAll left objects")
+	}
+	if h := tc.store.Save([]byte("kept")); h != kept || !tc.store.Has(kept) {
+		t.Errorf("could not save after DeleteAll")
+	}
+
+	// Referenced objects survive.
+	tc.store.Ref(kept)
+	if err := tc.store.Delete(kept); err == nil {
+		t.Errorf("Delete of referenced object succeeded")
+	}
+	other := tc.store.Save([]byte("other"))
+	if err := tc.store.DeleteAll(); err != nil {
+		t.Fatalf("DeleteAll: %v", err)
+	}
+	if !tc.store.Has(kept) || tc.store.Has(other) {
+		t.Errorf("DeleteAll with a reference: got kept %v, other %v", tc.store.Has(kept), tc.store.Has(other))
+	}
+	tc.store.Unref(kept)
+}
+
+func TestStoreSaveImmutablePath(t *testing.T) {
+	tc := newCcTestCase()
+	defer tc.Clean()
+
+	content := []byte("immutable")
+	src := tc.dir + "/src"
+	if err := ioutil.WriteFile(src, content, 0444); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	hash, err := tc.store.SaveImmutablePath(src)
+	if err != nil {
+		t.Fatalf("SaveImmutablePath: %v", err)
+	}
+	if hash != md5(content) || !tc.store.Has(hash) {
+		t.Fatalf("got hash %x, want %x", hash, md5(content))
+	}
+
+	srcFi, _ := os.Lstat(src)
+	objFi, _ := os.Lstat(tc.store.Path(hash))
+	if !os.SameFile(srcFi, objFi) {
+		t.Errorf("object is not a hard link to the source")
+	}
+
+	// Saving again is a no-op.
+	if again, err := tc.store.SaveImmutablePath(src); err != nil || again != hash {
+		t.Errorf("second save: got %x, %v", again, err)
+	}
+
+	writable := tc.dir + "/writable"
+	ioutil.WriteFile(writable, []byte("writable"), 0644)
+	if _, err := tc.store.SaveImmutablePath(writable); err == nil {
+		t.Errorf("SaveImmutablePath should refuse writable files")
+	}
+	if tc.store.Has(md5([]byte("writable"))) {
+		t.Errorf("writable file was saved")
+	}
+}
+
+func TestStoreHardlink(t *testing.T) {
+	tc := newCcTestCase()
+	defer tc.Clean()
+
+	content := []byte("large artifact")
+	hash := tc.store.Save(content)
+	dest := tc.dir + "/linked"
+	if err := tc.store.Hardlink(hash, dest); err != nil {
+		t.Fatalf("Hardlink: %v", err)
+	}
+	destFi, _ := os.Lstat(dest)
+	objFi, _ := os.Lstat(tc.store.Path(hash))
+	if !os.SameFile(destFi, objFi) {
+		t.Errorf("dest is not a hard link to the object")
+	}
+	if got, _ := ioutil.ReadFile(dest); string(got) != string(content) {
+		t.Errorf("got %q, want %q", got, content)
+	}
+
+	if err := tc.store.Hardlink(hash, dest); err == nil {
+		t.Errorf("Hardlink should not overwrite existing files")
+	}
+	if err := tc.store.Hardlink(md5([]byte("unknown")), tc.dir+"/unknown"); err == nil {
+		t.Errorf("Hardlink of unknown object should fail")
+	}
+}
+
+func TestStoreMigrateTo(t *testing.T) {
+	for _, crossDevice := range []bool{false, true} {
+		testStoreMigrateTo(t, crossDevice)
+	}
+}
+
+func testStoreMigrateTo(t *testing.T, crossDevice bool) {
+	tc := newCcTestCase()
+	defer tc.Clean()
+
+	contents := map[string][]byte{}
+	for i := 0; i < 50; i++ {
+		c := []byte(fmt.Sprintf("object %d", i))
+		contents[tc.store.Save(c)] = c
+	}
+	expiring := tc.store.SaveWithTTL([]byte("expiring"), time.Hour)
+	contents[expiring] = []byte("expiring")
+
+	check := func(when string) {
+		for h, c := range contents {
+			if !tc.store.Has(h) {
+				t.Errorf("%s: object %x missing", when, h)
+				continue
+			}
+			got, err := ioutil.ReadFile(tc.store.Path(h))
+			if err != nil || !bytes.Equal(got, c) {
+				t.Errorf("%s: object %x: got %q, %v", when, h, got, err)
+			}
+		}
+	}
+
+	// Halfway through, check that everything is served, and save
+	// a new object.
+	calls := 0
+	savedDuring := []byte("saved during migration")
+	linkObject = func(src, dst string) error {
+		calls++
+		if calls == 25 {
+			check("during migration")
+			if p := tc.store.Stats().Migration; p == nil || p.Objects != 51 || p.Done != 24 {
+				t.Errorf("progress: got %+v", p)
+			}
+			h := tc.store.Save(savedDuring)
+			contents[h] = savedDuring
+		}
+		if crossDevice {
+			return &os.LinkError{Op: "link", Old: src, New: dst, Err: syscall.EXDEV}
+		}
+		return os.Link(src, dst)
+	}
+	defer func() { linkObject = os.Link }()
+
+	dest := tc.dir + "-new"
+	defer os.RemoveAll(dest)
+	if err := tc.store.MigrateTo(dest); err != nil {
+		t.Fatalf("MigrateTo: %v", err)
+	}
+	if got := tc.store.Dir(); got != dest {
+		t.Fatalf("Dir: got %q, want %q", got, dest)
+	}
+
+	check("after migration")
+	for h := range contents {
+		if p := tc.store.Path(h); !strings.HasPrefix(p, dest+"/") {
+			t.Errorf("object %x still served from %s", h, p)
+		}
+	}
+	if left, _ := listObjects(tc.dir); len(left) != 0 {
+		t.Errorf("%d objects left in the old directory", len(left))
+	}
+	s := tc.store.Stats()
+	if s.Migration != nil || s.Count != len(contents) || s.Expiring != 1 {
+		t.Errorf("stats after migration: %+v", s)
+	}
+
+	// Expiry times survive a restart in the new directory.
+	restarted := NewStore(&StoreOptions{Dir: dest})
+	if restarted.Stats().Expiring != 1 {
+		t.Errorf("expiry log was not migrated")
+	}
+
+	if err := tc.store.MigrateTo(dest); err == nil {
+		t.Errorf("migration to the current directory should fail")
+	}
+}
+
+func TestStoreStats(t *testing.T) {
+	tc := newCcTestCase()
+	defer tc.Clean()
+
+	tc.store.Save([]byte("hello"))
+	tc.store.Save([]byte("world!"))
+	tc.store.SaveWithTTL([]byte("ttl"), time.Hour)
+
+	s := tc.store.Stats()
+	if s.Count != 3 || s.Bytes != 14 || s.Expiring != 1 || s.FetchesInFlight != 0 {
+		t.Errorf("got %+v, want 3 objects of 14 bytes, 1 expiring", s)
+	}
+}
+
+func TestStoreReapTemporaries(t *testing.T) {
+	tc := newCcTestCase()
+	defer tc.Clean()
+
+	stale := tc.store.partialPath(md5([]byte("stale")))
+	fresh := tc.store.partialPath(md5([]byte("fresh")))
+	for _, p := range []string{stale, fresh} {
+		if err := ioutil.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	old := time.Now().Add(-2 * tc.store.Options.TempTTL)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	permanent := tc.store.Save([]byte("permanent"))
+
+	if n := tc.store.ReapTemporaries(); n != 1 {
+		t.Errorf("ReapTemporaries: got %d, want 1", n)
+	}
+	if _, err := os.Lstat(stale); err == nil {
+		t.Errorf("stale partial not removed")
+	}
+	if _, err := os.Lstat(fresh); err != nil {
+		t.Errorf("fresh partial removed: %v", err)
+	}
+	if !tc.store.Has(permanent) {
+		t.Errorf("stored object removed")
+	}
+}
+
+func TestStoreLowerDir(t *testing.T) {
+	lower := newCcTestCase()
+	defer lower.Clean()
+	upper := newCcTestCase()
+	defer upper.Clean()
+
+	onlyLower := lower.store.Save([]byte("lower"))
+	both := lower.store.Save([]byte("both"))
+	if err := os.Chmod(lower.dir, 0555); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	defer os.Chmod(lower.dir, 0755)
+
+	upper.options.LowerDir = lower.dir
+	onlyUpper := upper.store.Save([]byte("upper"))
+	if h := upper.store.Save([]byte("both")); h != both {
+		t.Fatalf("hash mismatch %x %x", h, both)
+	}
+
+	for _, c := range []struct {
+		hash    string
+		content string
+		dir     string
+	}{
+		{onlyLower, "lower", lower.dir},
+		{onlyUpper, "upper", upper.dir},
+		{both, "both", upper.dir},
+	} {
+		if !upper.store.Has(c.hash) {
+			t.Errorf("Has(%q) failed", c.content)
+		}
+		p := upper.store.Path(c.hash)
+		if !strings.HasPrefix(p, c.dir) {
+			t.Errorf("Path(%q) = %q, want it in %q", c.content, p, c.dir)
+		}
+		if b, err := ioutil.ReadFile(p); err != nil || string(b) != c.content {
+			t.Errorf("ReadFile(%q): %q, %v", c.content, b, err)
+		}
+	}
+}
+
+type failingReader struct {
+	n int
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if r.n == 0 {
+		return 0, fmt.Errorf("read failure")
+	}
+	if len(b) > r.n {
+		b = b[:r.n]
+	}
+	for i := range b {
+		b[i] = 'x'
+	}
+	r.n -= len(b)
+	return len(b), nil
+}
+
+func TestStoreSaveReader(t *testing.T) {
+	tc := newCcTestCase()
+	defer tc.Clean()
+
+	content := bytes.Repeat([]byte("hello"), 100000)
+	h, err := tc.store.SaveReader(bytes.NewBuffer(content))
+	if err != nil || h != md5(content) {
+		t.Fatalf("SaveReader: %x, %v; want %x", h, err, md5(content))
+	}
+	if b, err := ioutil.ReadFile(tc.store.Path(h)); err != nil || bytes.Compare(b, content) != 0 {
+		t.Errorf("content mismatch: %v", err)
+	}
+
+	if h, err := tc.store.SaveReader(&failingReader{n: 1000}); err == nil {
+		t.Errorf("SaveReader should fail, got %x", h)
+	}
+	entries, _ := ioutil.ReadDir(tc.dir)
+	for _, e := range entries {
+		if isTemporary(e.Name()) {
+			t.Errorf("temporary file %q left behind", e.Name())
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package cba
+
+import (
+	"io/ioutil"
+
+	"github.com/hanwen/termite/fastpath"
+	"github.com/hanwen/termite/stats"
+)
+
+// StoreStats summarizes the state of a Store.
+type StoreStats struct {
+	// Number of objects, and their total size on disk.
+	Count int
+	Bytes stats.MemCounter
+
+	// Fetches from other stores in progress.
+	FetchesInFlight int
+
+	// Traffic since the store was created.
+	BytesReceived stats.MemCounter
+	BytesServed   stats.MemCounter
+
+	// Objects with an expiry time.
+	Expiring int
+
+	// Lookups through Client.FetchOnce, and how many of those
+	// were found in the store.
+	Lookups int
+	Hits    int
+
+	// Fetches from other stores, chunks served to them, and
+	// corrupt objects that were removed.
+	Fetches      int
+	ChunksServed int
+	Corrupt      int
+
+	// Set while MigrateTo runs.
+	Migration *MigrationProgress
+}
+
+// HitRate returns the fraction of lookups found in the store.
+func (s *StoreStats) HitRate() float64 {
+	if s.Lookups == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Lookups)
+}
+
+// Stats returns statistics for the store.  It walks the store
+// directory, so it is not cheap for large stores.  Objects in
+// Options.LowerDir, or copied by a running migration, are not
+// counted.
+func (st *Store) Stats() StoreStats {
+	s := StoreStats{}
+	dir := st.Dir()
+	dirs, _ := ioutil.ReadDir(dir)
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 2 {
+			continue
+		}
+		entries, _ := ioutil.ReadDir(fastpath.Join(dir, d.Name()))
+		for _, e := range entries {
+			if e.IsDir() || e.Name()[0] == '.' {
+				continue
+			}
+			s.Count++
+			s.Bytes += stats.MemCounter(e.Size())
+		}
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	s.FetchesInFlight = st.fetchesInFlight
+	s.BytesReceived = st.bytesReceived
+	s.BytesServed = st.bytesServed
+	s.Expiring = len(st.expiry)
+	s.Lookups = st.lookups
+	s.Hits = st.hits
+	s.Fetches = st.fetches
+	s.ChunksServed = st.chunksServed
+	s.Corrupt = st.corrupt
+	if st.migration != nil {
+		p := st.migration.MigrationProgress
+		s.Migration = &p
+	}
+	return s
+}
+
+func (st *Store) addFetchesInFlight(delta int) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.fetchesInFlight += delta
+	if delta > 0 {
+		st.fetches += delta
+	}
+}
+
+func (st *Store) addLookup(hit bool) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.lookups++
+	if hit {
+		st.hits++
+	}
+}
+
+func (st *Store) addChunkServed(size int) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.chunksServed++
+	st.bytesServed += stats.MemCounter(size)
+}
@@ -59,3 +59,11 @@ func (st *Store) addThroughput(received, served int64) {
 	st.bytesReceived += stats.MemCounter(received)
 	st.bytesServed += stats.MemCounter(served)
 }
+
+// Totals returns the number of bytes received and served since the
+// store was created.
+func (st *Store) Totals() (received, served int64) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return int64(st.bytesReceived), int64(st.bytesServed)
+}
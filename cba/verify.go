@@ -0,0 +1,66 @@
+package cba
+
+import (
+	"sync"
+)
+
+// An object can be damaged on disk after it was stored, for example
+// by a crash or a bad disk.  Has only looks at the file size, so
+// objects are rehashed the first time they are read, see Verify, and
+// a damaged one is removed so it can be fetched again.  Objects
+// written by this process were hashed as they were written, and need
+// no check.  The set of checked objects is kept in two generations;
+// objects that fall out are checked again on their next read.
+
+// Checked objects held in one generation.
+const _VERIFIED_OBJECTS = 1 << 16
+
+type verifiedSet struct {
+	mutex  sync.Mutex
+	recent map[string]bool
+	old    map[string]bool
+}
+
+func (v *verifiedSet) has(hash string) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.recent[hash] || v.old[hash]
+}
+
+func (v *verifiedSet) add(hash string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.recent == nil || len(v.recent) >= _VERIFIED_OBJECTS {
+		v.old = v.recent
+		v.recent = map[string]bool{}
+	}
+	v.recent[hash] = true
+}
+
+func (v *verifiedSet) drop(hash string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	delete(v.recent, hash)
+	delete(v.old, hash)
+}
+
+func (v *verifiedSet) clear() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.recent = nil
+	v.old = nil
+}
+
+// Verify checks that the stored object matches its hash, unless that
+// was done before.  A corrupt object is removed, as with Validate,
+// and false is returned, so the caller can fetch it again.
+func (st *Store) Verify(hash string) bool {
+	if st.verified.has(hash) {
+		return true
+	}
+	if !st.Validate(hash) {
+		return false
+	}
+	st.verified.add(hash)
+	return true
+}
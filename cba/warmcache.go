@@ -0,0 +1,118 @@
+package cba
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/hanwen/termite/fastpath"
+)
+
+// A restart empties the memory cache, so the first jobs after it
+// read everything from disk again.  With WarmCacheOnStart, a clean
+// shutdown writes the hashes in the memory cache, not their
+// contents, to a file in the store directory, and NewStore reads the
+// objects back into memory.  This is best effort: objects that are
+// gone are skipped, and a missing or damaged list starts cold.
+
+const memoryCacheListName = "memory-cache.list"
+
+func (st *Store) memoryCacheListPath() string {
+	return fastpath.Join(st.Dir(), memoryCacheListName)
+}
+
+// SaveMemoryCache records the hashes in the memory cache, most
+// recently used first, if Options.WarmCacheOnStart is set.  Call it
+// on clean shutdown.
+func (st *Store) SaveMemoryCache() error {
+	if !st.Options.WarmCacheOnStart {
+		return nil
+	}
+	m := &st.memory
+	m.mutex.Lock()
+	var keys []string
+	if m.cache != nil {
+		keys = m.cache.Keys()
+	}
+	m.mutex.Unlock()
+
+	f, err := ioutil.TempFile(st.Dir(), ".hashtemp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%x\n", k)
+	}
+	err = w.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), st.memoryCacheListPath())
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// warmMemoryCache reads the objects recorded by SaveMemoryCache into
+// memory, as many as the cache takes.  The list is removed, so a
+// later crash does not leave a stale one.
+func (st *Store) warmMemoryCache() {
+	p := st.memoryCacheListPath()
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("warmMemoryCache:", err)
+		}
+		return
+	}
+	os.Remove(p)
+
+	m := &st.memory
+	m.mutex.Lock()
+	limit := 0
+	if m.cache != nil {
+		limit = m.cache.size
+	}
+	m.mutex.Unlock()
+
+	var hashes []string
+	for _, l := range strings.Split(string(content), "\n") {
+		if len(hashes) >= limit {
+			break
+		}
+		h, err := hex.DecodeString(l)
+		if err != nil || len(h) != st.Options.Hash.Size() {
+			continue
+		}
+		hashes = append(hashes, string(h))
+	}
+
+	// Add the least recently used first, so the others stay if
+	// the cache fills up.
+	loaded := 0
+	for i := len(hashes) - 1; i >= 0; i-- {
+		h := hashes[i]
+		if st.expired(h) || !st.Has(h) || !st.Verify(h) {
+			continue
+		}
+		data, err := ioutil.ReadFile(st.Path(h))
+		if err != nil {
+			continue
+		}
+		m.mutex.Lock()
+		if m.cache != nil {
+			m.cache.Add(h, data)
+		}
+		m.mutex.Unlock()
+		loaded++
+	}
+	log.Printf("warmed memory cache with %d of %d objects", loaded, len(hashes))
+}
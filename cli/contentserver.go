@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"log"
+	"net"
+	"syscall"
+
+	"github.com/hanwen/termite/cba"
+	"github.com/hanwen/termite/termite"
+)
+
+// RunContentServerMain serves a content store, configured by the
+// flags in args.
+func RunContentServerMain(args []string) {
+	flags := newFlagSet("contentserver")
+	// coordinator := flags.String("coordinator", "localhost:1230", "address of coordinator. Overrides -workers")
+	secretFile := flags.String("secret", "secret.txt", "file containing password.")
+	cachedir := flags.String("cachedir", "/var/cache/termite/worker-cache", "content cache")
+	port := flags.Int("port", 0, "RPC port")
+	tls := addTLSFlags(flags)
+
+	parseFlags(flags, args)
+
+	secret := readSecret(*secretFile)
+	opts := cba.StoreOptions{
+		Dir: *cachedir,
+	}
+	tlsOpts := tls.options()
+	tlsConfig, err := tlsOpts.TLSConfig()
+	if err != nil {
+		log.Fatal("TLS: ", err)
+	}
+	store := cba.NewStore(&opts)
+	listener := termite.AuthenticatedListener(*port, secret, 10, tlsConfig)
+	for {
+		conn, err := listener.Accept()
+		if err == syscall.EINVAL {
+			break
+		}
+		if err != nil {
+			if e, ok := err.(*net.OpError); ok && e.Err == syscall.EINVAL {
+				break
+			}
+			log.Println("me.listener", err)
+			break
+		}
+
+		log.Println("Authenticated connection from", conn.RemoteAddr())
+		go store.ServeConn(conn)
+	}
+}
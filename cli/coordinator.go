@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hanwen/termite/termite"
+)
+
+func serveBin(name string) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		me, _ := os.Readlink("/proc/self/exe")
+		d, _ := filepath.Split(me)
+
+		for _, n := range []string{
+			filepath.Join(d, name),
+			filepath.Join(d, fmt.Sprintf("../%s/%s", name, name)),
+		} {
+			if fi, _ := os.Lstat(n); fi != nil && !fi.IsDir() {
+				http.ServeFile(w, req, n)
+				return
+			}
+		}
+		// The termite binary runs as any command, depending on
+		// the name it is started with.
+		if multiCall {
+			http.ServeFile(w, req, me)
+		}
+	}
+}
+
+// RunCoordinatorMain runs a coordinator, configured by the flags in args.
+func RunCoordinatorMain(args []string) {
+	flags := newFlagSet("coordinator")
+	port := flags.Int("port", 1230, "Where to listen for work requests.")
+	webPassword := flags.String("web-password", "killkillkill", "password for authorizing worker kills.")
+	secretFile := flags.String("secret", "secret.txt", "file containing password.")
+	utilization := flags.Float64("target-utilization", 0.8, "fraction of worker job slots that should be in use, for the suggested worker count on /api/capacity.")
+	checkConcurrency := flags.Int("check-concurrency", 16, "number of workers to probe in parallel when checking reachability.")
+	checkTimeout := flags.Float64("time.check", 10.0, "seconds to wait for a worker when checking reachability.")
+	checkInterval := flags.Float64("time.check-interval", 60.0, "seconds between reachability checks of the workers.")
+	missedChecks := flags.Int("missed-checks", 3, "number of reachability checks in a row a worker may fail before it is dropped.")
+	registry := flags.String("registry", "", "file to save registered workers to, and restore them from on startup.")
+	minDisk := flags.Int("min-disk", 0, "MB of free space a worker needs for its content store to be listed to masters.")
+	minHealth := flags.Float64("min-health", 0, "health score between 0 and 1 that a worker needs to be listed to masters.")
+	reportInterval := flags.Float64("time.report-interval", 60.0, "seconds between reports of the workers; workers that miss two in a row lose health.")
+	tls := addTLSFlags(flags)
+	parseFlags(flags, args)
+	log.SetPrefix("C")
+
+	secret := readSecret(*secretFile)
+
+	opts := termite.CoordinatorOptions{
+		Secret:            secret,
+		WebPassword:       *webPassword,
+		TargetUtilization: *utilization,
+		CheckConcurrency:  *checkConcurrency,
+		CheckTimeout:      time.Duration(*checkTimeout * float64(time.Second)),
+	}
+	opts.CheckInterval = time.Duration(*checkInterval * float64(time.Second))
+	opts.MaxMissedChecks = *missedChecks
+	opts.RegistryFile = *registry
+	opts.MinDiskAvailable = uint64(*minDisk) * (1 << 20)
+	opts.MinHealth = *minHealth
+	opts.ReportInterval = time.Duration(*reportInterval * float64(time.Second))
+	opts.TLSOptions = tls.options()
+	c := termite.NewCoordinator(&opts)
+	c.Mux.HandleFunc("/bin/worker", serveBin("worker"))
+	c.Mux.HandleFunc("/bin/shell-wrapper", serveBin("shell-wrapper"))
+	c.Mux.HandleFunc("/bin/termite", serveBin("termite"))
+
+	log.Println(termite.Version())
+	go c.PeriodicCheck()
+	c.ServeHTTP(*port)
+}
@@ -0,0 +1,97 @@
+package cli
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/hanwen/termite/termite"
+)
+
+// newFlagSet returns the flags of a subcommand, with the flags that
+// all subcommands have.
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.String("config", "", "file with name=value lines, for flags not given on the command line.")
+	return flags
+}
+
+// parseFlags parses args, and then the file given with -config.
+func parseFlags(flags *flag.FlagSet, args []string) {
+	flags.Parse(args)
+	if name := flags.Lookup("config").Value.String(); name != "" {
+		if err := loadConfig(flags, name); err != nil {
+			log.Fatalf("-config: %v", err)
+		}
+	}
+}
+
+// loadConfig sets the flags named in the file, except for those that
+// were set already.  Lines are name=value; empty lines and lines
+// starting with # are skipped.
+func loadConfig(flags *flag.FlagSet, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%s:%d: want name=value, got %q", name, lineno, line)
+		}
+		k := strings.TrimSpace(kv[0])
+		if k == "config" || set[k] {
+			continue
+		}
+		if err := flags.Set(k, strings.TrimSpace(kv[1])); err != nil {
+			return fmt.Errorf("%s:%d: %v", name, lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// tlsFlags are the flags for termite.TLSOptions.
+type tlsFlags struct {
+	certFile *string
+	keyFile  *string
+	caFile   *string
+}
+
+func addTLSFlags(flags *flag.FlagSet) *tlsFlags {
+	return &tlsFlags{
+		certFile: flags.String("cert", "", "TLS certificate file. Without it, connections are not encrypted."),
+		keyFile:  flags.String("key", "", "TLS key file."),
+		caFile:   flags.String("ca", "", "CA certificates that peer TLS certificates must be signed by."),
+	}
+}
+
+func (me *tlsFlags) options() termite.TLSOptions {
+	return termite.TLSOptions{
+		CertFile: *me.certFile,
+		KeyFile:  *me.keyFile,
+		CAFile:   *me.caFile,
+	}
+}
+
+// readSecret returns the password in the file name.
+func readSecret(name string) []byte {
+	secret, err := ioutil.ReadFile(name)
+	if err != nil {
+		log.Fatal("ReadFile", err)
+	}
+	return secret
+}
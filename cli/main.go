@@ -0,0 +1,70 @@
+// Package cli has the commands of termite.  They are subcommands of
+// the termite binary, as in "termite worker -jobs 4", and each is
+// also a binary of its own in bin/.
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hanwen/termite/termite"
+)
+
+var commands = map[string]func(args []string){
+	"contentserver": RunContentServerMain,
+	"coordinator":   RunCoordinatorMain,
+	"master":        RunMasterMain,
+	"run":           RunWrapperMain,
+	"worker":        RunWorkerMain,
+}
+
+// Names of the commands as binaries of their own, for links to the
+// termite binary.
+var binaryNames = map[string]string{
+	"shell-wrapper": "run",
+}
+
+// Set if the running binary has all the commands.
+var multiCall bool
+
+// command returns the command that argv runs, and its arguments.  A
+// binary linked as one of the commands, like termite-worker or
+// shell-wrapper, runs that command.
+func command(argv []string) (name string, args []string) {
+	base := strings.TrimPrefix(filepath.Base(argv[0]), "termite-")
+	if n, ok := binaryNames[base]; ok {
+		base = n
+	}
+	if commands[base] != nil {
+		return base, argv[1:]
+	}
+	if len(argv) < 2 {
+		return "", nil
+	}
+	return argv[1], argv[2:]
+}
+
+func usage() {
+	var names []string
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "%s\nusage: termite COMMAND [FLAGS]\ncommands: %s\n",
+		termite.Version(), strings.Join(names, " "))
+	os.Exit(2)
+}
+
+// Main runs the command that argv asks for.
+func Main(argv []string) {
+	multiCall = true
+	name, args := command(argv)
+	run := commands[name]
+	if run == nil {
+		usage()
+	}
+	run(args)
+}
@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestCommand(t *testing.T) {
+	cases := []struct {
+		argv []string
+		name string
+		args []string
+	}{
+		{[]string{"termite", "worker", "-jobs", "4"}, "worker", []string{"-jobs", "4"}},
+		{[]string{"/usr/bin/termite", "run", "-c", "ls"}, "run", []string{"-c", "ls"}},
+		{[]string{"/usr/bin/termite-worker", "-jobs", "4"}, "worker", []string{"-jobs", "4"}},
+		{[]string{"/tmp/worker-download/worker", "-jobs", "4"}, "worker", []string{"-jobs", "4"}},
+		{[]string{"shell-wrapper", "-c", "ls"}, "run", []string{"-c", "ls"}},
+		{[]string{"termite-master"}, "master", []string{}},
+		{[]string{"termite"}, "", nil},
+	}
+	for _, c := range cases {
+		name, args := command(c.argv)
+		if name != c.name || !reflect.DeepEqual(args, c.args) {
+			t.Errorf("command(%q): got %q %q, want %q %q", c.argv, name, args, c.name, c.args)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(dir)
+	config := dir + "/config"
+	ioutil.WriteFile(config, []byte(`
+# comment
+jobs = 4
+secret=/etc/termite/secret
+`), 0644)
+
+	flags := newFlagSet("test")
+	jobs := flags.Int("jobs", 1, "")
+	secret := flags.String("secret", "secret.txt", "")
+	flags.SetOutput(ioutil.Discard)
+	parseFlags(flags, []string{"-config", config, "-jobs", "8"})
+	if *jobs != 8 {
+		t.Errorf("command line flag overridden: jobs %d", *jobs)
+	}
+	if *secret != "/etc/termite/secret" {
+		t.Errorf("config not applied: secret %q", *secret)
+	}
+
+	ioutil.WriteFile(config, []byte("nonexistent=1\n"), 0644)
+	flags = flag.NewFlagSet("test", flag.ContinueOnError)
+	if err := loadConfig(flags, config); err == nil {
+		t.Errorf("unknown flag accepted")
+	}
+}
@@ -0,0 +1,183 @@
+package cli
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hanwen/termite/cba"
+	"github.com/hanwen/termite/termite"
+)
+
+// RunMasterMain runs a master for the current directory, configured
+// by the flags in args.
+func RunMasterMain(args []string) {
+	flags := newFlagSet("master")
+	home := os.Getenv("HOME")
+	cachedir := flags.String("cachedir", filepath.Join(home, ".cache", "termite-master"), "content cache")
+	coordinator := flags.String("coordinator", "localhost:1230", "address of coordinator. Overrides -workers")
+	exclude := flags.String("exclude", "usr/lib/locale/locale-archive,sys,proc,dev,selinux,cgroup", "prefixes to not export.")
+	fetchAll := flags.Bool("fetch-all", true, "Fetch all files on startup.")
+	fetchConcurrency := flags.Int("fetch-concurrency", 4, "number of chunks to fetch concurrently.")
+	memCache := flags.Int64("memory-cache", 32, "MB of content to keep in memory for pushing to workers. 0 disables.")
+	warmCache := flags.Bool("warm-memory-cache", false, "On exit, record which objects are in the memory cache, and load them on the next start.")
+	lowerCachedir := flags.String("lower-cachedir", "", "read-only content cache, consulted after -cachedir.")
+	harvestPeriod := flags.Float64("time.harvest", 0, "how often to collect finished files of running jobs. 0 disables.")
+	houseHoldPeriod := flags.Float64("time.household", 60.0, "how often to do house hold tasks.")
+	clampMtimes := flags.Bool("clamp-mtimes", false, "move mtimes of files written on workers whose clock is behind into the time the job ran.")
+	jobTimeout := flags.Float64("time.job", 0, "kill jobs that run longer than this many seconds. 0 disables.")
+	jobs := flags.Int("jobs", 1, "number of jobs to run")
+	keepAlive := flags.Float64("time.keepalive", 60.0, "for how long to keep workers reserved.")
+	logfile := flags.String("logfile", "", "where to send log output.")
+	paranoia := flags.Bool("paranoia", false, "Check attribute cache.")
+	port := flags.Int("port", 1231, "http status port")
+	retry := flags.Int("retry", 3, "how often to retry faulty jobs")
+	retryBackoff := flags.Float64("time.retry-backoff", 0.1, "seconds to wait before the first retry; doubles for each retry.")
+	retryMaxBackoff := flags.Float64("time.retry-max-backoff", 3.2, "maximum seconds to wait before a retry.")
+	workerCoolOff := flags.Float64("time.worker-cool-off", 30, "seconds to leave a worker alone after its mirror failed.")
+	scratch := flags.String("scratch", "", "directory outside the writable root where jobs may write too.")
+	sessionReport := flags.String("session-report", "", "file to write build statistics to as JSON on exit.")
+	secretFile := flags.String("secret", "secret.txt", "file containing password.")
+	shellFallback := flags.Bool("shell-fallback", false, "run scripts without #! line with /bin/sh.")
+	localFallback := flags.Bool("local-fallback", false, "run jobs on the master when no worker can be reached.")
+	localJobs := flags.Int("local-jobs", 0, "maximum number of jobs run on the master with -local-fallback. 0 is the number of CPUs.")
+	dedupEnv := flags.Bool("dedup-env", false, "send each job environment to a worker only once.")
+	privateTmp := flags.Bool("private-tmp", false, "give each job a private /tmp on the worker.")
+	persistAttrs := flags.Bool("persist-attrs", false, "keep file attributes in the cache directory across restarts.")
+	socket := flags.String("socket", ".termite-socket", "socket to listen for commands")
+	rateLimit := flags.Float64("rate-limit", 0, "maximum MB/s of content served to workers. 0 is unlimited.")
+	maintenanceRate := flags.Int("maintenance-rate", 0, "maximum objects per second handled by cache maintenance. 0 uses the default, negative is unlimited.")
+	checkReads := flags.Bool("check-reads", false, "report files that jobs read but that changed before the job finished.")
+	strictReads := flags.Bool("strict-reads", false, "fail jobs that read files that changed before the job finished.")
+	speculate := flags.Float64("speculate", 0, "start a second copy of jobs that take this many times the median of their command. 0 disables.")
+	srcRoot := flags.String("sourcedir", "", "root of corresponding source directory")
+	dirPageThreshold := flags.Int("dir-page-threshold", 0, "send directories with more entries to workers in pages. 0 means never.")
+	verifyBinaries := flags.Bool("verify-binaries", false, "run binaries inside the tree as synced to workers, not as found on the host.")
+	warmUp := flags.String("warmup", "", "command to run on each new worker, to prime its caches.")
+	workerSelector := flags.String("worker-selector", "", "only use workers with these labels, eg. pool=ci,arch=amd64.")
+	xattr := flags.Bool("xattr", true, "cache hashes in filesystem attribute.")
+	tls := addTLSFlags(flags)
+
+	parseFlags(flags, args)
+
+	if *logfile != "" {
+		f, err := os.OpenFile(*logfile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal("Could not open log file.", err)
+		}
+		log.Println("Log output to", *logfile)
+		log.SetOutput(f)
+	} else {
+		log.SetPrefix("M")
+	}
+
+	secret := readSecret(*secretFile)
+
+	excludeList := strings.Split(*exclude, ",")
+	root, sock := absSocket(*socket)
+
+	opts := termite.MasterOptions{
+		Secret:       secret,
+		MaxJobs:      *jobs,
+		Excludes:     excludeList,
+		Coordinator:  *coordinator,
+		SourceRoot:   *srcRoot,
+		WritableRoot: root,
+		Paranoia:     *paranoia,
+		Period:       time.Duration(*houseHoldPeriod * float64(time.Second)),
+		KeepAlive:    time.Duration(*keepAlive * float64(time.Second)),
+		FetchAll:     *fetchAll,
+		StoreOptions: cba.StoreOptions{
+			Dir:              *cachedir,
+			FetchConcurrency: *fetchConcurrency,
+			LowerDir:         *lowerCachedir,
+		},
+		RetryCount:    *retry,
+		XAttrCache:    *xattr,
+		LogFile:       *logfile,
+		Socket:        sock,
+		ShellFallback: *shellFallback,
+		LocalFallback: *localFallback,
+		DedupEnv:      *dedupEnv,
+		PrivateTmp:    *privateTmp,
+	}
+	if _, err := termite.ParseLabels(*workerSelector); err != nil {
+		log.Fatalf("-worker-selector: %v", err)
+	}
+	opts.WorkerSelector = *workerSelector
+	opts.ScratchRoot = *scratch
+	opts.LocalJobs = *localJobs
+	opts.VerifyBinaries = *verifyBinaries
+	opts.DirPageThreshold = *dirPageThreshold
+	opts.SessionReportFile = *sessionReport
+	opts.Speculate = *speculate
+	opts.CheckReads = *checkReads
+	opts.StrictReads = *strictReads
+	opts.RateLimitBytesPerSec = int64(*rateLimit * (1 << 20))
+	opts.MaintenanceOpsPerSec = *maintenanceRate
+	opts.MemoryCacheBytes = *memCache << 20
+	opts.WarmCacheOnStart = *warmCache
+	opts.RetryBackoff = time.Duration(*retryBackoff * float64(time.Second))
+	opts.RetryMaxBackoff = time.Duration(*retryMaxBackoff * float64(time.Second))
+	opts.WorkerCoolOff = time.Duration(*workerCoolOff * float64(time.Second))
+	opts.TLSOptions = tls.options()
+	opts.JobTimeout = time.Duration(*jobTimeout * float64(time.Second))
+	opts.ClampMtimes = *clampMtimes
+	if *harvestPeriod > 0 {
+		opts.HarvestPeriod = time.Duration(*harvestPeriod * float64(time.Second))
+	}
+	if *persistAttrs {
+		opts.PersistentAttrCache = filepath.Join(*cachedir, "attributes")
+	}
+	if *warmUp != "" {
+		opts.WarmUp = termite.ParseCommand(*warmUp)
+		if len(opts.WarmUp) == 0 {
+			log.Fatalf("could not parse -warmup %q", *warmUp)
+		}
+		bin, err := exec.LookPath(opts.WarmUp[0])
+		if err == nil {
+			bin, err = filepath.Abs(bin)
+		}
+		if err != nil {
+			log.Fatal("LookPath", err)
+		}
+		opts.WarmUp[0] = bin
+	}
+	master := termite.NewMaster(&opts)
+
+	log.Println(termite.Version())
+
+	go master.ServeHTTP(*port)
+	master.Start()
+}
+
+func absSocket(sock string) (root, absSock string) {
+	absSock, err := filepath.Abs(sock)
+	if err != nil {
+		log.Fatal("abs", err)
+	}
+
+	fi, err := os.Stat(absSock)
+	if fi != nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, _ := net.Dial("unix", absSock)
+		if conn != nil {
+			conn.Close()
+			log.Fatal("socket has someone listening: ", absSock)
+		}
+		// TODO - should check explicitly for the relevant error message.
+		log.Println("removing dead socket", absSock)
+		os.Remove(absSock)
+	}
+
+	root, _ = termite.SplitPath(absSock)
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		log.Fatal("EvalSymlinks", err)
+	}
+	root = filepath.Clean(root)
+	return root, absSock
+}
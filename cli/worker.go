@@ -0,0 +1,190 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/termite/cba"
+	"github.com/hanwen/termite/fs"
+	"github.com/hanwen/termite/termite"
+)
+
+var _ = log.Printf
+
+func handleStop(daemon *termite.Worker) {
+	ch := make(chan os.Signal, 1)
+
+	signal.Notify(ch, os.Interrupt, os.Kill)
+	for sig := range ch {
+		log.Println("got signal: ", sig)
+		req := termite.ShutdownRequest{Kill: true}
+		rep := termite.ShutdownResponse{}
+		daemon.Shutdown(&req, &rep)
+	}
+}
+
+func OpenUniqueLog(base string) *os.File {
+	name := base
+	i := 0
+	for {
+		fi, _ := os.Stat(name)
+		if fi == nil {
+			break
+		}
+
+		name = fmt.Sprintf("%s.%d", base, i)
+		i++
+	}
+
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatal("Could not open log file.", err)
+	}
+	return f
+}
+
+// RunWorkerMain runs a worker, configured by the flags in args.
+func RunWorkerMain(args []string) {
+	flags := newFlagSet("worker")
+	version := flags.Bool("version", false, "print version and exit.")
+	cachedir := flags.String("cachedir", "/var/cache/termite/worker-cache", "content cache")
+	tmpdir := flags.String("tmpdir", "/var/tmp",
+		"where to create FUSE mounts; should be on same partition as cachedir.")
+	secretFile := flags.String("secret", "secret.txt", "file containing password.")
+	port := flags.Int("port", 1232, "Start of port to try.")
+	portRetry := flags.Int("port-retry", 10, "How many other ports to try.")
+	coordinator := flags.String("coordinator", "", "Where to register the worker.")
+	jobs := flags.Int("jobs", 1, "Max number of jobs to run.")
+	reapcount := flags.Int("reap-count", 1, "Number of jobs per filesystem.")
+	userFlag := flags.String("user", "nobody", "Run as this user.")
+	logfile := flags.String("logfile", "", "Output log file to use.")
+	stderrFile := flags.String("stderr", "", "File to write stderr output to.")
+	paranoia := flags.Bool("paranoia", false, "Check attribute cache.")
+	cpus := flags.Int("cpus", 1, "Number of CPUs to use.")
+	heap := flags.Int("heap-size", 0, "Maximum heap size in MB.")
+	rateLimit := flags.Float64("rate-limit", 0, "Maximum MB/s of content served. 0 is unlimited.")
+	fetchConcurrency := flags.Int("fetch-concurrency", 4, "Number of chunks to fetch concurrently.")
+	negativeTTL := flags.Float64("time.negative-attr", 0, "Seconds to remember that a file is missing on the master. 0 disables.")
+	reportInterval := flags.Float64("time.report", 60.0, "Maximum seconds between reports to the coordinator.")
+	memThreshold := flags.Int("report-mem-threshold", 0, "Report to the coordinator when available memory crosses this many MB. 0 disables.")
+	minFreeDisk := flags.Int("min-free-disk", 0, "Refuse fetches that would leave less than this many MB free for the cache. 0 disables.")
+	maintenanceRate := flags.Int("maintenance-rate", 0, "Maximum objects per second handled by cache maintenance. 0 uses the default, negative is unlimited.")
+	diskThreshold := flags.Int("report-disk-threshold", 0, "Report to the coordinator when free cache disk space crosses this many MB. 0 disables.")
+	localPrefixes := flags.String("local-prefixes", "", "Comma separated directories whose files are read locally if they match the master's, eg. /usr,-/usr/local.")
+	maxJobMemory := flags.Int("max-job-memory", 0, "Maximum MB of address space per job process. 0 is unlimited.")
+	maxJobCPU := flags.Float64("max-job-cpu", 0, "Maximum seconds of CPU time per job process. 0 is unlimited.")
+	mirrorMemory := flags.Int("max-mirror-memory", 0, "Maximum MB of memory for the jobs of each mirror together, enforced with cgroups below -cgroup-dir. 0 is unlimited.")
+	mirrorShares := flags.Int("mirror-cpu-shares", 0, "cgroup CPU shares for the jobs of each mirror. 0 leaves them unset.")
+	cgroupDir := flags.String("cgroup-dir", "", "cgroup directory delegated to the worker, for per-job cgroups that limit job memory to -max-job-memory, and for mirror cgroups.")
+	nice := flags.Int("nice", 0, "Nice value for jobs. 0 leaves it unchanged.")
+	ioClass := flags.String("ionice", "", "I/O scheduling class for jobs: realtime, best-effort or idle. Empty leaves it unchanged.")
+	labels := flags.String("labels", "", "Comma separated key=value labels, for masters to select workers.")
+	procFiles := flags.String("proc-files", strings.Join(fs.DefaultProcFiles, ","), "Comma separated entries of /proc that jobs may see, besides the process directories.")
+	tls := addTLSFlags(flags)
+	parseFlags(flags, args)
+
+	if *version {
+		log.Println(termite.Version())
+		os.Exit(0)
+	}
+
+	if os.Geteuid() != 0 {
+		log.Fatal("This program must run as root")
+	}
+	secret := readSecret(*secretFile)
+
+	if *logfile != "" {
+		f := OpenUniqueLog(*logfile)
+		log.Println("Log output to", *logfile)
+		log.SetOutput(f)
+	} else {
+		log.SetPrefix("W")
+	}
+
+	if *stderrFile != "" {
+		f := OpenUniqueLog(*stderrFile)
+		err := syscall.Close(2)
+		if err != nil {
+			log.Fatalf("close stderr: %v", err)
+		}
+		_, err = syscall.Dup(int(f.Fd()))
+		if err != nil {
+			log.Fatalf("dup: %v", err)
+		}
+		f.Close()
+	}
+
+	opts := termite.WorkerOptions{
+		Secret:      secret,
+		TempDir:     *tmpdir,
+		Jobs:        *jobs,
+		Paranoia:    *paranoia,
+		ReapCount:   *reapcount,
+		LogFileName: *logfile,
+		StoreOptions: cba.StoreOptions{
+			Dir:              *cachedir,
+			FetchConcurrency: *fetchConcurrency,
+		},
+		HeapLimit:   uint64(*heap) * (1 << 20),
+		Coordinator: *coordinator,
+		Port:        *port,
+		PortRetry:   *portRetry,
+	}
+	opts.NegativeAttrTTL = time.Duration(*negativeTTL * float64(time.Second))
+	opts.ReportInterval = time.Duration(*reportInterval * float64(time.Second))
+	opts.ReportMemThreshold = uint64(*memThreshold) * (1 << 20)
+	opts.ReportDiskThreshold = uint64(*diskThreshold) * (1 << 20)
+	opts.MinFreeBytes = uint64(*minFreeDisk) * (1 << 20)
+	opts.LocalPrefixes = termite.ParseLocalPrefixes(*localPrefixes)
+	opts.RateLimitBytesPerSec = int64(*rateLimit * (1 << 20))
+	opts.MaintenanceOpsPerSec = *maintenanceRate
+	opts.TLSOptions = tls.options()
+	opts.RestartArgs = args
+	opts.MaxJobMemory = uint64(*maxJobMemory) * (1 << 20)
+	opts.MaxJobCPUTime = time.Duration(*maxJobCPU * float64(time.Second))
+	opts.CgroupDir = *cgroupDir
+	opts.MaxMirrorMemory = uint64(*mirrorMemory) * (1 << 20)
+	opts.MirrorCPUShares = *mirrorShares
+	opts.Nice = *nice
+	parsedLabels, err := termite.ParseLabels(*labels)
+	if err != nil {
+		log.Fatalf("-labels: %v", err)
+	}
+	opts.Labels = parsedLabels
+	opts.ProcFiles = []string{}
+	if *procFiles != "" {
+		opts.ProcFiles = strings.Split(*procFiles, ",")
+	}
+	opts.IOClass, err = termite.ParseIOClass(*ioClass)
+	if err != nil {
+		log.Fatalf("-ionice: %v", err)
+	}
+	if os.Geteuid() == 0 {
+		nobody, err := user.Lookup(*userFlag)
+		if err != nil {
+			log.Fatalf("can't lookup %q: %v", *userFlag, err)
+		}
+		uid, err := strconv.ParseInt(nobody.Uid, 10, 64)
+		gid, err := strconv.ParseInt(nobody.Gid, 10, 64)
+		opts.User = &termite.User{
+			Uid: int(uid),
+			Gid: int(gid),
+		}
+	}
+
+	daemon := termite.NewWorker(&opts)
+	if *cpus > 0 {
+		runtime.GOMAXPROCS(*cpus)
+	}
+	log.Printf("%s on %d CPUs", termite.Version(), runtime.GOMAXPROCS(0))
+	go handleStop(daemon)
+	daemon.RunWorkerServer()
+}
@@ -0,0 +1,463 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/termite/attr"
+	"github.com/hanwen/termite/termite"
+)
+
+// TODO - this file is a mess. Clean it up.
+const _TIMEOUT = 10 * time.Second
+
+var socketRpc *rpc.Client
+var socketPath string
+var topDir string
+
+func Rpc() (*rpc.Client, error) {
+	if socketRpc == nil {
+		socket := termite.FindSocket()
+		if socket == "" {
+			wd, _ := os.Getwd()
+			return nil, fmt.Errorf("Could not find .termite-socket; cwd: %s", wd)
+		}
+		topDir, _ = filepath.Split(socket)
+		topDir = filepath.Clean(topDir)
+		socketPath = socket
+		conn, err := termite.DialSocketConnection(socket, termite.RPC_CHANNEL, _TIMEOUT)
+		if err != nil {
+			return nil, err
+		}
+		socketRpc = rpc.NewClient(conn)
+	}
+	return socketRpc, nil
+}
+
+func TryRunDirect(req *termite.WorkRequest) {
+	if req.Argv[0] == "echo" {
+		fmt.Println(strings.Join(req.Argv[1:], " "))
+		os.Exit(0)
+	}
+	if req.Argv[0] == "true" {
+		os.Exit(0)
+	}
+	if req.Argv[0] == "false" {
+		os.Exit(1)
+	}
+}
+
+var bashInternals = []string{
+	"alias", "bg", "bind", "break", "builtin", "caller", "case", "cd",
+	"command", "compgen", "complete", "compopt", "continue", "coproc",
+	"declare", "dirs", "disown" /* echo, */, "enable", "eval", "exec", "exit",
+	"export", "false", "fc", "fg", "for", "for", "function", "getopts",
+	"hash", "help", "history", "if", "jobs", "kill", "let", "local",
+	"logout", "mapfile", "popd", "printf", "pushd", "pwd", "read",
+	"readarray", "readonly", "return", "select", "set", "shift", "shopt",
+	"source", "suspend", "test", "time", "times", "trap", "true", "type",
+	"typeset", "ulimit", "umask", "unalias", "unset", "until",
+	"variables", "wait", "while",
+}
+
+func NewWorkRequest(cmd string, dir string, topdir string) *termite.WorkRequest {
+	req := &termite.WorkRequest{
+		Binary: Shell(),
+		Argv:   []string{Shell(), "-c", cmd},
+		Env:    cleanEnv(os.Environ()),
+		Dir:    dir,
+	}
+
+	parsed := termite.ParseCommandEnv(cmd, req.Env)
+	if len(parsed) > 0 {
+		// Is this really necessary?
+		for _, c := range bashInternals {
+			if parsed[0] == c {
+				return req
+			}
+		}
+
+		// A no-frills command invocation: do it directly.
+		binary, err := exec.LookPath(parsed[0])
+		if err == nil {
+			req.Argv = parsed
+			if len(binary) > 0 && binary[0] != '/' {
+				binary = filepath.Join(req.Dir, binary)
+			}
+			req.Binary = binary
+		}
+	}
+
+	return req
+}
+
+func PrepareRun(cmd string, dir string, topdir string) (*termite.WorkRequest, *termite.LocalRule) {
+	cmd = termite.MakeUnescape(cmd)
+	if cmd == ":" || strings.TrimRight(cmd, " ") == "" {
+		os.Exit(0)
+	}
+
+	req := NewWorkRequest(cmd, dir, topdir)
+	TryRunDirect(req)
+	if strings.Contains(cmd, "-march=native") {
+		// The output only runs on CPUs like ours.
+		req.RequiredCPUFeatures = termite.NativeCPUFeatures()
+	}
+
+	decider := termite.NewLocalDecider(topdir)
+	rule := decider.ShouldRunLocally(cmd)
+	if rule != nil {
+		req.Debug = rule.Debug
+		req.Memory = rule.Memory
+		req.NoSpeculation = rule.NoSpeculation
+		return req, rule
+	}
+
+	return req, nil
+}
+
+func SetRateLimit(bps int64) {
+	req := termite.SetRateLimitRequest{BytesPerSec: bps}
+	rep := termite.SetRateLimitResponse{}
+	rpc, err := Rpc()
+	if err == nil {
+		err = rpc.Call("LocalMaster.SetRateLimit", &req, &rep)
+	}
+	if err != nil {
+		log.Fatal("LocalMaster.SetRateLimit: ", err)
+	}
+	log.Printf("rate limit was %d bytes/s", rep.Previous)
+}
+
+// WriteManifest writes the manifest of the master's session to the
+// file name.
+func WriteManifest(name string, exclude string) {
+	req := termite.ManifestRequest{}
+	if exclude != "" {
+		req.Exclude = strings.Split(exclude, ",")
+	}
+	rep := termite.Manifest{}
+	rpc, err := Rpc()
+	if err == nil {
+		err = rpc.Call("LocalMaster.ExportManifest", &req, &rep)
+	}
+	if err != nil {
+		log.Fatal("LocalMaster.ExportManifest: ", err)
+	}
+	content, err := json.MarshalIndent(&rep, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(name, content, 0644)
+	}
+	if err != nil {
+		log.Fatal("writing manifest: ", err)
+	}
+	log.Printf("wrote %d files and %d deletions to %s", len(rep.Files), len(rep.Deletions), name)
+}
+
+// ResetSession starts a new session on the master.
+func ResetSession() {
+	rep := termite.SessionReport{}
+	rpc, err := Rpc()
+	if err == nil {
+		err = rpc.Call("LocalMaster.ResetSession", &termite.Empty{}, &rep)
+	}
+	if err != nil {
+		log.Fatal("LocalMaster.ResetSession: ", err)
+	}
+	log.Printf("started a new session; the last one ran %d jobs in %v", rep.Jobs, rep.WallTime)
+}
+
+func Refresh() {
+	req := 1
+	rep := 1
+	rpc, err := Rpc()
+	err = rpc.Call("LocalMaster.RefreshAttributeCache", &req, &rep)
+	if err != nil {
+		log.Fatal("LocalMaster.RefreshAttributeCache: ", err)
+	}
+}
+
+func cleanEnv(input []string) []string {
+	env := []string{}
+	for _, v := range input {
+		comps := strings.SplitN(v, "=", 2)
+		if comps[1] == "termite-make" {
+			// TODO - more generic.
+			v = fmt.Sprintf("%s=%s", comps[0], "make")
+		} else if comps[0] == "MAKE_SHELL" {
+			continue
+		}
+		env = append(env, v)
+	}
+	return env
+}
+
+func Inspect(files []string) {
+	wd, _ := os.Getwd()
+	for _, p := range files {
+		if p[0] != '/' {
+			p = filepath.Join(wd, p)
+		}
+		p = p[1:]
+		req := attr.AttrRequest{Name: p}
+		rep := attr.AttrResponse{}
+		rpc, err := Rpc()
+		err = rpc.Call("LocalMaster.InspectFile", &req, &rep)
+		if err != nil {
+			log.Fatal("LocalMaster.InspectFile: ", err)
+		}
+
+		for _, a := range rep.Attrs {
+			entries := []string{}
+			log.Printf("%v", a.LongString())
+			for n, m := range a.NameModeMap {
+				entries = append(entries, fmt.Sprintf("%s %s", n, m))
+			}
+			sort.Strings(entries)
+			for _, e := range entries {
+				log.Println(e)
+			}
+		}
+	}
+}
+
+func Shell() string {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	return shell
+}
+
+func RunLocally(req *termite.WorkRequest, rule *termite.LocalRule) syscall.WaitStatus {
+	env := os.Environ()
+	if !rule.Recurse {
+		env = cleanEnv(env)
+	}
+
+	proc, err := os.StartProcess(req.Binary, req.Argv, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	})
+	if err != nil {
+		log.Fatalf("os.StartProcess() for %v: %v", req, err)
+	}
+	msg, err := proc.Wait()
+	if err != nil {
+		log.Fatalf("proc.Wait() for %v: %v", req, err)
+	}
+	return msg.Sys().(syscall.WaitStatus)
+}
+
+// StreamOutput sets up the request so stdout and stderr are copied
+// to ours while the job runs. The returned WaitGroup is done once all
+// output has arrived.
+func StreamOutput(req *termite.WorkRequest) *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
+	req.StdoutId = termite.ConnectionId()
+	req.StderrId = termite.ConnectionId()
+	for _, s := range []struct {
+		id  string
+		dst *os.File
+	}{{req.StdoutId, os.Stdout}, {req.StderrId, os.Stderr}} {
+		conn := termite.OpenSocketConnection(socketPath, s.id, _TIMEOUT)
+		wg.Add(1)
+		go func(dst *os.File) {
+			io.Copy(dst, conn)
+			conn.Close()
+			wg.Done()
+		}(s.dst)
+	}
+	return wg
+}
+
+// CancelOnInterrupt makes Ctrl-C cancel the remote job.
+func CancelOnInterrupt(req *termite.WorkRequest) {
+	req.CancelId = termite.ConnectionId()
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	go func() {
+		<-ch
+		rpc, err := Rpc()
+		if err == nil {
+			cancelReq := termite.CancelRequest{CancelId: req.CancelId}
+			err = rpc.Call("LocalMaster.Cancel", &cancelReq, &termite.Empty{})
+		}
+		if err != nil {
+			log.Fatal("LocalMaster.Cancel: ", err)
+		}
+	}()
+}
+
+// RunWrapperMain runs the command given in args through the master,
+// in place of the shell.  It is the shell-wrapper binary, and
+// "termite run".
+func RunWrapperMain(args []string) {
+	flags := newFlagSet("shell-wrapper")
+	command := flags.String("c", "", "command to run.")
+	refresh := flags.Bool("refresh", false, "refresh master file cache.")
+	shutdown := flags.Bool("shutdown", false, "shutdown master.")
+	inspect := flags.Bool("inspect", false, "inspect files on master.")
+	rateLimit := flags.Float64("rate-limit", -1, "set the MB/s of content the master serves to workers. 0 is unlimited.")
+	exec := flags.Bool("exec", false, "run command args without shell.")
+	directory := flags.String("dir", "", "directory from where to run (default: cwd).")
+	worker := flags.String("worker", "", "address of the worker to run on, for debugging.")
+	excludeWorkers := flags.String("exclude-worker", "", "comma separated addresses of workers not to run on.")
+	requireLabels := flags.String("require-labels", "", "only run on workers with these labels, eg. arch=arm64.")
+	localFallback := flags.Bool("local-fallback", false, "run the command locally if no worker has the labels of -require-labels.")
+	affinity := flags.String("affinity", "", "jobs with the same value, eg. their main input, prefer the same worker.")
+	debug := flags.Bool("dbg", false, "set on debugging in request.")
+	verbose := flags.Bool("verbose", false, "print a report of failed jobs.")
+	timeout := flags.Float64("timeout", 0, "kill the job after this many seconds. 0 uses the master's default.")
+	manifest := flags.String("manifest", "", "write the files produced in the master's session to this file as JSON. Combine with -shutdown to write it before the master exits.")
+	manifestExclude := flags.String("manifest-exclude", "", "comma separated patterns of files to leave out of the manifest.")
+	resetSession := flags.Bool("reset-session", false, "start a new session on the master. Combine with -manifest to write the manifest of the session that ends.")
+
+	parseFlags(flags, args)
+	log.SetPrefix("S")
+
+	if *manifest != "" {
+		WriteManifest(*manifest, *manifestExclude)
+		if !*shutdown && !*resetSession {
+			return
+		}
+	}
+	if *resetSession {
+		ResetSession()
+		if !*shutdown {
+			return
+		}
+	}
+	if *shutdown {
+		req := 1
+		rep := 1
+		rpc, err := Rpc()
+		err = rpc.Call("LocalMaster.Shutdown", &req, &rep)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *refresh {
+		Refresh()
+	}
+	if *rateLimit >= 0 {
+		SetRateLimit(int64(*rateLimit * (1 << 20)))
+		return
+	}
+
+	if *inspect {
+		Inspect(flags.Args())
+	}
+
+	if *directory == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			log.Fatal("Getwd", err)
+		}
+
+		directory = &wd
+	}
+
+	var req *termite.WorkRequest
+	var rule *termite.LocalRule
+	if *exec {
+		req = &termite.WorkRequest{
+			Binary: flags.Args()[0],
+			Argv:   flags.Args(),
+			Dir:    *directory,
+			Env:    os.Environ(),
+		}
+	} else {
+		req, rule = PrepareRun(*command, *directory, topDir)
+	}
+	var waitMsg syscall.WaitStatus
+	rep := termite.WorkResponse{}
+	if rule != nil && rule.Local {
+		waitMsg = RunLocally(req, rule)
+		if !rule.SkipRefresh {
+			Refresh()
+		}
+		rep.WorkerId = "(local)"
+	} else {
+		req.Debug = req.Debug || os.Getenv("TERMITE_DEBUG") != "" || *debug
+		req.RequireWorker = *worker
+		req.TimeoutNs = int64(*timeout * float64(time.Second))
+		req.AffinityHint = *affinity
+		if *excludeWorkers != "" {
+			req.ExcludeWorkers = strings.Split(*excludeWorkers, ",")
+		}
+		if *requireLabels != "" {
+			labels, err := termite.ParseLabels(*requireLabels)
+			if err != nil {
+				log.Fatalf("-require-labels: %v", err)
+			}
+			req.RequiredLabels = labels
+		}
+		rpc, err := Rpc()
+		if err != nil {
+			log.Fatalf("rpc connection problem (%s): %v", *command, err)
+		}
+		output := StreamOutput(req)
+		CancelOnInterrupt(req)
+		req.ReportFailure = true
+		err = rpc.Call("LocalMaster.Run", &req, &rep)
+		if err != nil {
+			log.Fatal("LocalMaster.Run: ", err)
+		}
+		output.Wait()
+		if f := rep.Failure; f != nil && f.NoMatchingWorker && *localFallback {
+			log.Printf("%s; running %q locally", f.Error, *command)
+			rep = termite.WorkResponse{
+				WorkerId: "(local)",
+				Exit:     RunLocally(req, &termite.LocalRule{}),
+			}
+			Refresh()
+		}
+		if len(rep.StaleReads) > 0 {
+			log.Printf("Job %q read files that changed since: %v", *command, rep.StaleReads)
+		}
+		if len(rep.OpenFiles) > 0 {
+			log.Printf("Job %q left files open for writing: %v", *command, rep.OpenFiles)
+		}
+		if f := rep.Failure; f != nil && *verbose {
+			log.Printf("Job %q %v", *command, f)
+		}
+		if f := rep.Failure; f != nil && rep.Exit == 0 && !rep.Cancelled {
+			log.Fatalf("LocalMaster.Run: %s: %s", f.Phase, f.Error)
+		}
+		if rep.Cancelled {
+			log.Printf("Cancelled %q", *command)
+			os.Exit(130)
+		}
+
+		os.Stdout.Write([]byte(rep.Stdout))
+		os.Stderr.Write([]byte(rep.Stderr))
+
+		waitMsg = rep.Exit
+	}
+
+	if waitMsg != 0 && rep.Failure != nil {
+		log.Printf("Failed %s in %s: '%q'", rep.WorkerId, rep.Failure.Phase, *command)
+	} else if waitMsg != 0 {
+		log.Printf("Failed %s: '%q'", rep.WorkerId, *command)
+	}
+
+	// TODO - is this necessary?
+	rpc, _ := Rpc()
+	rpc.Close()
+	os.Exit(int(waitMsg))
+}
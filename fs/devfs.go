@@ -28,6 +28,10 @@ func (me *DevFs) OnMount(fsc *nodefs.FileSystemConnector) {
 	me.root.Inode().AddChild("null", n)
 	n = me.root.Inode().New(false, &urandomNode{Node: def, size: 128})
 	me.root.Inode().AddChild("urandom", n)
+
+	// See ProcFs for the fd entries.
+	n = me.root.Inode().New(false, &linkNode{Node: def, target: "/proc/self/fd"})
+	me.root.Inode().AddChild("fd", n)
 }
 
 func (me *DevFs) Root() nodefs.Node {
@@ -95,3 +99,22 @@ func (me *urandomNode) Open(flags uint32, context *fuse.Context) (file nodefs.Fi
 
 	return nodefs.NewDataFile(randData[:n]), fuse.OK
 }
+
+type linkNode struct {
+	nodefs.Node
+	target string
+}
+
+func (me *linkNode) Deletable() bool {
+	return false
+}
+
+func (me *linkNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Context) (code fuse.Status) {
+	out.Mode = uint32(fuse.S_IFLNK | 0777)
+	out.Size = uint64(len(me.target))
+	return fuse.OK
+}
+
+func (me *linkNode) Readlink(c *fuse.Context) ([]byte, fuse.Status) {
+	return []byte(me.target), fuse.OK
+}
@@ -55,3 +55,12 @@ func TestRandom(t *testing.T) {
 		t.Error("/dev/urandom returned nothing.")
 	}
 }
+
+func TestDevFd(t *testing.T) {
+	wd, clean := setupDevNullFs()
+	defer clean()
+
+	if got, err := os.Readlink(wd + "/fd"); err != nil || got != "/proc/self/fd" {
+		t.Errorf("Readlink: got %q, %v", got, err)
+	}
+}
@@ -35,6 +35,10 @@ type MemUnionFs struct {
 	// here.  After deletion, entries may be recreated, but they
 	// will be treated as new.
 	deleted map[string]bool
+
+	// Results returned by ReapClosed since the last Reset.  They
+	// are not returned again unless they change.
+	harvested map[string]Result
 }
 
 type memNode struct {
@@ -48,6 +52,9 @@ type memNode struct {
 	changed  bool
 	link     string
 	info     fuse.Attr
+
+	// Number of files open for writing.
+	writers int
 }
 
 type Result struct {
@@ -57,13 +64,24 @@ type Result struct {
 	Link     string
 }
 
+func (me *Result) same(other *Result) bool {
+	if (me.Attr == nil) != (other.Attr == nil) {
+		return false
+	}
+	if me.Attr != nil && *me.Attr != *other.Attr {
+		return false
+	}
+	return me.Original == other.Original && me.Backing == other.Backing && me.Link == other.Link
+}
+
 func (me *MemUnionFs) OnMount(conn *nodefs.FileSystemConnector) {
 	me.connector = conn
 }
 
-func (me *MemUnionFs) markCloseWrite() {
+func (me *MemUnionFs) markCloseWrite(node *memNode) {
 	me.mutex.Lock()
 	defer me.mutex.Unlock()
+	node.writers--
 	me.openWritable--
 	if me.openWritable < 0 {
 		log.Panicf("openWritable Underflow")
@@ -87,13 +105,35 @@ func (me *MemUnionFs) Reset() {
 	}
 
 	me.deleted = make(map[string]bool, len(me.deleted))
+	me.harvested = map[string]Result{}
 	me.clearBackingStore()
 }
 
+// Reap returns the changes to the file system, once no files are
+// open for writing.
 func (me *MemUnionFs) Reap() map[string]*Result {
+	m, _ := me.ReapWait(-1)
+	return m
+}
+
+// ReapWait is Reap, but waits at most timeout for files open for
+// writing to be closed.  A negative timeout waits forever.  It also
+// returns the changed files that are still open.  Their results
+// describe what was written so far, and their backing files may
+// still change.
+func (me *MemUnionFs) ReapWait(timeout time.Duration) (map[string]*Result, []string) {
 	me.mutex.Lock()
 	defer me.mutex.Unlock()
-	for me.openWritable > 0 {
+	deadline := time.Now().Add(timeout)
+	if timeout >= 0 {
+		t := time.AfterFunc(timeout, func() {
+			me.mutex.Lock()
+			defer me.mutex.Unlock()
+			me.cond.Broadcast()
+		})
+		defer t.Stop()
+	}
+	for me.openWritable > 0 && (timeout < 0 || time.Now().Before(deadline)) {
 		me.cond.Wait()
 	}
 
@@ -126,10 +166,67 @@ func (me *MemUnionFs) Reap() map[string]*Result {
 		}
 	}
 
-	me.root.reap("", m)
+	seen := map[string]bool{}
+	me.root.reap("", m, seen)
+	for name, h := range me.harvested {
+		if r := m[name]; r != nil && r.same(&h) {
+			delete(m, name)
+		}
+		if !seen[name] {
+			m[name] = &Result{}
+		}
+	}
+
+	var open []string
+	if me.openWritable > 0 {
+		for name, r := range m {
+			if r.Attr != nil && me.writing(name) {
+				open = append(open, name)
+			}
+		}
+		sort.Strings(open)
+	}
+	return m, open
+}
+
+// writing returns whether the file name is open for writing.  Must
+// be called with the mutex held.
+func (me *MemUnionFs) writing(name string) bool {
+	node, rest := me.connector.Node(me.root.Inode(), name)
+	return len(rest) == 0 && node.Node().(*memNode).writers > 0
+}
+
+// ReapClosed returns the changed files that are not open for
+// writing, and the changed directories and symlinks, while the file
+// system stays in use.  Deletions are left for Reap.  Results are
+// only returned again, by ReapClosed or Reap, if they change.  The
+// backing files remain in use by the file system.
+func (me *MemUnionFs) ReapClosed() map[string]*Result {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	m := map[string]*Result{}
+	me.root.reap("", m, map[string]bool{})
+	for name, r := range m {
+		if h, ok := me.harvested[name]; me.writing(name) || (ok && r.same(&h)) {
+			delete(m, name)
+			continue
+		}
+		me.harvested[name] = *r
+	}
 	return m
 }
 
+// Unharvest makes ReapClosed and Reap return the given results of
+// ReapClosed again, for a harvest that could not be shipped.
+func (me *MemUnionFs) Unharvest(results map[string]*Result) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	for name := range results {
+		delete(me.harvested, name)
+	}
+}
+
 func (me *MemUnionFs) clearBackingStore() {
 	f, err := os.Open(me.backingStore)
 	if err != nil {
@@ -229,6 +326,7 @@ func NewMemUnionFs(backingStore string, roFs pathfs.FileSystem) (*MemUnionFs, er
 	me := &MemUnionFs{
 		FileSystem:   nodefs.NewDefaultFileSystem(),
 		deleted:      make(map[string]bool),
+		harvested:    map[string]Result{},
 		backingStore: backingStore,
 		readonly:     roFs,
 	}
@@ -434,6 +532,7 @@ func (me *memNode) Create(name string, flags uint32, mode uint32, context *fuse.
 	me.Inode().AddChild(name, n.Inode())
 	me.touch()
 	me.fs.openWritable++
+	n.writers++
 	return n.newFile(nodefs.NewLoopbackFile(f), true), n, fuse.OK
 }
 
@@ -456,7 +555,7 @@ func (me *memNodeFile) Release() {
 	// to disk.
 	me.File.Release()
 	if me.writable {
-		me.node.fs.markCloseWrite()
+		me.node.fs.markCloseWrite(me.node)
 	}
 }
 
@@ -483,34 +582,45 @@ func (me *memNode) newFile(f nodefs.File, writable bool) nodefs.File {
 	}
 }
 
+// promote copies the file to a backing file, so it can be written.
 // Must run inside mutex.
-func (me *memNode) promote() {
-	if me.backing == "" {
-		me.backing = me.fs.getFilename()
-		destfs := pathfs.NewLoopbackFileSystem("/")
-		pathfs.CopyFile(me.fs.readonly, destfs,
-			me.original, strings.TrimLeft(me.backing, "/"), nil)
-		me.original = ""
-		files := me.Inode().Files(0)
-		for _, f := range files {
-			mf := f.File.(*memNodeFile)
-			inner := mf.File
-			osFile, err := os.Open(me.backing)
-			if err != nil {
-				panic("error opening backing file")
-			}
-			mf.File = nodefs.NewLoopbackFile(osFile)
-			inner.Flush()
-			inner.Release()
+func (me *memNode) promote() fuse.Status {
+	if me.backing != "" {
+		return fuse.OK
+	}
+	backing := me.fs.getFilename()
+	destfs := pathfs.NewLoopbackFileSystem("/")
+	if code := pathfs.CopyFile(me.fs.readonly, destfs,
+		me.original, strings.TrimLeft(backing, "/"), nil); !code.Ok() {
+		log.Printf("copying %q to the backing store: %v", me.original, code)
+		os.Remove(backing)
+		return code
+	}
+	me.backing = backing
+	me.original = ""
+	files := me.Inode().Files(0)
+	for _, f := range files {
+		mf := f.File.(*memNodeFile)
+		inner := mf.File
+		osFile, err := os.Open(me.backing)
+		if err != nil {
+			log.Printf("opening backing file %q: %v", me.backing, err)
+			return fuse.EIO
 		}
+		mf.File = nodefs.NewLoopbackFile(osFile)
+		inner.Flush()
+		inner.Release()
 	}
+	return fuse.OK
 }
 
 func (me *memNode) Open(flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
 	me.mutex.Lock()
 	defer me.mutex.Unlock()
 	if flags&fuse.O_ANYWRITE != 0 {
-		me.promote()
+		if code := me.promote(); !code.Ok() {
+			return nil, code
+		}
 		me.touch()
 	}
 
@@ -522,6 +632,7 @@ func (me *memNode) Open(flags uint32, context *fuse.Context) (file nodefs.File,
 		wr := flags&fuse.O_ANYWRITE != 0
 		if wr {
 			me.fs.openWritable++
+			me.writers++
 		}
 		return me.newFile(nodefs.NewLoopbackFile(f), wr), fuse.OK
 	}
@@ -538,12 +649,11 @@ func (me *memNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Conte
 	var sz uint64
 	if file != nil {
 		code := file.GetAttr(out)
-		if code.Ok() {
-			sz = out.Size
-		} else {
-			msg := fmt.Sprintf("File.GetAttr(%s) = %v, %v", file.String(), out, code)
-			panic(msg)
+		if !code.Ok() {
+			log.Printf("File.GetAttr(%s) = %v, %v", file.String(), out, code)
+			return fuse.EIO
 		}
+		sz = out.Size
 	}
 	me.mutex.RLock()
 	defer me.mutex.RUnlock()
@@ -557,7 +667,9 @@ func (me *memNode) GetAttr(out *fuse.Attr, file nodefs.File, context *fuse.Conte
 func (me *memNode) Truncate(file nodefs.File, size uint64, context *fuse.Context) (code fuse.Status) {
 	me.mutex.Lock()
 	defer me.mutex.Unlock()
-	me.promote()
+	if code := me.promote(); !code.Ok() {
+		return code
+	}
 	if file != nil {
 		code = file.Truncate(size)
 	} else {
@@ -629,7 +741,8 @@ func (me *memNode) OpenDir(context *fuse.Context) (stream []fuse.DirEntry, code
 	return stream, fuse.OK
 }
 
-func (me *memNode) reap(path string, results map[string]*Result) {
+func (me *memNode) reap(path string, results map[string]*Result, seen map[string]bool) {
+	seen[path] = true
 	if me.changed {
 		info := me.info
 		results[path] = &Result{
@@ -642,7 +755,7 @@ func (me *memNode) reap(path string, results map[string]*Result) {
 
 	for n, ch := range me.Inode().FsChildren() {
 		p := fastpath.Join(path, n)
-		ch.Node().(*memNode).reap(p, results)
+		ch.Node().(*memNode).reap(p, results, seen)
 	}
 }
 
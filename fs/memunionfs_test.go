@@ -1002,3 +1002,101 @@ func TestMemUnionFsTruncateOpen(t *testing.T) {
 		t.Errorf("Size should be 4096 after Truncate: %d", fi.Size())
 	}
 }
+
+func TestMemUnionFsReapClosed(t *testing.T) {
+	wd, ufs, clean := setupMemUfs(t)
+	defer clean()
+
+	writeToFile(wd+"/mnt/done", "done")
+	f, err := os.Create(wd + "/mnt/open")
+	CheckSuccess(err)
+	_, err = f.Write([]byte("partial"))
+	CheckSuccess(err)
+
+	r := ufs.ReapClosed()
+	if r["done"] == nil || r["done"].Backing == "" || r["open"] != nil {
+		t.Errorf("got %v, want done but not open", r)
+	}
+	if content, err := ioutil.ReadFile(r["done"].Backing); err != nil || string(content) != "done" {
+		t.Errorf("backing file of done: %q, %v", content, err)
+	}
+	if r := ufs.ReapClosed(); len(r) != 0 {
+		t.Errorf("unchanged files reaped again: %v", r)
+	}
+	ufs.Unharvest(r)
+	if r := ufs.ReapClosed(); r["done"] == nil {
+		t.Errorf("unharvested file not reaped again: %v", r)
+	}
+
+	CheckSuccess(f.Close())
+	r = ufs.ReapClosed()
+	if r["open"] == nil || r["done"] != nil {
+		t.Errorf("got %v, want only open", r)
+	}
+
+	os.Remove(wd + "/mnt/done")
+	writeToFile(wd+"/mnt/late", "late")
+	r = ufs.Reap()
+	if d := r["done"]; d == nil || d.Attr != nil {
+		t.Errorf("harvested file that was removed should be a deletion: %v", r)
+	}
+	if r["open"] != nil || r["late"] == nil {
+		t.Errorf("got %v, want late but not open", r)
+	}
+
+	ufs.Reset()
+	if r := ufs.Reap(); len(r) != 0 {
+		t.Errorf("after reset: %v", r)
+	}
+}
+
+func TestMemUnionFsReapWait(t *testing.T) {
+	wd, ufs, clean := setupMemUfs(t)
+	defer clean()
+
+	writeToFile(wd+"/mnt/done", "done")
+	f, err := os.Create(wd + "/mnt/open")
+	CheckSuccess(err)
+	_, err = f.Write([]byte("partial"))
+	CheckSuccess(err)
+	defer f.Close()
+
+	start := time.Now()
+	r, open := ufs.ReapWait(50 * time.Millisecond)
+	if d := time.Now().Sub(start); d < 50*time.Millisecond {
+		t.Errorf("ReapWait returned after %v", d)
+	}
+	if r["done"] == nil || r["open"] == nil {
+		t.Errorf("got %v, want done and open", r)
+	}
+	if !reflect.DeepEqual(open, []string{"open"}) {
+		t.Errorf("got open files %v", open)
+	}
+	if content, err := ioutil.ReadFile(r["open"].Backing); err != nil || string(content) != "partial" {
+		t.Errorf("backing file of open: %q, %v", content, err)
+	}
+}
+
+// TestMemUnionFsForkedWriter checks that a file stays open for
+// writing while a child that inherited the descriptor runs, even
+// though the process that opened it exited.
+func TestMemUnionFsForkedWriter(t *testing.T) {
+	wd, ufs, clean := setupMemUfs(t)
+	defer clean()
+
+	cmd := exec.Command("/bin/sh", "-c",
+		`exec 3>file; echo parent >&3; /bin/sh -c "sleep 0.2; echo child >&3" & exit 0`)
+	cmd.Dir = wd + "/mnt"
+	CheckSuccess(cmd.Run())
+
+	if r := ufs.ReapClosed(); r["file"] != nil {
+		t.Errorf("harvested file that a child still writes: %v", r)
+	}
+	r := ufs.Reap()
+	if r["file"] == nil {
+		t.Fatalf("got %v, want file", r)
+	}
+	if content, err := ioutil.ReadFile(r["file"].Backing); err != nil || string(content) != "parent\nchild\n" {
+		t.Errorf("backing file: %q, %v", content, err)
+	}
+}
@@ -2,11 +2,13 @@ package fs
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"unicode"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -25,22 +27,36 @@ type ProcFs struct {
 	Uid              int
 }
 
+// DefaultProcFiles are the entries of /proc, besides the process
+// directories, that a ProcFs shows by default.
+var DefaultProcFiles = []string{
+	"meminfo",
+	"cpuinfo",
+	"iomem",
+	"ioport",
+	"loadavg",
+	"stat",
+	"self",
+	"filesystems",
+	"mounts",
+	"version",
+}
+
 func NewProcFs() *ProcFs {
-	return &ProcFs{
+	me := &ProcFs{
 		FileSystem:  pathfs.NewLoopbackFileSystem("/proc"),
 		StripPrefix: "/",
-		AllowedRootFiles: map[string]int{
-			"meminfo":     1,
-			"cpuinfo":     1,
-			"iomem":       1,
-			"ioport":      1,
-			"loadavg":     1,
-			"stat":        1,
-			"self":        1,
-			"filesystems": 1,
-			"mounts":      1,
-			"version":     1,
-		},
+	}
+	me.SetAllowedRootFiles(DefaultProcFiles)
+	return me
+}
+
+// SetAllowedRootFiles sets the entries of /proc, besides the process
+// directories, that are shown.
+func (me *ProcFs) SetAllowedRootFiles(names []string) {
+	me.AllowedRootFiles = map[string]int{}
+	for _, n := range names {
+		me.AllowedRootFiles[n] = 1
 	}
 }
 
@@ -62,6 +78,9 @@ func SplitPath(name string) (dir, base string) {
 
 func (me *ProcFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
 	dir, base := SplitPath(name)
+	if isFdDir(dir) {
+		return me.fdGetAttr(name, context)
+	}
 	if name != "" && dir == "" && !isNum(name) && me.AllowedRootFiles != nil {
 		if _, ok := me.AllowedRootFiles[base]; !ok {
 			return nil, fuse.ENOENT
@@ -81,6 +100,9 @@ func (me *ProcFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.
 }
 
 func (me *ProcFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if dir, _ := SplitPath(name); isFdDir(dir) {
+		return me.fdOpen(name, flags, context)
+	}
 	p := filepath.Join("/proc", name)
 	content, err := ioutil.ReadFile(p)
 	if err == nil {
@@ -97,9 +119,226 @@ func (me *ProcFs) Readlink(name string, context *fuse.Context) (string, fuse.Sta
 	if name == "self" {
 		return fmt.Sprintf("%d", context.Pid), fuse.OK
 	}
+	if dir, _ := SplitPath(name); isFdDir(dir) {
+		target, _, code := me.fdTarget(name, context)
+		return target, code
+	}
 	val, code := me.FileSystem.Readlink(name, context)
 	if code.Ok() && strings.HasPrefix(val, me.StripPrefix) {
 		val = "/" + strings.TrimLeft(val[len(me.StripPrefix):], "/")
 	}
 	return val, code
 }
+
+func (me *ProcFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if !isFdDir(name) {
+		return me.FileSystem.OpenDir(name, context)
+	}
+	if me.foreign(name, context) {
+		return nil, fuse.EPERM
+	}
+	d, err := os.Open(filepath.Join("/proc", name))
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	var visible []fuse.DirEntry
+	for _, n := range names {
+		_, special, code := me.fdTarget(filepath.Join(name, n), context)
+		if !code.Ok() {
+			continue
+		}
+		e := fuse.DirEntry{Name: n, Mode: fuse.S_IFLNK}
+		if special {
+			e.Mode = fuse.S_IFREG
+		}
+		visible = append(visible, e)
+	}
+	return visible, fuse.OK
+}
+
+// The <pid>/fd/<n> entries link to the files a process has open.  The
+// kernel opens the file itself when such a link is followed, even if
+// it has no name, such as a pipe, but through FUSE the entries are
+// plain symlinks.  Links to files in the view of the job are made
+// relative to StripPrefix, and links to other files are denied.
+// Pipes, sockets and the like show up as files that read from and
+// write to the open file, so /dev/fd/<n> works, eg. for process
+// substitution in bash.
+
+// isFdDir returns true if dir is a <pid>/fd directory.
+func isFdDir(dir string) bool {
+	pid, fd := SplitPath(dir)
+	return fd == "fd" && isNum(pid)
+}
+
+// foreign returns true if the process that fdDir belongs to is not
+// part of the job of the caller.  Jobs run in a process group of
+// their own, so a process is part of the job if it, or one of its
+// ancestors, is in the process group of the caller.  Processes of
+// other users are denied too; as root, we could otherwise see the
+// files of any process.
+func (me *ProcFs) foreign(fdDir string, context *fuse.Context) bool {
+	pid, _ := SplitPath(fdDir)
+	if os.Geteuid() == 0 {
+		var st syscall.Stat_t
+		if err := syscall.Stat(filepath.Join("/proc", pid), &st); err != nil || st.Uid != context.Uid {
+			return true
+		}
+	}
+	_, group, err := procParent(fmt.Sprint(context.Pid))
+	if err != nil {
+		return true
+	}
+	// Bounded, in case the processes change under us.
+	for i := 0; i < 1024 && pid != "0"; i++ {
+		parent, g, err := procParent(pid)
+		if err != nil {
+			return true
+		}
+		if g == group {
+			return false
+		}
+		pid = parent
+	}
+	return true
+}
+
+// procParent returns the parent pid and the process group of pid.
+func procParent(pid string) (parent string, group string, err error) {
+	content, err := ioutil.ReadFile(filepath.Join("/proc", pid, "stat"))
+	if err != nil {
+		return "", "", err
+	}
+	// The command name, in parentheses, may contain spaces.
+	s := string(content)
+	fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+	if len(fields) < 3 {
+		return "", "", fmt.Errorf("%s/stat: short line %q", pid, s)
+	}
+	return fields[1], fields[2], nil
+}
+
+// inView returns the path of p below StripPrefix.
+func (me *ProcFs) inView(p string) (string, bool) {
+	prefix := strings.TrimRight(me.StripPrefix, "/")
+	switch {
+	case prefix == "":
+		return p, true
+	case p == prefix:
+		return "/", true
+	case strings.HasPrefix(p, prefix+"/"):
+		return p[len(prefix):], true
+	}
+	return "", false
+}
+
+// fdTarget returns where the fd entry name links to.  special is set
+// if the target is not a file name.
+func (me *ProcFs) fdTarget(name string, context *fuse.Context) (target string, special bool, code fuse.Status) {
+	dir, _ := SplitPath(name)
+	if me.foreign(dir, context) {
+		return "", false, fuse.EPERM
+	}
+	val, err := os.Readlink(filepath.Join("/proc", name))
+	if err != nil {
+		return "", false, fuse.ToStatus(err)
+	}
+	if !strings.HasPrefix(val, "/") {
+		return val, true, fuse.OK
+	}
+	if p, ok := me.inView(val); ok {
+		return p, false, fuse.OK
+	}
+	return "", false, fuse.EACCES
+}
+
+func (me *ProcFs) fdGetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	target, special, code := me.fdTarget(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	p := filepath.Join("/proc", name)
+	if !special {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return nil, fuse.ToStatus(err)
+		}
+		a := fuse.ToAttr(fi)
+		a.Size = uint64(len(target))
+		return a, fuse.OK
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	a := fuse.ToAttr(fi)
+	a.Mode = fuse.S_IFREG | a.Mode&07777
+	a.Size = 0
+	return a, fuse.OK
+}
+
+func (me *ProcFs) fdOpen(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	_, special, code := me.fdTarget(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	if !special {
+		// The kernel follows the link rather than opening it.
+		return nil, fuse.EINVAL
+	}
+	f, err := os.OpenFile(filepath.Join("/proc", name), int(flags)&syscall.O_ACCMODE, 0)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return &nodefs.WithFlags{
+		File:      &streamFile{File: nodefs.NewDefaultFile(), f: f},
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}, fuse.OK
+}
+
+// Truncate ignores truncation of pipes, which comes with opening
+// /dev/fd/<n> with O_TRUNC.
+func (me *ProcFs) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	if dir, _ := SplitPath(name); isFdDir(dir) {
+		_, special, code := me.fdTarget(name, context)
+		if code.Ok() && !special {
+			code = fuse.EINVAL
+		}
+		return code
+	}
+	return me.FileSystem.Truncate(name, size, context)
+}
+
+// streamFile reads and writes a pipe or socket in order, ignoring
+// offsets.
+type streamFile struct {
+	nodefs.File
+	f *os.File
+}
+
+func (me *streamFile) String() string {
+	return fmt.Sprintf("streamFile(%s)", me.f.Name())
+}
+
+func (me *streamFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	n, err := me.f.Read(dest)
+	if err != nil && err != io.EOF {
+		return nil, fuse.ToStatus(err)
+	}
+	return fuse.ReadResultData(dest[:n]), fuse.OK
+}
+
+func (me *streamFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	n, err := me.f.Write(data)
+	return uint32(n), fuse.ToStatus(err)
+}
+
+func (me *streamFile) Release() {
+	me.f.Close()
+}
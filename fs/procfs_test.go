@@ -0,0 +1,118 @@
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestProcFsFd(t *testing.T) {
+	view, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(view)
+	outside, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(outside)
+
+	me := NewProcFs()
+	me.StripPrefix = view
+	context := &fuse.Context{
+		Owner: fuse.Owner{Uid: uint32(os.Getuid())},
+		Pid:   uint32(os.Getpid()),
+	}
+	fdName := func(f *os.File) string {
+		return fmt.Sprintf("%d/fd/%d", os.Getpid(), f.Fd())
+	}
+
+	inside, err := os.Create(filepath.Join(view, "inside"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer inside.Close()
+	if got, code := me.Readlink(fdName(inside), context); !code.Ok() || got != "/inside" {
+		t.Errorf("Readlink in view: got %q, %v", got, code)
+	}
+	if a, code := me.GetAttr(fdName(inside), context); !code.Ok() || !a.IsSymlink() {
+		t.Errorf("GetAttr in view: got %v, %v", a, code)
+	}
+
+	hidden, err := os.Create(filepath.Join(outside, "hidden"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer hidden.Close()
+	if _, code := me.GetAttr(fdName(hidden), context); code.Ok() {
+		t.Errorf("GetAttr of a file outside the view succeeded")
+	}
+	if got, code := me.Readlink(fdName(hidden), context); code.Ok() {
+		t.Errorf("Readlink of a file outside the view: got %q", got)
+	}
+	dir, _ := SplitPath(fdName(hidden))
+	entries, _ := me.OpenDir(dir, context)
+	listed := map[string]bool{}
+	for _, e := range entries {
+		listed[e.Name] = true
+	}
+	if !listed[fmt.Sprint(inside.Fd())] || listed[fmt.Sprint(hidden.Fd())] {
+		t.Errorf("OpenDir: got %v, want %d but not %d", entries, inside.Fd(), hidden.Fd())
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer r.Close()
+	if a, code := me.GetAttr(fdName(r), context); !code.Ok() || !a.IsRegular() {
+		t.Errorf("GetAttr of a pipe: got %v, %v", a, code)
+	}
+	f, code := me.Open(fdName(r), uint32(os.O_RDONLY), context)
+	if !code.Ok() {
+		t.Fatalf("Open of a pipe: %v", code)
+	}
+	defer f.Release()
+	w.Write([]byte("hi"))
+	w.Close()
+	res, code := f.Read(make([]byte, 10), 1234)
+	if !code.Ok() {
+		t.Fatalf("Read: %v", code)
+	}
+	if got, _ := res.Bytes(nil); string(got) != "hi" {
+		t.Errorf("Read: got %q, want hi", got)
+	}
+}
+
+func TestProcFsFdOtherJob(t *testing.T) {
+	me := NewProcFs()
+	start := func() *exec.Cmd {
+		cmd := exec.Command("sleep", "10")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+		return cmd
+	}
+	job := start()
+	defer job.Wait()
+	defer job.Process.Kill()
+	other := start()
+	defer other.Wait()
+	defer other.Process.Kill()
+
+	context := &fuse.Context{
+		Owner: fuse.Owner{Uid: uint32(os.Getuid())},
+		Pid:   uint32(job.Process.Pid),
+	}
+	if _, code := me.OpenDir(fmt.Sprintf("%d/fd", job.Process.Pid), context); !code.Ok() {
+		t.Errorf("OpenDir of the own job: %v", code)
+	}
+	if _, code := me.OpenDir(fmt.Sprintf("%d/fd", other.Process.Pid), context); code.Ok() {
+		t.Errorf("OpenDir of another job succeeded")
+	}
+	if _, code := me.OpenDir(fmt.Sprintf("%d/fd", os.Getpid()), context); code.Ok() {
+		t.Errorf("OpenDir of the parent of the job succeeded")
+	}
+}
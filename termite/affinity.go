@@ -0,0 +1,140 @@
+package termite
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Jobs that read the same inputs, such as recompiles of a source
+// file in incremental builds, are sent to the same worker, which
+// likely still has the inputs in its content store.  The worker is
+// chosen by rendezvous hashing of the input paths over the mirrors,
+// so adding or dropping a mirror only moves the jobs that preferred
+// it.  If the preferred mirror is saturated, pick falls back to
+// selection by load.  The mirror a job ran on is remembered for a
+// while, by the fingerprint of the job, and preferred over the hashed
+// one when the same job runs again, since that is where its inputs
+// are now.  Jobs can also name their inputs in
+// WorkRequest.AffinityHint, eg. when the command line does not show
+// them.
+
+// Number of jobs remembered per generation in
+// mirrorConnections.recent.
+const _AFFINITY_RECENT = 4096
+
+// affinityWord splits command lines into words that may name files.
+var affinityWord = regexp.MustCompile(`[^\s;&|<>()"'=]+`)
+
+// affinityKey returns a stable hash of the affinity hint of req, or
+// of the files below root named on its command line, relative ones
+// taken from req.Dir.  It returns 0 if there are none.
+func affinityKey(root string, req *WorkRequest) uint64 {
+	if req.AffinityHint != "" {
+		h := fnv.New64a()
+		io.WriteString(h, req.AffinityHint)
+		return h.Sum64()
+	}
+	if root == "" {
+		return 0
+	}
+	names := affinityFiles(root, req)
+	if len(names) == 0 {
+		return 0
+	}
+	sort.Strings(names)
+	h := fnv.New64a()
+	for _, n := range names {
+		io.WriteString(h, n)
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// affinityFiles returns the paths below root that the command line
+// of req seems to name.
+func affinityFiles(root string, req *WorkRequest) []string {
+	root = filepath.Clean(root)
+	var names []string
+	for _, w := range affinityWord.FindAllString(strings.Join(req.Argv, " "), -1) {
+		var p string
+		if i := strings.Index(w, root+"/"); i >= 0 {
+			// Also finds -I/root/include.
+			p = w[i:]
+		} else if req.Dir != "" && w[0] != '-' && w[0] != '/' && strings.ContainsAny(w, "./") {
+			p = filepath.Join(req.Dir, w)
+		} else {
+			continue
+		}
+		p = filepath.Clean(p)
+		if strings.HasPrefix(p, root+"/") {
+			names = append(names, p)
+		}
+	}
+	return names
+}
+
+// affinityFingerprint returns the key under which the mirror that ran
+// req is remembered.  It is WorkRequest.Fingerprint without input
+// hashes, which the master does not know before the job runs; a
+// recompile after an edit is still the same job.
+func affinityFingerprint(req *WorkRequest) string {
+	return req.Fingerprint(nil)
+}
+
+// affinityWeight ranks the mirror at addr for key; the mirror with
+// the highest weight is preferred.
+func affinityWeight(key uint64, addr string) uint64 {
+	h := fnv.New64a()
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], key)
+	h.Write(b[:])
+	io.WriteString(h, addr)
+	return h.Sum64()
+}
+
+// preferredMirror returns the suitable mirror with the highest weight
+// for key.  Must be called with lock held.
+func (me *mirrorConnections) preferredMirror(key uint64, req *WorkRequest) *mirrorConnection {
+	var best *mirrorConnection
+	var bestWeight uint64
+	for addr, mc := range me.mirrors {
+		if !me.suitable(addr, req) {
+			continue
+		}
+		if w := affinityWeight(key, addr); best == nil || w > bestWeight {
+			best = mc
+			bestWeight = w
+		}
+	}
+	return best
+}
+
+// recentMirror returns the suitable mirror that last ran the job
+// with fingerprint fp, if any.  Must be called with lock held.
+func (me *mirrorConnections) recentMirror(fp string, req *WorkRequest) *mirrorConnection {
+	addr, ok := me.recent[fp]
+	if !ok {
+		addr, ok = me.recentOld[fp]
+	}
+	if mc := me.mirrors[addr]; ok && mc != nil && me.suitable(addr, req) {
+		return mc
+	}
+	return nil
+}
+
+// remember records that the job with fingerprint fp runs on the
+// mirror at addr.  Jobs are kept in two generations; the older one is
+// dropped when the current one fills up.  Must be called with lock
+// held.
+func (me *mirrorConnections) remember(fp string, addr string) {
+	if len(me.recent) >= _AFFINITY_RECENT || me.recent == nil {
+		me.recentOld = me.recent
+		me.recent = make(map[string]string)
+	}
+	me.recent[fp] = addr
+}
@@ -0,0 +1,77 @@
+package termite
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Hermetic toolchains ship their binaries inside the synced tree.  With
+// MasterOptions.VerifyBinaries, a binary below the writable or source
+// root is resolved through the attribute cache, following symlinks
+// there, rather than on the host.  The job then carries the hash of
+// the binary, and the worker refuses to run it if its view of the
+// file has different content.  Binaries outside the synced roots are
+// run from the path given, as before.
+
+// Maximum number of symlinks followed when resolving a binary.
+const _MAX_BINARY_SYMLINKS = 40
+
+// syncedPath returns true if name, without leading /, is inside the
+// writable or source root.
+func (me *Master) syncedPath(name string) bool {
+	for _, r := range []string{me.options.WritableRoot, me.options.SourceRoot} {
+		r = strings.TrimLeft(r, "/")
+		if r != "" && (name == r || strings.HasPrefix(name, r+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveBinary sets req.Binary to the synced file that it refers to,
+// and req.BinaryHash to its content hash.
+func (me *Master) resolveBinary(req *WorkRequest) error {
+	name := strings.TrimLeft(filepath.Clean(req.Binary), "/")
+	for i := 0; i < _MAX_BINARY_SYMLINKS; i++ {
+		if !me.syncedPath(name) {
+			return nil
+		}
+		a := me.attributes.Get(name)
+		if a == nil || a.Deletion() {
+			return fmt.Errorf("binary %s: /%s does not exist", req.Binary, name)
+		}
+		if a.IsSymlink() {
+			link := a.Link
+			if !filepath.IsAbs(link) {
+				dir, _ := SplitPath(name)
+				link = filepath.Join("/"+dir, link)
+			}
+			name = strings.TrimLeft(filepath.Clean(link), "/")
+			continue
+		}
+		if !a.IsRegular() || a.Mode&0111 == 0 {
+			return fmt.Errorf("binary %s: /%s is not an executable file", req.Binary, name)
+		}
+		if a.Hash == "" || !me.contentStore.Has(a.Hash) {
+			return fmt.Errorf("binary %s: content of /%s is not in the store", req.Binary, name)
+		}
+		req.Binary = "/" + name
+		req.BinaryHash = a.Hash
+		return nil
+	}
+	return fmt.Errorf("binary %s: too many levels of symbolic links", req.Binary)
+}
+
+// checkBinary verifies that the worker sees the binary that the master
+// resolved.
+func (me *Mirror) checkBinary(req *WorkRequest) error {
+	if req.BinaryHash == "" {
+		return nil
+	}
+	a := me.rpcFs.attr.Get(strings.TrimLeft(req.Binary, "/"))
+	if a == nil || a.Hash != req.BinaryHash {
+		return fmt.Errorf("binary %s does not have the content %x resolved by the master", req.Binary, req.BinaryHash)
+	}
+	return nil
+}
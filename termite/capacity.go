@@ -0,0 +1,223 @@
+package termite
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Masters report their demand for job slots to the coordinator.  The
+// coordinator samples demand and supply across the fleet at a fixed
+// interval, and keeps a bounded history, so an external autoscaler
+// can decide how many workers to add or remove.
+const (
+	_CAPACITY_SAMPLE_PERIOD = 15 * time.Second
+	_CAPACITY_SHORT_WINDOW  = 5 * time.Minute
+	_CAPACITY_HISTORY       = 30 * time.Minute
+
+	// Demand reports older than this are ignored.
+	_DEMAND_EXPIRY = 5 * time.Minute
+
+	_DEFAULT_TARGET_UTILIZATION = 0.8
+)
+
+// DemandReport is sent by a master to the coordinator.
+type DemandReport struct {
+	// Identifies the master.
+	Master string
+
+	// Jobs that were handed to a mirror without a free slot.
+	Queued int
+
+	// Slots the master could use right now: running plus queued
+	// jobs.
+	Wanted int
+}
+
+// CapacitySample is the fleet-wide demand and supply at one point in
+// time.
+type CapacitySample struct {
+	Time time.Time
+
+	// Sums over the reporting masters.
+	Wanted int
+	Queued int
+
+	// Sums over the registered workers.
+	Workers   int
+	Available int
+	Running   int
+}
+
+// CapacityWindow summarizes the samples in a period.
+type CapacityWindow struct {
+	Period  time.Duration
+	Samples int
+
+	MeanWanted    float64
+	PeakWanted    int
+	MeanAvailable float64
+}
+
+// CapacityResponse is served as JSON on /api/capacity.
+type CapacityResponse struct {
+	Current CapacitySample
+	Windows []CapacityWindow
+
+	TargetUtilization float64
+
+	// Number of workers to add (positive) or remove (negative)
+	// to reach the target utilization.
+	SuggestedWorkerDelta int
+}
+
+// capacityHistory is a ring buffer of samples.
+type capacityHistory struct {
+	samples []CapacitySample
+	next    int
+	full    bool
+}
+
+func newCapacityHistory(size int) *capacityHistory {
+	return &capacityHistory{samples: make([]CapacitySample, size)}
+}
+
+func (me *capacityHistory) add(s CapacitySample) {
+	me.samples[me.next] = s
+	me.next++
+	if me.next == len(me.samples) {
+		me.next = 0
+		me.full = true
+	}
+}
+
+// since returns the samples taken after t, oldest first.
+func (me *capacityHistory) since(t time.Time) []CapacitySample {
+	var ordered []CapacitySample
+	if me.full {
+		ordered = append(ordered, me.samples[me.next:]...)
+	}
+	ordered = append(ordered, me.samples[:me.next]...)
+
+	for i, s := range ordered {
+		if s.Time.After(t) {
+			return ordered[i:]
+		}
+	}
+	return nil
+}
+
+func summarizeCapacity(period time.Duration, samples []CapacitySample) CapacityWindow {
+	w := CapacityWindow{Period: period, Samples: len(samples)}
+	if len(samples) == 0 {
+		return w
+	}
+	wanted := 0
+	available := 0
+	for _, s := range samples {
+		wanted += s.Wanted
+		available += s.Available
+		if s.Wanted > w.PeakWanted {
+			w.PeakWanted = s.Wanted
+		}
+	}
+	w.MeanWanted = float64(wanted) / float64(len(samples))
+	w.MeanAvailable = float64(available) / float64(len(samples))
+	return w
+}
+
+// suggestWorkerDelta scales up when the mean demand over the short
+// window exceeds the target utilization of the current supply, and
+// scales down only when the peak demand over the long window fits in
+// fewer workers.
+func suggestWorkerDelta(current CapacitySample, short, long CapacityWindow, target float64) int {
+	if target <= 0 || target > 1 {
+		target = _DEFAULT_TARGET_UTILIZATION
+	}
+	perWorker := 0.0
+	if current.Workers > 0 {
+		perWorker = float64(current.Available) / float64(current.Workers)
+	}
+	if perWorker <= 0 {
+		if short.MeanWanted > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	supply := float64(current.Available)
+	if need := short.MeanWanted / target; need > supply {
+		return int(math.Ceil((need - supply) / perWorker))
+	}
+	if long.Samples == 0 {
+		return 0
+	}
+	need := float64(long.PeakWanted) / target
+	if need >= supply {
+		return 0
+	}
+	return -int(math.Floor((supply - need) / perWorker))
+}
+
+// ReportDemand records the demand of a master.
+func (me *Coordinator) ReportDemand(req *DemandReport, rep *Empty) error {
+	if req.Master == "" {
+		return fmt.Errorf("demand report has no master")
+	}
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.demand[req.Master] = &masterDemand{
+		DemandReport: *req,
+		reported:     time.Now(),
+	}
+	return nil
+}
+
+type masterDemand struct {
+	DemandReport
+	reported time.Time
+}
+
+// Must be called with lock held.
+func (me *Coordinator) currentCapacity(now time.Time) CapacitySample {
+	s := CapacitySample{Time: now}
+	for k, d := range me.demand {
+		if now.Sub(d.reported) > _DEMAND_EXPIRY {
+			delete(me.demand, k)
+			continue
+		}
+		s.Wanted += d.Wanted
+		s.Queued += d.Queued
+	}
+	for _, w := range me.workers {
+		s.Workers++
+		s.Available += w.MaxJobs
+		s.Running += w.RunningJobs
+	}
+	return s
+}
+
+func (me *Coordinator) sampleCapacity() {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.capacity.add(me.currentCapacity(time.Now()))
+}
+
+// Capacity returns the current and historical demand for job slots.
+func (me *Coordinator) Capacity() CapacityResponse {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	now := time.Now()
+	rep := CapacityResponse{
+		Current:           me.currentCapacity(now),
+		TargetUtilization: me.options.TargetUtilization,
+	}
+	for _, p := range []time.Duration{_CAPACITY_SHORT_WINDOW, _CAPACITY_HISTORY} {
+		samples := append(me.capacity.since(now.Add(-p)), rep.Current)
+		rep.Windows = append(rep.Windows, summarizeCapacity(p, samples))
+	}
+	rep.SuggestedWorkerDelta = suggestWorkerDelta(rep.Current,
+		rep.Windows[0], rep.Windows[1], rep.TargetUtilization)
+	return rep
+}
@@ -0,0 +1,134 @@
+package termite
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCapacityHistoryRing(t *testing.T) {
+	h := newCapacityHistory(4)
+	start := time.Unix(1000, 0)
+	for i := 0; i < 10; i++ {
+		h.add(CapacitySample{Time: start.Add(time.Duration(i) * time.Second), Wanted: i})
+	}
+	if len(h.samples) != 4 {
+		t.Fatalf("history grew to %d samples", len(h.samples))
+	}
+
+	all := h.since(time.Time{})
+	if len(all) != 4 {
+		t.Fatalf("got %d samples, want 4: %v", len(all), all)
+	}
+	for i, s := range all {
+		if s.Wanted != 6+i {
+			t.Errorf("sample %d: got Wanted %d, want %d", i, s.Wanted, 6+i)
+		}
+	}
+
+	recent := h.since(start.Add(7 * time.Second))
+	if len(recent) != 2 || recent[0].Wanted != 8 {
+		t.Errorf("since: got %v, want samples 8 and 9", recent)
+	}
+	if got := h.since(start.Add(time.Hour)); len(got) != 0 {
+		t.Errorf("since future: got %v", got)
+	}
+}
+
+func TestSummarizeCapacity(t *testing.T) {
+	samples := []CapacitySample{
+		{Wanted: 2, Available: 8},
+		{Wanted: 10, Available: 8},
+		{Wanted: 6, Available: 16},
+	}
+	w := summarizeCapacity(time.Minute, samples)
+	if w.Samples != 3 || w.MeanWanted != 6 || w.PeakWanted != 10 {
+		t.Errorf("got %+v", w)
+	}
+	if w.MeanAvailable != 32.0/3 {
+		t.Errorf("got MeanAvailable %v", w.MeanAvailable)
+	}
+	if w := summarizeCapacity(time.Minute, nil); w.Samples != 0 || w.MeanWanted != 0 {
+		t.Errorf("empty: got %+v", w)
+	}
+}
+
+func TestSuggestWorkerDelta(t *testing.T) {
+	// 4 workers with 4 slots each.
+	current := CapacitySample{Workers: 4, Available: 16}
+	for _, c := range []struct {
+		name       string
+		mean, peak float64
+		target     float64
+		want       int
+	}{
+		// 16 * 0.8 = 12.8 slots can be used.
+		{"balanced", 12, 12, 0.8, 0},
+		// 20 / 0.8 = 25 slots, 9 more, 3 workers.
+		{"overloaded", 20, 20, 0.8, 3},
+		// Peak 4 needs 5 slots; 11 spare is 2 workers.
+		{"idle", 2, 4, 0.8, -2},
+		// A recent peak keeps us from scaling down.
+		{"recent peak", 2, 14, 0.8, 0},
+		{"full utilization", 16, 16, 1.0, 0},
+		{"bad target", 20, 20, 0, 3},
+	} {
+		short := CapacityWindow{Samples: 1, MeanWanted: c.mean, PeakWanted: int(c.mean)}
+		long := CapacityWindow{Samples: 1, MeanWanted: c.mean, PeakWanted: int(c.peak)}
+		if got := suggestWorkerDelta(current, short, long, c.target); got != c.want {
+			t.Errorf("%s: got delta %d, want %d", c.name, got, c.want)
+		}
+	}
+
+	if got := suggestWorkerDelta(CapacitySample{}, CapacityWindow{Samples: 1, MeanWanted: 3}, CapacityWindow{}, 0.8); got != 1 {
+		t.Errorf("no workers: got delta %d, want 1", got)
+	}
+	if got := suggestWorkerDelta(CapacitySample{}, CapacityWindow{}, CapacityWindow{}, 0.8); got != 0 {
+		t.Errorf("no workers, no demand: got delta %d, want 0", got)
+	}
+}
+
+func TestCoordinatorCapacity(t *testing.T) {
+	c := NewCoordinator(&CoordinatorOptions{TargetUtilization: 0.5})
+	for _, addr := range []string{"a:1", "b:1"} {
+		c.workers[addr] = &WorkerRegistration{
+			Registration: Registration{Address: addr, MaxJobs: 4, RunningJobs: 1},
+		}
+	}
+	c.ReportDemand(&DemandReport{Master: "m1", Wanted: 3, Queued: 1}, &Empty{})
+	c.ReportDemand(&DemandReport{Master: "m2", Wanted: 3}, &Empty{})
+	c.ReportDemand(&DemandReport{Master: "stale", Wanted: 100}, &Empty{})
+	c.demand["stale"].reported = time.Now().Add(-2 * _DEMAND_EXPIRY)
+	if err := c.ReportDemand(&DemandReport{}, &Empty{}); err == nil {
+		t.Errorf("ReportDemand without master should fail")
+	}
+
+	// Synthetic history: heavy load 20 minutes ago, nothing since.
+	now := time.Now()
+	c.capacity.add(CapacitySample{Time: now.Add(-20 * time.Minute), Wanted: 16, Available: 8})
+	c.capacity.add(CapacitySample{Time: now.Add(-time.Minute), Wanted: 0, Available: 8})
+
+	rep := c.Capacity()
+	if rep.Current.Wanted != 6 || rep.Current.Queued != 1 {
+		t.Errorf("current demand: got %+v", rep.Current)
+	}
+	if rep.Current.Workers != 2 || rep.Current.Available != 8 || rep.Current.Running != 2 {
+		t.Errorf("current supply: got %+v", rep.Current)
+	}
+	if _, ok := c.demand["stale"]; ok {
+		t.Errorf("stale demand report was not expired")
+	}
+	if len(rep.Windows) != 2 {
+		t.Fatalf("got %d windows, want 2", len(rep.Windows))
+	}
+	if short := rep.Windows[0]; short.Samples != 2 || short.MeanWanted != 3 {
+		t.Errorf("short window: got %+v", short)
+	}
+	if long := rep.Windows[1]; long.Samples != 3 || long.PeakWanted != 16 {
+		t.Errorf("long window: got %+v", long)
+	}
+	// Mean demand 3 at 50% needs 6 of 8 slots.  The peak of 16
+	// keeps us from scaling down.
+	if rep.SuggestedWorkerDelta != 0 {
+		t.Errorf("got delta %d, want 0", rep.SuggestedWorkerDelta)
+	}
+}
@@ -0,0 +1,72 @@
+package termite
+
+import (
+	"log"
+	"time"
+
+	"github.com/hanwen/termite/attr"
+)
+
+// Clocks can jump backward, eg. when a VM is restored from a
+// snapshot.  Intervals are measured on the monotonic clock that
+// time.Now carries, or, where times come from elsewhere, restart when
+// the clock went backward, so no interval lasts until the clock
+// catches up.  A worker whose clock is behind writes files with mtimes
+// from the past, which can make build tools think the outputs are
+// older than their inputs.  The master warns about such workers, and
+// with MasterOptions.ClampMtimes, moves the mtimes of the files their
+// jobs wrote forward, into the time the job ran by the master's
+// clock.
+
+// Clocks may differ this much before the master takes notice.
+const _CLOCK_TOLERANCE = time.Second
+
+// elapsed returns the time from *start to now.  If the clock went
+// backward since *start, it sets *start to now.
+func elapsed(start *time.Time, now time.Time) time.Duration {
+	if now.Before(*start) {
+		log.Printf("clock went back by %v", start.Sub(now))
+		*start = now
+	}
+	return now.Sub(*start)
+}
+
+// checkWorkerClock compares the clock of the worker that ran rep with
+// the master's.  The job was sent at sent, and the response came back
+// at received.
+func (me *Master) checkWorkerClock(addr string, sent, received time.Time, rep *WorkResponse) {
+	if rep.WorkerEnd.IsZero() || !rep.WorkerEnd.Before(sent.Add(-_CLOCK_TOLERANCE)) {
+		return
+	}
+	offset := received.Sub(rep.WorkerEnd)
+	log.Printf("Clock of worker %s is %v behind", addr, offset)
+	if me.options.ClampMtimes && rep.FileSet != nil {
+		clampMtimes(rep.FileSet.Files, rep.WorkerStart, offset, sent, received)
+	}
+}
+
+// clampMtimes moves the mtimes of the files written since
+// workerStart forward by offset, but to no earlier than from and no
+// later than to.
+func clampMtimes(files []*attr.FileAttr, workerStart time.Time, offset time.Duration, from, to time.Time) {
+	for _, f := range files {
+		if f.Deletion() || f.Attr == nil {
+			continue
+		}
+		m := f.ModTime()
+		if m.Before(workerStart.Add(-_CLOCK_TOLERANCE)) {
+			// Copied with its mtime, or not touched by
+			// the job.
+			continue
+		}
+		m = m.Add(offset)
+		if m.Before(from) {
+			m = from
+		}
+		if m.After(to) {
+			m = to
+		}
+		f.Mtime = uint64(m.Unix())
+		f.Mtimensec = uint32(m.Nanosecond())
+	}
+}
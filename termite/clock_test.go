@@ -0,0 +1,81 @@
+package termite
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/termite/attr"
+)
+
+func TestMirrorConnectionsIdleClockJump(t *testing.T) {
+	now := time.Unix(1e9, 0)
+	mcs := &mirrorConnections{
+		keepAlive: time.Minute,
+		mirrors:   map[string]*mirrorConnection{},
+		now:       func() time.Time { return now },
+	}
+	mcs.mirrors["w1:1"] = &mirrorConnection{workerAddr: "w1:1", maxJobs: 1, availableJobs: 0}
+	mcs.jobDone(mcs.mirrors["w1:1"])
+
+	now = now.Add(30 * time.Second)
+	if mcs.idle() {
+		t.Errorf("idle before keepAlive")
+	}
+
+	// The clock jumps back an hour.
+	now = now.Add(-time.Hour)
+	if mcs.idle() {
+		t.Errorf("idle right after the clock jumped")
+	}
+	now = now.Add(time.Minute)
+	if !mcs.idle() {
+		t.Errorf("not idle a keepAlive after the clock jumped")
+	}
+}
+
+func TestCoordinatorChangedClockJump(t *testing.T) {
+	c := NewCoordinator(&CoordinatorOptions{})
+	// As if the clock went back an hour since the last change.
+	last := time.Now().Add(time.Hour)
+	c.lastChange = last
+	c.changed()
+	if !c.lastChange.After(last) {
+		t.Errorf("lastChange %v not after %v", c.lastChange, last)
+	}
+}
+
+func TestClampMtimes(t *testing.T) {
+	master := time.Unix(1e9, 0)
+	worker := master.Add(-time.Hour)
+	file := func(name string, mtime time.Time) *attr.FileAttr {
+		return &attr.FileAttr{
+			Path: name,
+			Attr: &fuse.Attr{
+				Mode:      syscall.S_IFREG | 0644,
+				Mtime:     uint64(mtime.Unix()),
+				Mtimensec: uint32(mtime.Nanosecond()),
+			},
+		}
+	}
+	files := []*attr.FileAttr{
+		file("old", worker.Add(-time.Hour)),
+		file("written", worker.Add(time.Second)),
+		file("late", worker.Add(time.Minute)),
+		{Path: "deleted"},
+	}
+
+	// The job ran for 2s by the master's clock.
+	clampMtimes(files, worker, time.Hour, master, master.Add(2*time.Second))
+	want := []time.Time{
+		worker.Add(-time.Hour),
+		master.Add(time.Second),
+		master.Add(2 * time.Second),
+	}
+	for i, w := range want {
+		if got := files[i].ModTime(); !got.Equal(w) {
+			t.Errorf("%s: got mtime %v, want %v", files[i].Path, got, w)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package termite
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The master sums up where the time of remote jobs goes, per
+// command, so slow steps of a build can be found.  The statistics
+// start over when the master drops its mirrors.
+
+// CommandStats sums up the jobs of a single command, named by the
+// base name of Argv[0].
+type CommandStats struct {
+	Command string
+	Jobs    int
+
+	// Waiting for a mirror, sending file updates to it, running
+	// the job, and replaying its file changes.
+	Queue  time.Duration
+	Send   time.Duration
+	Remote time.Duration
+	Replay time.Duration
+
+	// Content pushed to the mirror with the jobs, and content of
+	// the files they produced.
+	Bytes int64
+}
+
+func (me *CommandStats) add(x *CommandStats) {
+	me.Jobs += x.Jobs
+	me.Queue += x.Queue
+	me.Send += x.Send
+	me.Remote += x.Remote
+	me.Replay += x.Replay
+	me.Bytes += x.Bytes
+}
+
+func (me *CommandStats) Total() time.Duration {
+	return me.Queue + me.Send + me.Remote + me.Replay
+}
+
+type CommandStatsResponse struct {
+	// Sorted by total time, longest first.
+	Commands []CommandStats
+}
+
+// Number of recent jobs per command whose durations are kept, and
+// how many are needed before the median is trusted.
+const (
+	_RECENT_JOBS     = 31
+	_MIN_RECENT_JOBS = 5
+)
+
+type commandStats struct {
+	mutex    sync.Mutex
+	commands map[string]*CommandStats
+
+	// Time from sending to replaying, of the recent jobs of each
+	// command.
+	recent map[string][]time.Duration
+}
+
+func newCommandStats() *commandStats {
+	return &commandStats{
+		commands: map[string]*CommandStats{},
+		recent:   map[string][]time.Duration{},
+	}
+}
+
+func commandName(req *WorkRequest) string {
+	if len(req.Argv) == 0 {
+		return "(none)"
+	}
+	return filepath.Base(req.Argv[0])
+}
+
+// add records a finished job of req.
+func (me *commandStats) add(req *WorkRequest, job *CommandStats) {
+	name := commandName(req)
+	job.Jobs = 1
+
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	c := me.commands[name]
+	if c == nil {
+		c = &CommandStats{Command: name}
+		me.commands[name] = c
+	}
+	c.add(job)
+
+	recent := append(me.recent[name], job.Total()-job.Queue)
+	if len(recent) > _RECENT_JOBS {
+		recent = recent[len(recent)-_RECENT_JOBS:]
+	}
+	me.recent[name] = recent
+}
+
+// median returns the median time of the recent jobs of the command
+// of req, from sending to replaying.  It returns false if there were
+// too few jobs to tell.
+func (me *commandStats) median(req *WorkRequest) (time.Duration, bool) {
+	me.mutex.Lock()
+	recent := append([]time.Duration(nil), me.recent[commandName(req)]...)
+	me.mutex.Unlock()
+	if len(recent) < _MIN_RECENT_JOBS {
+		return 0, false
+	}
+	sort.Sort(durations(recent))
+	return recent[len(recent)/2], true
+}
+
+func (me *commandStats) list() []CommandStats {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	var result []CommandStats
+	for _, c := range me.commands {
+		result = append(result, *c)
+	}
+	sort.Sort(commandStatsByTotal(result))
+	return result
+}
+
+func (me *commandStats) writeHttp(w http.ResponseWriter) {
+	commands := me.list()
+	if len(commands) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "<p>Jobs per command:<table><tr><th>Command<th>Jobs<th>Queue<th>Send<th>Remote<th>Replay<th>Bytes</tr>\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "<tr><td>%s<td>%d<td>%v<td>%v<td>%v<td>%v<td>%d</tr>\n",
+			c.Command, c.Jobs, c.Queue, c.Send, c.Remote, c.Replay, c.Bytes)
+	}
+	fmt.Fprintf(w, "</table>")
+}
+
+type commandStatsByTotal []CommandStats
+
+func (me commandStatsByTotal) Len() int { return len(me) }
+func (me commandStatsByTotal) Less(i, j int) bool {
+	if me[i].Total() != me[j].Total() {
+		return me[i].Total() > me[j].Total()
+	}
+	return me[i].Command < me[j].Command
+}
+func (me commandStatsByTotal) Swap(i, j int) { me[i], me[j] = me[j], me[i] }
+
+type durations []time.Duration
+
+func (me durations) Len() int           { return len(me) }
+func (me durations) Less(i, j int) bool { return me[i] < me[j] }
+func (me durations) Swap(i, j int)      { me[i], me[j] = me[j], me[i] }
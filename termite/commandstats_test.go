@@ -0,0 +1,80 @@
+package termite
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCommandStats(t *testing.T) {
+	mcs := &mirrorConnections{}
+	mcs.refreshStats()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			argv := []string{"/usr/bin/gcc", "-c", "a.c"}
+			if i%2 == 1 {
+				argv = []string{"ld"}
+			}
+			mcs.commandStats().add(&WorkRequest{Argv: argv}, &CommandStats{
+				Queue:  time.Millisecond,
+				Send:   time.Millisecond,
+				Remote: time.Duration(i) * time.Second,
+				Replay: time.Millisecond,
+				Bytes:  int64(i),
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	got := mcs.commandStats().list()
+	if len(got) != 2 || got[0].Command != "ld" || got[1].Command != "gcc" {
+		t.Fatalf("got %+v, want ld before gcc", got)
+	}
+	// ld ran the odd jobs, which took longest.
+	ld := got[0]
+	if ld.Jobs != 5 || ld.Remote != 25*time.Second || ld.Bytes != 25 || ld.Queue != 5*time.Millisecond {
+		t.Errorf("ld: got %+v", ld)
+	}
+	if want := ld.Queue + ld.Send + ld.Remote + ld.Replay; ld.Total() != want {
+		t.Errorf("Total: got %v, want %v", ld.Total(), want)
+	}
+	if got[1].Jobs != 5 || got[1].Bytes != 20 {
+		t.Errorf("gcc: got %+v", got[1])
+	}
+
+	mcs.dropConnections()
+	if got := mcs.commandStats().list(); len(got) != 0 {
+		t.Errorf("after drop: got %+v", got)
+	}
+}
+
+func TestCommandStatsMedian(t *testing.T) {
+	stats := newCommandStats()
+	req := &WorkRequest{Argv: []string{"/usr/bin/gcc"}}
+	for i := 1; i < _MIN_RECENT_JOBS; i++ {
+		stats.add(req, &CommandStats{Queue: time.Hour, Remote: time.Duration(i) * time.Second})
+	}
+	if _, ok := stats.median(req); ok {
+		t.Errorf("median from %d jobs", _MIN_RECENT_JOBS-1)
+	}
+
+	stats.add(req, &CommandStats{Remote: time.Minute})
+	if m, ok := stats.median(req); !ok || m != 3*time.Second {
+		t.Errorf("got %v, %v, want 3s", m, ok)
+	}
+	if _, ok := stats.median(&WorkRequest{Argv: []string{"ld"}}); ok {
+		t.Errorf("median for command without jobs")
+	}
+
+	// Only recent jobs count.
+	for i := 0; i < _RECENT_JOBS; i++ {
+		stats.add(req, &CommandStats{Remote: time.Millisecond})
+	}
+	if m, _ := stats.median(req); m != time.Millisecond {
+		t.Errorf("got %v, want 1ms", m)
+	}
+}
@@ -1,9 +1,9 @@
 package termite
 
 import (
-	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -14,7 +14,6 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -55,21 +54,33 @@ func sign(conn net.Conn, challenge []byte, secret []byte, local bool) []byte {
 // * Using the secret, sign (challenge + remote address + local address)
 // * Return the signature
 //
-// TODO - should probably use SSL/TLS? Figure out what is useful and
-// necessary here.
+// See tls.go for encrypting the connection afterwards, and frames.go
+// for authenticating what follows without TLS.
 func Authenticate(conn net.Conn, secret []byte) error {
-	challenge := RandomBytes(challengeLength)
+	_, err := authenticate(conn, secret, nil, false)
+	return err
+}
 
-	_, err := conn.Write(challenge)
+// authenticate is Authenticate.  Its last step tells the peer whether
+// we continue with TLS, as given by config.  Without TLS, if frames
+// is set, we offer framing; the returned connection is conn, framed
+// if the peer offered it too.
+func authenticate(conn net.Conn, secret []byte, config *tls.Config, frames bool) (net.Conn, error) {
+	challenge, err := newChallenge(frames && config == nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	_, err = conn.Write(challenge)
+	if err != nil {
+		return nil, err
 	}
 	expected := sign(conn, challenge, secret, true)
 
 	remoteChallenge := make([]byte, challengeLength)
 	n, err := conn.Read(remoteChallenge)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	remoteChallenge = remoteChallenge[:n]
 	_, err = conn.Write(sign(conn, remoteChallenge, secret, false))
@@ -77,40 +88,46 @@ func Authenticate(conn net.Conn, secret []byte) error {
 	response := make([]byte, len(expected))
 	n, err = conn.Read(response)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	response = response[:n]
 
-	if bytes.Compare(response, expected) != 0 {
+	if !hmac.Equal(response, expected) {
 		log.Println("Authentication failure from", conn.RemoteAddr())
 		conn.Close()
-		return errors.New("Mismatch in response")
+		return nil, errors.New("Mismatch in response")
 	}
 
-	expectAck := []byte("OK")
+	expectAck := handshakeAck(config)
 	conn.Write(expectAck)
 
 	ack := make([]byte, len(expectAck))
 	n, err = conn.Read(ack)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	ack = ack[:n]
-	if bytes.Compare(expectAck, ack) != 0 {
-		fmt.Println(expectAck, ack)
-		return errors.New("Missing ack reply")
+	if err := checkAck(expectAck, ack); err != nil {
+		log.Printf("Handshake with %v: %v", conn.RemoteAddr(), err)
+		return nil, err
 	}
 
-	return nil
+	if offersFrames(challenge) && offersFrames(remoteChallenge) {
+		return newFrameConn(conn, secret, challenge, remoteChallenge), nil
+	}
+	return conn, nil
 }
 
 type Listener struct {
 	net.Listener
 	secret []byte
+
+	// If set, accepted connections use TLS.
+	tlsConfig *tls.Config
 }
 
-func AuthenticatedListener(port int, secret []byte, retryCount int) net.Listener {
+func AuthenticatedListener(port int, secret []byte, retryCount int, config *tls.Config) net.Listener {
 	var err error
 	for i := 0; i <= retryCount; i++ {
 		p := port + i
@@ -118,7 +135,7 @@ func AuthenticatedListener(port int, secret []byte, retryCount int) net.Listener
 		listener, e := net.Listen("tcp", addr)
 		if e == nil {
 			log.Println("Listening to", listener.Addr())
-			return &Listener{listener, secret}
+			return &Listener{listener, secret, config}
 		}
 		err = e
 	}
@@ -132,12 +149,16 @@ func (me *Listener) Accept() (net.Conn, error) {
 		if err != nil {
 			return nil, err
 		}
-		err = Authenticate(c, me.secret)
+		conn, err := authenticate(c, me.secret, me.tlsConfig, true)
+		if err == nil {
+			conn, err = wrapTLS(conn, me.tlsConfig, true, "")
+		}
 		if err != nil {
+			log.Println("Rejecting connection:", err)
 			c.Close()
 			continue
 		}
-		return c, nil
+		return conn, nil
 	}
 	return nil, io.EOF
 }
@@ -149,34 +170,85 @@ const (
 	HEADER_LEN  = 9
 )
 
-var nextConnectionId uint64
+// After reading the id, the acceptor replies with one of these.
+const (
+	idAccepted  = 'y'
+	idUnknown   = 'u'
+	idDuplicate = 'd'
+)
+
+// How long DialTypedConnection waits for the reply to the id.
+const _ID_REPLY_TIMEOUT = 30 * time.Second
 
+// ConnectionId returns a random id. Ids are chosen by different
+// processes talking to the same master or worker, so a counter would
+// collide.
 func ConnectionId() string {
-	id := atomic.AddUint64(&nextConnectionId, 1)
-	id--
 	encoded := make([]byte, 9)
 	encoded[0] = 'i'
-	binary.BigEndian.PutUint64(encoded[1:], id)
+	binary.BigEndian.PutUint64(encoded[1:], uint64(rand.Int63()))
 	return string(encoded)
 }
 
+// readIdReply reads the acceptor's reply to the id we sent.
+func readIdReply(conn net.Conn, id string, timeout time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	reply := make([]byte, 1)
+	_, err := io.ReadFull(conn, reply)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("no reply to connection id %q: %v", id, err)
+	}
+	switch reply[0] {
+	case idAccepted:
+		return nil
+	case idUnknown:
+		return fmt.Errorf("connection id %q is not known", id)
+	case idDuplicate:
+		return fmt.Errorf("connection id %q was already used", id)
+	}
+	return fmt.Errorf("connection id %q: unexpected reply %q", id, reply[0])
+}
+
 type pendingConnection struct {
 	Id    string
 	Ready sync.Cond
 	Conn  net.Conn
 }
 
+// Number of used ids remembered per generation in
+// PendingConnections.used.
+const _USED_IDS = 4096
+
 // PendingConnections manages a list of connections, indexed by ID.
 // The id is sent as the first 8 bytes, after the authentication.
 type PendingConnections struct {
 	connectionsMutex sync.Mutex
 	connections      map[string]*pendingConnection
+
+	// Ids whose connection was handed out, to reject them if
+	// they come again.  Kept in two generations; the older one
+	// is dropped when the current one fills up.
+	used    map[string]bool
+	usedOld map[string]bool
 }
 
 func NewPendingConnections() *PendingConnections {
 	return &PendingConnections{
 		connections: make(map[string]*pendingConnection),
+		used:        make(map[string]bool),
+	}
+}
+
+// markUsed remembers that the connection for id was handed out.
+// Must be called with lock held.
+func (me *PendingConnections) markUsed(id string) {
+	delete(me.connections, id)
+	if len(me.used) >= _USED_IDS {
+		me.usedOld = me.used
+		me.used = make(map[string]bool)
 	}
+	me.used[id] = true
 }
 
 func (me *PendingConnections) newPendingConnection(id string) *pendingConnection {
@@ -200,59 +272,121 @@ func (me *PendingConnections) WaitConnection(id string) net.Conn {
 		p.Ready.Wait()
 	}
 
-	me.connections[id] = nil
+	me.markUsed(id)
 	return p.Conn
 }
 
+// reply sends the reply to the id. On failure or rejection, the
+// connection is closed.
+func (me *PendingConnections) reply(conn net.Conn, r byte) bool {
+	_, err := conn.Write([]byte{r})
+	if err != nil || r != idAccepted {
+		conn.Close()
+		return false
+	}
+	return true
+}
+
 // Returns false if caller should handle the connection.
 func (me *PendingConnections) Accept(conn net.Conn) bool {
 	idBytes := make([]byte, HEADER_LEN)
-	n, err := conn.Read(idBytes)
+	n, err := io.ReadFull(conn, idBytes)
 	if n != HEADER_LEN || err != nil {
 		conn.Close()
 		return true
 	}
 	id := string(idBytes)
 	if id == RPC_CHANNEL {
-		return false
+		return !me.reply(conn, idAccepted)
+	}
+	if id[0] != 'i' {
+		log.Printf("rejecting unknown connection id %q", id)
+		me.reply(conn, idUnknown)
+		return true
 	}
 
 	me.connectionsMutex.Lock()
 	defer me.connectionsMutex.Unlock()
 	p := me.connections[id]
+	if me.used[id] || me.usedOld[id] || (p != nil && p.Conn != nil) {
+		log.Printf("rejecting duplicate connection id %q", id)
+		me.reply(conn, idDuplicate)
+		return true
+	}
+	if !me.reply(conn, idAccepted) {
+		return true
+	}
 	if p == nil {
 		p = me.newPendingConnection(id)
 		me.connections[id] = p
 	}
-	if p.Conn != nil {
-		log.Panicf("accepted the same connection id twice: %s", id)
-	}
 	p.Conn = conn
 	p.Ready.Signal()
 	return true
 }
 
-func DialTypedConnection(addr string, id string, secret []byte) (net.Conn, error) {
+// DialTypedConnection connects to the given channel of a master or
+// worker.  If config is set, the connection uses TLS.
+func DialTypedConnection(addr string, id string, secret []byte, config *tls.Config) (net.Conn, error) {
+	return dialTypedConnection(addr, id, secret, config, 0)
+}
+
+// dialTypedConnection is DialTypedConnection.  A positive timeout
+// bounds connecting, authenticating and waiting for the reply to the
+// id together.
+func dialTypedConnection(addr string, id string, secret []byte, config *tls.Config, timeout time.Duration) (net.Conn, error) {
 	if len(id) != HEADER_LEN {
 		log.Fatal("id != 8", id, len(id))
 	}
-	conn, err := net.Dial("tcp", addr)
+	replyTimeout := _ID_REPLY_TIMEOUT
+	var conn net.Conn
+	var err error
+	if timeout > 0 {
+		deadline := time.Now().Add(timeout)
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+		if err == nil {
+			conn.SetDeadline(deadline)
+			if d := deadline.Sub(time.Now()); d < replyTimeout {
+				replyTimeout = d
+			}
+		}
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	err = Authenticate(conn, secret)
+	authConn, err := authenticate(conn, secret, config, true)
+	if err == nil {
+		authConn, err = wrapTLS(authConn, config, false, addr)
+	}
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	conn = authConn
 	_, err = io.WriteString(conn, id)
+	if err == nil {
+		err = readIdReply(conn, id, replyTimeout)
+	}
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
 	return conn, nil
 }
 
-func OpenSocketConnection(socket string, channel string, timeout time.Duration) net.Conn {
+// DialSocketConnection connects to the given channel on a unix
+// socket. The timeout applies both to connecting and to waiting for
+// the channel to be accepted.
+func DialSocketConnection(socket string, channel string, timeout time.Duration) (net.Conn, error) {
+	if len(channel) != HEADER_LEN {
+		return nil, fmt.Errorf("channel id %q should have length %d", channel, HEADER_LEN)
+	}
 	delay := time.Duration(0)
 	conn, err := net.Dial("unix", socket)
 	for try := 0; err != nil && delay < timeout; try++ {
@@ -262,15 +396,24 @@ func OpenSocketConnection(socket string, channel string, timeout time.Duration)
 		continue
 	}
 	if err != nil {
-		log.Fatal("OpenSocketConnection: ", err)
+		return nil, err
 	}
 
-	if len(channel) != HEADER_LEN {
-		panic(channel)
-	}
 	_, err = io.WriteString(conn, channel)
+	if err == nil {
+		err = readIdReply(conn, channel, timeout)
+	}
 	if err != nil {
-		log.Fatal("WriteString", err)
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func OpenSocketConnection(socket string, channel string, timeout time.Duration) net.Conn {
+	conn, err := DialSocketConnection(socket, channel, timeout)
+	if err != nil {
+		log.Fatal("OpenSocketConnection: ", err)
 	}
 	return conn
 }
@@ -3,36 +3,96 @@ package termite
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
 
+func testSecret(t *testing.T) []byte {
+	secret, err := RandomBytes(20)
+	if err != nil {
+		t.Fatalf("RandomBytes: %v", err)
+	}
+	return secret
+}
+
+func TestRandomBytes(t *testing.T) {
+	a := testSecret(t)
+	b := testSecret(t)
+	if len(a) != 20 || len(b) != 20 {
+		t.Fatalf("got lengths %d, %d, want 20", len(a), len(b))
+	}
+	if string(a) == string(b) {
+		t.Errorf("two calls returned the same bytes %x", a)
+	}
+}
+
+// TestAuthenticateTampered runs the handshake against a peer that
+// answers our challenge with a tampered digest.
+func TestAuthenticateTampered(t *testing.T) {
+	secret := testSecret(t)
+	for _, tamper := range []bool{false, true} {
+		a, b := net.Pipe()
+		errs := make(chan error, 1)
+		go func() { errs <- Authenticate(a, secret) }()
+
+		challenge := make([]byte, challengeLength)
+		io.ReadFull(b, challenge)
+		b.Write(make([]byte, challengeLength))
+		signature := make([]byte, len(sign(b, challenge, secret, false)))
+		io.ReadFull(b, signature)
+
+		response := sign(b, challenge, secret, false)
+		if tamper {
+			response[0] ^= 1
+		}
+		b.Write(response)
+		if !tamper {
+			io.ReadFull(b, make([]byte, len(plainAck)))
+			b.Write(plainAck)
+		}
+
+		err := <-errs
+		if tamper && err == nil {
+			t.Errorf("tampered digest was accepted")
+		} else if !tamper && err != nil {
+			t.Errorf("Authenticate: %v", err)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
 func TestAuthenticate(t *testing.T) {
-	secret := RandomBytes(20)
+	secret := testSecret(t)
 	port := int(rand.Int31n(2000) + 1024)
 
-	l := AuthenticatedListener(port, secret, 10)
+	l := AuthenticatedListener(port, secret, 10, nil)
+	pc := NewPendingConnections()
 	go func() {
 		for {
-			_, err := l.Accept()
+			c, err := l.Accept()
 			if err != nil {
 				break
 			}
+			pc.Accept(c)
 		}
 	}()
 
 	time.Sleep(1e9)
 	hostname, _ := os.Hostname()
 	addr := fmt.Sprintf("%s:%d", hostname, port)
-	_, err := DialTypedConnection(addr, RPC_CHANNEL, secret)
+	_, err := DialTypedConnection(addr, RPC_CHANNEL, secret, nil)
 	if err != nil {
 		t.Fatal("unexpected failure", err)
 	}
 
-	c, err := DialTypedConnection(addr, RPC_CHANNEL, []byte("foobar"))
+	c, err := DialTypedConnection(addr, RPC_CHANNEL, []byte("foobar"), nil)
 	if c != nil {
 		t.Error("expect failure")
 	}
@@ -80,3 +140,100 @@ func TestPendingConnection(t *testing.T) {
 		t.Error("unexpected", string(b[:n]), err)
 	}
 }
+
+func newSocketListener(t *testing.T) (string, net.Listener) {
+	dir, err := ioutil.TempDir("", "term-conn")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	sock := filepath.Join(dir, "socket")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	return dir, l
+}
+
+func TestDialSocketConnectionRejects(t *testing.T) {
+	dir, l := newSocketListener(t)
+	defer os.RemoveAll(dir)
+	defer l.Close()
+
+	pc := NewPendingConnections()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if !pc.Accept(conn) {
+				conn.Close()
+			}
+		}
+	}()
+
+	sock := filepath.Join(dir, "socket")
+	if _, err := DialSocketConnection(sock, "bogus....", time.Second); err == nil || !strings.Contains(err.Error(), "not known") {
+		t.Errorf("unknown id: got %v", err)
+	}
+
+	id := ConnectionId()
+	conn, err := DialSocketConnection(sock, id, time.Second)
+	if err != nil {
+		t.Fatalf("DialSocketConnection: %v", err)
+	}
+	defer conn.Close()
+	if _, err := DialSocketConnection(sock, id, time.Second); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("pending duplicate id: got %v", err)
+	}
+
+	pc.WaitConnection(id).Close()
+	if _, err := DialSocketConnection(sock, id, time.Second); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("stale id: got %v", err)
+	}
+}
+
+func TestPendingConnectionsUsedBounded(t *testing.T) {
+	pc := NewPendingConnections()
+	first := ConnectionId()
+	pc.markUsed(first)
+	for i := 0; i < 2*_USED_IDS; i++ {
+		pc.markUsed(ConnectionId())
+	}
+	if len(pc.connections) != 0 {
+		t.Errorf("got %d pending connections, want 0", len(pc.connections))
+	}
+	if n := len(pc.used) + len(pc.usedOld); n > 2*_USED_IDS {
+		t.Errorf("remembered %d ids, want at most %d", n, 2*_USED_IDS)
+	}
+	if pc.used[first] || pc.usedOld[first] {
+		t.Errorf("oldest id still remembered")
+	}
+}
+
+func TestDialSocketConnectionSlowServer(t *testing.T) {
+	dir, l := newSocketListener(t)
+	defer os.RemoveAll(dir)
+	defer l.Close()
+
+	// Accept, but never reply.
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	timeout := 100 * time.Millisecond
+	_, err := DialSocketConnection(filepath.Join(dir, "socket"), ConnectionId(), timeout)
+	if err == nil {
+		t.Fatalf("dial to a silent server should fail")
+	}
+	if dt := time.Now().Sub(start); dt > 10*timeout {
+		t.Errorf("dial took %v, timeout was %v", dt, timeout)
+	}
+}
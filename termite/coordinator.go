@@ -1,6 +1,7 @@
 package termite
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
@@ -19,6 +20,47 @@ type Registration struct {
 	Name           string
 	Version        string
 	HttpStatusPort int
+
+	// Capacity, as of the last report.
+	MaxJobs     int
+	RunningJobs int
+
+	// Available memory in bytes, or 0 if unknown.
+	MemAvailable uint64
+
+	// One-minute load average, and the number of CPUs.  NumCPU is
+	// 0 if the worker does not report its load.
+	LoadAvg float64
+	NumCPU  int
+
+	// Free space for the content store in bytes, or 0 if unknown.
+	DiskAvailable uint64
+
+	// Sorted CPU feature flags, as listed in /proc/cpuinfo.
+	CPUFeatures []string
+
+	// See WorkerOptions.Labels.
+	Labels map[string]string
+
+	// Content store traffic since the worker started.
+	CacheBytesReceived int64
+	CacheBytesServed   int64
+
+	// Jobs killed for exceeding resource limits.
+	ResourceKills int
+
+	// Set by the coordinator, from 0 for a useless worker to 1
+	// for a healthy one.  See health.go.
+	Health float64
+}
+
+// load returns the load average per CPU, and false if the worker did
+// not report it.
+func (me *Registration) load() (float64, bool) {
+	if me.NumCPU <= 0 {
+		return 0, false
+	}
+	return me.LoadAvg / float64(me.NumCPU), true
 }
 
 type RegistrationRequest Registration
@@ -27,6 +69,10 @@ type ListRequest struct {
 	// Return changes after this time stamp.  Will halt if no
 	// changes to report.
 	Latest time.Time
+
+	// If set, only return workers with these labels, given as
+	// for ParseLabels.
+	Selector string
 }
 
 type ListResponse struct {
@@ -37,6 +83,29 @@ type ListResponse struct {
 type WorkerRegistration struct {
 	Registration
 	LastReported time.Time
+
+	// Consecutive reachability checks that the worker failed.
+	MissedChecks int
+
+	// How long the last successful probe of the worker took.
+	ProbeLatency time.Duration
+
+	// Value of Coordinator.registrations when the worker
+	// registered, or 0 if it was restored from the registry.
+	registration uint64
+
+	// Set for workers restored from the registry, until they
+	// answer a probe.  List leaves them out.
+	unverified bool
+}
+
+type CoordinatorStatusRequest struct {
+}
+
+// CoordinatorStatusResponse is returned by the Coordinator.Status
+// RPC, and served as JSON on /status.json.
+type CoordinatorStatusResponse struct {
+	Workers []WorkerRegistration
 }
 
 // Coordinator is the registration service for termite.  Workers
@@ -54,6 +123,20 @@ type Coordinator struct {
 	cond       *sync.Cond
 	workers    map[string]*WorkerRegistration
 	lastChange time.Time
+
+	// Counts registrations, so checkReachable can tell whether a
+	// worker registered while it was probed.
+	registrations uint64
+
+	// Workers restored from the registry file, and not probed yet.
+	restored int
+
+	// Demand reported by masters, keyed by DemandReport.Master.
+	demand   map[string]*masterDemand
+	capacity *capacityHistory
+
+	// Set if the web server and connections to workers use TLS.
+	tlsConfig *tls.Config
 }
 
 type CoordinatorOptions struct {
@@ -64,21 +147,94 @@ type CoordinatorOptions struct {
 	// Password should be passed in the kill/restart URLs to make
 	// sure web scrapers don't randomly shutdown workers.
 	WebPassword string
+
+	// Fraction of the worker job slots that should be in use;
+	// determines the suggested number of workers.
+	TargetUtilization float64
+
+	// Number of workers probed at the same time by the periodic
+	// reachability check, and how long to wait for each.
+	CheckConcurrency int
+	CheckTimeout     time.Duration
+
+	// Time between reachability checks, and the number of
+	// consecutive checks a worker may fail before it is dropped.
+	// A worker that misses a check during a network blip stays
+	// listed until it misses MaxMissedChecks in a row.
+	CheckInterval   time.Duration
+	MaxMissedChecks int
+
+	// If set, the registered workers are saved to this file, and
+	// restored from it on startup.
+	RegistryFile string
+
+	// Workers that report less free space for their content
+	// store are not listed to masters.
+	MinDiskAvailable uint64
+
+	// Workers whose health score is below this are not listed
+	// to masters.
+	MinHealth float64
+
+	// How often workers report; a worker that has not reported
+	// for more than two intervals loses health.
+	ReportInterval time.Duration
+
+	// Certificates for the web server and for TLS connections to
+	// workers.
+	TLSOptions
 }
 
+const (
+	_DEFAULT_CHECK_CONCURRENCY = 16
+	_DEFAULT_CHECK_TIMEOUT     = 10 * time.Second
+	_DEFAULT_CHECK_INTERVAL    = 60 * time.Second
+	_DEFAULT_MAX_MISSED_CHECKS = 3
+)
+
 func NewCoordinator(opts *CoordinatorOptions) *Coordinator {
 	o := *opts
+	if o.TargetUtilization <= 0 || o.TargetUtilization > 1 {
+		o.TargetUtilization = _DEFAULT_TARGET_UTILIZATION
+	}
+	if o.CheckConcurrency <= 0 {
+		o.CheckConcurrency = _DEFAULT_CHECK_CONCURRENCY
+	}
+	if o.CheckTimeout <= 0 {
+		o.CheckTimeout = _DEFAULT_CHECK_TIMEOUT
+	}
+	if o.CheckInterval <= 0 {
+		o.CheckInterval = _DEFAULT_CHECK_INTERVAL
+	}
+	if o.MaxMissedChecks <= 0 {
+		o.MaxMissedChecks = _DEFAULT_MAX_MISSED_CHECKS
+	}
+	if o.ReportInterval <= 0 {
+		o.ReportInterval = _DEFAULT_REPORT_INTERVAL
+	}
 	c := &Coordinator{
-		options: &o,
-		workers: make(map[string]*WorkerRegistration),
-		Mux:     http.NewServeMux(),
+		options:  &o,
+		workers:  make(map[string]*WorkerRegistration),
+		demand:   make(map[string]*masterDemand),
+		capacity: newCapacityHistory(int(_CAPACITY_HISTORY / _CAPACITY_SAMPLE_PERIOD)),
+		Mux:      http.NewServeMux(),
 	}
 	c.cond = sync.NewCond(&c.mutex)
+	var err error
+	c.tlsConfig, err = o.TLSConfig()
+	if err != nil {
+		log.Fatal("TLS: ", err)
+	}
+	if o.RegistryFile != "" {
+		c.loadRegistry()
+	}
 	return c
 }
 
 func (me *Coordinator) Register(req *RegistrationRequest, rep *Empty) error {
-	conn, err := DialTypedConnection(req.Address, RPC_CHANNEL, me.options.Secret)
+	start := time.Now()
+	conn, err := DialTypedConnection(req.Address, RPC_CHANNEL, me.options.Secret, me.tlsConfig)
+	latency := time.Now().Sub(start)
 	if conn != nil {
 		conn.Close()
 	}
@@ -92,7 +248,11 @@ func (me *Coordinator) Register(req *RegistrationRequest, rep *Empty) error {
 
 	w := &WorkerRegistration{Registration: Registration(*req)}
 	w.LastReported = time.Now()
-	me.lastChange = w.LastReported
+	w.ProbeLatency = latency
+	w.Health = me.health(w, w.LastReported)
+	me.registrations++
+	w.registration = me.registrations
+	me.changed()
 	me.workers[w.Address] = w
 	me.cond.Broadcast()
 	return nil
@@ -105,6 +265,11 @@ func (me *Coordinator) WorkerCount() int {
 }
 
 func (me *Coordinator) List(req *ListRequest, rep *ListResponse) error {
+	selector, err := ParseLabels(req.Selector)
+	if err != nil {
+		return err
+	}
+
 	me.mutex.Lock()
 	defer me.mutex.Unlock()
 
@@ -112,61 +277,178 @@ func (me *Coordinator) List(req *ListRequest, rep *ListResponse) error {
 		me.cond.Wait()
 	}
 
+	for _, w := range me.selectWorkers(selector) {
+		if w.DiskAvailable > 0 && w.DiskAvailable < me.options.MinDiskAvailable {
+			continue
+		}
+		if w.Health < me.options.MinHealth {
+			continue
+		}
+		rep.Registrations = append(rep.Registrations, w.Registration)
+	}
+	rep.LastChange = me.lastChange
+	return nil
+}
+
+// selectWorkers returns the workers that match selector, sorted by
+// address.  Must hold mutex.
+func (me *Coordinator) selectWorkers(selector map[string]string) []WorkerRegistration {
 	keys := []string{}
 	for k := range me.workers {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
+	var result []WorkerRegistration
 	for _, k := range keys {
 		w := me.workers[k]
-		rep.Registrations = append(rep.Registrations, w.Registration)
+		if !w.unverified && matchLabels(selector, w.Labels) {
+			result = append(result, *w)
+		}
+	}
+	return result
+}
+
+// WorkerList is served as JSON on /workers.json.
+type WorkerList struct {
+	Workers    []WorkerRegistration
+	LastChange time.Time
+}
+
+// workerList returns the workers that match selector, given as for
+// ParseLabels.  Unlike List, it does not wait for changes.
+func (me *Coordinator) workerList(selector string) (*WorkerList, error) {
+	labels, err := ParseLabels(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return &WorkerList{
+		Workers:    me.selectWorkers(labels),
+		LastChange: me.lastChange,
+	}, nil
+}
+
+// Status returns all registered workers, sorted by address.
+func (me *Coordinator) Status(req *CoordinatorStatusRequest, rep *CoordinatorStatusResponse) error {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	keys := []string{}
+	for k := range me.workers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		rep.Workers = append(rep.Workers, *me.workers[k])
 	}
-	rep.LastChange = me.lastChange
 	return nil
 }
 
+// checkReachable probes the workers, and drops those that missed
+// MaxMissedChecks checks in a row.  Workers are probed concurrently,
+// so a hung worker does not delay checking the others.
 func (me *Coordinator) checkReachable() {
-	now := time.Now()
+	me.mutex.Lock()
+	before := me.registrations
+	me.mutex.Unlock()
 
 	addrs := me.workerAddresses()
 
-	var toDelete []string
+	var wg sync.WaitGroup
+	var resultMutex sync.Mutex
+	failed := map[string]error{}
+	reached := map[string]time.Duration{}
+	sem := make(chan bool, me.options.CheckConcurrency)
 	for _, a := range addrs {
-		conn, err := DialTypedConnection(a, RPC_CHANNEL, me.options.Secret)
-		if err != nil {
-			toDelete = append(toDelete, a)
-		} else {
-			conn.Close()
-		}
-	}
-
-	if len(toDelete) == 0 {
-		return
+		wg.Add(1)
+		sem <- true
+		go func(a string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			start := time.Now()
+			conn, err := dialTypedConnection(a, RPC_CHANNEL, me.options.Secret, me.tlsConfig, me.options.CheckTimeout)
+			latency := time.Now().Sub(start)
+			if conn != nil {
+				conn.Close()
+			}
+			resultMutex.Lock()
+			defer resultMutex.Unlock()
+			if err != nil {
+				failed[a] = err
+			} else {
+				reached[a] = latency
+			}
+		}(a)
 	}
+	wg.Wait()
 
 	me.mutex.Lock()
-	for _, a := range toDelete {
+	defer me.mutex.Unlock()
+	verified := false
+	for a, latency := range reached {
+		if w := me.workers[a]; w != nil {
+			w.MissedChecks = 0
+			w.ProbeLatency = latency
+			if w.unverified {
+				w.unverified = false
+				verified = true
+			}
+		}
+	}
+	evicted := false
+	for a, err := range failed {
 		w := me.workers[a]
-		if w != nil && now.After(w.LastReported) {
-			delete(me.workers, a)
+		if w == nil || w.registration > before {
+			// Registered again while we probed.
+			continue
+		}
+		w.MissedChecks++
+		if w.MissedChecks < me.options.MaxMissedChecks {
+			log.Printf("worker %s missed %d of %d checks: %v", a, w.MissedChecks, me.options.MaxMissedChecks, err)
+			continue
 		}
+		log.Printf("dropping worker %s: unreachable for %d checks: %v", a, w.MissedChecks, err)
+		delete(me.workers, a)
+		evicted = true
+	}
+	rescored := me.rescore(time.Now())
+	if verified || evicted || rescored {
+		me.changed()
+		me.cond.Broadcast()
 	}
-	me.lastChange = time.Now()
-	me.mutex.Unlock()
 }
 
-const _POLL = 60
+// changed advances lastChange, which masters pass back in
+// ListRequest.Latest.  If the clock went backward, it moves on from
+// the last value anyway, so List does not hold back changes until the
+// clock catches up.  Must hold mutex.
+func (me *Coordinator) changed() {
+	now := time.Now()
+	if !now.After(me.lastChange) {
+		now = me.lastChange.Add(time.Nanosecond)
+	}
+	me.lastChange = now
+}
 
 func (me *Coordinator) PeriodicCheck() {
+	me.checkRestored()
+	poll := time.NewTicker(me.options.CheckInterval)
+	sample := time.NewTicker(_CAPACITY_SAMPLE_PERIOD)
 	for {
-		c := time.After(_POLL * 1e9)
-		<-c
-		me.checkReachable()
+		select {
+		case <-poll.C:
+			me.checkReachable()
+			me.saveRegistry()
+		case <-sample.C:
+			me.sampleCapacity()
+		}
 	}
 }
 
 func (me *Coordinator) killWorker(addr string, restart bool) error {
-	conn, err := DialTypedConnection(addr, RPC_CHANNEL, me.options.Secret)
+	conn, err := DialTypedConnection(addr, RPC_CHANNEL, me.options.Secret, me.tlsConfig)
 	if err == nil {
 		killReq := ShutdownRequest{Restart: restart}
 		rep := ShutdownResponse{}
@@ -178,7 +460,7 @@ func (me *Coordinator) killWorker(addr string, restart bool) error {
 }
 
 func (me *Coordinator) shutdownWorker(addr string, restart bool) error {
-	conn, err := DialTypedConnection(addr, RPC_CHANNEL, me.options.Secret)
+	conn, err := DialTypedConnection(addr, RPC_CHANNEL, me.options.Secret, me.tlsConfig)
 	if err != nil {
 		return err
 	}
@@ -209,6 +491,7 @@ func (me *Coordinator) getWorker(addr string) *WorkerRegistration {
 
 func (me *Coordinator) Shutdown() {
 	log.Println("Coordinator shutdown.")
+	me.saveRegistry()
 	me.listener.Close()
 }
 
@@ -0,0 +1,330 @@
+package termite
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCoordinatorStatus(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/status.json", tc.coordinatorPort))
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+
+	status := CoordinatorStatusResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(status.Workers) != 1 {
+		t.Fatalf("got %d workers, want 1: %v", len(status.Workers), status)
+	}
+	w := status.Workers[0]
+	if w.Version != Version() {
+		t.Errorf("got version %q, want %q", w.Version, Version())
+	}
+	if w.MaxJobs != tc.workerOpts.Jobs {
+		t.Errorf("got MaxJobs %d, want %d", w.MaxJobs, tc.workerOpts.Jobs)
+	}
+	if w.LastReported.IsZero() {
+		t.Errorf("LastReported unset")
+	}
+
+	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("localhost:%d", tc.coordinatorPort))
+	if err != nil {
+		t.Fatalf("DialHTTP: %v", err)
+	}
+	defer client.Close()
+
+	rpcStatus := CoordinatorStatusResponse{}
+	if err := client.Call("Coordinator.Status", &CoordinatorStatusRequest{}, &rpcStatus); err != nil {
+		t.Fatalf("Coordinator.Status: %v", err)
+	}
+	if len(rpcStatus.Workers) != 1 || rpcStatus.Workers[0].Address != w.Address {
+		t.Errorf("RPC status %v does not match JSON status %v", rpcStatus, status)
+	}
+}
+
+// fakeWorker accepts RPC connections, and closes them.
+func fakeWorker(secret []byte) net.Listener {
+	l := AuthenticatedListener(0, secret, 0, nil)
+	pending := NewPendingConnections()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if !pending.Accept(conn) {
+					conn.Close()
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestCoordinatorCheckHungWorker(t *testing.T) {
+	secret := []byte("secret")
+	c := NewCoordinator(&CoordinatorOptions{
+		Secret:           secret,
+		CheckConcurrency: 2,
+		CheckTimeout:     200 * time.Millisecond,
+	})
+
+	// Accepts connections, but never answers.
+	hung, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer hung.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := hung.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	reported := time.Now().Add(-time.Minute)
+	addrs := []string{hung.Addr().String()}
+	for i := 0; i < 4; i++ {
+		l := fakeWorker(secret)
+		defer l.Close()
+		addrs = append(addrs, l.Addr().String())
+	}
+	for _, a := range addrs {
+		c.workers[a] = &WorkerRegistration{
+			Registration: Registration{Address: a},
+			LastReported: reported,
+		}
+	}
+
+	for i := 1; i <= _DEFAULT_MAX_MISSED_CHECKS; i++ {
+		if w := c.getWorker(hung.Addr().String()); w == nil {
+			t.Fatalf("hung worker removed after %d checks", i-1)
+		}
+		start := time.Now()
+		c.checkReachable()
+		if dt := time.Now().Sub(start); dt > 2*time.Second {
+			t.Errorf("check took %v", dt)
+		}
+	}
+	if c.getWorker(hung.Addr().String()) != nil {
+		t.Errorf("hung worker was not removed")
+	}
+	if n := c.WorkerCount(); n != 4 {
+		t.Errorf("got %d workers, want 4", n)
+	}
+}
+
+// TestCoordinatorMissedChecks checks that a worker survives missed
+// checks that are not consecutive, and can register again once it is
+// dropped.
+func TestCoordinatorMissedChecks(t *testing.T) {
+	secret := []byte("secret")
+	c := NewCoordinator(&CoordinatorOptions{
+		Secret:          secret,
+		CheckTimeout:    200 * time.Millisecond,
+		MaxMissedChecks: 2,
+	})
+
+	l := fakeWorker(secret)
+	addr := l.Addr().String()
+	c.workers[addr] = &WorkerRegistration{
+		Registration: Registration{Address: addr},
+		MissedChecks: 1,
+	}
+	c.checkReachable()
+	if w := c.getWorker(addr); w == nil || w.MissedChecks != 0 {
+		t.Fatalf("reachable worker: got %+v", w)
+	}
+	l.Close()
+
+	c.checkReachable()
+	if w := c.getWorker(addr); w == nil || w.MissedChecks != 1 {
+		t.Fatalf("after one miss: got %+v", w)
+	}
+	c.checkReachable()
+	if w := c.getWorker(addr); w != nil {
+		t.Fatalf("after two misses: got %+v", w)
+	}
+
+	l = fakeWorker(secret)
+	defer l.Close()
+	addr = l.Addr().String()
+	if err := c.Register(&RegistrationRequest{Address: addr}, &Empty{}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if w := c.getWorker(addr); w == nil || w.MissedChecks != 0 {
+		t.Errorf("registered again: got %+v", w)
+	}
+}
+
+func TestCoordinatorRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "term-registry")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := []byte("secret")
+	opts := CoordinatorOptions{
+		Secret:       secret,
+		CheckTimeout: 200 * time.Millisecond,
+		RegistryFile: filepath.Join(dir, "registry"),
+	}
+	c := NewCoordinator(&opts)
+
+	live := fakeWorker(secret)
+	defer live.Close()
+	dead, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	dead.Close()
+
+	reported := time.Now().Add(-time.Minute)
+	for _, a := range []string{live.Addr().String(), dead.Addr().String()} {
+		c.workers[a] = &WorkerRegistration{
+			Registration: Registration{Address: a, MaxJobs: 3},
+			LastReported: reported,
+		}
+	}
+	c.saveRegistry()
+
+	restored := NewCoordinator(&opts)
+	if n := restored.WorkerCount(); n != 2 {
+		t.Fatalf("restored %d workers, want 2", n)
+	}
+	w := restored.getWorker(live.Addr().String())
+	if w == nil || w.MaxJobs != 3 || !w.LastReported.Equal(reported) {
+		t.Errorf("restored %+v", w)
+	}
+	if l, _ := restored.workerList(""); len(l.Workers) != 0 {
+		t.Errorf("listed %d workers before probing, want 0", len(l.Workers))
+	}
+
+	restored.checkRestored()
+	if restored.getWorker(dead.Addr().String()) != nil {
+		t.Errorf("dead worker was not removed")
+	}
+	if n := restored.WorkerCount(); n != 1 {
+		t.Errorf("got %d workers, want 1", n)
+	}
+	rep := ListResponse{}
+	if err := restored.List(&ListRequest{}, &rep); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(rep.Registrations) != 1 || rep.Registrations[0].Address != live.Addr().String() {
+		t.Errorf("listed %+v, want the live worker", rep.Registrations)
+	}
+}
+
+func TestCoordinatorWorkersJson(t *testing.T) {
+	c := NewCoordinator(&CoordinatorOptions{})
+	reported := time.Now()
+	for _, a := range []string{"w2:1", "w1:1"} {
+		c.workers[a] = &WorkerRegistration{
+			Registration: Registration{
+				Address: a,
+				MaxJobs: 2,
+				Labels:  map[string]string{"pool": a[:2]},
+			},
+			LastReported: reported,
+		}
+	}
+
+	get := func(url string) (*WorkerList, int) {
+		w := httptest.NewRecorder()
+		c.workersJsonHandler(w, httptest.NewRequest("GET", url, nil))
+		list := &WorkerList{}
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(list); err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+		}
+		return list, w.Code
+	}
+
+	list, code := get("/workers.json")
+	if code != http.StatusOK || len(list.Workers) != 2 {
+		t.Fatalf("got %d, %v", code, list)
+	}
+	if w := list.Workers[0]; w.Address != "w1:1" || w.MaxJobs != 2 || !w.LastReported.Equal(reported) {
+		t.Errorf("got %+v", w)
+	}
+
+	list, _ = get("/workers.json?selector=pool=w2")
+	if len(list.Workers) != 1 || list.Workers[0].Address != "w2:1" {
+		t.Errorf("selector: got %v", list.Workers)
+	}
+	if _, code := get("/workers.json?selector=pool"); code != http.StatusBadRequest {
+		t.Errorf("bad selector: got %d", code)
+	}
+}
+
+func TestCoordinatorHealth(t *testing.T) {
+	c := NewCoordinator(&CoordinatorOptions{
+		CheckTimeout: time.Second,
+		MinHealth:    0.4,
+	})
+	now := time.Now()
+	for _, w := range []*WorkerRegistration{
+		{Registration: Registration{Address: "healthy:1", MaxJobs: 4}, LastReported: now},
+		{Registration: Registration{Address: "slow:1", MaxJobs: 4, RunningJobs: 4}, LastReported: now, ProbeLatency: time.Second},
+		{Registration: Registration{Address: "stale:1"}, LastReported: now.Add(-4 * time.Minute)},
+		{Registration: Registration{Address: "missed:1"}, LastReported: now, MissedChecks: 2},
+	} {
+		c.workers[w.Address] = w
+	}
+	if !c.rescore(now) {
+		t.Errorf("rescore: no change reported")
+	}
+	for addr, want := range map[string]float64{
+		"healthy:1": 1,
+		"slow:1":    0.375,
+		"stale:1":   0.5,
+		"missed:1":  1.0 / 3,
+	} {
+		if got := c.workers[addr].Health; got < want-1e-9 || got > want+1e-9 {
+			t.Errorf("%s: got health %v, want %v", addr, got, want)
+		}
+	}
+	if c.rescore(now) {
+		t.Errorf("rescore without changes reported a change")
+	}
+
+	c.changed()
+	rep := ListResponse{}
+	if err := c.List(&ListRequest{}, &rep); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var got []string
+	for _, r := range rep.Registrations {
+		got = append(got, r.Address)
+	}
+	if want := "healthy:1 stale:1"; strings.Join(got, " ") != want {
+		t.Errorf("listed %v, want %s", got, want)
+	}
+}
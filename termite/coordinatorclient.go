@@ -0,0 +1,130 @@
+package termite
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// coordinatorClient issues RPCs to the coordinator.  After a failure,
+// calls fail right away until a jittered, exponentially growing
+// backoff expires, so a coordinator that comes back up is not flooded
+// by every master and worker at once.  Calls never wait for the
+// backoff, as callers such as the periodic reports must not stall; a
+// caller with nothing else to do can wait with waitBackoff.
+type coordinatorClient struct {
+	addr      string
+	tlsConfig *tls.Config
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	// Caps the number of concurrent dials.
+	dials chan bool
+
+	mutex sync.Mutex
+
+	// Consecutive failures, and when we may dial again.
+	consecutiveFailures int
+	notBefore           time.Time
+
+	successes int
+	failures  int
+}
+
+const (
+	_COORDINATOR_MIN_BACKOFF  = time.Second
+	_COORDINATOR_MAX_BACKOFF  = 2 * time.Minute
+	_COORDINATOR_MAX_DIALS    = 2
+	_COORDINATOR_DIAL_TIMEOUT = 10 * time.Second
+)
+
+var errNoCoordinator = errors.New("no coordinator configured")
+
+func newCoordinatorClient(addr string, config *tls.Config) *coordinatorClient {
+	return &coordinatorClient{
+		addr:       addr,
+		tlsConfig:  config,
+		minBackoff: _COORDINATOR_MIN_BACKOFF,
+		maxBackoff: _COORDINATOR_MAX_BACKOFF,
+		dials:      make(chan bool, _COORDINATOR_MAX_DIALS),
+	}
+}
+
+// Call dials the coordinator and runs the given RPC.  While the
+// backoff from previous failures runs, it fails without dialing.
+func (me *coordinatorClient) Call(method string, req interface{}, rep interface{}) error {
+	if me.addr == "" {
+		return errNoCoordinator
+	}
+	if wait := me.backoffLeft(); wait > 0 {
+		return fmt.Errorf("coordinator %s unreachable; retrying in %v", me.addr, wait)
+	}
+
+	me.dials <- true
+	client, err := dialHTTPRPC(me.addr, me.tlsConfig, _COORDINATOR_DIAL_TIMEOUT)
+	<-me.dials
+	if err == nil {
+		err = client.Call(method, req, rep)
+		client.Close()
+	}
+	me.record(err)
+	return err
+}
+
+// backoffLeft returns how long calls still fail after the last
+// failure.
+func (me *coordinatorClient) backoffLeft() time.Duration {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return me.notBefore.Sub(time.Now())
+}
+
+// waitBackoff sleeps until calls may dial again.
+func (me *coordinatorClient) waitBackoff() {
+	if wait := me.backoffLeft(); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+func (me *coordinatorClient) record(err error) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if err == nil {
+		me.successes++
+		me.consecutiveFailures = 0
+		me.notBefore = time.Time{}
+		return
+	}
+
+	me.failures++
+	me.consecutiveFailures++
+	me.notBefore = time.Now().Add(me.backoff(me.consecutiveFailures))
+}
+
+func (me *coordinatorClient) backoff(failures int) time.Duration {
+	return jitteredBackoff(me.minBackoff, me.maxBackoff, failures)
+}
+
+// jitteredBackoff returns a random duration in [b/2, b), where b
+// starts at min and doubles for each consecutive failure, up to max.
+func jitteredBackoff(min, max time.Duration, failures int) time.Duration {
+	b := min
+	for i := 1; i < failures && b < max; i++ {
+		b *= 2
+	}
+	if b > max {
+		b = max
+	}
+	return b/2 + time.Duration(rand.Int63n(int64(b/2)+1))
+}
+
+// Stats returns the number of successful and failed calls.
+func (me *coordinatorClient) Stats() (successes, failures int) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return me.successes, me.failures
+}
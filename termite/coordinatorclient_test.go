@@ -0,0 +1,117 @@
+package termite
+
+import (
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rejectingListener closes the first reject connections it accepts.
+type rejectingListener struct {
+	net.Listener
+	reject int
+
+	mutex   sync.Mutex
+	accepts []time.Time
+}
+
+func (me *rejectingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := me.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		me.mutex.Lock()
+		me.accepts = append(me.accepts, time.Now())
+		rejected := len(me.accepts) <= me.reject
+		me.mutex.Unlock()
+		if !rejected {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+func TestCoordinatorClientBackoff(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	listener := &rejectingListener{Listener: l, reject: 4}
+	defer listener.Close()
+
+	coordinator := NewCoordinator(&CoordinatorOptions{})
+	rpcServer := rpc.NewServer()
+	rpcServer.Register(coordinator)
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, rpcServer)
+	go http.Serve(listener, mux)
+
+	client := newCoordinatorClient(l.Addr().String(), nil)
+	client.minBackoff = 20 * time.Millisecond
+	client.maxBackoff = 100 * time.Millisecond
+
+	calls := 0
+	for {
+		if calls > 0 {
+			// Calls during the backoff fail without dialing.
+			start := time.Now()
+			if err := client.Call("Coordinator.Status", &CoordinatorStatusRequest{}, &CoordinatorStatusResponse{}); err == nil {
+				t.Fatalf("call during backoff succeeded")
+			}
+			if d := time.Now().Sub(start); d > client.minBackoff/2 {
+				t.Errorf("call during backoff took %v", d)
+			}
+			client.waitBackoff()
+		}
+		calls++
+		rep := CoordinatorStatusResponse{}
+		if err := client.Call("Coordinator.Status", &CoordinatorStatusRequest{}, &rep); err == nil {
+			break
+		}
+		if calls > 10 {
+			t.Fatalf("no success after %d calls", calls)
+		}
+	}
+
+	if calls != listener.reject+1 {
+		t.Errorf("got %d calls, want %d", calls, listener.reject+1)
+	}
+	if s, f := client.Stats(); s != 1 || f != listener.reject {
+		t.Errorf("Stats: got %d successes, %d failures", s, f)
+	}
+
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	for i := 1; i < len(listener.accepts); i++ {
+		b := client.minBackoff << uint(i-1)
+		if b > client.maxBackoff {
+			b = client.maxBackoff
+		}
+		gap := listener.accepts[i].Sub(listener.accepts[i-1])
+		if gap < b/2 {
+			t.Errorf("attempt %d came %v after the previous one, want at least %v", i, gap, b/2)
+		}
+	}
+}
+
+func TestCoordinatorClientJitter(t *testing.T) {
+	client := newCoordinatorClient("", nil)
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		b := client.backoff(3)
+		if b < 2*client.minBackoff || b > 4*client.minBackoff {
+			t.Errorf("backoff(3) = %v, want in [%v, %v]", b, 2*client.minBackoff, 4*client.minBackoff)
+		}
+		seen[b] = true
+	}
+	if len(seen) == 1 {
+		t.Errorf("backoff is not jittered: %v", seen)
+	}
+	if b := client.backoff(100); b > client.maxBackoff {
+		t.Errorf("backoff(100) = %v exceeds maximum %v", b, client.maxBackoff)
+	}
+}
@@ -1,13 +1,18 @@
 package termite
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -36,8 +41,8 @@ func (me *Coordinator) workerHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	workerData := me.getWorker(addr)
 	host, _, _ := net.SplitHostPort(addr)
-	resp, err := http.Get(fmt.Sprintf("http://%s:%d/%s?%s", host, workerData.HttpStatusPort,
-		req.URL.Path, req.URL.RawQuery))
+	resp, err := httpClient(me.tlsConfig).Get(fmt.Sprintf("%s://%s:%d/%s?%s", httpScheme(me.tlsConfig),
+		host, workerData.HttpStatusPort, req.URL.Path, req.URL.RawQuery))
 
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -50,11 +55,62 @@ func (me *Coordinator) workerHandler(w http.ResponseWriter, req *http.Request) {
 	resp.Body.Close()
 }
 
+func (me *Coordinator) statusJsonHandler(w http.ResponseWriter, req *http.Request) {
+	status := CoordinatorStatusResponse{}
+	me.Status(&CoordinatorStatusRequest{}, &status)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&status); err != nil {
+		log.Println("status.json:", err)
+	}
+}
+
+// workersJsonHandler serves the workers as JSON.  The query
+// parameter selector restricts them to those with the given labels.
+func (me *Coordinator) workersJsonHandler(w http.ResponseWriter, req *http.Request) {
+	list, err := me.workerList(req.URL.Query().Get("selector"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		log.Println("workers.json:", err)
+	}
+}
+
+func (me *Coordinator) capacityHandler(w http.ResponseWriter, req *http.Request) {
+	capacity := me.Capacity()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&capacity); err != nil {
+		log.Println("capacity:", err)
+	}
+}
+
 func (me *Coordinator) ServeHTTP(port int) {
 	me.Mux.HandleFunc("/",
 		func(w http.ResponseWriter, req *http.Request) {
 			me.rootHandler(w, req)
 		})
+	me.Mux.HandleFunc("/status.json",
+		func(w http.ResponseWriter, req *http.Request) {
+			me.statusJsonHandler(w, req)
+		})
+	me.Mux.HandleFunc("/workers.json",
+		func(w http.ResponseWriter, req *http.Request) {
+			me.workersJsonHandler(w, req)
+		})
+	me.Mux.HandleFunc("/metrics",
+		func(w http.ResponseWriter, req *http.Request) {
+			me.metricsHandler(w, req)
+		})
+	me.Mux.HandleFunc("/api/capacity",
+		func(w http.ResponseWriter, req *http.Request) {
+			me.capacityHandler(w, req)
+		})
 	me.Mux.HandleFunc("/worker",
 		func(w http.ResponseWriter, req *http.Request) {
 			me.workerHandler(w, req)
@@ -63,6 +119,10 @@ func (me *Coordinator) ServeHTTP(port int) {
 		func(w http.ResponseWriter, req *http.Request) {
 			me.workerHandler(w, req)
 		})
+	me.Mux.HandleFunc("/content.json",
+		func(w http.ResponseWriter, req *http.Request) {
+			me.workerHandler(w, req)
+		})
 	me.Mux.HandleFunc("/shutdown",
 		func(w http.ResponseWriter, req *http.Request) {
 			me.shutdownSelf(w, req)
@@ -71,6 +131,10 @@ func (me *Coordinator) ServeHTTP(port int) {
 		func(w http.ResponseWriter, req *http.Request) {
 			me.killHandler(w, req)
 		})
+	me.Mux.HandleFunc("/ratelimit",
+		func(w http.ResponseWriter, req *http.Request) {
+			me.rateLimitHandler(w, req)
+		})
 	me.Mux.HandleFunc("/killall",
 		func(w http.ResponseWriter, req *http.Request) {
 			me.killAllHandler(w, req)
@@ -83,15 +147,16 @@ func (me *Coordinator) ServeHTTP(port int) {
 		func(w http.ResponseWriter, req *http.Request) {
 			me.killHandler(w, req)
 		})
+	me.Mux.HandleFunc("/restartworker",
+		func(w http.ResponseWriter, req *http.Request) {
+			me.updateHandler(w, req)
+		})
 
 	rpcServer := rpc.NewServer()
 	if err := rpcServer.Register(me); err != nil {
 		log.Fatal("rpcServer.Register:", err)
 	}
-	me.Mux.HandleFunc(rpc.DefaultRPCPath,
-		func(w http.ResponseWriter, req *http.Request) {
-			rpcServer.ServeHTTP(w, req)
-		})
+	me.Mux.Handle(rpc.DefaultRPCPath, requireClientCert(rpcServer))
 
 	addr := fmt.Sprintf(":%d", port)
 	var err error
@@ -101,11 +166,7 @@ func (me *Coordinator) ServeHTTP(port int) {
 	}
 	log.Println("Coordinator listening on", addr)
 
-	httpServer := http.Server{
-		Addr:    addr,
-		Handler: me.Mux,
-	}
-	err = httpServer.Serve(me.listener)
+	err = serveHTTP(me.listener, me.Mux, me.tlsConfig)
 	if e, ok := err.(*net.OpError); ok && e.Err == syscall.EINVAL {
 		return
 	}
@@ -154,7 +215,7 @@ func (me *Coordinator) killHandler(w http.ResponseWriter, req *http.Request) {
 	addr, err := me.getHost(req)
 	var conn net.Conn
 	if err == nil {
-		conn, err = DialTypedConnection(addr, RPC_CHANNEL, me.options.Secret)
+		conn, err = DialTypedConnection(addr, RPC_CHANNEL, me.options.Secret, me.tlsConfig)
 	}
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
@@ -189,11 +250,131 @@ func (me *Coordinator) killHandler(w http.ResponseWriter, req *http.Request) {
 		action = "restart"
 	}
 	fmt.Fprintf(w, "<p>%s of %s in progress", action, conn.RemoteAddr())
+	me.mutex.Lock()
+	if reg := me.workers[addr]; reg != nil && len(reg.Labels) > 0 {
+		fmt.Fprintf(w, "<p>labels: <tt>%s</tt>", FormatLabels(reg.Labels))
+	}
+	me.mutex.Unlock()
 	// Should have a redirect.
 	fmt.Fprintf(w, "<p><a href=\"/\">back to index</a>")
 	go me.checkReachable()
 }
 
+// Upper bound on the size of a worker binary.
+const _MAX_WORKER_BINARY = 1 << 30
+
+// updateHandler sends the worker binary POSTed to it to the worker
+// given by the query parameter host, or to all workers if there is
+// none.
+func (me *Coordinator) updateHandler(w http.ResponseWriter, req *http.Request) {
+	me.log(req)
+	if !me.checkPassword(w, req) {
+		return
+	}
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "POST the worker binary")
+		return
+	}
+
+	addrs := me.workerAddresses()
+	var err error
+	if req.URL.Query().Get("host") != "" {
+		var addr string
+		addr, err = me.getHost(req)
+		addrs = []string{addr}
+	}
+	var binary []byte
+	if err == nil {
+		binary, err = ioutil.ReadAll(io.LimitReader(req.Body, _MAX_WORKER_BINARY+1))
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	if len(binary) > _MAX_WORKER_BINARY {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "error: binary is larger than %d bytes", _MAX_WORKER_BINARY)
+		return
+	}
+
+	hash := binaryHash(binary)
+	sort.Strings(addrs)
+	errs := make([]error, len(addrs))
+	var wg sync.WaitGroup
+	for i, a := range addrs {
+		wg.Add(1)
+		go func(i int, a string) {
+			defer wg.Done()
+			errs[i] = me.updateWorker(a, hash, binary)
+		}(i, a)
+	}
+	wg.Wait()
+
+	failed := false
+	for i, a := range addrs {
+		if errs[i] != nil {
+			failed = true
+			fmt.Fprintf(w, "%s: error: %v\n", a, errs[i])
+		} else {
+			fmt.Fprintf(w, "%s: restarting\n", a)
+		}
+	}
+	if failed {
+		log.Printf("updating workers failed: %v", errs)
+	}
+	go me.checkReachable()
+}
+
+// rateLimitHandler sets the rate at which a worker serves content,
+// from the query parameters host and bps.
+func (me *Coordinator) rateLimitHandler(w http.ResponseWriter, req *http.Request) {
+	me.log(req)
+	if !me.checkPassword(w, req) {
+		return
+	}
+	addr, err := me.getHost(req)
+	var bps int64
+	if err == nil {
+		bps, err = strconv.ParseInt(req.URL.Query().Get("bps"), 10, 64)
+	}
+	var conn net.Conn
+	if err == nil {
+		conn, err = DialTypedConnection(addr, RPC_CHANNEL, me.options.Secret, me.tlsConfig)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "<html><head><title>Termite worker error</title></head>")
+		fmt.Fprintf(w, "<body>Error: %s</body></html>", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, "<html><head><title>Termite worker rate limit</title></head>")
+	fmt.Fprintf(w, "<body><h1>Rate limit %s</h1>", addr)
+	defer fmt.Fprintf(w, "</body></html>")
+
+	rateReq := SetRateLimitRequest{BytesPerSec: bps}
+	rep := SetRateLimitResponse{}
+	cl := rpc.NewClient(conn)
+	defer cl.Close()
+	if err := cl.Call("Worker.SetRateLimit", &rateReq, &rep); err != nil {
+		fmt.Fprintf(w, "<p><tt>Error: %v<tt>", err)
+		return
+	}
+	fmt.Fprintf(w, "<p>Content served at %s, was %s", formatRate(bps), formatRate(rep.Previous))
+	fmt.Fprintf(w, "<p><a href=\"/\">back to index</a>")
+}
+
+func formatRate(bps int64) string {
+	if bps <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d bytes/s", bps)
+}
+
 func (me *Coordinator) rootHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 	me.mutex.Lock()
@@ -217,6 +398,28 @@ func (me *Coordinator) rootHandler(w http.ResponseWriter, req *http.Request) {
 			" (<a href=\"/workerkill?host=%s\">Kill</a>, \n"+
 			"<a href=\"/restart?host=%s\">Restart</a>)\n",
 			addr, addr, worker.Name, addr, addr)
+		fmt.Fprintf(w, "<br>version <tt>%s</tt>\n", worker.Version)
+		if len(worker.Labels) > 0 {
+			fmt.Fprintf(w, "<br>labels: <tt>%s</tt>\n", FormatLabels(worker.Labels))
+		}
+		if worker.NumCPU > 0 {
+			fmt.Fprintf(w, "<br>load %.2f on %d CPUs, %d MB available\n",
+				worker.LoadAvg, worker.NumCPU, worker.MemAvailable>>20)
+		}
+		if worker.ResourceKills > 0 {
+			fmt.Fprintf(w, "<br>%d jobs killed for exceeding resource limits\n", worker.ResourceKills)
+		}
+		if worker.Health > 0 {
+			fmt.Fprintf(w, "<br>health %.2f, probe took %v\n", worker.Health, worker.ProbeLatency)
+		}
+		if worker.unverified {
+			fmt.Fprintf(w, "<br>restored from registry, not probed yet\n")
+		} else if worker.MissedChecks > 0 {
+			fmt.Fprintf(w, "<br>missed %d reachability checks\n", worker.MissedChecks)
+		}
+		if len(worker.CPUFeatures) > 0 {
+			fmt.Fprintf(w, "<br>CPU features: <tt>%s</tt>\n", strings.Join(worker.CPUFeatures, " "))
+		}
 	}
 	fmt.Fprintf(w, "</ul>")
 
@@ -0,0 +1,85 @@
+package termite
+
+import (
+	"io/ioutil"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Objects compiled with -march=native only run on machines with the
+// instruction set extensions of the compiling machine.  Workers
+// report their CPU feature flags, and jobs can require a set of
+// them.
+
+// Prefixes of the /proc/cpuinfo flags that name instruction set
+// extensions on x86.  Other flags, such as "hypervisor", do not
+// matter to compiled code.
+var isaFlagPrefixes = []string{
+	"abm", "adx", "aes", "amx", "avx", "bmi", "clflushopt", "clwb",
+	"f16c", "fma", "fsgsbase", "gfni", "lzcnt", "mmx", "movbe",
+	"pclmulqdq", "popcnt", "rdrand", "rdseed", "sha_ni", "sse",
+	"ssse3", "vaes", "vpclmulqdq", "xsave",
+}
+
+// parseCPUFeatures returns the sorted feature flags of the first
+// processor in the /proc/cpuinfo content.
+func parseCPUFeatures(cpuinfo string) []string {
+	for _, l := range strings.Split(cpuinfo, "\n") {
+		kv := strings.SplitN(l, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		// "flags" on x86, "Features" on ARM.
+		if k := strings.TrimSpace(kv[0]); k != "flags" && k != "Features" {
+			continue
+		}
+		features := strings.Fields(kv[1])
+		sort.Strings(features)
+		return features
+	}
+	return nil
+}
+
+// CPUFeatures returns the CPU feature flags of this machine.
+func CPUFeatures() []string {
+	content, err := ioutil.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return nil
+	}
+	return parseCPUFeatures(string(content))
+}
+
+// NativeCPUFeatures returns the features that code compiled with
+// -march=native on this machine may use.
+func NativeCPUFeatures() []string {
+	return isaFeatures(runtime.GOARCH, CPUFeatures())
+}
+
+func isaFeatures(arch string, features []string) []string {
+	if arch != "amd64" && arch != "386" {
+		return features
+	}
+	var result []string
+	for _, f := range features {
+		for _, p := range isaFlagPrefixes {
+			if strings.HasPrefix(f, p) {
+				result = append(result, f)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// missingCPUFeature returns a feature in want that is not in have,
+// or "" if there is none.  have must be sorted.
+func missingCPUFeature(have, want []string) string {
+	for _, f := range want {
+		i := sort.SearchStrings(have, f)
+		if i == len(have) || have[i] != f {
+			return f
+		}
+	}
+	return ""
+}
@@ -0,0 +1,34 @@
+package termite
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCPUFeatures(t *testing.T) {
+	cpuinfo := `processor	: 0
+vendor_id	: GenuineIntel
+flags		: fpu sse2 avx512f hypervisor avx2 sse4_2
+bugs		: spectre_v1
+
+processor	: 1
+flags		: fpu sse2
+`
+	got := parseCPUFeatures(cpuinfo)
+	want := []string{"avx2", "avx512f", "fpu", "hypervisor", "sse2", "sse4_2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	arm := "processor\t: 0\nFeatures\t: fp asimd aes\n"
+	if got := parseCPUFeatures(arm); !reflect.DeepEqual(got, []string{"aes", "asimd", "fp"}) {
+		t.Errorf("arm: got %v", got)
+	}
+
+	if got := isaFeatures("amd64", want); !reflect.DeepEqual(got, []string{"avx2", "avx512f", "sse2", "sse4_2"}) {
+		t.Errorf("isaFeatures: got %v", got)
+	}
+	if missing := missingCPUFeature(want, []string{"avx2", "avx512vl"}); missing != "avx512vl" {
+		t.Errorf("missingCPUFeature: got %q", missing)
+	}
+}
@@ -0,0 +1,72 @@
+package termite
+
+import (
+	"fmt"
+	"strings"
+)
+
+// With MasterOptions.DedupEnv, the master registers the environment
+// of a job with the mirror once, and sends later jobs with the same
+// environment with only its handle.
+
+// RegisterEnvRequest registers an environment with a mirror.
+type RegisterEnvRequest struct {
+	Handle string
+	Env    []string
+}
+
+func envHandle(env []string) string {
+	return md5str(strings.Join(env, "\x00"))
+}
+
+// RegisterEnv stores the environment for use by later WorkRequests.
+func (me *Mirror) RegisterEnv(req *RegisterEnvRequest, rep *Empty) error {
+	if envHandle(req.Env) != req.Handle {
+		return fmt.Errorf("environment does not match handle %x", req.Handle)
+	}
+	me.fsMutex.Lock()
+	defer me.fsMutex.Unlock()
+	me.envs[req.Handle] = req.Env
+	return nil
+}
+
+// resolveEnv fills in the environment of a request that only has a
+// handle.
+func (me *Mirror) resolveEnv(req *WorkRequest) error {
+	if req.EnvHandle == "" {
+		return nil
+	}
+	me.fsMutex.Lock()
+	defer me.fsMutex.Unlock()
+	env, ok := me.envs[req.EnvHandle]
+	if !ok {
+		return fmt.Errorf("unknown environment handle %x", req.EnvHandle)
+	}
+	req.Env = env
+	return nil
+}
+
+// mirrorRequest returns the request to send to the mirror: req itself,
+// or a copy that refers to the environment by handle.
+func (me *Master) mirrorRequest(mirror *mirrorConnection, req *WorkRequest) (*WorkRequest, error) {
+	if !me.options.DedupEnv || len(req.Env) == 0 {
+		return req, nil
+	}
+
+	h := envHandle(req.Env)
+	mirror.envMutex.Lock()
+	defer mirror.envMutex.Unlock()
+	if !mirror.envs[h] {
+		envReq := RegisterEnvRequest{Handle: h, Env: req.Env}
+		if err := mirror.rpcClient.Call("Mirror.RegisterEnv", &envReq, &Empty{}); err != nil {
+			return nil, err
+		}
+		mirror.envs[h] = true
+		mirror.envsSent++
+	}
+
+	short := *req
+	short.Env = nil
+	short.EnvHandle = h
+	return &short, nil
+}
@@ -0,0 +1,195 @@
+package termite
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+
+	"github.com/hanwen/termite/attr"
+)
+
+// When a job fails, the WorkResponse carries a FailureReport that
+// says in which phase of the job it failed, and where.  Errors are
+// tagged with their phase at the phase boundaries in the master and
+// the worker, and the report is assembled from the tagged error.
+
+// Phases of a job, as used in FailureReport.
+const (
+	// Checking the request: paths, binary, environment.
+	PhaseValidation = "validation"
+
+	// Finding a worker and setting up the job there.
+	PhaseScheduling = "scheduling"
+
+	// Sending pending file changes to the worker.
+	PhaseUpdateFlush = "update-flush"
+
+	// Running the command.
+	PhaseExec = "exec"
+
+	// Collecting files from a job while it runs.
+	PhaseHarvest = "harvest"
+
+	// Checking that the files the job read are still current.
+	PhaseReadCheck = "read-check"
+
+	// Applying the file changes of the job on the master.
+	PhaseReplay = "replay"
+)
+
+// FailureReport describes why a job did not succeed.
+type FailureReport struct {
+	Phase string
+
+	// Address of the worker involved, if any.
+	Worker string
+	Error  string
+
+	// Every attempt to run the job, in order.  All but the last
+	// were retried.
+	Attempts []FailureAttempt
+
+	// Content the worker fetched from the master while the job
+	// ran, including fetches for concurrent jobs.
+	BytesFetched int64
+
+	// Files of the job that were replayed on the master before it
+	// failed.
+	FilesReplayed int
+
+	// Set if no worker has the labels the job requires; see
+	// NoMatchingWorkerError.
+	NoMatchingWorker bool
+}
+
+// FailureAttempt is the outcome of one attempt to run a job.
+type FailureAttempt struct {
+	Phase  string
+	Worker string
+	Error  string
+}
+
+func (me *FailureReport) String() string {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "failed in phase %s", me.Phase)
+	if me.Worker != "" {
+		fmt.Fprintf(b, " on %s", me.Worker)
+	}
+	fmt.Fprintf(b, "\n  error: %s\n", me.Error)
+	if len(me.Attempts) > 1 {
+		for i, a := range me.Attempts {
+			fmt.Fprintf(b, "  attempt %d: %s on %s: %s\n", i+1, a.Phase, a.Worker, a.Error)
+		}
+	}
+	fmt.Fprintf(b, "  bytes fetched: %d\n", me.BytesFetched)
+	fmt.Fprintf(b, "  files replayed: %d\n", me.FilesReplayed)
+	return b.String()
+}
+
+// A jobError is an error tagged with the phase of the job where it
+// happened.  Its message is that of the underlying error.
+type jobError struct {
+	phase  string
+	worker string
+	err    error
+
+	bytesFetched  int64
+	filesReplayed int
+}
+
+func (me *jobError) Error() string {
+	return me.err.Error()
+}
+
+// phaseError tags err with a phase, unless it has one already.
+func phaseError(phase string, worker string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*jobError); ok {
+		return err
+	}
+	return &jobError{phase: phase, worker: worker, err: err}
+}
+
+// mirrorAtFault returns false for errors of a job that say nothing
+// about the mirror it ran on.
+func mirrorAtFault(err error) bool {
+	switch errorCause(err).(type) {
+	case *attr.PathTooLongError, *StaleReadError:
+		return false
+	}
+	return errorCause(err) != errStdinNotReplayable
+}
+
+// errorCause returns the error underneath the phase tag.
+func errorCause(err error) error {
+	if e, ok := err.(*jobError); ok {
+		return e.err
+	}
+	return err
+}
+
+func failureAttempt(err error) FailureAttempt {
+	a := FailureAttempt{Phase: PhaseExec, Error: err.Error()}
+	if e, ok := err.(*jobError); ok {
+		a.Phase = e.phase
+		a.Worker = e.worker
+	}
+	return a
+}
+
+// newFailureReport describes a job that failed with err after the
+// given attempts, or one that exited with a non-zero status if err is
+// nil.
+func newFailureReport(err error, attempts []FailureAttempt, rep *WorkResponse) *FailureReport {
+	var last FailureAttempt
+	if err != nil {
+		last = failureAttempt(err)
+	} else {
+		last = FailureAttempt{
+			Phase:  PhaseExec,
+			Worker: rep.WorkerId,
+			Error:  exitMessage(rep.Exit),
+		}
+		if rep.TimedOut {
+			last.Error = "timed out, " + last.Error
+		}
+		if rep.ResourceExceeded != "" {
+			last.Error = fmt.Sprintf("exceeded %s limit, %s", rep.ResourceExceeded, last.Error)
+		}
+	}
+	r := &FailureReport{
+		Phase:    last.Phase,
+		Worker:   last.Worker,
+		Error:    last.Error,
+		Attempts: append(attempts, last),
+	}
+	if e, ok := err.(*jobError); ok {
+		r.BytesFetched = e.bytesFetched
+		r.FilesReplayed = e.filesReplayed
+	}
+	if _, ok := errorCause(err).(*NoMatchingWorkerError); ok {
+		r.NoMatchingWorker = true
+	}
+	return r
+}
+
+func exitMessage(status syscall.WaitStatus) string {
+	if status.Signaled() {
+		return fmt.Sprintf("killed by signal %v", status.Signal())
+	}
+	return fmt.Sprintf("exit status %d", status.ExitStatus())
+}
+
+// failureError turns a failure reported by a worker back into an
+// error.
+func failureError(f *FailureReport) error {
+	return &jobError{
+		phase:         f.Phase,
+		worker:        f.Worker,
+		err:           fmt.Errorf("%s", f.Error),
+		bytesFetched:  f.BytesFetched,
+		filesReplayed: f.FilesReplayed,
+	}
+}
@@ -0,0 +1,44 @@
+package termite
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestFailureReport(t *testing.T) {
+	first := phaseError(PhaseScheduling, "w1", fmt.Errorf("no workers"))
+	last := phaseError(PhaseExec, "w2", fmt.Errorf("connection reset"))
+	if again := phaseError(PhaseReplay, "w3", last); again != last {
+		t.Errorf("phaseError retagged %v", again)
+	}
+	last.(*jobError).filesReplayed = 3
+
+	r := newFailureReport(last, []FailureAttempt{failureAttempt(first)}, &WorkResponse{})
+	if r.Phase != PhaseExec || r.Worker != "w2" || r.Error != "connection reset" || r.FilesReplayed != 3 {
+		t.Errorf("got %#v", r)
+	}
+	if len(r.Attempts) != 2 || r.Attempts[0].Phase != PhaseScheduling || r.Attempts[1].Worker != "w2" {
+		t.Errorf("got attempts %v", r.Attempts)
+	}
+
+	e := failureError(r)
+	if got := failureAttempt(e); got != r.Attempts[1] {
+		t.Errorf("round trip: got %v, want %v", got, r.Attempts[1])
+	}
+
+	if r.NoMatchingWorker {
+		t.Errorf("NoMatchingWorker set for %v", r)
+	}
+	noMatch := phaseError(PhaseScheduling, "", &NoMatchingWorkerError{Labels: map[string]string{"arch": "arm64"}})
+	r = newFailureReport(noMatch, nil, &WorkResponse{})
+	if !r.NoMatchingWorker || r.Error != "no worker has labels arch=arm64" {
+		t.Errorf("got %#v", r)
+	}
+
+	rep := &WorkResponse{Exit: syscall.WaitStatus(2 << 8), WorkerId: "w4"}
+	r = newFailureReport(nil, nil, rep)
+	if r.Phase != PhaseExec || r.Worker != "w4" || r.Error != "exit status 2" {
+		t.Errorf("got %#v", r)
+	}
+}
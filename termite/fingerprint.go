@@ -0,0 +1,94 @@
+package termite
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+)
+
+// Tools that cache job results or record and replay builds need to
+// tell whether two requests are the same job.  Keying on Dir and Argv
+// alone is not enough: two compiles that differ only in an
+// environment variable expanded by the command, as in -DFOO=$BAR,
+// must not be taken for one another.  Fingerprint digests everything
+// that determines the outcome of a job, and leaves out variables that
+// differ between runs of the same build without changing what it
+// does.  The session manifest records it for each job, and affinity
+// scheduling remembers by it which mirror ran a job last.
+
+// Environment variables that Fingerprint ignores.
+var fingerprintIgnoredEnv = map[string]bool{
+	"TERM": true,
+}
+
+// Variables whose words Fingerprint scrubs with scrubMakeflags.
+var fingerprintMakeflags = map[string]bool{
+	"MAKEFLAGS": true,
+	"MFLAGS":    true,
+}
+
+// scrubMakeflags drops the jobserver file descriptors, which make
+// passes down to submakes and which change from run to run.
+func scrubMakeflags(v string) string {
+	var words []string
+	for _, w := range strings.Fields(v) {
+		if strings.HasPrefix(w, "--jobserver-fds=") || strings.HasPrefix(w, "--jobserver-auth=") {
+			continue
+		}
+		words = append(words, w)
+	}
+	return strings.Join(words, " ")
+}
+
+// fingerprintEnv returns the environment that Fingerprint digests,
+// sorted.
+func fingerprintEnv(env []string) []string {
+	var result []string
+	for _, kv := range env {
+		name := kv
+		if i := strings.Index(kv, "="); i >= 0 {
+			name = kv[:i]
+		}
+		if fingerprintIgnoredEnv[name] {
+			continue
+		}
+		if fingerprintMakeflags[name] {
+			kv = name + "=" + scrubMakeflags(kv[len(name)+1:])
+		}
+		result = append(result, kv)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Fingerprint returns a digest, in hex, that is equal for requests
+// of the same job: the binary and its hash, Argv, the environment
+// without ignored variables, Dir, and the content hashes of the
+// inputs, in any order.  Env must be resolved, rather than given by
+// EnvHandle.  Scheduling and reporting fields are left out.
+func (me *WorkRequest) Fingerprint(inputHashes []string) string {
+	h := sha256.New()
+	writeFingerprintStrings(h, []string{me.Binary, me.BinaryHash})
+	writeFingerprintStrings(h, me.Argv)
+	writeFingerprintStrings(h, fingerprintEnv(me.Env))
+	writeFingerprintStrings(h, []string{me.Dir})
+
+	inputs := append([]string(nil), inputHashes...)
+	sort.Strings(inputs)
+	writeFingerprintStrings(h, inputs)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// writeFingerprintStrings writes a list with its length, and strings
+// with theirs, so no two lists digest alike.
+func writeFingerprintStrings(h hash.Hash, list []string) {
+	var buf [binary.MaxVarintLen64]byte
+	h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(list)))])
+	for _, s := range list {
+		h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(s)))])
+		h.Write([]byte(s))
+	}
+}
@@ -0,0 +1,58 @@
+package termite
+
+import (
+	"testing"
+)
+
+func fingerprintTestRequest() *WorkRequest {
+	return &WorkRequest{
+		Binary:     "/usr/bin/gcc",
+		BinaryHash: "\x01\x02",
+		Argv:       []string{"gcc", "-c", "-DFOO=bar", "a.c"},
+		Env:        []string{"PATH=/bin", "LANG=C", "TERM=xterm", "MAKEFLAGS=k --jobserver-auth=3,4"},
+		Dir:        "/src",
+		TaskId:     1,
+		Debug:      true,
+	}
+}
+
+func TestFingerprintStable(t *testing.T) {
+	req := fingerprintTestRequest()
+	want := req.Fingerprint([]string{"h1", "h2"})
+
+	same := fingerprintTestRequest()
+	same.Env = []string{"MAKEFLAGS=k --jobserver-fds=5,6", "LANG=C", "PATH=/bin", "TERM=dumb"}
+	same.TaskId = 2
+	same.Debug = false
+	same.RequireWorker = "w:1"
+	if got := same.Fingerprint([]string{"h2", "h1"}); got != want {
+		t.Errorf("reordered request: got %s, want %s", got, want)
+	}
+}
+
+func TestFingerprintDiffers(t *testing.T) {
+	want := fingerprintTestRequest().Fingerprint([]string{"h1"})
+	for name, change := range map[string]func(*WorkRequest){
+		"env":       func(r *WorkRequest) { r.Env[1] = "LANG=de_DE" },
+		"makeflags": func(r *WorkRequest) { r.Env[3] = "MAKEFLAGS=ki --jobserver-auth=3,4" },
+		"argv":      func(r *WorkRequest) { r.Argv[2] = "-DFOO=baz" },
+		"split":     func(r *WorkRequest) { r.Argv = []string{"gcc", "-c -DFOO=bar", "a.c"} },
+		"dir":       func(r *WorkRequest) { r.Dir = "/src/sub" },
+		"binary":    func(r *WorkRequest) { r.BinaryHash = "\x01\x03" },
+	} {
+		req := fingerprintTestRequest()
+		change(req)
+		if got := req.Fingerprint([]string{"h1"}); got == want {
+			t.Errorf("%s: change not in fingerprint", name)
+		}
+	}
+	if got := fingerprintTestRequest().Fingerprint([]string{"h2"}); got == want {
+		t.Errorf("inputs: change not in fingerprint")
+	}
+}
+
+func TestScrubMakeflags(t *testing.T) {
+	if got := scrubMakeflags("ks -j8 --jobserver-fds=3,4 --jobserver-auth=fifo:/tmp/x -- V=1"); got != "ks -j8 -- V=1" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,165 @@
+package termite
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// Without TLS, the shared-secret handshake authenticates the peer,
+// but not the bytes that follow, so anyone on the path can inject or
+// change data once it is done.  Peers that both offer it wrap such
+// connections in frames carrying an HMAC-SHA256 of their content.
+// Each direction has its own key, derived from the secret and the
+// challenges of both sides, and frames are numbered, so frames cannot
+// be replayed from another connection, nor reordered or dropped
+// within one.  A frame that fails verification ends the connection.
+//
+// A peer offers framing by starting its challenge with frameOffer.
+// Older peers take that for random bytes, and connections with them
+// stay unframed.
+
+var frameOffer = []byte("TMH\x01")
+
+// Largest payload of a frame.
+const _MAX_FRAME = 32 << 10
+
+// newChallenge returns a challenge for the handshake, which offers
+// framing if offer is set.
+func newChallenge(offer bool) ([]byte, error) {
+	challenge, err := RandomBytes(challengeLength)
+	if err != nil {
+		return nil, err
+	}
+	if offer {
+		copy(challenge, frameOffer)
+	}
+	return challenge, nil
+}
+
+// offersFrames returns whether the peer that sent challenge offers
+// framing.
+func offersFrames(challenge []byte) bool {
+	return len(challenge) == challengeLength && bytes.HasPrefix(challenge, frameOffer)
+}
+
+// frameKey returns the key for frames from the side that sent the
+// challenge from.
+func frameKey(secret, from, to []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	io.WriteString(h, "termite frames")
+	h.Write(from)
+	h.Write(to)
+	return h.Sum(nil)
+}
+
+// frameMAC returns the MAC of the frame with number seq.
+func frameMAC(key []byte, seq uint64, payload []byte) []byte {
+	var header [12]byte
+	binary.BigEndian.PutUint64(header[:8], seq)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(payload)))
+	h := hmac.New(sha256.New, key)
+	h.Write(header[:])
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// frameConn sends and receives authenticated frames over a
+// connection.
+type frameConn struct {
+	net.Conn
+
+	writeMutex sync.Mutex
+	writeKey   []byte
+	writeSeq   uint64
+
+	readMutex sync.Mutex
+	readKey   []byte
+	readSeq   uint64
+
+	// Verified payload not returned yet.
+	pending []byte
+	readErr error
+}
+
+// newFrameConn frames conn, after a handshake in which we sent the
+// challenge ours, and the peer sent theirs.
+func newFrameConn(conn net.Conn, secret, ours, theirs []byte) *frameConn {
+	return &frameConn{
+		Conn:     conn,
+		writeKey: frameKey(secret, ours, theirs),
+		readKey:  frameKey(secret, theirs, ours),
+	}
+}
+
+func (me *frameConn) Write(p []byte) (int, error) {
+	me.writeMutex.Lock()
+	defer me.writeMutex.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > _MAX_FRAME {
+			chunk = chunk[:_MAX_FRAME]
+		}
+		frame := make([]byte, 4, 4+len(chunk)+sha256.Size)
+		binary.BigEndian.PutUint32(frame, uint32(len(chunk)))
+		frame = append(frame, chunk...)
+		frame = append(frame, frameMAC(me.writeKey, me.writeSeq, chunk)...)
+		if _, err := me.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		me.writeSeq++
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (me *frameConn) Read(p []byte) (int, error) {
+	me.readMutex.Lock()
+	defer me.readMutex.Unlock()
+	for len(me.pending) == 0 {
+		if me.readErr != nil {
+			return 0, me.readErr
+		}
+		me.pending, me.readErr = me.readFrame()
+	}
+	n := copy(p, me.pending)
+	me.pending = me.pending[n:]
+	return n, nil
+}
+
+// readFrame reads and verifies the next frame.  Must hold readMutex.
+func (me *frameConn) readFrame() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(me.Conn, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n == 0 || n > _MAX_FRAME {
+		me.Conn.Close()
+		return nil, fmt.Errorf("frame from %v has bad length %d", me.RemoteAddr(), n)
+	}
+	buf := make([]byte, int(n)+sha256.Size)
+	if _, err := io.ReadFull(me.Conn, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	payload, mac := buf[:n], buf[n:]
+	if !hmac.Equal(mac, frameMAC(me.readKey, me.readSeq, payload)) {
+		log.Println("Frame failed verification, closing connection from", me.RemoteAddr())
+		me.Conn.Close()
+		return nil, fmt.Errorf("frame %d from %v failed verification", me.readSeq, me.RemoteAddr())
+	}
+	me.readSeq++
+	return payload, nil
+}
@@ -0,0 +1,141 @@
+package termite
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// authenticatePair runs the handshake over a TCP connection, with
+// each side offering framing or not.
+func authenticatePair(t *testing.T, secret []byte, offerA, offerB bool) (net.Conn, net.Conn) {
+	a, b, err := netPair()
+	if err != nil {
+		t.Fatalf("netPair: %v", err)
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	out := make(chan result, 1)
+	go func() {
+		c, err := authenticate(b, secret, nil, offerB)
+		out <- result{c, err}
+	}()
+	ca, err := authenticate(a, secret, nil, offerA)
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	r := <-out
+	if r.err != nil {
+		t.Fatalf("authenticate: %v", r.err)
+	}
+	return ca, r.conn
+}
+
+func TestFramesNegotiation(t *testing.T) {
+	secret := testSecret(t)
+	for _, c := range []struct {
+		a, b, framed bool
+	}{{true, true, true}, {true, false, false}, {false, true, false}} {
+		ca, cb := authenticatePair(t, secret, c.a, c.b)
+		_, framedA := ca.(*frameConn)
+		_, framedB := cb.(*frameConn)
+		if framedA != c.framed || framedB != c.framed {
+			t.Errorf("offers %v, %v: got framed %v, %v, want %v", c.a, c.b, framedA, framedB, c.framed)
+		}
+		ca.Close()
+		cb.Close()
+	}
+}
+
+func TestFramesRoundTrip(t *testing.T) {
+	ca, cb := authenticatePair(t, testSecret(t), true, true)
+	defer ca.Close()
+	defer cb.Close()
+
+	want := bytes.Repeat([]byte("termite"), _MAX_FRAME/3)
+	go ca.Write(want)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(cb, got); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("payload changed in transit")
+	}
+}
+
+// framePair returns framed connections that talk through the raw
+// connections given back too, as a man in the middle would.
+func framePair(secret []byte) (sender, receiver *frameConn, senderRaw, receiverRaw net.Conn) {
+	ours := bytes.Repeat([]byte{1}, challengeLength)
+	theirs := bytes.Repeat([]byte{2}, challengeLength)
+	a, a2 := net.Pipe()
+	b, b2 := net.Pipe()
+	return newFrameConn(a, secret, ours, theirs), newFrameConn(b, secret, theirs, ours), a2, b2
+}
+
+// frameBytes returns what sender puts on the wire for payload.
+func frameBytes(sender *frameConn, senderRaw net.Conn, payload string) []byte {
+	go io.WriteString(sender, payload)
+	frame := make([]byte, 4+len(payload)+32)
+	io.ReadFull(senderRaw, frame)
+	return frame
+}
+
+func TestFramesTampered(t *testing.T) {
+	sender, receiver, senderRaw, receiverRaw := framePair(testSecret(t))
+	defer receiver.Close()
+
+	frame := frameBytes(sender, senderRaw, "hello")
+	frame[5] ^= 1
+	go receiverRaw.Write(frame)
+	if _, err := receiver.Read(make([]byte, 10)); err == nil || !strings.Contains(err.Error(), "verification") {
+		t.Errorf("tampered frame: got %v", err)
+	}
+}
+
+func TestFramesReplayed(t *testing.T) {
+	sender, receiver, senderRaw, receiverRaw := framePair(testSecret(t))
+	defer receiver.Close()
+
+	frame := frameBytes(sender, senderRaw, "hello")
+	go func() {
+		receiverRaw.Write(frame)
+		receiverRaw.Write(frame)
+	}()
+	buf := make([]byte, 10)
+	if n, err := receiver.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("first frame: got %q, %v", buf[:n], err)
+	}
+	if _, err := receiver.Read(buf); err == nil {
+		t.Errorf("replayed frame was accepted")
+	}
+}
+
+func TestFramesTypedConnection(t *testing.T) {
+	secret := testSecret(t)
+	l := AuthenticatedListener(0, secret, 0, nil)
+	defer l.Close()
+	out := make(chan string, 2)
+	go serveTyped(l, out)
+
+	addr := strings.Replace(l.Addr().String(), "[::]", "127.0.0.1", 1)
+	conn, err := DialTypedConnection(addr, RPC_CHANNEL, secret, nil)
+	if err != nil {
+		t.Fatalf("DialTypedConnection: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*frameConn); !ok {
+		t.Errorf("got %T, want *frameConn", conn)
+	}
+	io.WriteString(conn, "hello")
+	if got := <-out; got != "plaintext" {
+		t.Errorf("got %q, want plaintext", got)
+	}
+	if got := <-out; got != "hello" {
+		t.Errorf("got %q, want hello", got)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 
@@ -117,37 +118,17 @@ func newRpcFsTestCase(t *testing.T) (me *rpcFsTestCase) {
 		})
 	me.attr.Paranoia = true
 	me.server = attr.NewServer(me.attr)
+	me.serve()
 
-	
-	var err error
-	me.sockL, me.sockR, err = netPair()
-	if err != nil {
-		t.Fatal(err)
-	}
-	me.contentL, me.contentR, err = netPair()
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	rpcServer := rpc.NewServer()
-	rpcServer.Register(me.server)
-	go func() {
-		rpcServer.ServeConn(me.sockL)
-		me.sockL.Close()
-	}()
-	go func() {
-		me.serverStore.ServeConn(me.contentL)
-		me.contentL.Close()
-	}()
-	
 	cOpts := cba.StoreOptions{
 		Dir: me.tmp + "/client-cache",
 	}
 	me.clientStore = cba.NewStore(&cOpts)
 	attrClient := attr.NewClient(me.sockR, "id")
-	me.rpcFs = NewRpcFs(attrClient, me.clientStore, me.contentR)
+	me.rpcFs = NewRpcFs(attrClient, me.clientStore, me.contentR, nil)
 	me.rpcFs.id = "rpcfs_test"
 	nfs := pathfs.NewPathNodeFs(me.rpcFs, nil)
+	var err error
 	me.state, _, err = nodefs.MountFileSystem(me.mnt, nfs, nil)
 	me.state.SetDebug(fuse.VerboseTest())
 	if err != nil {
@@ -158,6 +139,31 @@ func newRpcFsTestCase(t *testing.T) (me *rpcFsTestCase) {
 	return me
 }
 
+// serve sets up the connections for attributes and content, and
+// serves them.
+func (me *rpcFsTestCase) serve() {
+	var err error
+	me.sockL, me.sockR, err = netPair()
+	if err != nil {
+		me.tester.Fatal(err)
+	}
+	me.contentL, me.contentR, err = netPair()
+	if err != nil {
+		me.tester.Fatal(err)
+	}
+
+	rpcServer := rpc.NewServer()
+	rpcServer.Register(me.server)
+	go func(conn io.ReadWriteCloser) {
+		rpcServer.ServeConn(conn)
+		conn.Close()
+	}(me.sockL)
+	go func(conn io.ReadWriteCloser) {
+		me.serverStore.ServeConn(conn)
+		conn.Close()
+	}(me.contentL)
+}
+
 func (me *rpcFsTestCase) Clean() {
 	if err := me.state.Unmount(); err != nil {
 		log.Panic("fuse unmount failed.", err)
@@ -293,6 +299,24 @@ func TestRpcFsFetchOnce(t *testing.T) {
 	}
 }
 
+func TestRpcFsCorruptBlob(t *testing.T) {
+	me := newRpcFsTestCase(t)
+	defer me.Clean()
+	check(ioutil.WriteFile(me.orig+"/file.txt", []byte("hello"), 0644))
+	me.attr.Refresh("")
+
+	// The worker's copy was damaged on disk.  Has does not notice,
+	// but Open does, and fetches it again.
+	p := me.clientStore.Path(md5str("hello"))
+	check(os.MkdirAll(filepath.Dir(p), 0755))
+	check(ioutil.WriteFile(p, []byte("hellO"), 0444))
+
+	c, err := ioutil.ReadFile(me.mnt + "/file.txt")
+	if err != nil || string(c) != "hello" {
+		t.Errorf("Readfile: want 'hello', got '%s', err %v", c, err)
+	}
+}
+
 func TestFsServerCache(t *testing.T) {
 	me := newRpcFsTestCase(t)
 	defer me.Clean()
@@ -328,3 +352,359 @@ func TestFsServerCache(t *testing.T) {
 		t.Errorf("after rename: entry for %q unexpected", name)
 	}
 }
+
+func TestRpcFsWriteBack(t *testing.T) {
+	me := newRpcFsTestCase(t)
+	defer me.Clean()
+
+	os.Mkdir(me.orig+"/scratch", 0755)
+	check(ioutil.WriteFile(me.orig+"/scratch/old.txt", []byte("old"), 0644))
+	check(ioutil.WriteFile(me.orig+"/file.txt", []byte("file"), 0644))
+	backing := me.tmp + "/scratch-backing"
+	check(os.Mkdir(backing, 0700))
+	wb := newWriteBackFs(me.rpcFs, "/scratch", backing)
+	ctx := &fuse.Context{Owner: fuse.Owner{Uid: 42, Gid: 43}}
+
+	if _, code := wb.Open("file.txt", uint32(os.O_WRONLY), ctx); code.Ok() {
+		t.Errorf("writing outside the scratch root should fail")
+	}
+	if _, code := wb.Create("scratch/nodir/new.txt", uint32(os.O_WRONLY), 0644, ctx); code.Ok() {
+		t.Errorf("create in nonexistent directory should fail")
+	}
+
+	f, code := wb.Create("scratch/new.txt", uint32(os.O_WRONLY), 0644, ctx)
+	if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	if _, code := f.Write([]byte("hello"), 0); !code.Ok() {
+		t.Fatalf("Write: %v", code)
+	}
+
+	// Reads see the content before the writer closes.
+	readAll := func(name string) string {
+		r, code := wb.Open(name, uint32(os.O_RDONLY), ctx)
+		if !code.Ok() {
+			t.Fatalf("Open %s: %v", name, code)
+		}
+		defer r.Release()
+		buf := make([]byte, 100)
+		res, code := r.Read(buf, 0)
+		if !code.Ok() {
+			t.Fatalf("Read %s: %v", name, code)
+		}
+		data, _ := res.Bytes(buf)
+		return string(data)
+	}
+	if got := readAll("scratch/new.txt"); got != "hello" {
+		t.Errorf("read while open: got %q", got)
+	}
+	f.Release()
+
+	a, code := wb.GetAttr("scratch/new.txt", ctx)
+	if !code.Ok() || a.Size != 5 || a.Uid != 42 || !a.IsRegular() {
+		t.Errorf("GetAttr: got %v, %v", a, code)
+	}
+
+	// Existing files are copied before writing.
+	f, code = wb.Open("scratch/old.txt", uint32(os.O_RDWR), ctx)
+	if !code.Ok() {
+		t.Fatalf("Open for writing: %v", code)
+	}
+	f.Write([]byte("er"), 3)
+	f.Release()
+	if got := readAll("scratch/old.txt"); got != "older" {
+		t.Errorf("read after write: got %q", got)
+	}
+
+	entries, code := wb.OpenDir("scratch", ctx)
+	names := map[string]bool{}
+	for _, e := range entries {
+		names[e.Name] = true
+	}
+	if !code.Ok() || len(entries) != 2 || !names["new.txt"] || !names["old.txt"] {
+		t.Errorf("OpenDir: got %v, %v", entries, code)
+	}
+
+	files := wb.reap()
+	if len(files) != 2 {
+		t.Fatalf("reap: got %v", files)
+	}
+	for _, f := range files {
+		want := map[string]string{
+			"scratch/new.txt": "hello",
+			"scratch/old.txt": "older",
+		}[f.Path]
+		if f.Hash != md5str(want) || !me.clientStore.Has(f.Hash) {
+			t.Errorf("reaped %s: hash %x, want content %q", f.Path, f.Hash, want)
+		}
+	}
+	if _, code := wb.GetAttr("scratch/new.txt", ctx); code.Ok() {
+		t.Errorf("reaped file should be gone")
+	}
+	if left, _ := ioutil.ReadDir(backing); len(left) != 0 {
+		t.Errorf("backing files left: %v", left)
+	}
+}
+
+func TestRpcFsNegativeUpdate(t *testing.T) {
+	me := newRpcFsTestCase(t)
+	defer me.Clean()
+	me.rpcFs.attr.NegativeTTL = time.Hour
+
+	os.Mkdir(me.orig+"/include", 0755)
+	for _, n := range []string{"a.h", "b.h", "c.h"} {
+		check(ioutil.WriteFile(me.orig+"/include/"+n, []byte(n), 0644))
+	}
+	me.attr.Get("include/c.h")
+
+	if _, code := me.rpcFs.GetAttr("include/a.h", nil); !code.Ok() {
+		t.Fatalf("GetAttr a.h: %v", code)
+	}
+	// The master had c.h cached, and sent it along with a.h.
+	if !me.rpcFs.attr.Have("include/c.h") {
+		t.Errorf("sibling c.h was not sent")
+	}
+	if me.rpcFs.attr.Have("include/b.h") {
+		t.Errorf("b.h was not cached on the master, so it should not be sent")
+	}
+
+	before := me.rpcFs.attr.Stats()
+	for i := 0; i < 3; i++ {
+		if _, code := me.rpcFs.GetAttr("include/new.h", nil); code != fuse.ENOENT {
+			t.Fatalf("GetAttr new.h: got %v, want ENOENT", code)
+		}
+		me.rpcFs.GetAttr("include/c.h", nil)
+	}
+	after := me.rpcFs.attr.Stats()
+	if after.Fetches != before.Fetches {
+		t.Errorf("lookups went to the master: %d fetches, want %d", after.Fetches, before.Fetches)
+	}
+	if after.NegativeHits-before.NegativeHits != 3 || after.Hits-before.Hits < 3 {
+		t.Errorf("got stats %+v, before %+v", after, before)
+	}
+
+	// The build creates the file.
+	check(ioutil.WriteFile(me.orig+"/include/new.h", []byte("new"), 0644))
+	fset := me.attr.Refresh("")
+	me.rpcFs.updateFiles(fset.Files)
+
+	a, code := me.rpcFs.GetAttr("include/new.h", nil)
+	if !code.Ok() || a.Size != 3 {
+		t.Errorf("after creation: got %v, %v", a, code)
+	}
+
+	// GetAttr fetches content in the background; finish before
+	// the stores are removed.
+	for _, n := range []string{"include/a.h", "include/c.h", "include/new.h"} {
+		check(me.rpcFs.FetchHash(me.rpcFs.attr.Get(n)))
+	}
+}
+
+func TestRpcFsPagedDir(t *testing.T) {
+	me := newRpcFsTestCase(t)
+	defer me.Clean()
+	me.attr.PageThreshold = 2
+
+	os.Mkdir(me.orig+"/big", 0755)
+	for _, n := range []string{"a", "b", "c", "d"} {
+		check(ioutil.WriteFile(me.orig+"/big/"+n, []byte(n), 0644))
+	}
+
+	entries, code := me.rpcFs.OpenDir("big", nil)
+	if !code.Ok() || len(entries) != 4 {
+		t.Fatalf("OpenDir: got %v, %v", entries, code)
+	}
+	if a := me.rpcFs.attr.GetDir("big"); !a.Paged() {
+		t.Errorf("directory not paged on the worker: %v", a)
+	}
+	if _, _, ok := me.rpcFs.attr.Page("big", 0); !ok {
+		t.Errorf("page was not cached")
+	}
+
+	// The master learns about a new file, and tells the worker
+	// about it, but not the new listing.
+	check(ioutil.WriteFile(me.orig+"/big/e", []byte("e"), 0644))
+	e := me.getattr("big/e")
+	e.Path = "big/e"
+	me.attr.Update([]*attr.FileAttr{e})
+	me.rpcFs.updateFiles([]*attr.FileAttr{e})
+
+	entries, code = me.rpcFs.OpenDir("big", nil)
+	if !code.Ok() || len(entries) != 5 {
+		t.Errorf("OpenDir after update: got %v, %v", entries, code)
+	}
+}
+
+func TestRpcFsReadlink(t *testing.T) {
+	me := newRpcFsTestCase(t)
+	defer me.Clean()
+
+	check(os.Symlink("target", me.orig+"/link"))
+	check(ioutil.WriteFile(me.orig+"/file", []byte("file"), 0644))
+
+	if l, code := me.rpcFs.Readlink("link", nil); !code.Ok() || l != "target" {
+		t.Errorf("Readlink: got %q, %v", l, code)
+	}
+	if _, code := me.rpcFs.Readlink("file", nil); code != fuse.EINVAL {
+		t.Errorf("Readlink on file: got %v, want EINVAL", code)
+	}
+
+	// The worker only gets a bare attribute for the new link.
+	check(os.Remove(me.orig + "/link"))
+	check(os.Symlink("other", me.orig+"/link"))
+	fset := me.attr.Refresh("")
+	me.rpcFs.updateFiles(fset.Files)
+	bare := me.rpcFs.attr.Get("link")
+	bare.Link = ""
+	me.rpcFs.updateFiles([]*attr.FileAttr{bare})
+
+	if l, code := me.rpcFs.Readlink("link", nil); !code.Ok() || l != "other" {
+		t.Errorf("Readlink after update: got %q, %v", l, code)
+	}
+	if l, ok := me.rpcFs.attr.Link("link"); !ok || l != "other" {
+		t.Errorf("target not cached: %q, %v", l, ok)
+	}
+	me.rpcFs.FetchHash(me.rpcFs.attr.Get("file"))
+}
+
+func TestRpcFsReconnect(t *testing.T) {
+	me := newRpcFsTestCase(t)
+	defer me.Clean()
+	check(ioutil.WriteFile(me.orig+"/a", []byte("a"), 0644))
+	check(ioutil.WriteFile(me.orig+"/b", []byte("b"), 0644))
+
+	if state := me.rpcFs.checkReverse(time.Second); state != ReverseUp {
+		t.Fatalf("check: got %v, want up", state)
+	}
+
+	// The master side goes away.
+	me.sockL.Close()
+	me.contentL.Close()
+	if state := me.rpcFs.checkReverse(time.Second); state != ReverseDown {
+		t.Fatalf("check after break: got %v, want down", state)
+	}
+
+	// Lookups wait for the master to reconnect.
+	done := make(chan fuse.Status, 1)
+	go func() {
+		_, code := me.rpcFs.GetAttr("a", nil)
+		done <- code
+	}()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case code := <-done:
+		t.Fatalf("GetAttr did not wait: %v", code)
+	default:
+	}
+
+	me.rpcFs.reverse.startReconnect()
+	me.serve()
+	me.rpcFs.reconnect(me.sockR, me.contentR)
+	if code := <-done; !code.Ok() {
+		t.Errorf("GetAttr after reconnect: %v", code)
+	}
+	if state, n := me.rpcFs.reverse.State(), me.rpcFs.reverse.Reconnects(); state != ReverseUp || n != 1 {
+		t.Errorf("got state %v, %d reconnects; want up, 1", state, n)
+	}
+
+	// A call that finds the connection broken tries again after
+	// the reconnect.
+	me.sockL.Close()
+	me.contentL.Close()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		me.rpcFs.reverse.startReconnect()
+		me.serve()
+		me.rpcFs.reconnect(me.sockR, me.contentR)
+	}()
+	if _, code := me.rpcFs.GetAttr("b", nil); !code.Ok() {
+		t.Errorf("GetAttr across reconnect: %v", code)
+	}
+	for _, n := range []string{"a", "b"} {
+		check(me.rpcFs.FetchHash(me.rpcFs.attr.Get(n)))
+	}
+}
+
+func TestRpcFsExpandDir(t *testing.T) {
+	me := newRpcFsTestCase(t)
+	defer me.Clean()
+
+	os.Mkdir(me.orig+"/dir", 0755)
+	for _, n := range []string{"a", "b", "c"} {
+		check(os.Symlink("target", me.orig+"/dir/"+n))
+	}
+	// The master only sends the attributes it has.
+	for _, n := range []string{"a", "b", "c"} {
+		me.attr.Get("dir/" + n)
+	}
+
+	if _, code := me.rpcFs.OpenDir("dir", nil); !code.Ok() {
+		t.Fatalf("OpenDir: %v", code)
+	}
+	before := me.rpcFs.attr.Stats()
+	for _, n := range []string{"a", "b", "c"} {
+		if a, code := me.rpcFs.GetAttr("dir/"+n, nil); !code.Ok() || a.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			t.Errorf("GetAttr %s: %v, %v", n, a, code)
+		}
+	}
+	if after := me.rpcFs.attr.Stats(); after.Fetches != before.Fetches {
+		t.Errorf("GetAttr after OpenDir fetched %d attributes", after.Fetches-before.Fetches)
+	}
+}
+
+func TestRpcFsSaveLocal(t *testing.T) {
+	me := newRpcFsTestCase(t)
+	defer me.Clean()
+
+	local := me.tmp + "/local"
+	check(os.Mkdir(local, 0755))
+	check(os.Mkdir(local+"/skip", 0755))
+	me.rpcFs.localPrefixes = LocalPrefixes{local, "-" + local + "/skip"}
+
+	fileAttr := func(p string) *attr.FileAttr {
+		return &attr.FileAttr{
+			Path: p[1:],
+			Attr: StatForTest(t, p),
+			Hash: me.serverStore.SavePath(p),
+		}
+	}
+
+	check(ioutil.WriteFile(local+"/file", []byte("hello"), 0644))
+	a := fileAttr(local + "/file")
+	if !me.rpcFs.considerSaveLocal(a) || !me.clientStore.Has(a.Hash) {
+		t.Errorf("local file not saved")
+	}
+
+	check(ioutil.WriteFile(local+"/skip/file", []byte("skip"), 0644))
+	if me.rpcFs.considerSaveLocal(fileAttr(local + "/skip/file")) {
+		t.Errorf("saved file below excluded prefix")
+	}
+
+	// The worker's copy differs from the master's.
+	check(ioutil.WriteFile(local+"/changed", []byte("before"), 0644))
+	a = fileAttr(local + "/changed")
+	check(ioutil.WriteFile(local+"/changed", []byte("after!"), 0644))
+	check(os.Chtimes(local+"/changed", time.Now(), time.Now().Add(time.Hour)))
+	if me.rpcFs.considerSaveLocal(a) {
+		t.Errorf("saved file that changed")
+	}
+}
+
+func TestStatFs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "term-statfs")
+	defer os.RemoveAll(dir)
+
+	fs := &RpcFs{tempDir: dir}
+	out := fs.StatFs("")
+	if out == nil {
+		t.Fatal("StatFs returned nil")
+	}
+	var s syscall.Statfs_t
+	syscall.Statfs(dir, &s)
+	if out.Blocks != s.Blocks || out.Bsize != uint32(s.Bsize) || out.Frsize == 0 {
+		t.Errorf("got %+v, want %+v", out, s)
+	}
+	if out.Bavail > out.Blocks {
+		t.Errorf("more blocks available than there are: %+v", out)
+	}
+}
@@ -3,6 +3,7 @@ package termite
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -22,12 +23,20 @@ type workerFuseFs struct {
 	tmpDir string
 	mount  string
 
+	// Backs /tmp and /var/tmp.
+	tmpBacking string
+	options    nodefs.Options
+
+	// Backs files written below the scratch root.
+	scratchBacking string
+
 	// without leading /
 	writableRoot string
 	*fuse.Server
 	fsConnector *nodefs.FileSystemConnector
 	unionFs     *fs.MemUnionFs
 	procFs      *fs.ProcFs
+	scratch     *writeBackFs
 	rpcNodeFs   *pathfs.PathNodeFs
 	unionNodeFs *pathfs.PathNodeFs
 
@@ -35,11 +44,28 @@ type workerFuseFs struct {
 	id      string
 	reaping bool
 
+	// If set, no other tasks may join the file system until it
+	// is reaped.
+	private bool
+
+	// Set if a task timed out.  Processes of the task may still
+	// hold on to the file system, so it is stopped rather than
+	// reused once its tasks are done.
+	retired bool
+
+	// Set by resetTmp if a temporary directory could not be
+	// mounted again.  The file system is retired when returned.
+	// Only accessed by the goroutine that reaps.
+	tmpBroken bool
+
 	// When this reaches zero, we reap the filesystem.
 	tasks map[*WorkerTask]bool
 
 	// Task ids that have results pending in this FS.
 	taskIds []int
+
+	// Files read from the master since the FS was prepared.
+	reads *readSet
 }
 
 func (me *workerFuseFs) Status() (s FuseFsStatus) {
@@ -56,11 +82,28 @@ func (me *workerFuseFs) addTask(task *WorkerTask) {
 	me.tasks[task] = true
 }
 
+// Unmount attempts in Stop.  Between attempts, we kill processes
+// that keep the file system busy.
+const (
+	_UNMOUNT_TRIES       = 10
+	_UNMOUNT_RETRY_DELAY = 100 * time.Millisecond
+)
+
+// Stop kills the processes that use the file system, and unmounts it.
 func (me *workerFuseFs) Stop() {
-	if err := me.Server.Unmount(); err != nil {
-		// If the unmount fails, the RemoveAll will stat all
-		// of the FUSE file system, so we have to exit.
-		log.Panic("unmount fail in workerFuseFs.Stop:", err)
+	var err error
+	for i := 0; i < _UNMOUNT_TRIES; i++ {
+		killProcesses(leftoverProcesses(0, me.mount))
+		if err = me.Server.Unmount(); err == nil {
+			break
+		}
+		time.Sleep(_UNMOUNT_RETRY_DELAY)
+	}
+	if err != nil {
+		// RemoveAll would stat all of the FUSE file system,
+		// which is still served, so leave it alone.
+		log.Printf("unmount of %s failed, leaving %s: %v", me.mount, me.tmpDir, err)
+		return
 	}
 
 	os.RemoveAll(me.tmpDir)
@@ -72,7 +115,7 @@ func (me *workerFuseFs) SetDebug(debug bool) {
 	me.rpcNodeFs.SetDebug(debug)
 }
 
-func newWorkerFuseFs(tmpDir string, rpcFs pathfs.FileSystem, writableRoot string, nobody *User) (*workerFuseFs, error) {
+func newWorkerFuseFs(tmpDir string, rpcFs *RpcFs, writableRoot, scratchRoot string, nobody *User, procFiles []string) (*workerFuseFs, error) {
 	tmpDir, err := ioutil.TempDir(tmpDir, "termite-task")
 	if err != nil {
 		return nil, err
@@ -81,6 +124,7 @@ func newWorkerFuseFs(tmpDir string, rpcFs pathfs.FileSystem, writableRoot string
 		tmpDir:       tmpDir,
 		writableRoot: strings.TrimLeft(writableRoot, "/"),
 		tasks:        map[*WorkerTask]bool{},
+		reads:        newReadSet(),
 	}
 
 	type dirInit struct {
@@ -88,11 +132,11 @@ func newWorkerFuseFs(tmpDir string, rpcFs pathfs.FileSystem, writableRoot string
 		val string
 	}
 
-	tmpBacking := ""
 	for _, v := range []dirInit{
 		{&me.rwDir, "rw"},
 		{&me.mount, "mnt"},
-		{&tmpBacking, "tmp-backing"},
+		{&me.tmpBacking, "tmp-backing"},
+		{&me.scratchBacking, "scratch-backing"},
 	} {
 		*v.dst = filepath.Join(me.tmpDir, v.val)
 		err = os.Mkdir(*v.dst, 0700)
@@ -106,9 +150,14 @@ func newWorkerFuseFs(tmpDir string, rpcFs pathfs.FileSystem, writableRoot string
 		fuseOpts.AllowOther = true
 	}
 
-	me.rpcNodeFs = pathfs.NewPathNodeFs(rpcFs, nil)
+	var rootFs pathfs.FileSystem = rpcFs
+	if scratchRoot != "" {
+		me.scratch = newWriteBackFs(rpcFs, scratchRoot, me.scratchBacking)
+		rootFs = me.scratch
+	}
+	me.rpcNodeFs = pathfs.NewPathNodeFs(&readRecorder{rootFs, me.reads}, nil)
 	ttl := 30 * time.Second
-	mOpts := nodefs.Options{
+	me.options = nodefs.Options{
 		EntryTimeout:    ttl,
 		AttrTimeout:     ttl,
 		NegativeTimeout: ttl,
@@ -117,6 +166,7 @@ func newWorkerFuseFs(tmpDir string, rpcFs pathfs.FileSystem, writableRoot string
 		// numbers.
 		PortableInodes: true,
 	}
+	mOpts := me.options
 
 	me.fsConnector = nodefs.NewFileSystemConnector(me.rpcNodeFs, &mOpts)
 	me.Server, err = fuse.NewServer(me.fsConnector.RawFS(), me.mount, &fuseOpts)
@@ -126,13 +176,16 @@ func newWorkerFuseFs(tmpDir string, rpcFs pathfs.FileSystem, writableRoot string
 	go me.Server.Serve()
 
 	me.unionFs, err = fs.NewMemUnionFs(
-		me.rwDir, pathfs.NewPrefixFileSystem(rpcFs, me.writableRoot))
+		me.rwDir, pathfs.NewPrefixFileSystem(&readRecorder{rpcFs, me.reads}, me.writableRoot))
 	if err != nil {
 		return nil, err
 	}
 
 	me.procFs = fs.NewProcFs()
 	me.procFs.StripPrefix = me.mount
+	if procFiles != nil {
+		me.procFs.SetAllowedRootFiles(procFiles)
+	}
 	if nobody != nil {
 		me.procFs.Uid = nobody.Uid
 	}
@@ -144,9 +197,10 @@ func newWorkerFuseFs(tmpDir string, rpcFs pathfs.FileSystem, writableRoot string
 	mounts := []submount{
 		{"proc", pathfs.NewPathNodeFs(me.procFs, nil)},
 		{"sys", pathfs.NewPathNodeFs(pathfs.NewReadonlyFileSystem(pathfs.NewLoopbackFileSystem("/sys")), nil)},
-		{"tmp", nodefs.NewMemNodeFs(tmpBacking + "/tmp")},
 		{"dev", fs.NewDevFs()},
-		{"var/tmp", nodefs.NewMemNodeFs(tmpBacking + "/vartmp")},
+	}
+	for _, t := range tmpMounts {
+		mounts = append(mounts, submount{t.mountpoint, nodefs.NewMemNodeFs(me.tmpBacking + t.backing)})
 	}
 	for _, s := range mounts {
 		subOpts := &mOpts
@@ -188,6 +242,60 @@ func newWorkerFuseFs(tmpDir string, rpcFs pathfs.FileSystem, writableRoot string
 	return me, nil
 }
 
+// The temporary directories of the file system.  They are outside the
+// writable root, so their contents never show up in the reaped
+// FileSet.
+var tmpMounts = []struct {
+	mountpoint string
+	backing    string
+}{
+	{"tmp", "/tmp"},
+	{"var/tmp", "/vartmp"},
+}
+
+// resetTmp replaces the temporary directories with empty ones, so
+// files left by one batch of tasks are not seen by the next.
+func (me *workerFuseFs) resetTmp() {
+	if strings.HasPrefix(me.writableRoot, "tmp/") {
+		// The writable root is mounted inside /tmp.
+		return
+	}
+	backing, err := ioutil.TempDir(me.tmpDir, "tmp-backing")
+	if err != nil {
+		log.Printf("resetTmp: %v", err)
+		return
+	}
+
+	clean := true
+	for _, t := range tmpMounts {
+		if code := me.rpcNodeFs.Unmount(t.mountpoint); !code.Ok() {
+			// Background processes may still use it. The
+			// backing is removed when the FS stops.
+			log.Printf("unmount of /%s in fuse FS %s: %v", t.mountpoint, me.id, code)
+			clean = false
+			continue
+		}
+		opts := me.options
+		code := me.rpcNodeFs.Mount(t.mountpoint, nodefs.NewMemNodeFs(backing+t.backing), &opts)
+		if !code.Ok() {
+			log.Printf("remount of /%s in fuse FS %s: %v", t.mountpoint, me.id, code)
+			me.tmpBroken = true
+		}
+	}
+	if clean {
+		os.RemoveAll(me.tmpBacking)
+	}
+	me.tmpBacking = backing
+}
+
+// reapScratch returns the files written below the scratch root.
+func (me *workerFuseFs) reapScratch() []*attr.FileAttr {
+	if me.scratch == nil {
+		return nil
+	}
+	return me.scratch.reap()
+}
+
 func (me *workerFuseFs) update(attrs []*attr.FileAttr) {
 	updates := map[string]*fs.Result{}
 	for _, attr := range attrs {
@@ -215,12 +323,21 @@ func (me *workerFuseFs) update(attrs []*attr.FileAttr) {
 	me.unionFs.Update(updates)
 }
 
-func (fs *workerFuseFs) reap() (dir string, yield map[string]*fs.Result) {
-	yield = fs.unionFs.Reap()
+// reap returns the changes of the file system, and the changed files
+// that processes still had open for writing; see _OPEN_WRITER_DELAY.
+func (fs *workerFuseFs) reap() (dir string, yield map[string]*fs.Result, open []string) {
+	yield, open = fs.unionFs.ReapWait(_OPEN_WRITER_DELAY)
 	backingStoreFiles := map[string]string{}
+
+	// The backing files of open files may still be written, so
+	// they are copied rather than moved.
+	openBacking := map[string]bool{}
+	for _, n := range open {
+		openBacking[yield[n].Backing] = true
+	}
 	dir, err := ioutil.TempDir(fs.tmpDir, "reap")
 	if err != nil {
-		log.Fatalf("ioutil.TempDir: %v", err)
+		log.Panicf("ioutil.TempDir: %v", err)
 	}
 
 	i := 0
@@ -228,22 +345,51 @@ func (fs *workerFuseFs) reap() (dir string, yield map[string]*fs.Result) {
 		if v.Backing == "" {
 			continue
 		}
-		newBacking := backingStoreFiles[v.Backing]
+		backing := v.Backing
+		newBacking := backingStoreFiles[backing]
 		if newBacking == "" {
 			newBacking = fmt.Sprintf("%s/%d", dir, i)
 			i++
 
-			err := os.Rename(v.Backing, newBacking)
-			if err != nil {
+			if openBacking[backing] {
+				if err := copyFile(backing, newBacking); err != nil {
+					log.Panicf("reapFiles copy failed: %v", err)
+				}
+			} else if err := os.Rename(backing, newBacking); err != nil {
 				log.Panicf("reapFiles rename failed: %v", err)
 			}
 			log.Printf("created %q", newBacking)
-			backingStoreFiles[v.Backing] = newBacking
+			backingStoreFiles[backing] = newBacking
 		}
 		v.Backing = newBacking
+
+		// The copy may have more than the file system knew of.
+		if fi, _ := os.Lstat(newBacking); openBacking[backing] && fi != nil && v.Attr != nil {
+			a := *v.Attr
+			a.Size = uint64(fi.Size())
+			v.Attr = &a
+		}
 	}
 
 	// We saved the backing store files, so we don't need the file system anymore.
 	fs.unionFs.Reset()
-	return dir, yield
+	fs.resetTmp()
+	return dir, yield, open
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
 }
@@ -0,0 +1,305 @@
+package termite
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hanwen/termite/attr"
+)
+
+// With MasterOptions.HarvestPeriod, the master periodically asks the
+// mirror for the files that a running job finished writing, and
+// replays them right away, so other mirrors see them before the job
+// completes.  Before each replay, it records how to undo it.  If the
+// job fails or is cancelled, the replays are reverted.  The master
+// acknowledges each harvest with the next request; the worker adds
+// the files of unacknowledged harvests to the WorkResponse.
+//
+// A file is harvested only once the last process writing it closed
+// it, so a harvest never ships a file that a tool is still writing.
+// Processes can keep files open across their own exit, through
+// children that inherit the descriptors.  When the job is reaped, the
+// worker waits _OPEN_WRITER_DELAY for them.  Files still open then are
+// harvested last, as they are, and listed in WorkResponse.OpenFiles.
+
+// How long reaping waits for files open for writing to be closed.
+const _OPEN_WRITER_DELAY = time.Second
+
+// Harvest returns the files of a running incremental task that are
+// not open for writing, and changed since the previous harvest.
+func (me *Mirror) Harvest(req *HarvestRequest, rep *HarvestResponse) (err error) {
+	task := me.findTask(req.TaskId)
+	if task == nil {
+		// Not started, or already done.
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = me.worker.jobPanicked(task.req, r)
+		}
+	}()
+	return task.harvest(req.Acked, rep)
+}
+
+func (me *Mirror) findTask(id int) *WorkerTask {
+	me.fsMutex.Lock()
+	defer me.fsMutex.Unlock()
+	for fs := range me.activeFses {
+		for t := range fs.tasks {
+			if t.req.TaskId == id {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+func (me *WorkerTask) harvest(acked int, rep *HarvestResponse) error {
+	me.harvestMutex.Lock()
+	defer me.harvestMutex.Unlock()
+	for len(me.unacked) > 0 && me.unacked[0].Seq <= acked {
+		me.unacked = me.unacked[1:]
+	}
+	if !me.req.Incremental || me.fuseFs == nil || me.reaped {
+		return nil
+	}
+
+	content := me.mirror.worker.content
+	content.PauseMaintenance()
+	defer content.ResumeMaintenance()
+
+	yield := me.fuseFs.unionFs.ReapClosed()
+	if len(yield) == 0 {
+		return nil
+	}
+	// The file system keeps using the backing files, so copy
+	// them.
+	files, err := me.mirror.resultFiles(yield, func(p string) (string, error) {
+		if h := content.SavePath(p); h != "" {
+			return h, nil
+		}
+		return "", fmt.Errorf("could not save %s", p)
+	})
+	if err != nil {
+		me.fuseFs.unionFs.Unharvest(yield)
+		return err
+	}
+
+	me.harvestSeq++
+	rep.Seq = me.harvestSeq
+	rep.FileSet = &attr.FileSet{Files: files}
+	rep.FileSet.Sort()
+	me.unacked = append(me.unacked, rep)
+	return nil
+}
+
+// addUnacked adds the files of harvests that the master may have
+// missed to the final result.  The union FS leaves out files that did
+// not change since they were harvested.
+func (me *WorkerTask) addUnacked(fset *attr.FileSet) {
+	me.harvestMutex.Lock()
+	defer me.harvestMutex.Unlock()
+	if fset == nil || len(me.unacked) == 0 {
+		return
+	}
+
+	have := map[string]bool{}
+	for _, f := range fset.Files {
+		have[f.Path] = true
+	}
+	// Newest first, so later versions of a file win.
+	for i := len(me.unacked) - 1; i >= 0; i-- {
+		for _, f := range me.unacked[i].Files {
+			if !have[f.Path] {
+				have[f.Path] = true
+				fset.Files = append(fset.Files, f)
+			}
+		}
+	}
+	me.unacked = nil
+	fset.Sort()
+}
+
+// harvester collects the files of one running job.
+type harvester struct {
+	master *Master
+	mirror *mirrorConnection
+	taskId int
+	job    *manifestJob
+
+	stopChan chan int
+	done     chan int
+
+	// Only accessed by the harvest goroutine until done is
+	// closed.
+	seq    int
+	failed bool
+
+	// Why harvesting stopped early, and the number of files
+	// replayed before.
+	err      error
+	replayed int
+
+	// Reverts each replayed FileSet, oldest first.
+	undo []attr.FileSet
+
+	// The replayed FileSets, for the session manifest.
+	replayedSets []*attr.FileSet
+}
+
+func (me *Master) startHarvest(mirror *mirrorConnection, req *WorkRequest, inputs []*attr.FileAttr) *harvester {
+	h := &harvester{
+		master:   me,
+		mirror:   mirror,
+		taskId:   req.TaskId,
+		job:      newManifestJob(req, mirror.workerAddr, inputs),
+		stopChan: make(chan int),
+		done:     make(chan int),
+	}
+	go h.loop(me.options.HarvestPeriod)
+	return h
+}
+
+func (me *harvester) loop(period time.Duration) {
+	defer close(me.done)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for !me.failed {
+		select {
+		case <-me.stopChan:
+			return
+		case <-ticker.C:
+			me.harvestOnce()
+		}
+	}
+}
+
+func (me *harvester) harvestOnce() {
+	req := HarvestRequest{TaskId: me.taskId, Acked: me.seq}
+	rep := HarvestResponse{}
+	if err := me.mirror.rpcClient.Call("Mirror.Harvest", &req, &rep); err != nil {
+		log.Printf("harvest of task %d: %v", me.taskId, err)
+		me.failed = true
+		me.err = err
+		return
+	}
+	if rep.FileSet == nil || len(rep.Files) == 0 {
+		return
+	}
+	if rep.Seq != me.seq+1 {
+		// The unacknowledged files come with the
+		// WorkResponse.
+		log.Printf("harvest of task %d: got sequence %d, want %d; stopping", me.taskId, rep.Seq, me.seq+1)
+		me.failed = true
+		return
+	}
+	me.seq = rep.Seq
+
+	undo := me.master.undoFileSet(*rep.FileSet)
+	if err := me.mirror.replay(*rep.FileSet); err != nil {
+		// Not acknowledged, so the files come with the
+		// WorkResponse.
+		log.Printf("harvest of task %d: replay: %v", me.taskId, err)
+		me.master.releaseUndo(undo)
+		me.failed = true
+		me.err = err
+		return
+	}
+	me.undo = append(me.undo, undo)
+	me.replayedSets = append(me.replayedSets, rep.FileSet)
+	me.replayed += len(rep.Files)
+}
+
+// stop waits for a running harvest to finish.
+func (me *harvester) stop() {
+	close(me.stopChan)
+	<-me.done
+}
+
+// finish stops harvesting, and reverts the replayed files if revert
+// is set.
+func (me *harvester) finish(revert bool) {
+	me.stop()
+	if revert && len(me.undo) > 0 {
+		log.Printf("reverting %d partial replays of task %d", len(me.undo), me.taskId)
+		for i := len(me.undo) - 1; i >= 0; i-- {
+			if err := me.master.replay(me.master.pruneUndo(me.undo[i])); err != nil {
+				log.Printf("reverting task %d: %v", me.taskId, err)
+			}
+		}
+	}
+	for _, u := range me.undo {
+		me.master.releaseUndo(u)
+	}
+	if !revert {
+		for _, fs := range me.replayedSets {
+			me.master.sessionOutputs(fs, me.job)
+		}
+	}
+}
+
+// undoFileSet returns the changes that revert replaying fset.  The
+// content of the files it restores is pinned in the store until
+// releaseUndo.
+func (me *Master) undoFileSet(fset attr.FileSet) attr.FileSet {
+	undo := attr.FileSet{}
+	for _, f := range fset.Files {
+		prev := me.attributes.Get(f.Path)
+		if prev.Deletion() {
+			if !f.Deletion() {
+				undo.Files = append(undo.Files, &attr.FileAttr{Path: f.Path})
+			}
+			continue
+		}
+		if prev.Hash != "" {
+			me.contentStore.Ref(prev.Hash)
+		}
+		// Only restore the metadata of directories; their
+		// entries are restored one by one.
+		undo.Files = append(undo.Files, prev.Copy(false))
+	}
+	undo.Sort()
+	return undo
+}
+
+func (me *Master) releaseUndo(undo attr.FileSet) {
+	for _, f := range undo.Files {
+		if f.Hash != "" {
+			me.contentStore.Unref(f.Hash)
+		}
+	}
+}
+
+// pruneUndo drops deletions of files that are already gone, and of
+// directories that other jobs have put files in since.
+func (me *Master) pruneUndo(undo attr.FileSet) attr.FileSet {
+	deleted := map[string]bool{}
+	for _, f := range undo.Files {
+		if f.Deletion() {
+			deleted[f.Path] = true
+		}
+	}
+
+	// Deletions are sorted children first.
+	out := attr.FileSet{}
+	for _, f := range undo.Files {
+		if f.Deletion() {
+			cur := me.attributes.GetDir(f.Path)
+			if cur.Deletion() {
+				delete(deleted, f.Path)
+				continue
+			}
+			busy := false
+			for name := range cur.NameModeMap {
+				busy = busy || !deleted[f.Path+"/"+name]
+			}
+			if busy {
+				delete(deleted, f.Path)
+				continue
+			}
+		}
+		out.Files = append(out.Files, f)
+	}
+	return out
+}
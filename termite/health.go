@@ -0,0 +1,78 @@
+package termite
+
+import (
+	"time"
+)
+
+// Masters otherwise find bad workers only by failing jobs on them.
+// The coordinator scores each worker whenever it probes it, from
+// 0 to 1, and hands the score to masters in Registration.Health.
+// The score multiplies factors for the latency of the probe, for
+// missed reachability checks, for how long ago the worker last
+// reported, and for its free job slots.  Masters prefer workers that
+// score higher; workers scoring below CoordinatorOptions.MinHealth
+// are not listed at all.
+
+// How often workers are expected to report, by default.  See
+// WorkerOptions.ReportInterval.
+const _DEFAULT_REPORT_INTERVAL = 60 * time.Second
+
+// health returns the score of w, as of now.  Must hold mutex.
+func (me *Coordinator) health(w *WorkerRegistration, now time.Time) float64 {
+	score := 1.0
+
+	// A probe that takes the whole CheckTimeout halves the score.
+	if t := me.options.CheckTimeout; t > 0 {
+		score *= 1 - 0.5*fraction(float64(w.ProbeLatency)/float64(t))
+	}
+
+	score *= 1 - fraction(float64(w.MissedChecks)/float64(me.options.MaxMissedChecks))
+
+	// Missing a report or two can happen; after that, the score
+	// drops with the time since the last one.
+	if age, grace := now.Sub(w.LastReported), 2*me.options.ReportInterval; !w.LastReported.IsZero() && age > grace {
+		score *= float64(grace) / float64(age)
+	}
+
+	// A full worker is not broken, but another one will be
+	// quicker.
+	if w.MaxJobs > 0 {
+		free := float64(w.MaxJobs-w.RunningJobs) / float64(w.MaxJobs)
+		score *= 0.75 + 0.25*fraction(free)
+	}
+	return score
+}
+
+// fraction clamps f to [0, 1].
+func fraction(f float64) float64 {
+	if f < 0 {
+		return 0
+	}
+	if f > 1 {
+		return 1
+	}
+	return f
+}
+
+// rescore updates the health of the workers.  It returns true if a
+// score changed enough for masters to hear about it.  Must hold
+// mutex.
+func (me *Coordinator) rescore(now time.Time) bool {
+	changed := false
+	for _, w := range me.workers {
+		h := me.health(w, now)
+		listed := h >= me.options.MinHealth
+		if listed != (w.Health >= me.options.MinHealth) || h-w.Health > 0.1 || w.Health-h > 0.1 {
+			changed = true
+		}
+		w.Health = h
+	}
+	return changed
+}
+
+// healthClass groups workers with similar scores, for masters to
+// prefer higher ones.  Coordinators that do not score workers give
+// them all class 0.
+func (me *Registration) healthClass() int {
+	return int(me.Health * 4)
+}
@@ -0,0 +1,218 @@
+package termite
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/termite/attr"
+)
+
+// A build tool often knows which files the coming jobs will read
+// before it starts them.  It can pass them to LocalMaster.Hint, with
+// the likelihood that they are read.  The master hashes the hinted
+// files in the background, most likely first, and pushes them to its
+// mirrors, so the workers have them by the time the jobs arrive.
+// Mirrors that connect later get the most likely files pushed when
+// they connect.  Hints are advisory: the master handles a batch per
+// period at most, and keeps a bounded number of them.  HintStats
+// tells how many hinted files jobs actually read, so tools can tell
+// whether their hints are any good.
+const (
+	// Hints waiting to be resolved.  Beyond this, hints are
+	// dropped.
+	_HINT_MAX_PENDING = 10000
+
+	// Resolved hints kept for new mirrors, and for counting use.
+	_HINT_MAX_RESOLVED = 2000
+
+	// Hints resolved and pushed per period.
+	_HINT_BATCH  = 100
+	_HINT_PERIOD = 100 * time.Millisecond
+)
+
+type hintedFile struct {
+	attr       *attr.FileAttr
+	likelihood float64
+}
+
+type hintSet struct {
+	mutex   sync.Mutex
+	stats   HintStats
+	pending map[string]float64
+
+	// Set while a goroutine resolves pending hints.
+	running bool
+
+	// Sorted by likelihood, most likely first.
+	resolved []hintedFile
+
+	// The hashes of resolved, and whether a job read them.
+	used map[string]bool
+}
+
+func newHintSet() *hintSet {
+	return &hintSet{
+		pending: map[string]float64{},
+		used:    map[string]bool{},
+	}
+}
+
+// add queues hints.  It returns true if the caller should start
+// resolving them.
+func (me *hintSet) add(hints []Hint) bool {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	for _, h := range hints {
+		me.stats.Received++
+		p := strings.TrimLeft(h.Path, "/")
+		old, ok := me.pending[p]
+		if h.Likelihood <= 0 || p == "" || (!ok && len(me.pending) >= _HINT_MAX_PENDING) {
+			me.stats.Dropped++
+			continue
+		}
+		if h.Likelihood > old {
+			me.pending[p] = h.Likelihood
+		}
+	}
+	if me.running || len(me.pending) == 0 {
+		return false
+	}
+	me.running = true
+	return true
+}
+
+// next takes up to n of the most likely pending hints.  If none are
+// left, it returns nil, and the caller should stop resolving.
+func (me *hintSet) next(n int) []Hint {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if len(me.pending) == 0 {
+		me.running = false
+		return nil
+	}
+	var result []Hint
+	for p, l := range me.pending {
+		result = append(result, Hint{Path: p, Likelihood: l})
+	}
+	sort.Sort(hintsByLikelihood(result))
+	if len(result) > n {
+		result = result[:n]
+	}
+	for _, h := range result {
+		delete(me.pending, h.Path)
+	}
+	return result
+}
+
+// resolve records the file that a hint resolved to.
+func (me *hintSet) resolve(a *attr.FileAttr, likelihood float64) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.stats.Resolved++
+	if _, ok := me.used[a.Hash]; ok {
+		return
+	}
+	me.used[a.Hash] = false
+	i := sort.Search(len(me.resolved), func(i int) bool {
+		return me.resolved[i].likelihood < likelihood
+	})
+	me.resolved = append(me.resolved, hintedFile{})
+	copy(me.resolved[i+1:], me.resolved[i:])
+	me.resolved[i] = hintedFile{a, likelihood}
+	if len(me.resolved) > _HINT_MAX_RESOLVED {
+		last := me.resolved[len(me.resolved)-1]
+		delete(me.used, last.attr.Hash)
+		me.resolved = me.resolved[:len(me.resolved)-1]
+	}
+}
+
+// use records that a job read the content with the given hash.
+func (me *hintSet) use(hash string) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if used, ok := me.used[hash]; ok && !used {
+		me.used[hash] = true
+		me.stats.Used++
+	}
+}
+
+// files returns the resolved files, most likely first.
+func (me *hintSet) files() []*attr.FileAttr {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	var result []*attr.FileAttr
+	for _, h := range me.resolved {
+		result = append(result, h.attr)
+	}
+	return result
+}
+
+func (me *hintSet) getStats() HintStats {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return me.stats
+}
+
+type hintsByLikelihood []Hint
+
+func (me hintsByLikelihood) Len() int { return len(me) }
+func (me hintsByLikelihood) Less(i, j int) bool {
+	if me[i].Likelihood != me[j].Likelihood {
+		return me[i].Likelihood > me[j].Likelihood
+	}
+	return me[i].Path < me[j].Path
+}
+func (me hintsByLikelihood) Swap(i, j int) { me[i], me[j] = me[j], me[i] }
+
+// hint queues hints, and starts resolving them if needed.
+func (me *Master) hint(hints []Hint) HintStats {
+	if me.hints.add(hints) {
+		go me.resolveHints()
+	}
+	return me.hints.getStats()
+}
+
+// resolveHints hashes the pending hints, a batch per period, and
+// pushes the files to the mirrors.
+func (me *Master) resolveHints() {
+	for {
+		batch := me.hints.next(_HINT_BATCH)
+		if batch == nil {
+			return
+		}
+		var files []*attr.FileAttr
+		for _, h := range batch {
+			a := me.attributes.Get(h.Path)
+			if a == nil || a.Deletion() || !a.IsRegular() || a.Hash == "" {
+				continue
+			}
+			me.hints.resolve(a, h.Likelihood)
+			files = append(files, a)
+		}
+
+		me.mirrors.Lock()
+		var mirrors []*mirrorConnection
+		for _, mc := range me.mirrors.mirrors {
+			mirrors = append(mirrors, mc)
+		}
+		me.mirrors.Unlock()
+		for _, mc := range mirrors {
+			me.sendHints(mc, files)
+		}
+		time.Sleep(_HINT_PERIOD)
+	}
+}
+
+// sendHints pushes hinted files to a mirror.  Like prefetching, it
+// is best-effort.
+func (me *Master) sendHints(mirror *mirrorConnection, files []*attr.FileAttr) {
+	if len(files) == 0 {
+		return
+	}
+	if _, err := me.sendPrefetch(mirror, files); err != nil {
+		log.Printf("pushing hinted files to %s: %v", mirror.workerAddr, err)
+	}
+}
@@ -0,0 +1,79 @@
+package termite
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hanwen/termite/attr"
+)
+
+func TestHintSetNext(t *testing.T) {
+	s := newHintSet()
+	if !s.add([]Hint{{"/a", 0.5}, {"b", 0.9}, {"c", 0}, {"a", 0.7}}) {
+		t.Fatal("add should start resolving")
+	}
+	if s.add([]Hint{{"d", 0.1}}) {
+		t.Error("add started resolving twice")
+	}
+	got := s.next(2)
+	if len(got) != 2 || got[0] != (Hint{"b", 0.9}) || got[1] != (Hint{"a", 0.7}) {
+		t.Errorf("got %v, want b and a", got)
+	}
+	if got := s.next(2); len(got) != 1 || got[0].Path != "d" {
+		t.Errorf("got %v, want d", got)
+	}
+	if got := s.next(2); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+	if !s.add([]Hint{{"e", 1}}) {
+		t.Error("add should start resolving again")
+	}
+	if st := s.getStats(); st.Received != 6 || st.Dropped != 1 {
+		t.Errorf("got stats %+v", st)
+	}
+}
+
+func TestHintSetPendingBound(t *testing.T) {
+	s := newHintSet()
+	var hints []Hint
+	for i := 0; i < _HINT_MAX_PENDING+10; i++ {
+		hints = append(hints, Hint{fmt.Sprintf("f%d", i), 0.5})
+	}
+	s.add(hints)
+	if len(s.pending) != _HINT_MAX_PENDING {
+		t.Errorf("got %d pending", len(s.pending))
+	}
+	if st := s.getStats(); st.Dropped != 10 {
+		t.Errorf("got %d dropped, want 10", st.Dropped)
+	}
+}
+
+func TestHintSetUse(t *testing.T) {
+	s := newHintSet()
+	s.resolve(&attr.FileAttr{Path: "a", Hash: "h1"}, 0.2)
+	s.resolve(&attr.FileAttr{Path: "b", Hash: "h2"}, 0.8)
+	files := s.files()
+	if len(files) != 2 || files[0].Hash != "h2" || files[1].Hash != "h1" {
+		t.Errorf("got %v, want h2 before h1", files)
+	}
+
+	s.use("h1")
+	s.use("h1")
+	s.use("h3")
+	if st := s.getStats(); st.Resolved != 2 || st.Used != 1 {
+		t.Errorf("got stats %+v", st)
+	}
+}
+
+func TestHintSetResolvedBound(t *testing.T) {
+	s := newHintSet()
+	for i := 0; i <= _HINT_MAX_RESOLVED; i++ {
+		s.resolve(&attr.FileAttr{Hash: fmt.Sprintf("h%d", i)}, 1-float64(i)/1e4)
+	}
+	if len(s.resolved) != _HINT_MAX_RESOLVED || len(s.used) != _HINT_MAX_RESOLVED {
+		t.Errorf("got %d resolved, %d hashes", len(s.resolved), len(s.used))
+	}
+	if _, ok := s.used[fmt.Sprintf("h%d", _HINT_MAX_RESOLVED)]; ok {
+		t.Error("least likely file was kept")
+	}
+}
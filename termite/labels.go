@@ -0,0 +1,76 @@
+package termite
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Workers carry labels, such as "pool=ci", so masters can select the
+// workers they use in a mixed cluster, and jobs the workers they run
+// on.  Besides the labels they are given, workers have "arch" and
+// "os" labels, as in Go's GOARCH and GOOS.
+
+// NoMatchingWorkerError fails jobs whose RequiredLabels no worker
+// has.  The wrapper may run such jobs locally instead.
+type NoMatchingWorkerError struct {
+	Labels map[string]string
+}
+
+func (e *NoMatchingWorkerError) Error() string {
+	return fmt.Sprintf("no worker has labels %s", FormatLabels(e.Labels))
+}
+
+// ParseLabels parses a comma separated list of key=value pairs, as
+// used for worker labels and label selectors.
+func ParseLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("label %q is not of the form key=value", kv)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// FormatLabels returns the labels as sorted key=value pairs,
+// separated by commas.
+func FormatLabels(labels map[string]string) string {
+	var kvs []string
+	for k, v := range labels {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+// matchLabels returns true if labels has all key/value pairs of
+// selector.
+func matchLabels(selector, labels map[string]string) bool {
+	for k, v := range selector {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// workerLabels returns labels with the arch and os labels added,
+// unless they are set already.
+func workerLabels(labels map[string]string) map[string]string {
+	result := map[string]string{
+		"arch": runtime.GOARCH,
+		"os":   runtime.GOOS,
+	}
+	for k, v := range labels {
+		result[k] = v
+	}
+	return result
+}
@@ -0,0 +1,73 @@
+package termite
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestParseLabels(t *testing.T) {
+	got, err := ParseLabels("pool=ci, arch=amd64,empty=")
+	want := map[string]string{"pool": "ci", "arch": "amd64", "empty": ""}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, %v; want %v", got, err, want)
+	}
+	if s := FormatLabels(got); s != "arch=amd64,empty=,pool=ci" {
+		t.Errorf("FormatLabels: got %q", s)
+	}
+	if got, err := ParseLabels(""); err != nil || len(got) != 0 {
+		t.Errorf("empty: got %v, %v", got, err)
+	}
+	for _, bad := range []string{"pool", "=ci", "pool=ci,arch"} {
+		if _, err := ParseLabels(bad); err == nil {
+			t.Errorf("ParseLabels(%q) should fail", bad)
+		}
+	}
+}
+
+func TestCoordinatorListSelector(t *testing.T) {
+	c := NewCoordinator(&CoordinatorOptions{})
+	for addr, labels := range map[string]map[string]string{
+		"ci:1":   {"pool": "ci", "arch": "amd64"},
+		"arm:1":  {"pool": "ci", "arch": "arm64"},
+		"team:1": {"pool": "team"},
+		"none:1": nil,
+	} {
+		c.workers[addr] = &WorkerRegistration{
+			Registration: Registration{Address: addr, Labels: labels},
+		}
+	}
+	c.lastChange = time.Now()
+
+	for sel, want := range map[string][]string{
+		"":                   {"arm:1", "ci:1", "none:1", "team:1"},
+		"pool=ci":            {"arm:1", "ci:1"},
+		"pool=ci,arch=amd64": {"ci:1"},
+		"pool=nobody":        nil,
+	} {
+		rep := ListResponse{}
+		if err := c.List(&ListRequest{Selector: sel}, &rep); err != nil {
+			t.Fatalf("List(%q): %v", sel, err)
+		}
+		var got []string
+		for _, r := range rep.Registrations {
+			got = append(got, r.Address)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("List(%q): got %v, want %v", sel, got, want)
+		}
+	}
+
+	if err := c.List(&ListRequest{Selector: "pool"}, &ListResponse{}); err == nil {
+		t.Errorf("List with bad selector should fail")
+	}
+}
+
+func TestWorkerLabels(t *testing.T) {
+	got := workerLabels(map[string]string{"pool": "ci", "os": "android"})
+	want := map[string]string{"pool": "ci", "os": "android", "arch": runtime.GOARCH}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
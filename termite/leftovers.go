@@ -0,0 +1,186 @@
+package termite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Some build steps start daemons that outlive the command.  When the
+// main command of a task exits, the rest of its process group is
+// killed, except for processes whose name is listed in
+// WorkRequest.AllowBackground.  When the last task of a file system
+// is done, other processes still using the mount are killed too.
+// Allowed processes keep running until the file system is stopped,
+// which kills everything that still uses the mount before
+// unmounting.
+
+// How long to wait for output of background processes after the main
+// command exits.
+const _BACKGROUND_OUTPUT_DELAY = time.Second
+
+// BackgroundProcess is a process that a task left running.
+type BackgroundProcess struct {
+	Pid    int
+	Name   string
+	TaskId int
+}
+
+type backgroundProcess struct {
+	BackgroundProcess
+	fs *workerFuseFs
+}
+
+type procInfo struct {
+	pid  int
+	pgid int
+	name string
+}
+
+// listProcesses returns the live processes on the system.
+func listProcesses() []procInfo {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var result []procInfo
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			continue
+		}
+
+		// The name is in parentheses, and may contain spaces
+		// or parentheses itself.
+		s := string(stat)
+		open := strings.IndexByte(s, '(')
+		close := strings.LastIndex(s, ")")
+		if open < 0 || close < open {
+			continue
+		}
+		// state, ppid, pgrp, ...
+		fields := strings.Fields(s[close+1:])
+		if len(fields) < 3 || fields[0] == "Z" {
+			continue
+		}
+		pgid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		result = append(result, procInfo{pid, pgid, s[open+1 : close]})
+	}
+	return result
+}
+
+// usesMount returns true if the root or working directory of the
+// process is inside mount.
+func usesMount(pid int, mount string) bool {
+	for _, link := range []string{"root", "cwd"} {
+		dest, err := os.Readlink(fmt.Sprintf("/proc/%d/%s", pid, link))
+		if err == nil && (dest == mount || strings.HasPrefix(dest, mount+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// leftoverProcesses returns the processes in process group pgid, if
+// it is nonzero, and those using mount, if it is set.
+func leftoverProcesses(pgid int, mount string) []procInfo {
+	self := os.Getpid()
+	var result []procInfo
+	for _, p := range listProcesses() {
+		if p.pid == self {
+			continue
+		}
+		if (pgid != 0 && p.pgid == pgid) || (mount != "" && usesMount(p.pid, mount)) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func killProcesses(procs []procInfo) {
+	for _, p := range procs {
+		err := syscall.Kill(p.pid, syscall.SIGKILL)
+		if err != nil && err != syscall.ESRCH {
+			log.Printf("kill %d (%s): %v", p.pid, p.name, err)
+		}
+	}
+}
+
+// killLeftovers kills the rest of the process group of the task,
+// except the processes it may leave running.
+func (me *WorkerTask) killLeftovers(fs *workerFuseFs) {
+	if me.cmd == nil || me.cmd.Process == nil {
+		return
+	}
+	me.mirror.handleLeftovers(me, fs, leftoverProcesses(me.cmd.Process.Pid, ""))
+}
+
+// killMountUsers kills processes using the file system that are not
+// allowed to run in the background.  It is called after the last task
+// in the file system is done.
+func (me *WorkerTask) killMountUsers(fs *workerFuseFs) {
+	me.mirror.handleLeftovers(me, fs, leftoverProcesses(0, fs.mount))
+}
+
+func (me *Mirror) handleLeftovers(task *WorkerTask, fs *workerFuseFs, procs []procInfo) {
+	allowed := map[string]bool{}
+	for _, n := range task.req.AllowBackground {
+		allowed[n] = true
+	}
+
+	me.fsMutex.Lock()
+	defer me.fsMutex.Unlock()
+	var kill []procInfo
+	for _, p := range procs {
+		if bg := me.background[p.pid]; bg != nil && bg.fs == fs {
+			continue
+		}
+		if allowed[p.name] {
+			log.Printf("task %d leaves %s (pid %d) running", task.req.TaskId, p.name, p.pid)
+			me.background[p.pid] = &backgroundProcess{
+				BackgroundProcess{p.pid, p.name, task.req.TaskId}, fs}
+			continue
+		}
+		kill = append(kill, p)
+	}
+	if len(kill) > 0 {
+		log.Printf("task %d left %d processes; killing them", task.req.TaskId, len(kill))
+		killProcesses(kill)
+	}
+}
+
+// stopFs stops the file system, and forgets about its background
+// processes.  Must hold fsMutex.
+func (me *Mirror) stopFs(fs *workerFuseFs) {
+	for pid, bg := range me.background {
+		if bg.fs == fs {
+			delete(me.background, pid)
+		}
+	}
+	fs.Stop()
+}
+
+// backgroundStatus returns the background processes that are still
+// alive.  Must hold fsMutex.
+func (me *Mirror) backgroundStatus() (result []BackgroundProcess) {
+	for pid, bg := range me.background {
+		if syscall.Kill(pid, 0) != nil {
+			delete(me.background, pid)
+			continue
+		}
+		result = append(result, bg.BackgroundProcess)
+	}
+	return result
+}
@@ -0,0 +1,176 @@
+package termite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// A runaway job can take down the worker's host.  With
+// WorkerOptions.MaxJobMemory and MaxJobCPUTime, each process of a
+// job gets resource limits: RLIMIT_AS and RLIMIT_CPU on the process
+// the job starts with, which its children inherit.  Processes that
+// use up their CPU time get SIGXCPU.  Processes that exceed the
+// address space limit see their allocations fail, which the worker
+// cannot tell apart from other failures.  With
+// WorkerOptions.CgroupDir, jobs also get a cgroup v2 of their own,
+// whose memory.max limits the memory of the job as a whole.  The
+// kernel kills the job when it is exceeded.  With mirror limits,
+// the cgroup of the job goes below that of its mirror; see
+// mirrorcgroup.go.  Jobs killed for exceeding limits have
+// WorkResponse.ResourceExceeded set.
+
+// Values for WorkResponse.ResourceExceeded.
+const (
+	ResourceMemory = "memory"
+	ResourceCPU    = "cpu"
+)
+
+// Seconds between SIGXCPU and SIGKILL, for processes that ignore
+// SIGXCPU.
+const _CPU_GRACE_SECS = 2
+
+func prlimit(pid int, resource int, lim *syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid),
+		uintptr(resource), uintptr(unsafe.Pointer(lim)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// jobLimits are the limits set on a running job.
+type jobLimits struct {
+	// The cgroup of the job, or "".
+	cgroup string
+
+	// The file of the cgroup that counts OOM kills.
+	events string
+}
+
+// limitJob sets the resource limits on the job started as pid, and
+// puts it in the cgroup of its mirror.  The process has started
+// already, so children it forks right away may escape the rlimits;
+// they are in the cgroup anyway.
+func (me *Worker) limitJob(pid int, taskId int, mirror *mirrorCgroup) (*jobLimits, error) {
+	o := me.options
+	if o.MaxJobMemory == 0 && o.MaxJobCPUTime == 0 && mirror == nil {
+		return nil, nil
+	}
+	if o.MaxJobMemory > 0 {
+		lim := syscall.Rlimit{Cur: o.MaxJobMemory, Max: o.MaxJobMemory}
+		if err := prlimit(pid, syscall.RLIMIT_AS, &lim); err != nil {
+			return nil, fmt.Errorf("prlimit RLIMIT_AS: %v", err)
+		}
+	}
+	if o.MaxJobCPUTime > 0 {
+		secs := uint64((o.MaxJobCPUTime + 999999999) / 1e9)
+		lim := syscall.Rlimit{Cur: secs, Max: secs + _CPU_GRACE_SECS}
+		if err := prlimit(pid, syscall.RLIMIT_CPU, &lim); err != nil {
+			return nil, fmt.Errorf("prlimit RLIMIT_CPU: %v", err)
+		}
+	}
+
+	limits := &jobLimits{}
+	version := 2
+	parent := o.CgroupDir
+	switch {
+	case mirror != nil:
+		// The job cgroup goes below the mirror's, so the
+		// kernel counts OOM kills of the job there.
+		version = mirror.version
+		parent = mirror.dirs[0]
+		if version == 2 {
+			// Processes can only be in the leaves of a
+			// cgroup v2 tree.
+			ioutil.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+memory"), 0644)
+		} else if err := cgroupAdd(mirror.dirs[1], pid); err != nil {
+			return nil, err
+		}
+	case o.CgroupDir == "" || o.MaxJobMemory == 0:
+		return limits, nil
+	}
+	dir := filepath.Join(parent, fmt.Sprintf("job-%d-%d", taskId, pid))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	limits.cgroup = dir
+	var settings [][2]string
+	if version == 2 {
+		limits.events = filepath.Join(dir, "memory.events")
+		if o.MaxJobMemory > 0 {
+			settings = append(settings, [2]string{"memory.max", strconv.FormatUint(o.MaxJobMemory, 10)})
+		}
+		settings = append(settings, [2]string{"memory.oom.group", "1"})
+	} else {
+		limits.events = filepath.Join(dir, "memory.oom_control")
+	}
+	for _, kv := range append(settings, [2]string{"cgroup.procs", strconv.Itoa(pid)}) {
+		if err := ioutil.WriteFile(filepath.Join(dir, kv[0]), []byte(kv[1]), 0644); err != nil {
+			limits.release()
+			return nil, err
+		}
+	}
+	return limits, nil
+}
+
+// exceeded returns the resource whose limit the job exceeded, or "".
+func (me *jobLimits) exceeded(status syscall.WaitStatus) string {
+	if me == nil {
+		return ""
+	}
+	if status.Signaled() && status.Signal() == syscall.SIGXCPU {
+		return ResourceCPU
+	}
+	if me.events != "" {
+		// Also counts kills for a mirror that ran out of
+		// memory, if the kernel picked a process of the job.
+		content, _ := ioutil.ReadFile(me.events)
+		if cgroupEvents(string(content))["oom_kill"] > 0 {
+			return ResourceMemory
+		}
+	}
+	return ""
+}
+
+// cgroupEvents parses the "name count" lines of a cgroup events file.
+func cgroupEvents(content string) map[string]int {
+	events := map[string]int{}
+	for _, l := range strings.Split(content, "\n") {
+		fields := strings.Fields(l)
+		if len(fields) != 2 {
+			continue
+		}
+		if n, err := strconv.Atoi(fields[1]); err == nil {
+			events[fields[0]] = n
+		}
+	}
+	return events
+}
+
+// release removes the cgroup of the job.  This fails if processes of
+// the job are still running.
+func (me *jobLimits) release() {
+	if me == nil || me.cgroup == "" {
+		return
+	}
+	if err := os.Remove(me.cgroup); err != nil {
+		log.Printf("removing cgroup: %v", err)
+	}
+}
+
+// resourceKilled counts a job killed for exceeding a limit.
+func (me *Worker) resourceKilled() {
+	atomic.AddInt32(&me.resourceKills, 1)
+}
+
+func (me *Worker) resourceKillCount() int {
+	return int(atomic.LoadInt32(&me.resourceKills))
+}
@@ -0,0 +1,67 @@
+package termite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCgroupEvents(t *testing.T) {
+	events := cgroupEvents("low 0\nhigh 3\nmax 4\noom 1\noom_kill 1\n")
+	if events["oom_kill"] != 1 || events["high"] != 3 || events["none"] != 0 {
+		t.Errorf("got %v", events)
+	}
+}
+
+func TestJobLimitsExceeded(t *testing.T) {
+	var none *jobLimits
+	xcpu := syscall.WaitStatus(syscall.SIGXCPU)
+	if r := none.exceeded(xcpu); r != "" {
+		t.Errorf("no limits: got %q", r)
+	}
+	limits := &jobLimits{}
+	if r := limits.exceeded(xcpu); r != ResourceCPU {
+		t.Errorf("SIGXCPU: got %q", r)
+	}
+	if r := limits.exceeded(syscall.WaitStatus(syscall.SIGKILL)); r != "" {
+		t.Errorf("SIGKILL: got %q", r)
+	}
+}
+
+func TestLimitJob(t *testing.T) {
+	w := &Worker{options: &WorkerOptions{
+		MaxJobMemory:  1 << 30,
+		MaxJobCPUTime: 1500 * time.Millisecond,
+	}}
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	if _, err := w.limitJob(cmd.Process.Pid, 1, nil); err != nil {
+		t.Fatalf("limitJob: %v", err)
+	}
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/limits", cmd.Process.Pid))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	for _, l := range strings.Split(string(content), "\n") {
+		f := strings.Fields(l)
+		switch {
+		case strings.HasPrefix(l, "Max cpu time"):
+			if f[3] != "2" || f[4] != "4" {
+				t.Errorf("got %q, want 2 and 4 seconds", l)
+			}
+		case strings.HasPrefix(l, "Max address space"):
+			if f[3] != "1073741824" {
+				t.Errorf("got %q", l)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package termite
+
+import (
+	"crypto"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/termite/attr"
+)
+
+// Workers usually run the same OS install as their master, so files
+// below prefixes like /usr or /opt often exist on the worker
+// unchanged.  For those, the worker reads the content from its own
+// file system rather than fetching it, if the local file has the same
+// size, mtime, permissions and link count as the master's, and the
+// same hash.  Files whose hash differs are remembered, so they are
+// not hashed again until they change.
+
+// The number of mismatching local files remembered.
+const _LOCAL_MISMATCH_MEMO = 4096
+
+// localFile identifies a version of a local file.
+type localFile struct {
+	path  string
+	mtime int64
+	size  int64
+}
+
+// LocalPrefixes lists the directories whose files workers may read
+// locally.  A prefix starting with "-" excludes files below it; of
+// the prefixes containing a file, the longest decides.  For example,
+// {"/usr", "-/usr/local"} covers /usr/lib but not /usr/local/lib.
+type LocalPrefixes []string
+
+// Match returns true if path is below an included prefix.
+func (me LocalPrefixes) Match(path string) bool {
+	longest := -1
+	match := false
+	for _, p := range me {
+		exclude := strings.HasPrefix(p, "-")
+		dir := strings.TrimPrefix(p, "-")
+		if len(dir) > longest && HasDirPrefix(path, dir) {
+			longest = len(dir)
+			match = !exclude
+		}
+	}
+	return match
+}
+
+// ParseLocalPrefixes parses a comma separated list of prefixes.
+func ParseLocalPrefixes(s string) LocalPrefixes {
+	var result LocalPrefixes
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// considerSaveLocal saves the content of a from the worker's own copy
+// of the file, if that is trusted to match the master's.  It returns
+// true if the content is in the store afterwards.
+func (me *RpcFs) considerSaveLocal(a *attr.FileAttr) bool {
+	p := "/" + a.Path
+	if !a.IsRegular() || !me.localPrefixes.Match(p) {
+		return false
+	}
+	fi, err := os.Lstat(p)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+
+	var local, remote attr.EncodedAttr
+	local.FromAttr(fuse.ToAttr(fi))
+	remote.FromAttr(a.Attr)
+	if !local.Eq(&remote) {
+		return false
+	}
+
+	key := localFile{p, fi.ModTime().UnixNano(), fi.Size()}
+	if me.localMismatch(key) {
+		return false
+	}
+	hash, err := hashFile(p, me.cache.HashType())
+	if err != nil {
+		log.Printf("Hashing local %s: %v", p, err)
+		return false
+	}
+	if hash != a.Hash {
+		log.Printf("Local %s has hash %x, master has %x", p, hash, a.Hash)
+		me.addLocalMismatch(key)
+		return false
+	}
+
+	// Files the worker's user could make writable are copied; see
+	// cba.Store.SaveImmutablePath.
+	st, _ := fi.Sys().(*syscall.Stat_t)
+	if fi.Mode().Perm()&0222 == 0 && st != nil && st.Uid != uint32(os.Getuid()) {
+		hash, err = me.cache.SaveImmutablePath(p)
+	} else {
+		hash = me.cache.SavePath(p)
+	}
+	if err != nil || hash != a.Hash {
+		log.Printf("Saving local %s: got %x, %v", p, hash, err)
+		return false
+	}
+	return true
+}
+
+func (me *RpcFs) localMismatch(f localFile) bool {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return me.localMismatches[f]
+}
+
+func (me *RpcFs) addLocalMismatch(f localFile) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if me.localMismatches == nil || len(me.localMismatches) >= _LOCAL_MISMATCH_MEMO {
+		me.localMismatches = map[localFile]bool{}
+	}
+	me.localMismatches[f] = true
+}
+
+// hashFile returns the hash of the content of the file at p.
+func hashFile(p string, hashType crypto.Hash) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := hashType.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return string(h.Sum(nil)), nil
+}
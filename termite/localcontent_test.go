@@ -0,0 +1,80 @@
+package termite
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/termite/attr"
+	"github.com/hanwen/termite/cba"
+)
+
+func TestLocalPrefixes(t *testing.T) {
+	prefixes := ParseLocalPrefixes("/usr, -/usr/local,/usr/local/share,/nix/store")
+	for path, want := range map[string]bool{
+		"/usr":                  true,
+		"/usr/lib/libc.so":      true,
+		"/usr/local":            false,
+		"/usr/local/lib/x.so":   false,
+		"/usr/local/share/x":    true,
+		"/usr/localx":           true,
+		"/nix/store/abc-gcc/cc": true,
+		"/nix":                  false,
+		"/opt/x":                false,
+	} {
+		if got := prefixes.Match(path); got != want {
+			t.Errorf("Match(%q): got %v, want %v", path, got, want)
+		}
+	}
+	if LocalPrefixes(nil).Match("/usr/lib") {
+		t.Errorf("empty prefixes match")
+	}
+}
+
+func TestConsiderSaveLocal(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(dir)
+	store := cba.NewStore(&cba.StoreOptions{Dir: dir + "/cache"})
+	me := &RpcFs{cache: store, localPrefixes: LocalPrefixes{dir + "/local"}}
+	os.MkdirAll(dir+"/local", 0755)
+
+	attrOf := func(name, content, masterContent string) *attr.FileAttr {
+		p := dir + "/local/" + name
+		ioutil.WriteFile(p, []byte(content), 0444)
+		fi, _ := os.Lstat(p)
+		return &attr.FileAttr{
+			Path: strings.TrimLeft(p, "/"),
+			Attr: fuse.ToAttr(fi),
+			Hash: string(contentHash(masterContent, store)),
+		}
+	}
+
+	same := attrOf("same", "content", "content")
+	if !me.considerSaveLocal(same) || !store.Has(same.Hash) {
+		t.Errorf("matching local file not saved")
+	}
+	fi, _ := os.Stat("/" + same.Path)
+	if stored, _ := os.Stat(store.Path(same.Hash)); os.SameFile(fi, stored) {
+		t.Errorf("file of our own user was linked into the store")
+	}
+
+	differs := attrOf("differs", "local", "master")
+	if me.considerSaveLocal(differs) {
+		t.Errorf("mismatching local file accepted")
+	}
+	if local := string(contentHash("local", store)); store.Has(local) {
+		t.Errorf("mismatching local file saved")
+	}
+	fi, _ = os.Lstat("/" + differs.Path)
+	if !me.localMismatch(localFile{"/" + differs.Path, fi.ModTime().UnixNano(), fi.Size()}) {
+		t.Errorf("mismatch not remembered")
+	}
+}
+
+func contentHash(content string, store *cba.Store) []byte {
+	h := store.HashType().New()
+	h.Write([]byte(content))
+	return h.Sum(nil)
+}
@@ -0,0 +1,177 @@
+package termite
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/termite/attr"
+)
+
+// When no worker can be reached at all, jobs fail in scheduling, and
+// the build stops.  With MasterOptions.LocalFallback, the master runs
+// such jobs itself, as the wrapper runs the jobs that .termite-localrc
+// marks local.  The job writes straight to disk; afterwards the
+// master compares its attribute cache with the file system, as
+// RefreshAttributeCache does, and passes the changes on to the
+// workers and the session manifest, as for a FileSet replayed from a
+// worker.
+
+var errNoWorkers = errors.New("No workers found at all.")
+
+// localWorkerId is the WorkerId of jobs that ran on the master.
+const localWorkerId = "(local)"
+
+// runLocally runs req on this machine, with its stdin and output
+// streams.  At most MasterOptions.LocalJobs run at once.
+func (me *Master) runLocally(req *WorkRequest, rep *WorkResponse, streams *outputStreams) error {
+	me.localSlots <- true
+	defer func() { <-me.localSlots }()
+
+	log.Printf("No workers; running task %d locally: %v", req.TaskId, req.Argv)
+	cmd := &exec.Cmd{
+		Path: req.Binary,
+		Args: req.Argv,
+		Dir:  req.Dir,
+		Env:  req.Env,
+
+		// A process group, so a timeout kills the children too.
+		SysProcAttr: &syscall.SysProcAttr{Setpgid: true},
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if c := streams.conns[0]; c != nil {
+		cmd.Stdout = c
+	}
+	if c := streams.conns[1]; c != nil {
+		cmd.Stderr = c
+	}
+	if streams.stdin != nil {
+		input, err := streams.stdin.reader()
+		if err != nil {
+			return phaseError(PhaseExec, localWorkerId, err)
+		}
+		cmd.Stdin = input
+	}
+
+	start := time.Now()
+	me.localMutex.RLock()
+	if err := cmd.Start(); err != nil {
+		me.localMutex.RUnlock()
+		return phaseError(PhaseExec, localWorkerId, err)
+	}
+	if !me.setCancelKill(req, cmd.Process) {
+		cmd.Process.Kill()
+		cmd.Wait()
+		me.localMutex.RUnlock()
+		rep.Cancelled = true
+		return nil
+	}
+
+	// The timer may fire while Wait returns; done and timedOut
+	// decide whether the kill counts as a timeout.
+	var timeoutMutex sync.Mutex
+	done, timedOut := false, false
+	if req.TimeoutNs > 0 {
+		t := time.AfterFunc(time.Duration(req.TimeoutNs), func() {
+			timeoutMutex.Lock()
+			defer timeoutMutex.Unlock()
+			if done {
+				return
+			}
+			timedOut = true
+			log.Printf("Killing local task %d after timeout", req.TaskId)
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		defer t.Stop()
+	}
+	err := cmd.Wait()
+	me.localMutex.RUnlock()
+	timeoutMutex.Lock()
+	done = true
+	rep.TimedOut = timedOut
+	timeoutMutex.Unlock()
+	rep.addTiming("local", time.Now().Sub(start))
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return phaseError(PhaseExec, localWorkerId, err)
+	}
+	rep.Exit = cmd.ProcessState.Sys().(syscall.WaitStatus)
+	rep.Stdout = stdout.String()
+	rep.Stderr = stderr.String()
+	rep.WorkerId = localWorkerId
+	rep.Cancelled = me.cancelled(req)
+
+	fset := me.localChanges()
+	me.sessionOutputs(fset, newManifestJob(req, localWorkerId, nil))
+	return nil
+}
+
+// localChanges updates the attribute cache for files changed on disk
+// below the writable root, and queues the changes for the workers.
+// It waits for running local jobs, so it does not see their outputs
+// half written.
+func (me *Master) localChanges() *attr.FileSet {
+	me.localMutex.Lock()
+	defer me.localMutex.Unlock()
+	fset := me.attributes.Refresh(strings.TrimLeft(me.options.WritableRoot, "/"))
+
+	// Refresh only looks at cached files.  New entries of changed
+	// directories may be cached as missing, so they are looked up
+	// explicitly.
+	var added []*attr.FileAttr
+	todo := fset.Files
+	for len(todo) > 0 {
+		f := todo[0]
+		todo = todo[1:]
+		if !f.IsDir() {
+			continue
+		}
+		for name := range f.NameModeMap {
+			p := filepath.Join(f.Path, name)
+			if me.attributes.Have(p) {
+				continue
+			}
+			a := me.uncachedGetAttr(p)
+			if a.Deletion() {
+				continue
+			}
+			added = append(added, a)
+			todo = append(todo, a)
+		}
+	}
+	if len(added) > 0 {
+		me.attributes.Update(added)
+		fset.Files = append(fset.Files, added...)
+		fset.Sort()
+	}
+	me.attributes.Queue(fset)
+	return &fset
+}
+
+// setCancelKill records the process of a cancellable job that runs
+// locally.  It returns false if the job was cancelled already.
+func (me *Master) setCancelKill(req *WorkRequest, proc *os.Process) bool {
+	me.cancelMutex.Lock()
+	defer me.cancelMutex.Unlock()
+	t := me.cancellable[req.CancelId]
+	if t == nil {
+		return true
+	}
+	t.process = proc
+	return !t.cancelled
+}
+
+// cancelled returns whether req was cancelled.
+func (me *Master) cancelled(req *WorkRequest) bool {
+	me.cancelMutex.Lock()
+	defer me.cancelMutex.Unlock()
+	t := me.cancellable[req.CancelId]
+	return t != nil && t.cancelled
+}
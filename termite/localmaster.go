@@ -32,11 +32,23 @@ func (me *LocalMaster) Run(req *WorkRequest, rep *WorkResponse) error {
 		log.Println("Ran command locally:", req.Argv)
 		return nil
 	}
+	report := req.ReportFailure
+	var err error
 	if len(req.Binary) == 0 || req.Binary[0] != '/' {
-		return fmt.Errorf("Path to binary is not absolute: %q", req.Binary)
+		err = fmt.Errorf("Path to binary is not absolute: %q", req.Binary)
+		rep.Failure = newFailureReport(phaseError(PhaseValidation, "", err), nil, rep)
+	} else {
+		err = me.master.run(req, rep)
 	}
+	if report && rep.Failure != nil {
+		return nil
+	}
+	return err
+}
 
-	return me.master.run(req, rep)
+// Cancel stops a job that was started with a CancelId.
+func (me *LocalMaster) Cancel(req *CancelRequest, rep *Empty) error {
+	return me.master.cancel(req.CancelId)
 }
 
 func (me *LocalMaster) Shutdown(req *int, rep *int) error {
@@ -51,8 +63,55 @@ func (me *LocalMaster) RefreshAttributeCache(input *int, output *int) error {
 	return nil
 }
 
+// Stats returns where the time of remote jobs went, per command.
+func (me *LocalMaster) Stats(req *Empty, rep *CommandStatsResponse) error {
+	rep.Commands = me.master.mirrors.commandStats().list()
+	return nil
+}
+
+// SetRateLimit changes how fast the master serves content to
+// workers.
+func (me *LocalMaster) SetRateLimit(req *SetRateLimitRequest, rep *SetRateLimitResponse) error {
+	rep.Previous = me.master.contentStore.RateLimit()
+	me.master.contentStore.SetRateLimit(req.BytesPerSec)
+	log.Printf("Content rate limit set to %s", formatRate(req.BytesPerSec))
+	return nil
+}
+
+// Hint passes files that upcoming jobs will probably read.  The
+// master pushes them to its mirrors in the background.
+func (me *LocalMaster) Hint(req *HintRequest, rep *HintResponse) error {
+	rep.Stats = me.master.hint(req.Hints)
+	return nil
+}
+
+// ExportManifest returns the files that the current session
+// produced.
+func (me *LocalMaster) ExportManifest(req *ManifestRequest, rep *Manifest) error {
+	m, err := me.master.Manifest(req)
+	if err != nil {
+		return err
+	}
+	*rep = *m
+	return nil
+}
+
+// ResetSession starts a new session, and returns the report of the
+// one that ended.
+func (me *LocalMaster) ResetSession(req *Empty, rep *SessionReport) error {
+	*rep = me.master.SessionReport()
+	me.master.ResetSession()
+	log.Println("Started a new session")
+	return nil
+}
+
 func (me *LocalMaster) InspectFile(req *attr.AttrRequest, rep *attr.AttrResponse) error {
-	return me.master.fileServer.GetAttr(req, rep)
+	err := me.master.fileServer.GetAttr(req, rep)
+	if len(rep.Attrs) > 1 {
+		// Leave out the siblings.
+		rep.Attrs = rep.Attrs[:1]
+	}
+	return err
 }
 
 func (me *LocalMaster) start(sock string) {
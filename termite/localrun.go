@@ -17,6 +17,14 @@ type LocalRule struct {
 	Recurse     bool
 	SkipRefresh bool
 	Debug       bool
+
+	// Estimated memory use in bytes of matching jobs that run
+	// remotely.  See WorkRequest.Memory.
+	Memory uint64
+
+	// Matching jobs must not run twice; see
+	// WorkRequest.NoSpeculation.
+	NoSpeculation bool
 }
 
 type localDecider struct {
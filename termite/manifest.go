@@ -0,0 +1,196 @@
+package termite
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hanwen/termite/attr"
+)
+
+// The master notes which job produced each file it replays during a
+// session, so release engineering can list what a build produced.
+// The bookkeeping keeps the last writer of every path, and is cheap
+// enough to be always on; Manifest assembles it on demand.  Files of
+// jobs that shared a worker file system come back in one FileSet,
+// and are attributed to the job whose response carried it.  A
+// session keeps at most MasterOptions.ManifestMaxFiles paths; start
+// a new one with ResetSession.
+
+// ManifestEntry is a file that a session created, changed or
+// deleted.
+type ManifestEntry struct {
+	// Absolute path.
+	Path string
+
+	// Content hash in hex, size and symlink target; not set for
+	// deletions.
+	Hash string `json:",omitempty"`
+	Size uint64 `json:",omitempty"`
+	Link string `json:",omitempty"`
+
+	// The command line of the job that last wrote or deleted the
+	// file, and the worker that ran it, or "" for jobs run by
+	// the master.
+	Command []string
+	Worker  string
+
+	// See WorkRequest.Fingerprint.
+	Fingerprint string `json:",omitempty"`
+}
+
+// Manifest lists the files of a session, sorted by path.
+type Manifest struct {
+	Start     time.Time
+	Files     []ManifestEntry
+	Deletions []ManifestEntry
+
+	// Paths left out because the session had more than
+	// MasterOptions.ManifestMaxFiles.
+	Dropped int `json:",omitempty"`
+}
+
+// ManifestRequest asks for the manifest of the current session.
+type ManifestRequest struct {
+	// Files matching these patterns are left out.  A pattern
+	// with a slash matches the absolute path, as for
+	// filepath.Match; otherwise it matches the base name.
+	Exclude []string
+}
+
+// manifestJob is shared by the files of a job.
+type manifestJob struct {
+	command     []string
+	worker      string
+	fingerprint string
+}
+
+// newManifestJob describes req, which ran on worker with the given
+// inputs.
+func newManifestJob(req *WorkRequest, worker string, inputs []*attr.FileAttr) *manifestJob {
+	var hashes []string
+	for _, a := range inputs {
+		hashes = append(hashes, a.Hash)
+	}
+	return &manifestJob{req.Argv, worker, req.Fingerprint(hashes)}
+}
+
+type manifestFile struct {
+	hash string
+	size uint64
+	link string
+	job  *manifestJob
+}
+
+// sessionOutputs records the files of a replayed FileSet for the
+// session manifest.  Directories are left out.
+func (me *Master) sessionOutputs(fset *attr.FileSet, job *manifestJob) {
+	if fset == nil || len(fset.Files) == 0 {
+		return
+	}
+
+	me.sessionMutex.Lock()
+	defer me.sessionMutex.Unlock()
+	s := me.session
+	for _, f := range fset.Files {
+		if f.IsDir() {
+			continue
+		}
+		_, isOutput := s.outputs[f.Path]
+		_, isDeletion := s.deletions[f.Path]
+		if !isOutput && !isDeletion && len(s.outputs)+len(s.deletions) >= me.options.ManifestMaxFiles {
+			s.dropped++
+			continue
+		}
+		if f.Deletion() {
+			delete(s.outputs, f.Path)
+			s.deletions[f.Path] = job
+		} else {
+			delete(s.deletions, f.Path)
+			s.outputs[f.Path] = manifestFile{f.Hash, f.Size, f.Link, job}
+		}
+	}
+}
+
+// Manifest returns the files produced in the current session.
+func (me *Master) Manifest(req *ManifestRequest) (*Manifest, error) {
+	for _, p := range req.Exclude {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("exclude pattern %q: %v", p, err)
+		}
+	}
+	excluded := func(p string) bool {
+		if me.excluded[p[1:]] {
+			return true
+		}
+		for _, pat := range req.Exclude {
+			name := filepath.Base(p)
+			if strings.Contains(pat, "/") {
+				name = p
+			}
+			if ok, _ := filepath.Match(pat, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	me.sessionMutex.Lock()
+	defer me.sessionMutex.Unlock()
+	s := me.session
+	m := &Manifest{Start: s.report.Start, Dropped: s.dropped}
+	for p, f := range s.outputs {
+		p = "/" + p
+		if excluded(p) {
+			continue
+		}
+		m.Files = append(m.Files, ManifestEntry{
+			Path:        p,
+			Hash:        fmt.Sprintf("%x", f.hash),
+			Size:        f.size,
+			Link:        f.link,
+			Command:     f.job.command,
+			Worker:      f.job.worker,
+			Fingerprint: f.job.fingerprint,
+		})
+	}
+	for p, job := range s.deletions {
+		p = "/" + p
+		if excluded(p) {
+			continue
+		}
+		m.Deletions = append(m.Deletions, ManifestEntry{
+			Path:        p,
+			Command:     job.command,
+			Worker:      job.worker,
+			Fingerprint: job.fingerprint,
+		})
+	}
+	sort.Sort(manifestEntries(m.Files))
+	sort.Sort(manifestEntries(m.Deletions))
+	return m, nil
+}
+
+// WriteManifest writes the manifest of the current session to the
+// file name, as JSON.
+func (me *Master) WriteManifest(name string, req *ManifestRequest) error {
+	m, err := me.Manifest(req)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, content, 0644)
+}
+
+type manifestEntries []ManifestEntry
+
+func (me manifestEntries) Len() int           { return len(me) }
+func (me manifestEntries) Less(i, j int) bool { return me[i].Path < me[j].Path }
+func (me manifestEntries) Swap(i, j int)      { me[i], me[j] = me[j], me[i] }
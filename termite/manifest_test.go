@@ -0,0 +1,95 @@
+package termite
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/termite/attr"
+	"github.com/hanwen/termite/cba"
+)
+
+func TestMasterManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "term-manifest")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(dir+"/wd", 0755)
+	master := NewMaster(&MasterOptions{
+		WritableRoot:  dir + "/wd",
+		ExposePrivate: true,
+		StoreOptions:  cba.StoreOptions{Dir: dir + "/cache"},
+	})
+
+	file := func(p string, size uint64) *attr.FileAttr {
+		return &attr.FileAttr{
+			Path: p,
+			Attr: &fuse.Attr{Mode: syscall.S_IFREG | 0644, Size: size},
+			Hash: "\x01\x02",
+		}
+	}
+	cc := []string{"cc", "-c", "a.c"}
+	master.sessionOutputs(&attr.FileSet{Files: []*attr.FileAttr{
+		{Path: "out", Attr: &fuse.Attr{Mode: syscall.S_IFDIR | 0755}},
+		file("out/a.o", 10),
+		file("out/a.d", 1),
+		file("out/tmp", 2),
+	}}, newManifestJob(&WorkRequest{Argv: cc}, "w1:1", nil))
+	rm := []string{"rm", "out/tmp", "old"}
+	master.sessionOutputs(&attr.FileSet{Files: []*attr.FileAttr{
+		{Path: "out/tmp"},
+		{Path: "old"},
+	}}, &manifestJob{rm, "", "f"})
+
+	m, err := master.Manifest(&ManifestRequest{Exclude: []string{"*.d"}})
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	wantFiles := []ManifestEntry{
+		{Path: "/out/a.o", Hash: "0102", Size: 10, Command: cc, Worker: "w1:1",
+			Fingerprint: (&WorkRequest{Argv: cc}).Fingerprint(nil)},
+	}
+	if !reflect.DeepEqual(m.Files, wantFiles) {
+		t.Errorf("got files %v, want %v", m.Files, wantFiles)
+	}
+	wantDeletions := []ManifestEntry{
+		{Path: "/old", Command: rm, Fingerprint: "f"},
+		{Path: "/out/tmp", Command: rm, Fingerprint: "f"},
+	}
+	if !reflect.DeepEqual(m.Deletions, wantDeletions) {
+		t.Errorf("got deletions %v, want %v", m.Deletions, wantDeletions)
+	}
+
+	if _, err := master.Manifest(&ManifestRequest{Exclude: []string{"["}}); err == nil {
+		t.Errorf("bad pattern accepted")
+	}
+
+	local := &LocalMaster{master: master}
+	report := SessionReport{}
+	if err := local.ResetSession(&Empty{}, &report); err != nil || report.Start.IsZero() {
+		t.Errorf("ResetSession: got %v, %v", report, err)
+	}
+	if m, _ := master.Manifest(&ManifestRequest{}); len(m.Files) != 0 || len(m.Deletions) != 0 {
+		t.Errorf("new session has manifest %v", m)
+	}
+
+	// Options.Excludes hides files, and the manifest is bounded.
+	master.excluded["out/secret"] = true
+	master.options.ManifestMaxFiles = 2
+	master.sessionOutputs(&attr.FileSet{Files: []*attr.FileAttr{
+		file("out/a.o", 10),
+		file("out/secret", 1),
+		file("out/b.o", 2),
+	}}, newManifestJob(&WorkRequest{Argv: cc}, "w1:1", nil))
+	master.sessionOutputs(&attr.FileSet{Files: []*attr.FileAttr{
+		file("out/a.o", 11),
+	}}, newManifestJob(&WorkRequest{Argv: cc}, "w1:1", nil))
+	m, _ = master.Manifest(&ManifestRequest{})
+	if len(m.Files) != 1 || m.Files[0].Path != "/out/a.o" || m.Files[0].Size != 11 || m.Dropped != 1 {
+		t.Errorf("got %+v, want only out/a.o, and 1 dropped", m)
+	}
+}
@@ -1,21 +1,24 @@
 package termite
 
 import (
+	"crypto/tls"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/splice"
 	"github.com/hanwen/termite/attr"
 	"github.com/hanwen/termite/cba"
+	"github.com/hanwen/termite/stats"
 )
 
 type Master struct {
@@ -30,6 +33,55 @@ type Master struct {
 	options       *MasterOptions
 	replayChannel chan *replayRequest
 	quit          chan int
+
+	// Jobs that can be cancelled, keyed by WorkRequest.CancelId.
+	cancelMutex sync.Mutex
+	cancellable map[string]*cancellableTask
+
+	// Slots for jobs that run on the master; see LocalFallback.
+	// Running local jobs hold localMutex for reading, and
+	// localChanges holds it for writing.
+	localSlots chan bool
+	localMutex sync.RWMutex
+
+	// Aggregate of the per-job timings.
+	timings *stats.TimerStats
+
+	// Prefetch candidates the mirror already had, contents
+	// pushed to mirrors, and files mirrors were asked to fetch in
+	// the background.
+	prefetchMutex   sync.Mutex
+	prefetchHits    int
+	prefetchSent    int
+	prefetchBytes   int
+	prefetchFetched int
+
+	// Files that upcoming jobs are likely to read.
+	hints *hintSet
+
+	// Statistics for SessionReport.
+	sessionMutex sync.Mutex
+	session      *session
+
+	// Set if connections to workers and the coordinator use TLS.
+	tlsConfig *tls.Config
+
+	// If set, called before each change of a replay; an error
+	// fails the replay.  For tests.
+	replayFault func(name string) error
+
+	// If set, makes the scheduling choices of schedhook.go.  For
+	// tests.
+	sched schedHook
+}
+
+type cancellableTask struct {
+	taskId    int
+	mirror    *mirrorConnection
+	cancelled bool
+
+	// Set for jobs that run on the master; see LocalFallback.
+	process *os.Process
 }
 
 // Immutable state and options for master.
@@ -42,6 +94,19 @@ type MasterOptions struct {
 	// How often a failed should be retried on another worker.
 	RetryCount int
 
+	// Retries wait a random part of a backoff that starts at
+	// RetryBackoff, and doubles for each retry up to
+	// RetryMaxBackoff.
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+
+	// How long to leave a worker alone after its mirror failed.
+	WorkerCoolOff time.Duration
+
+	// With RetryCount, the master keeps up to this many bytes of
+	// the stdin of a job, to replay them if it retries the job.
+	MaxStdinReplay int
+
 	// List of files that should not be served
 	Excludes []string
 
@@ -53,6 +118,10 @@ type MasterOptions struct {
 
 	Secret []byte
 
+	// Certificates for TLS connections to workers and the
+	// coordinator.
+	TLSOptions
+
 	MaxJobs int
 
 	// Turns on internal consistency checks. Expensive.
@@ -67,6 +136,13 @@ type MasterOptions struct {
 	// How long to keep mirrors alive.
 	KeepAlive time.Duration
 
+	// Default for WorkRequest.TimeoutNs.  0 means no limit.
+	JobTimeout time.Duration
+
+	// Move the mtimes of files written by jobs on workers whose
+	// clock is behind into the time the job ran.  See clock.go.
+	ClampMtimes bool
+
 	// Cache hashes in filesystem extended attributes.
 	XAttrCache bool
 
@@ -78,16 +154,87 @@ type MasterOptions struct {
 
 	// Path to the socket file.
 	Socket string
+
+	// If set, run this command (with absolute binary path) on
+	// each new mirror before it takes jobs, to prime the
+	// worker's caches.
+	WarmUp []string
+
+	// Run scripts without #! line with /bin/sh, rather than
+	// failing with an exec format error.
+	ShellFallback bool
+
+	// If set, jobs run on the master when no worker can be
+	// reached.
+	LocalFallback bool
+
+	// Maximum number of jobs that run on the master at once with
+	// LocalFallback.  Defaults to the number of CPUs.
+	LocalJobs int
+
+	// Maximum number of files in a single Mirror.Update.
+	UpdateBatchSize int
+
+	// Send each distinct job environment to a mirror only once,
+	// and refer to it by handle afterwards.
+	DedupEnv bool
+
+	// Give each job a private /tmp on the worker.
+	PrivateTmp bool
+
+	// Only use workers whose labels match, eg. "pool=ci,arch=amd64".
+	// See WorkerOptions.Labels.
+	WorkerSelector string
+
+	// If nonzero, collect the finished files of running jobs at
+	// this interval, so other jobs see them before the job
+	// completes.
+	HarvestPeriod time.Duration
+
+	// If set, jobs may also write files below this directory,
+	// outside the writable root.  The files are buffered on the
+	// worker and returned with the job's results.  It must be on
+	// the same file system as the writable root.
+	ScratchRoot string
+
+	// Resolve binaries inside the writable and source roots
+	// through the attribute cache, and have workers check that
+	// they run the same content.
+	VerifyBinaries bool
+
+	// If positive, directories with more entries are sent to
+	// workers without their listing, and workers read the listing
+	// in pages when they need it.
+	DirPageThreshold int
+
+	// If set, the session report is written to this file as JSON
+	// when the master exits.
+	SessionReportFile string
+
+	// Maximum number of paths in the session manifest.  Defaults
+	// to _MANIFEST_MAX_FILES.
+	ManifestMaxFiles int
+
+	// If set, the attribute cache is saved to this file
+	// periodically and on exit, and loaded on startup, so a
+	// restart does not rehash the tree.
+	PersistentAttrCache string
+
+	// If positive, a job that runs this many times longer than
+	// the median of its command is started on a second mirror as
+	// well, and the first to finish is used.  See speculate.go.
+	Speculate float64
+
+	// Report files that jobs read, but that changed on the master
+	// before the job finished, in WorkResponse.StaleReads.  With
+	// StrictReads, such jobs fail.  See readcheck.go.
+	CheckReads  bool
+	StrictReads bool
 }
 
 type replayRequest struct {
-	// Hash => Tempfile name.
-	NewFiles map[string][]string
-
-	// Path => Hash
-	DelFileHashes map[string]string
-	Files         []*attr.FileAttr
-	Done          chan int
+	Stage *replayStage
+	Done  chan error
 }
 
 func (me *Master) uncachedGetAttr(name string) (rep *attr.FileAttr) {
@@ -149,7 +296,14 @@ func (me *Master) fillContent(rep *attr.FileAttr) {
 		rep.ReadFromFs(me.path(rep.Path), me.options.Hash)
 	} else if rep.IsRegular() {
 		fullPath := me.path(rep.Path)
-		rep.Hash = me.contentStore.SavePath(fullPath)
+		if me.immutable(rep) {
+			// Read-only files, such as system libraries,
+			// can be linked into the store.
+			rep.Hash, _ = me.contentStore.SaveImmutablePath(fullPath)
+		}
+		if rep.Hash == "" {
+			rep.Hash = me.contentStore.SavePath(fullPath)
+		}
 		if rep.Hash == "" {
 			// Typically happens if we want to open /etc/shadow as normal user.
 			log.Println("fillContent returning EPERM for", rep.Path)
@@ -158,6 +312,18 @@ func (me *Master) fillContent(rep *attr.FileAttr) {
 	}
 }
 
+// immutable returns whether rep may be linked into the content
+// store.  Read-only files that we own, or that are in the writable
+// root, may still be made writable and changed in place, which would
+// change the stored object too.
+func (me *Master) immutable(rep *attr.FileAttr) bool {
+	if rep.Mode&0222 != 0 || rep.Uid == uint32(me.options.Uid) {
+		return false
+	}
+	root := me.options.WritableRoot
+	return root == "" || !strings.HasPrefix(me.path(rep.Path)+"/", root+"/")
+}
+
 func (me *Master) path(n string) string {
 	return "/" + n
 }
@@ -170,11 +336,35 @@ func NewMaster(options *MasterOptions) *Master {
 		taskIds:       make(chan int, 100),
 		replayChannel: make(chan *replayRequest, 1),
 		quit:          make(chan int, 0),
+		cancellable:   make(map[string]*cancellableTask),
+		timings:       stats.NewTimerStats(),
 	}
+	me.hints = newHintSet()
 	o := *options
 	if o.Period <= 0.0 {
 		o.Period = 60.0
 	}
+	if o.UpdateBatchSize <= 0 {
+		o.UpdateBatchSize = _UPDATE_BATCH_SIZE
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = _RETRY_BACKOFF
+	}
+	if o.RetryMaxBackoff < o.RetryBackoff {
+		o.RetryMaxBackoff = o.RetryBackoff * 32
+	}
+	if o.WorkerCoolOff <= 0 {
+		o.WorkerCoolOff = _WORKER_COOL_OFF
+	}
+	if o.MaxStdinReplay <= 0 {
+		o.MaxStdinReplay = _MAX_STDIN_REPLAY
+	}
+	if o.ManifestMaxFiles <= 0 {
+		o.ManifestMaxFiles = _MANIFEST_MAX_FILES
+	}
+	if o.LocalJobs <= 0 {
+		o.LocalJobs = runtime.NumCPU()
+	}
 	o.Uid = os.Getuid()
 	if o.SourceRoot != "" {
 		o.SourceRoot, _ = filepath.Abs(o.SourceRoot)
@@ -186,8 +376,20 @@ func NewMaster(options *MasterOptions) *Master {
 	if o.LogFile != "" {
 		o.LogFile, _ = filepath.Abs(o.LogFile)
 	}
+	if o.ScratchRoot != "" {
+		o.ScratchRoot, _ = filepath.Abs(o.ScratchRoot)
+		if o.ScratchRoot == "/" || strings.HasPrefix(o.ScratchRoot+"/", o.WritableRoot+"/") {
+			log.Fatalf("ScratchRoot %q must be outside the writable root", o.ScratchRoot)
+		}
+	}
 
 	me.options = &o
+	me.localSlots = make(chan bool, o.LocalJobs)
+	var err error
+	me.tlsConfig, err = o.TLSConfig()
+	if err != nil {
+		log.Fatal("TLS: ", err)
+	}
 	me.excluded = make(map[string]bool)
 	for _, e := range options.Excludes {
 		me.excluded[e] = true
@@ -196,6 +398,13 @@ func NewMaster(options *MasterOptions) *Master {
 	me.mirrors = newMirrorConnections(
 		me, options.Coordinator, options.MaxJobs)
 	me.mirrors.keepAlive = options.KeepAlive
+	me.mirrors.coolOff = o.WorkerCoolOff
+	me.mirrors.affinityRoot = o.WritableRoot
+	selector, err := ParseLabels(options.WorkerSelector)
+	if err != nil {
+		log.Fatalf("WorkerSelector: %v", err)
+	}
+	me.mirrors.selector = selector
 	me.pending = NewPendingConnections()
 	me.attributes = attr.NewAttributeCache(func(n string) *attr.FileAttr {
 		return me.uncachedGetAttr(n)
@@ -204,9 +413,13 @@ func NewMaster(options *MasterOptions) *Master {
 			fi, _ := os.Lstat(me.path(n))
 			return fuse.ToAttr(fi)
 		})
+	me.attributes.PageThreshold = options.DirPageThreshold
+	me.recoverReplays()
+	me.loadAttributes()
 	me.fileServer = attr.NewServer(me.attributes)
 	me.fileServerRpc = rpc.NewServer()
 	me.fileServerRpc.Register(me.fileServer)
+	me.ResetSession()
 
 	me.CheckPrivate()
 
@@ -223,8 +436,7 @@ func NewMaster(options *MasterOptions) *Master {
 	go func() {
 		for {
 			r := <-me.replayChannel
-			me.replayFileModifications(r.Files, r.DelFileHashes, r.NewFiles)
-			r.Done <- 1
+			r.Done <- me.applyReplay(r.Stage)
 		}
 	}()
 
@@ -286,35 +498,35 @@ func (me *Master) createMirror(addr string, jobs int) (*mirrorConnection, error)
 	}()
 
 	secret := me.options.Secret
-	conn, err := DialTypedConnection(addr, RPC_CHANNEL, secret)
+	conn, err := DialTypedConnection(addr, RPC_CHANNEL, secret, me.tlsConfig)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
 
 	rpcId := ConnectionId()
-	rpcConn, err := DialTypedConnection(addr, rpcId, secret)
+	rpcConn, err := DialTypedConnection(addr, rpcId, secret, me.tlsConfig)
 	if err != nil {
 		return nil, err
 	}
 	closeMe = append(closeMe, rpcConn)
 
 	revId := ConnectionId()
-	revConn, err := DialTypedConnection(addr, revId, secret)
+	revConn, err := DialTypedConnection(addr, revId, secret, me.tlsConfig)
 	if err != nil {
 		return nil, err
 	}
 	closeMe = append(closeMe, revConn)
 
 	contentId := ConnectionId()
-	contentConn, err := DialTypedConnection(addr, contentId, secret)
+	contentConn, err := DialTypedConnection(addr, contentId, secret, me.tlsConfig)
 	if err != nil {
 		return nil, err
 	}
 	closeMe = append(closeMe, contentConn)
 
 	revContentId := ConnectionId()
-	revContentConn, err := DialTypedConnection(addr, revContentId, secret)
+	revContentConn, err := DialTypedConnection(addr, revContentId, secret, me.tlsConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -326,6 +538,7 @@ func (me *Master) createMirror(addr string, jobs int) (*mirrorConnection, error)
 		ContentId:    contentId,
 		RevContentId: revContentId,
 		WritableRoot: me.options.WritableRoot,
+		ScratchRoot:  me.options.ScratchRoot,
 		MaxJobCount:  jobs,
 	}
 	rep := CreateMirrorResponse{}
@@ -338,77 +551,271 @@ func (me *Master) createMirror(addr string, jobs int) (*mirrorConnection, error)
 	}
 	closeMe = nil
 
-	go me.fileServerRpc.ServeConn(revConn)
-	go me.contentStore.ServeConn(revContentConn)
-
 	mc := &mirrorConnection{
-		master:             me,
-		rpcClient:          rpc.NewClient(rpcConn),
-		contentClient:      me.contentStore.NewClient(contentConn),
-		reverseConnection:  revConn,
-		reverseContentConn: revContentConn,
-		maxJobs:            rep.GrantedJobCount,
-		availableJobs:      rep.GrantedJobCount,
+		workerAddr:    addr,
+		master:        me,
+		rpcClient:     rpc.NewClient(rpcConn),
+		contentClient: me.contentStore.NewClient(contentConn),
+		reverse:       newReverseChannel(),
+		maxJobs:       rep.GrantedJobCount,
+		availableJobs: rep.GrantedJobCount,
+		maxPathLength: rep.MaxPathLength,
+		sent:          map[string]string{},
+		envs:          map[string]bool{},
 	}
 	mc.fileSetWaiter = attr.NewFileSetWaiter(func(fset attr.FileSet) error {
 		return mc.replay(fset)
 	})
+	if hook := me.sched; hook != nil {
+		mc.fileSetWaiter.Order = func(ids []int) { schedShuffle(hook, ids) }
+	}
+	mc.serveReverse(revConn, revContentConn)
+	go mc.checkReverseLoop(_REVERSE_CHECK_INTERVAL)
 
 	return mc, nil
 }
 
-func (me *Master) runOnMirror(mirror *mirrorConnection, req *WorkRequest, rep *WorkResponse) error {
+// warmUp runs the warm-up command on a new mirror. It does not count
+// towards job statistics. Its file changes are replayed like those of
+// any other job.
+func (me *Master) warmUp(mirror *mirrorConnection) error {
+	if len(me.options.WarmUp) == 0 {
+		return nil
+	}
+	req := WorkRequest{
+		TaskId: <-me.taskIds,
+		Binary: me.options.WarmUp[0],
+		Argv:   me.options.WarmUp,
+		Env:    os.Environ(),
+		Dir:    me.options.WritableRoot,
+	}
+	rep := WorkResponse{}
+	log.Printf("Warming up %s: %v", mirror.workerAddr, req.Argv)
+	mirror.fileSetWaiter.Prepare(req.TaskId)
+	err := mirror.rpcClient.Call("Mirror.Run", &req, &rep)
+	if err == nil {
+		err = mirror.fileSetWaiter.Wait(rep.FileSet, rep.TaskIds, req.TaskId)
+	}
+	if err == nil && rep.Exit.ExitStatus() != 0 {
+		log.Printf("Warm-up on %s exited with status %d: %s",
+			mirror.workerAddr, rep.Exit.ExitStatus(), rep.Stderr)
+	}
+	return err
+}
+
+// runOnMirror runs req on mirror.  It records where the time went in
+// job.  If claim is set, it is called once the job finished, and the
+// file changes are discarded unless it returns true.
+func (me *Master) runOnMirror(mirror *mirrorConnection, req *WorkRequest, rep *WorkResponse, streams *outputStreams, job *CommandStats, claim func() bool) error {
+	syncStart := time.Now()
+	for _, p := range []string{req.Dir, req.Binary} {
+		if err := mirror.checkPath(strings.TrimLeft(p, "/")); err != nil {
+			me.mirrors.jobDone(mirror)
+			return phaseError(PhaseValidation, mirror.workerAddr, err)
+		}
+	}
+	if err := mirror.waitReverse(); err != nil {
+		me.mirrors.jobDone(mirror)
+		return phaseError(PhaseScheduling, mirror.workerAddr, err)
+	}
+
+	if me.sched != nil {
+		schedYield(me.sched, schedFlush, req.TaskId)
+	}
 	me.mirrors.stats.Enter("send")
+	sendStart := time.Now()
 	err := me.attributes.Send(mirror)
+	job.Send = time.Now().Sub(sendStart)
 	me.mirrors.stats.Exit("send")
 	if err != nil {
-		return err
+		return phaseError(PhaseUpdateFlush, mirror.workerAddr, err)
 	}
 
 	defer me.mirrors.jobDone(mirror)
 
+	if !me.setCancelMirror(req, mirror) {
+		rep.Cancelled = true
+		return nil
+	}
+
 	// Tunnel stdin.
-	if req.StdinId != "" {
-		inputConn := me.pending.WaitConnection(req.StdinId)
-		destInputConn, err := DialTypedConnection(mirror.reverseConnection.RemoteAddr().String(),
-			req.StdinId, me.options.Secret)
+	var input *stdinReader
+	if streams.stdin != nil {
+		input, err = streams.stdin.reader()
 		if err != nil {
-			return err
+			return phaseError(PhaseScheduling, mirror.workerAddr, err)
+		}
+		defer input.stop()
+		destInputConn, err := DialTypedConnection(mirror.reverseAddr(),
+			req.StdinId, me.options.Secret, me.tlsConfig)
+		if err != nil {
+			return phaseError(PhaseScheduling, mirror.workerAddr, err)
 		}
 		go func() {
-			HookedCopy(destInputConn, inputConn, PrintStdinSliceLen)
+			HookedCopy(destInputConn, input, PrintStdinSliceLen)
 			destInputConn.Close()
-			inputConn.Close()
 		}()
 	}
 
+	// Tunnel stdout and stderr.
+	waitOutput, err := streams.tunnel(mirror.reverseAddr(), me.options.Secret, me.tlsConfig)
+	if err != nil {
+		return phaseError(PhaseScheduling, mirror.workerAddr, err)
+	}
+
 	log.Printf("Running task %d on %s: %v", req.TaskId, mirror.workerAddr, req.Argv)
 	if req.Debug {
 		log.Println("with environment", req.Env)
 	}
 
+	// Keep the likely inputs of the job around until it is done.
+	inputs := me.prefetchCandidates(req)
+	for _, a := range inputs {
+		me.contentStore.Ref(a.Hash)
+		me.hints.use(a.Hash)
+	}
+	defer func() {
+		for _, a := range inputs {
+			me.contentStore.Unref(a.Hash)
+		}
+	}()
+
+	me.mirrors.stats.Enter("prefetch")
+	job.Bytes += me.prefetch(mirror, req, inputs)
+	me.mirrors.stats.Exit("prefetch")
+	syncDt := time.Now().Sub(syncStart)
+
+	mirrorReq, err := me.mirrorRequest(mirror, req)
+	if err != nil {
+		waitOutput(true)
+		return phaseError(PhaseScheduling, mirror.workerAddr, err)
+	}
+
 	mirror.fileSetWaiter.Prepare(req.TaskId)
+	var harvest *harvester
+	if req.Incremental {
+		harvest = me.startHarvest(mirror, req, inputs)
+	}
 	me.mirrors.stats.Enter("remote")
-	err = mirror.rpcClient.Call("Mirror.Run", req, rep)
-	me.mirrors.stats.Exit("remote")
+	remoteStart := time.Now()
+	err = mirror.rpcClient.Call("Mirror.Run", mirrorReq, rep)
+	if err == nil && rep.Failure != nil {
+		err = failureError(rep.Failure)
+		rep.Failure = nil
+		rep.FileSet = nil
+		rep.TaskIds = nil
+	}
+	err = phaseError(PhaseExec, mirror.workerAddr, err)
+	remoteEnd := time.Now()
+	remoteDt := remoteEnd.Sub(remoteStart)
 	if err == nil {
+		me.checkWorkerClock(mirror.workerAddr, remoteStart, remoteEnd, rep)
+	}
+	job.Remote = remoteDt
+	waitOutput(err != nil)
+	me.mirrors.stats.Exit("remote")
+	me.mirrors.Lock()
+	slots := mirror.maxJobs
+	me.mirrors.Unlock()
+	if !req.forcedPlacement() {
+		me.sessionWorkerTime(mirror.workerAddr, slots, remoteDt)
+	}
+	if harvest != nil {
+		harvest.finish(err != nil || rep.Cancelled)
+		if err != nil && harvest.err != nil {
+			// The harvest failed first.
+			err = &jobError{
+				phase:  PhaseHarvest,
+				worker: mirror.workerAddr,
+				err:    fmt.Errorf("%v; then %v", harvest.err, err),
+			}
+		}
+	}
+	rep.addTiming("sync", syncDt)
+	if err == nil && req.RecordReads && !rep.Cancelled {
+		if err = phaseError(PhaseReadCheck, mirror.workerAddr, me.checkReads(rep)); err != nil {
+			mirror.fileSetWaiter.Discard(req.TaskId)
+			rep.FileSet = nil
+			return err
+		}
+	}
+	lost := err == nil && claim != nil && !claim()
+	if lost && (req.PrivateTmp || len(rep.TaskIds) <= 1) {
+		// Another attempt of the job won, and the file
+		// changes belong to this attempt only.
+		mirror.fileSetWaiter.Discard(req.TaskId)
+		rep.FileSet = nil
+		return errSpeculationLost
+	}
+	if err == nil && !lost && rep.Cancelled && len(rep.TaskIds) == 1 {
+		// The file changes belong to this job only, and
+		// nobody wants them.  If other jobs shared the file
+		// system, we can't separate them, and replay as
+		// usual.
+		mirror.fileSetWaiter.Discard(req.TaskId)
+		rep.FileSet = nil
+	} else if err == nil {
 		me.mirrors.stats.Enter("filewait")
-		err = mirror.fileSetWaiter.Wait(rep.FileSet, rep.TaskIds, req.TaskId)
+		start := time.Now()
+		if rep.FileSet != nil {
+			for _, f := range rep.FileSet.Files {
+				if f.Hash != "" {
+					job.Bytes += int64(f.Size)
+				}
+			}
+		}
+		err = phaseError(PhaseReplay, mirror.workerAddr,
+			mirror.fileSetWaiter.Wait(rep.FileSet, rep.TaskIds, req.TaskId))
+		if err == nil {
+			me.sessionOutputs(rep.FileSet, newManifestJob(req, mirror.workerAddr, inputs))
+		}
+		job.Replay = time.Now().Sub(start)
+		rep.addTiming("output", job.Replay)
 		me.mirrors.stats.Exit("filewait")
 	}
+	if err == nil && input != nil && !rep.Cancelled {
+		// The job saw the end of its stdin, but the client
+		// did not send it.
+		err = phaseError(PhaseExec, mirror.workerAddr, input.failure())
+	}
+	if e, ok := err.(*jobError); ok && harvest != nil {
+		e.filesReplayed = harvest.replayed
+	}
+	if err == nil && lost {
+		// The file system was shared with other jobs, whose
+		// changes were replayed above.
+		return errSpeculationLost
+	}
 	return err
 }
 
-func (me *Master) runOnce(req *WorkRequest, rep *WorkResponse) error {
-	mirror, err := me.mirrors.pick()
+func (me *Master) logTimings(rep *WorkResponse) {
+	for _, t := range rep.Timings {
+		me.timings.Log("Job."+t.Name, rep.Timing(t.Name))
+	}
+}
+
+// runOnce runs req on a mirror, preferring one not on the worker at
+// address avoid.
+func (me *Master) runOnce(req *WorkRequest, rep *WorkResponse, streams *outputStreams, avoid string) error {
+	start := time.Now()
+	mirror, err := me.mirrors.pickAvoiding(req, avoid)
 	if err != nil {
-		return err
+		return phaseError(PhaseScheduling, "", err)
 	}
-	err = me.runOnMirror(mirror, req, rep)
+	pickDt := time.Now().Sub(start)
+	job := CommandStats{Queue: pickDt}
+	err = me.runOnMirror(mirror, req, rep, streams, &job, nil)
+	rep.addTiming("schedule", pickDt)
 	if err != nil {
-		me.mirrors.drop(mirror, err)
+		if mirrorAtFault(err) {
+			me.mirrors.drop(mirror, err)
+		}
 		return err
 	}
+	if !req.forcedPlacement() {
+		me.mirrors.commandStats().add(req, &job)
+	}
 
 	rep.FileSet = nil
 	return err
@@ -418,169 +825,185 @@ func (me *Master) run(req *WorkRequest, rep *WorkResponse) (err error) {
 	me.mirrors.stats.Enter("run")
 	defer me.mirrors.stats.Exit("run")
 	req.TaskId = <-me.taskIds
-	if me.MaybeRunInMaster(req, rep) {
-		log.Println("Ran in master:", req.Summary())
-		return nil
+	if !req.forcedPlacement() {
+		// Debugging runs would skew the timings.
+		defer me.logTimings(rep)
 	}
-
-	if req.Worker != "" {
-		mc, err := me.mirrors.find(req.Worker)
-		if err != nil {
-			return err
-		}
-		return me.runOnMirror(mc, req, rep)
+	if me.options.ShellFallback {
+		req.ShellFallback = true
 	}
-
-	err = me.runOnce(req, rep)
-	for i := 0; i < me.options.RetryCount && err != nil; i++ {
-		log.Println("Retrying; last error:", err)
-		err = me.runOnce(req, rep)
+	if me.options.PrivateTmp {
+		req.PrivateTmp = true
+	}
+	if me.options.HarvestPeriod > 0 {
+		req.Incremental = true
+	}
+	if me.options.CheckReads || me.options.StrictReads {
+		req.RecordReads = true
 	}
+	if req.TimeoutNs == 0 {
+		req.TimeoutNs = int64(me.options.JobTimeout)
+	}
+	// Failures on the worker come back with the response.
+	req.ReportFailure = true
 
-	return err
-}
+	streams := me.waitOutputStreams(req)
+	defer streams.finish(rep)
 
-func (me *Master) replayFileModifications(infos []*attr.FileAttr, delFileHashes map[string]string, newFiles map[string][]string) {
-	for _, info := range infos {
-		name := "/" + info.Path
-		if info.Deletion() {
-			if delFileHashes[info.Path] != "" {
-				dest := fmt.Sprintf("%s/.termite-deltmp%x",
-					me.options.WritableRoot, RandomBytes(8))
-				if err := os.Rename(name, dest); err != nil {
-					log.Fatal("os.Rename:", err)
-				}
-				newFiles[delFileHashes[info.Path]] = append(newFiles[delFileHashes[info.Path]], dest)
-			} else {
-				if err := os.Remove(name); err != nil {
-					log.Fatal("os.Remove:", err)
-				}
-			}
-			continue
-		}
+	inMaster := false
+	defer func() { me.sessionJobDone(inMaster, req.forcedPlacement(), err) }()
 
-		if info.IsDir() {
-			if err := os.Mkdir(name, os.FileMode(info.Mode&07777)); err != nil {
-				// some other process may have created
-				// the dir.
-				fi, _ := os.Lstat(name)
-				if fi == nil || !fi.IsDir() {
-					log.Fatal("os.Mkdir", err)
-				}
-			}
-		}
-		if info.Hash != "" {
-			fs := newFiles[info.Hash]
-			src := fs[len(fs)-1]
-			newFiles[info.Hash] = fs[:len(fs)-1]
-			if err := os.Rename(src, name); err != nil {
-				log.Fatal("os.Rename:", err)
-			}
-		}
-		if info.Link != "" {
-			// Ignore errors.
-			os.Remove(name)
-			if err := os.Symlink(info.Link, name); err != nil {
-				log.Fatal("os.Symlink", err)
-			}
-		}
-		if info.Hash == "" && !info.IsSymlink() {
-			if err := os.Chtimes(name, info.AccessTime(), info.ModTime()); err != nil {
-				log.Fatal("os.Chtimes", err)
-			}
-			if err := os.Chmod(name, os.FileMode(info.Mode&07777)); err != nil {
-				log.Fatal("os.Chmod", err)
-			}
+	var attempts []FailureAttempt
+	defer func() {
+		if err != nil || (!rep.Cancelled && rep.Exit != 0) {
+			rep.Failure = newFailureReport(err, attempts, rep)
 		}
+	}()
+
+	if req.CancelId != "" {
+		me.cancelMutex.Lock()
+		me.cancellable[req.CancelId] = &cancellableTask{taskId: req.TaskId}
+		me.cancelMutex.Unlock()
+		defer func() {
+			me.cancelMutex.Lock()
+			delete(me.cancellable, req.CancelId)
+			me.cancelMutex.Unlock()
+		}()
+	}
 
-		// Reread FileInfo, since some filesystems (eg. ext3) do
-		// not have nanosecond timestamps.
-		//
-		// TODO - test this.
-		fi, _ := os.Lstat(name)
-		info.Attr = fuse.ToAttr(fi)
-		if info.IsRegular() && me.options.XAttrCache && info.Uid == uint32(me.options.Uid) {
-			info.WriteXAttr(name)
+	if me.MaybeRunInMaster(req, rep) {
+		log.Println("Ran in master:", req.Summary())
+		inMaster = true
+		return nil
+	}
+	if me.options.VerifyBinaries {
+		if err := me.resolveBinary(req); err != nil {
+			return phaseError(PhaseValidation, "", err)
 		}
 	}
 
-	me.attributes.Update(infos)
-	for _, v := range newFiles {
-		for _, f := range v {
-			if err := os.Remove(f); err != nil {
-				log.Fatalf("os.Remove: %v", err)
-			}
+	attempts, err = me.retry(func(avoid string) error {
+		if median, ok := me.speculationMedian(req); ok {
+			return me.runSpeculative(req, rep, streams, avoid, median)
 		}
+		return me.runOnce(req, rep, streams, avoid)
+	})
+	if err != nil && me.options.LocalFallback && errorCause(err) == errNoWorkers {
+		err = me.runLocally(req, rep, streams)
 	}
+	return err
 }
 
-func (me *Master) replay(fset attr.FileSet) {
-	// TODO - make a .termitetmp for replayed files.
-	req := replayRequest{
-		make(map[string][]string),
-		make(map[string]string),
-		fset.Files,
-		make(chan int),
-	}
-
-	haveHashes := make(map[string]int)
-	// We prepare the files before we call
-	// replayFileModifications(), to limit contention.
-	for _, info := range fset.Files {
-		if info.Deletion() {
-			a := me.attributes.Get(info.Path)
-			if !a.Deletion() && a.Hash != "" {
-				req.DelFileHashes[info.Path] = a.Hash
-				haveHashes[a.Hash]++
-			}
-			continue
-		}
-		if info.Hash == "" {
-			continue
+const (
+	_RETRY_BACKOFF    = 100 * time.Millisecond
+	_WORKER_COOL_OFF  = 30 * time.Second
+	_MAX_STDIN_REPLAY = 1 << 20
+
+	_MANIFEST_MAX_FILES = 1 << 20
+)
+
+// retry calls attempt until it succeeds, or RetryCount retries have
+// failed.  Retries wait out a backoff, and avoid the worker where the
+// previous attempt failed.  It returns the failed attempts that were
+// retried, and the last error.
+func (me *Master) retry(attempt func(avoid string) error) (retried []FailureAttempt, err error) {
+	err = attempt("")
+	for i := 0; i < me.options.RetryCount && err != nil; i++ {
+		if _, ok := errorCause(err).(*attr.PathTooLongError); ok {
+			break
 		}
-		if haveHashes[info.Hash] > 0 {
-			haveHashes[info.Hash]--
-			continue
+		if errorCause(err) == errStdinNotReplayable {
+			break
 		}
-
-		log.Printf("Prepare %x: %s", info.Hash, info.Path)
-		f, err := ioutil.TempFile(me.options.WritableRoot, ".tmp-termite")
-		if err != nil {
-			log.Fatal("TempFile", err)
+		if _, ok := errorCause(err).(*NoMatchingWorkerError); ok {
+			break
 		}
+		log.Println("Retrying; last error:", err)
+		me.sessionRetry()
+		failed := failureAttempt(err)
+		retried = append(retried, failed)
+		time.Sleep(jitteredBackoff(me.options.RetryBackoff, me.options.RetryMaxBackoff, i+1))
+		err = attempt(failed.Worker)
+	}
+	return retried, err
+}
 
-		req.NewFiles[info.Hash] = append(req.NewFiles[info.Hash], f.Name())
+// setCancelMirror records where a cancellable job runs. It returns
+// false if the job was cancelled already.
+func (me *Master) setCancelMirror(req *WorkRequest, mirror *mirrorConnection) bool {
+	me.cancelMutex.Lock()
+	defer me.cancelMutex.Unlock()
+	t := me.cancellable[req.CancelId]
+	if t == nil {
+		return true
+	}
+	t.mirror = mirror
+	return !t.cancelled
+}
 
-		var src *os.File
-		path := me.contentStore.Path(info.Hash)
-		src, err = os.Open(path)
-		if err != nil {
-			log.Panicf("cache path missing for %x: %v", info.Hash, err)
-		}
-		err = splice.CopyFds(f, src)
-		src.Close()
-		if err != nil {
-			log.Fatal("f.CopyFds", err)
-		}
+// cancel stops the job with the given cancel id.
+func (me *Master) cancel(id string) error {
+	me.cancelMutex.Lock()
+	t := me.cancellable[id]
+	if t == nil {
+		me.cancelMutex.Unlock()
+		return fmt.Errorf("no job with cancel id %q", id)
+	}
+	t.cancelled = true
+	mirror := t.mirror
+	proc := t.process
+	me.cancelMutex.Unlock()
+
+	if proc != nil {
+		log.Printf("Cancelling local task %d", t.taskId)
+		return proc.Kill()
+	}
+	if mirror == nil {
+		return nil
+	}
+	log.Printf("Cancelling task %d on %s", t.taskId, mirror.workerAddr)
+	req := CancelTaskRequest{TaskId: t.taskId}
+	return mirror.rpcClient.Call("Mirror.Cancel", &req, &Empty{})
+}
 
-		err = f.Chmod(os.FileMode(info.Attr.Mode & 07777))
-		if err != nil {
-			log.Fatal("f.Chmod", err)
-		}
-		err = f.Close()
-		if err != nil {
-			log.Fatal("f.Close", err)
-		}
-		err = os.Chtimes(f.Name(), info.AccessTime(), info.ModTime())
-		if err != nil {
-			log.Fatal("Chtimes", err)
-		}
+// linkReplayFile links the content of a read-only output to name.
+// Since the link shares mode and timestamps with the store object,
+// this is only done if nothing else links to the object.  It returns
+// false if the file should be copied instead.
+func (me *Master) linkReplayFile(info *attr.FileAttr, name string) bool {
+	if info.Mode&0222 != 0 {
+		return false
+	}
+	fi, err := os.Lstat(me.contentStore.Path(info.Hash))
+	if err != nil || fi.Sys().(*syscall.Stat_t).Nlink != 1 {
+		return false
+	}
+	if err := me.contentStore.Hardlink(info.Hash, name); err != nil {
+		log.Printf("Hardlink %x: %v", info.Hash, err)
+		return false
 	}
+	return true
+}
 
-	me.attributes.Queue(fset)
+// copyReplayFile copies the content of info to name.
+func (me *Master) copyReplayFile(info *attr.FileAttr, name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
 
-	me.replayChannel <- &req
-	<-req.Done
+	path := me.contentStore.Path(info.Hash)
+	src, err := os.Open(path)
+	if err != nil {
+		log.Panicf("cache path missing for %x: %v", info.Hash, err)
+	}
+	err = splice.CopyFds(f, src)
+	src.Close()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 func (me *Master) refreshAttributeCache() {
@@ -588,6 +1011,48 @@ func (me *Master) refreshAttributeCache() {
 	me.attributes.Queue(updated)
 }
 
+// loadAttributes fills the attribute cache from the snapshot in
+// PersistentAttrCache.  Files whose content is no longer in the
+// store are fetched again.
+func (me *Master) loadAttributes() {
+	name := me.options.PersistentAttrCache
+	if name == "" {
+		return
+	}
+	err := me.attributes.Load(name, func(a *attr.FileAttr) bool {
+		return !a.IsRegular() || me.contentStore.Has(a.Hash)
+	})
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("loading attribute cache: %v", err)
+		return
+	}
+	s := me.attributes.Stats()
+	log.Printf("Loaded %d attributes from %s, dropped %d stale ones", s.Loaded, name, s.Stale)
+}
+
+func (me *Master) saveAttributes() {
+	name := me.options.PersistentAttrCache
+	if name == "" {
+		return
+	}
+	if err := me.attributes.Save(name); err != nil {
+		log.Printf("saving attribute cache: %v", err)
+	}
+}
+
+func (me *Master) writeSessionReport() {
+	name := me.options.SessionReportFile
+	if name == "" {
+		return
+	}
+	if err := me.WriteSessionReport(name); err != nil {
+		log.Printf("writing session report: %v", err)
+	}
+}
+
 func (me *Master) fetchAll(path string) {
 	a := me.attributes.GetDir(path)
 	for n := range a.NameModeMap {
@@ -604,10 +1069,17 @@ L:
 		select {
 		case <-me.quit:
 			log.Println("quit received.")
+			me.saveAttributes()
+			me.writeSessionReport()
+			if err := me.contentStore.SaveMemoryCache(); err != nil {
+				log.Println("SaveMemoryCache:", err)
+			}
 			break L
 		case <-ticker.C:
 			log.Println("periodic household.")
 			me.mirrors.periodicHouseholding()
+			me.contentStore.StartMaintenance()
+			me.saveAttributes()
 		}
 	}
 }
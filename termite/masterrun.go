@@ -110,7 +110,12 @@ func rmMaybeMasterRun(master *Master, req *WorkRequest, rep *WorkResponse) bool
 			}
 		}
 	}
-	master.replay(fs)
+	if err := master.replay(fs); err != nil {
+		msgs = append(msgs, fmt.Sprintf("rm: %v", err))
+		status = 1
+	} else {
+		master.sessionOutputs(&fs, newManifestJob(req, "", nil))
+	}
 
 	rep.Stderr = strings.Join(msgs, "\n")
 	rep.Exit = syscall.WaitStatus(status << 8)
@@ -169,7 +174,10 @@ func mkdirParentMasterRun(master *Master, arg string, rep *WorkResponse) {
 			fs := attr.FileSet{
 				Files: []*attr.FileAttr{parent, entry},
 			}
-			master.replay(fs)
+			if err := master.replay(fs); err != nil {
+				msgs = append(msgs, fmt.Sprintf("mkdir: %v", err))
+				break
+			}
 
 			parent = entry
 		} else if dirAttr.IsDir() {
@@ -230,5 +238,8 @@ func mkdirNormalMasterRun(master *Master, arg string, rep *WorkResponse) {
 	mt := chAttr.ModTime()
 	dirAttr.SetTimes(nil, &mt, &ct)
 	fs.Files = append(fs.Files, dirAttr, chAttr)
-	master.replay(fs)
+	if err := master.replay(fs); err != nil {
+		rep.Stderr = fmt.Sprintf("mkdir: %v", err)
+		rep.Exit = syscall.WaitStatus(1 << 8)
+	}
 }
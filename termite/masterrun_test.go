@@ -8,7 +8,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/termite/attr"
+	"github.com/hanwen/termite/cba"
 )
 
 func TestEndToEndMkdirCleanPath(t *testing.T) {
@@ -225,3 +227,298 @@ func TestEndToEndRmParentTimestamp(t *testing.T) {
 			beforeTime, afterTime)
 	}
 }
+
+func TestMasterPersistentAttrCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(dir)
+	wd := dir + "/wd"
+	os.MkdirAll(wd+"/src", 0755)
+	ioutil.WriteFile(wd+"/src/hot.c", []byte("int main() {}"), 0644)
+
+	opts := MasterOptions{
+		WritableRoot:        wd,
+		ExposePrivate:       true,
+		StoreOptions:        cba.StoreOptions{Dir: dir + "/cache"},
+		PersistentAttrCache: dir + "/cache/attributes",
+	}
+	hot := strings.TrimLeft(wd, "/") + "/src/hot.c"
+
+	first := NewMaster(&opts)
+	a := first.attributes.Get(hot)
+	if a.Deletion() || a.Hash == "" {
+		t.Fatalf("Get(%q): %v", hot, a)
+	}
+	first.saveAttributes()
+
+	restarted := NewMaster(&opts)
+	if s := restarted.attributes.Stats(); s.Loaded == 0 {
+		t.Fatalf("nothing loaded: %+v", s)
+	}
+	if got := restarted.attributes.Get(hot); got.Hash != a.Hash {
+		t.Errorf("got hash %x, want %x", got.Hash, a.Hash)
+	}
+	if s := restarted.attributes.Stats(); s.Fetches != 0 {
+		t.Errorf("hot path was fetched again: %+v", s)
+	}
+}
+
+func TestEndToEndReplayHardlink(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"sh", "-c", "echo read-only artifact > ro.txt && chmod 444 ro.txt && echo writable artifact > rw.txt"},
+	})
+
+	for _, c := range []struct {
+		name   string
+		linked bool
+	}{{"ro.txt", true}, {"rw.txt", false}} {
+		a := tc.master.attributes.Get(strings.TrimLeft(tc.wd, "/") + "/" + c.name)
+		if a.Deletion() || a.Hash == "" {
+			t.Fatalf("%s: got %v", c.name, a)
+		}
+		fi, _ := os.Lstat(tc.wd + "/" + c.name)
+		objFi, _ := os.Lstat(tc.master.contentStore.Path(a.Hash))
+		if fi == nil || objFi == nil {
+			t.Fatalf("%s: missing file or object", c.name)
+		}
+		if os.SameFile(fi, objFi) != c.linked {
+			t.Errorf("%s: got linked %v, want %v", c.name, !c.linked, c.linked)
+		}
+	}
+}
+
+func TestMasterHarvestUndo(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(dir)
+	wd := dir + "/wd"
+	scratch := dir + "/scratch"
+	os.MkdirAll(wd, 0755)
+	os.MkdirAll(scratch+"/gen", 0755)
+	ioutil.WriteFile(wd+"/keep.txt", []byte("old"), 0644)
+
+	master := NewMaster(&MasterOptions{
+		WritableRoot:  wd,
+		ExposePrivate: true,
+		StoreOptions:  cba.StoreOptions{Dir: dir + "/cache"},
+	})
+	root := strings.TrimLeft(wd, "/")
+	if a := master.attributes.Get(root + "/keep.txt"); a.Deletion() {
+		t.Fatalf("keep.txt not found")
+	}
+
+	file := func(name, content string) *attr.FileAttr {
+		p := scratch + "/" + name
+		ioutil.WriteFile(p, []byte(content), 0644)
+		return &attr.FileAttr{
+			Path: root + "/" + name,
+			Attr: StatForTest(t, p),
+			Hash: master.contentStore.Save([]byte(content)),
+		}
+	}
+	genDir := &attr.FileAttr{
+		Path:        root + "/gen",
+		Attr:        StatForTest(t, scratch+"/gen"),
+		NameModeMap: map[string]fuse.FileMode{"a.txt": fuse.S_IFREG},
+	}
+
+	// A partial result of the job: a changed and a new file.
+	partial := attr.FileSet{Files: []*attr.FileAttr{
+		file("keep.txt", "new"), genDir, file("gen/a.txt", "a"),
+	}}
+	partial.Sort()
+	undo := master.undoFileSet(partial)
+	master.replay(partial)
+	if c, _ := ioutil.ReadFile(wd + "/keep.txt"); string(c) != "new" {
+		t.Fatalf("keep.txt after replay: %q", c)
+	}
+
+	// Another job puts a file in the new directory.
+	master.replay(attr.FileSet{Files: []*attr.FileAttr{file("gen/other.txt", "other")}})
+
+	// The job fails.
+	master.replay(master.pruneUndo(undo))
+	master.releaseUndo(undo)
+
+	if c, _ := ioutil.ReadFile(wd + "/keep.txt"); string(c) != "old" {
+		t.Errorf("keep.txt after revert: %q", c)
+	}
+	if fi, _ := os.Lstat(wd + "/gen/a.txt"); fi != nil {
+		t.Errorf("gen/a.txt survived the revert")
+	}
+	if fi, _ := os.Lstat(wd + "/gen/other.txt"); fi == nil {
+		t.Errorf("revert removed the file of another job")
+	}
+	if a := master.attributes.Get(root + "/gen/a.txt"); !a.Deletion() {
+		t.Errorf("attributes still have gen/a.txt: %v", a)
+	}
+}
+
+func TestMasterResolveBinary(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(dir)
+	wd := dir + "/wd"
+	os.MkdirAll(wd+"/bin", 0755)
+	ioutil.WriteFile(wd+"/bin/tool", []byte("#!/bin/sh\necho tool\n"), 0755)
+	ioutil.WriteFile(wd+"/bin/data", []byte("data"), 0644)
+	os.Symlink("tool", wd+"/bin/cc")
+	os.Symlink(wd+"/bin/cc", wd+"/abs-cc")
+	os.Symlink("/bin/sh", wd+"/bin/host-sh")
+	os.Symlink("loop", wd+"/bin/loop")
+
+	master := NewMaster(&MasterOptions{
+		WritableRoot:   wd,
+		ExposePrivate:  true,
+		VerifyBinaries: true,
+		StoreOptions:   cba.StoreOptions{Dir: dir + "/cache"},
+	})
+	toolHash := md5str("#!/bin/sh\necho tool\n")
+
+	for _, c := range []struct {
+		binary string
+		want   string
+		hash   string
+		err    bool
+	}{
+		{wd + "/bin/tool", wd + "/bin/tool", toolHash, false},
+		{wd + "/bin/cc", wd + "/bin/tool", toolHash, false},
+		{wd + "/abs-cc", wd + "/bin/tool", toolHash, false},
+		{wd + "/bin/../bin/cc", wd + "/bin/tool", toolHash, false},
+		// Outside the tree, the host path is used.
+		{"/bin/sh", "/bin/sh", "", false},
+		{wd + "/bin/host-sh", wd + "/bin/host-sh", "", false},
+		{wd + "/bin/data", "", "", true},
+		{wd + "/bin/missing", "", "", true},
+		{wd + "/bin/loop", "", "", true},
+	} {
+		req := WorkRequest{Binary: c.binary}
+		err := master.resolveBinary(&req)
+		if (err != nil) != c.err {
+			t.Errorf("%s: got error %v, want error %v", c.binary, err, c.err)
+			continue
+		}
+		if !c.err && (req.Binary != c.want || req.BinaryHash != c.hash) {
+			t.Errorf("%s: got %s (%x), want %s (%x)", c.binary, req.Binary, req.BinaryHash, c.want, c.hash)
+		}
+	}
+}
+
+func TestMasterLocalFallback(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(dir)
+	wd := dir + "/wd"
+	os.MkdirAll(wd, 0755)
+	ioutil.WriteFile(wd+"/old.txt", []byte("old"), 0644)
+
+	master := NewMaster(&MasterOptions{
+		WritableRoot:  wd,
+		ExposePrivate: true,
+		StoreOptions:  cba.StoreOptions{Dir: dir + "/cache"},
+		LocalFallback: true,
+	})
+	master.attributes.NegativeTTL = time.Hour
+	root := strings.TrimLeft(wd, "/")
+	if a := master.attributes.Get(root + "/old.txt"); a.Deletion() {
+		t.Fatalf("old.txt not found")
+	}
+	if a := master.attributes.Get(root + "/new.txt"); !a.Deletion() {
+		t.Fatalf("new.txt exists before the job")
+	}
+
+	req := &WorkRequest{
+		Binary: "/bin/sh",
+		Argv:   []string{"sh", "-c", "echo out; rm old.txt; echo new > new.txt; mkdir sub; echo f > sub/f"},
+		Dir:    wd,
+		Env:    os.Environ(),
+	}
+	rep := &WorkResponse{}
+	if err := master.run(req, rep); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if rep.Exit != 0 || rep.Stdout != "out\n" || rep.WorkerId != localWorkerId {
+		t.Errorf("got exit %v, stdout %q, worker %q", rep.Exit, rep.Stdout, rep.WorkerId)
+	}
+
+	if a := master.attributes.Get(root + "/old.txt"); !a.Deletion() {
+		t.Errorf("old.txt still cached: %v", a)
+	}
+	for name, content := range map[string]string{"new.txt": "new\n", "sub/f": "f\n"} {
+		a := master.attributes.Get(root + "/" + name)
+		if a.Deletion() || a.Hash != master.contentStore.Save([]byte(content)) {
+			t.Errorf("%s: got %v, want hash of %q", name, a, content)
+		}
+	}
+
+	m, err := master.Manifest(&ManifestRequest{})
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	found := false
+	for _, f := range m.Files {
+		if f.Path == wd+"/new.txt" && f.Worker == localWorkerId {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("new.txt not in manifest: %+v", m.Files)
+	}
+}
+
+func TestMasterLocalFallbackTimeout(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(dir)
+	wd := dir + "/wd"
+	os.MkdirAll(wd, 0755)
+
+	master := NewMaster(&MasterOptions{
+		WritableRoot:  wd,
+		ExposePrivate: true,
+		StoreOptions:  cba.StoreOptions{Dir: dir + "/cache"},
+		LocalFallback: true,
+		LocalJobs:     1,
+	})
+	req := &WorkRequest{
+		Binary:    "/bin/sh",
+		Argv:      []string{"sh", "-c", "sleep 10"},
+		Dir:       wd,
+		Env:       os.Environ(),
+		TimeoutNs: int64(100 * time.Millisecond),
+	}
+	rep := &WorkResponse{}
+	if err := master.run(req, rep); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if !rep.TimedOut || rep.Exit == 0 {
+		t.Errorf("got timed out %v, exit %v; want a timeout", rep.TimedOut, rep.Exit)
+	}
+}
+
+func TestMasterCopiesOwnReadOnlyFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "termite")
+	defer os.RemoveAll(dir)
+	wd := dir + "/wd"
+	os.MkdirAll(wd, 0755)
+	ioutil.WriteFile(wd+"/ro.txt", []byte("read-only"), 0444)
+
+	master := NewMaster(&MasterOptions{
+		WritableRoot:  wd,
+		ExposePrivate: true,
+		StoreOptions:  cba.StoreOptions{Dir: dir + "/cache"},
+	})
+	a := master.attributes.Get(strings.TrimLeft(wd, "/") + "/ro.txt")
+	if a.Deletion() || a.Hash == "" {
+		t.Fatalf("ro.txt not found: %v", a)
+	}
+
+	// The file can be made writable and changed; the stored
+	// object must not change with it.
+	fi, _ := os.Stat(wd + "/ro.txt")
+	stored, err := os.Stat(master.contentStore.Path(a.Hash))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if os.SameFile(fi, stored) {
+		t.Errorf("read-only file in the writable root was linked into the store")
+	}
+}
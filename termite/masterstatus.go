@@ -1,10 +1,13 @@
 package termite
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"strings"
 
 	"github.com/hanwen/termite/cba"
 )
@@ -53,6 +56,7 @@ func (me *Master) statusHandler(w http.ResponseWriter, req *http.Request) {
 
 	msgs := me.fileServer.TimingMessages()
 	msgs = append(msgs, me.contentStore.TimingMessages()...)
+	msgs = append(msgs, me.timings.TimingMessages()...)
 	fmt.Fprintf(w, "<ul>")
 	for _, msg := range msgs {
 		fmt.Fprintf(w, "<li>%s", msg)
@@ -61,10 +65,41 @@ func (me *Master) statusHandler(w http.ResponseWriter, req *http.Request) {
 
 	me.mirrors.stats.WriteHttp(w)
 
+	attrStats := me.attributes.Stats()
+	fmt.Fprintf(w, "<p>Attribute cache: %d fetched, %d loaded from snapshot, %d stale in snapshot",
+		attrStats.Fetches, attrStats.Loaded, attrStats.Stale)
+
+	me.prefetchMutex.Lock()
+	fmt.Fprintf(w, "<p>Prefetch: %d files already on the worker, %d files (%d bytes) pushed, %d fetched in the background",
+		me.prefetchHits, me.prefetchSent, me.prefetchBytes, me.prefetchFetched)
+	me.prefetchMutex.Unlock()
+
+	if hits, bytes := me.contentStore.MemoryHitRate(); hits > 0 {
+		fmt.Fprintf(w, "<p>Content memory cache: %.0f%% of reads, %.0f%% of bytes",
+			100*hits, 100*bytes)
+	}
+
+	if h := me.hints.getStats(); h.Received > 0 {
+		fmt.Fprintf(w, "<p>Hints: %d received, %d dropped, %d files resolved, %d of which jobs read",
+			h.Received, h.Dropped, h.Resolved, h.Used)
+	}
+
 	me.writeThroughput(w)
+	me.mirrors.commandStats().writeHttp(w)
 
 	fmt.Fprintf(w, "<p>Master parallelism (--jobs): %d. Reserved job slots: %d",
 		me.mirrors.wantedMaxJobs, me.mirrors.maxJobs())
+
+	fmt.Fprintf(w, "<ul>")
+	for _, m := range me.mirrors.status() {
+		fmt.Fprintf(w, "<li>%s: %d of %d jobs available, reverse connection %s (re-established %d times)",
+			m.Worker, m.AvailableJobs, m.MaxJobs, m.Reverse, m.ReverseReconnects)
+	}
+	fmt.Fprintf(w, "</ul>")
+	fmt.Fprintf(w, "<p>Retries this session: %d", me.sessionRetries())
+	if cooling := me.mirrors.workersCoolingOff(); len(cooling) > 0 {
+		fmt.Fprintf(w, "<p>Left alone after a failure: %s", strings.Join(cooling, ", "))
+	}
 	fmt.Fprintf(w, "</body></html>")
 }
 
@@ -86,14 +121,49 @@ func (me *Master) writeThroughput(w http.ResponseWriter) {
 	}
 }
 
+func (me *Master) statusJsonHandler(w http.ResponseWriter, req *http.Request) {
+	status := MasterStatusResponse{
+		Mirrors:    me.mirrors.status(),
+		Retries:    me.sessionRetries(),
+		CoolingOff: me.mirrors.workersCoolingOff(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&status); err != nil {
+		log.Println("status.json:", err)
+	}
+}
+
+func (me *Master) commandsJsonHandler(w http.ResponseWriter, req *http.Request) {
+	status := CommandStatsResponse{
+		Commands: me.mirrors.commandStats().list(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&status); err != nil {
+		log.Println("commands.json:", err)
+	}
+}
+
 func (me *Master) ServeHTTP(port int) {
 	http.HandleFunc("/",
 		func(w http.ResponseWriter, req *http.Request) {
 			me.statusHandler(w, req)
 		})
+	http.HandleFunc("/status.json",
+		func(w http.ResponseWriter, req *http.Request) {
+			me.statusJsonHandler(w, req)
+		})
+	http.HandleFunc("/commands.json",
+		func(w http.ResponseWriter, req *http.Request) {
+			me.commandsJsonHandler(w, req)
+		})
 	addr := fmt.Sprintf(":%d", port)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Println("http listen error:", err)
+		return
+	}
 	log.Println("HTTP status on", addr)
-	err := http.ListenAndServe(addr, nil)
+	err = serveHTTP(l, nil, me.tlsConfig)
 	if err != nil {
 		log.Println("http serve error:", err)
 	}
@@ -0,0 +1,178 @@
+package termite
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The coordinator and the workers serve /metrics for dashboards, in
+// the Prometheus text exposition format.  The format is simple
+// enough to write by hand, which saves a client library dependency.
+// All metrics are gauges or counters with the prefix termite_.
+
+const _METRICS_CONTENT_TYPE = "text/plain; version=0.0.4"
+
+// metricsWriter collects samples in the text format.  Samples of a
+// metric must be added together, after its HELP and TYPE lines.
+type metricsWriter struct {
+	buf  bytes.Buffer
+	last string
+}
+
+// add writes a sample.  Labels are pairs of names and values.
+func (me *metricsWriter) add(name, kind, help string, value float64, labels ...string) {
+	name = "termite_" + name
+	if name != me.last {
+		fmt.Fprintf(&me.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		me.last = name
+	}
+	me.buf.WriteString(name)
+	if len(labels) > 0 {
+		var pairs []string
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], escapeLabel(labels[i+1])))
+		}
+		me.buf.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	fmt.Fprintf(&me.buf, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (me *metricsWriter) gauge(name, help string, value float64, labels ...string) {
+	me.add(name, "gauge", help, value, labels...)
+}
+
+func (me *metricsWriter) counter(name, help string, value float64, labels ...string) {
+	me.add(name, "counter", help, value, labels...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (me *metricsWriter) serve(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", _METRICS_CONTENT_TYPE)
+	if _, err := w.Write(me.buf.Bytes()); err != nil {
+		log.Println("metrics:", err)
+	}
+}
+
+func (me *Coordinator) metricsHandler(w http.ResponseWriter, req *http.Request) {
+	me.mutex.Lock()
+	capacity := me.currentCapacity(time.Now())
+	var workers []Registration
+	for _, w := range me.workers {
+		workers = append(workers, w.Registration)
+	}
+	me.mutex.Unlock()
+	sort.Sort(registrationsByAddress(workers))
+
+	m := &metricsWriter{}
+	m.gauge("coordinator_workers", "Registered workers.", float64(capacity.Workers))
+	m.gauge("coordinator_job_slots", "Job slots of the registered workers.", float64(capacity.Available))
+	m.gauge("coordinator_jobs_running", "Jobs running on the registered workers.", float64(capacity.Running))
+	m.gauge("coordinator_jobs_wanted", "Job slots that masters want.", float64(capacity.Wanted))
+	m.gauge("coordinator_jobs_queued", "Jobs that masters have queued.", float64(capacity.Queued))
+
+	type perWorker struct {
+		name, kind, help string
+		value            func(r *Registration) float64
+	}
+	for _, p := range []perWorker{
+		{"worker_max_jobs", "gauge", "Job slots of the worker.",
+			func(r *Registration) float64 { return float64(r.MaxJobs) }},
+		{"worker_jobs_running", "gauge", "Jobs running on the worker.",
+			func(r *Registration) float64 { return float64(r.RunningJobs) }},
+		{"worker_mem_available_bytes", "gauge", "Memory available on the worker.",
+			func(r *Registration) float64 { return float64(r.MemAvailable) }},
+		{"worker_disk_available_bytes", "gauge", "Free space for the content store of the worker.",
+			func(r *Registration) float64 { return float64(r.DiskAvailable) }},
+		{"worker_cache_received_bytes_total", "counter", "Content store bytes fetched by the worker.",
+			func(r *Registration) float64 { return float64(r.CacheBytesReceived) }},
+		{"worker_cache_served_bytes_total", "counter", "Content store bytes served by the worker.",
+			func(r *Registration) float64 { return float64(r.CacheBytesServed) }},
+		{"worker_resource_kills_total", "counter", "Jobs killed for exceeding resource limits.",
+			func(r *Registration) float64 { return float64(r.ResourceKills) }},
+	} {
+		for i := range workers {
+			m.add(p.name, p.kind, p.help, p.value(&workers[i]), "worker", workers[i].Address)
+		}
+	}
+	m.serve(w)
+}
+
+type registrationsByAddress []Registration
+
+func (me registrationsByAddress) Len() int           { return len(me) }
+func (me registrationsByAddress) Less(i, j int) bool { return me[i].Address < me[j].Address }
+func (me registrationsByAddress) Swap(i, j int)      { me[i], me[j] = me[j], me[i] }
+
+func serveMetrics(worker *Worker, w http.ResponseWriter, req *http.Request) {
+	status := WorkerStatusResponse{}
+	if err := worker.Status(&WorkerStatusRequest{}, &status); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+
+	m := &metricsWriter{}
+	m.gauge("worker_max_jobs", "Job slots of the worker.", float64(status.MaxJobCount))
+	m.gauge("worker_accepting", "Whether the worker accepts jobs.", boolGauge(status.Accepting))
+	m.gauge("worker_mirrors", "Mirrors serving masters.", float64(len(status.MirrorStatus)))
+	running, waiting, background := 0, 0, 0
+	for _, s := range status.MirrorStatus {
+		for _, fs := range s.Fses {
+			running += len(fs.Tasks)
+		}
+		waiting += s.WaitingTasks
+		background += len(s.Background)
+	}
+	m.gauge("worker_jobs_running", "Jobs running on the worker.", float64(running))
+	m.gauge("worker_jobs_waiting", "Jobs waiting for a file system.", float64(waiting))
+	m.gauge("worker_background_processes", "Processes left running by jobs.", float64(background))
+	for i, name := range status.PhaseNames {
+		if i < len(status.PhaseCounts) {
+			m.gauge("worker_phase_jobs", "Jobs in each phase.", float64(status.PhaseCounts[i]), "phase", name)
+		}
+	}
+	m.counter("worker_resource_kills_total", "Jobs killed for exceeding resource limits.", float64(status.ResourceKills))
+	m.counter("worker_job_panics_total", "Jobs that failed with a panic in the worker.", float64(status.JobPanics))
+	m.gauge("worker_disk_available_bytes", "Free space for the content store.", float64(status.DiskAvailable))
+	m.gauge("worker_temp_disk_available_bytes", "Free space for the temporary directory.", float64(status.TempDiskAvailable))
+
+	cpu := status.TotalCpu
+	m.counter("worker_cpu_seconds_total", "CPU time of the worker and its children.", cpu.SelfCpu.Seconds(), "process", "self", "mode", "user")
+	m.counter("worker_cpu_seconds_total", "", cpu.SelfSys.Seconds(), "process", "self", "mode", "system")
+	m.counter("worker_cpu_seconds_total", "", cpu.ChildCpu.Seconds(), "process", "children", "mode", "user")
+	m.counter("worker_cpu_seconds_total", "", cpu.ChildSys.Seconds(), "process", "children", "mode", "system")
+	m.gauge("worker_heap_bytes", "Heap of the worker process.", float64(status.MemStat.HeapInuse), "state", "inuse")
+	m.gauge("worker_heap_bytes", "", float64(status.MemStat.HeapIdle), "state", "idle")
+
+	c := status.ContentStats
+	m.gauge("content_objects", "Objects in the content store.", float64(c.Count))
+	m.gauge("content_bytes", "Size of the content store on disk.", float64(c.Bytes))
+	m.gauge("content_fetches_in_flight", "Fetches from other stores in progress.", float64(c.FetchesInFlight))
+	m.counter("content_received_bytes_total", "Bytes fetched from other stores.", float64(c.BytesReceived))
+	m.counter("content_served_bytes_total", "Bytes served to other stores.", float64(c.BytesServed))
+	m.counter("content_lookups_total", "Lookups in the content store.", float64(c.Lookups))
+	m.counter("content_hits_total", "Lookups found in the content store.", float64(c.Hits))
+	m.gauge("content_hit_ratio", "Fraction of lookups found in the content store.", c.HitRate())
+	hits, hitBytes := worker.content.MemoryHitRate()
+	m.gauge("content_memory_hit_ratio", "Fraction of reads served from the memory cache.", hits, "by", "reads")
+	m.gauge("content_memory_hit_ratio", "", hitBytes, "by", "bytes")
+	m.serve(w)
+}
@@ -0,0 +1,82 @@
+package termite
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMetricsWriter(t *testing.T) {
+	m := &metricsWriter{}
+	m.gauge("a", "First.", 1.5)
+	m.counter("b_total", "Second.", 3, "x", `q"\`)
+	m.counter("b_total", "", 4, "x", "y")
+	want := `# HELP termite_a First.
+# TYPE termite_a gauge
+termite_a 1.5
+# HELP termite_b_total Second.
+# TYPE termite_b_total counter
+termite_b_total{x="q\"\\"} 3
+termite_b_total{x="y"} 4
+`
+	if got := m.buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCoordinatorMetrics(t *testing.T) {
+	c := NewCoordinator(&CoordinatorOptions{})
+	for a, running := range map[string]int{"w2:1": 1, "w1:1": 2} {
+		c.workers[a] = &WorkerRegistration{
+			Registration: Registration{
+				Address:     a,
+				MaxJobs:     4,
+				RunningJobs: running,
+			},
+		}
+	}
+
+	w := httptest.NewRecorder()
+	c.metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, l := range []string{
+		"termite_coordinator_workers 2\n",
+		"termite_coordinator_job_slots 8\n",
+		"termite_coordinator_jobs_running 3\n",
+		"termite_worker_jobs_running{worker=\"w1:1\"} 2\ntermite_worker_jobs_running{worker=\"w2:1\"} 1\n",
+	} {
+		if !strings.Contains(body, l) {
+			t.Errorf("missing %q in\n%s", l, body)
+		}
+	}
+	if ct := w.Header().Get("Content-Type"); ct != _METRICS_CONTENT_TYPE {
+		t.Errorf("got content type %q", ct)
+	}
+}
+
+func TestWorkerMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "term-metrics")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := WorkerOptions{TempDir: dir, Jobs: 3}
+	opts.Dir = dir + "/cache"
+	worker := NewWorker(&opts)
+
+	w := httptest.NewRecorder()
+	serveMetrics(worker, w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, l := range []string{
+		"termite_worker_max_jobs 3\n",
+		"termite_worker_mirrors 0\n",
+		"# TYPE termite_content_served_bytes_total counter\n",
+		"termite_content_memory_hit_ratio{by=\"bytes\"} 0\n",
+	} {
+		if !strings.Contains(body, l) {
+			t.Errorf("missing %q in\n%s", l, body)
+		}
+	}
+}
@@ -6,19 +6,22 @@ import (
 	"net"
 	"net/rpc"
 	"sync"
+	"time"
 
 	"github.com/hanwen/termite/attr"
 )
 
+const _CANCELLED_IDS = 1024
+
 // State associated with one master.
 type Mirror struct {
-	worker         *Worker
-	rpcConn        net.Conn
-	contentConn    net.Conn
-	revContentConn net.Conn
+	worker      *Worker
+	rpcConn     net.Conn
+	contentConn net.Conn
 
 	rpcFs        *RpcFs
 	writableRoot string
+	scratchRoot  string
 
 	// key in Worker's map.
 	key string
@@ -32,26 +35,48 @@ type Mirror struct {
 	activeFses map[*workerFuseFs]bool
 	accepting  bool
 	killed     bool
+
+	// Tasks that were cancelled before they got a file system.
+	// A cancel may also arrive after its task finished, so the
+	// ids are kept in two generations, like PendingConnections.used.
+	cancelledIds map[int]bool
+	cancelledOld map[int]bool
+
+	// Environments registered by the master, keyed by handle.
+	envs map[string][]string
+
+	// Processes that tasks were allowed to leave running, keyed
+	// by pid.
+	background map[int]*backgroundProcess
+
+	// Holds the processes of the jobs, if there are mirror
+	// limits; see mirrorcgroup.go.
+	cgroup *mirrorCgroup
 }
 
 func NewMirror(worker *Worker, rpcConn, revConn, contentConn, revContentConn net.Conn) *Mirror {
 	log.Println("Mirror for", rpcConn)
 
 	mirror := &Mirror{
-		activeFses:     map[*workerFuseFs]bool{},
-		rpcConn:        rpcConn,
-		contentConn:    contentConn,
-		revContentConn: revContentConn,
-		worker:         worker,
-		accepting:      true,
+		activeFses:   map[*workerFuseFs]bool{},
+		cancelledIds: map[int]bool{},
+		envs:         map[string][]string{},
+		background:   map[int]*backgroundProcess{},
+		rpcConn:      rpcConn,
+		contentConn:  contentConn,
+		worker:       worker,
+		accepting:    true,
 	}
 	_, portString, _ := net.SplitHostPort(worker.listener.Addr().String())
 	id := Hostname + ":" + portString
 	mirror.cond = sync.NewCond(&mirror.fsMutex)
+	mirror.cgroup = worker.newMirrorCgroup()
 	attrClient := attr.NewClient(revConn, id)
-	mirror.rpcFs = NewRpcFs(attrClient, worker.content, revContentConn)
+	mirror.rpcFs = NewRpcFs(attrClient, worker.content, revContentConn, worker.options.LocalPrefixes)
 	mirror.rpcFs.id = id
+	mirror.rpcFs.tempDir = worker.options.TempDir
 	mirror.rpcFs.attr.Paranoia = worker.options.Paranoia
+	mirror.rpcFs.attr.NegativeTTL = worker.options.NegativeAttrTTL
 
 	go mirror.serveRpc()
 	return mirror
@@ -84,7 +109,7 @@ func (me *Mirror) Shutdown(aggressive bool) {
 
 	for fs := range me.activeFses {
 		if len(fs.tasks) == 0 {
-			fs.Stop()
+			me.stopFs(fs)
 			delete(me.activeFses, fs)
 		}
 	}
@@ -103,6 +128,7 @@ func (me *Mirror) Shutdown(aggressive bool) {
 
 	me.rpcConn.Close()
 	me.contentConn.Close()
+	me.cgroup.remove()
 }
 
 func (me *Mirror) runningCount() int {
@@ -129,15 +155,29 @@ func (me *Mirror) newFs(t *WorkerTask) (fs *workerFuseFs, err error) {
 	}
 	me.waiting--
 
+	if me.cancelledIds[t.req.TaskId] || me.cancelledOld[t.req.TaskId] {
+		t.cancelled = true
+		me.forgetCancel(t.req.TaskId)
+	}
+
 	if !me.accepting {
 		return nil, ShuttingDownError
 	}
 
+	// Harvested files and reads can only be attributed to the
+	// task if it has the file system to itself.
+	private := t.req.PrivateTmp || t.req.Incremental || t.req.RecordReads
 	for fs := range me.activeFses {
-		if !fs.reaping && len(fs.taskIds) < me.worker.options.ReapCount {
-			fs.addTask(t)
-			return fs, nil
+		if fs.reaping || fs.private || fs.retired || len(fs.taskIds) >= me.worker.options.ReapCount {
+			continue
+		}
+		if private && len(fs.tasks) > 0 {
+			continue
 		}
+		fs.private = private
+		fs.addTask(t)
+		me.worker.reporter.Trigger()
+		return fs, nil
 	}
 	fs, err = me.newWorkerFuseFs()
 	if err != nil {
@@ -145,15 +185,19 @@ func (me *Mirror) newFs(t *WorkerTask) (fs *workerFuseFs, err error) {
 	}
 
 	me.prepareFs(fs)
+	fs.private = private
 	fs.addTask(t)
 	me.activeFses[fs] = true
+	me.worker.reporter.Trigger()
 	return fs, nil
 }
 
 // Must hold lock.
 func (me *Mirror) prepareFs(fs *workerFuseFs) {
 	fs.reaping = false
+	fs.private = false
 	fs.taskIds = make([]int, 0, me.worker.options.ReapCount)
+	fs.reads.reset()
 }
 
 func (me *Mirror) considerReap(fs *workerFuseFs, task *WorkerTask) bool {
@@ -164,15 +208,21 @@ func (me *Mirror) considerReap(fs *workerFuseFs, task *WorkerTask) bool {
 		fs.reaping = true
 	}
 	me.cond.Broadcast()
+	me.worker.reporter.Trigger()
 	return fs.reaping
 }
 
-func (me *Mirror) reapFuse(fs *workerFuseFs) (results *attr.FileSet, taskIds []int) {
+func (me *Mirror) reapFuse(fs *workerFuseFs) (results *attr.FileSet, taskIds []int, open []string) {
 	log.Printf("Reaping fuse FS %v", fs.id)
 	ids := fs.taskIds[:]
-	results = me.fillReply(fs)
 
-	return results, ids
+	// Saving the results competes with maintenance for the disk.
+	// fillReply panics on errors, which Harvest recovers from.
+	me.worker.content.PauseMaintenance()
+	defer me.worker.content.ResumeMaintenance()
+	results, open = me.fillReply(fs)
+
+	return results, ids, open
 }
 
 func (me *Mirror) returnFs(fs *workerFuseFs) {
@@ -182,17 +232,60 @@ func (me *Mirror) returnFs(fs *workerFuseFs) {
 	if fs.reaping {
 		me.prepareFs(fs)
 	}
+	if fs.tmpBroken {
+		fs.retired = true
+	}
 
 	fs.SetDebug(false)
-	if !me.accepting {
-		fs.Stop()
+	if !me.accepting || (fs.retired && len(fs.tasks) == 0) {
+		me.stopFs(fs)
 		delete(me.activeFses, fs)
 		me.cond.Broadcast()
 	}
 }
 
 func (me *Mirror) Update(req *UpdateRequest, rep *UpdateResponse) error {
-	me.updateFiles(req.Files)
+	files, err := req.files()
+	if err != nil {
+		return err
+	}
+	me.updateFiles(files)
+	return nil
+}
+
+// Cancel kills the process group of the given task. If the task has
+// not started yet, it will not run at all.
+func (me *Mirror) Cancel(req *CancelTaskRequest, rep *Empty) error {
+	me.fsMutex.Lock()
+	defer me.fsMutex.Unlock()
+	for fs := range me.activeFses {
+		for t := range fs.tasks {
+			if t.req.TaskId == req.TaskId {
+				t.cancel()
+				return nil
+			}
+		}
+	}
+	if len(me.cancelledIds) >= _CANCELLED_IDS {
+		me.cancelledOld = me.cancelledIds
+		me.cancelledIds = map[int]bool{}
+	}
+	me.cancelledIds[req.TaskId] = true
+	return nil
+}
+
+// forgetCancel drops a recorded cancel for the given task. Must be
+// called with fsMutex held.
+func (me *Mirror) forgetCancel(id int) {
+	delete(me.cancelledIds, id)
+	delete(me.cancelledOld, id)
+}
+
+// HaveHashes reports which of the requested hashes are in the
+// worker's content store, so the master can check a whole FileSet in
+// a single round trip.
+func (me *Mirror) HaveHashes(req *HaveHashesRequest, rep *HaveHashesResponse) error {
+	rep.Have = me.worker.content.HasHashes(req.Hashes)
 	return nil
 }
 
@@ -208,17 +301,45 @@ func (me *Mirror) updateFiles(attrs []*attr.FileAttr) {
 }
 
 func (me *Mirror) Run(req *WorkRequest, rep *WorkResponse) error {
+	received, _ := me.worker.content.Totals()
+	err := me.runRecovered(req, rep)
+
+	// The task is done, so a cancel for it no longer applies.
+	me.fsMutex.Lock()
+	me.forgetCancel(req.TaskId)
+	me.fsMutex.Unlock()
+	if err == nil || !req.ReportFailure {
+		return err
+	}
+	rep.Failure = newFailureReport(phaseError(PhaseExec, me.worker.listener.Addr().String(), err), nil, rep)
+	now, _ := me.worker.content.Totals()
+	rep.Failure.BytesFetched = now - received
+	return nil
+}
+
+func (me *Mirror) run(req *WorkRequest, rep *WorkResponse) error {
 	me.worker.stats.Enter("run")
 	log.Print("Received request", req)
 
+	addr := me.worker.listener.Addr().String()
+	if err := me.resolveEnv(req); err != nil {
+		return phaseError(PhaseValidation, addr, err)
+	}
+	if err := me.checkBinary(req); err != nil {
+		return phaseError(PhaseValidation, addr, err)
+	}
+
 	// Don't run me.updateFiles() as we don't want to issue
 	// unneeded cache invalidations.
 	task, err := me.newWorkerTask(req, rep)
 	if err != nil {
 		return err
 	}
+	defer task.abandonOnPanic()
 
+	rep.WorkerStart = time.Now()
 	err = task.Run()
+	rep.WorkerEnd = time.Now()
 	if err != nil {
 		log.Println("task.Run:", err)
 		return err
@@ -229,7 +350,7 @@ func (me *Mirror) Run(req *WorkRequest, rep *WorkResponse) error {
 	me.worker.stats.Exit("run")
 
 	if me.killed {
-		return fmt.Errorf("killed worker %s", me.worker.listener.Addr().String())
+		return fmt.Errorf("killed worker %s", addr)
 	}
 	return nil
 }
@@ -238,7 +359,7 @@ const _DELETIONS = "DELETIONS"
 
 func (me *Mirror) newWorkerFuseFs() (*workerFuseFs, error) {
 	f, err := newWorkerFuseFs(me.worker.options.TempDir, me.rpcFs, me.writableRoot,
-		me.worker.options.User)
+		me.scratchRoot, me.worker.options.User, me.worker.options.ProcFiles)
 	if err != nil {
 		return nil, err
 	}
@@ -249,16 +370,24 @@ func (me *Mirror) newWorkerFuseFs() (*workerFuseFs, error) {
 }
 
 func (me *Mirror) newWorkerTask(req *WorkRequest, rep *WorkResponse) (*WorkerTask, error) {
-	var stdin net.Conn
+	var stdin, stdout, stderr net.Conn
 	if req.StdinId != "" {
 		stdin = me.worker.pending.WaitConnection(req.StdinId)
 	}
+	if req.StdoutId != "" {
+		stdout = me.worker.pending.WaitConnection(req.StdoutId)
+	}
+	if req.StderrId != "" {
+		stderr = me.worker.pending.WaitConnection(req.StderrId)
+	}
 	task := &WorkerTask{
-		req:       req,
-		rep:       rep,
-		stdinConn: stdin,
-		mirror:    me,
-		taskInfo:  fmt.Sprintf("%v, dir %v", req.Argv, req.Dir),
+		req:        req,
+		rep:        rep,
+		stdinConn:  stdin,
+		stdoutConn: stdout,
+		stderrConn: stderr,
+		mirror:     me,
+		taskInfo:   fmt.Sprintf("%v, dir %v", req.Argv, req.Dir),
 	}
 	return task, nil
 }
@@ -0,0 +1,151 @@
+package termite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+)
+
+// The per-job limits of limits.go do not stop a master from filling
+// the worker with jobs that together exhaust its memory.  With
+// WorkerOptions.MaxMirrorMemory or MirrorCPUShares, the worker puts
+// the jobs of each mirror in a cgroup of its own below
+// WorkerOptions.CgroupDir, so a runaway link step of one master
+// cannot take down the mirrors of the others.  The worker never
+// touches cgroups it was not given: the administrator delegates
+// CgroupDir to it, with the memory and cpu controllers enabled for
+// its children.  CgroupDir is either a cgroup v2 directory, or holds
+// the memory and cpu hierarchies of v1.  Without it, or if the
+// worker may not create cgroups there, it logs once and runs jobs
+// without mirror limits.  Each job gets a cgroup of its own below
+// the mirror's, so a job that the kernel kills while its mirror is
+// out of memory can be told from one killed otherwise; it has
+// WorkResponse.ResourceExceeded set to ResourceMemory.
+
+// cgroupVersion returns 2 if dir is a cgroup v2 directory, 1 if it
+// holds v1 hierarchies, and 0 if neither.
+func cgroupVersion(dir string) int {
+	if _, err := os.Stat(filepath.Join(dir, "cgroup.controllers")); err == nil {
+		return 2
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "memory")); err == nil && fi.IsDir() {
+		return 1
+	}
+	return 0
+}
+
+// cpuWeight converts v1 cpu.shares to a v2 cpu.weight.
+func cpuWeight(shares int) int {
+	if shares < 2 {
+		shares = 2
+	}
+	if shares > 262144 {
+		shares = 262144
+	}
+	return 1 + (shares-2)*9999/262142
+}
+
+// mirrorCgroup holds the jobs of a mirror.
+type mirrorCgroup struct {
+	version int
+
+	// The cgroup directories: one for v2, the memory and cpu
+	// ones for v1.
+	dirs []string
+
+	// The limits applied.
+	memory uint64
+	shares int
+}
+
+// newMirrorCgroup creates a cgroup for a mirror, or returns nil if
+// there are no mirror limits, or cgroups cannot be used.
+func (me *Worker) newMirrorCgroup() *mirrorCgroup {
+	o := me.options
+	if o.MaxMirrorMemory == 0 && o.MirrorCPUShares == 0 {
+		return nil
+	}
+	var cg *mirrorCgroup
+	err := fmt.Errorf("no cgroup directory given")
+	if o.CgroupDir != "" {
+		name := fmt.Sprintf("termite-%d-mirror-%d", os.Getpid(), atomic.AddInt32(&me.mirrorCgroups, 1))
+		cg, err = createMirrorCgroup(o.CgroupDir, name, o.MaxMirrorMemory, o.MirrorCPUShares)
+	}
+	if err != nil {
+		me.cgroupWarning.Do(func() {
+			log.Printf("mirror cgroups unavailable, running jobs without mirror limits: %v", err)
+		})
+		return nil
+	}
+	return cg
+}
+
+// createMirrorCgroup creates the cgroup name below base with the
+// given limits.
+func createMirrorCgroup(base, name string, memory uint64, shares int) (*mirrorCgroup, error) {
+	cg := &mirrorCgroup{
+		version: cgroupVersion(base),
+		memory:  memory,
+		shares:  shares,
+	}
+	var settings [][2]string
+	switch cg.version {
+	case 2:
+		dir := filepath.Join(base, name)
+		cg.dirs = []string{dir}
+		if memory > 0 {
+			settings = append(settings, [2]string{filepath.Join(dir, "memory.max"), strconv.FormatUint(memory, 10)})
+		}
+		if shares > 0 {
+			settings = append(settings, [2]string{filepath.Join(dir, "cpu.weight"), strconv.Itoa(cpuWeight(shares))})
+		}
+	case 1:
+		mem := filepath.Join(base, "memory", name)
+		cpu := filepath.Join(base, "cpu", name)
+		cg.dirs = []string{mem, cpu}
+		if memory > 0 {
+			settings = append(settings, [2]string{filepath.Join(mem, "memory.limit_in_bytes"), strconv.FormatUint(memory, 10)})
+		}
+		if shares > 0 {
+			settings = append(settings, [2]string{filepath.Join(cpu, "cpu.shares"), strconv.Itoa(shares)})
+		}
+	default:
+		return nil, fmt.Errorf("no cgroup file system at %s", base)
+	}
+
+	for _, d := range cg.dirs {
+		if err := os.Mkdir(d, 0755); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+	for _, kv := range settings {
+		if err := ioutil.WriteFile(kv[0], []byte(kv[1]), 0644); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+	return cg, nil
+}
+
+// cgroupAdd moves the process pid into the cgroup dir.
+func cgroupAdd(dir string, pid int) error {
+	return ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
+
+// remove removes the cgroup.  This fails if processes of the mirror
+// are still running.
+func (me *mirrorCgroup) remove() {
+	if me == nil {
+		return
+	}
+	for _, d := range me.dirs {
+		if err := os.Remove(d); err != nil && !os.IsNotExist(err) {
+			log.Printf("removing mirror cgroup: %v", err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package termite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func readCgroupFile(t *testing.T, name string) string {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	return string(content)
+}
+
+func TestCpuWeight(t *testing.T) {
+	for shares, want := range map[int]int{0: 1, 2: 1, 1024: 39, 262144: 10000, 1 << 20: 10000} {
+		if got := cpuWeight(shares); got != want {
+			t.Errorf("cpuWeight(%d): got %d, want %d", shares, got, want)
+		}
+	}
+}
+
+func TestMirrorCgroupV2(t *testing.T) {
+	root, _ := ioutil.TempDir("", "term-cgroup")
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory"), 0644)
+
+	cg, err := createMirrorCgroup(root, "m1", 1<<30, 1024)
+	if err != nil {
+		t.Fatalf("createMirrorCgroup: %v", err)
+	}
+	dir := filepath.Join(root, "m1")
+	if cg.version != 2 || len(cg.dirs) != 1 || cg.dirs[0] != dir {
+		t.Fatalf("got %+v", cg)
+	}
+	if got := readCgroupFile(t, dir+"/memory.max"); got != "1073741824" {
+		t.Errorf("memory.max: got %q", got)
+	}
+	if got := readCgroupFile(t, dir+"/cpu.weight"); got != "39" {
+		t.Errorf("cpu.weight: got %q", got)
+	}
+
+	w := &Worker{options: &WorkerOptions{CgroupDir: root, MaxMirrorMemory: 1 << 30}}
+	limits, err := w.limitJob(1234, 7, cg)
+	if err != nil {
+		t.Fatalf("limitJob: %v", err)
+	}
+	job := dir + "/job-7-1234"
+	if got := readCgroupFile(t, job+"/cgroup.procs"); got != "1234" {
+		t.Errorf("cgroup.procs: got %q", got)
+	}
+
+	killed := syscall.WaitStatus(syscall.SIGKILL)
+	if r := limits.exceeded(killed); r != "" {
+		t.Errorf("SIGKILL without OOM: got %q", r)
+	}
+	ioutil.WriteFile(dir+"/memory.events", []byte("oom 1\noom_kill 1\n"), 0644)
+	if r := limits.exceeded(killed); r != "" {
+		t.Errorf("SIGKILL while the mirror killed another job: got %q", r)
+	}
+	ioutil.WriteFile(job+"/memory.events", []byte("oom 0\noom_kill 1\n"), 0644)
+	if r := limits.exceeded(killed); r != ResourceMemory {
+		t.Errorf("SIGKILL after OOM: got %q", r)
+	}
+}
+
+func TestMirrorCgroupV1(t *testing.T) {
+	root, _ := ioutil.TempDir("", "term-cgroup")
+	defer os.RemoveAll(root)
+	os.Mkdir(root+"/memory", 0755)
+	os.Mkdir(root+"/cpu", 0755)
+
+	cg, err := createMirrorCgroup(root, "m1", 1<<30, 512)
+	if err != nil {
+		t.Fatalf("createMirrorCgroup: %v", err)
+	}
+	if cg.version != 1 || len(cg.dirs) != 2 {
+		t.Fatalf("got %+v", cg)
+	}
+	if got := readCgroupFile(t, root+"/memory/m1/memory.limit_in_bytes"); got != "1073741824" {
+		t.Errorf("memory.limit_in_bytes: got %q", got)
+	}
+	if got := readCgroupFile(t, root+"/cpu/m1/cpu.shares"); got != "512" {
+		t.Errorf("cpu.shares: got %q", got)
+	}
+
+	w := &Worker{options: &WorkerOptions{CgroupDir: root, MaxMirrorMemory: 1 << 30}}
+	limits, err := w.limitJob(1234, 7, cg)
+	if err != nil {
+		t.Fatalf("limitJob: %v", err)
+	}
+	if got := readCgroupFile(t, root+"/cpu/m1/cgroup.procs"); got != "1234" {
+		t.Errorf("cpu cgroup.procs: got %q", got)
+	}
+	job := root + "/memory/m1/job-7-1234"
+	if got := readCgroupFile(t, job+"/cgroup.procs"); got != "1234" {
+		t.Errorf("memory cgroup.procs: got %q", got)
+	}
+	ioutil.WriteFile(job+"/memory.oom_control", []byte("oom_kill_disable 0\nunder_oom 0\noom_kill 2\n"), 0644)
+	if r := limits.exceeded(syscall.WaitStatus(syscall.SIGKILL)); r != ResourceMemory {
+		t.Errorf("SIGKILL after OOM: got %q", r)
+	}
+}
+
+func TestMirrorCgroupUnavailable(t *testing.T) {
+	root, _ := ioutil.TempDir("", "term-cgroup")
+	defer os.RemoveAll(root)
+
+	if _, err := createMirrorCgroup(root, "m1", 1<<30, 0); err == nil {
+		t.Errorf("created a cgroup without a cgroup file system")
+	}
+
+	// Without a directory given, the worker does not look for
+	// cgroups itself.
+	w := &Worker{options: &WorkerOptions{MaxMirrorMemory: 1 << 30}}
+	if cg := w.newMirrorCgroup(); cg != nil {
+		t.Errorf("got %+v, want nil", cg)
+	}
+	w.options.CgroupDir = root
+	if cg := w.newMirrorCgroup(); cg != nil {
+		t.Errorf("got %+v, want nil", cg)
+	}
+	var none *mirrorCgroup
+	none.remove()
+}
@@ -1,14 +1,14 @@
 package termite
 
 import (
-	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"net/rpc"
-	"strings"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hanwen/termite/attr"
@@ -21,51 +21,195 @@ type mirrorConnection struct {
 	rpcClient     *rpc.Client
 	contentClient *cba.Client
 
-	// For serving the Fileserver.
+	// For serving the Fileserver.  Replaced when the connections
+	// are re-established.
+	reverseMutex       sync.Mutex
 	reverseConnection  net.Conn
 	reverseContentConn net.Conn
+	reverse            *reverseChannel
 
 	// Protected by mirrorConnections.Mutex.
 	maxJobs       int
 	availableJobs int
 
+	// Longest path that fits in the worker's mirror, or 0 if
+	// unknown.
+	maxPathLength int
+
 	master        *Master
 	fileSetWaiter *attr.FileSetWaiter
+
+	// sentKey of the last update sent for each path.  Only
+	// accessed from Send, which the attribute cache serializes.
+	sent map[string]string
+
+	// Handles of the environments registered with the mirror.
+	envMutex sync.Mutex
+	envs     map[string]bool
+	envsSent int
 }
 
 func (me *mirrorConnection) Id() string {
 	return me.workerAddr
 }
 
+func (me *mirrorConnection) close() {
+	me.reverse.close()
+	me.rpcClient.Close()
+	me.contentClient.Close()
+	me.reverseMutex.Lock()
+	defer me.reverseMutex.Unlock()
+	me.reverseConnection.Close()
+	me.reverseContentConn.Close()
+}
+
+// checkPath verifies that a root-relative path fits in the mirror.
+func (me *mirrorConnection) checkPath(path string) error {
+	if me.maxPathLength == 0 {
+		return nil
+	}
+	return attr.CheckPathLength(path, me.maxPathLength)
+}
+
+// missingFiles returns the entries of the fileset whose content we
+// don't have locally, one entry per hash.
+func (me *mirrorConnection) missingFiles(fset attr.FileSet) []*attr.FileAttr {
+	seen := map[string]bool{}
+	var hashes []string
+	var files []*attr.FileAttr
+	for _, info := range fset.Files {
+		if info.Hash == "" || seen[info.Hash] {
+			continue
+		}
+		seen[info.Hash] = true
+		hashes = append(hashes, info.Hash)
+		files = append(files, info)
+	}
+
+	var missing []*attr.FileAttr
+	for i, have := range me.master.contentStore.HasHashes(hashes) {
+		if !have {
+			missing = append(missing, files[i])
+		}
+	}
+	return missing
+}
+
 func (me *mirrorConnection) replay(fset attr.FileSet) error {
 	// Must get data before we modify the file-system, so we don't
 	// leave the FS in a half-finished state.
+	if me.maxPathLength > 0 {
+		if err := fset.CheckPathLengths(me.maxPathLength); err != nil {
+			return err
+		}
+	}
+
+	// Pin the content until it has been copied into the
+	// file system.
 	for _, info := range fset.Files {
-		if info.Hash != "" && !me.master.contentStore.Has(info.Hash) {
+		if info.Hash != "" {
+			me.master.contentStore.Ref(info.Hash)
+		}
+	}
+	defer func() {
+		for _, info := range fset.Files {
+			if info.Hash != "" {
+				me.master.contentStore.Unref(info.Hash)
+			}
+		}
+	}()
+
+	missing := me.missingFiles(fset)
+	if len(missing) > 0 {
+		req := HaveHashesRequest{}
+		for _, info := range missing {
+			req.Hashes = append(req.Hashes, info.Hash)
+		}
+		rep := HaveHashesResponse{}
+		if err := me.rpcClient.Call("Mirror.HaveHashes", &req, &rep); err != nil {
+			return err
+		}
+		if len(rep.Have) != len(req.Hashes) {
+			return fmt.Errorf("mirrorConnection.replay: HaveHashes returned %d results for %d hashes",
+				len(rep.Have), len(req.Hashes))
+		}
+		for i, have := range rep.Have {
+			if !have {
+				return fmt.Errorf("mirrorConnection.replay: remote %s does not have file %x",
+					me.workerAddr, req.Hashes[i])
+			}
+		}
+	}
+	if err := me.fetchMissing(missing); err != nil {
+		return err
+	}
+	return me.master.replay(fset)
+}
+
+// fetchMissing fetches the content of files from the worker, up to
+// FetchConcurrency at a time, and returns the first error.
+func (me *mirrorConnection) fetchMissing(missing []*attr.FileAttr) error {
+	errs := make(chan error, len(missing))
+	slots := make(chan bool, me.master.contentStore.Options.FetchConcurrency)
+	for _, info := range missing {
+		slots <- true
+		go func(info *attr.FileAttr) {
+			defer func() { <-slots }()
 			got, err := me.contentClient.Fetch(info.Hash, int64(info.Size))
 			if !got && err == nil {
-				log.Fatalf("mirrorConnection.replay: fetch corruption remote does not have file %x", info.Hash)
-			}
-			if err != nil {
-				return err
+				err = fmt.Errorf("mirrorConnection.replay: remote %s lost file %x", me.workerAddr, info.Hash)
 			}
+			errs <- err
+		}(info)
+	}
+	var first error
+	for range missing {
+		if err := <-errs; err != nil && first == nil {
+			first = err
 		}
 	}
-	me.master.replay(fset)
-	return nil
+	return first
 }
 
 func (me *mirrorConnection) Send(files []*attr.FileAttr) error {
-	req := UpdateRequest{
-		Files: files,
+	var todo []*attr.FileAttr
+	for _, f := range files {
+		// The mirror could never show these, so there is no
+		// point in sending them.
+		if err := me.checkPath(f.Path); err != nil {
+			log.Printf("Not sending to %s: %v", me.workerAddr, err)
+			continue
+		}
+		if me.sent[f.Path] != "" && me.sent[f.Path] == sentKey(f) {
+			continue
+		}
+		todo = append(todo, f)
 	}
-	rep := UpdateResponse{}
-	err := me.rpcClient.Call("Mirror.Update", &req, &rep)
-	if err != nil {
-		log.Println("Mirror.Update failure", err)
-		return err
+	if len(todo) == 0 {
+		return nil
 	}
-	log.Printf("Sent pending changes to %s", me.workerAddr)
+
+	batchSize := me.master.options.UpdateBatchSize
+	for start := 0; start < len(todo); start += batchSize {
+		end := start + batchSize
+		if end > len(todo) {
+			end = len(todo)
+		}
+		batch := todo[start:end]
+		req, err := newUpdateRequest(batch)
+		if err != nil {
+			return err
+		}
+		rep := UpdateResponse{}
+		if err := me.rpcClient.Call("Mirror.Update", req, &rep); err != nil {
+			log.Println("Mirror.Update failure", err)
+			return err
+		}
+		for _, f := range batch {
+			me.sent[f.Path] = sentKey(f)
+		}
+	}
+	log.Printf("Sent %d pending changes to %s", len(todo), me.workerAddr)
 	return nil
 }
 
@@ -73,39 +217,73 @@ func (me *mirrorConnection) Send(files []*attr.FileAttr) error {
 // on the workers.
 type mirrorConnections struct {
 	master      *Master
-	coordinator string
+	coordinator *coordinatorClient
 
 	keepAlive time.Duration
 
+	// How long to leave a worker alone after its mirror failed.
+	coolOff time.Duration
+
 	wantedMaxJobs int
 
+	// Only use workers with these labels.
+	selector map[string]string
+
+	// Root of the files used for affinity scheduling, or empty to
+	// schedule by load only.
+	affinityRoot string
+
 	stats *stats.ServerStats
 
+	// time.Now, replaced in tests.
+	now func() time.Time
+
+	// Set while a demand report is in flight.
+	reporting int32
+
 	// Protects all of the below.
 	sync.Mutex
-	workers        map[string]bool
+	workers        map[string]Registration
 	mirrors        map[string]*mirrorConnection
 	lastActionTime time.Time
+
+	// Workers whose mirror failed, and when they may be used
+	// again.
+	coolingOff map[string]time.Time
+
+	// All workers the coordinator listed last.  Unlike workers,
+	// it keeps those whose mirror failed.
+	known map[string]Registration
+
+	// Mirrors that recently ran jobs, by the fingerprint of the
+	// job; see affinity.go.
+	recent    map[string]string
+	recentOld map[string]string
+
+	// Timings of jobs per command.  Like stats, it starts over
+	// when the connections are dropped.
+	commands *commandStats
 }
 
-func (me *mirrorConnections) fetchWorkers(last *time.Time) (newMap map[string]bool, err error) {
-	newMap = map[string]bool{}
-	client, err := rpc.DialHTTP("tcp", me.coordinator)
-	if err != nil {
-		log.Println("fetchWorkers: dialing coordinator:", err)
-		return nil, err
+func (me *mirrorConnections) fetchWorkers(last *time.Time) (newMap map[string]Registration, err error) {
+	newMap = map[string]Registration{}
+	req := ListRequest{
+		Latest:   *last,
+		Selector: FormatLabels(me.selector),
 	}
-	defer client.Close()
-	req := ListRequest{Latest: *last}
 	rep := ListResponse{}
-	err = client.Call("Coordinator.List", &req, &rep)
+	err = me.coordinator.Call("Coordinator.List", &req, &rep)
 	if err != nil {
 		log.Println("coordinator rpc error:", err)
 		return nil, err
 	}
 
 	for _, v := range rep.Registrations {
-		newMap[v.Address] = true
+		// Older coordinators do not filter.
+		if !matchLabels(me.selector, v.Labels) {
+			continue
+		}
+		newMap[v.Address] = v
 	}
 	if len(newMap) == 0 {
 		log.Println("coordinator has no workers for us.")
@@ -115,16 +293,24 @@ func (me *mirrorConnections) fetchWorkers(last *time.Time) (newMap map[string]bo
 }
 
 func (me *mirrorConnections) refreshWorkers() {
+	if me.coordinator.addr == "" {
+		return
+	}
 	last := time.Unix(0, 0)
 	for {
+		me.coordinator.waitBackoff()
 		newWorkers, err := me.fetchWorkers(&last)
 		if err != nil {
-			time.Sleep(10 * time.Second)
 			continue
 		}
 		log.Printf("Got %d workers %v", len(newWorkers), last)
+		known := make(map[string]Registration, len(newWorkers))
+		for k, v := range newWorkers {
+			known[k] = v
+		}
 		me.Mutex.Lock()
 		me.workers = newWorkers
+		me.known = known
 		me.Mutex.Unlock()
 	}
 }
@@ -133,10 +319,11 @@ func newMirrorConnections(m *Master, coordinator string, maxJobs int) *mirrorCon
 	me := &mirrorConnections{
 		master:        m,
 		wantedMaxJobs: maxJobs,
-		workers:       make(map[string]bool),
+		workers:       make(map[string]Registration),
 		mirrors:       make(map[string]*mirrorConnection),
-		coordinator:   coordinator,
+		coordinator:   newCoordinatorClient(coordinator, m.tlsConfig),
 		keepAlive:     time.Minute,
+		now:           time.Now,
 	}
 	me.refreshStats()
 	return me
@@ -144,11 +331,52 @@ func newMirrorConnections(m *Master, coordinator string, maxJobs int) *mirrorCon
 
 func (me *mirrorConnections) refreshStats() {
 	me.stats = stats.NewServerStats()
-	me.stats.PhaseOrder = []string{"run", "send", "remote", "filewait"}
+	me.stats.PhaseOrder = []string{"run", "send", "prefetch", "remote", "filewait"}
+	me.commands = newCommandStats()
+}
+
+func (me *mirrorConnections) commandStats() *commandStats {
+	me.Mutex.Lock()
+	defer me.Mutex.Unlock()
+	return me.commands
 }
 
 func (me *mirrorConnections) periodicHouseholding() {
 	me.maybeDropConnections()
+
+	// Dialing a coordinator that is down takes a while.  Skip
+	// the report if the previous one has not finished.
+	if atomic.CompareAndSwapInt32(&me.reporting, 0, 1) {
+		go func() {
+			me.reportDemand()
+			atomic.StoreInt32(&me.reporting, 0)
+		}()
+	}
+}
+
+// demand returns the job slots in use or waited for, and the number
+// of jobs that were sent to a mirror without a free slot.
+func (me *mirrorConnections) demand() (wanted, queued int) {
+	me.Mutex.Lock()
+	defer me.Mutex.Unlock()
+	for _, mc := range me.mirrors {
+		wanted += mc.maxJobs - mc.availableJobs
+		if mc.availableJobs < 0 {
+			queued -= mc.availableJobs
+		}
+	}
+	return wanted, queued
+}
+
+// reportDemand tells the coordinator how many job slots we could use.
+func (me *mirrorConnections) reportDemand() {
+	req := DemandReport{
+		Master: fmt.Sprintf("%s:%s", Hostname, me.master.options.Socket),
+	}
+	req.Wanted, req.Queued = me.demand()
+	if err := me.coordinator.Call("Coordinator.ReportDemand", &req, &Empty{}); err != nil {
+		log.Println("coordinator rpc error:", err)
+	}
 }
 
 // Must be called with lock held.
@@ -171,6 +399,30 @@ func (me *mirrorConnections) maxJobs() int {
 	return a
 }
 
+// status returns the state of the mirrors, sorted by worker.
+func (me *mirrorConnections) status() []MirrorConnectionStatus {
+	me.Mutex.Lock()
+	defer me.Mutex.Unlock()
+	var addrs []string
+	for addr := range me.mirrors {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var result []MirrorConnectionStatus
+	for _, addr := range addrs {
+		mc := me.mirrors[addr]
+		result = append(result, MirrorConnectionStatus{
+			Worker:            addr,
+			MaxJobs:           mc.maxJobs,
+			AvailableJobs:     mc.availableJobs,
+			Reverse:           mc.reverse.State().String(),
+			ReverseReconnects: mc.reverse.Reconnects(),
+		})
+	}
+	return result
+}
+
 func (me *mirrorConnections) maybeDropConnections() {
 	me.Mutex.Lock()
 	defer me.Mutex.Unlock()
@@ -180,12 +432,7 @@ func (me *mirrorConnections) maybeDropConnections() {
 		return
 	}
 
-	// Something is running.
-	if me.availableJobs() < me.maxJobs() {
-		return
-	}
-
-	if me.lastActionTime.Add(me.keepAlive).After(time.Now()) {
+	if !me.idle() {
 		return
 	}
 
@@ -193,139 +440,431 @@ func (me *mirrorConnections) maybeDropConnections() {
 	me.dropConnections()
 }
 
+// idle returns true if no job ran for keepAlive.  Must hold lock.
+func (me *mirrorConnections) idle() bool {
+	// Something is running.
+	if me.availableJobs() < me.maxJobs() {
+		return false
+	}
+	return elapsed(&me.lastActionTime, me.now()) >= me.keepAlive
+}
+
 func (me *mirrorConnections) dropConnections() {
 	for _, mc := range me.mirrors {
-		mc.rpcClient.Close()
-		mc.contentClient.Close()
-		mc.reverseConnection.Close()
-		mc.reverseContentConn.Close()
+		mc.close()
 		me.master.attributes.RmClient(mc)
 	}
 	me.mirrors = make(map[string]*mirrorConnection)
 	me.refreshStats()
 }
 
-// Gets a mirrorConnection to run on.  Will block if none available
-func (me *mirrorConnections) find(name string) (*mirrorConnection, error) {
-	me.Mutex.Lock()
-	defer me.Mutex.Unlock()
+// suitable returns true if the worker reported enough available
+// memory, and the CPU features and labels for req.  Must be called
+// with lock held.
+func (me *mirrorConnections) suitable(addr string, req *WorkRequest) bool {
+	for _, x := range req.ExcludeWorkers {
+		if x == addr {
+			return false
+		}
+	}
+	w := me.workers[addr]
+	if req.Memory > 0 && w.MemAvailable < req.Memory {
+		return false
+	}
+	if !matchLabels(req.RequiredLabels, w.Labels) {
+		return false
+	}
+	return missingCPUFeature(w.CPUFeatures, req.RequiredCPUFeatures) == ""
+}
 
-	var found *mirrorConnection
-	for nm, v := range me.mirrors {
-		if strings.Contains(nm, name) {
-			found = v
-			break
+// knownMatch returns true if any worker the coordinator knows has
+// labels.  Must be called with lock held.
+func (me *mirrorConnections) knownMatch(labels map[string]string) bool {
+	for _, m := range []map[string]Registration{me.workers, me.known} {
+		for _, w := range m {
+			if matchLabels(labels, w.Labels) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unsuitableError explains why no mirror can run req.  Must be
+// called with lock held.
+func (me *mirrorConnections) unsuitableError(req *WorkRequest) error {
+	if len(req.ExcludeWorkers) > 0 {
+		excluded := 0
+		for addr := range me.mirrors {
+			if !me.suitable(addr, &WorkRequest{ExcludeWorkers: req.ExcludeWorkers}) {
+				excluded++
+			}
+		}
+		if excluded == len(me.mirrors) {
+			return fmt.Errorf("all workers are excluded: %v", req.ExcludeWorkers)
 		}
 	}
-	if found == nil {
-		return nil, fmt.Errorf("No worker with name: %q. Have %v", name, me.mirrors)
+	if len(req.RequiredLabels) > 0 {
+		matched := false
+		for addr := range me.mirrors {
+			matched = matched || matchLabels(req.RequiredLabels, me.workers[addr].Labels)
+		}
+		if !matched && !me.knownMatch(req.RequiredLabels) {
+			return &NoMatchingWorkerError{Labels: req.RequiredLabels}
+		}
+		if !matched {
+			// The worker may be cooling off, or unreachable
+			// for now; the job can be retried.
+			return fmt.Errorf("no connected worker has labels %s", FormatLabels(req.RequiredLabels))
+		}
 	}
-	found.availableJobs--
-	return found, nil
+	for _, f := range req.RequiredCPUFeatures {
+		supported := false
+		for addr := range me.mirrors {
+			if missingCPUFeature(me.workers[addr].CPUFeatures, []string{f}) == "" {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("no worker supports %s", f)
+		}
+	}
+	if req.Memory > 0 {
+		return fmt.Errorf("no worker has %d bytes of memory available", req.Memory)
+	}
+	return fmt.Errorf("no worker has CPU features %v", req.RequiredCPUFeatures)
 }
 
-func (me *mirrorConnections) pick() (*mirrorConnection, error) {
+// required returns the mirror on the worker that req must run on,
+// creating it if needed.  The job runs there even if the worker has
+// no free slot or lacks what req needs.  Must hold lock.
+func (me *mirrorConnections) required(req *WorkRequest) (*mirrorConnection, error) {
+	addr := req.RequireWorker
+	mc := me.mirrors[addr]
+	if mc == nil {
+		jobs := me.wantedMaxJobs - me.maxJobs()
+		if jobs < 1 {
+			jobs = 1
+		}
+		if err := me.connect(addr, jobs); err != nil {
+			return nil, fmt.Errorf("required worker %s is unreachable: %v", addr, err)
+		}
+		mc = me.mirrors[addr]
+	}
+	mc.availableJobs--
+	return mc, nil
+}
+
+// pick returns a mirror to run req on.  Only mirrors on workers
+// that reported the memory and CPU features that req needs are
+// considered.  Jobs with the same inputs go to the same mirror, if
+// it has a free slot.
+func (me *mirrorConnections) pick(req *WorkRequest) (*mirrorConnection, error) {
+	return me.pickAvoiding(req, "")
+}
+
+// pickAvoiding is pick, but it only uses a mirror on the worker at
+// address avoid if no other mirror can run req.
+func (me *mirrorConnections) pickAvoiding(req *WorkRequest, avoid string) (picked *mirrorConnection, err error) {
+	key := affinityKey(me.affinityRoot, req)
+	var fp string
+	if key != 0 {
+		fp = affinityFingerprint(req)
+	}
+
 	me.Mutex.Lock()
 	defer me.Mutex.Unlock()
+	if key != 0 {
+		defer func() {
+			if picked != nil {
+				me.remember(fp, picked.workerAddr)
+			}
+		}()
+	}
+
+	if req.RequireWorker != "" {
+		return me.required(req)
+	}
 
-	if me.availableJobs() <= 0 {
-		me.tryConnect()
+	orig := req
+	if avoid != "" {
+		r := *req
+		r.ExcludeWorkers = append(r.ExcludeWorkers[:len(r.ExcludeWorkers):len(r.ExcludeWorkers)], avoid)
+		req = &r
+	}
+	if me.availableJobs() <= 0 || !me.anySuitable(req) {
+		me.tryConnect(req)
 
 		if me.maxJobs() == 0 {
-			// Didn't connect to anything.  Should
-			// probably direct the wrapper to compile
-			// locally.
-			return nil, errors.New("No workers found at all.")
+			// Didn't connect to anything.  The master
+			// may run the job itself; see LocalFallback.
+			return nil, errNoWorkers
 		}
 	}
+	if req != orig && !me.anySuitable(req) {
+		req = orig
+	}
 
+	hook := me.sched()
+	if key != 0 && (hook == nil || hook.choose(schedAffinity, req.TaskId, 2) == 0) {
+		if mc := me.recentMirror(fp, req); mc != nil && mc.availableJobs > 0 {
+			mc.availableJobs--
+			return mc, nil
+		}
+		if mc := me.preferredMirror(key, req); mc != nil && mc.availableJobs > 0 {
+			mc.availableJobs--
+			return mc, nil
+		}
+	}
+
+	var free []string
 	maxAvail := -1e9
 	var maxAvailMirror *mirrorConnection
-	for _, v := range me.mirrors {
+	for addr, v := range me.mirrors {
+		if !me.suitable(addr, req) {
+			continue
+		}
 		if v.availableJobs > 0 {
-			v.availableJobs--
-			return v, nil
+			free = append(free, addr)
+			continue
 		}
 		l := float64(v.availableJobs) / float64(v.maxJobs)
-		if l > maxAvail {
+		if l > maxAvail || (l == maxAvail && me.lessLoaded(addr, maxAvailMirror.workerAddr)) {
 			maxAvailMirror = v
 			maxAvail = l
 		}
 	}
+	if len(free) > 0 {
+		addr := ""
+		if hook != nil {
+			addr = schedPickFrom(hook, req.TaskId, free)
+		} else {
+			addr = me.leastLoaded(free)
+		}
+		mc := me.mirrors[addr]
+		mc.availableJobs--
+		return mc, nil
+	}
+	if maxAvailMirror == nil {
+		return nil, me.unsuitableError(req)
+	}
 
 	maxAvailMirror.availableJobs--
 	return maxAvailMirror, nil
 }
 
+// pickSpare returns a mirror with a free slot for req on a worker
+// other than avoid, or nil if there is none.  Unlike pick, it does
+// not connect to more workers.
+func (me *mirrorConnections) pickSpare(req *WorkRequest, avoid string) *mirrorConnection {
+	me.Mutex.Lock()
+	defer me.Mutex.Unlock()
+	hook := me.sched()
+	var free []string
+	for addr, mc := range me.mirrors {
+		if addr == avoid || mc.availableJobs <= 0 || !me.suitable(addr, req) {
+			continue
+		}
+		if hook != nil {
+			free = append(free, addr)
+			continue
+		}
+		mc.availableJobs--
+		return mc
+	}
+	if len(free) > 0 {
+		mc := me.mirrors[schedPickFrom(hook, req.TaskId, free)]
+		mc.availableJobs--
+		return mc
+	}
+	return nil
+}
+
+// Must be called with lock held.
+func (me *mirrorConnections) anySuitable(req *WorkRequest) bool {
+	for addr := range me.mirrors {
+		if me.suitable(addr, req) {
+			return true
+		}
+	}
+	return false
+}
+
 func (me *mirrorConnections) drop(mc *mirrorConnection, err error) {
 	me.master.attributes.RmClient(mc)
 
 	me.Mutex.Lock()
 	defer me.Mutex.Unlock()
 	log.Printf("Dropping mirror %s. Reason: %s", mc.workerAddr, err)
-	mc.rpcClient.Close()
-	mc.contentClient.Close()
-	mc.reverseConnection.Close()
-	mc.reverseContentConn.Close()
+	mc.close()
 	delete(me.mirrors, mc.workerAddr)
 	delete(me.workers, mc.workerAddr)
+	me.startCoolOff(mc.workerAddr)
+}
+
+// startCoolOff leaves the worker at addr alone for a while.  Must
+// hold lock.
+func (me *mirrorConnections) startCoolOff(addr string) {
+	if me.coolingOff == nil {
+		me.coolingOff = make(map[string]time.Time)
+	}
+	me.coolingOff[addr] = me.now().Add(me.coolOff)
+}
+
+// isCoolingOff returns whether the mirror on the worker at addr
+// failed recently.  Must hold lock.
+func (me *mirrorConnections) isCoolingOff(addr string) bool {
+	until, ok := me.coolingOff[addr]
+	if ok && !me.now().Before(until) {
+		delete(me.coolingOff, addr)
+		return false
+	}
+	return ok
+}
+
+// workersCoolingOff returns the workers that are left alone after a
+// failure, sorted.
+func (me *mirrorConnections) workersCoolingOff() []string {
+	me.Mutex.Lock()
+	defer me.Mutex.Unlock()
+	var addrs []string
+	for addr := range me.coolingOff {
+		if me.isCoolingOff(addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
 }
 
 func (me *mirrorConnections) jobDone(mc *mirrorConnection) {
 	me.Mutex.Lock()
 	defer me.Mutex.Unlock()
 
-	me.lastActionTime = time.Now()
+	me.lastActionTime = me.now()
 	mc.availableJobs++
 }
 
-func (me *mirrorConnections) idleWorkerAddress() string {
+// idleWorkerAddress returns a worker that has no mirror yet, did not
+// fail recently, and can run req if it is not nil.  Of those, it
+// picks among the ones the coordinator scored healthiest.  Must hold
+// lock.
+func (me *mirrorConnections) idleWorkerAddress(req *WorkRequest) string {
 	cands := []string{}
-	for addr := range me.workers {
+	best := -1
+	for addr, w := range me.workers {
 		_, ok := me.mirrors[addr]
-		if ok {
+		if ok || me.isCoolingOff(addr) {
 			continue
 		}
-		cands = append(cands, addr)
+		if req != nil && !me.suitable(addr, req) {
+			continue
+		}
+		switch c := w.healthClass(); {
+		case c > best:
+			best = c
+			cands = []string{addr}
+		case c == best:
+			cands = append(cands, addr)
+		}
 	}
 
 	if len(cands) == 0 {
 		return ""
 	}
-	return cands[rand.Intn(len(cands))]
+	return me.leastLoaded(cands)
 }
 
-// Tries to connect to one extra worker.  Must already hold mutex.
-func (me *mirrorConnections) tryConnect() {
+// lessLoaded returns true if both workers reported their load, and a
+// is less loaded than b.  Must hold lock.
+func (me *mirrorConnections) lessLoaded(a, b string) bool {
+	wa, wb := me.workers[a], me.workers[b]
+	la, okA := wa.load()
+	lb, okB := wb.load()
+	if !okA || !okB {
+		return false
+	}
+	if la != lb {
+		return la < lb
+	}
+	return wa.MemAvailable > wb.MemAvailable
+}
+
+// leastLoaded returns the worker among addrs with the lowest load per
+// CPU, and of those, the most available memory.  If some worker did
+// not report its load, it returns a random one.  Must hold lock.
+func (me *mirrorConnections) leastLoaded(addrs []string) string {
+	for _, a := range addrs {
+		w := me.workers[a]
+		if _, ok := w.load(); !ok {
+			return addrs[rand.Intn(len(addrs))]
+		}
+	}
+	sort.Strings(addrs)
+	best := addrs[0]
+	for _, a := range addrs[1:] {
+		if me.lessLoaded(a, best) {
+			best = a
+		}
+	}
+	return best
+}
+
+// Tries to connect to one extra worker.  If req requires labels that
+// no mirror has, it connects to a worker that has them, even if the
+// master has all the jobs it wants.  Must already hold mutex.
+func (me *mirrorConnections) tryConnect(req *WorkRequest) {
 	// We want to max out capacity of each worker, as that helps
 	// with cache hit rates on the worker.
 	wanted := me.wantedMaxJobs - me.maxJobs()
-	if wanted <= 0 {
-		return
+	for wanted > 0 {
+		addr := me.idleWorkerAddress(nil)
+		if addr == "" {
+			break
+		}
+		if err := me.connect(addr, wanted); err != nil {
+			log.Println("nonfatal error creating mirror:", err)
+		}
 	}
 
-	for {
-		addr := me.idleWorkerAddress()
+	for len(req.RequiredLabels) > 0 && !me.anySuitable(req) {
+		addr := me.idleWorkerAddress(req)
 		if addr == "" {
 			break
 		}
-		me.Mutex.Unlock()
-		log.Printf("Creating mirror on %v, requesting %d jobs", addr, wanted)
-		mc, err := me.master.createMirror(addr, wanted)
-		me.Mutex.Lock()
-		if err != nil {
-			delete(me.workers, addr)
+		if err := me.connect(addr, 1); err != nil {
 			log.Println("nonfatal error creating mirror:", err)
-		} else {
-			// This could happen in the unlikely event of
-			// the workers having more capacity than our
-			// parallelism.
-			if _, ok := me.mirrors[addr]; ok {
-				log.Panicf("already have this mirror: %v", addr)
-			}
-			mc.workerAddr = addr
-			me.mirrors[addr] = mc
-			me.master.attributes.AddClient(mc)
 		}
 	}
 }
+
+// connect creates a mirror on the worker at addr.  Must hold lock; it
+// is released while connecting.
+func (me *mirrorConnections) connect(addr string, jobs int) error {
+	me.Mutex.Unlock()
+	log.Printf("Creating mirror on %v, requesting %d jobs", addr, jobs)
+	mc, err := me.master.createMirror(addr, jobs)
+	if err == nil {
+		if err = me.master.warmUp(mc); err != nil {
+			mc.close()
+		}
+	}
+	me.Mutex.Lock()
+	if err != nil {
+		delete(me.workers, addr)
+		me.startCoolOff(addr)
+		return err
+	}
+	// Jobs that require the same worker may connect to it
+	// concurrently.
+	if _, ok := me.mirrors[addr]; ok {
+		log.Printf("already have a mirror on %v; closing the new one", addr)
+		mc.close()
+		return nil
+	}
+	me.mirrors[addr] = mc
+	me.master.attributes.AddClient(mc)
+	go me.master.sendHints(mc, me.master.hints.files())
+	return nil
+}
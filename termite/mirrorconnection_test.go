@@ -0,0 +1,439 @@
+package termite
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorConnectionsPickMemory(t *testing.T) {
+	const gb = 1 << 30
+	mcs := &mirrorConnections{
+		workers: map[string]Registration{
+			"small:1": {Address: "small:1", MemAvailable: 1 * gb},
+			"roomy:1": {Address: "roomy:1", MemAvailable: 16 * gb},
+		},
+		mirrors: map[string]*mirrorConnection{
+			"small:1": {workerAddr: "small:1", maxJobs: 2, availableJobs: 2},
+			"roomy:1": {workerAddr: "roomy:1", maxJobs: 1, availableJobs: 1},
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		mc, err := mcs.pick(&WorkRequest{Memory: 8 * gb})
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		// The second job has to wait for a slot on the
+		// roomy worker.
+		if mc.workerAddr != "roomy:1" {
+			t.Errorf("big job %d went to %s", i, mc.workerAddr)
+		}
+	}
+
+	if mc, err := mcs.pick(&WorkRequest{}); err != nil || mc.workerAddr != "small:1" {
+		t.Errorf("small job: got %v, %v", mc, err)
+	}
+	if mc, err := mcs.pick(&WorkRequest{Memory: 32 * gb}); err == nil {
+		t.Errorf("huge job should fail, got %s", mc.workerAddr)
+	}
+}
+
+func TestMirrorConnectionsPickCPUFeatures(t *testing.T) {
+	mcs := &mirrorConnections{
+		workers: map[string]Registration{
+			"old:1": {Address: "old:1", CPUFeatures: []string{"avx", "avx2", "sse4_2"}},
+			"new:1": {Address: "new:1", CPUFeatures: []string{"avx", "avx2", "avx512f", "sse4_2"}},
+		},
+		mirrors: map[string]*mirrorConnection{
+			"old:1": {workerAddr: "old:1", maxJobs: 4, availableJobs: 4},
+			"new:1": {workerAddr: "new:1", maxJobs: 1, availableJobs: 1},
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		mc, err := mcs.pick(&WorkRequest{RequiredCPUFeatures: []string{"avx512f", "avx2"}})
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		if mc.workerAddr != "new:1" {
+			t.Errorf("avx512 job %d went to %s", i, mc.workerAddr)
+		}
+	}
+	if mc, err := mcs.pick(&WorkRequest{RequiredCPUFeatures: []string{"avx2"}}); err != nil || mc.workerAddr != "old:1" {
+		t.Errorf("avx2 job: got %v, %v", mc, err)
+	}
+
+	_, err := mcs.pick(&WorkRequest{RequiredCPUFeatures: []string{"avx2", "amx_tile"}})
+	if err == nil || !strings.Contains(err.Error(), "no worker supports amx_tile") {
+		t.Errorf("got error %v, want one about amx_tile", err)
+	}
+}
+
+func TestMirrorConnectionsPickAffinity(t *testing.T) {
+	mcs := &mirrorConnections{
+		workers:      map[string]Registration{},
+		mirrors:      map[string]*mirrorConnection{},
+		affinityRoot: "/src",
+		now:          time.Now,
+	}
+	for _, a := range []string{"w1:1", "w2:1", "w3:1"} {
+		mcs.workers[a] = Registration{Address: a}
+		mcs.mirrors[a] = &mirrorConnection{workerAddr: a, maxJobs: 2, availableJobs: 2}
+	}
+
+	req := &WorkRequest{Argv: []string{"cc", "-c", "/src/a.c", "-o", "/src/a.o"}}
+	first, err := mcs.pick(req)
+	if err != nil {
+		t.Fatalf("pick: %v", err)
+	}
+	mcs.jobDone(first)
+	for i := 0; i < 5; i++ {
+		mc, err := mcs.pick(req)
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		if mc != first {
+			t.Errorf("job %d went to %s, want %s", i, mc.workerAddr, first.workerAddr)
+		}
+		mcs.jobDone(mc)
+	}
+
+	// The order of the inputs does not matter.
+	swapped := &WorkRequest{Argv: []string{"cc", "-o", "/src/a.o", "-c", "/src/a.c"}}
+	if mc, _ := mcs.pick(swapped); mc != first {
+		t.Errorf("swapped inputs went to %s, want %s", mc.workerAddr, first.workerAddr)
+	}
+
+	// Relative names count from the job's directory.
+	relative := &WorkRequest{Dir: "/src", Argv: []string{"sh", "-c", "cc -c a.c -o ./a.o"}}
+	if mc, _ := mcs.pick(relative); mc != first {
+		t.Errorf("relative inputs went to %s, want %s", mc.workerAddr, first.workerAddr)
+	}
+	mcs.jobDone(first)
+
+	// The preferred mirror is full; the job goes elsewhere.
+	if mc, _ := mcs.pick(req); mc != first {
+		t.Errorf("second slot: got %s, want %s", mc.workerAddr, first.workerAddr)
+	}
+	mc, err := mcs.pick(req)
+	if err != nil || mc == first {
+		t.Errorf("saturated: got %v, %v", mc, err)
+	}
+}
+
+func TestMirrorConnectionsPickRecent(t *testing.T) {
+	mcs := &mirrorConnections{
+		workers: map[string]Registration{},
+		mirrors: map[string]*mirrorConnection{},
+		now:     time.Now,
+	}
+	for _, a := range []string{"w1:1", "w2:1", "w3:1"} {
+		mcs.workers[a] = Registration{Address: a}
+		mcs.mirrors[a] = &mirrorConnection{workerAddr: a, maxJobs: 1, availableJobs: 1}
+	}
+
+	// Without a root, only the hint counts.
+	req := &WorkRequest{Argv: []string{"cc", "-c", "a.c"}, AffinityHint: "a.c"}
+	preferred := mcs.preferredMirror(affinityKey("", req), req)
+	preferred.availableJobs--
+	elsewhere, err := mcs.pick(req)
+	if err != nil || elsewhere == preferred {
+		t.Fatalf("saturated: got %v, %v", elsewhere, err)
+	}
+	preferred.availableJobs++
+	mcs.jobDone(elsewhere)
+
+	// Jobs are remembered by fingerprint: a different job with the
+	// same hint, or the same command in another environment, goes
+	// to the hashed mirror.
+	other := &WorkRequest{Argv: []string{"cc", "-E", "a.c"}, AffinityHint: "a.c"}
+	if mc, _ := mcs.pick(other); mc != preferred {
+		t.Errorf("other job: got %s, want %s", mc.workerAddr, preferred.workerAddr)
+	} else {
+		mcs.jobDone(mc)
+	}
+	env := &WorkRequest{Argv: req.Argv, Env: []string{"FOO=1"}, AffinityHint: "a.c"}
+	if mc, _ := mcs.pick(env); mc != preferred {
+		t.Errorf("other env: got %s, want %s", mc.workerAddr, preferred.workerAddr)
+	} else {
+		mcs.jobDone(mc)
+	}
+
+	// The job ran elsewhere last, so its inputs are there.
+	again := &WorkRequest{Argv: []string{"cc", "-c", "a.c"}, AffinityHint: "a.c", Env: []string{"TERM=xterm"}}
+	if mc, _ := mcs.pick(again); mc != elsewhere {
+		t.Errorf("got %s, want %s where the job ran last", mc.workerAddr, elsewhere.workerAddr)
+	} else {
+		mcs.jobDone(mc)
+	}
+
+	// Once that mirror is gone, the hashed one is preferred
+	// again.
+	delete(mcs.mirrors, elsewhere.workerAddr)
+	if mc, _ := mcs.pick(again); mc != preferred {
+		t.Errorf("got %s, want %s", mc.workerAddr, preferred.workerAddr)
+	}
+}
+
+func TestMirrorConnectionsPickForced(t *testing.T) {
+	mcs := &mirrorConnections{
+		master:  &Master{options: &MasterOptions{}},
+		workers: map[string]Registration{},
+		mirrors: map[string]*mirrorConnection{},
+		now:     time.Now,
+	}
+	for _, a := range []string{"w1:1", "w2:1"} {
+		mcs.workers[a] = Registration{Address: a}
+		mcs.mirrors[a] = &mirrorConnection{workerAddr: a, maxJobs: 1, availableJobs: 1}
+	}
+
+	exclude := &WorkRequest{ExcludeWorkers: []string{"w1:1"}}
+	for i := 0; i < 2; i++ {
+		mc, err := mcs.pick(exclude)
+		if err != nil || mc.workerAddr != "w2:1" {
+			t.Errorf("excluding w1:1: got %v, %v", mc, err)
+		}
+	}
+	if _, err := mcs.pick(&WorkRequest{ExcludeWorkers: []string{"w1:1", "w2:1"}}); err == nil {
+		t.Errorf("pick succeeded with all workers excluded")
+	}
+
+	// Required workers are used even when they are full.
+	require := &WorkRequest{RequireWorker: "w2:1"}
+	if mc, err := mcs.pick(require); err != nil || mc.workerAddr != "w2:1" {
+		t.Errorf("requiring w2:1: got %v, %v", mc, err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	if _, err := mcs.pick(&WorkRequest{RequireWorker: addr}); err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Errorf("requiring unreachable worker: got %v", err)
+	}
+}
+
+func TestMasterRetryAvoidsFailedWorker(t *testing.T) {
+	mcs := &mirrorConnections{
+		workers: map[string]Registration{},
+		mirrors: map[string]*mirrorConnection{},
+		now:     time.Now,
+	}
+	for _, a := range []string{"w1:1", "w2:1"} {
+		mcs.workers[a] = Registration{Address: a}
+		mcs.mirrors[a] = &mirrorConnection{workerAddr: a, maxJobs: 1, availableJobs: 1}
+	}
+	m := &Master{
+		options: &MasterOptions{
+			RetryCount:      3,
+			RetryBackoff:    time.Millisecond,
+			RetryMaxBackoff: time.Millisecond,
+		},
+		mirrors: mcs,
+		session: &session{},
+	}
+	mcs.master = m
+
+	// Fails on the first worker it runs on.
+	flaky := func() ([]string, error) {
+		var used []string
+		_, err := m.retry(func(avoid string) error {
+			mc, err := mcs.pickAvoiding(&WorkRequest{}, avoid)
+			if err != nil {
+				return err
+			}
+			defer mcs.jobDone(mc)
+			used = append(used, mc.workerAddr)
+			if len(used) == 1 {
+				return phaseError(PhaseExec, mc.workerAddr, fmt.Errorf("flaky"))
+			}
+			return nil
+		})
+		return used, err
+	}
+
+	used, err := flaky()
+	if err != nil || len(used) != 2 || used[0] == used[1] {
+		t.Errorf("got workers %v, error %v; want a retry on the other worker", used, err)
+	}
+
+	// With one worker left, the retry goes there again.
+	delete(mcs.mirrors, "w2:1")
+	used, err = flaky()
+	if err != nil || len(used) != 2 || used[1] != "w1:1" {
+		t.Errorf("got workers %v, error %v; want a retry on w1:1", used, err)
+	}
+}
+
+func TestMirrorConnectionsPickSpare(t *testing.T) {
+	mcs := &mirrorConnections{
+		workers: map[string]Registration{},
+		mirrors: map[string]*mirrorConnection{},
+	}
+	for _, a := range []string{"w1:1", "w2:1", "w3:1"} {
+		mcs.workers[a] = Registration{Address: a}
+		mcs.mirrors[a] = &mirrorConnection{workerAddr: a, maxJobs: 1, availableJobs: 1}
+	}
+	mcs.mirrors["w3:1"].availableJobs = 0
+
+	if mc := mcs.pickSpare(&WorkRequest{ExcludeWorkers: []string{"w2:1"}}, "w1:1"); mc != nil {
+		t.Errorf("got excluded worker %s", mc.workerAddr)
+	}
+	req := &WorkRequest{}
+	if mc := mcs.pickSpare(req, "w1:1"); mc == nil || mc.workerAddr != "w2:1" {
+		t.Fatalf("got %v, want w2:1", mc)
+	}
+	if mc := mcs.pickSpare(req, "w1:1"); mc != nil {
+		t.Errorf("got %s, want none without free slots", mc.workerAddr)
+	}
+}
+
+func TestMirrorConnectionsPickLoad(t *testing.T) {
+	const gb = 1 << 30
+	mcs := &mirrorConnections{
+		workers: map[string]Registration{
+			"busy:1":  {Address: "busy:1", LoadAvg: 7, NumCPU: 8, MemAvailable: 8 * gb},
+			"idle:1":  {Address: "idle:1", LoadAvg: 1, NumCPU: 4, MemAvailable: 1 * gb},
+			"roomy:1": {Address: "roomy:1", LoadAvg: 2, NumCPU: 8, MemAvailable: 4 * gb},
+		},
+		mirrors: map[string]*mirrorConnection{},
+	}
+	for a := range mcs.workers {
+		mcs.mirrors[a] = &mirrorConnection{workerAddr: a, maxJobs: 1, availableJobs: 1}
+	}
+
+	// idle:1 and roomy:1 both have a load of 0.25 per CPU.
+	var got []string
+	for i := 0; i < 3; i++ {
+		mc, err := mcs.pick(&WorkRequest{})
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		got = append(got, mc.workerAddr)
+	}
+	if want := "roomy:1 idle:1 busy:1"; strings.Join(got, " ") != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+
+	// All full: the least loaded gets the extra job.
+	if mc, err := mcs.pick(&WorkRequest{}); err != nil || mc.workerAddr != "roomy:1" {
+		t.Errorf("all busy: got %v, %v", mc, err)
+	}
+
+	// Workers that do not report their load are still used.
+	mcs.workers["old:1"] = Registration{Address: "old:1"}
+	mcs.mirrors["old:1"] = &mirrorConnection{workerAddr: "old:1", maxJobs: 1, availableJobs: 1}
+	mcs.mirrors["idle:1"].availableJobs = 1
+	for i := 0; i < 2; i++ {
+		if _, err := mcs.pick(&WorkRequest{}); err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+	}
+	if mcs.mirrors["old:1"].availableJobs != 0 || mcs.mirrors["idle:1"].availableJobs != 0 {
+		t.Errorf("free mirrors left unused")
+	}
+
+	delete(mcs.mirrors, "busy:1")
+	delete(mcs.mirrors, "roomy:1")
+	delete(mcs.workers, "old:1")
+	if addr := mcs.idleWorkerAddress(nil); addr != "roomy:1" {
+		t.Errorf("idleWorkerAddress: got %s, want roomy:1", addr)
+	}
+}
+
+func TestMirrorConnectionsPickLabels(t *testing.T) {
+	mcs := &mirrorConnections{
+		workers: map[string]Registration{
+			"x86:1": {Address: "x86:1", Labels: map[string]string{"arch": "amd64"}},
+			"arm:1": {Address: "arm:1", Labels: map[string]string{"arch": "arm64", "pool": "ci"}},
+		},
+		mirrors: map[string]*mirrorConnection{},
+	}
+	for a := range mcs.workers {
+		mcs.mirrors[a] = &mirrorConnection{workerAddr: a, maxJobs: 2, availableJobs: 2}
+	}
+
+	req := &WorkRequest{RequiredLabels: map[string]string{"arch": "arm64"}}
+	for i := 0; i < 3; i++ {
+		if mc, err := mcs.pick(req); err != nil || mc.workerAddr != "arm:1" {
+			t.Fatalf("pick %d: got %v, %v; want arm:1", i, mc, err)
+		}
+	}
+
+	req = &WorkRequest{RequiredLabels: map[string]string{"arch": "arm64", "pool": "prod"}}
+	if mc, err := mcs.pick(req); err == nil || !strings.Contains(err.Error(), "arch=arm64,pool=prod") {
+		t.Errorf("unmatched labels: got %v, %v", mc, err)
+	} else if _, ok := err.(*NoMatchingWorkerError); !ok {
+		t.Errorf("unmatched labels: got %T, want *NoMatchingWorkerError", err)
+	}
+
+	// A matching worker that is known but not connected, eg.
+	// because it is cooling off, may come back.
+	mcs.known = map[string]Registration{
+		"prod:1": {Address: "prod:1", Labels: map[string]string{"arch": "arm64", "pool": "prod"}},
+	}
+	if _, err := mcs.pick(req); err == nil {
+		t.Errorf("unconnected labels: pick succeeded")
+	} else if _, ok := err.(*NoMatchingWorkerError); ok {
+		t.Errorf("unconnected labels: got %v, want a retryable error", err)
+	}
+
+	// Unconstrained requests still use all workers.
+	if mc, err := mcs.pick(&WorkRequest{}); err != nil || mc.workerAddr != "x86:1" {
+		t.Errorf("unconstrained: got %v, %v; want the free x86:1", mc, err)
+	}
+}
+
+func TestMirrorConnectionsCoolOff(t *testing.T) {
+	now := time.Unix(1000, 0)
+	mcs := &mirrorConnections{
+		workers: map[string]Registration{
+			"w1:1": {Address: "w1:1"},
+		},
+		mirrors:    map[string]*mirrorConnection{},
+		coolingOff: map[string]time.Time{"w1:1": now.Add(time.Minute)},
+		now:        func() time.Time { return now },
+	}
+	if addr := mcs.idleWorkerAddress(nil); addr != "" {
+		t.Errorf("got %s while it cools off", addr)
+	}
+	if got := mcs.workersCoolingOff(); len(got) != 1 || got[0] != "w1:1" {
+		t.Errorf("workersCoolingOff: got %v", got)
+	}
+
+	now = now.Add(time.Minute)
+	if addr := mcs.idleWorkerAddress(nil); addr != "w1:1" {
+		t.Errorf("got %q after cooling off, want w1:1", addr)
+	}
+	if len(mcs.coolingOff) != 0 {
+		t.Errorf("expired entry kept: %v", mcs.coolingOff)
+	}
+}
+
+func TestMirrorConnectionsPreferHealthy(t *testing.T) {
+	mcs := &mirrorConnections{
+		workers: map[string]Registration{
+			"sick:1":   {Address: "sick:1", Health: 0.3, LoadAvg: 0, NumCPU: 8},
+			"busy:1":   {Address: "busy:1", Health: 0.9, LoadAvg: 6, NumCPU: 8},
+			"better:1": {Address: "better:1", Health: 0.95, LoadAvg: 2, NumCPU: 8},
+		},
+		mirrors: map[string]*mirrorConnection{},
+	}
+	// Among equally healthy workers, load decides.
+	if addr := mcs.idleWorkerAddress(nil); addr != "better:1" {
+		t.Errorf("got %s, want better:1", addr)
+	}
+	delete(mcs.workers, "better:1")
+	if addr := mcs.idleWorkerAddress(nil); addr != "busy:1" {
+		t.Errorf("got %s, want busy:1 over the idle but unhealthy worker", addr)
+	}
+	delete(mcs.workers, "busy:1")
+	if addr := mcs.idleWorkerAddress(nil); addr != "sick:1" {
+		t.Errorf("got %q, want sick:1 as the last resort", addr)
+	}
+}
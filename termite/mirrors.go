@@ -49,6 +49,7 @@ func (me *WorkerMirrors) getMirror(rpcConn, revConn, contentConn, revContentConn
 	key := fmt.Sprintf("%v", rpcConn.RemoteAddr())
 	me.mirrorMap[key] = mirror
 	mirror.key = key
+	me.worker.reporter.Trigger()
 	return mirror, nil
 }
 
@@ -59,6 +60,7 @@ func (me *WorkerMirrors) DropMirror(mirror *Mirror) {
 	log.Println("dropping mirror", mirror.key)
 	delete(me.mirrorMap, mirror.key)
 	me.cond.Broadcast()
+	me.worker.reporter.Trigger()
 	runtime.GC()
 }
 
@@ -71,6 +73,17 @@ func (me *WorkerMirrors) mirrors() (result []*Mirror) {
 	return
 }
 
+// runningCount returns the number of tasks running across all mirrors.
+func (me *WorkerMirrors) runningCount() int {
+	r := 0
+	for _, m := range me.mirrors() {
+		m.fsMutex.Lock()
+		r += m.runningCount()
+		m.fsMutex.Unlock()
+	}
+	return r
+}
+
 func (me *WorkerMirrors) shutdown(aggressive bool) {
 	log.Printf("shutting down mirrors: aggressive=%v", aggressive)
 	wg := sync.WaitGroup{}
@@ -2,6 +2,7 @@ package termite
 
 import (
 	"crypto"
+	cryptorand "crypto/rand"
 	"fmt"
 	"io"
 	"log"
@@ -27,10 +28,22 @@ func SplitPath(name string) (dir, base string) {
 	return dir, base
 }
 
-func RandomBytes(n int) []byte {
-	c := make([]byte, 0)
-	for i := 0; i < n; i++ {
-		c = append(c, byte(rand.Int31n(256)))
+// RandomBytes returns n bytes from the system's secure random
+// source, for secrets and challenges.
+func RandomBytes(n int) ([]byte, error) {
+	c := make([]byte, n)
+	if _, err := io.ReadFull(cryptorand.Reader, c); err != nil {
+		return nil, fmt.Errorf("reading random bytes: %v", err)
+	}
+	return c, nil
+}
+
+// pseudoRandomBytes returns n bytes from the cheap random source,
+// for uses that need no secrecy, like temporary file names.
+func pseudoRandomBytes(n int) []byte {
+	c := make([]byte, n)
+	for i := range c {
+		c[i] = byte(rand.Int31n(256))
 	}
 	return c
 }
@@ -123,14 +136,70 @@ func MakeUnescape(cmd string) string {
 // will give up and return nil when it returns shell-metacharacters
 // ($, ` , etc.)
 func ParseCommand(cmd string) []string {
+	return parseCommand(cmd, nil)
+}
+
+// ParseCommandEnv is ParseCommand, but it also expands $VAR, ${VAR}
+// and a leading ~ like the shell would with the environment env.  It
+// returns nil for expansions that the shell would split into words
+// or glob, and for other uses of $, like $(...) or ${VAR:-x}.
+func ParseCommandEnv(cmd string, env []string) []string {
+	vars := map[string]string{}
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i > 0 {
+			vars[kv[:i]] = kv[i+1:]
+		}
+	}
+	return parseCommand(cmd, vars)
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(!first && c >= '0' && c <= '9')
+}
+
+// parseVariable parses the name of the variable reference at the
+// start of s, which follows a '$'.  It returns the name and the
+// length of the reference, or a length of 0 if it is not a plain
+// variable reference.
+func parseVariable(s string) (name string, n int) {
+	braced := strings.HasPrefix(s, "{")
+	i := 0
+	if braced {
+		i++
+	}
+	start := i
+	for i < len(s) && isNameChar(s[i], i == start) {
+		i++
+	}
+	if i == start {
+		return "", 0
+	}
+	name = s[start:i]
+	if braced {
+		if i == len(s) || s[i] != '}' {
+			return "", 0
+		}
+		i++
+	}
+	return name, i
+}
+
+// parseCommand parses cmd, expanding variables from vars.  If vars is
+// nil, it gives up on any expansion.
+func parseCommand(cmd string, vars map[string]string) []string {
 	escape := false
 	squote := false
 	dquote := false
 
 	result := []string{}
 	word := []byte{}
-	for i, ch := range cmd {
-		c := byte(ch)
+
+	// Set once the current word has quotes or characters; an
+	// unquoted empty expansion does not make a word.
+	inWord := false
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
 		if squote {
 			if c == '\'' {
 				squote = false
@@ -139,6 +208,24 @@ func ParseCommand(cmd string) []string {
 			}
 			continue
 		}
+		if c == '$' && !escape {
+			if vars == nil {
+				return nil
+			}
+			name, n := parseVariable(cmd[i+1:])
+			if n == 0 {
+				return nil
+			}
+			val := vars[name]
+			if !dquote && strings.ContainsAny(val, " \t\n\f*?[") {
+				// Subject to word splitting and globbing.
+				return nil
+			}
+			word = append(word, val...)
+			inWord = inWord || val != ""
+			i += n
+			continue
+		}
 		if dquote {
 			// TODO - not really correct; "a\nb" -> a\nb
 			if escape {
@@ -152,8 +239,6 @@ func ParseCommand(cmd string) []string {
 				dquote = !dquote
 			case '\\':
 				escape = true
-			case '$':
-				return nil
 			default:
 				word = append(word, c)
 			}
@@ -161,35 +246,50 @@ func ParseCommand(cmd string) []string {
 		}
 		if escape {
 			word = append(word, c)
+			inWord = true
 			escape = false
 			continue
 		}
 		if c == '\'' {
 			squote = true
+			inWord = true
 			continue
 		}
 		if c == '"' {
 			dquote = true
+			inWord = true
 			continue
 		}
 		if c == '\\' {
 			escape = true
 			continue
 		}
+		if c == '~' && !inWord && vars != nil &&
+			(i+1 == len(cmd) || cmd[i+1] == '/' || IsSpace(cmd[i+1])) {
+			home, ok := vars["HOME"]
+			if !ok {
+				return nil
+			}
+			word = append(word, home...)
+			inWord = true
+			continue
+		}
 		if controlCharMap[c] {
 			return nil
 		}
 		if IsSpace(c) {
-			if i > 0 && !IsSpace(cmd[i-1]) {
+			if inWord {
 				result = append(result, string(word))
 				word = []byte{}
+				inWord = false
 			}
 		} else {
 			word = append(word, c)
+			inWord = true
 		}
 	}
 
-	if len(cmd) > 0 && !IsSpace(cmd[len(cmd)-1]) {
+	if inWord {
 		result = append(result, string(word))
 	}
 	return result
@@ -2,6 +2,7 @@ package termite
 
 import (
 	"log"
+	"reflect"
 	"testing"
 )
 
@@ -82,6 +83,64 @@ func TestParseCommand(t *testing.T) {
 	}
 }
 
+func TestParseCommandEnv(t *testing.T) {
+	env := []string{
+		"HOME=/home/user",
+		"OBJDIR=out",
+		"EMPTY=",
+		"FLAGS=-O2 -g",
+		"GLOB=*.c",
+	}
+	cases := []struct {
+		cmd string
+		res []string
+	}{
+		{"gcc -I$HOME/include", []string{"gcc", "-I/home/user/include"}},
+		{"gcc -o ${OBJDIR}/foo.o", []string{"gcc", "-o", "out/foo.o"}},
+		{"echo ${OBJDIR}x $OBJDIR.o", []string{"echo", "outx", "out.o"}},
+		{"echo \"$FLAGS\"", []string{"echo", "-O2 -g"}},
+		{"echo \"${GLOB}\"", []string{"echo", "*.c"}},
+		{"echo '$HOME'", []string{"echo", "$HOME"}},
+		{"echo \\$HOME", []string{"echo", "$HOME"}},
+		{"echo \"\\$HOME\"", []string{"echo", "$HOME"}},
+		{"echo a$UNDEFINED", []string{"echo", "a"}},
+		{"echo $UNDEFINED b", []string{"echo", "b"}},
+		{"echo $EMPTY", []string{"echo"}},
+		{"echo \"$UNDEFINED\"", []string{"echo", ""}},
+		{"ls ~", []string{"ls", "/home/user"}},
+		{"ls ~/src", []string{"ls", "/home/user/src"}},
+		{"echo \"~\" '~/x'", []string{"echo", "~", "~/x"}},
+
+		// Unsafe.
+		{"echo $FLAGS", nil},
+		{"echo $GLOB", nil},
+		{"echo $(pwd)", nil},
+		{"echo `pwd`", nil},
+		{"echo ${HOME:-x}", nil},
+		{"echo ${HOME", nil},
+		{"echo $1 $?", nil},
+		{"echo $", nil},
+		{"ls ~other", nil},
+		{"ls a~", nil},
+		{"echo $HOME > x", nil},
+		{"a $HOME | b", nil},
+		{"echo *.c", nil},
+	}
+	for _, c := range cases {
+		got := ParseCommandEnv(c.cmd, env)
+		if !reflect.DeepEqual(got, c.res) {
+			t.Errorf("ParseCommandEnv(%q): got %q, want %q", c.cmd, got, c.res)
+		}
+	}
+
+	if got := ParseCommandEnv("ls ~", nil); got != nil {
+		t.Errorf("~ without HOME: got %q", got)
+	}
+	if got := ParseCommand("echo $HOME"); got != nil {
+		t.Errorf("ParseCommand expanded: %q", got)
+	}
+}
+
 func TestMakeUnescape(t *testing.T) {
 	cases := []struct {
 		in, out string
@@ -0,0 +1,97 @@
+package termite
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// outputStreams holds the client connections that receive the stdout
+// and stderr of a job while it runs, and the stdin of the job, if it
+// has one.
+type outputStreams struct {
+	ids   []string
+	conns []net.Conn
+	stdin *stdinReplay
+}
+
+func (me *Master) waitOutputStreams(req *WorkRequest) *outputStreams {
+	s := &outputStreams{}
+	if id := req.StdinId; id != "" {
+		keep := 0
+		if me.options.RetryCount > 0 {
+			keep = me.options.MaxStdinReplay
+		}
+		s.stdin = newStdinReplay(func() net.Conn {
+			return me.pending.WaitConnection(id)
+		}, keep)
+	}
+	for _, id := range []string{req.StdoutId, req.StderrId} {
+		var conn net.Conn
+		if id != "" {
+			conn = me.pending.WaitConnection(id)
+		}
+		s.ids = append(s.ids, id)
+		s.conns = append(s.conns, conn)
+	}
+	return s
+}
+
+// tunnel forwards output from the worker at addr to the client.  The
+// returned function waits for the copies to finish; if abort is set,
+// the worker side is closed first, so we don't wait for a job that
+// never started.
+func (me *outputStreams) tunnel(addr string, secret []byte, config *tls.Config) (wait func(abort bool), err error) {
+	var wg sync.WaitGroup
+	var remotes []net.Conn
+	wait = func(abort bool) {
+		if abort {
+			for _, r := range remotes {
+				r.Close()
+			}
+		}
+		wg.Wait()
+	}
+
+	for i, id := range me.ids {
+		if id == "" {
+			continue
+		}
+		remote, err := DialTypedConnection(addr, id, secret, config)
+		if err != nil {
+			wait(true)
+			return nil, err
+		}
+		remotes = append(remotes, remote)
+		wg.Add(1)
+		go func(dst net.Conn) {
+			if _, err := io.Copy(dst, remote); err != nil {
+				log.Println("output stream:", err)
+			}
+			remote.Close()
+			wg.Done()
+		}(me.conns[i])
+	}
+	return wait, nil
+}
+
+// finish writes output that was not streamed, and closes the client
+// connections.
+func (me *outputStreams) finish(rep *WorkResponse) {
+	if me.stdin != nil {
+		me.stdin.close()
+	}
+	for i, out := range []*string{&rep.Stdout, &rep.Stderr} {
+		conn := me.conns[i]
+		if conn == nil {
+			continue
+		}
+		if *out != "" {
+			io.WriteString(conn, *out)
+			*out = ""
+		}
+		conn.Close()
+	}
+}
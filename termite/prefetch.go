@@ -0,0 +1,146 @@
+package termite
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/hanwen/termite/attr"
+)
+
+// Before running a job, the master pushes the content of files named
+// on its command line to the mirror, so the worker does not fetch
+// them one by one when the job opens them.  Files beyond the push
+// limit are fetched by the mirror in the background instead.
+const (
+	// Upper bound on the content pushed for a single job.
+	_PREFETCH_LIMIT = 16 << 20
+
+	// Upper bound on the content sent in a single RPC.
+	_PREFETCH_BATCH = 1 << 20
+)
+
+// Prefetch saves the pushed contents in the worker's content store,
+// and starts fetching the others.  Contents that would take the free
+// space below StoreOptions.MinFreeBytes are refused.
+func (me *Mirror) Prefetch(req *PrefetchRequest, rep *PrefetchResponse) error {
+	for _, c := range req.Contents {
+		if err := me.worker.content.CheckSpace(int64(len(c))); err != nil {
+			return err
+		}
+		me.worker.content.Save(c)
+	}
+	if len(req.Fetch) > 0 {
+		me.rpcFs.prefetch(req.Fetch)
+	}
+	return nil
+}
+
+// prefetchCandidates returns the files that appear on the command
+// line of req, one for each content hash.
+func (me *Master) prefetchCandidates(req *WorkRequest) []*attr.FileAttr {
+	names := DetectFiles(me.options.WritableRoot, strings.Join(req.Argv, " "))
+	seen := map[string]bool{}
+	var result []*attr.FileAttr
+	for _, n := range names {
+		a := me.attributes.Get(strings.TrimLeft(n, "/"))
+		if a == nil || a.Deletion() || !a.IsRegular() || a.Hash == "" || seen[a.Hash] {
+			continue
+		}
+		seen[a.Hash] = true
+		result = append(result, a)
+	}
+	return result
+}
+
+// prefetch pushes the candidates that the mirror does not have yet,
+// and returns the number of bytes pushed.  It is best-effort: errors
+// are only logged.
+func (me *Master) prefetch(mirror *mirrorConnection, req *WorkRequest, candidates []*attr.FileAttr) int64 {
+	if len(candidates) == 0 {
+		return 0
+	}
+	pushed, err := me.sendPrefetch(mirror, candidates)
+	if err != nil {
+		log.Printf("prefetch for task %d: %v", req.TaskId, err)
+	}
+	return pushed
+}
+
+func (me *Master) sendPrefetch(mirror *mirrorConnection, candidates []*attr.FileAttr) (pushed int64, err error) {
+	haveReq := HaveHashesRequest{}
+	for _, a := range candidates {
+		haveReq.Hashes = append(haveReq.Hashes, a.Hash)
+	}
+	haveRep := HaveHashesResponse{}
+	if err := mirror.rpcClient.Call("Mirror.HaveHashes", &haveReq, &haveRep); err != nil {
+		return 0, err
+	}
+	if len(haveRep.Have) != len(candidates) {
+		return 0, fmt.Errorf("HaveHashes returned %d results for %d hashes", len(haveRep.Have), len(candidates))
+	}
+
+	hits := 0
+	total := 0
+	fetch := map[string]int64{}
+	batch := PrefetchRequest{}
+	batchSize := 0
+	flush := func() error {
+		if len(batch.Contents) == 0 {
+			return nil
+		}
+		me.contentStore.Throttle(batchSize)
+		err := mirror.rpcClient.Call("Mirror.Prefetch", &batch, &PrefetchResponse{})
+		if err == nil {
+			me.addPrefetchStats(0, len(batch.Contents), batchSize, 0)
+			pushed += int64(batchSize)
+		}
+		batch = PrefetchRequest{}
+		batchSize = 0
+		return err
+	}
+	for i, a := range candidates {
+		if haveRep.Have[i] {
+			hits++
+			continue
+		}
+		if total+int(a.Size) > _PREFETCH_LIMIT {
+			fetch[a.Hash] = int64(a.Size)
+			continue
+		}
+		total += int(a.Size)
+		content, err := me.contentStore.ReadContent(a.Hash)
+		if err != nil {
+			log.Printf("prefetch: %v", err)
+			continue
+		}
+		if batchSize+len(content) > _PREFETCH_BATCH {
+			if err := flush(); err != nil {
+				return pushed, err
+			}
+		}
+		batch.Contents = append(batch.Contents, content)
+		batchSize += len(content)
+	}
+	me.addPrefetchStats(hits, 0, 0, 0)
+	if err := flush(); err != nil {
+		return pushed, err
+	}
+	if len(fetch) == 0 {
+		return pushed, nil
+	}
+	err = mirror.rpcClient.Call("Mirror.Prefetch", &PrefetchRequest{Fetch: fetch}, &PrefetchResponse{})
+	if err == nil {
+		me.addPrefetchStats(0, 0, 0, len(fetch))
+	}
+	return pushed, err
+}
+
+func (me *Master) addPrefetchStats(hits, sent, bytes, fetched int) {
+	me.prefetchMutex.Lock()
+	defer me.prefetchMutex.Unlock()
+	me.prefetchHits += hits
+	me.prefetchSent += sent
+	me.prefetchBytes += bytes
+	me.prefetchFetched += fetched
+}
@@ -0,0 +1,75 @@
+package termite
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Jobs on a shared machine should not starve its interactive users.
+// With WorkerOptions.Nice and IOClass, the worker lowers the CPU and
+// I/O scheduling priority of each job right after starting it.  The
+// settings are per worker, so a dedicated build machine can run jobs
+// at normal priority while a laptop runs them niced.  Both apply to
+// the process group of the job, and the processes it forks later
+// inherit them.
+
+// I/O scheduling classes for WorkerOptions.IOClass; see ioprio_set(2).
+const (
+	IOClassRealtime   = 1
+	IOClassBestEffort = 2
+	IOClassIdle       = 3
+)
+
+const (
+	_IOPRIO_WHO_PGRP    = 2
+	_IOPRIO_CLASS_SHIFT = 13
+
+	// The default level within the best-effort and realtime
+	// classes.
+	_IOPRIO_DEFAULT_LEVEL = 4
+)
+
+// ParseIOClass parses the name of an I/O scheduling class, as in
+// ionice(1).  The empty string leaves the class unchanged.
+func ParseIOClass(name string) (int, error) {
+	switch name {
+	case "":
+		return 0, nil
+	case "realtime":
+		return IOClassRealtime, nil
+	case "best-effort":
+		return IOClassBestEffort, nil
+	case "idle":
+		return IOClassIdle, nil
+	}
+	return 0, fmt.Errorf("unknown I/O class %q; want realtime, best-effort or idle", name)
+}
+
+func ioprioSet(who, id, prio int) error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, uintptr(who), uintptr(id), uintptr(prio))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// prioritizeJob sets the scheduling priority of the job started as
+// pid, which leads its own process group.
+func (me *Worker) prioritizeJob(pid int) error {
+	o := me.options
+	if o.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PGRP, pid, o.Nice); err != nil {
+			return fmt.Errorf("setpriority: %v", err)
+		}
+	}
+	if o.IOClass != 0 {
+		prio := o.IOClass << _IOPRIO_CLASS_SHIFT
+		if o.IOClass != IOClassIdle {
+			prio |= _IOPRIO_DEFAULT_LEVEL
+		}
+		if err := ioprioSet(_IOPRIO_WHO_PGRP, pid, prio); err != nil {
+			return fmt.Errorf("ioprio_set: %v", err)
+		}
+	}
+	return nil
+}
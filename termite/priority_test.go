@@ -0,0 +1,59 @@
+package termite
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+func TestParseIOClass(t *testing.T) {
+	for name, want := range map[string]int{
+		"":            0,
+		"realtime":    IOClassRealtime,
+		"best-effort": IOClassBestEffort,
+		"idle":        IOClassIdle,
+	} {
+		if got, err := ParseIOClass(name); err != nil || got != want {
+			t.Errorf("ParseIOClass(%q) = %d, %v, want %d", name, got, err, want)
+		}
+	}
+	if _, err := ParseIOClass("low"); err == nil {
+		t.Error("ParseIOClass(low) should fail")
+	}
+}
+
+func TestPrioritizeJob(t *testing.T) {
+	w := &Worker{options: &WorkerOptions{
+		Nice:    7,
+		IOClass: IOClassIdle,
+	}}
+	cmd := exec.Command("sleep", "10")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	if err := w.prioritizeJob(cmd.Process.Pid); err != nil {
+		t.Fatalf("prioritizeJob: %v", err)
+	}
+
+	// The getpriority system call returns 20 - nice.
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, cmd.Process.Pid)
+	if err != nil {
+		t.Fatalf("Getpriority: %v", err)
+	}
+	if nice := 20 - prio; nice != 7 {
+		t.Errorf("got nice %d, want 7", nice)
+	}
+
+	const ioprioWhoProcess = 1
+	r, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_GET, ioprioWhoProcess, uintptr(cmd.Process.Pid), 0)
+	if errno != 0 {
+		t.Fatalf("ioprio_get: %v", errno)
+	}
+	if class := int(r) >> _IOPRIO_CLASS_SHIFT; class != IOClassIdle {
+		t.Errorf("got I/O class %d, want %d", class, IOClassIdle)
+	}
+}
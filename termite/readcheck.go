@@ -0,0 +1,168 @@
+package termite
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+)
+
+// A job can race with an edit on the master: it reads a header while
+// the master already has a newer version.  With
+// MasterOptions.CheckReads, workers record the content hash of every
+// file a job reads from the master, and the master compares them with
+// its current hashes once the job is done.  Stale reads are listed in
+// the WorkResponse; with StrictReads, the job fails instead, and its
+// file changes are discarded.  Jobs that record reads get a file
+// system of their own, so the reads are theirs alone.
+
+// FileRead is a file that a job read, with the hash of the content
+// it saw.
+type FileRead struct {
+	Path string
+	Hash string
+}
+
+// StaleReadError fails jobs that read files which changed on the
+// master since.
+type StaleReadError struct {
+	Files []string
+}
+
+func (e *StaleReadError) Error() string {
+	return fmt.Sprintf("read %d files that changed since: %s",
+		len(e.Files), HumanTrim(strings.Join(e.Files, " "), 200))
+}
+
+////////////////////////////////////////////////////////////////
+// Worker side.
+
+// readSet holds the files read in a workerFuseFs.
+type readSet struct {
+	mutex sync.Mutex
+	reads map[string]string
+
+	// Set if a file could not be fetched for lack of disk space.
+	// The job may have failed for it, so it is retried elsewhere.
+	fetchErr error
+}
+
+func newReadSet() *readSet {
+	return &readSet{reads: map[string]string{}}
+}
+
+// add records a read of name.  If the file is read more than once,
+// the first read counts.
+func (me *readSet) add(name, hash string) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if _, ok := me.reads[name]; !ok {
+		me.reads[name] = hash
+	}
+}
+
+func (me *readSet) reset() {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.reads = map[string]string{}
+	me.fetchErr = nil
+}
+
+// noSpace records that name could not be fetched, because the
+// content store is full.
+func (me *readSet) noSpace(name string) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if me.fetchErr == nil {
+		me.fetchErr = fmt.Errorf("no disk space to fetch %s", name)
+	}
+}
+
+// fetchError returns the error recorded by noSpace, if any.
+func (me *readSet) fetchError() error {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return me.fetchErr
+}
+
+// list returns the reads, sorted by path.
+func (me *readSet) list() []FileRead {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	var result []FileRead
+	for p, h := range me.reads {
+		result = append(result, FileRead{Path: p, Hash: h})
+	}
+	sort.Sort(fileReadsByPath(result))
+	return result
+}
+
+type fileReadsByPath []FileRead
+
+func (me fileReadsByPath) Len() int           { return len(me) }
+func (me fileReadsByPath) Less(i, j int) bool { return me[i].Path < me[j].Path }
+func (me fileReadsByPath) Swap(i, j int)      { me[i], me[j] = me[j], me[i] }
+
+// readRecorder adds the files opened from RpcFs to a readSet, and
+// notes fetches that failed for lack of disk space.
+type readRecorder struct {
+	pathfs.FileSystem
+	reads *readSet
+}
+
+func (me *readRecorder) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, code := me.FileSystem.Open(name, flags, context)
+	if code.Ok() {
+		if h := openedHash(f); h != "" {
+			me.reads.add(name, h)
+		}
+	} else if code == fuse.Status(syscall.ENOSPC) {
+		me.reads.noSpace(name)
+	}
+	return f, code
+}
+
+// openedHash returns the content hash of a file opened on RpcFs, or
+// "" for other files.
+func openedHash(f nodefs.File) string {
+	if w, ok := f.(*nodefs.WithFlags); ok {
+		f = w.File
+	}
+	if r, ok := f.(*rpcFsFile); ok {
+		return r.hash
+	}
+	return ""
+}
+
+////////////////////////////////////////////////////////////////
+// Master side.
+
+// staleReads returns the files in reads whose content on the master
+// differs from what the job read.
+func (me *Master) staleReads(reads []FileRead) []string {
+	var stale []string
+	for _, r := range reads {
+		me.hints.use(r.Hash)
+		a := me.attributes.Get(r.Path)
+		if a == nil || a.Hash != r.Hash {
+			stale = append(stale, r.Path)
+		}
+	}
+	return stale
+}
+
+// checkReads compares the files the job read with the master's, and
+// returns an error for stale reads under StrictReads.
+func (me *Master) checkReads(rep *WorkResponse) error {
+	rep.StaleReads = me.staleReads(rep.Reads)
+	rep.Reads = nil
+	if len(rep.StaleReads) == 0 || !me.options.StrictReads {
+		return nil
+	}
+	return &StaleReadError{Files: rep.StaleReads}
+}
@@ -0,0 +1,116 @@
+package termite
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"github.com/hanwen/termite/attr"
+)
+
+func TestReadSet(t *testing.T) {
+	s := newReadSet()
+	s.add("b", "hash-b")
+	s.add("a", "hash-a")
+	s.add("b", "hash-b2")
+
+	want := []FileRead{{"a", "hash-a"}, {"b", "hash-b"}}
+	if got := s.list(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	s.reset()
+	if got := s.list(); len(got) != 0 {
+		t.Errorf("got %v after reset", got)
+	}
+}
+
+// noSpaceFs fails all opens for lack of disk space.
+type noSpaceFs struct {
+	pathfs.FileSystem
+}
+
+func (me *noSpaceFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	return nil, fuse.Status(syscall.ENOSPC)
+}
+
+func TestReadRecorderNoSpace(t *testing.T) {
+	s := newReadSet()
+	r := &readRecorder{&noSpaceFs{pathfs.NewDefaultFileSystem()}, s}
+	if _, code := r.Open("file", 0, nil); code.Ok() {
+		t.Fatalf("Open succeeded")
+	}
+	if err := s.fetchError(); err == nil {
+		t.Errorf("fetch failure not recorded")
+	}
+	s.reset()
+	if err := s.fetchError(); err != nil {
+		t.Errorf("got %v after reset", err)
+	}
+}
+
+func TestOpenedHash(t *testing.T) {
+	f := &rpcFsFile{nodefs.NewDefaultFile(), fuse.Attr{}, "hash"}
+	if h := openedHash(f); h != "hash" {
+		t.Errorf("got %q", h)
+	}
+	if h := openedHash(&nodefs.WithFlags{File: f}); h != "hash" {
+		t.Errorf("got %q for wrapped file", h)
+	}
+	if h := openedHash(nodefs.NewDefaultFile()); h != "" {
+		t.Errorf("got %q for other file", h)
+	}
+}
+
+func TestMasterStaleReads(t *testing.T) {
+	files := map[string]*attr.FileAttr{
+		"": {
+			Path:        "",
+			Attr:        &fuse.Attr{Mode: fuse.S_IFDIR | 0755},
+			NameModeMap: map[string]fuse.FileMode{"same": fuse.S_IFREG, "changed": fuse.S_IFREG},
+		},
+		"same":    {Path: "same", Attr: &fuse.Attr{Mode: fuse.S_IFREG | 0644}, Hash: "h1"},
+		"changed": {Path: "changed", Attr: &fuse.Attr{Mode: fuse.S_IFREG | 0644}, Hash: "h3"},
+	}
+	cache := attr.NewAttributeCache(
+		func(n string) *attr.FileAttr {
+			if a := files[n]; a != nil {
+				return a
+			}
+			return &attr.FileAttr{Path: n}
+		}, nil)
+
+	m := &Master{
+		options:    &MasterOptions{},
+		attributes: cache,
+		hints:      newHintSet(),
+	}
+	reads := []FileRead{
+		{"changed", "h2"},
+		{"gone", "h4"},
+		{"same", "h1"},
+	}
+	rep := WorkResponse{Reads: reads}
+	if err := m.checkReads(&rep); err != nil {
+		t.Fatalf("checkReads: %v", err)
+	}
+	if want := []string{"changed", "gone"}; !reflect.DeepEqual(rep.StaleReads, want) {
+		t.Errorf("got stale %v, want %v", rep.StaleReads, want)
+	}
+	if rep.Reads != nil {
+		t.Errorf("reads not cleared: %v", rep.Reads)
+	}
+
+	m.options.StrictReads = true
+	rep = WorkResponse{Reads: reads}
+	err := m.checkReads(&rep)
+	if _, ok := err.(*StaleReadError); !ok {
+		t.Errorf("got %v, want StaleReadError", err)
+	}
+	if mirrorAtFault(phaseError(PhaseReadCheck, "w", err)) {
+		t.Errorf("stale reads blamed on the mirror")
+	}
+}
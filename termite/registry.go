@@ -0,0 +1,92 @@
+package termite
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// A coordinator that restarts knows no workers until they register
+// again, which can take a while.  With
+// CoordinatorOptions.RegistryFile, the coordinator writes its workers
+// to that file every check interval, and reads them back when it
+// starts.  Restored workers may have gone away meanwhile, so List
+// leaves them out until they answer a probe.  PeriodicCheck probes
+// them as soon as it starts rather than a check interval later, and
+// drops those that do not answer the first probe.
+
+func (me *Coordinator) loadRegistry() {
+	content, err := ioutil.ReadFile(me.options.RegistryFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	var workers []WorkerRegistration
+	if err == nil {
+		err = json.Unmarshal(content, &workers)
+	}
+	if err != nil {
+		log.Printf("reading worker registry: %v", err)
+		return
+	}
+
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	for i := range workers {
+		w := &workers[i]
+		if w.Address == "" {
+			continue
+		}
+		// One miss drops the worker, until it answers a probe.
+		w.MissedChecks = me.options.MaxMissedChecks - 1
+		w.unverified = true
+		me.workers[w.Address] = w
+		me.restored++
+	}
+	log.Printf("restored %d workers from %s", me.restored, me.options.RegistryFile)
+}
+
+// saveRegistry writes the workers to the registry file.  It writes
+// a temporary file first, so a crash leaves the old registry intact.
+func (me *Coordinator) saveRegistry() {
+	if me.options.RegistryFile == "" {
+		return
+	}
+	rep := CoordinatorStatusResponse{}
+	me.Status(&CoordinatorStatusRequest{}, &rep)
+	content, err := json.Marshal(rep.Workers)
+	if err != nil {
+		log.Printf("saving worker registry: %v", err)
+		return
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(me.options.RegistryFile), ".registry")
+	if err == nil {
+		_, err = f.Write(content)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), me.options.RegistryFile)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("saving worker registry: %v", err)
+	}
+}
+
+// checkRestored probes the workers restored from the registry, if
+// there are any.
+func (me *Coordinator) checkRestored() {
+	me.mutex.Lock()
+	n := me.restored
+	me.restored = 0
+	me.mutex.Unlock()
+	if n > 0 {
+		me.checkReachable()
+	}
+}
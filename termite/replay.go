@@ -0,0 +1,425 @@
+package termite
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/termite/attr"
+)
+
+// Replaying a FileSet changes many files in the writable root.  If
+// that stops halfway, through an error or a crash of the master,
+// later builds see a tree that is neither the old nor the new one.
+// A replay therefore first puts the new contents in a staging
+// directory in the writable root.  Before the tree changes, a journal
+// of the changes, with the old mode and times of the entries changed
+// in place, is synced to the staging directory.  The changes are
+// then applied parents before children, with deletions last.  Entries
+// that are replaced or deleted move to the staging directory instead
+// of being removed, so on an error the changes are undone in reverse
+// order.  Once all changes are in, the staging directory is removed.
+// A master that starts up and finds a journal undoes the replay that
+// was interrupted.
+
+const (
+	_REPLAY_STAGE_PREFIX = ".termite-replay-"
+	_REPLAY_JOURNAL      = "journal"
+)
+
+// replayJournal is the on-disk record of a replay in progress.
+type replayJournal struct {
+	Files []*attr.FileAttr
+	Steps []*replayStep
+}
+
+// replayStep is the change of a single path.
+type replayStep struct {
+	Name string
+
+	// Where the entry at Name goes if it is deleted or replaced.
+	Backup string `json:",omitempty"`
+
+	// Set if the replay creates Name where nothing was.
+	Created bool `json:",omitempty"`
+
+	// Set if the entry at Name changes in place, with its old
+	// permissions and times.
+	InPlace bool `json:",omitempty"`
+	Mode    uint32
+	Atime   time.Time
+	Mtime   time.Time
+
+	info *attr.FileAttr
+
+	// The staged content for info.
+	staged string
+}
+
+// replayStage holds a replay while it is prepared and applied.
+type replayStage struct {
+	dir   string
+	files []*attr.FileAttr
+
+	// Hash => staged files with that content.
+	content map[string][]string
+	count   int
+}
+
+func (me *replayStage) tempName(prefix string) string {
+	me.count++
+	return filepath.Join(me.dir, fmt.Sprintf("%s%d", prefix, me.count))
+}
+
+// replay applies fset to the writable root and the attribute cache.
+// On error, the writable root is left as it was.
+func (me *Master) replay(fset attr.FileSet) error {
+	// We prepare the files before we queue the request, to limit
+	// contention.
+	stage, err := me.prepareReplay(fset)
+	if err != nil {
+		return err
+	}
+	req := replayRequest{stage, make(chan error)}
+	me.replayChannel <- &req
+	return <-req.Done
+}
+
+// prepareReplay stages the content of the new files.
+func (me *Master) prepareReplay(fset attr.FileSet) (*replayStage, error) {
+	dir, err := ioutil.TempDir(me.options.WritableRoot, _REPLAY_STAGE_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	stage := &replayStage{
+		dir:     dir,
+		files:   fset.Files,
+		content: map[string][]string{},
+	}
+
+	// Deleted files whose content reappears, like the source of a
+	// mv, are linked rather than copied.
+	deleted := map[string][]string{}
+	for _, info := range fset.Files {
+		if !info.Deletion() {
+			continue
+		}
+		if a := me.attributes.Get(info.Path); !a.Deletion() && a.Hash != "" {
+			deleted[a.Hash] = append(deleted[a.Hash], me.path(info.Path))
+		}
+	}
+
+	for _, info := range fset.Files {
+		if info.Deletion() || info.Hash == "" {
+			continue
+		}
+		name, err := me.stageContent(stage, info, deleted)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		stage.content[info.Hash] = append(stage.content[info.Hash], name)
+	}
+	return stage, nil
+}
+
+func (me *Master) stageContent(stage *replayStage, info *attr.FileAttr, deleted map[string][]string) (string, error) {
+	name := stage.tempName("new-")
+	if d := deleted[info.Hash]; len(d) > 0 {
+		deleted[info.Hash] = d[:len(d)-1]
+		if err := os.Link(d[len(d)-1], name); err == nil {
+			return name, nil
+		}
+	}
+
+	log.Printf("Prepare %x: %s", info.Hash, info.Path)
+	if !me.linkReplayFile(info, name) {
+		if err := me.copyReplayFile(info, name); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Chmod(name, os.FileMode(info.Attr.Mode&07777)); err != nil {
+		return "", err
+	}
+	if err := os.Chtimes(name, info.AccessTime(), info.ModTime()); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// plan orders the changes, parents before children and deletions
+// last, and notes what they replace.
+func (me *replayStage) plan() ([]*replayStep, error) {
+	sorted := attr.FileSet{Files: append([]*attr.FileAttr{}, me.files...)}
+	sorted.Sort()
+
+	// Sort puts the deletions first.  Moving them last keeps the
+	// old names of moved content until the new ones are in place.
+	n := 0
+	for n < len(sorted.Files) && sorted.Files[n].Deletion() {
+		n++
+	}
+	ordered := append(append([]*attr.FileAttr{}, sorted.Files[n:]...), sorted.Files[:n]...)
+
+	var steps []*replayStep
+	for _, info := range ordered {
+		s := &replayStep{Name: "/" + info.Path, info: info}
+		fi, err := os.Lstat(s.Name)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		switch {
+		case fi == nil:
+			s.Created = !info.Deletion()
+		case !info.Deletion() && info.IsDir() == fi.IsDir() && info.Hash == "" && !info.IsSymlink():
+			st := fi.Sys().(*syscall.Stat_t)
+			s.InPlace = true
+			s.Mode = st.Mode & 07777
+			s.Atime = time.Unix(st.Atim.Unix())
+			s.Mtime = fi.ModTime()
+		default:
+			s.Backup = me.tempName("old-")
+		}
+
+		if info.Hash != "" {
+			staged := me.content[info.Hash]
+			if len(staged) == 0 {
+				log.Fatalf("no staged content for %x: %s", info.Hash, info.Path)
+			}
+			s.staged = staged[len(staged)-1]
+			me.content[info.Hash] = staged[:len(staged)-1]
+		}
+		steps = append(steps, s)
+	}
+	return steps, nil
+}
+
+// writeJournal syncs the planned steps to disk.
+func (me *replayStage) writeJournal(steps []*replayStep) error {
+	content, err := json.Marshal(&replayJournal{Files: me.files, Steps: steps})
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(me.dir, _REPLAY_JOURNAL))
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(content); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(me.dir)
+}
+
+func syncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// apply makes the change to the tree, except for the permissions
+// and times of entries without content, which setAttr sets.
+func (me *replayStep) apply() error {
+	info := me.info
+	if me.Backup != "" {
+		err := os.Rename(me.Name, me.Backup)
+		// A deleted child may have gone with its replaced
+		// parent already.
+		if err != nil && !(info.Deletion() && os.IsNotExist(err)) {
+			return err
+		}
+	}
+	switch {
+	case info.Deletion() || me.InPlace:
+	case info.IsDir():
+		if err := os.Mkdir(me.Name, 0700); err != nil {
+			// Some other process may have created the dir.
+			if fi, _ := os.Lstat(me.Name); fi == nil || !fi.IsDir() {
+				return err
+			}
+		}
+	case info.Hash != "":
+		return os.Rename(me.staged, me.Name)
+	case info.Link != "":
+		return os.Symlink(info.Link, me.Name)
+	}
+	return nil
+}
+
+func (me *replayStep) setAttr() error {
+	info := me.info
+	if info.Deletion() || info.Hash != "" || info.IsSymlink() {
+		return nil
+	}
+	if err := os.Chtimes(me.Name, info.AccessTime(), info.ModTime()); err != nil {
+		return err
+	}
+	return os.Chmod(me.Name, os.FileMode(info.Mode&07777))
+}
+
+// undo reverts the step, whether or not it was applied.
+func (me *replayStep) undo() error {
+	if me.Created {
+		if err := os.Remove(me.Name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if me.Backup != "" {
+		if _, err := os.Lstat(me.Backup); err == nil {
+			if err := os.Remove(me.Name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Rename(me.Backup, me.Name); err != nil {
+				return err
+			}
+		}
+	}
+	if me.InPlace {
+		if err := os.Chmod(me.Name, os.FileMode(me.Mode)); err != nil {
+			return err
+		}
+		return os.Chtimes(me.Name, me.Atime, me.Mtime)
+	}
+	return nil
+}
+
+// undoSteps reverts steps in reverse order.  It returns the first
+// error, but tries all steps.
+func undoSteps(steps []*replayStep) error {
+	// New permissions may keep us from removing what was
+	// created.
+	for _, s := range steps {
+		if s.InPlace {
+			os.Chmod(s.Name, os.FileMode(s.Mode))
+		} else if fi, _ := os.Lstat(s.Name); s.Created && fi != nil && fi.IsDir() {
+			os.Chmod(s.Name, 0700)
+		}
+	}
+
+	var result error
+	for i := len(steps) - 1; i >= 0; i-- {
+		if err := steps[i].undo(); err != nil {
+			log.Printf("undoing replay of %s: %v", steps[i].Name, err)
+			if result == nil {
+				result = err
+			}
+		}
+	}
+	return result
+}
+
+// applyReplay changes the writable root and the attribute cache.
+// Replays must be applied one at a time.
+func (me *Master) applyReplay(stage *replayStage) error {
+	steps, err := stage.plan()
+	if err == nil {
+		err = stage.writeJournal(steps)
+	}
+	if err != nil {
+		os.RemoveAll(stage.dir)
+		return err
+	}
+
+	err = me.applySteps(steps)
+	if err != nil {
+		if undoErr := undoSteps(steps); undoErr != nil {
+			log.Printf("replay: could not undo; keeping %s", stage.dir)
+			return err
+		}
+		os.RemoveAll(stage.dir)
+		return err
+	}
+
+	for _, s := range steps {
+		info := s.info
+		if info.Deletion() {
+			continue
+		}
+		// Reread FileInfo, since some filesystems (eg. ext3) do
+		// not have nanosecond timestamps.
+		fi, _ := os.Lstat(s.Name)
+		info.Attr = fuse.ToAttr(fi)
+		if info.IsRegular() && me.options.XAttrCache && info.Uid == uint32(me.options.Uid) {
+			info.WriteXAttr(s.Name)
+		}
+	}
+	me.attributes.Queue(attr.FileSet{Files: stage.files})
+	me.attributes.Update(stage.files)
+
+	if err := os.Remove(filepath.Join(stage.dir, _REPLAY_JOURNAL)); err != nil {
+		log.Printf("replay: removing journal: %v", err)
+	}
+	if err := os.RemoveAll(stage.dir); err != nil {
+		log.Printf("replay: %v", err)
+	}
+	return nil
+}
+
+func (me *Master) applySteps(steps []*replayStep) error {
+	for _, s := range steps {
+		var err error
+		if me.replayFault != nil {
+			err = me.replayFault(s.Name)
+		}
+		if err == nil {
+			err = s.apply()
+		}
+		if err != nil {
+			return fmt.Errorf("replay %s: %v", s.Name, err)
+		}
+	}
+	for i := len(steps) - 1; i >= 0; i-- {
+		if err := steps[i].setAttr(); err != nil {
+			return fmt.Errorf("replay %s: %v", steps[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// recoverReplays undoes the replays that a crashed master left
+// behind.
+func (me *Master) recoverReplays() {
+	if me.options.WritableRoot == "" {
+		return
+	}
+	dirs, _ := filepath.Glob(filepath.Join(me.options.WritableRoot, _REPLAY_STAGE_PREFIX+"*"))
+	for _, dir := range dirs {
+		if err := undoReplay(dir); err != nil {
+			log.Printf("undoing interrupted replay in %s: %v", dir, err)
+			continue
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func undoReplay(dir string) error {
+	content, err := ioutil.ReadFile(filepath.Join(dir, _REPLAY_JOURNAL))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var j replayJournal
+	if err := json.Unmarshal(content, &j); err != nil {
+		// The journal is synced before the tree changes, so a
+		// torn journal means nothing changed yet.
+		return nil
+	}
+	log.Printf("undoing interrupted replay of %d files", len(j.Files))
+	return undoSteps(j.Steps)
+}
@@ -0,0 +1,209 @@
+package termite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/termite/attr"
+	"github.com/hanwen/termite/cba"
+)
+
+type replayTestCase struct {
+	tester  *testing.T
+	dir     string
+	wd      string
+	scratch string
+	root    string
+	master  *Master
+}
+
+// newReplayTestCase sets up a writable root with some files, and a
+// FileSet that changes, adds, moves and deletes files.
+func newReplayTestCase(t *testing.T) (*replayTestCase, attr.FileSet) {
+	dir, _ := ioutil.TempDir("", "termite")
+	me := &replayTestCase{
+		tester:  t,
+		dir:     dir,
+		wd:      dir + "/wd",
+		scratch: dir + "/scratch",
+	}
+	os.MkdirAll(me.wd, 0755)
+	os.MkdirAll(me.scratch+"/dir", 0750)
+	ioutil.WriteFile(me.wd+"/keep.txt", []byte("old"), 0644)
+	ioutil.WriteFile(me.wd+"/gone.txt", []byte("gone"), 0644)
+	ioutil.WriteFile(me.wd+"/moved.txt", []byte("moved"), 0644)
+	ioutil.WriteFile(me.wd+"/sym", []byte("not a link"), 0644)
+
+	me.master = NewMaster(&MasterOptions{
+		WritableRoot:  me.wd,
+		ExposePrivate: true,
+		StoreOptions:  cba.StoreOptions{Dir: dir + "/cache"},
+	})
+	me.root = strings.TrimLeft(me.wd, "/")
+	if a := me.master.attributes.Get(me.root + "/moved.txt"); a.Deletion() {
+		t.Fatalf("moved.txt not found")
+	}
+
+	os.Symlink("keep.txt", me.scratch+"/sym")
+	fset := attr.FileSet{Files: []*attr.FileAttr{
+		me.file("keep.txt", "new"),
+		{
+			Path:        me.root + "/dir",
+			Attr:        StatForTest(t, me.scratch+"/dir"),
+			NameModeMap: map[string]fuse.FileMode{"moved.txt": fuse.S_IFREG},
+		},
+		me.file("dir/moved.txt", "moved"),
+		{
+			Path: me.root + "/sym",
+			Attr: StatForTest(t, me.scratch+"/sym"),
+			Link: "keep.txt",
+		},
+		{Path: me.root + "/gone.txt"},
+		{Path: me.root + "/moved.txt"},
+	}}
+	fset.Sort()
+	return me, fset
+}
+
+func (me *replayTestCase) Clean() {
+	os.RemoveAll(me.dir)
+}
+
+func (me *replayTestCase) file(name, content string) *attr.FileAttr {
+	p := me.scratch + "/" + name
+	ioutil.WriteFile(p, []byte(content), 0644)
+	return &attr.FileAttr{
+		Path: me.root + "/" + name,
+		Attr: StatForTest(me.tester, p),
+		Hash: me.master.contentStore.Save([]byte(content)),
+	}
+}
+
+// snapshot describes the entries of the writable root.
+func (me *replayTestCase) snapshot() map[string]string {
+	result := map[string]string{}
+	filepath.Walk(me.wd, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == me.wd {
+			return err
+		}
+		rel := p[len(me.wd)+1:]
+		if strings.HasPrefix(rel, _REPLAY_STAGE_PREFIX) {
+			me.tester.Errorf("staging directory %s left behind", rel)
+			return filepath.SkipDir
+		}
+		desc := fi.Mode().String()
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			l, _ := os.Readlink(p)
+			desc += " -> " + l
+		case fi.Mode().IsRegular():
+			c, _ := ioutil.ReadFile(p)
+			desc += " " + string(c)
+		}
+		result[rel] = desc
+		return nil
+	})
+	return result
+}
+
+var oldReplayTree = map[string]string{
+	"keep.txt":  "-rw-r--r-- old",
+	"gone.txt":  "-rw-r--r-- gone",
+	"moved.txt": "-rw-r--r-- moved",
+	"sym":       "-rw-r--r-- not a link",
+}
+
+var newReplayTree = map[string]string{
+	"keep.txt":      "-rw-r--r-- new",
+	"dir":           "drwxr-x---",
+	"dir/moved.txt": "-rw-r--r-- moved",
+	"sym":           "Lrwxrwxrwx -> keep.txt",
+}
+
+func TestReplayFault(t *testing.T) {
+	tc, fset := newReplayTestCase(t)
+	defer tc.Clean()
+
+	for k := 1; ; k++ {
+		calls := 0
+		tc.master.replayFault = func(name string) error {
+			calls++
+			if calls == k {
+				return fmt.Errorf("fault before %s", name)
+			}
+			return nil
+		}
+		err := tc.master.replay(fset)
+		if calls < k {
+			if err != nil {
+				t.Fatalf("replay: %v", err)
+			}
+			break
+		}
+		if err == nil {
+			t.Fatalf("fault %d: replay succeeded", k)
+		}
+		if got := tc.snapshot(); !reflect.DeepEqual(got, oldReplayTree) {
+			t.Fatalf("fault %d: got %v, want %v", k, got, oldReplayTree)
+		}
+		if a := tc.master.attributes.Get(tc.root + "/dir"); !a.Deletion() {
+			t.Fatalf("fault %d: attributes have dir: %v", k, a)
+		}
+	}
+
+	if got := tc.snapshot(); !reflect.DeepEqual(got, newReplayTree) {
+		t.Errorf("got %v, want %v", got, newReplayTree)
+	}
+	if a := tc.master.attributes.Get(tc.root + "/dir/moved.txt"); a.Deletion() {
+		t.Errorf("attributes miss dir/moved.txt")
+	}
+	if a := tc.master.attributes.Get(tc.root + "/moved.txt"); !a.Deletion() {
+		t.Errorf("attributes still have moved.txt: %v", a)
+	}
+}
+
+// TestReplayRecover stops replays halfway, as a crash would, and
+// checks that the next master undoes them.
+func TestReplayRecover(t *testing.T) {
+	tc, fset := newReplayTestCase(t)
+	defer tc.Clean()
+
+	for k := 0; ; k++ {
+		stage, err := tc.master.prepareReplay(fset)
+		if err != nil {
+			t.Fatalf("prepareReplay: %v", err)
+		}
+		steps, err := stage.plan()
+		if err != nil {
+			t.Fatalf("plan: %v", err)
+		}
+		if err := stage.writeJournal(steps); err != nil {
+			t.Fatalf("writeJournal: %v", err)
+		}
+		if k > len(steps) {
+			break
+		}
+		for _, s := range steps[:k] {
+			if err := s.apply(); err != nil {
+				t.Fatalf("apply %s: %v", s.Name, err)
+			}
+		}
+
+		tc.master.recoverReplays()
+		if got := tc.snapshot(); !reflect.DeepEqual(got, oldReplayTree) {
+			t.Fatalf("crash after %d steps: got %v, want %v", k, got, oldReplayTree)
+		}
+	}
+
+	// The master cleans up the last staging directory on startup.
+	NewMaster(tc.master.options)
+	if got := tc.snapshot(); !reflect.DeepEqual(got, oldReplayTree) {
+		t.Fatalf("got %v, want %v", got, oldReplayTree)
+	}
+}
@@ -0,0 +1,106 @@
+package termite
+
+import (
+	"sync"
+	"time"
+)
+
+// Workers report to the coordinator when something a master cares
+// about changes: a job starts or finishes, a mirror comes or goes, or
+// memory or disk space crosses a threshold.  Bursts of changes are
+// coalesced, and an idle worker only sends a heartbeat every
+// WorkerOptions.ReportInterval.
+
+const (
+	// Minimum time between two reports.
+	_REPORT_COALESCE = 100 * time.Millisecond
+
+	// How often memory and disk space are checked against the
+	// thresholds.
+	_RESOURCE_POLL = 5 * time.Second
+)
+
+type reporter struct {
+	report    func()
+	heartbeat time.Duration
+	coalesce  time.Duration
+
+	// Replaced in tests.
+	after func(time.Duration) <-chan time.Time
+
+	trigger  chan bool
+	done     chan bool
+	stopOnce sync.Once
+}
+
+func newReporter(report func(), heartbeat time.Duration) *reporter {
+	return &reporter{
+		report:    report,
+		heartbeat: heartbeat,
+		coalesce:  _REPORT_COALESCE,
+		after:     time.After,
+		trigger:   make(chan bool, 1),
+		done:      make(chan bool),
+	}
+}
+
+// Trigger asks for a report.  It does not block.
+func (me *reporter) Trigger() {
+	select {
+	case me.trigger <- true:
+	default:
+	}
+}
+
+// loop sends a report right away, and then on triggers and
+// heartbeats, until stop is called.
+func (me *reporter) loop() {
+	for {
+		me.report()
+		select {
+		case <-me.after(me.coalesce):
+		case <-me.done:
+			return
+		}
+		select {
+		case <-me.trigger:
+		case <-me.after(me.heartbeat):
+		case <-me.done:
+			return
+		}
+	}
+}
+
+func (me *reporter) stop() {
+	me.stopOnce.Do(func() { close(me.done) })
+}
+
+// watchResources triggers a report when available memory or disk
+// space crosses its threshold.
+func (me *Worker) watchResources() {
+	mem, disk := me.lowResources()
+	for me.accepting {
+		time.Sleep(_RESOURCE_POLL)
+		m, d := me.lowResources()
+		if m != mem || d != disk {
+			mem, disk = m, d
+			me.reporter.Trigger()
+		}
+	}
+}
+
+// lowResources returns which of memory and disk space are below
+// their thresholds.
+func (me *Worker) lowResources() (mem, disk bool) {
+	if t := me.options.ReportMemThreshold; t > 0 {
+		if avail := memAvailable(); avail > 0 {
+			mem = avail < t
+		}
+	}
+	if t := me.options.ReportDiskThreshold; t > 0 {
+		if avail := me.content.DiskAvailable(); avail > 0 {
+			disk = avail < t
+		}
+	}
+	return mem, disk
+}
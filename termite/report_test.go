@@ -0,0 +1,129 @@
+package termite
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock hands out timers that only fire when the test says so.
+type fakeClock struct {
+	mutex  sync.Mutex
+	timers map[time.Duration][]chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{timers: map[time.Duration][]chan time.Time{}}
+}
+
+func (me *fakeClock) After(d time.Duration) <-chan time.Time {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	c := make(chan time.Time, 1)
+	me.timers[d] = append(me.timers[d], c)
+	return c
+}
+
+// fire fires all timers of duration d, waiting for one to be set.
+func (me *fakeClock) fire(t *testing.T, d time.Duration) {
+	for i := 0; i < 1000; i++ {
+		me.mutex.Lock()
+		timers := me.timers[d]
+		delete(me.timers, d)
+		me.mutex.Unlock()
+		if len(timers) > 0 {
+			for _, c := range timers {
+				c <- time.Now()
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("no timer for %v", d)
+}
+
+func expectReports(t *testing.T, reports chan bool, want int) {
+	for i := 0; i < want; i++ {
+		select {
+		case <-reports:
+		case <-time.After(time.Second):
+			t.Fatalf("got %d reports, want %d", i, want)
+		}
+	}
+	select {
+	case <-reports:
+		t.Fatalf("got more than %d reports", want)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestReporter(t *testing.T) {
+	clock := newFakeClock()
+	reports := make(chan bool, 10)
+	r := newReporter(func() { reports <- true }, time.Minute)
+	r.after = clock.After
+	go r.loop()
+	defer r.stop()
+
+	// Reports on startup.
+	expectReports(t, reports, 1)
+
+	// A burst of events during the coalescing period gives a
+	// single report.
+	r.Trigger()
+	r.Trigger()
+	r.Trigger()
+	expectReports(t, reports, 0)
+	clock.fire(t, _REPORT_COALESCE)
+	expectReports(t, reports, 1)
+
+	// Once the period is over, an event is reported right away.
+	clock.fire(t, _REPORT_COALESCE)
+	r.Trigger()
+	expectReports(t, reports, 1)
+
+	// Without events, the heartbeat sends reports.
+	clock.fire(t, _REPORT_COALESCE)
+	expectReports(t, reports, 0)
+	clock.fire(t, time.Minute)
+	expectReports(t, reports, 1)
+}
+
+func TestWorkerStatusDiskAvailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "term-disk")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := WorkerOptions{TempDir: dir}
+	opts.Dir = dir + "/cache"
+	w := NewWorker(&opts)
+
+	rep := WorkerStatusResponse{}
+	if err := w.Status(&WorkerStatusRequest{}, &rep); err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if rep.DiskAvailable == 0 || rep.TempDiskAvailable == 0 {
+		t.Errorf("got DiskAvailable %d, TempDiskAvailable %d", rep.DiskAvailable, rep.TempDiskAvailable)
+	}
+}
+
+func TestCoordinatorListMinDisk(t *testing.T) {
+	c := NewCoordinator(&CoordinatorOptions{MinDiskAvailable: 1 << 30})
+	for addr, disk := range map[string]uint64{"full:1": 1 << 20, "ok:1": 2 << 30, "unknown:1": 0} {
+		c.workers[addr] = &WorkerRegistration{
+			Registration: Registration{Address: addr, DiskAvailable: disk},
+		}
+	}
+	c.lastChange = time.Now()
+
+	rep := ListResponse{}
+	if err := c.List(&ListRequest{}, &rep); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(rep.Registrations) != 2 || rep.Registrations[0].Address != "ok:1" || rep.Registrations[1].Address != "unknown:1" {
+		t.Errorf("got %v, want ok:1 and unknown:1", rep.Registrations)
+	}
+}
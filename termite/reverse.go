@@ -0,0 +1,326 @@
+package termite
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Workers read attributes and content from their master over two
+// reverse connections, dialed by the master along with the mirror.
+// These can break on their own, eg. when a NAT mapping goes stale,
+// while the control connection keeps working.  The master therefore
+// has the worker check them periodically with a no-op call.  Whoever
+// notices the breakage first starts a reconnect: the worker by
+// closing the connections, the master by dialing new ones and handing
+// them over with Mirror.Reconnect.  Meanwhile, jobs wait for the
+// connections to come back.
+
+const (
+	// How often the master has the worker check the reverse
+	// connections.
+	_REVERSE_CHECK_INTERVAL = 30 * time.Second
+
+	// How long a check may take before the connections are
+	// considered broken.
+	_REVERSE_CHECK_TIMEOUT = 10 * time.Second
+
+	// How long jobs wait for broken reverse connections to come
+	// back.
+	_REVERSE_WAIT = 10 * time.Second
+)
+
+type ReverseState int
+
+const (
+	ReverseUp = ReverseState(iota)
+	ReverseDown
+	ReverseReconnecting
+)
+
+func (me ReverseState) String() string {
+	switch me {
+	case ReverseUp:
+		return "up"
+	case ReverseDown:
+		return "down"
+	case ReverseReconnecting:
+		return "reconnecting"
+	}
+	return fmt.Sprintf("ReverseState(%d)", int(me))
+}
+
+// reverseChannel tracks the state of the reverse connections of a
+// mirror.
+type reverseChannel struct {
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	state      ReverseState
+	closed     bool
+	reconnects int
+}
+
+func newReverseChannel() *reverseChannel {
+	me := &reverseChannel{}
+	me.cond = sync.NewCond(&me.mutex)
+	return me
+}
+
+func (me *reverseChannel) State() ReverseState {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return me.state
+}
+
+// Reconnects returns how often the connections were re-established.
+func (me *reverseChannel) Reconnects() int {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return me.reconnects
+}
+
+// broken marks the connections down.  It returns false if they were
+// down or being replaced already.
+func (me *reverseChannel) broken() bool {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if me.state != ReverseUp || me.closed {
+		return false
+	}
+	me.state = ReverseDown
+	me.cond.Broadcast()
+	return true
+}
+
+// startReconnect marks the connections as being replaced.  It
+// returns false if a reconnect is in progress already.
+func (me *reverseChannel) startReconnect() bool {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if me.state == ReverseReconnecting || me.closed {
+		return false
+	}
+	me.state = ReverseReconnecting
+	return true
+}
+
+// endReconnect records the outcome of a reconnect.
+func (me *reverseChannel) endReconnect(ok bool) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if ok {
+		me.state = ReverseUp
+		me.reconnects++
+	} else {
+		me.state = ReverseDown
+	}
+	me.cond.Broadcast()
+}
+
+func (me *reverseChannel) isClosed() bool {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return me.closed
+}
+
+// close wakes up waiters for good.
+func (me *reverseChannel) close() {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.closed = true
+	me.cond.Broadcast()
+}
+
+// wait waits up to d for the connections to be up, and returns an
+// error if they are not.
+func (me *reverseChannel) wait(d time.Duration) error {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if me.state != ReverseUp && !me.closed {
+		deadline := time.Now().Add(d)
+		t := time.AfterFunc(d, func() {
+			me.mutex.Lock()
+			defer me.mutex.Unlock()
+			me.cond.Broadcast()
+		})
+		defer t.Stop()
+		for me.state != ReverseUp && !me.closed && time.Now().Before(deadline) {
+			me.cond.Wait()
+		}
+	}
+	if me.closed {
+		return ShuttingDownError
+	}
+	if me.state != ReverseUp {
+		return fmt.Errorf("reverse connection is %v", me.state)
+	}
+	return nil
+}
+
+// isConnectionError returns true if err comes from a broken
+// connection rather than from the peer.
+func isConnectionError(err error) bool {
+	return err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+////////////////////////////////////////////////////////////////
+// Worker side.
+
+// CheckReverse checks the reverse connections to the master with a
+// no-op call.
+func (me *Mirror) CheckReverse(req *CheckReverseRequest, rep *CheckReverseResponse) error {
+	rep.State = me.rpcFs.checkReverse(_REVERSE_CHECK_TIMEOUT)
+	return nil
+}
+
+// Reconnect switches the file system to new reverse connections
+// dialed by the master.
+func (me *Mirror) Reconnect(req *ReconnectRequest, rep *ReconnectResponse) error {
+	started := me.rpcFs.reverse.startReconnect()
+	revConn := me.worker.pending.WaitConnection(req.RevRpcId)
+	revContentConn := me.worker.pending.WaitConnection(req.RevContentId)
+	if !started {
+		revConn.Close()
+		revContentConn.Close()
+		return fmt.Errorf("cannot reconnect: reverse connection is %v", me.rpcFs.reverse.State())
+	}
+	log.Println("Reverse connections to master re-established")
+	me.rpcFs.reconnect(revConn, revContentConn)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////
+// Master side.
+
+// serveReverse serves the file system over new reverse connections,
+// closing the previous ones.  If they break while the mirror is in
+// use, they are re-established.
+func (me *mirrorConnection) serveReverse(revConn, revContentConn net.Conn) {
+	me.reverseMutex.Lock()
+	oldConn, oldContentConn := me.reverseConnection, me.reverseContentConn
+	me.reverseConnection, me.reverseContentConn = revConn, revContentConn
+	me.reverseMutex.Unlock()
+	if oldConn != nil {
+		oldConn.Close()
+		oldContentConn.Close()
+	}
+
+	done := make(chan bool, 2)
+	go func() {
+		me.master.fileServerRpc.ServeConn(revConn)
+		done <- true
+	}()
+	go func() {
+		me.master.contentStore.ServeConn(revContentConn)
+		done <- true
+	}()
+	go func() {
+		<-done
+		revConn.Close()
+		revContentConn.Close()
+
+		me.reverseMutex.Lock()
+		current := me.reverseConnection == revConn
+		me.reverseMutex.Unlock()
+		if current && me.reverse.broken() {
+			log.Printf("Reverse connection to %s broken", me.workerAddr)
+			me.reconnectReverse()
+		}
+	}()
+}
+
+// reverseAddr returns the address of the worker, for tunneling
+// connections to it.
+func (me *mirrorConnection) reverseAddr() string {
+	me.reverseMutex.Lock()
+	defer me.reverseMutex.Unlock()
+	return me.reverseConnection.RemoteAddr().String()
+}
+
+// reconnectReverse replaces the reverse connections, unless that is
+// in progress already.
+func (me *mirrorConnection) reconnectReverse() {
+	if !me.reverse.startReconnect() {
+		return
+	}
+	err := me.master.renewReverse(me)
+	if err != nil {
+		log.Printf("Reconnecting reverse connection to %s: %v", me.workerAddr, err)
+	} else {
+		log.Printf("Reverse connection to %s re-established", me.workerAddr)
+	}
+	me.reverse.endReconnect(err == nil)
+}
+
+// waitReverse waits briefly for the reverse connections to be up,
+// starting a reconnect if they are down.
+func (me *mirrorConnection) waitReverse() error {
+	if me.reverse.State() == ReverseDown {
+		go me.reconnectReverse()
+	}
+	return me.reverse.wait(_REVERSE_WAIT)
+}
+
+// checkReverseLoop has the worker check the reverse connections
+// every interval, and reconnects them if they are down.
+func (me *mirrorConnection) checkReverseLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if me.reverse.isClosed() {
+			return
+		}
+		if me.reverse.State() == ReverseDown {
+			me.reconnectReverse()
+			continue
+		}
+
+		req := CheckReverseRequest{}
+		rep := CheckReverseResponse{}
+		err := me.rpcClient.Call("Mirror.CheckReverse", &req, &rep)
+		if err == rpc.ErrShutdown {
+			return
+		}
+		if err != nil {
+			log.Printf("CheckReverse on %s: %v", me.workerAddr, err)
+			continue
+		}
+		if rep.State != ReverseUp && me.reverse.broken() {
+			log.Printf("Reverse connection to %s is %v on the worker", me.workerAddr, rep.State)
+			me.reconnectReverse()
+		}
+	}
+}
+
+// renewReverse dials new reverse connections for mc, and hands them
+// to the worker.
+func (me *Master) renewReverse(mc *mirrorConnection) error {
+	secret := me.options.Secret
+	revId := ConnectionId()
+	revConn, err := DialTypedConnection(mc.workerAddr, revId, secret, me.tlsConfig)
+	if err != nil {
+		return err
+	}
+	revContentId := ConnectionId()
+	revContentConn, err := DialTypedConnection(mc.workerAddr, revContentId, secret, me.tlsConfig)
+	if err != nil {
+		revConn.Close()
+		return err
+	}
+
+	req := ReconnectRequest{
+		RevRpcId:     revId,
+		RevContentId: revContentId,
+	}
+	rep := ReconnectResponse{}
+	if err := mc.rpcClient.Call("Mirror.Reconnect", &req, &rep); err != nil {
+		revConn.Close()
+		revContentConn.Close()
+		return err
+	}
+	mc.serveReverse(revConn, revContentConn)
+	return nil
+}
@@ -0,0 +1,34 @@
+package termite
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReverseChannelWait(t *testing.T) {
+	c := newReverseChannel()
+	if err := c.wait(time.Millisecond); err != nil {
+		t.Errorf("wait when up: %v", err)
+	}
+	if !c.broken() || c.broken() {
+		t.Errorf("broken should report the first break only")
+	}
+	if err := c.wait(time.Millisecond); err == nil {
+		t.Errorf("wait when down succeeded")
+	}
+
+	go func() {
+		c.startReconnect()
+		time.Sleep(10 * time.Millisecond)
+		c.endReconnect(true)
+	}()
+	if err := c.wait(time.Minute); err != nil {
+		t.Errorf("wait for reconnect: %v", err)
+	}
+
+	c.broken()
+	go c.close()
+	if err := c.wait(time.Minute); err != ShuttingDownError {
+		t.Errorf("wait after close: got %v, want %v", err, ShuttingDownError)
+	}
+}
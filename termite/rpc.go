@@ -3,8 +3,10 @@ package termite
 import (
 	"fmt"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/termite/attr"
+	"github.com/hanwen/termite/cba"
 	"github.com/hanwen/termite/stats"
 )
 
@@ -12,11 +14,37 @@ type Empty struct{}
 
 type UpdateRequest struct {
 	Files []*attr.FileAttr
+
+	// If set, the flate compressed gob encoding of the files,
+	// and Files is empty.
+	Compressed []byte
 }
 
 type UpdateResponse struct {
 }
 
+type HaveHashesRequest struct {
+	Hashes []string
+}
+
+type HaveHashesResponse struct {
+	// Have[i] is set if the content for Hashes[i] is available.
+	Have []bool
+}
+
+// PrefetchRequest pushes content to a mirror ahead of the job that
+// reads it.
+type PrefetchRequest struct {
+	Contents [][]byte
+
+	// Objects, by hash with their size, that the mirror should
+	// fetch from the master in the background.
+	Fetch map[string]int64
+}
+
+type PrefetchResponse struct {
+}
+
 type MirrorStatusRequest struct {
 }
 
@@ -34,6 +62,66 @@ type MirrorStatusResponse struct {
 	WaitingTasks int
 	IdleFses     int
 	RpcTimings   []string
+
+	// Opens of files from this master that were served from the
+	// content store, and those that needed a fetch.
+	ContentHits   int
+	ContentMisses int
+
+	// Processes left running by tasks.
+	Background []BackgroundProcess
+
+	// Lookups in the attribute cache of the RpcFs.
+	AttrStats attr.AttributeCacheStats
+
+	// State of the reverse connections to the master, and how
+	// often they were re-established.
+	Reverse           string
+	ReverseReconnects int
+
+	// Limits of the cgroup of the mirror's jobs; zero if there
+	// is none.
+	MemoryLimit uint64
+	CPUShares   int
+}
+
+type CheckReverseRequest struct {
+}
+
+type CheckReverseResponse struct {
+	State ReverseState
+}
+
+// ReconnectRequest hands new reverse connections to a mirror.
+type ReconnectRequest struct {
+	RevRpcId     string
+	RevContentId string
+}
+
+type ReconnectResponse struct {
+}
+
+// MasterStatusResponse is served as JSON by the master's
+// /status.json page.
+type MasterStatusResponse struct {
+	Mirrors []MirrorConnectionStatus
+
+	// Extra attempts of jobs in this session.
+	Retries int
+
+	// Workers left alone after their mirror failed.
+	CoolingOff []string
+}
+
+// MirrorConnectionStatus is the master's view of a mirror.
+type MirrorConnectionStatus struct {
+	Worker        string
+	MaxJobs       int
+	AvailableJobs int
+
+	// See MirrorStatusResponse.
+	Reverse           string
+	ReverseReconnects int
 }
 
 type WorkerStatusRequest struct {
@@ -53,11 +141,44 @@ type WorkerStatusResponse struct {
 	PhaseNames  []string
 	PhaseCounts []int
 	MemStat     stats.MemStat
+
+	ContentStats cba.StoreStats
+
+	// Jobs killed for exceeding resource limits.
+	ResourceKills int
+
+	// Jobs that failed with a panic in the worker.
+	JobPanics int
+
+	// Free space in bytes for the content store and for
+	// WorkerOptions.TempDir, or 0 if unknown.
+	DiskAvailable     uint64
+	TempDiskAvailable uint64
+
+	// Reaping and migration of the content store, which pause
+	// while tasks save their results.
+	Maintenance cba.MaintenanceStatus
+}
+
+// ContentStatsResponse is served as JSON by the worker's
+// /content.json page.
+type ContentStatsResponse struct {
+	Store   cba.StoreStats
+	Mirrors []MirrorContentStats
+}
+
+// MirrorContentStats has the open hits and misses for the mirror
+// serving one master.
+type MirrorContentStats struct {
+	Root   string
+	Hits   int
+	Misses int
 }
 
 type Timing struct {
 	Name string
-	Dt   float64
+	// In seconds.
+	Dt float64
 }
 
 type WorkResponse struct {
@@ -75,6 +196,38 @@ type WorkResponse struct {
 
 	// Worker where this was processed.
 	WorkerId string
+
+	// Set if the job was cancelled.  Its file changes are
+	// discarded.
+	Cancelled bool
+
+	// Set if the worker killed the job for running longer than
+	// WorkRequest.TimeoutNs.  Exit is non-zero then.
+	TimedOut bool
+
+	// Set if the worker killed the job for exceeding a resource
+	// limit: ResourceMemory or ResourceCPU.
+	ResourceExceeded string
+
+	// Set if the job did not succeed.
+	Failure *FailureReport
+
+	// With WorkRequest.RecordReads, the files the job read from
+	// the master.  The master clears it.
+	Reads []FileRead
+
+	// Files the job read that changed on the master since; see
+	// MasterOptions.CheckReads.
+	StaleReads []string
+
+	// Files that processes of the job still had open for writing
+	// when the job was reaped.  They are harvested as they were
+	// then, and may be incomplete.
+	OpenFiles []string
+
+	// When the job started and ended, by the worker's clock.
+	WorkerStart time.Time
+	WorkerEnd   time.Time
 }
 
 type WorkRequest struct {
@@ -83,17 +236,147 @@ type WorkRequest struct {
 
 	// Id of connection streaming stdin.
 	StdinId string
-	Debug   bool
-	Binary  string
-	Argv    []string
-	Env     []string
-	Dir     string
+
+	// If set, ids of connections that receive stdout and stderr
+	// while the job runs. The corresponding fields of WorkResponse
+	// are then left empty.
+	StdoutId string
+	StderrId string
+	Debug    bool
+	Binary   string
+	Argv     []string
+	Env      []string
+	Dir      string
 
 	// Signal that a command ran locally.  Used for logging in the master.
 	RanLocally bool
 
-	// If set, must run on this worker. Used for debugging.
-	Worker string
+	// If set, the job must run on the worker with this address.
+	// Used for debugging.
+	RequireWorker string
+
+	// The job must not run on workers with these addresses.
+	ExcludeWorkers []string
+
+	// If set, the job can be cancelled by passing this id to
+	// LocalMaster.Cancel.
+	CancelId string
+
+	// If set, a binary that cannot be executed (ENOEXEC), such as
+	// a script without #! line, is run with /bin/sh instead.
+	ShellFallback bool
+
+	// If set, Env is empty, and the job runs with the environment
+	// registered under this handle with Mirror.RegisterEnv.
+	EnvHandle string
+
+	// Names of processes, such as build daemons, that may keep
+	// running after the command exits.  Other processes left by
+	// the command are killed.
+	AllowBackground []string
+
+	// If set, the job runs in a file system of its own, so its
+	// /tmp is not shared with concurrent jobs.
+	PrivateTmp bool
+
+	// Estimated memory use of the job in bytes.  If set, the job
+	// only runs on workers that report at least this much
+	// available memory.
+	Memory uint64
+
+	// The job only runs on workers whose CPU has these features,
+	// eg. "avx512f".
+	RequiredCPUFeatures []string
+
+	// The job only runs on workers with all these labels, eg.
+	// arch=arm64; see WorkerOptions.Labels.
+	RequiredLabels map[string]string
+
+	// If set, jobs with the same hint, eg. the name of their main
+	// input, prefer the same worker.  Otherwise, the files named
+	// on the command line are used; see affinity.go.
+	AffinityHint string
+
+	// If set, the master collects the files that the job has
+	// finished writing with Mirror.Harvest while it runs.  The
+	// WorkResponse then only has the remaining changes.
+	Incremental bool
+
+	// If set, the content hash of Binary.  The worker refuses to
+	// run a binary with other content.
+	BinaryHash string
+
+	// If set, a failure is returned in WorkResponse.Failure
+	// rather than as an RPC error, which would drop the response.
+	ReportFailure bool
+
+	// If set, the master does not start a second copy of a slow
+	// job.  Set it for commands that must not run twice.
+	NoSpeculation bool
+
+	// If set, the worker returns the files the job read in
+	// WorkResponse.Reads.
+	RecordReads bool
+
+	// If positive, the worker kills the process group of the job
+	// after this many nanoseconds.
+	TimeoutNs int64
+}
+
+type HarvestRequest struct {
+	TaskId int
+
+	// The master applied the harvests up to this sequence
+	// number.  Later ones are included in the WorkResponse again.
+	Acked int
+}
+
+type HarvestResponse struct {
+	// Counts the harvests of the task that returned files,
+	// starting at 1.
+	Seq int
+
+	// Files finished since the previous harvest, or nil.
+	*attr.FileSet
+}
+
+type CancelRequest struct {
+	CancelId string
+}
+
+type CancelTaskRequest struct {
+	TaskId int
+}
+
+// addTiming adds dt to the timing of the given phase of the job.
+// Phases are "schedule" (picking a worker), "sync" (sending file
+// attributes and prefetching content), "queued" (waiting for a slot
+// on the worker), "exec", "reap" and "output" (waiting for the
+// result files).
+func (me *WorkResponse) addTiming(name string, dt time.Duration) {
+	for i := range me.Timings {
+		if me.Timings[i].Name == name {
+			me.Timings[i].Dt += dt.Seconds()
+			return
+		}
+	}
+	me.Timings = append(me.Timings, Timing{name, dt.Seconds()})
+}
+
+// Timing returns the time spent in the given phase.
+func (me *WorkResponse) Timing(name string) time.Duration {
+	for _, t := range me.Timings {
+		if t.Name == name {
+			return time.Duration(t.Dt * float64(time.Second))
+		}
+	}
+	return 0
+}
+
+// forcedPlacement returns true if the request restricts the workers
+// it may run on, which is done for debugging.
+func (me *WorkRequest) forcedPlacement() bool {
+	return me.RequireWorker != "" || len(me.ExcludeWorkers) > 0
 }
 
 func (me *WorkRequest) Summary() string {
@@ -110,12 +393,20 @@ type CreateMirrorRequest struct {
 	// The writable root for the mirror.
 	WritableRoot string
 
+	// Files below this directory may be written too.  See
+	// MasterOptions.ScratchRoot.
+	ScratchRoot string
+
 	// Max number of processes to reserve.
 	MaxJobCount int
 }
 
 type CreateMirrorResponse struct {
 	GrantedJobCount int
+
+	// The longest path (relative to the root) that fits in the
+	// mirror's FUSE mount.  Zero if unknown.
+	MaxPathLength int
 }
 
 type ShutdownRequest struct {
@@ -126,6 +417,18 @@ type ShutdownRequest struct {
 type ShutdownResponse struct {
 }
 
+// SetRateLimitRequest changes how fast content is served; see
+// cba.Store.SetRateLimit.
+type SetRateLimitRequest struct {
+	// Zero lifts the limit.
+	BytesPerSec int64
+}
+
+type SetRateLimitResponse struct {
+	// The limit before the change.
+	Previous int64
+}
+
 type LogRequest struct {
 	Whence int
 	Off    int64
@@ -135,3 +438,35 @@ type LogRequest struct {
 type LogResponse struct {
 	Data []byte
 }
+
+// Hint names a file that an upcoming job is likely to read.
+type Hint struct {
+	Path string
+
+	// Between 0 and 1.  Hints with likelihood 0 or less are
+	// dropped.
+	Likelihood float64
+}
+
+// HintRequest tells the master which files the jobs of an upcoming
+// session will probably read.
+type HintRequest struct {
+	Hints []Hint
+}
+
+// HintStats counts the hints of a master since it started.
+type HintStats struct {
+	// Hints received, and hints dropped because they were invalid
+	// or too many were pending.
+	Received int
+	Dropped  int
+
+	// Hinted files that were found and hashed, and how many of
+	// those were read by a job since.
+	Resolved int
+	Used     int
+}
+
+type HintResponse struct {
+	Stats HintStats
+}
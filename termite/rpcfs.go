@@ -4,6 +4,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
@@ -16,52 +21,210 @@ import (
 
 type RpcFs struct {
 	pathfs.FileSystem
-	cache         *cba.Store
+	cache *cba.Store
+
+	// Clients over the reverse connections to the master.  They
+	// are replaced when the connections are re-established.
+	clientMutex   sync.Mutex
 	attrClient    *attr.Client
 	contentClient *cba.Client
+	reverse       *reverseChannel
 
 	timings *stats.TimerStats
 	attr    *attr.AttributeCache
 	id      string
+
+	// Files whose content may be read from the local file system.
+	localPrefixes LocalPrefixes
+
+	// Directory holding the writable layers of the worker file
+	// systems, or "" for the system default.  See StatFs.
+	tempDir string
+
+	// Content lookups of content clients that were replaced by
+	// reconnect; see ContentHits.
+	mutex  sync.Mutex
+	hits   int
+	misses int
+
+	// Local files whose content differed from the master's; see
+	// considerSaveLocal.  Protected by mutex.
+	localMismatches map[localFile]bool
 }
 
-func NewRpcFs(attrClient *attr.Client, cache *cba.Store, contentConn io.ReadWriteCloser) *RpcFs {
+func NewRpcFs(attrClient *attr.Client, cache *cba.Store, contentConn io.ReadWriteCloser, localPrefixes LocalPrefixes) *RpcFs {
 	me := &RpcFs{
 		FileSystem:    pathfs.NewDefaultFileSystem(),
 		attrClient:    attrClient,
 		contentClient: cache.NewClient(contentConn),
+		reverse:       newReverseChannel(),
 		timings:       stats.NewTimerStats(),
+		localPrefixes: localPrefixes,
 	}
 
 	me.attr = attr.NewAttributeCache(
 		func(n string) *attr.FileAttr {
-			a := attr.FileAttr{}
-			err := attrClient.GetAttr(n, &a)
+			var attrs []*attr.FileAttr
+			err := me.callMaster(func(ac *attr.Client, cc *cba.Client) (err error) {
+				attrs, err = ac.GetAttrs(n)
+				return err
+			})
 			if err != nil {
 				log.Printf("GetAttr %s: %v", n, err)
 				return nil
 			}
-			return &a
+			var a *attr.FileAttr
+			var siblings []*attr.FileAttr
+			for _, r := range attrs {
+				if r.Path == n {
+					a = r
+				} else {
+					siblings = append(siblings, r)
+				}
+			}
+			me.attr.Prime(siblings)
+			if a == nil {
+				a = &attr.FileAttr{}
+			}
+			return a
 		}, nil)
 	me.cache = cache
 	return me
 }
 
 func (me *RpcFs) Close() {
+	me.reverse.close()
+	me.clientMutex.Lock()
+	defer me.clientMutex.Unlock()
+	me.attrClient.Close()
+	me.contentClient.Close()
+}
+
+// clients returns the clients for the master, waiting briefly if the
+// reverse connections are down.
+func (me *RpcFs) clients() (*attr.Client, *cba.Client, error) {
+	if err := me.reverse.wait(_REVERSE_WAIT); err != nil {
+		return nil, nil, err
+	}
+	me.clientMutex.Lock()
+	defer me.clientMutex.Unlock()
+	return me.attrClient, me.contentClient, nil
+}
+
+// callMaster runs f with the clients for the master.  If the reverse
+// connections break during the call, it tries once more after they
+// are re-established.
+func (me *RpcFs) callMaster(f func(*attr.Client, *cba.Client) error) error {
+	ac, cc, err := me.clients()
+	if err != nil {
+		return err
+	}
+	err = f(ac, cc)
+	if err == nil || !isConnectionError(err) {
+		return err
+	}
+	me.reverseBroken(ac, err)
+	if ac, cc, err = me.clients(); err != nil {
+		return err
+	}
+	return f(ac, cc)
+}
+
+// reverseBroken closes the reverse connections if ac still uses
+// them, so the master notices and reconnects.
+func (me *RpcFs) reverseBroken(ac *attr.Client, err error) {
+	me.clientMutex.Lock()
+	defer me.clientMutex.Unlock()
+	if ac != me.attrClient || !me.reverse.broken() {
+		return
+	}
+	log.Printf("Reverse connection to master broken: %v", err)
 	me.attrClient.Close()
 	me.contentClient.Close()
 }
 
+// checkReverse does a no-op call over both reverse connections, and
+// returns their state.
+func (me *RpcFs) checkReverse(timeout time.Duration) ReverseState {
+	me.clientMutex.Lock()
+	ac, cc := me.attrClient, me.contentClient
+	me.clientMutex.Unlock()
+	if me.reverse.State() == ReverseUp {
+		err := ac.Ping(timeout)
+		if err == nil {
+			err = cc.Ping(timeout)
+		}
+		if err != nil {
+			me.reverseBroken(ac, err)
+		}
+	}
+	return me.reverse.State()
+}
+
+// reconnect switches to new reverse connections.  The caller must
+// have called reverse.startReconnect.
+func (me *RpcFs) reconnect(attrConn, contentConn io.ReadWriteCloser) {
+	me.clientMutex.Lock()
+	oldAttr, oldContent := me.attrClient, me.contentClient
+	me.attrClient = attr.NewClient(attrConn, me.id)
+	me.contentClient = me.cache.NewClient(contentConn)
+	me.clientMutex.Unlock()
+
+	hits, misses := oldContent.Lookups()
+	me.mutex.Lock()
+	me.hits += hits
+	me.misses += misses
+	me.mutex.Unlock()
+
+	oldAttr.Close()
+	oldContent.Close()
+	me.reverse.endReconnect(true)
+}
+
+// prefetch starts fetching objects in the background, unless the
+// reverse connections are down.  Then they are fetched on open.
+func (me *RpcFs) prefetch(objects map[string]int64) {
+	if me.reverse.State() != ReverseUp {
+		return
+	}
+	me.clientMutex.Lock()
+	cc := me.contentClient
+	me.clientMutex.Unlock()
+	cc.Prefetch(objects)
+}
+
+// ContentHits returns how many content lookups, from opens and
+// prefetches, found their content in the store, and how many had to
+// fetch it.  Each file is counted once, when it is first asked for.
+func (me *RpcFs) ContentHits() (hits, misses int) {
+	me.clientMutex.Lock()
+	cc := me.contentClient
+	me.clientMutex.Unlock()
+	hits, misses = cc.Lookups()
+
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return hits + me.hits, misses + me.misses
+}
+
 func (me *RpcFs) FetchHash(a *attr.FileAttr) error {
-	got, e := me.contentClient.FetchOnce(a.Hash, int64(a.Size))
+	var got bool
+	e := me.callMaster(func(ac *attr.Client, cc *cba.Client) (err error) {
+		got, err = cc.FetchOnce(a.Hash, int64(a.Size))
+		return err
+	})
 	if e == nil && !got {
-		log.Fatalf("Did not have hash %x for %s", a.Hash, a.Path)
+		e = fmt.Errorf("master does not have hash %x for %s", a.Hash, a.Path)
 	}
 	return e
 }
 
 func (me *RpcFs) Update(req *UpdateRequest, resp *UpdateResponse) error {
-	me.updateFiles(req.Files)
+	files, err := req.files()
+	if err != nil {
+		return err
+	}
+	me.updateFiles(files)
 	return nil
 }
 
@@ -85,19 +248,94 @@ func (me *RpcFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, f
 		return nil, fuse.EINVAL
 	}
 
+	if r.Paged() {
+		return me.readPagedDir(name, r.Generation)
+	}
+
 	c := make([]fuse.DirEntry, 0, len(r.NameModeMap))
+	missing := false
 	for k, mode := range r.NameModeMap {
 		c = append(c, fuse.DirEntry{
 			Name: k,
 			Mode: uint32(mode),
 		})
+		if !mode.IsDir() && !missing {
+			missing = !me.attr.Have(filepath.Join(name, k))
+		}
+	}
+	if missing {
+		me.expandDir(name)
 	}
 	return c, fuse.OK
 }
 
+// expandDir fetches the attributes of the files in a directory in
+// one go, as listing a directory is usually followed by a stat of
+// each entry.
+func (me *RpcFs) expandDir(name string) {
+	var attrs []*attr.FileAttr
+	err := me.callMaster(func(ac *attr.Client, cc *cba.Client) (err error) {
+		attrs, err = ac.ExpandDir(name)
+		return err
+	})
+	if err != nil {
+		log.Printf("ExpandDir %s: %v", name, err)
+	}
+	me.attr.Prime(attrs)
+}
+
+const (
+	// Number of entries read at once from a paged directory.
+	_DIR_PAGE_SIZE = 1000
+
+	// Give up if the directory keeps changing while we read it.
+	_MAX_DIR_PAGE_RESTARTS = 5
+)
+
+// readPagedDir reads the listing of a paged directory, using the
+// pages cached for its generation.
+func (me *RpcFs) readPagedDir(name string, generation uint64) ([]fuse.DirEntry, fuse.Status) {
+	if _, g, ok := me.attr.Page(name, 0); ok {
+		generation = g
+	}
+
+	var result []fuse.DirEntry
+	for restarts := 0; restarts <= _MAX_DIR_PAGE_RESTARTS; {
+		offset := len(result)
+		entries, g, ok := me.attr.Page(name, offset)
+		if !ok || g != generation {
+			var rep *attr.DirPageResponse
+			err := me.callMaster(func(ac *attr.Client, cc *cba.Client) (err error) {
+				rep, err = ac.ReadDirPage(name, generation, offset, _DIR_PAGE_SIZE)
+				return err
+			})
+			if err != nil {
+				log.Printf("ReadDirPage %s: %v", name, err)
+				return nil, fuse.EIO
+			}
+			if rep.Generation != generation {
+				// Changed on the master; start over.
+				generation = rep.Generation
+				result = nil
+				restarts++
+				continue
+			}
+			entries = rep.Entries
+			me.attr.AddPage(name, generation, offset, entries)
+		}
+		result = append(result, entries...)
+		if len(entries) < _DIR_PAGE_SIZE {
+			return result, fuse.OK
+		}
+	}
+	log.Printf("ReadDirPage %s: directory keeps changing", name)
+	return nil, fuse.EIO
+}
+
 type rpcFsFile struct {
 	nodefs.File
 	fuse.Attr
+	hash string
 }
 
 func (me *rpcFsFile) GetAttr(a *fuse.Attr) fuse.Status {
@@ -121,8 +359,21 @@ func (me *RpcFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.
 		return nil, fuse.ENOENT
 	}
 
-	if err := me.FetchHash(a); err != nil {
+	// A local copy makes the fetch below a hit.
+	if !me.cache.Has(a.Hash) {
+		me.considerSaveLocal(a)
+	}
+	err := me.FetchHash(a)
+	if err == nil && !me.cache.Verify(a.Hash) {
+		// The local copy was damaged, and is gone now.
+		err = me.FetchHash(a)
+	}
+	if err != nil {
 		log.Printf("Error fetching contents %v", err)
+		if e, ok := err.(*cba.DiskFullError); ok && e.Temporary() {
+			// See readRecorder.
+			return nil, fuse.Status(syscall.ENOSPC)
+		}
 		return nil, fuse.EIO
 	}
 
@@ -131,6 +382,7 @@ func (me *RpcFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.
 		File: &rpcFsFile{
 			NewLazyLoopbackFile(me.cache.Path(a.Hash)),
 			fa,
+			a.Hash,
 		},
 		FuseFlags: raw.FOPEN_KEEP_CACHE,
 	}, fuse.OK
@@ -150,7 +402,23 @@ func (me *RpcFs) Readlink(name string, context *fuse.Context) (string, fuse.Stat
 	}
 
 	// TODO - kick off getattr on destination.
-	return a.Link, fuse.OK
+	if a.Link != "" {
+		return a.Link, fuse.OK
+	}
+	if l, ok := me.attr.Link(name); ok {
+		return l, fuse.OK
+	}
+	var l string
+	err := me.callMaster(func(ac *attr.Client, cc *cba.Client) (err error) {
+		l, err = ac.Readlink(name)
+		return err
+	})
+	if err != nil {
+		log.Printf("Readlink %s: %v", name, err)
+		return "", fuse.EIO
+	}
+	me.attr.AddLink(a, l)
+	return l, fuse.OK
 }
 
 func (me *RpcFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
@@ -158,8 +426,10 @@ func (me *RpcFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.S
 	if r == nil {
 		return nil, fuse.ENOENT
 	}
-	if r.Hash != "" {
-		go me.FetchHash(r)
+	if r.Hash != "" && r.IsRegular() && !me.localPrefixes.Match("/"+name) {
+		// Reading usually follows; start fetching the content
+		// in the background.  Open waits for it to finish.
+		me.prefetch(map[string]int64{r.Hash: int64(r.Size)})
 	}
 	a := &fuse.Attr{}
 	if !r.Deletion() {
@@ -180,3 +450,40 @@ func (me *RpcFs) Access(name string, mode uint32, context *fuse.Context) (code f
 	}
 	return fuse.OK
 }
+
+// StatFs reports the file system that holds the writable layers, as
+// that is where writes to the mirror end up.  The read-only part
+// served from the master has no capacity of its own; without this,
+// statvfs fails, and tools that check for free space give up.
+func (me *RpcFs) StatFs(name string) *nodefs.StatfsOut {
+	dir := me.tempDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return statFs(dir)
+}
+
+// statFs returns the statistics of the file system holding dir, or
+// nil if it cannot be read.
+func statFs(dir string) *nodefs.StatfsOut {
+	var s syscall.Statfs_t
+	if err := syscall.Statfs(dir, &s); err != nil {
+		log.Printf("statfs %s: %v", dir, err)
+		return nil
+	}
+	out := &nodefs.StatfsOut{
+		Blocks:  s.Blocks,
+		Bfree:   s.Bfree,
+		Bavail:  s.Bavail,
+		Files:   s.Files,
+		Ffree:   s.Ffree,
+		Bsize:   uint32(s.Bsize),
+		NameLen: uint32(s.Namelen),
+		Frsize:  uint32(s.Frsize),
+	}
+	// Block counts are in units of Frsize.
+	if out.Frsize == 0 {
+		out.Frsize = out.Bsize
+	}
+	return out
+}
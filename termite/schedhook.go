@@ -0,0 +1,140 @@
+package termite
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Some races only show up for particular choices that the master
+// otherwise leaves to timing or map order: which of the free mirrors
+// a job goes to, whether a job sends its pending attribute updates
+// before or after other goroutines get to run, and the order in which
+// jobs that share a FileSet are woken when it is replayed.  Tests can
+// take over those choices by setting Master.sched.  seededSched makes
+// them from a seeded PRNG, so a failing seed can be run again, and
+// scriptSched replays an explicit list of choices.  Without a hook,
+// the master behaves as before.  Choices are made for a task id, and
+// seededSched draws them from a stream per decision point and task,
+// so the choices for one job do not depend on how the goroutines of
+// other jobs interleave.
+
+// Decision points, passed to schedHook.choose.
+const (
+	schedPick      = "pick"
+	schedAffinity  = "affinity"
+	schedFlush     = "flush"
+	schedBroadcast = "broadcast"
+)
+
+type schedHook interface {
+	// choose returns which of n alternatives to take at point
+	// for the task with the given id, in [0, n).
+	choose(point string, id int, n int) int
+}
+
+type schedStream struct {
+	point string
+	id    int
+}
+
+// seededSched makes choices from PRNGs derived from a seed.
+type seededSched struct {
+	mutex   sync.Mutex
+	seed    int64
+	streams map[schedStream]*rand.Rand
+
+	// The choices made, for a scriptSched.
+	trace []int
+}
+
+func newSeededSched(seed int64) *seededSched {
+	return &seededSched{seed: seed, streams: map[schedStream]*rand.Rand{}}
+}
+
+func (me *seededSched) choose(point string, id int, n int) int {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	k := schedStream{point, id}
+	r := me.streams[k]
+	if r == nil {
+		h := fnv.New64a()
+		var b [16]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(me.seed))
+		binary.LittleEndian.PutUint64(b[8:], uint64(id))
+		h.Write(b[:])
+		io.WriteString(h, point)
+		r = rand.New(rand.NewSource(int64(h.Sum64())))
+		me.streams[k] = r
+	}
+	c := r.Intn(n)
+	me.trace = append(me.trace, c)
+	return c
+}
+
+// scriptSched makes the choices in script, in order, and takes the
+// first alternative when it runs out.
+type scriptSched struct {
+	mutex  sync.Mutex
+	script []int
+}
+
+func (me *scriptSched) choose(point string, id int, n int) int {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if len(me.script) == 0 {
+		return 0
+	}
+	c := me.script[0]
+	me.script = me.script[1:]
+	if c < 0 || c >= n {
+		c = 0
+	}
+	return c
+}
+
+// schedPickFrom returns the address that hook picks from addrs for
+// the task id.
+func schedPickFrom(hook schedHook, id int, addrs []string) string {
+	sort.Strings(addrs)
+	return addrs[hook.choose(schedPick, id, len(addrs))]
+}
+
+// schedYield lets other goroutines run first, if hook says so.
+func schedYield(hook schedHook, point string, id int) {
+	if hook.choose(point, id, 2) == 1 {
+		runtime.Gosched()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// schedShuffle permutes ids as hook chooses.  The choices are made
+// for the lowest id.
+func schedShuffle(hook schedHook, ids []int) {
+	if len(ids) == 0 {
+		return
+	}
+	min := ids[0]
+	for _, id := range ids {
+		if id < min {
+			min = id
+		}
+	}
+	for i := len(ids) - 1; i > 0; i-- {
+		j := hook.choose(schedBroadcast, min, i+1)
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+}
+
+// sched returns the scheduling hook installed by a test, or nil.
+func (me *mirrorConnections) sched() schedHook {
+	if me.master == nil {
+		return nil
+	}
+	return me.master.sched
+}
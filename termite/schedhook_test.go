@@ -0,0 +1,131 @@
+package termite
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// schedSeeds returns the seeds for a sweep: TERMITE_SCHED_SEED if
+// set, and a few fresh ones otherwise.
+func schedSeeds(t *testing.T) []int64 {
+	if s := os.Getenv("TERMITE_SCHED_SEED"); s != "" {
+		seed, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			t.Fatalf("TERMITE_SCHED_SEED: %v", err)
+		}
+		return []int64{seed}
+	}
+	n := 10
+	if testing.Short() {
+		n = 3
+	}
+	base := time.Now().UnixNano()
+	var seeds []int64
+	for i := 0; i < n; i++ {
+		seeds = append(seeds, base+int64(i))
+	}
+	return seeds
+}
+
+// sweepSched hands the choices to the seededSched of the current
+// round of a sweep.
+type sweepSched struct {
+	mutex sync.Mutex
+	cur   *seededSched
+}
+
+func (me *sweepSched) set(seed int64) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.cur = newSeededSched(seed)
+}
+
+func (me *sweepSched) choose(point string, id int, n int) int {
+	me.mutex.Lock()
+	cur := me.cur
+	me.mutex.Unlock()
+	if cur == nil {
+		return 0
+	}
+	return cur.choose(point, id, n)
+}
+
+// schedSweep runs round under each seed of the sweep, and prints the
+// seed of the first round that fails.
+func schedSweep(t *testing.T, sched *sweepSched, round func(seed int64)) {
+	for _, seed := range schedSeeds(t) {
+		sched.set(seed)
+		round(seed)
+		if t.Failed() {
+			t.Fatalf("failed with scheduler seed %d; run again with TERMITE_SCHED_SEED=%d", seed, seed)
+		}
+	}
+}
+
+func TestSeededSchedReproducible(t *testing.T) {
+	choices := func(s schedHook) []int {
+		var out []int
+		for i := 1; i < 20; i++ {
+			out = append(out, s.choose(schedPick, 1, i))
+		}
+		return out
+	}
+	first := newSeededSched(42)
+	want := choices(first)
+	if got := choices(newSeededSched(42)); !reflect.DeepEqual(got, want) {
+		t.Errorf("same seed: got %v, want %v", got, want)
+	}
+	if got := choices(&scriptSched{script: first.trace}); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed trace: got %v, want %v", got, want)
+	}
+
+	// Choices for other tasks in between do not change those
+	// for task 1.
+	interleaved := newSeededSched(42)
+	var got []int
+	for i := 1; i < 20; i++ {
+		interleaved.choose(schedPick, 2, i)
+		interleaved.choose(schedFlush, 1, 2)
+		got = append(got, interleaved.choose(schedPick, 1, i))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("interleaved: got %v, want %v", got, want)
+	}
+}
+
+func TestSchedShuffle(t *testing.T) {
+	ids := []int{1, 2, 3}
+	schedShuffle(&scriptSched{script: []int{0, 0}}, ids)
+	if want := []int{2, 3, 1}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+}
+
+func TestMirrorConnectionsPickSched(t *testing.T) {
+	mcs := &mirrorConnections{
+		master:  &Master{sched: &scriptSched{script: []int{2, 0, 1}}},
+		workers: map[string]Registration{},
+		mirrors: map[string]*mirrorConnection{},
+		now:     time.Now,
+	}
+	for _, a := range []string{"w2:1", "w3:1", "w1:1"} {
+		mcs.workers[a] = Registration{Address: a}
+		mcs.mirrors[a] = &mirrorConnection{workerAddr: a, maxJobs: 1, availableJobs: 1}
+	}
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		mc, err := mcs.pick(&WorkRequest{})
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		got = append(got, mc.workerAddr)
+	}
+	if want := []string{"w3:1", "w1:1", "w2:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
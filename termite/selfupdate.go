@@ -0,0 +1,184 @@
+package termite
+
+import (
+	"crypto"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+// Workers can be updated from the coordinator: /restartworker takes
+// a new binary, and sends it to the workers with the
+// Worker.UpdateBinary RPC.  The binary goes through the worker's
+// content store, by hash, so a worker that has it already is not sent
+// it again.  The RPC connection is authenticated with the shared
+// secret, like all others.  The worker checks that the binary is an
+// executable for its architecture, puts it in place of its own
+// executable, and once its jobs are done, executes it with the same
+// arguments.  Workers report their Version to the coordinator, so it
+// shows which ones still run an old build.
+
+// BinaryUpdateRequest asks a worker to run a new binary.
+type BinaryUpdateRequest struct {
+	// The hash of the binary, as used by the content store.
+	Hash string
+
+	// The binary itself.  May be left out if the worker has it
+	// already.
+	Binary []byte
+}
+
+type BinaryUpdateResponse struct {
+	// Set if the worker does not have the binary, and the
+	// request should be sent again with it.
+	NeedBinary bool
+}
+
+// The hash of binaries sent to workers; that of content stores with
+// default options.
+const _BINARY_HASH = crypto.MD5
+
+// UpdateBinary replaces the worker binary, and restarts the worker once
+// its jobs are done.
+func (me *Worker) UpdateBinary(req *BinaryUpdateRequest, rep *BinaryUpdateResponse) error {
+	if len(req.Binary) > 0 {
+		if h := me.content.Save(req.Binary); h != req.Hash {
+			return fmt.Errorf("binary has hash %x, want %x", h, req.Hash)
+		}
+	} else if !me.content.Has(req.Hash) {
+		rep.NeedBinary = true
+		return nil
+	}
+
+	// Claim the restart, so concurrent updates do not both
+	// replace the executable.
+	me.mutex.Lock()
+	if !me.canRestart {
+		me.mutex.Unlock()
+		return fmt.Errorf("worker is restarting already")
+	}
+	me.canRestart = false
+	me.mutex.Unlock()
+
+	exe, err := me.installBinary(req.Hash)
+	me.mutex.Lock()
+	if err != nil {
+		me.canRestart = true
+	} else {
+		me.execPath = exe
+	}
+	me.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Updated %s; restarting once jobs are done", exe)
+	me.shutdown(false, false)
+	return nil
+}
+
+// installBinary puts the binary for hash in place of the worker's
+// executable, and returns the path of the latter.
+func (me *Worker) installBinary(hash string) (string, error) {
+	if err := checkExecutable(me.content.Path(hash)); err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadFile(me.content.Path(hash))
+	if err != nil {
+		return "", err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return exe, replaceFile(exe, content)
+}
+
+// elfMachines maps GOARCH to the ELF machine of its executables.
+var elfMachines = map[string]elf.Machine{
+	"386":     elf.EM_386,
+	"amd64":   elf.EM_X86_64,
+	"arm":     elf.EM_ARM,
+	"arm64":   elf.EM_AARCH64,
+	"ppc64":   elf.EM_PPC64,
+	"ppc64le": elf.EM_PPC64,
+	"riscv64": elf.EM_RISCV,
+	"s390x":   elf.EM_S390,
+}
+
+// checkExecutable returns an error unless name is an ELF executable
+// that runs on this machine.
+func checkExecutable(name string) error {
+	f, err := elf.Open(name)
+	if err != nil {
+		return fmt.Errorf("not an ELF binary: %v", err)
+	}
+	defer f.Close()
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return fmt.Errorf("ELF type %v is not executable", f.Type)
+	}
+	if m, ok := elfMachines[runtime.GOARCH]; !ok || f.Machine != m {
+		return fmt.Errorf("ELF machine %v does not run on %s", f.Machine, runtime.GOARCH)
+	}
+	return nil
+}
+
+// replaceFile writes content next to name, and renames it over name.
+func replaceFile(name string, content []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0755)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// reexec executes the updated binary in place of this process.  It
+// only returns if that fails.
+func (me *Worker) reexec(exe string) {
+	log.Printf("Executing %s %v", exe, os.Args[1:])
+	err := syscall.Exec(exe, os.Args, os.Environ())
+	log.Printf("Exec: %v", err)
+}
+
+// updateWorker sends binary to the worker at addr.
+func (me *Coordinator) updateWorker(addr string, hash string, binary []byte) error {
+	conn, err := DialTypedConnection(addr, RPC_CHANNEL, me.options.Secret, me.tlsConfig)
+	if err != nil {
+		return err
+	}
+	cl := rpc.NewClient(conn)
+	defer cl.Close()
+
+	req := BinaryUpdateRequest{Hash: hash}
+	rep := BinaryUpdateResponse{}
+	if err := cl.Call("Worker.UpdateBinary", &req, &rep); err != nil || !rep.NeedBinary {
+		return err
+	}
+	req.Binary = binary
+	return cl.Call("Worker.UpdateBinary", &req, &rep)
+}
+
+func binaryHash(binary []byte) string {
+	h := _BINARY_HASH.New()
+	h.Write(binary)
+	return string(h.Sum(nil))
+}
@@ -0,0 +1,58 @@
+package termite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/termite/cba"
+)
+
+func TestCheckExecutable(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Executable: %v", err)
+	}
+	if err := checkExecutable(exe); err != nil {
+		t.Errorf("test binary: %v", err)
+	}
+
+	dir, _ := ioutil.TempDir("", "term-update")
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "script")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\n"), 0755)
+	if err := checkExecutable(script); err == nil {
+		t.Errorf("shell script accepted")
+	}
+}
+
+func TestReplaceFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "term-update")
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "worker")
+	ioutil.WriteFile(name, []byte("old"), 0755)
+
+	if err := replaceFile(name, []byte("new")); err != nil {
+		t.Fatalf("replaceFile: %v", err)
+	}
+	if content, _ := ioutil.ReadFile(name); string(content) != "new" {
+		t.Errorf("got %q, want %q", content, "new")
+	}
+	if fi, err := os.Stat(name); err != nil || fi.Mode().Perm() != 0755 {
+		t.Errorf("got %v, %v, want mode 0755", fi.Mode(), err)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("left %d files behind", len(entries)-1)
+	}
+}
+
+func TestBinaryHash(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "term-update")
+	defer os.RemoveAll(dir)
+	store := cba.NewStore(&cba.StoreOptions{Dir: dir})
+	content := []byte("binary")
+	if h := store.Save(content); h != binaryHash(content) {
+		t.Errorf("store hash %x, binary hash %x", h, binaryHash(content))
+	}
+}
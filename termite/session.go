@@ -0,0 +1,223 @@
+package termite
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/hanwen/termite/attr"
+)
+
+// A session is the stretch of builds since the master started, or
+// since ResetSession, which the wrapper calls with -reset-session.
+// The master sums up what it did in a
+// SessionReport, which can be written as JSON for build performance
+// analysis.
+
+// SessionReport summarizes a session.
+type SessionReport struct {
+	Start    time.Time
+	WallTime time.Duration
+
+	// Jobs finished, and of those, jobs handled by the master
+	// itself and jobs that failed with an error.  Retries counts
+	// the extra attempts on other workers.  Forced counts jobs
+	// whose workers were required or excluded; they are left out
+	// of the worker statistics.
+	Jobs         int
+	JobsInMaster int
+	Failed       int
+	Retries      int
+	Forced       int
+
+	// Second copies of slow jobs started on another worker, and
+	// copies that finished first.
+	Speculations    int
+	SpeculationWins int
+
+	// Attribute lookups answered from the cache, and lookups that
+	// stat'ed and hashed the file.
+	AttrHits    int
+	AttrFetches int
+	AttrHitRate float64
+
+	// Job inputs that the worker already had, and inputs whose
+	// content had to be pushed or fetched.
+	ContentHits    int
+	ContentMisses  int
+	ContentHitRate float64
+
+	// Content traffic between the master and the workers,
+	// including content pushed with jobs.
+	BytesSent     int64
+	BytesReceived int64
+
+	Workers []WorkerSessionReport
+}
+
+// WorkerSessionReport is the part of a SessionReport for a single
+// worker.
+type WorkerSessionReport struct {
+	Address string
+	Jobs    int
+
+	// Time spent running jobs, summed over the jobs.
+	Busy time.Duration
+
+	// Job slots reserved on the worker.
+	Slots int
+
+	// Busy as a fraction of the wall time of all slots.
+	Utilization float64
+}
+
+type session struct {
+	report  SessionReport
+	workers map[string]*WorkerSessionReport
+
+	// Files replayed in the session, for Manifest.
+	outputs   map[string]manifestFile
+	deletions map[string]*manifestJob
+	dropped   int
+
+	// Counters at the start of the session.
+	attrStats                    attr.AttributeCacheStats
+	prefetchHits, prefetchMisses int
+	prefetchBytes                int64
+	bytesReceived, bytesServed   int64
+}
+
+func (me *Master) prefetchCounts() (hits, misses int, bytes int64) {
+	me.prefetchMutex.Lock()
+	defer me.prefetchMutex.Unlock()
+	return me.prefetchHits, me.prefetchSent + me.prefetchFetched, int64(me.prefetchBytes)
+}
+
+// ResetSession starts a new session.
+func (me *Master) ResetSession() {
+	s := &session{
+		report:    SessionReport{Start: time.Now()},
+		workers:   map[string]*WorkerSessionReport{},
+		outputs:   map[string]manifestFile{},
+		deletions: map[string]*manifestJob{},
+		attrStats: me.attributes.Stats(),
+	}
+	s.prefetchHits, s.prefetchMisses, s.prefetchBytes = me.prefetchCounts()
+	s.bytesReceived, s.bytesServed = me.contentStore.Totals()
+
+	me.sessionMutex.Lock()
+	defer me.sessionMutex.Unlock()
+	me.session = s
+}
+
+// SessionReport returns the report for the current session.
+func (me *Master) SessionReport() SessionReport {
+	attrStats := me.attributes.Stats()
+	hits, misses, pushed := me.prefetchCounts()
+	received, served := me.contentStore.Totals()
+
+	me.sessionMutex.Lock()
+	defer me.sessionMutex.Unlock()
+	s := me.session
+	r := s.report
+	r.WallTime = time.Now().Sub(r.Start)
+
+	r.AttrHits = attrStats.Hits + attrStats.NegativeHits - s.attrStats.Hits - s.attrStats.NegativeHits
+	r.AttrFetches = attrStats.Fetches - s.attrStats.Fetches
+	r.AttrHitRate = hitRate(r.AttrHits, r.AttrFetches)
+
+	r.ContentHits = hits - s.prefetchHits
+	r.ContentMisses = misses - s.prefetchMisses
+	r.ContentHitRate = hitRate(r.ContentHits, r.ContentMisses)
+
+	r.BytesSent = served - s.bytesServed + pushed - s.prefetchBytes
+	r.BytesReceived = received - s.bytesReceived
+
+	for _, w := range s.workers {
+		wr := *w
+		if wr.Slots > 0 && r.WallTime > 0 {
+			wr.Utilization = float64(wr.Busy) / (float64(r.WallTime) * float64(wr.Slots))
+		}
+		r.Workers = append(r.Workers, wr)
+	}
+	sort.Sort(workerSessionReports(r.Workers))
+	return r
+}
+
+// WriteSessionReport writes the report for the current session to
+// the file name, as JSON.
+func (me *Master) WriteSessionReport(name string) error {
+	content, err := json.MarshalIndent(me.SessionReport(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, content, 0644)
+}
+
+func hitRate(hits, misses int) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+func (me *Master) sessionJobDone(inMaster bool, forced bool, err error) {
+	me.sessionMutex.Lock()
+	defer me.sessionMutex.Unlock()
+	me.session.report.Jobs++
+	if inMaster {
+		me.session.report.JobsInMaster++
+	}
+	if forced {
+		me.session.report.Forced++
+	}
+	if err != nil {
+		me.session.report.Failed++
+	}
+}
+
+func (me *Master) sessionRetry() {
+	me.sessionMutex.Lock()
+	defer me.sessionMutex.Unlock()
+	me.session.report.Retries++
+}
+
+func (me *Master) sessionRetries() int {
+	me.sessionMutex.Lock()
+	defer me.sessionMutex.Unlock()
+	return me.session.report.Retries
+}
+
+func (me *Master) sessionSpeculation(won bool) {
+	me.sessionMutex.Lock()
+	defer me.sessionMutex.Unlock()
+	if won {
+		me.session.report.SpeculationWins++
+	} else {
+		me.session.report.Speculations++
+	}
+}
+
+// sessionWorkerTime records a job that ran on a worker with the
+// given number of job slots.
+func (me *Master) sessionWorkerTime(addr string, slots int, dt time.Duration) {
+	me.sessionMutex.Lock()
+	defer me.sessionMutex.Unlock()
+	w := me.session.workers[addr]
+	if w == nil {
+		w = &WorkerSessionReport{Address: addr}
+		me.session.workers[addr] = w
+	}
+	w.Jobs++
+	w.Busy += dt
+	if slots > w.Slots {
+		w.Slots = slots
+	}
+}
+
+type workerSessionReports []WorkerSessionReport
+
+func (me workerSessionReports) Len() int           { return len(me) }
+func (me workerSessionReports) Less(i, j int) bool { return me[i].Address < me[j].Address }
+func (me workerSessionReports) Swap(i, j int)      { me[i], me[j] = me[j], me[i] }
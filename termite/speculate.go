@@ -0,0 +1,138 @@
+package termite
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// A job that hangs on its worker, or is much slower there than
+// usual, holds up everything that waits for it.  With
+// MasterOptions.Speculate set, the master starts a second copy of
+// such a job on another worker, and uses whichever copy finishes
+// first.  The other copy is cancelled.  The second copy runs in a
+// file system of its own, so its changes can be discarded if it
+// loses.  Only jobs whose copies cannot get in each other's way
+// qualify: they have no streamed input or output.  Commands that must not run twice opt
+// out with WorkRequest.NoSpeculation.
+
+// Jobs are not copied before they ran this long.
+const _SPECULATE_MIN_DELAY = time.Second
+
+var errSpeculationLost = errors.New("another copy of the job finished first")
+
+// speculationMedian returns the median duration of the command of
+// req, if req may get a second copy.
+func (me *Master) speculationMedian(req *WorkRequest) (time.Duration, bool) {
+	if me.options.Speculate <= 0 || req.NoSpeculation || req.forcedPlacement() ||
+		req.StdinId != "" || req.StdoutId != "" || req.StderrId != "" ||
+		req.Incremental || req.CancelId != "" {
+		return 0, false
+	}
+	return me.mirrors.commandStats().median(req)
+}
+
+type speculativeAttempt struct {
+	mirror *mirrorConnection
+	rep    WorkResponse
+	job    CommandStats
+	err    error
+}
+
+// runSpeculative is runOnce for jobs that may get a second copy.  The
+// copy starts once the job took Speculate times median, on a mirror
+// of another worker that has a free slot.
+func (me *Master) runSpeculative(req *WorkRequest, rep *WorkResponse, streams *outputStreams, avoid string, median time.Duration) error {
+	start := time.Now()
+	first, err := me.mirrors.pickAvoiding(req, avoid)
+	if err != nil {
+		return phaseError(PhaseScheduling, "", err)
+	}
+
+	var winnerMutex sync.Mutex
+	var winner *mirrorConnection
+	results := make(chan *speculativeAttempt, 2)
+	var launched []*mirrorConnection
+	launch := func(mc *mirrorConnection, r *WorkRequest) {
+		launched = append(launched, mc)
+		a := &speculativeAttempt{
+			mirror: mc,
+			job:    CommandStats{Queue: time.Now().Sub(start)},
+		}
+		claim := func() bool {
+			winnerMutex.Lock()
+			defer winnerMutex.Unlock()
+			if winner == nil {
+				winner = mc
+			}
+			return winner == mc
+		}
+		go func() {
+			a.err = me.runOnMirror(mc, r, &a.rep, streams, &a.job, claim)
+			if a.err != nil && a.err != errSpeculationLost && mirrorAtFault(a.err) {
+				me.mirrors.drop(mc, a.err)
+			}
+			results <- a
+		}()
+	}
+	launch(first, req)
+
+	delay := time.Duration(me.options.Speculate * float64(median))
+	if delay < _SPECULATE_MIN_DELAY {
+		delay = _SPECULATE_MIN_DELAY
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	running := 1
+	var result *speculativeAttempt
+	for running > 0 && (result == nil || result.err != nil) {
+		select {
+		case <-timer.C:
+			mc := me.mirrors.pickSpare(req, first.workerAddr)
+			if mc == nil {
+				timer.Reset(delay)
+				continue
+			}
+			log.Printf("Task %d on %s is slow, starting it on %s too", req.TaskId, first.workerAddr, mc.workerAddr)
+			me.sessionSpeculation(false)
+			// The changes of the copy must not end up in
+			// the results of other jobs.
+			copyReq := *req
+			copyReq.PrivateTmp = true
+			launch(mc, &copyReq)
+			running++
+		case result = <-results:
+			running--
+		}
+	}
+
+	if result.err == nil && running > 0 {
+		for _, mc := range launched {
+			if mc != result.mirror {
+				go me.cancelCopy(mc, req.TaskId)
+			}
+		}
+	}
+
+	*rep = result.rep
+	rep.addTiming("schedule", result.job.Queue)
+	if result.err != nil {
+		return result.err
+	}
+	if result.mirror != first {
+		me.sessionSpeculation(true)
+	}
+	me.mirrors.commandStats().add(req, &result.job)
+	rep.FileSet = nil
+	return nil
+}
+
+// cancelCopy stops the copy of a job that lost.
+func (me *Master) cancelCopy(mc *mirrorConnection, taskId int) {
+	req := CancelTaskRequest{TaskId: taskId}
+	if err := mc.rpcClient.Call("Mirror.Cancel", &req, &Empty{}); err != nil {
+		log.Printf("Cancelling task %d on %s: %v", taskId, mc.workerAddr, err)
+	}
+}
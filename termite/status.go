@@ -1,6 +1,7 @@
 package termite
 
 import (
+	"github.com/hanwen/termite/cba"
 	"github.com/hanwen/termite/stats"
 )
 
@@ -15,8 +16,17 @@ func (me *Mirror) Status(req *MirrorStatusRequest, rep *MirrorStatusResponse) er
 	for fs := range me.activeFses {
 		rep.Fses = append(rep.Fses, fs.Status())
 	}
+	rep.ContentHits, rep.ContentMisses = me.rpcFs.ContentHits()
+	rep.AttrStats = me.rpcFs.attr.Stats()
+	rep.Background = me.backgroundStatus()
 	rep.RpcTimings = append(me.rpcFs.timings.TimingMessages(),
 		me.worker.content.TimingMessages()...)
+	rep.Reverse = me.rpcFs.reverse.State().String()
+	rep.ReverseReconnects = me.rpcFs.reverse.Reconnects()
+	if me.cgroup != nil {
+		rep.MemoryLimit = me.cgroup.memory
+		rep.CPUShares = me.cgroup.shares
+	}
 	return nil
 }
 
@@ -33,5 +43,11 @@ func (me *Worker) Status(req *WorkerStatusRequest, rep *WorkerStatusResponse) er
 	rep.PhaseNames = me.stats.PhaseOrder
 	rep.TotalCpu = *stats.TotalCpuStat()
 	rep.MemStat = *stats.GetMemStat()
+	rep.ContentStats = me.content.Stats()
+	rep.ResourceKills = me.resourceKillCount()
+	rep.JobPanics = me.jobPanicCount()
+	rep.DiskAvailable = me.content.DiskAvailable()
+	rep.TempDiskAvailable = cba.DiskAvailable(me.options.TempDir)
+	rep.Maintenance = me.content.MaintenanceStatus()
 	return nil
 }
@@ -0,0 +1,184 @@
+package termite
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// The master forwards the stdin of a job from the client to the
+// worker.  When a job is retried on another worker, the new attempt
+// must read stdin from the start, but the client sent it only once.
+// With MasterOptions.RetryCount, the master keeps up to
+// MaxStdinReplay bytes of what it forwarded, and replays them to the
+// next attempt before forwarding the rest.  A job whose stdin
+// outgrew that is not retried.  The reader of a finished attempt is
+// stopped, so it no longer reads from the client on behalf of an
+// attempt that is gone.
+
+var errStdinNotReplayable = errors.New("stdin is too large to replay for a retry")
+
+// stdinReplay reads the stdin of a job from the client, and keeps
+// what it read for later attempts.
+type stdinReplay struct {
+	// Waits for the client connection.
+	open func() net.Conn
+
+	// How many bytes to keep.
+	max int
+
+	// Serializes reads from the client.
+	readMutex sync.Mutex
+
+	// Protects the below.
+	mutex  sync.Mutex
+	src    net.Conn
+	closed bool
+	buf    []byte
+
+	// Bytes read from the client.
+	read int
+
+	// Set if buf no longer holds all that was read.
+	overflow bool
+
+	// Error from the client connection, io.EOF at the end.
+	err error
+}
+
+func newStdinReplay(open func() net.Conn, max int) *stdinReplay {
+	return &stdinReplay{open: open, max: max}
+}
+
+// reader returns a reader for an attempt of the job, which starts at
+// the beginning of stdin.
+func (me *stdinReplay) reader() (*stdinReader, error) {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if me.overflow && me.read > 0 {
+		return nil, errStdinNotReplayable
+	}
+	return &stdinReader{replay: me}, nil
+}
+
+// close closes the client connection.  Attempts still reading get
+// an error.
+func (me *stdinReplay) close() {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	me.closed = true
+	if me.src != nil {
+		me.src.Close()
+	}
+}
+
+// fill reads from the client into p, for a reader at offset off.  It
+// returns 0 and no error if the reader should look at buf again.
+func (me *stdinReplay) fill(off int, p []byte) (int, error) {
+	me.readMutex.Lock()
+	defer me.readMutex.Unlock()
+
+	me.mutex.Lock()
+	if off < me.read || me.err != nil {
+		// Another attempt read ahead meanwhile.
+		me.mutex.Unlock()
+		return 0, nil
+	}
+	src := me.src
+	closed := me.closed
+	me.mutex.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	if src == nil {
+		src = me.open()
+		me.mutex.Lock()
+		me.src = src
+		if me.closed {
+			src.Close()
+		}
+		me.mutex.Unlock()
+	}
+
+	n, err := src.Read(p)
+
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if !me.overflow && len(me.buf)+n <= me.max {
+		me.buf = append(me.buf, p[:n]...)
+	} else {
+		me.overflow = true
+		me.buf = nil
+	}
+	me.read += n
+	me.err = err
+	return n, err
+}
+
+// stdinReader reads stdin for one attempt of a job.
+type stdinReader struct {
+	replay *stdinReplay
+	off    int
+
+	// Protected by replay.mutex.
+	stopped bool
+	err     error
+}
+
+// stop makes further reads fail.
+func (me *stdinReader) stop() {
+	me.replay.mutex.Lock()
+	defer me.replay.mutex.Unlock()
+	me.stopped = true
+}
+
+// failure returns the error that ended reading, if it was not the
+// end of stdin.  The attempt then saw its stdin cut short.
+func (me *stdinReader) failure() error {
+	me.replay.mutex.Lock()
+	defer me.replay.mutex.Unlock()
+	return me.err
+}
+
+func (me *stdinReader) Read(p []byte) (int, error) {
+	n, err := me.read(p)
+	if err != nil && err != io.EOF {
+		me.replay.mutex.Lock()
+		if me.err == nil {
+			me.err = err
+		}
+		me.replay.mutex.Unlock()
+	}
+	return n, err
+}
+
+func (me *stdinReader) read(p []byte) (int, error) {
+	r := me.replay
+	for {
+		r.mutex.Lock()
+		switch {
+		case me.stopped:
+			r.mutex.Unlock()
+			return 0, io.ErrClosedPipe
+		case me.off < r.read && r.overflow:
+			r.mutex.Unlock()
+			return 0, errStdinNotReplayable
+		case me.off < r.read:
+			n := copy(p, r.buf[me.off:])
+			me.off += n
+			r.mutex.Unlock()
+			return n, nil
+		case r.err != nil:
+			r.mutex.Unlock()
+			return 0, r.err
+		}
+		r.mutex.Unlock()
+
+		n, err := r.fill(me.off, p)
+		me.off += n
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package termite
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// testStdin returns a stdinReplay that reads content from a client.
+func testStdin(t *testing.T, content string, max int) *stdinReplay {
+	client, server := net.Pipe()
+	go func() {
+		io.WriteString(client, content)
+		client.Close()
+	}()
+	return newStdinReplay(func() net.Conn { return server }, max)
+}
+
+func TestStdinReplay(t *testing.T) {
+	s := testStdin(t, "hello world", 100)
+	defer s.close()
+
+	first, err := s.reader()
+	if err != nil {
+		t.Fatalf("reader: %v", err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(first, b); err != nil || string(b) != "hello" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+
+	// A retry starts over, and continues past what the first
+	// attempt read.
+	second, err := s.reader()
+	if err != nil {
+		t.Fatalf("reader: %v", err)
+	}
+	if got, err := ioutil.ReadAll(second); err != nil || string(got) != "hello world" {
+		t.Errorf("retry: got %q, %v", got, err)
+	}
+	if got, err := ioutil.ReadAll(first); err != nil || string(got) != " world" {
+		t.Errorf("first: got %q, %v", got, err)
+	}
+}
+
+func TestStdinReplayOverflow(t *testing.T) {
+	s := testStdin(t, "hello world", 5)
+	defer s.close()
+
+	first, _ := s.reader()
+	if got, err := ioutil.ReadAll(first); err != nil || string(got) != "hello world" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if _, err := s.reader(); err != errStdinNotReplayable {
+		t.Errorf("got %v, want errStdinNotReplayable", err)
+	}
+}
+
+func TestStdinReplayUnused(t *testing.T) {
+	opened := false
+	s := newStdinReplay(func() net.Conn {
+		opened = true
+		return nil
+	}, 0)
+	// Without retries nothing is kept, but an attempt that did
+	// not read may be retried.
+	if _, err := s.reader(); err != nil {
+		t.Errorf("reader: %v", err)
+	}
+	if _, err := s.reader(); err != nil {
+		t.Errorf("second reader: %v", err)
+	}
+	s.close()
+	if opened {
+		t.Errorf("client connection opened without reads")
+	}
+}
+
+func TestStdinReplayStop(t *testing.T) {
+	s := testStdin(t, "hello world", 5)
+	defer s.close()
+
+	// The first attempt failed after reading a bit.
+	first, _ := s.reader()
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(first, b); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	second, err := s.reader()
+	if err != nil {
+		t.Fatalf("reader: %v", err)
+	}
+	first.stop()
+
+	// It must not read on, past what can be replayed.
+	if n, err := first.Read(b); n != 0 || err == nil {
+		t.Errorf("stopped reader: got %d, %v", n, err)
+	}
+	if got, err := ioutil.ReadAll(second); err != nil || string(got) != "hello world" {
+		t.Errorf("retry: got %q, %v", got, err)
+	}
+	if err := second.failure(); err != nil {
+		t.Errorf("failure: %v", err)
+	}
+}
+
+func TestStdinReplayFailure(t *testing.T) {
+	s := testStdin(t, "hello world", 5)
+	defer s.close()
+
+	first, _ := s.reader()
+	second, _ := s.reader()
+	if got, err := ioutil.ReadAll(first); err != nil || string(got) != "hello world" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	// The second attempt fell behind what can be replayed; its
+	// stdin is cut short.
+	if _, err := ioutil.ReadAll(second); err != errStdinNotReplayable {
+		t.Errorf("got %v, want errStdinNotReplayable", err)
+	}
+	if err := second.failure(); err != errStdinNotReplayable {
+		t.Errorf("failure: got %v, want errStdinNotReplayable", err)
+	}
+	if err := first.failure(); err != nil {
+		t.Errorf("failure of the first attempt: %v", err)
+	}
+}
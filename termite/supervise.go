@@ -0,0 +1,90 @@
+package termite
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+	"syscall"
+)
+
+// A worker runs jobs for many masters at once, so a bug hit by one
+// job should not take the others down.  Mirror.Run recovers panics:
+// the job that panicked fails with an error, its processes are
+// killed, and its file system is retired and unmounted once the
+// other jobs on it are done.  The worker keeps serving.
+// Mirror.Harvest recovers too, and fails the harvest.
+//
+// Panics in the FUSE handlers are not recovered, as they run on the
+// server's goroutines.  The handlers therefore return errors, such as
+// EIO for a file that cannot be copied to the backing store, and a
+// file system whose /tmp cannot be mounted again is retired rather
+// than reused.
+//
+// A few conditions are still fatal to the worker: a FUSE mount that
+// cannot be unmounted after a failed setup, since the worker cannot
+// tell what still uses it, and configuration errors at startup, such
+// as an unusable content store directory or bad TLS files.
+
+// runRecovered is run, but turns a panic into an error for this job.
+func (me *Mirror) runRecovered(req *WorkRequest, rep *WorkResponse) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = me.worker.jobPanicked(req, r)
+		}
+	}()
+	return me.run(req, rep)
+}
+
+// jobPanicked logs the panic of a job, and returns the error that
+// fails it.
+func (me *Worker) jobPanicked(req *WorkRequest, r interface{}) error {
+	atomic.AddInt32(&me.jobPanics, 1)
+	log.Printf("Task %d panicked: %v\n%s", req.TaskId, r, debug.Stack())
+	return fmt.Errorf("task %d panicked on %s: %v", req.TaskId, Hostname, r)
+}
+
+func (me *Worker) jobPanicCount() int {
+	return int(atomic.LoadInt32(&me.jobPanics))
+}
+
+// abandonOnPanic cleans up after the task if it panics, and passes
+// the panic on.  It must be deferred.
+func (me *WorkerTask) abandonOnPanic() {
+	if r := recover(); r != nil {
+		me.abandon()
+		panic(r)
+	}
+}
+
+// abandon kills the processes of the task and gives up its file
+// system, which may be in any state.
+func (me *WorkerTask) abandon() {
+	me.harvestMutex.Lock()
+	fs := me.fuseFs
+	me.reaped = true
+	me.harvestMutex.Unlock()
+
+	if me.cmd != nil && me.cmd.Process != nil {
+		syscall.Kill(-me.cmd.Process.Pid, syscall.SIGKILL)
+	}
+	me.closeOutput()
+	me.limits.release()
+	if fs != nil {
+		me.mirror.abandonFs(fs, me)
+	}
+}
+
+// abandonFs retires a file system that a panicking task used.  It is
+// stopped when no other task uses it.
+func (me *Mirror) abandonFs(fs *workerFuseFs, task *WorkerTask) {
+	me.fsMutex.Lock()
+	defer me.fsMutex.Unlock()
+	delete(fs.tasks, task)
+	fs.retired = true
+	if len(fs.tasks) == 0 && me.activeFses[fs] {
+		me.stopFs(fs)
+		delete(me.activeFses, fs)
+	}
+	me.cond.Broadcast()
+}
@@ -0,0 +1,107 @@
+package termite
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newSuperviseMirror(t *testing.T) (*Mirror, func()) {
+	dir, err := ioutil.TempDir("", "term-supervise")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	opts := WorkerOptions{TempDir: dir, Jobs: 2}
+	opts.Dir = dir + "/cache"
+	worker := NewWorker(&opts)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	worker.listener = l
+
+	// Without an RpcFs, checking the binary panics.
+	mirror := &Mirror{
+		worker:     worker,
+		activeFses: map[*workerFuseFs]bool{},
+		envs:       map[string][]string{},
+		accepting:  true,
+	}
+	mirror.cond = sync.NewCond(&mirror.fsMutex)
+	return mirror, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMirrorRunRecoversPanic(t *testing.T) {
+	mirror, clean := newSuperviseMirror(t)
+	defer clean()
+
+	req := &WorkRequest{TaskId: 7, Binary: "/bin/true", BinaryHash: "x"}
+	rep := &WorkResponse{}
+	if err := mirror.Run(req, rep); err == nil || !strings.Contains(err.Error(), "task 7 panicked") {
+		t.Fatalf("got %v, want panic error", err)
+	}
+
+	req = &WorkRequest{TaskId: 8, Binary: "/bin/true", BinaryHash: "x", ReportFailure: true}
+	rep = &WorkResponse{}
+	if err := mirror.Run(req, rep); err != nil {
+		t.Fatalf("Run with ReportFailure: %v", err)
+	}
+	if rep.Failure == nil || !strings.Contains(rep.Failure.Error, "panicked") {
+		t.Errorf("got failure %v, want panic", rep.Failure)
+	}
+
+	// The mirror still serves other requests.
+	req = &WorkRequest{TaskId: 9, EnvHandle: "unknown"}
+	if err := mirror.Run(req, &WorkResponse{}); err == nil || strings.Contains(err.Error(), "panicked") {
+		t.Errorf("got %v, want unknown handle error", err)
+	}
+
+	status := WorkerStatusResponse{}
+	if err := mirror.worker.Status(&WorkerStatusRequest{}, &status); err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if status.JobPanics != 2 {
+		t.Errorf("got %d panics, want 2", status.JobPanics)
+	}
+}
+
+func TestWorkerTaskAbandonOnPanic(t *testing.T) {
+	mirror, clean := newSuperviseMirror(t)
+	defer clean()
+
+	fs := &workerFuseFs{tasks: map[*WorkerTask]bool{}}
+	other := &WorkerTask{mirror: mirror, fuseFs: fs}
+	task := &WorkerTask{mirror: mirror, fuseFs: fs, req: &WorkRequest{}}
+	fs.tasks[other] = true
+	fs.tasks[task] = true
+	mirror.activeFses[fs] = true
+
+	func() {
+		defer func() {
+			if r := recover(); r != "oops" {
+				t.Errorf("got panic %v, want oops", r)
+			}
+		}()
+		defer task.abandonOnPanic()
+		panic("oops")
+	}()
+
+	if fs.tasks[task] || !fs.tasks[other] {
+		t.Errorf("got tasks %v, want only the other task", fs.tasks)
+	}
+	if !fs.retired {
+		t.Errorf("file system of panicked task not retired")
+	}
+	if !mirror.activeFses[fs] {
+		t.Errorf("file system stopped while in use")
+	}
+	if !task.reaped {
+		t.Errorf("task not marked reaped")
+	}
+}
@@ -8,19 +8,44 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/termite/attr"
 	"github.com/hanwen/termite/fastpath"
+	"github.com/hanwen/termite/fs"
 )
 
 type WorkerTask struct {
 	req       *WorkRequest
 	rep       *WorkResponse
 	stdinConn net.Conn
-	mirror    *Mirror
-	cmd       *exec.Cmd
-	taskInfo  string
+
+	// If set, output is streamed here rather than returned in
+	// the WorkResponse.
+	stdoutConn net.Conn
+	stderrConn net.Conn
+	mirror     *Mirror
+	cmd        *exec.Cmd
+	taskInfo   string
+	limits     *jobLimits
+
+	// Protected by Mirror.fsMutex.
+	cancelled bool
+	timedOut  bool
+
+	// Set once the process was waited for, so a timeout that fires
+	// late does not kill a reused process group.  Protected by
+	// Mirror.fsMutex.
+	exited bool
+
+	// For incremental harvests.
+	harvestMutex sync.Mutex
+	fuseFs       *workerFuseFs
+	harvestSeq   int
+	reaped       bool
+	unacked      []*HarvestResponse
 }
 
 func (me *WorkerTask) Kill() {
@@ -31,12 +56,51 @@ func (me *WorkerTask) Kill() {
 	}
 }
 
+// cancel kills the process group of the task. Must hold
+// Mirror.fsMutex.
+func (me *WorkerTask) cancel() {
+	me.cancelled = true
+	if me.cmd != nil && me.cmd.Process != nil {
+		pid := me.cmd.Process.Pid
+		err := syscall.Kill(-pid, syscall.SIGKILL)
+		log.Printf("Cancelled process group %d, result %v", pid, err)
+	}
+}
+
+// expire kills the process group of a task that ran past its
+// timeout, and retires its file system.
+func (me *WorkerTask) expire(fs *workerFuseFs) {
+	me.mirror.fsMutex.Lock()
+	defer me.mirror.fsMutex.Unlock()
+	if me.exited {
+		return
+	}
+	me.timedOut = true
+	fs.retired = true
+	pid := me.cmd.Process.Pid
+	err := syscall.Kill(-pid, syscall.SIGKILL)
+	log.Printf("Task %d timed out after %v; killed process group %d, result %v",
+		me.req.TaskId, time.Duration(me.req.TimeoutNs), pid, err)
+}
+
 func (me *WorkerTask) String() string {
 	return me.taskInfo
 }
 
+// closeOutput closes the streamed output connections, signaling EOF
+// to the client.
+func (me *WorkerTask) closeOutput() {
+	for _, c := range []net.Conn{me.stdoutConn, me.stderrConn} {
+		if c != nil {
+			c.Close()
+		}
+	}
+}
+
 func (me *WorkerTask) Run() error {
+	start := time.Now()
 	fuseFs, err := me.mirror.newFs(me)
+	me.rep.addTiming("queued", time.Now().Sub(start))
 
 	if err == ShuttingDownError {
 		// We can't return an error, since that would cause
@@ -49,19 +113,53 @@ func (me *WorkerTask) Run() error {
 	}
 
 	if err != nil {
-		return err
+		me.closeOutput()
+		return phaseError(PhaseScheduling, me.mirror.worker.listener.Addr().String(), err)
 	}
 
+	me.harvestMutex.Lock()
+	me.fuseFs = fuseFs
+	me.harvestMutex.Unlock()
+
 	me.mirror.worker.stats.Enter("fuse")
+	start = time.Now()
 	err = me.runInFuse(fuseFs)
+	if fetchErr := fuseFs.reads.fetchError(); fetchErr != nil {
+		// Failed reads may have failed the job; another
+		// worker may have the space.
+		err = phaseError(PhaseScheduling, me.mirror.worker.listener.Addr().String(), fetchErr)
+	}
+	me.rep.addTiming("exec", time.Now().Sub(start))
 	me.mirror.worker.stats.Exit("fuse")
 
+	me.mirror.fsMutex.Lock()
+	me.rep.Cancelled = me.cancelled
+	me.rep.TimedOut = me.timedOut
+	me.mirror.fsMutex.Unlock()
+
+	// Files not harvested yet go into the WorkResponse.
+	me.harvestMutex.Lock()
+	me.reaped = true
+	me.harvestMutex.Unlock()
+
+	me.killLeftovers(fuseFs)
+	me.limits.release()
+	if me.req.RecordReads {
+		me.rep.Reads = fuseFs.reads.list()
+	}
 	me.mirror.worker.stats.Enter("reap")
+	start = time.Now()
 	if me.mirror.considerReap(fuseFs, me) {
-		me.rep.FileSet, me.rep.TaskIds = me.mirror.reapFuse(fuseFs)
+		me.killMountUsers(fuseFs)
+		me.rep.FileSet, me.rep.TaskIds, me.rep.OpenFiles = me.mirror.reapFuse(fuseFs)
+		if len(me.rep.OpenFiles) > 0 {
+			log.Printf("Task %d left files open for writing: %v", me.req.TaskId, me.rep.OpenFiles)
+		}
+		me.addUnacked(me.rep.FileSet)
 	} else {
 		me.mirror.returnFs(fuseFs)
 	}
+	me.rep.addTiming("reap", time.Now().Sub(start))
 	me.mirror.worker.stats.Exit("reap")
 
 	return err
@@ -86,22 +184,56 @@ func (me *WorkerTask) runInFuse(fuseFs *workerFuseFs) error {
 			Gid: uint32(me.mirror.worker.options.User.Gid),
 		}
 		attr.Chroot = fuseFs.mount
+		attr.Setpgid = true
 
 		cmd.SysProcAttr = attr
 		cmd.Dir = me.req.Dir
 	} else {
+		// Own process group, so we can cancel the entire job.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 		cmd.Path = fastpath.Join(fuseFs.mount, me.req.Binary)
 		cmd.Dir = fastpath.Join(fuseFs.mount, me.req.Dir)
 	}
 
 	cmd.Env = me.req.Env
+	// Background processes may hold on to the output; don't wait
+	// for them indefinitely.
+	cmd.WaitDelay = _BACKGROUND_OUTPUT_DELAY
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
 	if me.stdinConn != nil {
 		cmd.Stdin = me.stdinConn
 	}
+	if me.stdoutConn != nil {
+		cmd.Stdout = me.stdoutConn
+	}
+	if me.stderrConn != nil {
+		cmd.Stderr = me.stderrConn
+	}
+	defer me.closeOutput()
 
-	if err := cmd.Start(); err != nil {
+	me.mirror.fsMutex.Lock()
+	cancelled := me.cancelled
+	var err error
+	if !cancelled {
+		err = cmd.Start()
+		if isExecFormatError(err) && me.req.ShellFallback {
+			cmd = me.shellCommand(cmd, fuseFs)
+			err = cmd.Start()
+		}
+	}
+	me.mirror.fsMutex.Unlock()
+	if cancelled || err != nil {
+		return err
+	}
+
+	err = me.mirror.worker.prioritizeJob(cmd.Process.Pid)
+	if err == nil {
+		me.limits, err = me.mirror.worker.limitJob(cmd.Process.Pid, me.req.TaskId, me.mirror.cgroup)
+	}
+	if err != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		cmd.Wait()
 		return err
 	}
 
@@ -111,13 +243,33 @@ func (me *WorkerTask) runInFuse(fuseFs *workerFuseFs) error {
 	}
 	me.taskInfo = fmt.Sprintf("%v, dir %v, fuse FS %v",
 		printCmd, cmd.Dir, fuseFs.id)
-	err := cmd.Wait()
+	var timer *time.Timer
+	if me.req.TimeoutNs > 0 {
+		timer = time.AfterFunc(time.Duration(me.req.TimeoutNs), func() {
+			me.expire(fuseFs)
+		})
+	}
+	err = cmd.Wait()
+	me.mirror.fsMutex.Lock()
+	me.exited = true
+	me.mirror.fsMutex.Unlock()
+	if timer != nil {
+		timer.Stop()
+	}
+	if err == exec.ErrWaitDelay {
+		err = nil
+	}
 
 	exitErr, ok := err.(*exec.ExitError)
 	if ok {
 		me.rep.Exit = exitErr.Sys().(syscall.WaitStatus)
 		err = nil
 	}
+	if r := me.limits.exceeded(me.rep.Exit); r != "" {
+		log.Printf("Task %d exceeded its %s limit", me.req.TaskId, r)
+		me.rep.ResourceExceeded = r
+		me.mirror.worker.resourceKilled()
+	}
 
 	// No waiting: if the process exited, we kill the connection.
 	if me.stdinConn != nil {
@@ -127,16 +279,68 @@ func (me *WorkerTask) runInFuse(fuseFs *workerFuseFs) error {
 	// We could use a connection here too, but this is simpler.
 	me.rep.Stdout = stdout.String()
 	me.rep.Stderr = stderr.String()
+	if me.rep.ResourceExceeded == ResourceMemory {
+		me.rep.Stderr += "killed: memory limit\n"
+	}
 
 	return err
 }
 
+func isExecFormatError(err error) bool {
+	pe, ok := err.(*os.PathError)
+	return ok && pe.Err == syscall.ENOEXEC
+}
+
+// shellCommand returns a command that runs the binary of cmd as a
+// shell script.
+func (me *WorkerTask) shellCommand(cmd *exec.Cmd, fuseFs *workerFuseFs) *exec.Cmd {
+	shell := "/bin/sh"
+	if os.Geteuid() != 0 {
+		shell = fastpath.Join(fuseFs.mount, shell)
+	}
+	me.cmd = &exec.Cmd{
+		Path:        shell,
+		Args:        append([]string{"/bin/sh", cmd.Path}, me.req.Argv[1:]...),
+		Env:         cmd.Env,
+		Dir:         cmd.Dir,
+		Stdin:       cmd.Stdin,
+		Stdout:      cmd.Stdout,
+		Stderr:      cmd.Stderr,
+		SysProcAttr: cmd.SysProcAttr,
+		WaitDelay:   cmd.WaitDelay,
+	}
+	return me.cmd
+}
+
 // fillReply empties the unionFs and hashes files as needed.  It will
-// return the FS back the pool as soon as possible.
-func (me *Mirror) fillReply(fs *workerFuseFs) *attr.FileSet {
-	dir, yield := fs.reap()
+// return the FS back the pool as soon as possible.  It also returns
+// the files that were still open for writing.
+func (me *Mirror) fillReply(fs *workerFuseFs) (*attr.FileSet, []string) {
+	dir, yield, open := fs.reap()
+	scratch := fs.reapScratch()
 	me.returnFs(fs)
 
+	files, err := me.resultFiles(yield, me.worker.content.DestructiveSavePath)
+	if err != nil {
+		log.Panicf("fillReply: %v", err)
+	}
+	fset := attr.FileSet{Files: files}
+	fset.Files = append(fset.Files, scratch...)
+	fset.Sort()
+	if err := os.Remove(dir); err != nil {
+		log.Panicf("fillReply: Remove failed: %v", err)
+	}
+
+	wrRoot := strings.TrimLeft(me.writableRoot, "/")
+	for i, n := range open {
+		open[i] = fastpath.Join(wrRoot, n)
+	}
+	return &fset, open
+}
+
+// resultFiles converts union FS results to file attributes, saving
+// the content of backing files with save.
+func (me *Mirror) resultFiles(yield map[string]*fs.Result, save func(string) (string, error)) ([]*attr.FileAttr, error) {
 	files := make([]*attr.FileAttr, 0, len(yield))
 	wrRoot := strings.TrimLeft(me.writableRoot, "/")
 	reapedHashes := map[string]string{}
@@ -154,7 +358,7 @@ func (me *Mirror) fillReply(fs *workerFuseFs) *attr.FileSet {
 			if v.Original != "" && v.Original != contentPath {
 				fa := me.rpcFs.attr.Get(contentPath)
 				if fa.Hash == "" {
-					log.Panicf("Contents for %q disappeared.", contentPath)
+					return nil, fmt.Errorf("contents for %q disappeared", contentPath)
 				}
 				f.Hash = fa.Hash
 			}
@@ -163,9 +367,12 @@ func (me *Mirror) fillReply(fs *workerFuseFs) *attr.FileSet {
 				if !ok {
 					var err error
 
-					h, err = me.worker.content.DestructiveSavePath(v.Backing)
-					if err != nil || h == "" {
-						log.Fatalf("DestructiveSavePath fail %v, %q", err, h)
+					h, err = save(v.Backing)
+					if err == nil && h == "" {
+						err = fmt.Errorf("no hash")
+					}
+					if err != nil {
+						return nil, fmt.Errorf("saving %s failed: %v", v.Backing, err)
 					}
 					reapedHashes[v.Backing] = h
 				}
@@ -174,13 +381,5 @@ func (me *Mirror) fillReply(fs *workerFuseFs) *attr.FileSet {
 		}
 		files = append(files, f)
 	}
-
-	fset := attr.FileSet{Files: files}
-	fset.Sort()
-	err := os.Remove(dir)
-	if err != nil {
-		log.Fatal("fillReply: Remove failed: %v", err)
-	}
-
-	return &fset
+	return files, nil
 }
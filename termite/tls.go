@@ -0,0 +1,193 @@
+package termite
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
+	"time"
+)
+
+// Connections between coordinator, masters and workers can use TLS.
+// The shared-secret handshake happens first, in the clear, so both
+// sides learn whether the other uses TLS and fail with a readable
+// error if they differ.  Then the connection is wrapped in TLS, with
+// both sides presenting a certificate signed by the CA.  Without
+// CertFile, connections stay plaintext.
+
+// TLSOptions configures TLS for a coordinator, master or worker.
+// Masters reach workers both by name and by IP address, so worker
+// certificates must be valid for both.
+type TLSOptions struct {
+	// Certificate and key presented to peers.
+	CertFile string
+	KeyFile  string
+
+	// CA certificates that the certificates of peers must chain
+	// to.  If empty, the system roots are used.
+	CAFile string
+}
+
+// TLSConfig returns the TLS configuration for the options, or nil if
+// TLS is off.
+func (me *TLSOptions) TLSConfig() (*tls.Config, error) {
+	if me.CertFile == "" && me.KeyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(me.CertFile, me.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if me.CAFile != "" {
+		pem, err := ioutil.ReadFile(me.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", me.CAFile)
+		}
+		config.RootCAs = pool
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
+
+// Acknowledgements that end the shared-secret handshake.
+var (
+	plainAck = []byte("OK")
+	tlsAck   = []byte("OT")
+)
+
+func handshakeAck(config *tls.Config) []byte {
+	if config != nil {
+		return tlsAck
+	}
+	return plainAck
+}
+
+// checkAck compares the acknowledgement of the peer with ours.
+func checkAck(ours, theirs []byte) error {
+	switch {
+	case string(ours) == string(theirs):
+		return nil
+	case string(theirs) == string(tlsAck):
+		return errors.New("peer uses TLS, but TLS is not configured here")
+	case string(theirs) == string(plainAck):
+		return errors.New("TLS is configured here, but the peer does not use TLS")
+	}
+	return errors.New("Missing ack reply")
+}
+
+// wrapTLS starts TLS on an authenticated connection, if config is
+// set.  The client checks that the certificate of the server is
+// valid for addr.
+func wrapTLS(conn net.Conn, config *tls.Config, server bool, addr string) (net.Conn, error) {
+	if config == nil {
+		return conn, nil
+	}
+	var t *tls.Conn
+	if server {
+		t = tls.Server(conn, config)
+	} else {
+		t = tls.Client(conn, clientTLSConfig(config, addr))
+	}
+	if err := t.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake with %v: %v", conn.RemoteAddr(), err)
+	}
+	return t, nil
+}
+
+// clientTLSConfig returns config for dialing addr.
+func clientTLSConfig(config *tls.Config, addr string) *tls.Config {
+	c := config.Clone()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		c.ServerName = host
+	} else {
+		c.ServerName = addr
+	}
+	return c
+}
+
+// dialHTTPRPC is rpc.DialHTTP, over TLS if config is set.  Dialing
+// gives up after timeout.
+func dialHTTPRPC(addr string, config *tls.Config, timeout time.Duration) (*rpc.Client, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if config == nil {
+		conn, err = dialer.Dial("tcp", addr)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, clientTLSConfig(config, addr))
+	}
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = fmt.Errorf("unexpected HTTP response: %s", resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// httpClient returns a client for the web servers of the coordinator
+// and workers.
+func httpClient(config *tls.Config) *http.Client {
+	if config == nil {
+		return &http.Client{}
+	}
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: config},
+	}
+}
+
+// serveHTTP serves handler on l, over TLS if config is set.  Client
+// certificates are optional, because browsers looking at the status
+// pages have none.
+func serveHTTP(l net.Listener, handler http.Handler, config *tls.Config) error {
+	server := http.Server{Handler: handler}
+	if config == nil {
+		return server.Serve(l)
+	}
+	server.TLSConfig = config.Clone()
+	server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return server.ServeTLS(l, "", "")
+}
+
+// requireClientCert wraps handler so requests over TLS without a
+// verified client certificate are refused.  serveHTTP only verifies
+// certificates that are given, which is not enough for RPC.
+func requireClientCert(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil && len(req.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// httpScheme returns the URL scheme for a web server that uses
+// config.
+func httpScheme(config *tls.Config) string {
+	if config == nil {
+		return "http"
+	}
+	return "https"
+}
@@ -0,0 +1,221 @@
+package termite
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/rpc"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCerts writes a self-signed CA, and a certificate for
+// localhost signed by it, into dir.
+func writeTestCerts(t *testing.T, dir string) TLSOptions {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "termite test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+
+	o := TLSOptions{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+	}
+	for name, block := range map[string]*pem.Block{
+		o.CAFile:   {Type: "CERTIFICATE", Bytes: caDER},
+		o.CertFile: {Type: "CERTIFICATE", Bytes: leafDER},
+		o.KeyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := ioutil.WriteFile(name, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	return o
+}
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	o := writeTestCerts(t, t.TempDir())
+	config, err := o.TLSConfig()
+	if err != nil {
+		t.Fatalf("TLSConfig: %v", err)
+	}
+	return config
+}
+
+// serveTyped accepts connections on l, and sends the first 5 bytes
+// received on each to out.
+func serveTyped(l net.Listener, out chan string) {
+	pc := NewPendingConnections()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if _, ok := c.(*tls.Conn); !ok {
+			out <- "plaintext"
+		}
+		go func() {
+			defer c.Close()
+			if pc.Accept(c) {
+				return
+			}
+			b := make([]byte, 5)
+			if _, err := io.ReadFull(c, b); err == nil {
+				out <- string(b)
+			}
+		}()
+	}
+}
+
+func TestTLSConnection(t *testing.T) {
+	config := testTLSConfig(t)
+	secret := testSecret(t)
+	l := AuthenticatedListener(0, secret, 0, config)
+	defer l.Close()
+	out := make(chan string, 2)
+	go serveTyped(l, out)
+
+	addr := strings.Replace(l.Addr().String(), "[::]", "127.0.0.1", 1)
+	conn, err := DialTypedConnection(addr, RPC_CHANNEL, secret, config)
+	if err != nil {
+		t.Fatalf("DialTypedConnection: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Errorf("got %T, want *tls.Conn", conn)
+	}
+	io.WriteString(conn, "hello")
+	if got := <-out; got != "hello" {
+		t.Errorf("got %q, want hello", got)
+	}
+}
+
+func TestTLSMismatch(t *testing.T) {
+	config := testTLSConfig(t)
+	secret := testSecret(t)
+	for _, c := range []struct {
+		listen, dial *tls.Config
+	}{{config, nil}, {nil, config}} {
+		l := AuthenticatedListener(0, secret, 0, c.listen)
+		go serveTyped(l, make(chan string, 10))
+
+		addr := strings.Replace(l.Addr().String(), "[::]", "127.0.0.1", 1)
+		conn, err := DialTypedConnection(addr, RPC_CHANNEL, secret, c.dial)
+		if err == nil {
+			conn.Close()
+			t.Errorf("listen TLS %v, dial TLS %v: dial succeeded", c.listen != nil, c.dial != nil)
+		} else if !strings.Contains(err.Error(), "TLS") {
+			t.Errorf("listen TLS %v, dial TLS %v: got %v, want error about TLS", c.listen != nil, c.dial != nil, err)
+		}
+		l.Close()
+	}
+}
+
+func TestTLSCoordinatorClient(t *testing.T) {
+	config := testTLSConfig(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	coordinator := NewCoordinator(&CoordinatorOptions{})
+	rpcServer := rpc.NewServer()
+	rpcServer.Register(coordinator)
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, requireClientCert(rpcServer))
+	go serveHTTP(l, mux, config)
+
+	rep := CoordinatorStatusResponse{}
+	plain := newCoordinatorClient(l.Addr().String(), nil)
+	if err := plain.Call("Coordinator.Status", &CoordinatorStatusRequest{}, &rep); err == nil {
+		t.Errorf("plaintext call to TLS coordinator succeeded")
+	}
+
+	// Trusts the CA, but has no certificate.
+	anonymous := newCoordinatorClient(l.Addr().String(), &tls.Config{RootCAs: config.RootCAs})
+	if err := anonymous.Call("Coordinator.Status", &CoordinatorStatusRequest{}, &rep); err == nil {
+		t.Errorf("call without client certificate succeeded")
+	}
+
+	client := newCoordinatorClient(l.Addr().String(), config)
+	if err := client.Call("Coordinator.Status", &CoordinatorStatusRequest{}, &rep); err != nil {
+		t.Errorf("Call: %v", err)
+	}
+}
+
+func TestTLSStatusPages(t *testing.T) {
+	config := testTLSConfig(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "status")
+	})
+	go serveHTTP(l, mux, config)
+
+	// Like a browser: trusts the CA, but has no certificate.
+	browser := &tls.Config{RootCAs: config.RootCAs}
+	for _, c := range []*tls.Config{config, browser} {
+		resp, err := httpClient(c).Get("https://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		content, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(content) != "status" {
+			t.Errorf("got %q, want status", content)
+		}
+	}
+}
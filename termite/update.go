@@ -0,0 +1,68 @@
+package termite
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/hanwen/termite/attr"
+)
+
+// Pending file changes are sent to a mirror in batches of
+// MasterOptions.UpdateBatchSize files.  Batches that encode to more
+// than _UPDATE_COMPRESS_THRESHOLD bytes are sent compressed.
+const (
+	_UPDATE_BATCH_SIZE         = 1000
+	_UPDATE_COMPRESS_THRESHOLD = 4096
+)
+
+func newUpdateRequest(files []*attr.FileAttr) (*UpdateRequest, error) {
+	encoded := &bytes.Buffer{}
+	if err := gob.NewEncoder(encoded).Encode(files); err != nil {
+		return nil, err
+	}
+	if encoded.Len() < _UPDATE_COMPRESS_THRESHOLD {
+		return &UpdateRequest{Files: files}, nil
+	}
+
+	compressed := &bytes.Buffer{}
+	w, err := flate.NewWriter(compressed, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(encoded.Bytes())
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return &UpdateRequest{Compressed: compressed.Bytes()}, nil
+}
+
+// files returns the files of the update, decompressing them if
+// necessary.
+func (me *UpdateRequest) files() ([]*attr.FileAttr, error) {
+	if me.Compressed == nil {
+		return me.Files, nil
+	}
+	var files []*attr.FileAttr
+	r := flate.NewReader(bytes.NewReader(me.Compressed))
+	defer r.Close()
+	if err := gob.NewDecoder(r).Decode(&files); err != nil {
+		return nil, fmt.Errorf("decoding compressed update: %v", err)
+	}
+	return files, nil
+}
+
+// sentKey summarizes an update, so we can skip sending an identical
+// update for the same path to a mirror twice.  Directories are always
+// sent, since their listing may have changed.
+func sentKey(f *attr.FileAttr) string {
+	if f.Deletion() {
+		return "deleted"
+	}
+	if f.IsDir() {
+		return ""
+	}
+	return fmt.Sprintf("%x %q %o %d %d.%d", f.Hash, f.Link, f.Mode,
+		f.Size, f.Mtime, f.Mtimensec)
+}
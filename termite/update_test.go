@@ -0,0 +1,122 @@
+package termite
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/termite/attr"
+)
+
+func smallFileUpdates(n int) []*attr.FileAttr {
+	var files []*attr.FileAttr
+	for i := 0; i < n; i++ {
+		files = append(files, &attr.FileAttr{
+			Path: fmt.Sprintf("src/dir%d/file%d.o", i/100, i),
+			Hash: md5str(fmt.Sprintf("content %d", i)),
+			Attr: &fuse.Attr{
+				Mode:  syscall.S_IFREG | 0644,
+				Size:  uint64(100 + i),
+				Mtime: 1300000000 + uint64(i),
+			},
+		})
+	}
+	return files
+}
+
+// wireBytes returns the size of the gob encoding of the update
+// requests for files, which is what net/rpc puts on the wire.
+func wireBytes(files []*attr.FileAttr, batchSize int) (int, error) {
+	total := 0
+	for start := 0; start < len(files); start += batchSize {
+		end := start + batchSize
+		if end > len(files) {
+			end = len(files)
+		}
+		req, err := newUpdateRequest(files[start:end])
+		if err != nil {
+			return 0, err
+		}
+		buf := &bytes.Buffer{}
+		if err := gob.NewEncoder(buf).Encode(req); err != nil {
+			return 0, err
+		}
+		total += buf.Len()
+	}
+	return total, nil
+}
+
+func TestUpdateRequestCompressed(t *testing.T) {
+	files := smallFileUpdates(100)
+	req, err := newUpdateRequest(files)
+	if err != nil {
+		t.Fatalf("newUpdateRequest: %v", err)
+	}
+	if req.Compressed == nil || req.Files != nil {
+		t.Fatalf("large update was not compressed")
+	}
+	got, err := req.files()
+	if err != nil {
+		t.Fatalf("files: %v", err)
+	}
+	if len(got) != len(files) {
+		t.Fatalf("got %d files, want %d", len(got), len(files))
+	}
+	for i, f := range got {
+		if f.Path != files[i].Path || f.Hash != files[i].Hash || f.Size != files[i].Size {
+			t.Errorf("file %d: got %v, want %v", i, f, files[i])
+		}
+	}
+
+	small, err := newUpdateRequest(files[:1])
+	if err != nil {
+		t.Fatalf("newUpdateRequest: %v", err)
+	}
+	if small.Compressed != nil || len(small.Files) != 1 {
+		t.Errorf("small update should not be compressed: %v", small)
+	}
+
+	if _, err := (&UpdateRequest{Compressed: []byte("garbage")}).files(); err == nil {
+		t.Errorf("decoding garbage should fail")
+	}
+}
+
+func TestSentKey(t *testing.T) {
+	files := smallFileUpdates(2)
+	if sentKey(files[0]) == sentKey(files[1]) {
+		t.Errorf("different files have the same key")
+	}
+	if sentKey(files[0]) != sentKey(files[0].Copy(true)) {
+		t.Errorf("copy has a different key")
+	}
+	dir := &attr.FileAttr{Path: "d", Attr: &fuse.Attr{Mode: syscall.S_IFDIR | 0755}}
+	if sentKey(dir) != "" {
+		t.Errorf("directories should always be sent")
+	}
+	if sentKey(&attr.FileAttr{Path: "x"}) == "" {
+		t.Errorf("deletions should have a key")
+	}
+}
+
+func BenchmarkUpdateWireBytes(b *testing.B) {
+	files := smallFileUpdates(10000)
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(&UpdateRequest{Files: files}); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	n := 0
+	for i := 0; i < b.N; i++ {
+		var err error
+		n, err = wireBytes(files, _UPDATE_BATCH_SIZE)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(buf.Len()), "unbatched-bytes")
+	b.ReportMetric(float64(n), "wire-bytes")
+}
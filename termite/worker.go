@@ -1,17 +1,20 @@
 package termite
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
-	"net/http"
 	"net/rpc"
 	"os"
 	"os/exec"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -35,6 +38,33 @@ type Worker struct {
 
 	httpStatusPort int
 	mirrors        *WorkerMirrors
+	coordinator    *coordinatorClient
+	cpuFeatures    []string
+
+	// Sends reports to the coordinator.
+	reporter *reporter
+
+	// Jobs killed for exceeding resource limits.  Atomic.
+	resourceKills int32
+
+	// Jobs that failed with a panic.  Atomic.
+	jobPanics int32
+
+	// Counts mirror cgroups, for their names, and logs that they
+	// are unavailable once.
+	mirrorCgroups int32
+	cgroupWarning sync.Once
+
+	// Protects canRestart and execPath.
+	mutex sync.Mutex
+
+	// If set, the updated binary to execute once the jobs are
+	// done; see UpdateBinary.
+	execPath string
+
+	// Set if connections from masters and to the coordinator use
+	// TLS.
+	tlsConfig *tls.Config
 }
 
 type User struct {
@@ -56,8 +86,12 @@ type WorkerOptions struct {
 
 	Paranoia bool
 	Secret   []byte
-	TempDir  string
-	Jobs     int
+
+	// Certificates for TLS connections from masters and to the
+	// coordinator.
+	TLSOptions
+	TempDir string
+	Jobs    int
 
 	// If set, change user to this for running.
 	User *User
@@ -65,7 +99,8 @@ type WorkerOptions struct {
 	// How often to reap filesystems. If 1, use 1 FS per task.
 	ReapCount int
 
-	// Delay between contacting the coordinator for making reports.
+	// Maximum delay between reports to the coordinator.  Workers
+	// also report when their state changes.
 	ReportInterval time.Duration
 	LogFileName    string
 
@@ -76,6 +111,57 @@ type WorkerOptions struct {
 	// How long to wait between the last task exit, and shutting
 	// down the server.
 	LameDuckPeriod time.Duration
+
+	// Sent to the coordinator, so masters can select workers;
+	// see MasterOptions.WorkerSelector and
+	// WorkRequest.RequiredLabels.  The arch and os labels are
+	// added.
+	Labels map[string]string
+
+	// How long files found missing on the master are assumed to
+	// stay missing, unless an update creates them.  If zero, each
+	// lookup that is not answered by a cached directory asks the
+	// master.
+	NegativeAttrTTL time.Duration
+
+	// Report right away when the available memory, or the free
+	// space for the content store, crosses these many bytes.
+	// Zero disables.
+	ReportMemThreshold  uint64
+	ReportDiskThreshold uint64
+
+	// Files that are read from the worker's own file system,
+	// if they match the master's; see LocalPrefixes.
+	LocalPrefixes LocalPrefixes
+
+	// Limits on the address space and CPU time of each process
+	// of a job.  Zero means no limit.  See limits.go.
+	MaxJobMemory  uint64
+	MaxJobCPUTime time.Duration
+
+	// If set, a cgroup v2 directory where the worker creates a
+	// cgroup for each job, limiting the memory of the job as a
+	// whole to MaxJobMemory.  Mirror cgroups go here too.
+	CgroupDir string
+
+	// Limits on the memory and the CPU shares of all jobs of a
+	// mirror together.  Zero means no limit.  They need
+	// CgroupDir.  See mirrorcgroup.go.
+	MaxMirrorMemory uint64
+	MirrorCPUShares int
+
+	// The nice value and I/O scheduling class of jobs; zero
+	// leaves them unchanged.  See priority.go.
+	Nice    int
+	IOClass int
+
+	// Arguments for the worker binary downloaded on restart.  If
+	// nil, the arguments of this process are used.
+	RestartArgs []string
+
+	// Entries of /proc, besides the process directories, that
+	// jobs may see.  If nil, fs.DefaultProcFiles.
+	ProcFiles []string
 }
 
 func NewWorker(options *WorkerOptions) *Worker {
@@ -108,7 +194,17 @@ func NewWorker(options *WorkerOptions) *Worker {
 		canRestart: true,
 	}
 	me.stats.PhaseOrder = []string{"run", "fuse", "reap"}
+	me.cpuFeatures = CPUFeatures()
 	me.mirrors = NewWorkerMirrors(me)
+	me.reporter = newReporter(me.Report, options.ReportInterval)
+	var err error
+	me.tlsConfig, err = copied.TLSConfig()
+	if err != nil {
+		log.Fatal("TLS: ", err)
+	}
+	if copied.Coordinator != "" {
+		me.coordinator = newCoordinatorClient(copied.Coordinator, me.tlsConfig)
+	}
 	me.stopListener = make(chan int, 1)
 	me.rpcServer.Register(me)
 	return me
@@ -116,7 +212,7 @@ func NewWorker(options *WorkerOptions) *Worker {
 
 func (me *Worker) PeriodicHouseholding() {
 	for me.accepting {
-		me.Report()
+		me.content.StartMaintenance()
 		if me.options.HeapLimit > 0 {
 			heap := stats.GetMemStat().Total()
 			if heap > me.options.HeapLimit {
@@ -143,12 +239,7 @@ func init() {
 }
 
 func (me *Worker) Report() {
-	if me.options.Coordinator == "" {
-		return
-	}
-	client, err := rpc.DialHTTP("tcp", me.options.Coordinator)
-	if err != nil {
-		log.Println("dialing coordinator:", err)
+	if me.coordinator == nil {
 		return
 	}
 
@@ -157,14 +248,59 @@ func (me *Worker) Report() {
 		Name:           fmt.Sprintf("%s:%d", Hostname, me.options.Port),
 		Version:        Version(),
 		HttpStatusPort: me.httpStatusPort,
+		MaxJobs:        me.options.Jobs,
+		RunningJobs:    me.mirrors.runningCount(),
+	}
+	req.CacheBytesReceived, req.CacheBytesServed = me.content.Totals()
+	req.MemAvailable = memAvailable()
+	if avg, ok := loadAvg(); ok {
+		req.LoadAvg = avg
+		req.NumCPU = runtime.NumCPU()
 	}
+	req.DiskAvailable = me.content.DiskAvailable()
+	req.CPUFeatures = me.cpuFeatures
+	req.Labels = workerLabels(me.options.Labels)
+	req.ResourceKills = me.resourceKillCount()
 	rep := Empty{}
-	err = client.Call("Coordinator.Register", &req, &rep)
-	if err != nil {
+	if err := me.coordinator.Call("Coordinator.Register", &req, &rep); err != nil {
 		log.Println("coordinator rpc error:", err)
 	}
 }
 
+// memAvailable returns the memory available for starting new
+// processes, according to the kernel, or 0 if unknown.
+func memAvailable() uint64 {
+	content, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	for _, l := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) == 3 && fields[0] == "MemAvailable:" && fields[2] == "kB" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb << 10
+		}
+	}
+	return 0
+}
+
+// loadAvg returns the one-minute load average.
+func loadAvg() (float64, bool) {
+	content, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	avg, err := strconv.ParseFloat(fields[0], 64)
+	return avg, err == nil
+}
+
 func (me *Worker) CreateMirror(req *CreateMirrorRequest, rep *CreateMirrorResponse) error {
 	if !me.accepting {
 		return errors.New("Worker is shutting down.")
@@ -183,16 +319,36 @@ func (me *Worker) CreateMirror(req *CreateMirrorRequest, rep *CreateMirrorRespon
 		return err
 	}
 	mirror.writableRoot = req.WritableRoot
+	mirror.scratchRoot = req.ScratchRoot
 
 	rep.GrantedJobCount = mirror.maxJobCount
+	rep.MaxPathLength = me.mirrorPathMax()
 	return nil
 }
 
+// PATH_MAX on Linux, including the terminating NUL.
+const _PATH_MAX = 4096
+
+// mirrorPathMax returns the length of the longest path, relative to
+// the root, that still fits in PATH_MAX once it is placed under the
+// mount point of a mirror's FUSE file system.
+func (me *Worker) mirrorPathMax() int {
+	tmp := me.options.TempDir
+	if tmp == "" {
+		tmp = os.TempDir()
+	}
+	// See newWorkerFuseFs: $TMP/termite-task<uint32>/mnt/
+	prefix := len(tmp) + len("/termite-task") + 10 + len("/mnt/")
+	return _PATH_MAX - 1 - prefix
+}
+
 func (me *Worker) RunWorkerServer() {
-	me.listener = AuthenticatedListener(me.options.Port, me.options.Secret, me.options.PortRetry)
+	me.listener = AuthenticatedListener(me.options.Port, me.options.Secret, me.options.PortRetry, me.tlsConfig)
 	_, portString, _ := net.SplitHostPort(me.listener.Addr().String())
 	fmt.Sscanf(portString, "%d", &me.options.Port)
 	go me.PeriodicHouseholding()
+	go me.reporter.loop()
+	go me.watchResources()
 	go me.serveStatus(me.options.Port, me.options.PortRetry)
 
 	for {
@@ -215,6 +371,14 @@ func (me *Worker) RunWorkerServer() {
 	}
 }
 
+// SetRateLimit changes how fast the worker serves content.
+func (me *Worker) SetRateLimit(req *SetRateLimitRequest, rep *SetRateLimitResponse) error {
+	rep.Previous = me.content.RateLimit()
+	me.content.SetRateLimit(req.BytesPerSec)
+	log.Printf("Content rate limit set to %s", formatRate(req.BytesPerSec))
+	return nil
+}
+
 func (me *Worker) Log(req *LogRequest, rep *LogResponse) error {
 	if me.options.LogFileName == "" {
 		return fmt.Errorf("No log filename set.")
@@ -261,8 +425,8 @@ func (me *Worker) Log(req *LogRequest, rep *LogResponse) error {
 }
 
 func (me *Worker) restart() {
-	cl := http.Client{}
-	req, err := cl.Get(fmt.Sprintf("http://%s/bin/worker", me.options.Coordinator))
+	cl := httpClient(me.tlsConfig)
+	req, err := cl.Get(fmt.Sprintf("%s://%s/bin/worker", httpScheme(me.tlsConfig), me.options.Coordinator))
 	if err != nil {
 		log.Fatal("http get error.")
 	}
@@ -281,7 +445,11 @@ func (me *Worker) restart() {
 	f.Close()
 	os.Chmod(f.Name(), 0755)
 	log.Println("Starting downloaded worker.")
-	cmd := exec.Command(f.Name(), os.Args[1:]...)
+	args := me.options.RestartArgs
+	if args == nil {
+		args = os.Args[1:]
+	}
+	cmd := exec.Command(f.Name(), args...)
 	cmd.Start()
 }
 
@@ -296,8 +464,13 @@ func (me *Worker) Shutdown(req *ShutdownRequest, rep *ShutdownResponse) error {
 }
 
 func (me *Worker) shutdown(restart bool, aggressive bool) {
-	if restart && me.canRestart {
+	me.mutex.Lock()
+	restart = restart && me.canRestart
+	if restart {
 		me.canRestart = false
+	}
+	me.mutex.Unlock()
+	if restart {
 		me.restart()
 
 		// Wait a bit, since we don't want to shutdown before
@@ -305,6 +478,7 @@ func (me *Worker) shutdown(restart bool, aggressive bool) {
 		time.Sleep(2 * time.Second)
 	}
 	me.accepting = false
+	me.reporter.stop()
 	go func() {
 		me.mirrors.shutdown(aggressive)
 
@@ -312,6 +486,12 @@ func (me *Worker) shutdown(restart bool, aggressive bool) {
 		if !aggressive {
 			time.Sleep(me.options.LameDuckPeriod)
 		}
+		me.mutex.Lock()
+		exe := me.execPath
+		me.mutex.Unlock()
+		if exe != "" {
+			me.reexec(exe)
+		}
 		me.listener.Close()
 	}()
 }
@@ -1,7 +1,9 @@
 package termite
 
 import (
+	"crypto/md5"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -12,6 +14,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -81,7 +84,7 @@ func NewTestCase(t *testing.T) *testCase {
 
 	me := new(testCase)
 	me.tester = t
-	me.secret = RandomBytes(20)
+	me.secret = testSecret(t)
 	me.tmp, _ = ioutil.TempDir("", "")
 
 	me.startFdCount = me.fdCount()
@@ -203,8 +206,11 @@ func (me *testCase) RunSuccess(req WorkRequest) (rep WorkResponse) {
 	return rep
 }
 
+// How long the tests wait for the master to accept socket connections.
+const testDialTimeout = time.Second
+
 func (me *testCase) Run(req WorkRequest, mustExit bool) (rep WorkResponse) {
-	rpcConn := OpenSocketConnection(me.socket, RPC_CHANNEL, 1e7)
+	rpcConn := OpenSocketConnection(me.socket, RPC_CHANNEL, testDialTimeout)
 	client := rpc.NewClient(rpcConn)
 	if req.Env == nil {
 		req.Env = testEnv()
@@ -234,7 +240,7 @@ func TestEndToEndBasic(t *testing.T) {
 		Argv:    []string{"tee", "output.txt"},
 	}
 
-	stdinConn := OpenSocketConnection(tc.socket, req.StdinId, 10e6)
+	stdinConn := OpenSocketConnection(tc.socket, req.StdinId, testDialTimeout)
 	go func() {
 		stdinConn.Write([]byte("hello"))
 		stdinConn.Close()
@@ -269,11 +275,53 @@ func TestEndToEndBasic(t *testing.T) {
 	}
 }
 
+// Like TestEndToEndBasic, but streams stdout, and checks that it is
+// received while the job runs.
+func TestEndToEndStreamOutput(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	req := WorkRequest{
+		StdoutId: ConnectionId(),
+		Argv:     []string{"sh", "-c", "echo hello; sleep 1; echo world"},
+	}
+
+	stdoutConn := OpenSocketConnection(tc.socket, req.StdoutId, testDialTimeout)
+	defer stdoutConn.Close()
+
+	done := make(chan WorkResponse, 1)
+	go func() {
+		done <- tc.Run(req, false)
+	}()
+
+	first := make([]byte, 6)
+	if _, err := io.ReadFull(stdoutConn, first); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	select {
+	case <-done:
+		t.Errorf("job finished before output was streamed")
+	default:
+	}
+	rest, err := ioutil.ReadAll(stdoutConn)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if got := string(first) + string(rest); got != "hello\nworld\n" {
+		t.Errorf("got output %q", got)
+	}
+
+	rep := <-done
+	if rep.Exit.ExitStatus() != 0 || rep.Stdout != "" {
+		t.Errorf("got exit %d, stdout %q; want 0, empty", rep.Exit.ExitStatus(), rep.Stdout)
+	}
+}
+
 func TestEndToEndFullPath(t *testing.T) {
 	tc := NewTestCase(t)
 	defer tc.Clean()
 
-	rpcConn := OpenSocketConnection(tc.socket, RPC_CHANNEL, 1e7)
+	rpcConn := OpenSocketConnection(tc.socket, RPC_CHANNEL, testDialTimeout)
 	client := rpc.NewClient(rpcConn)
 	req := WorkRequest{
 		Binary: "true",
@@ -300,7 +348,7 @@ func TestEndToEndFormatError(t *testing.T) {
 
 	ioutil.WriteFile(tc.wd+"/ls.sh", []byte("ls"), 0755)
 
-	rpcConn := OpenSocketConnection(tc.socket, RPC_CHANNEL, 1e7)
+	rpcConn := OpenSocketConnection(tc.socket, RPC_CHANNEL, testDialTimeout)
 	client := rpc.NewClient(rpcConn)
 	req := WorkRequest{
 		Binary: tc.wd + "/ls.sh",
@@ -310,8 +358,82 @@ func TestEndToEndFormatError(t *testing.T) {
 	}
 	rep := &WorkResponse{}
 	err := client.Call("LocalMaster.Run", &req, &rep)
-	t.Log(err)
 	client.Close()
+	if err == nil || !strings.Contains(err.Error(), "exec format error") {
+		t.Errorf("got %v, want exec format error", err)
+	}
+}
+
+func TestEndToEndFailureReport(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	ioutil.WriteFile(tc.wd+"/ls.sh", []byte("ls"), 0755)
+
+	rpcConn := OpenSocketConnection(tc.socket, RPC_CHANNEL, testDialTimeout)
+	client := rpc.NewClient(rpcConn)
+	req := WorkRequest{
+		Binary:        tc.wd + "/ls.sh",
+		Argv:          []string{"ls.sh"},
+		Env:           testEnv(),
+		Dir:           tc.wd,
+		ReportFailure: true,
+	}
+	rep := &WorkResponse{}
+	err := client.Call("LocalMaster.Run", &req, &rep)
+	client.Close()
+	if err != nil {
+		t.Fatalf("LocalMaster.Run: %v", err)
+	}
+	f := rep.Failure
+	if f == nil {
+		t.Fatalf("no failure report")
+	}
+	if f.Phase != PhaseExec || f.Worker == "" || !strings.Contains(f.Error, "exec format error") {
+		t.Errorf("got %v", f)
+	}
+}
+
+func TestEndToEndCommandStats(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	for i := 0; i < 3; i++ {
+		tc.RunSuccess(WorkRequest{
+			Argv: []string{"touch", fmt.Sprintf("file%d", i)},
+		})
+	}
+
+	rpcConn := OpenSocketConnection(tc.socket, RPC_CHANNEL, testDialTimeout)
+	client := rpc.NewClient(rpcConn)
+	rep := CommandStatsResponse{}
+	err := client.Call("LocalMaster.Stats", &Empty{}, &rep)
+	client.Close()
+	if err != nil {
+		t.Fatalf("LocalMaster.Stats: %v", err)
+	}
+	if len(rep.Commands) != 1 {
+		t.Fatalf("got %+v, want stats for touch only", rep.Commands)
+	}
+	c := rep.Commands[0]
+	if c.Command != "touch" || c.Jobs != 3 || c.Remote <= 0 || c.Total() < c.Remote {
+		t.Errorf("got %+v", c)
+	}
+}
+
+func TestEndToEndShellFallback(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	ioutil.WriteFile(tc.wd+"/hello.sh", []byte("echo hello $1"), 0755)
+	rep := tc.RunSuccess(WorkRequest{
+		Binary:        tc.wd + "/hello.sh",
+		Argv:          []string{"hello.sh", "world"},
+		ShellFallback: true,
+	})
+	if rep.Stdout != "hello world\n" {
+		t.Errorf("got stdout %q, want %q", rep.Stdout, "hello world\n")
+	}
 }
 
 func TestEndToEndExec(t *testing.T) {
@@ -323,6 +445,26 @@ func TestEndToEndExec(t *testing.T) {
 	})
 }
 
+func TestEndToEndStatFs(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	// The writable root, and the read-only part from the master.
+	rep := tc.RunSuccess(WorkRequest{
+		Argv: []string{"stat", "-f", "-c", "%a %S", ".", "/"},
+	})
+	lines := strings.Split(strings.TrimSpace(rep.Stdout), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %q, want two lines", rep.Stdout)
+	}
+	for _, l := range lines {
+		var avail, bsize uint64
+		if _, err := fmt.Sscanf(l, "%d %d", &avail, &bsize); err != nil || avail == 0 || bsize == 0 {
+			t.Errorf("got %q (%v), want free blocks and block size", l, err)
+		}
+	}
+}
+
 func TestEndToEndNegativeNotify(t *testing.T) {
 	tc := NewTestCase(t)
 	defer tc.Clean()
@@ -536,6 +678,30 @@ func TestEndToEndProcDeny(t *testing.T) {
 	tc.RunFail(req)
 }
 
+func TestEndToEndProcSelfFd(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	rep := tc.RunSuccess(WorkRequest{
+		Argv: []string{"bash", "-c", "cat <(echo hi)"},
+	})
+	if rep.Stdout != "hi\n" {
+		t.Errorf("process substitution: got %q, want %q", rep.Stdout, "hi\n")
+	}
+
+	// Files in the job's view are listed with their path in the
+	// chroot.
+	err := ioutil.WriteFile(tc.wd+"/file.txt", []byte{42}, 0644)
+	check(err)
+	tc.refresh()
+	rep = tc.RunSuccess(WorkRequest{
+		Argv: []string{"bash", "-c", "exec 3< file.txt; readlink /proc/self/fd/3"},
+	})
+	if want := filepath.Join(tc.wd, "file.txt") + "\n"; rep.Stdout != want {
+		t.Errorf("readlink: got %q, want %q", rep.Stdout, want)
+	}
+}
+
 func TestEndToEndEnvironment(t *testing.T) {
 	tc := NewTestCase(t)
 	defer tc.Clean()
@@ -616,3 +782,584 @@ func TestEndToEndDenyPrivate(t *testing.T) {
 	}
 	tc.RunFail(req)
 }
+
+// longDir returns a directory under tc.wd whose root-relative path is
+// exactly n bytes long.
+func (me *testCase) longDir(n int) string {
+	dir := me.wd
+	for len(dir)-1 < n {
+		c := n - len(dir)
+		if c > attr.MaxNameLength {
+			c = attr.MaxNameLength
+			if n-len(dir)-c == 1 {
+				// Leave room for "/x".
+				c--
+			}
+		}
+		dir += "/" + strings.Repeat("d", c)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		me.tester.Fatalf("MkdirAll: %v", err)
+	}
+	return dir
+}
+
+func TestEndToEndPathLength(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	limit := tc.workers[0].mirrorPathMax()
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"true"},
+		Dir:  tc.longDir(limit),
+	})
+
+	rpcConn := OpenSocketConnection(tc.socket, RPC_CHANNEL, testDialTimeout)
+	client := rpc.NewClient(rpcConn)
+	defer client.Close()
+	req := WorkRequest{
+		Binary: tc.FindBin("true"),
+		Argv:   []string{"true"},
+		Env:    testEnv(),
+		Dir:    tc.longDir(limit + 1),
+	}
+	rep := WorkResponse{}
+	err := client.Call("LocalMaster.Run", &req, &rep)
+	if err == nil || !strings.Contains(err.Error(), req.Dir[1:]) {
+		t.Fatalf("got error %v, want error naming %q", err, req.Dir)
+	}
+}
+
+func TestEndToEndWarmUp(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	content := make([]byte, 100*1024)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	err := ioutil.WriteFile(tc.wd+"/data.txt", content, 0644)
+	check(err)
+
+	tc.master.options.WarmUp = []string{tc.FindBin("sh"), "-c", "cat data.txt > /dev/null; echo warm > warm.txt"}
+
+	// Creates the mirror, which runs the warm-up.
+	mc, err := tc.master.mirrors.pick(&WorkRequest{})
+	if err != nil {
+		t.Fatalf("pick: %v", err)
+	}
+	tc.master.mirrors.jobDone(mc)
+
+	worker := tc.workers[0]
+	h := md5.New()
+	h.Write(content)
+	if !worker.content.Has(string(h.Sum(nil))) {
+		t.Errorf("warm-up did not fetch data.txt")
+	}
+	if c, err := ioutil.ReadFile(tc.wd + "/warm.txt"); err != nil || string(c) != "warm\n" {
+		t.Errorf("warm-up output not replayed: %q, %v", c, err)
+	}
+
+	before, _ := worker.content.Totals()
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"cat", "data.txt"},
+	})
+	if after, _ := worker.content.Totals(); after != before {
+		t.Errorf("job after warm-up fetched %d bytes, want 0", after-before)
+	}
+}
+
+func TestEndToEndCancel(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	req := WorkRequest{
+		CancelId: ConnectionId(),
+		Argv:     []string{"sh", "-c", "echo x > early.txt; sleep 10; echo y > late.txt"},
+	}
+	done := make(chan WorkResponse, 1)
+	start := time.Now()
+	go func() {
+		done <- tc.Run(req, true)
+	}()
+
+	time.Sleep(time.Second)
+	rpcConn := OpenSocketConnection(tc.socket, RPC_CHANNEL, testDialTimeout)
+	client := rpc.NewClient(rpcConn)
+	defer client.Close()
+	cancelReq := CancelRequest{CancelId: req.CancelId}
+	if err := client.Call("LocalMaster.Cancel", &cancelReq, &Empty{}); err != nil {
+		t.Fatalf("LocalMaster.Cancel: %v", err)
+	}
+
+	rep := <-done
+	if dt := time.Now().Sub(start); dt > 5*time.Second {
+		t.Errorf("cancelled job took %v", dt)
+	}
+	if !rep.Cancelled {
+		t.Errorf("response should be marked cancelled: %v", rep)
+	}
+	for _, n := range []string{"early.txt", "late.txt"} {
+		if fi, _ := os.Lstat(tc.wd + "/" + n); fi != nil {
+			t.Errorf("%s of cancelled job should not be replayed", n)
+		}
+	}
+
+	if err := client.Call("LocalMaster.Cancel", &cancelReq, &Empty{}); err == nil {
+		t.Errorf("cancelling a finished job should fail")
+	}
+}
+
+func TestMirrorCancelForgotten(t *testing.T) {
+	mirror, clean := newSuperviseMirror(t)
+	defer clean()
+	mirror.cancelledIds = map[int]bool{}
+
+	// A cancel for a task that finished before it arrived is
+	// bounded to two generations.
+	for i := 0; i < 3*_CANCELLED_IDS; i++ {
+		if err := mirror.Cancel(&CancelTaskRequest{TaskId: i}, &Empty{}); err != nil {
+			t.Fatalf("Cancel: %v", err)
+		}
+	}
+	if n := len(mirror.cancelledIds) + len(mirror.cancelledOld); n > 2*_CANCELLED_IDS {
+		t.Errorf("kept %d cancelled ids", n)
+	}
+
+	// A finished task drops its cancel.
+	id := 3*_CANCELLED_IDS - 1
+	mirror.Run(&WorkRequest{TaskId: id, EnvHandle: "unknown"}, &WorkResponse{})
+	if mirror.cancelledIds[id] || mirror.cancelledOld[id] {
+		t.Errorf("cancel for finished task %d kept", id)
+	}
+}
+
+func TestEndToEndTimeout(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	start := time.Now()
+	rep := tc.Run(WorkRequest{
+		Argv:      []string{"sh", "-c", "sleep 1791 & sleep 1792"},
+		TimeoutNs: int64(time.Second),
+	}, true)
+	if dt := time.Now().Sub(start); dt > 10*time.Second {
+		t.Errorf("timed out job took %v", dt)
+	}
+	if !rep.TimedOut || rep.Exit == 0 {
+		t.Errorf("got timed out %v, exit %v; want a timeout", rep.TimedOut, rep.Exit)
+	}
+	if rep.Failure == nil || !strings.Contains(rep.Failure.Error, "timed out") {
+		t.Errorf("got failure %v, want a timeout", rep.Failure)
+	}
+	if pids := processesWithArgs("sleep", "1791"); len(pids) > 0 {
+		t.Errorf("processes %v survived the timeout", pids)
+	}
+	if pids := processesWithArgs("sleep", "1792"); len(pids) > 0 {
+		t.Errorf("processes %v survived the timeout", pids)
+	}
+
+	// The file system of the job is unmounted, not reused.
+	for _, w := range tc.workers {
+		status := WorkerStatusResponse{}
+		w.Status(&WorkerStatusRequest{}, &status)
+		for _, m := range status.MirrorStatus {
+			if len(m.Fses) > 0 {
+				t.Errorf("mirror still has file systems %v", m.Fses)
+			}
+		}
+	}
+	tmps, _ := filepath.Glob(tc.tmp + "/worker-tmp/termite-task*")
+	if len(tmps) > 0 {
+		t.Errorf("task directories %v not removed", tmps)
+	}
+}
+
+func TestEndToEndCPULimit(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	tc.workers[0].options.MaxJobCPUTime = time.Second
+	rep := tc.Run(WorkRequest{
+		Argv: []string{"sh", "-c", "while : ; do : ; done"},
+	}, true)
+	if rep.ResourceExceeded != ResourceCPU || rep.Exit == 0 {
+		t.Errorf("got exceeded %q, exit %v; want the CPU limit", rep.ResourceExceeded, rep.Exit)
+	}
+	if rep.Failure == nil || !strings.Contains(rep.Failure.Error, "cpu limit") {
+		t.Errorf("got failure %v", rep.Failure)
+	}
+
+	status := WorkerStatusResponse{}
+	tc.workers[0].Status(&WorkerStatusRequest{}, &status)
+	if status.ResourceKills != 1 {
+		t.Errorf("got %d resource kills, want 1", status.ResourceKills)
+	}
+}
+
+func TestEndToEndPrefetch(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	content := "prefetched content"
+	ioutil.WriteFile(tc.wd+"/input.txt", []byte(content), 0644)
+	rep := tc.RunSuccess(WorkRequest{
+		Argv: []string{"cat", tc.wd + "/input.txt"},
+	})
+	if rep.Stdout != content {
+		t.Errorf("got %q, want %q", rep.Stdout, content)
+	}
+
+	tc.master.prefetchMutex.Lock()
+	sent := tc.master.prefetchSent
+	tc.master.prefetchMutex.Unlock()
+	if sent != 1 {
+		t.Errorf("got %d prefetched files, want 1", sent)
+	}
+}
+
+func TestEndToEndQueuedTiming(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	// The master has a single job slot, so one of these has to
+	// wait for the other.
+	reps := make(chan WorkResponse, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			reps <- tc.RunSuccess(WorkRequest{
+				Argv: []string{"sleep", "1"},
+			})
+		}()
+	}
+
+	var maxQueued time.Duration
+	for i := 0; i < 2; i++ {
+		rep := <-reps
+		if exec := rep.Timing("exec"); exec < 900*time.Millisecond {
+			t.Errorf("exec time %v, want at least 1s: %v", exec, rep.Timings)
+		}
+		if q := rep.Timing("queued"); q > maxQueued {
+			maxQueued = q
+		}
+	}
+	if maxQueued < 500*time.Millisecond {
+		t.Errorf("got maximum queued time %v, want at least 0.5s", maxQueued)
+	}
+}
+
+func TestEndToEndDedupEnv(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+	tc.master.options.DedupEnv = true
+
+	env := os.Environ()
+	for i := 0; i < 100; i++ {
+		env = append(env, fmt.Sprintf("FILLER%d=%s", i, strings.Repeat("x", 100)))
+	}
+	for i, v := range []string{"first", "second", "third"} {
+		e := env
+		if i == 2 {
+			e = append(append([]string{}, env...), "OTHER=1")
+		}
+		rep := tc.RunSuccess(WorkRequest{
+			Argv: []string{"sh", "-c", "echo $FILLER7 $OTHER"},
+			Env:  e,
+		})
+		want := strings.Repeat("x", 100)
+		if i == 2 {
+			want += " 1"
+		}
+		if rep.Stdout != want+"\n" {
+			t.Errorf("job %s: got stdout %q, want %q", v, rep.Stdout, want+"\n")
+		}
+	}
+
+	tc.master.mirrors.Lock()
+	defer tc.master.mirrors.Unlock()
+	for _, mc := range tc.master.mirrors.mirrors {
+		mc.envMutex.Lock()
+		sent := mc.envsSent
+		mc.envMutex.Unlock()
+		if sent != 2 {
+			t.Errorf("sent %d environments to %s, want 2", sent, mc.workerAddr)
+		}
+	}
+}
+
+// processesWithArgs returns the pids of processes with the given
+// command line.
+func processesWithArgs(args ...string) []int {
+	want := strings.Join(args, "\x00") + "\x00"
+	var pids []int
+	for _, p := range listProcesses() {
+		cmdline, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", p.pid))
+		if string(cmdline) == want {
+			pids = append(pids, p.pid)
+		}
+	}
+	return pids
+}
+
+func TestEndToEndKillLeftovers(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	start := time.Now()
+	rep := tc.RunSuccess(WorkRequest{
+		Argv: []string{"sh", "-c", "sleep 1789 & echo started"},
+	})
+	if rep.Stdout != "started\n" {
+		t.Errorf("got stdout %q", rep.Stdout)
+	}
+	if dt := time.Now().Sub(start); dt > 10*time.Second {
+		t.Errorf("job took %v; waited for the background process?", dt)
+	}
+	if pids := processesWithArgs("sleep", "1789"); len(pids) > 0 {
+		t.Errorf("leftover processes %v still running", pids)
+	}
+}
+
+func TestEndToEndAllowBackground(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	tc.RunSuccess(WorkRequest{
+		Argv:            []string{"sh", "-c", "sleep 1790 > /dev/null 2>&1 &"},
+		AllowBackground: []string{"sleep"},
+	})
+	pids := processesWithArgs("sleep", "1790")
+	if len(pids) != 1 {
+		t.Fatalf("got background processes %v, want one", pids)
+	}
+	defer syscall.Kill(pids[0], syscall.SIGKILL)
+
+	found := false
+	for _, w := range tc.workers {
+		rep := WorkerStatusResponse{}
+		w.Status(&WorkerStatusRequest{}, &rep)
+		for _, m := range rep.MirrorStatus {
+			for _, b := range m.Background {
+				found = found || (b.Pid == pids[0] && b.Name == "sleep")
+			}
+		}
+	}
+	if !found {
+		t.Errorf("background process %d not in mirror status", pids[0])
+	}
+
+	// When the master is idle, it drops the mirror, which kills
+	// the background process.
+	time.Sleep(2 * time.Second)
+	if left := processesWithArgs("sleep", "1790"); len(left) > 0 {
+		t.Errorf("background processes %v survived the mirror", left)
+	}
+}
+
+func TestEndToEndPrivateTmp(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+	tc.workers[0].options.Jobs = 2
+	tc.master.mirrors.wantedMaxJobs = 2
+
+	// Relative, so it also works when the worker does not chroot.
+	tmp := strings.Repeat("../", strings.Count(tc.wd, "/")) + "tmp"
+	reps := make(chan WorkResponse, 2)
+	for _, content := range []string{"first", "second"} {
+		script := fmt.Sprintf("echo %s > %s/shared.txt && sleep 1 && test $(cat %s/shared.txt) = %s",
+			content, tmp, tmp, content)
+		req := WorkRequest{
+			Argv:       []string{"sh", "-c", script},
+			PrivateTmp: true,
+		}
+		go func() {
+			reps <- tc.RunSuccess(req)
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		<-reps
+	}
+	if fi, _ := os.Lstat("/tmp/shared.txt"); fi != nil {
+		t.Errorf("job wrote to the host /tmp")
+	}
+}
+
+func TestEndToEndIncrementalHarvest(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+	tc.master.options.HarvestPeriod = 100 * time.Millisecond
+
+	done := make(chan WorkResponse, 1)
+	go func() {
+		done <- tc.RunSuccess(WorkRequest{
+			Argv: []string{"sh", "-c", "echo early > a.txt && sleep 2 && echo late > b.txt"},
+		})
+	}()
+
+	deadline := time.Now().Add(1500 * time.Millisecond)
+	for {
+		if c, _ := ioutil.ReadFile(tc.wd + "/a.txt"); string(c) == "early\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("a.txt did not appear before the job finished")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if fi, _ := os.Lstat(tc.wd + "/b.txt"); fi != nil {
+		t.Errorf("b.txt appeared early")
+	}
+
+	<-done
+	if c, _ := ioutil.ReadFile(tc.wd + "/b.txt"); string(c) != "late\n" {
+		t.Errorf("b.txt: got %q", c)
+	}
+	if c, _ := ioutil.ReadFile(tc.wd + "/a.txt"); string(c) != "early\n" {
+		t.Errorf("a.txt: got %q", c)
+	}
+}
+
+func TestEndToEndSyncedBinary(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+	tc.master.options.VerifyBinaries = true
+
+	os.Mkdir(tc.wd+"/toolchain", 0755)
+	ioutil.WriteFile(tc.wd+"/toolchain/tool", []byte("#!/bin/sh\necho synced $1\n"), 0755)
+	os.Symlink("toolchain/tool", tc.wd+"/cc")
+	rep := tc.RunSuccess(WorkRequest{
+		Binary: tc.wd + "/cc",
+		Argv:   []string{"cc", "input"},
+	})
+	if rep.Stdout != "synced input\n" {
+		t.Errorf("got stdout %q, want %q", rep.Stdout, "synced input\n")
+	}
+}
+
+func TestEndToEndSessionReport(t *testing.T) {
+	tc := NewTestCase(t)
+	defer tc.Clean()
+
+	ioutil.WriteFile(tc.wd+"/input.txt", []byte("hello"), 0644)
+	tc.master.ResetSession()
+	for i := 0; i < 3; i++ {
+		tc.RunSuccess(WorkRequest{
+			Argv: []string{"cat", tc.wd + "/input.txt"},
+		})
+	}
+	tc.RunSuccess(WorkRequest{
+		Argv: []string{"mkdir", "-p", tc.wd + "/dir"},
+	})
+
+	r := tc.master.SessionReport()
+	if r.Jobs != 4 || r.JobsInMaster != 1 || r.Failed != 0 {
+		t.Errorf("got %d jobs, %d in master, %d failed; want 4, 1, 0", r.Jobs, r.JobsInMaster, r.Failed)
+	}
+	workerJobs := 0
+	for _, w := range r.Workers {
+		workerJobs += w.Jobs
+		if w.Busy <= 0 || w.Slots <= 0 || w.Utilization <= 0 || w.Utilization > 1 {
+			t.Errorf("bad worker report %+v", w)
+		}
+	}
+	if workerJobs != 3 {
+		t.Errorf("workers ran %d jobs, want 3", workerJobs)
+	}
+	if r.AttrHits+r.AttrFetches == 0 || r.AttrHitRate != hitRate(r.AttrHits, r.AttrFetches) {
+		t.Errorf("attribute stats: %+v", r)
+	}
+	// The first job pushes the input; the others find it on the
+	// worker.
+	if r.ContentMisses == 0 || r.ContentHits == 0 || r.ContentHitRate <= 0 || r.ContentHitRate >= 1 {
+		t.Errorf("content stats: %+v", r)
+	}
+	if r.BytesSent < int64(len("hello")) {
+		t.Errorf("got %d bytes sent, want at least %d", r.BytesSent, len("hello"))
+	}
+	if r.WallTime <= 0 {
+		t.Errorf("got wall time %v", r.WallTime)
+	}
+
+	tc.master.ResetSession()
+	if r := tc.master.SessionReport(); r.Jobs != 0 || len(r.Workers) != 0 || r.BytesSent != 0 {
+		t.Errorf("after reset: %+v", r)
+	}
+}
+
+// newSchedTestCase starts a test case with two workers, and a sweep
+// scheduler installed before any mirror exists.
+func newSchedTestCase(t *testing.T, jobs int) (*testCase, *sweepSched) {
+	tc := NewTestCase(t)
+	sched := &sweepSched{}
+	tc.master.sched = sched
+	tc.workers[0].options.Jobs = jobs
+	tc.workerOpts.Jobs = jobs
+	tc.StartWorker()
+	for i := 0; tc.coordinator.WorkerCount() < 2 && i < 20; i++ {
+		time.Sleep(50e6)
+	}
+	tc.master.mirrors.wantedMaxJobs = jobs
+	return tc, sched
+}
+
+func TestEndToEndSchedWriteThenRead(t *testing.T) {
+	tc, sched := newSchedTestCase(t, 1)
+	defer tc.Clean()
+
+	schedSweep(t, sched, func(seed int64) {
+		name := fmt.Sprintf("seed-%d.txt", seed)
+		want := fmt.Sprintf("%d", seed)
+		tc.RunSuccess(WorkRequest{
+			Argv: []string{"sh", "-c", fmt.Sprintf("echo %s > %s", want, name)},
+		})
+		rep := tc.RunSuccess(WorkRequest{
+			Argv: []string{"cat", name},
+		})
+		if got := strings.TrimSpace(rep.Stdout); got != want {
+			t.Errorf("read %q from %s on %s, want %q", got, name, rep.WorkerId, want)
+		}
+	})
+}
+
+func TestEndToEndSchedConcurrentCompletion(t *testing.T) {
+	tc, sched := newSchedTestCase(t, 3)
+	defer tc.Clean()
+
+	schedSweep(t, sched, func(seed int64) {
+		var names []string
+		reps := make(chan WorkResponse, 3)
+		for i := 0; i < 3; i++ {
+			name := fmt.Sprintf("seed-%d-%d.txt", seed, i)
+			names = append(names, name)
+			req := WorkRequest{
+				Argv: []string{"sh", "-c", fmt.Sprintf("echo %d > %s", i, name)},
+			}
+			go func() {
+				reps <- tc.Run(req, false)
+			}()
+		}
+		for i := 0; i < 3; i++ {
+			select {
+			case rep := <-reps:
+				if rep.Exit.ExitStatus() != 0 {
+					t.Errorf("job failed: %v", rep)
+				}
+			case <-time.After(20 * time.Second):
+				t.Errorf("jobs completing together did not all return")
+				return
+			}
+		}
+		rep := tc.RunSuccess(WorkRequest{
+			Argv: append([]string{"cat"}, names...),
+		})
+		if got := strings.Fields(rep.Stdout); strings.Join(got, " ") != "0 1 2" {
+			t.Errorf("read %q after concurrent jobs, want 0 1 2", rep.Stdout)
+		}
+		for i, n := range names {
+			content, err := ioutil.ReadFile(filepath.Join(tc.wd, n))
+			if err != nil || strings.TrimSpace(string(content)) != fmt.Sprintf("%d", i) {
+				t.Errorf("master has %s = %q, %v", n, content, err)
+			}
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package termite
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
@@ -32,6 +33,25 @@ func serveLog(worker *Worker, w http.ResponseWriter, req *http.Request) {
 	w.Write(logRep.Data)
 }
 
+func serveContentStats(worker *Worker, w http.ResponseWriter, req *http.Request) {
+	status := WorkerStatusResponse{}
+	worker.mirrors.Status(&WorkerStatusRequest{}, &status)
+
+	rep := ContentStatsResponse{Store: worker.content.Stats()}
+	for _, m := range status.MirrorStatus {
+		rep.Mirrors = append(rep.Mirrors, MirrorContentStats{
+			Root:   m.Root,
+			Hits:   m.ContentHits,
+			Misses: m.ContentMisses,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&rep); err != nil {
+		log.Println("content.json:", err)
+	}
+}
+
 func serveStatus(worker *Worker, w http.ResponseWriter, r *http.Request) {
 	statusReq := WorkerStatusRequest{}
 	status := WorkerStatusResponse{}
@@ -46,6 +66,7 @@ func serveStatus(worker *Worker, w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "<p>Worker %s (<a href=\"http://%s:%d\">status</a>)<p>Version %s<p>Jobs %d\n",
 		addr, cname, worker.httpStatusPort, status.Version, status.MaxJobCount)
 	fmt.Fprintf(w, "<p><a href=\"/log?host=%s\">Worker log %s</a>\n", addr, addr)
+	fmt.Fprintf(w, "<p><a href=\"/content.json?host=%s\">Content statistics</a>\n", addr)
 
 	if !status.Accepting {
 		fmt.Fprintf(w, "<b>shutting down</b>")
@@ -58,6 +79,20 @@ func serveStatus(worker *Worker, w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "<p>HeapIdle: %v, HeapInUse: %v",
 		m.HeapIdle, m.HeapInuse)
 
+	c := status.ContentStats
+	fmt.Fprintf(w, "<p>Content store: %d objects, %v; %d expiring; %d fetches in flight; received %v, served %v",
+		c.Count, c.Bytes, c.Expiring, c.FetchesInFlight, c.BytesReceived, c.BytesServed)
+	fmt.Fprintf(w, "<p>Lookups: %d, hit rate %.0f%%; %d fetches, %d chunks served, %d corrupt objects removed",
+		c.Lookups, 100*c.HitRate(), c.Fetches, c.ChunksServed, c.Corrupt)
+	fmt.Fprintf(w, "<p>Free space: %d MB for content, %d MB for temporary files",
+		status.DiskAvailable>>20, status.TempDiskAvailable>>20)
+	if mt := status.Maintenance; mt.Operation != "" {
+		fmt.Fprintf(w, "<p>Maintenance: %s, %s (%d of %d objects)",
+			mt.State, mt.Operation, mt.Done, mt.Total)
+	} else {
+		fmt.Fprintf(w, "<p>Maintenance: %s", mt.State)
+	}
+
 	stats.CountStatsWriteHttp(w, status.PhaseNames, status.PhaseCounts)
 
 	for _, mirrorStatus := range status.MirrorStatus {
@@ -78,9 +113,24 @@ func mirrorStatusHtml(w http.ResponseWriter, s MirrorStatusResponse) {
 
 	fmt.Fprintf(w, "<p>%d maximum jobs, %d running, %d waiting tasks, %d unused filesystems.\n",
 		s.Granted, running, s.WaitingTasks, s.IdleFses)
+	if total := s.ContentHits + s.ContentMisses; total > 0 {
+		fmt.Fprintf(w, "<p>Content: %d of %d opens served from the store (%d%%)\n",
+			s.ContentHits, total, 100*s.ContentHits/total)
+	}
+	fmt.Fprintf(w, "<p>Attributes: %d fetched from the master, %d lookups of files and %d of missing files answered locally\n",
+		s.AttrStats.Fetches, s.AttrStats.Hits, s.AttrStats.NegativeHits)
+	fmt.Fprintf(w, "<p>Reverse connection: %s, re-established %d times\n",
+		s.Reverse, s.ReverseReconnects)
 	if !s.Accepting {
 		fmt.Fprintf(w, "<p><b>shutting down</b>\n")
 	}
+	if len(s.Background) > 0 {
+		fmt.Fprintf(w, "<p>Background processes:<ul>\n")
+		for _, p := range s.Background {
+			fmt.Fprintf(w, "<li>%s (pid %d), from task %d\n", p.Name, p.Pid, p.TaskId)
+		}
+		fmt.Fprintf(w, "</ul>\n")
+	}
 
 	fmt.Fprintf(w, "<ul>\n")
 	for _, v := range s.Fses {
@@ -121,13 +171,19 @@ func (w *Worker) serveStatus(port, delta int) {
 	mux.HandleFunc("/log", func(wr http.ResponseWriter, r *http.Request) {
 		serveLog(w, wr, r)
 	})
+	mux.HandleFunc("/content.json", func(wr http.ResponseWriter, r *http.Request) {
+		serveContentStats(w, wr, r)
+	})
+	mux.HandleFunc("/metrics", func(wr http.ResponseWriter, r *http.Request) {
+		serveMetrics(w, wr, r)
+	})
 
 	mux.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
 	mux.Handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
 	mux.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
 	mux.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
 
-	err = http.Serve(l, mux)
+	err = serveHTTP(l, mux, w.tlsConfig)
 	if err != nil {
 		log.Println("status serve:", err)
 		return
@@ -0,0 +1,390 @@
+package termite
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/raw"
+	"github.com/hanwen/termite/attr"
+)
+
+// Jobs may write files below the scratch root of the master, even
+// though it lies outside the writable root.  The writes are buffered
+// in backing files on the worker.  When a writer closes, the content
+// is hashed into the worker's store, and when the file system is
+// reaped, the files are returned with the job's FileSet.  Everything
+// else in the RpcFs stays read-only.
+type writeBackFs struct {
+	*RpcFs
+
+	// Without leading /.
+	root string
+
+	// Directory for the backing files.
+	dir string
+
+	mutex    sync.Mutex
+	files    map[string]*writeBackEntry
+	nextFree int
+}
+
+type writeBackEntry struct {
+	backing  string
+	mode     uint32
+	uid, gid uint32
+
+	// Number of files open for writing, and how often the file
+	// was opened for writing.
+	writers int
+	gen     int
+
+	// Hash of the content, set when the last writer closes.
+	hash string
+}
+
+func newWriteBackFs(rpcFs *RpcFs, root, dir string) *writeBackFs {
+	return &writeBackFs{
+		RpcFs: rpcFs,
+		root:  strings.Trim(root, "/"),
+		dir:   dir,
+		files: map[string]*writeBackEntry{},
+	}
+}
+
+func (me *writeBackFs) String() string {
+	return fmt.Sprintf("writeBackFs(%s)", me.root)
+}
+
+// inScratch returns true if name is below the scratch root.
+func (me *writeBackFs) inScratch(name string) bool {
+	return strings.HasPrefix(name, me.root+"/")
+}
+
+func (me *writeBackFs) entry(name string) *writeBackEntry {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	return me.files[name]
+}
+
+// newEntry starts a buffered file for name.  Must hold mutex.
+func (me *writeBackFs) newEntry(name string, mode uint32, context *fuse.Context) *writeBackEntry {
+	e := me.allocEntry(mode)
+	if context != nil {
+		e.uid, e.gid = context.Uid, context.Gid
+	}
+	me.files[name] = e
+	return e
+}
+
+// allocEntry returns a buffered file with a fresh backing file name.
+// Must hold mutex.
+func (me *writeBackFs) allocEntry(mode uint32) *writeBackEntry {
+	e := &writeBackEntry{
+		backing: fmt.Sprintf("%s/%d", me.dir, me.nextFree),
+		mode:    mode & 07777,
+	}
+	me.nextFree++
+	return e
+}
+
+// prepareEntry returns a buffered file with the content of the RpcFs
+// file name, unless flags truncate it.  The content is fetched
+// without holding mutex, and the entry is not registered yet.
+func (me *writeBackFs) prepareEntry(name string, flags uint32) (*writeBackEntry, fuse.Status) {
+	a := me.RpcFs.attr.Get(name)
+	if a == nil || a.Deletion() {
+		return nil, fuse.ENOENT
+	}
+	if !a.IsRegular() {
+		return nil, fuse.EPERM
+	}
+	me.mutex.Lock()
+	e := me.allocEntry(a.Mode)
+	me.mutex.Unlock()
+	e.uid, e.gid = a.Uid, a.Gid
+	if flags&uint32(os.O_TRUNC) == 0 {
+		if err := me.copyFrom(a, e.backing); err != nil {
+			log.Printf("copy of %s for writing: %v", name, err)
+			os.Remove(e.backing)
+			return nil, fuse.EIO
+		}
+	}
+	return e, fuse.OK
+}
+
+// attr returns the attributes of the buffered file.  Must hold mutex.
+func (me *writeBackEntry) attr() *fuse.Attr {
+	fi, err := os.Lstat(me.backing)
+	if err != nil {
+		return nil
+	}
+	a := fuse.ToAttr(fi)
+	a.Mode = fuse.S_IFREG | me.mode
+	a.Uid = me.uid
+	a.Gid = me.gid
+	return a
+}
+
+// copyFrom fills the backing file with the content of the RpcFs file.
+func (me *writeBackFs) copyFrom(a *attr.FileAttr, backing string) error {
+	if err := me.FetchHash(a); err != nil {
+		return err
+	}
+	in, err := os.Open(me.cache.Path(a.Hash))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(backing)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (me *writeBackFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	me.mutex.Lock()
+	if e := me.files[name]; e != nil {
+		a := e.attr()
+		me.mutex.Unlock()
+		if a == nil {
+			return nil, fuse.EIO
+		}
+		return a, fuse.OK
+	}
+	me.mutex.Unlock()
+	return me.RpcFs.GetAttr(name, context)
+}
+
+func (me *writeBackFs) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	stream, code := me.RpcFs.OpenDir(name, context)
+	if !code.Ok() || !(name == me.root || me.inScratch(name)) {
+		return stream, code
+	}
+
+	seen := map[string]bool{}
+	for _, e := range stream {
+		seen[e.Name] = true
+	}
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	for n, e := range me.files {
+		if dir, base := SplitPath(n); dir == name && !seen[base] {
+			stream = append(stream, fuse.DirEntry{Name: base, Mode: fuse.S_IFREG | e.mode})
+		}
+	}
+	return stream, fuse.OK
+}
+
+func (me *writeBackFs) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	if mode&raw.W_OK == 0 || !me.inScratch(name) {
+		return me.RpcFs.Access(name, mode, context)
+	}
+	_, code := me.GetAttr(name, context)
+	return code
+}
+
+func (me *writeBackFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if !me.inScratch(name) {
+		return me.RpcFs.Create(name, flags, mode, context)
+	}
+	dir, _ := SplitPath(name)
+	if a, code := me.RpcFs.GetAttr(dir, context); !code.Ok() {
+		return nil, code
+	} else if !a.IsDir() {
+		return nil, fuse.ENOTDIR
+	}
+
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	e := me.newEntry(name, mode, context)
+	f, err := os.OpenFile(e.backing, int(flags)|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		delete(me.files, name)
+		return nil, fuse.ToStatus(err)
+	}
+	return me.newFile(e, f, true), fuse.OK
+}
+
+func (me *writeBackFs) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if !me.inScratch(name) {
+		return me.RpcFs.Open(name, flags, context)
+	}
+	write := flags&fuse.O_ANYWRITE != 0
+	var fresh *writeBackEntry
+	if me.entry(name) == nil {
+		if !write {
+			return me.RpcFs.Open(name, flags, context)
+		}
+		var code fuse.Status
+		if fresh, code = me.prepareEntry(name, flags); !code.Ok() {
+			return nil, code
+		}
+	}
+
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	e := me.files[name]
+	switch {
+	case e == nil && fresh != nil:
+		e = fresh
+		me.files[name] = e
+	case fresh != nil:
+		// Another open came first.
+		os.Remove(fresh.backing)
+	case e == nil:
+		// Reaped in the meantime.
+		return me.RpcFs.Open(name, flags, context)
+	}
+
+	f, err := os.OpenFile(e.backing, int(flags)|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return me.newFile(e, f, write), fuse.OK
+}
+
+func (me *writeBackFs) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	e := me.entry(name)
+	if e == nil {
+		return me.RpcFs.Truncate(name, size, context)
+	}
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	e.gen++
+	e.hash = ""
+	return fuse.ToStatus(os.Truncate(e.backing, int64(size)))
+}
+
+func (me *writeBackFs) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	e := me.entry(name)
+	if e == nil {
+		return me.RpcFs.Chmod(name, mode, context)
+	}
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	e.mode = mode & 07777
+	return fuse.OK
+}
+
+func (me *writeBackFs) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	e := me.entry(name)
+	if e == nil {
+		return me.RpcFs.Utimens(name, atime, mtime, context)
+	}
+	now := time.Now()
+	if atime == nil {
+		atime = &now
+	}
+	if mtime == nil {
+		mtime = &now
+	}
+	return fuse.ToStatus(os.Chtimes(e.backing, *atime, *mtime))
+}
+
+// newFile wraps the backing file.  Must hold mutex.
+func (me *writeBackFs) newFile(e *writeBackEntry, f *os.File, write bool) nodefs.File {
+	if write {
+		e.writers++
+		e.gen++
+		e.hash = ""
+	}
+	return &writeBackFile{
+		File:  nodefs.NewLoopbackFile(f),
+		fs:    me,
+		entry: e,
+		write: write,
+	}
+}
+
+// closeWrite hashes the content once the last writer is gone.
+func (me *writeBackFs) closeWrite(e *writeBackEntry) {
+	me.mutex.Lock()
+	e.writers--
+	if e.writers > 0 {
+		me.mutex.Unlock()
+		return
+	}
+	gen := e.gen
+	me.mutex.Unlock()
+
+	h := me.cache.SavePath(e.backing)
+
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+	if e.gen == gen {
+		e.hash = h
+	}
+}
+
+// reap returns the buffered files, and forgets them.
+func (me *writeBackFs) reap() []*attr.FileAttr {
+	me.mutex.Lock()
+	defer me.mutex.Unlock()
+
+	result := make([]*attr.FileAttr, 0, len(me.files))
+	for name, e := range me.files {
+		a := &attr.FileAttr{
+			Path: name,
+			Attr: e.attr(),
+			Hash: e.hash,
+		}
+		if a.Hash == "" {
+			// Still open, eg. by a background process.
+			a.Hash = me.cache.SavePath(e.backing)
+		}
+		os.Remove(e.backing)
+		if a.Attr == nil || a.Hash == "" {
+			log.Printf("dropping scratch file %s: cannot read %s", name, e.backing)
+			continue
+		}
+		result = append(result, a)
+	}
+	me.files = map[string]*writeBackEntry{}
+	return result
+}
+
+type writeBackFile struct {
+	nodefs.File
+	fs    *writeBackFs
+	entry *writeBackEntry
+	write bool
+}
+
+func (me *writeBackFile) String() string {
+	return fmt.Sprintf("writeBackFile(%s)", me.File.String())
+}
+
+func (me *writeBackFile) InnerFile() nodefs.File {
+	return me.File
+}
+
+func (me *writeBackFile) GetAttr(a *fuse.Attr) fuse.Status {
+	me.fs.mutex.Lock()
+	defer me.fs.mutex.Unlock()
+	attr := me.entry.attr()
+	if attr == nil {
+		return fuse.EIO
+	}
+	*a = *attr
+	return fuse.OK
+}
+
+func (me *writeBackFile) Release() {
+	// Release first, so the content is on disk when we hash it.
+	me.File.Release()
+	if me.write {
+		me.fs.closeWrite(me.entry)
+	}
+}